@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	ACMEDefaultDirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+	ACMERenewBefore         = 30 * 24 * time.Hour
+	ACMERetryDelay          = 1 * time.Hour
+	ACMEPollTimeout         = 2 * time.Minute
+	acmeTLSALPNProto        = "acme-tls/1"
+	acmeMaxResponseSize     = 1 << 20
+)
+
+// id-pe-acmeIdentifier, RFC 8737
+var acmeIdentifierOID = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// ACMEClient obtains and renews the certificate of the local DoH server from an ACME (RFC 8555)
+// certificate authority such as Let's Encrypt. Domains are validated using the tls-alpn-01 challenge
+// (RFC 8737), answered by the local DoH server itself, that has to be reachable on port 443.
+type ACMEClient struct {
+	sync.RWMutex
+	xTransport   *XTransport
+	directoryURL string
+	email        string
+	domains      []string
+	cacheDir     string
+	accountKey   *ecdsa.PrivateKey
+	accountURL   string
+	directory    acmeDirectory
+	nonce        string
+	certificate  *tls.Certificate
+	challenges   map[string]*tls.Certificate
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type  string `json:"type"`
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	} `json:"challenges"`
+}
+
+func NewACMEClient(xTransport *XTransport, config *LocalDoHConfig) (*ACMEClient, error) {
+	if len(config.ACMEDomains) == 0 {
+		return nil, nil
+	}
+	if len(config.CertFile) > 0 || len(config.CertKeyFile) > 0 {
+		return nil, errors.New("local DoH: `acme_domains` cannot be used along with `cert_file` and `cert_key_file`")
+	}
+	directoryURL := config.ACMEDirectoryURL
+	if len(directoryURL) == 0 {
+		directoryURL = ACMEDefaultDirectoryURL
+	}
+	if _, err := url.Parse(directoryURL); err != nil {
+		return nil, fmt.Errorf("local DoH: invalid ACME directory URL: [%v]", err)
+	}
+	domains := make([]string, len(config.ACMEDomains))
+	for i, domain := range config.ACMEDomains {
+		domains[i] = strings.TrimSuffix(strings.ToLower(domain), ".")
+	}
+	return &ACMEClient{
+		xTransport:   xTransport,
+		directoryURL: directoryURL,
+		email:        config.ACMEEmail,
+		domains:      domains,
+		cacheDir:     config.ACMECacheDir,
+		challenges:   make(map[string]*tls.Certificate),
+	}, nil
+}
+
+// Start loads the cached certificate, and keeps it up to date in the background
+func (acme *ACMEClient) Start() error {
+	if err := os.MkdirAll(acme.cacheDir, 0o700); err != nil {
+		return err
+	}
+	if err := acme.loadAccountKey(); err != nil {
+		return err
+	}
+	if certificate, err := tls.LoadX509KeyPair(acme.certFile(), acme.keyFile()); err == nil {
+		acme.Lock()
+		acme.certificate = &certificate
+		acme.Unlock()
+	}
+	go func() {
+		for {
+			delay := ACMERetryDelay
+			if renewAt, ok := acme.renewAt(); ok && time.Now().Before(renewAt) {
+				delay = time.Until(renewAt)
+			} else if err := acme.obtainCertificate(); err != nil {
+				dlog.Errorf("Unable to obtain a certificate for the local DoH server: [%v]", err)
+			} else {
+				continue
+			}
+			time.Sleep(delay)
+		}
+	}()
+	return nil
+}
+
+func (acme *ACMEClient) certFile() string {
+	return filepath.Join(acme.cacheDir, "cert.pem")
+}
+
+func (acme *ACMEClient) keyFile() string {
+	return filepath.Join(acme.cacheDir, "key.pem")
+}
+
+// renewAt returns the time the current certificate has to be renewed at
+func (acme *ACMEClient) renewAt() (time.Time, bool) {
+	acme.RLock()
+	defer acme.RUnlock()
+	if acme.certificate == nil || len(acme.certificate.Certificate) == 0 {
+		return time.Time{}, false
+	}
+	leaf, err := x509.ParseCertificate(acme.certificate.Certificate[0])
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, domain := range acme.domains {
+		if leaf.VerifyHostname(domain) != nil {
+			return time.Time{}, false
+		}
+	}
+	return leaf.NotAfter.Add(-ACMERenewBefore), true
+}
+
+// GetCertificate returns the certificate for a TLS handshake, or the response to a tls-alpn-01 challenge
+func (acme *ACMEClient) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	acme.RLock()
+	defer acme.RUnlock()
+	if len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmeTLSALPNProto {
+		if challenge := acme.challenges[strings.ToLower(hello.ServerName)]; challenge != nil {
+			return challenge, nil
+		}
+		return nil, fmt.Errorf("No pending ACME challenge for [%s]", hello.ServerName)
+	}
+	if acme.certificate == nil {
+		return nil, errors.New("The certificate of the local DoH server hasn't been obtained yet")
+	}
+	return acme.certificate, nil
+}
+
+func (acme *ACMEClient) loadAccountKey() error {
+	keyFile := filepath.Join(acme.cacheDir, "account.key")
+	if bin, err := os.ReadFile(keyFile); err == nil {
+		block, _ := pem.Decode(bin)
+		if block == nil {
+			return fmt.Errorf("Invalid ACME account key in [%s]", keyFile)
+		}
+		accountKey, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		acme.accountKey = accountKey
+		return nil
+	}
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), crypto_rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalECPrivateKey(accountKey)
+	if err != nil {
+		return err
+	}
+	if err := safefile.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return err
+	}
+	acme.accountKey = accountKey
+	return nil
+}
+
+func (acme *ACMEClient) jwk() map[string]string {
+	byteLen := (acme.accountKey.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"crv": "P-256",
+		"kty": "EC",
+		"x":   base64.RawURLEncoding.EncodeToString(acme.accountKey.X.FillBytes(make([]byte, byteLen))),
+		"y":   base64.RawURLEncoding.EncodeToString(acme.accountKey.Y.FillBytes(make([]byte, byteLen))),
+	}
+}
+
+// thumbprint returns the JWK thumbprint of the account key (RFC 7638)
+func (acme *ACMEClient) thumbprint() string {
+	jwk := acme.jwk()
+	canonical := fmt.Sprintf(`{"crv":"%s","kty":"%s","x":"%s","y":"%s"}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])
+	h := sha256.Sum256([]byte(canonical))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+func (acme *ACMEClient) httpDo(method string, rawURL string, contentType string, body []byte) (*http.Response, []byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := acme.xTransport.resolveAndUpdateCache(u.Hostname()); err != nil {
+		return nil, nil, err
+	}
+	client := http.Client{Transport: acme.xTransport.transport, Timeout: acme.xTransport.timeout}
+	req, err := http.NewRequest(method, rawURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", "dnscrypt-proxy")
+	if len(contentType) > 0 {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if nonce := resp.Header.Get("Replay-Nonce"); len(nonce) > 0 {
+		acme.nonce = nonce
+	}
+	bin, err := io.ReadAll(io.LimitReader(resp.Body, acmeMaxResponseSize))
+	return resp, bin, err
+}
+
+func (acme *ACMEClient) newNonce() (string, error) {
+	if nonce := acme.nonce; len(nonce) > 0 {
+		acme.nonce = ""
+		return nonce, nil
+	}
+	if _, _, err := acme.httpDo("HEAD", acme.directory.NewNonce, "", nil); err != nil {
+		return "", err
+	}
+	if len(acme.nonce) == 0 {
+		return "", errors.New("The ACME server didn't return a nonce")
+	}
+	nonce := acme.nonce
+	acme.nonce = ""
+	return nonce, nil
+}
+
+// post sends a JWS-signed request; a nil payload sends a POST-as-GET request
+func (acme *ACMEClient) post(rawURL string, payload interface{}) (*http.Response, []byte, error) {
+	payloadB64 := ""
+	if payload != nil {
+		bin, err := json.Marshal(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		payloadB64 = base64.RawURLEncoding.EncodeToString(bin)
+	}
+	for tries := 2; ; tries-- {
+		nonce, err := acme.newNonce()
+		if err != nil {
+			return nil, nil, err
+		}
+		protected := map[string]interface{}{"alg": "ES256", "nonce": nonce, "url": rawURL}
+		if len(acme.accountURL) > 0 {
+			protected["kid"] = acme.accountURL
+		} else {
+			protected["jwk"] = acme.jwk()
+		}
+		protectedBin, err := json.Marshal(protected)
+		if err != nil {
+			return nil, nil, err
+		}
+		protectedB64 := base64.RawURLEncoding.EncodeToString(protectedBin)
+		h := sha256.Sum256([]byte(protectedB64 + "." + payloadB64))
+		r, s, err := ecdsa.Sign(crypto_rand.Reader, acme.accountKey, h[:])
+		if err != nil {
+			return nil, nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		jws, err := json.Marshal(map[string]string{
+			"protected": protectedB64,
+			"payload":   payloadB64,
+			"signature": base64.RawURLEncoding.EncodeToString(signature),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, body, err := acme.httpDo("POST", rawURL, "application/jose+json", jws)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode < 400 {
+			return resp, body, nil
+		}
+		var problem acmeProblem
+		json.Unmarshal(body, &problem)
+		if problem.Type == "urn:ietf:params:acme:error:badNonce" && tries > 1 {
+			continue
+		}
+		return nil, nil, fmt.Errorf("ACME error %d for [%s]: %s %s", resp.StatusCode, rawURL, problem.Type, problem.Detail)
+	}
+}
+
+func (acme *ACMEClient) register() error {
+	_, body, err := acme.httpDo("GET", acme.directoryURL, "", nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &acme.directory); err != nil {
+		return err
+	}
+	if len(acme.directory.NewNonce) == 0 || len(acme.directory.NewAccount) == 0 || len(acme.directory.NewOrder) == 0 {
+		return fmt.Errorf("Invalid ACME directory at [%s]", acme.directoryURL)
+	}
+	account := map[string]interface{}{"termsOfServiceAgreed": true}
+	if len(acme.email) > 0 {
+		account["contact"] = []string{"mailto:" + acme.email}
+	}
+	acme.accountURL = ""
+	resp, _, err := acme.post(acme.directory.NewAccount, account)
+	if err != nil {
+		return err
+	}
+	acme.accountURL = resp.Header.Get("Location")
+	if len(acme.accountURL) == 0 {
+		return errors.New("The ACME server didn't return an account URL")
+	}
+	return nil
+}
+
+func (acme *ACMEClient) fetch(rawURL string, resource interface{}) error {
+	_, body, err := acme.post(rawURL, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, resource)
+}
+
+// poll fetches a resource until its status is no longer pending or processing
+func (acme *ACMEClient) poll(rawURL string, resource interface{}, status func() string) error {
+	deadline := time.Now().Add(ACMEPollTimeout)
+	for {
+		if err := acme.fetch(rawURL, resource); err != nil {
+			return err
+		}
+		switch status() {
+		case "pending", "processing":
+		default:
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timeout while waiting for [%s]", rawURL)
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (acme *ACMEClient) authorize(authzURL string) error {
+	var authz acmeAuthorization
+	if err := acme.fetch(authzURL, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	domain := authz.Identifier.Value
+	for _, challenge := range authz.Challenges {
+		if challenge.Type != "tls-alpn-01" {
+			continue
+		}
+		challengeCert, err := acmeChallengeCertificate(domain, challenge.Token+"."+acme.thumbprint())
+		if err != nil {
+			return err
+		}
+		acme.Lock()
+		acme.challenges[domain] = challengeCert
+		acme.Unlock()
+		defer func() {
+			acme.Lock()
+			delete(acme.challenges, domain)
+			acme.Unlock()
+		}()
+		if _, _, err := acme.post(challenge.URL, struct{}{}); err != nil {
+			return err
+		}
+		if err := acme.poll(authzURL, &authz, func() string { return authz.Status }); err != nil {
+			return err
+		}
+		if authz.Status != "valid" {
+			return fmt.Errorf("The ACME server couldn't validate [%s] - Is the local DoH server reachable on port 443?", domain)
+		}
+		return nil
+	}
+	return fmt.Errorf("The ACME server doesn't support the tls-alpn-01 challenge for [%s]", domain)
+}
+
+func (acme *ACMEClient) obtainCertificate() error {
+	dlog.Noticef("Requesting a certificate for %v", acme.domains)
+	if err := acme.register(); err != nil {
+		return err
+	}
+	identifiers := make([]map[string]string, len(acme.domains))
+	for i, domain := range acme.domains {
+		identifiers[i] = map[string]string{"type": "dns", "value": domain}
+	}
+	resp, body, err := acme.post(acme.directory.NewOrder, map[string]interface{}{"identifiers": identifiers})
+	if err != nil {
+		return err
+	}
+	orderURL := resp.Header.Get("Location")
+	var order acmeOrder
+	if err := json.Unmarshal(body, &order); err != nil {
+		return err
+	}
+	for _, authzURL := range order.Authorizations {
+		if err := acme.authorize(authzURL); err != nil {
+			return err
+		}
+	}
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), crypto_rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(crypto_rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: acme.domains[0]},
+		DNSNames: acme.domains,
+	}, certKey)
+	if err != nil {
+		return err
+	}
+	if _, _, err := acme.post(order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}); err != nil {
+		return err
+	}
+	if err := acme.poll(orderURL, &order, func() string { return order.Status }); err != nil {
+		return err
+	}
+	if order.Status != "valid" || len(order.Certificate) == 0 {
+		return fmt.Errorf("The ACME order ended with status [%s]", order.Status)
+	}
+	_, certPEM, err := acme.post(order.Certificate, nil)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if err := safefile.WriteFile(acme.keyFile(), keyPEM, 0o600); err != nil {
+		return err
+	}
+	if err := safefile.WriteFile(acme.certFile(), certPEM, 0o644); err != nil {
+		return err
+	}
+	acme.Lock()
+	acme.certificate = &certificate
+	acme.Unlock()
+	dlog.Noticef("New certificate installed for %v", acme.domains)
+	return nil
+}
+
+// acmeChallengeCertificate returns a self-signed certificate proving the control of a domain (RFC 8737)
+func acmeChallengeCertificate(domain string, keyAuthorization string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crypto_rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuthorization))
+	extValue, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		DNSNames:        []string{domain},
+		ExtraExtensions: []pkix.Extension{{Id: acmeIdentifierOID, Critical: true, Value: extValue}},
+	}
+	der, err := x509.CreateCertificate(crypto_rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"time"
+)
+
+// Number of responses a server must have sent before its timeout is adjusted
+const AdaptiveTimeoutMinSamples = 100
+
+// AdaptiveTimeouts computes a timeout for every server from its observed latencies (p99 + margin),
+// instead of waiting for the global timeout. The global timeout remains the upper bound.
+type AdaptiveTimeouts struct {
+	min    time.Duration
+	margin time.Duration
+	max    time.Duration
+}
+
+func NewAdaptiveTimeouts(min time.Duration, margin time.Duration, max time.Duration) *AdaptiveTimeouts {
+	return &AdaptiveTimeouts{min: min, margin: margin, max: max}
+}
+
+func (adaptive *AdaptiveTimeouts) clamp(timeout time.Duration) time.Duration {
+	if timeout < adaptive.min {
+		timeout = adaptive.min
+	}
+	if timeout > adaptive.max {
+		timeout = adaptive.max
+	}
+	return timeout
+}
+
+// update recomputes the timeout of a server after a response. The ServersInfo lock must be held.
+func (adaptive *AdaptiveTimeouts) update(stats *ServerStats) {
+	if adaptive == nil || stats == nil {
+		return
+	}
+	stats.consecutiveTimeouts = 0
+	if stats.latency.count < AdaptiveTimeoutMinSamples {
+		return
+	}
+	p99 := time.Duration(stats.latency.Percentile(99) * float64(time.Millisecond))
+	stats.timeout.Store(int64(adaptive.clamp(p99 + adaptive.margin)))
+}
+
+// backoff doubles the timeout of a server after every consecutive timeout, so that a server whose latency
+// suddenly increased can still respond. The ServersInfo lock must be held.
+func (adaptive *AdaptiveTimeouts) backoff(stats *ServerStats) {
+	if adaptive == nil || stats == nil {
+		return
+	}
+	stats.consecutiveTimeouts++
+	if timeout := time.Duration(stats.timeout.Load()); timeout > 0 {
+		stats.timeout.Store(int64(adaptive.clamp(timeout * 2)))
+	}
+}
+
+// currentTimeout returns the timeout to use for the next query sent to a server
+func (serverInfo *ServerInfo) currentTimeout() time.Duration {
+	if serverInfo.stats != nil {
+		if timeout := time.Duration(serverInfo.stats.timeout.Load()); timeout > 0 {
+			return timeout
+		}
+	}
+	return serverInfo.Timeout
+}
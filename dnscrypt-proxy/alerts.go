@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	AlertServerUnreachable   = "server_unreachable"
+	AlertNoLiveServers       = "no_live_servers"
+	AlertServFailRate        = "servfail_rate"
+	AlertSourceRefreshFailed = "source_refresh_failed"
+	AlertCertificateExpiring = "certificate_expiring"
+	AlertSystemFallback      = "system_fallback"
+)
+
+var AlertTypes = []string{
+	AlertServerUnreachable,
+	AlertNoLiveServers,
+	AlertServFailRate,
+	AlertSourceRefreshFailed,
+	AlertCertificateExpiring,
+	AlertSystemFallback,
+}
+
+type Alert struct {
+	Type     string    `json:"type"`
+	Subject  string    `json:"subject,omitempty"`
+	Message  string    `json:"message"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname,omitempty"`
+}
+
+// Alerter sends alerts to a webhook, as JSON documents.
+// The same alert is not sent again for the same subject before the cooldown delay.
+type Alerter struct {
+	sync.Mutex
+	webhookURL            string
+	events                map[string]bool
+	cooldown              time.Duration
+	servFailRateThreshold float64
+	servFailMinQueries    uint64
+	hostname              string
+	httpClient            *http.Client
+	lastSent              map[string]time.Time
+}
+
+func NewAlerter(config *AlertsConfig) (*Alerter, error) {
+	if len(config.WebhookURL) == 0 {
+		return nil, nil
+	}
+	events := config.Events
+	if len(events) == 0 {
+		events = AlertTypes
+	}
+	alerter := &Alerter{
+		webhookURL:            config.WebhookURL,
+		events:                make(map[string]bool),
+		cooldown:              time.Duration(config.Cooldown) * time.Minute,
+		servFailRateThreshold: config.ServFailRateThreshold,
+		servFailMinQueries:    uint64(Max(1, config.ServFailMinQueries)),
+		httpClient:            &http.Client{Timeout: 10 * time.Second},
+		lastSent:              make(map[string]time.Time),
+	}
+	alerter.hostname, _ = os.Hostname()
+	for _, event := range events {
+		found := false
+		for _, alertType := range AlertTypes {
+			if event == alertType {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unsupported alert type: [%s]", event)
+		}
+		alerter.events[event] = true
+	}
+	return alerter, nil
+}
+
+func (alerter *Alerter) Fire(alertType string, subject string, format string, args ...interface{}) {
+	if alerter == nil || !alerter.events[alertType] {
+		return
+	}
+	now := time.Now()
+	key := alertType + "/" + subject
+	alerter.Lock()
+	if lastSent, ok := alerter.lastSent[key]; ok && now.Sub(lastSent) < alerter.cooldown {
+		alerter.Unlock()
+		return
+	}
+	alerter.lastSent[key] = now
+	alerter.Unlock()
+	alert := Alert{
+		Type:     alertType,
+		Subject:  subject,
+		Message:  fmt.Sprintf(format, args...),
+		Time:     now,
+		Hostname: alerter.hostname,
+	}
+	go func() {
+		if err := alerter.send(&alert); err != nil {
+			dlog.Warnf("Unable to send alert to the webhook: [%v]", err)
+		}
+	}()
+}
+
+func (alerter *Alerter) send(alert *Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := alerter.httpClient.Post(alerter.webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
+
+// Start periodically checks the SERVFAIL rate of every server
+func (alerter *Alerter) Start(proxy *Proxy) {
+	if alerter == nil || !alerter.events[AlertServFailRate] {
+		return
+	}
+	go func() {
+		previous := make(map[string]ServerStatsReport)
+		for {
+			time.Sleep(time.Minute)
+			for _, current := range proxy.serversInfo.statsReport().Servers {
+				last := previous[current.Name]
+				previous[current.Name] = current
+				if current.Queries < last.Queries {
+					continue
+				}
+				queries, servFails := current.Queries-last.Queries, current.ServFails-last.ServFails
+				if queries < alerter.servFailMinQueries {
+					continue
+				}
+				if rate := float64(servFails) / float64(queries); rate > alerter.servFailRateThreshold {
+					alerter.Fire(AlertServFailRate, current.Name,
+						"[%s] returned SERVFAIL for %.1f%% of the last %d queries", current.Name, rate*100.0, queries)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Only respond to queries that can be answered from the cache or by plugins
+	OverloadActionCacheOnly = "cache_only"
+	// Respond with REFUSED
+	OverloadActionRefuse = "refuse"
+	// Don't respond
+	OverloadActionDrop = "drop"
+)
+
+func ValidateOverloadAction(action string) error {
+	switch action {
+	case OverloadActionCacheOnly, OverloadActionRefuse, OverloadActionDrop:
+		return nil
+	}
+	return fmt.Errorf("Unsupported overload action: [%s]", action)
+}
+
+// ClientsLimiter limits the number of queries being processed for each client IP address
+type ClientsLimiter struct {
+	sync.Mutex
+	counts map[string]uint32
+	max    uint32
+}
+
+func NewClientsLimiter(max uint32) *ClientsLimiter {
+	return &ClientsLimiter{counts: make(map[string]uint32), max: max}
+}
+
+func clientIPKey(clientAddr net.Addr) string {
+	switch addr := clientAddr.(type) {
+	case *net.UDPAddr:
+		return string(addr.IP.To16())
+	case *net.TCPAddr:
+		return string(addr.IP.To16())
+	}
+	return clientAddr.String()
+}
+
+func (limiter *ClientsLimiter) acquire(clientAddr net.Addr) bool {
+	if limiter == nil {
+		return true
+	}
+	key := clientIPKey(clientAddr)
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.counts[key] >= limiter.max {
+		return false
+	}
+	limiter.counts[key]++
+	return true
+}
+
+func (limiter *ClientsLimiter) release(clientAddr net.Addr) {
+	if limiter == nil {
+		return
+	}
+	key := clientIPKey(clientAddr)
+	limiter.Lock()
+	defer limiter.Unlock()
+	if count := limiter.counts[key]; count <= 1 {
+		delete(limiter.counts, key)
+	} else {
+		limiter.counts[key] = count - 1
+	}
+}
+
+// clientsCountQueue reserves a place in the queue of queries waiting for a client slot
+func (proxy *Proxy) clientsCountQueue() bool {
+	for {
+		queued := atomic.LoadUint32(&proxy.queuedClients)
+		if queued >= proxy.maxQueuedClients {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&proxy.queuedClients, queued, queued+1) {
+			return true
+		}
+	}
+}
+
+// clientsCountWait waits until a client slot is available, or until the timeout expires.
+// The caller must have a place in the queue, that is released by this function.
+func (proxy *Proxy) clientsCountWait() bool {
+	defer atomic.AddUint32(&proxy.queuedClients, ^uint32(0))
+	timer := time.NewTimer(proxy.timeout)
+	defer timer.Stop()
+	for {
+		if proxy.clientsCountInc() {
+			return true
+		}
+		select {
+		case <-proxy.clientSlotFreed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// handleUDPQuery processes a query received over UDP, unless the proxy or the client is overloaded.
+// If `buffer` is not nil, it is the pooled buffer holding the packet, returned to the pool once the query has been processed.
+func (proxy *Proxy) handleUDPQuery(packet []byte, buffer *[]byte, clientAddr net.Addr, clientPc net.Conn, start time.Time) {
+	release := func() {
+		if buffer != nil {
+			putPacketBuffer(buffer)
+		}
+	}
+	if acl := proxy.listenerACL(clientPc.LocalAddr()); !acl.Allows(clientAddr) {
+		defer release()
+		dlog.Debugf("Client [%v] is not allowed to use this listener", clientAddr)
+		if response := acl.Reject(packet); response != nil {
+			clientPc.(net.PacketConn).WriteTo(response, clientAddr)
+		}
+		return
+	}
+	if !proxy.clientsLimiter.acquire(clientAddr) {
+		defer release()
+		dlog.Debugf("Too many concurrent queries from [%v]", clientAddr)
+		proxy.rejectUDPQuery(packet, clientAddr, clientPc, start)
+		return
+	}
+	if proxy.clientsCountInc() {
+		go func() {
+			defer release()
+			defer proxy.clientsLimiter.release(clientAddr)
+			defer proxy.clientsCountDec()
+			proxy.processIncomingQuery("udp", proxy.mainProto, packet, &clientAddr, clientPc, start, false)
+		}()
+		return
+	}
+	if proxy.clientsCountQueue() {
+		go func() {
+			defer release()
+			defer proxy.clientsLimiter.release(clientAddr)
+			if !proxy.clientsCountWait() {
+				proxy.rejectUDPQuery(packet, clientAddr, clientPc, start)
+				return
+			}
+			defer proxy.clientsCountDec()
+			proxy.processIncomingQuery("udp", proxy.mainProto, packet, &clientAddr, clientPc, start, false)
+		}()
+		return
+	}
+	defer release()
+	proxy.clientsLimiter.release(clientAddr)
+	dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
+	proxy.rejectUDPQuery(packet, clientAddr, clientPc, start)
+}
+
+func (proxy *Proxy) rejectUDPQuery(packet []byte, clientAddr net.Addr, clientPc net.Conn, start time.Time) {
+	switch proxy.overloadAction {
+	case OverloadActionCacheOnly:
+		proxy.processIncomingQuery("udp", proxy.mainProto, packet, &clientAddr, clientPc, start, true)
+	case OverloadActionRefuse:
+		msg := dns.Msg{}
+		if msg.Unpack(packet) != nil || len(msg.Question) != 1 {
+			return
+		}
+		response, err := RefusedResponseFromMessage(&msg, true, nil, nil, 0).Pack()
+		if err != nil {
+			return
+		}
+		clientPc.(net.PacketConn).WriteTo(response, clientAddr)
+	}
+}
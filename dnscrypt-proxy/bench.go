@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	crypto_rand "crypto/rand"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	// Use generated queries instead of a query file
+	BenchSourceSynthetic = "synthetic"
+	// Send the queries directly to the configured servers
+	BenchTargetServers = "servers"
+	// Send the queries to the first listening address of the proxy
+	BenchTargetListener = "listener"
+)
+
+// Names used to generate synthetic traffic. A fraction of the queries is sent for random names
+// instead, so that both cached and uncached responses are measured.
+var benchSyntheticNames = []string{
+	"example.com.", "google.com.", "facebook.com.", "amazon.com.", "wikipedia.org.",
+	"apple.com.", "microsoft.com.", "cloudflare.com.", "github.com.", "netflix.com.",
+}
+
+type BenchQuery struct {
+	qName string
+	qType uint16
+}
+
+type BenchOptions struct {
+	source      string
+	target      string
+	queries     int
+	concurrency int
+}
+
+type benchResult struct {
+	latencies []time.Duration
+	rcodes    map[string]int
+	errors    map[string]int
+}
+
+// loadBenchQueries reads a query file, with one `<name> [<type>]` entry per line
+func loadBenchQueries(fileName string) ([]BenchQuery, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var queries []BenchQuery
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := TrimAndStripInlineComments(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		parts := strings.Fields(line)
+		query := BenchQuery{qName: dns.Fqdn(parts[0]), qType: dns.TypeA}
+		if len(parts) > 1 {
+			qType, ok := dns.StringToType[strings.ToUpper(parts[1])]
+			if !ok {
+				return nil, fmt.Errorf("Unsupported query type [%s] at line %d", parts[1], lineNo)
+			}
+			query.qType = qType
+		}
+		if _, ok := dns.IsDomainName(query.qName); !ok {
+			return nil, fmt.Errorf("Invalid name [%s] at line %d", parts[0], lineNo)
+		}
+		queries = append(queries, query)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(queries) == 0 {
+		return nil, errors.New("No queries found in the query file")
+	}
+	return queries, nil
+}
+
+func syntheticBenchQuery() BenchQuery {
+	if rand.Intn(10) == 0 {
+		return BenchQuery{qName: fmt.Sprintf("%08x.%s", rand.Uint32(), nonexistentName), qType: dns.TypeA}
+	}
+	qType := dns.TypeA
+	if rand.Intn(2) == 0 {
+		qType = dns.TypeAAAA
+	}
+	return BenchQuery{qName: benchSyntheticNames[rand.Intn(len(benchSyntheticNames))], qType: qType}
+}
+
+func benchPercentile(sortedLatencies []time.Duration, percentile int) time.Duration {
+	if len(sortedLatencies) == 0 {
+		return 0
+	}
+	index := (len(sortedLatencies)*percentile + 99) / 100
+	if index < 1 {
+		index = 1
+	}
+	return sortedLatencies[index-1]
+}
+
+func benchErrorType(err error) string {
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		return "timeout"
+	}
+	if _, ok := err.(*QueryEncryptionError); ok {
+		return "encryption"
+	}
+	return "network"
+}
+
+func (proxy *Proxy) benchExchangeFunc(options *BenchOptions, listenAddresses []string) (func(*dns.Msg) (*dns.Msg, error), error) {
+	target := options.target
+	if target == BenchTargetListener {
+		if len(listenAddresses) == 0 {
+			return nil, errors.New("No listening addresses configured")
+		}
+		target = listenAddresses[0]
+	}
+	if target != BenchTargetServers {
+		client := dns.Client{Net: "udp", Timeout: proxy.timeout}
+		return func(msg *dns.Msg) (*dns.Msg, error) {
+			response, _, err := client.Exchange(msg, target)
+			if err == nil && response.Truncated {
+				tcpClient := dns.Client{Net: "tcp", Timeout: proxy.timeout}
+				response, _, err = tcpClient.Exchange(msg, target)
+			}
+			return response, err
+		}, nil
+	}
+	proxy.questionSizeEstimator = NewQuestionSizeEstimator()
+	if _, err := crypto_rand.Read(proxy.proxySecretKey[:]); err != nil {
+		return nil, err
+	}
+	curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
+	liveServers, err := proxy.serversInfo.refresh(proxy)
+	if liveServers == 0 {
+		if err == nil {
+			err = errors.New("No servers are reachable")
+		}
+		return nil, err
+	}
+	return func(msg *dns.Msg) (*dns.Msg, error) {
+		serverInfo := proxy.serversInfo.getOne()
+		if serverInfo == nil {
+			return nil, errors.New("No servers are reachable")
+		}
+		query, err := msg.Pack()
+		if err != nil {
+			return nil, err
+		}
+		pluginsState := PluginsState{queryID: "bench"}
+		response, err := proxy.exchangeWithServer(&pluginsState, serverInfo, query, "udp")
+		if err != nil {
+			return nil, err
+		}
+		responseMsg := dns.Msg{}
+		if err := responseMsg.Unpack(response); err != nil {
+			return nil, err
+		}
+		return &responseMsg, nil
+	}, nil
+}
+
+// runBenchmark sends queries from a query file or synthetic queries to the servers or to a listener,
+// and prints the throughput, the latency distribution and a breakdown of the errors
+func (proxy *Proxy) runBenchmark(options *BenchOptions, listenAddresses []string) error {
+	if options.queries <= 0 || options.concurrency <= 0 {
+		return errors.New("The number of queries and the concurrency must be positive")
+	}
+	nextQuery := syntheticBenchQuery
+	if options.source != BenchSourceSynthetic {
+		queries, err := loadBenchQueries(options.source)
+		if err != nil {
+			return err
+		}
+		var queryIndex int
+		var queryIndexLock sync.Mutex
+		nextQuery = func() BenchQuery {
+			queryIndexLock.Lock()
+			defer queryIndexLock.Unlock()
+			query := queries[queryIndex%len(queries)]
+			queryIndex++
+			return query
+		}
+	}
+	exchange, err := proxy.benchExchangeFunc(options, listenAddresses)
+	if err != nil {
+		return err
+	}
+
+	jobs := make(chan BenchQuery, options.concurrency)
+	results := make([]benchResult, options.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < options.concurrency; i++ {
+		wg.Add(1)
+		go func(result *benchResult) {
+			defer wg.Done()
+			result.rcodes, result.errors = make(map[string]int), make(map[string]int)
+			for query := range jobs {
+				msg := dns.Msg{}
+				msg.SetQuestion(query.qName, query.qType)
+				msg.SetEdns0(uint16(MaxDNSPacketSize), true)
+				queryStart := time.Now()
+				response, err := exchange(&msg)
+				if err != nil {
+					result.errors[benchErrorType(err)]++
+					continue
+				}
+				result.latencies = append(result.latencies, time.Since(queryStart))
+				result.rcodes[dns.RcodeToString[response.Rcode]]++
+			}
+		}(&results[i])
+	}
+	for i := 0; i < options.queries; i++ {
+		jobs <- nextQuery()
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var latencies []time.Duration
+	rcodes, errorTypes := make(map[string]int), make(map[string]int)
+	for _, result := range results {
+		latencies = append(latencies, result.latencies...)
+		for rcode, count := range result.rcodes {
+			rcodes[rcode] += count
+		}
+		for errorType, count := range result.errors {
+			errorTypes[errorType] += count
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	fmt.Printf("Queries:     %d (concurrency: %d)\n", options.queries, options.concurrency)
+	fmt.Printf("Responses:   %d\n", len(latencies))
+	fmt.Printf("Duration:    %v\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("QPS:         %.1f\n", float64(len(latencies))/elapsed.Seconds())
+	if len(latencies) > 0 {
+		fmt.Printf("Latency:     p50=%v p90=%v p99=%v max=%v\n",
+			benchPercentile(latencies, 50).Round(time.Microsecond),
+			benchPercentile(latencies, 90).Round(time.Microsecond),
+			benchPercentile(latencies, 99).Round(time.Microsecond),
+			latencies[len(latencies)-1].Round(time.Microsecond))
+	}
+	printBenchCounts("Rcodes:", rcodes)
+	printBenchCounts("Errors:", errorTypes)
+	return nil
+}
+
+func printBenchCounts(title string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println(title)
+	for _, name := range names {
+		fmt.Printf("  %-16s %d\n", name, counts[name])
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestLoadBenchQueries(t *testing.T) {
+	c := check.T(t)
+	fileName := filepath.Join(t.TempDir(), "queries.txt")
+	c.Nil(os.WriteFile(fileName, []byte("# comment\nexample.com\n\nexample.net aaaa # inline\n"), 0o600))
+	queries, err := loadBenchQueries(fileName)
+	c.Nil(err)
+	c.Equal(len(queries), 2)
+	c.Equal(queries[0], BenchQuery{qName: "example.com.", qType: dns.TypeA})
+	c.Equal(queries[1], BenchQuery{qName: "example.net.", qType: dns.TypeAAAA})
+
+	c.Nil(os.WriteFile(fileName, []byte("example.com BOGUS\n"), 0o600))
+	_, err = loadBenchQueries(fileName)
+	c.NotNil(err)
+}
+
+func TestBenchPercentile(t *testing.T) {
+	c := check.T(t)
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(i+1) * time.Millisecond
+	}
+	c.Equal(benchPercentile(latencies, 50), 50*time.Millisecond)
+	c.Equal(benchPercentile(latencies, 99), 99*time.Millisecond)
+	c.Equal(benchPercentile(latencies, 100), 100*time.Millisecond)
+	c.Equal(benchPercentile(latencies[:1], 50), time.Millisecond)
+	c.Equal(benchPercentile(nil, 50), time.Duration(0))
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Name of the network interface that sockets used to send queries to servers are bound to
+var outboundInterface string
+
+type socketControl func(network, address string, c syscall.RawConn) error
+
+// bindToInterface returns a control function that binds sockets to a network interface,
+// after applying `control`. It returns `control` as is if no interface name is given.
+func bindToInterface(ifName string, control socketControl) socketControl {
+	if len(ifName) == 0 {
+		return control
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		var err error
+		if controlErr := c.Control(func(fd uintptr) {
+			err = bindSocketToInterface(fd, network, ifName)
+		}); controlErr != nil {
+			return controlErr
+		}
+		return err
+	}
+}
+
+// outboundDialer returns a dialer for connections to servers
+func outboundDialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: timeout, KeepAlive: timeout, Control: bindToInterface(outboundInterface, nil)}
+}
+
+// listenOutboundUDP returns a socket to send queries to servers over UDP-based protocols
+func listenOutboundUDP(network string) (*net.UDPConn, error) {
+	if len(outboundInterface) == 0 {
+		return net.ListenUDP(network, nil)
+	}
+	listenConfig := net.ListenConfig{Control: bindToInterface(outboundInterface, nil)}
+	pc, err := listenConfig.ListenPacket(context.Background(), network, "")
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// bindListenConfig makes a listener configuration bind sockets to `listen_interface`, if it is set
+func (proxy *Proxy) bindListenConfig(listenConfig *net.ListenConfig) *net.ListenConfig {
+	listenConfig.Control = bindToInterface(proxy.listenInterface, listenConfig.Control)
+	return listenConfig
+}
+
+func (proxy *Proxy) listenUDP(network string, listenAddr *net.UDPAddr) (*net.UDPConn, error) {
+	pc, err := proxy.bindListenConfig(&net.ListenConfig{}).ListenPacket(context.Background(), network, listenAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+func (proxy *Proxy) listenTCP(network string, listenAddr *net.TCPAddr) (*net.TCPListener, error) {
+	listener, err := proxy.bindListenConfig(&net.ListenConfig{}).Listen(context.Background(), network, listenAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return listener.(*net.TCPListener), nil
+}
@@ -0,0 +1,9 @@
+package main
+
+import (
+	"syscall"
+)
+
+func bindSocketToInterface(fd uintptr, network string, ifName string) error {
+	return syscall.BindToDevice(int(fd), ifName)
+}
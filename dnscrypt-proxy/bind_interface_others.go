@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package main
+
+import (
+	"errors"
+)
+
+func bindSocketToInterface(fd uintptr, network string, ifName string) error {
+	return errors.New("Binding sockets to a network interface is not supported on this platform")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	ipUnicastIf   = 31
+	ipv6UnicastIf = 31
+)
+
+// bindSocketToInterface only changes the interface used to send packets; Windows has no way to only receive
+// packets from a given interface
+func bindSocketToInterface(fd uintptr, network string, ifName string) error {
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(network, "6") {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, ipv6UnicastIf, iface.Index)
+	}
+	// The IPv4 option expects the index in network byte order
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], uint32(iface.Index))
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, ipUnicastIf, int(binary.NativeEndian.Uint32(index[:])))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"hash/maphash"
+	"strings"
+)
+
+const (
+	// Bits per key; with 7 hash functions, this gives a false positive rate of about 1%
+	BloomFilterBitsPerKey = 10
+	BloomFilterHashes     = 7
+	BloomFilterMinKeys    = 1024
+)
+
+// BloomFilter is a set of strings that can return false positives, but no false negatives
+type BloomFilter struct {
+	seed     maphash.Seed
+	bits     []uint64
+	capacity int
+	count    int
+}
+
+func NewBloomFilter(capacity int) *BloomFilter {
+	capacity = Max(capacity, BloomFilterMinKeys)
+	return &BloomFilter{
+		seed:     maphash.MakeSeed(),
+		bits:     make([]uint64, (capacity*BloomFilterBitsPerKey+63)/64),
+		capacity: capacity,
+	}
+}
+
+// Full returns true if the filter contains as many keys as it was sized for
+func (filter *BloomFilter) Full() bool {
+	return filter.count >= filter.capacity
+}
+
+func (filter *BloomFilter) Add(key string) {
+	h := maphash.String(filter.seed, key)
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	nbits := uint32(len(filter.bits) * 64)
+	for i := uint32(0); i < BloomFilterHashes; i++ {
+		bit := (h1 + i*h2) % nbits
+		filter.bits[bit/64] |= 1 << (bit % 64)
+	}
+	filter.count++
+}
+
+func (filter *BloomFilter) MayContain(key string) bool {
+	h := maphash.String(filter.seed, key)
+	h1, h2 := uint32(h), uint32(h>>32)|1
+	nbits := uint32(len(filter.bits) * 64)
+	for i := uint32(0); i < BloomFilterHashes; i++ {
+		bit := (h1 + i*h2) % nbits
+		if filter.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MayContainSuffixOf returns true if the filter may contain the name, or any of its parent domains
+func (filter *BloomFilter) MayContainSuffixOf(name string) bool {
+	for {
+		if filter.MayContain(name) {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
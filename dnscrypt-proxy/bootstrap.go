@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	BootstrapDoHPrefix = "https://"
+	BootstrapDoTPrefix = "tls://"
+	BootstrapDoTPort   = 853
+)
+
+// Bootstrap resolvers can be plain DNS resolvers (`ip:port`), DoH servers (`https://ip[:port]/path`)
+// or DoT servers (`tls://ip[:port]`). Encrypted resolvers must be given by IP address, so that
+// they can be reached without any prior name resolution; their certificates must then include that address.
+func validateBootstrapResolver(resolver string) error {
+	switch {
+	case strings.HasPrefix(resolver, BootstrapDoHPrefix):
+		parsedURL, err := url.Parse(resolver)
+		if err != nil {
+			return err
+		}
+		if ParseIP(parsedURL.Hostname()) == nil {
+			return fmt.Errorf("Host does not parse as IP '%s'", resolver)
+		}
+		return nil
+	case strings.HasPrefix(resolver, BootstrapDoTPrefix):
+		host, port := ExtractHostAndPort(strings.TrimPrefix(resolver, BootstrapDoTPrefix), BootstrapDoTPort)
+		if ParseIP(host) == nil {
+			return fmt.Errorf("Host does not parse as IP '%s'", resolver)
+		} else if port <= 0 || port > 65535 {
+			return fmt.Errorf("Port does not parse '%s'", resolver)
+		}
+		return nil
+	}
+	return isIPAndPort(resolver)
+}
+
+// isEncryptedBootstrapResolver returns true if a bootstrap resolver is a DoH or DoT server
+func isEncryptedBootstrapResolver(resolver string) bool {
+	return strings.HasPrefix(resolver, BootstrapDoHPrefix) || strings.HasPrefix(resolver, BootstrapDoTPrefix)
+}
+
+// bootstrapResolverAddress returns the `ip:port` address of a bootstrap resolver, whatever its protocol is
+func bootstrapResolverAddress(resolver string) string {
+	switch {
+	case strings.HasPrefix(resolver, BootstrapDoHPrefix):
+		parsedURL, err := url.Parse(resolver)
+		if err != nil {
+			return resolver
+		}
+		port := parsedURL.Port()
+		if len(port) == 0 {
+			port = "443"
+		}
+		return net.JoinHostPort(parsedURL.Hostname(), port)
+	case strings.HasPrefix(resolver, BootstrapDoTPrefix):
+		host, port := ExtractHostAndPort(strings.TrimPrefix(resolver, BootstrapDoTPrefix), BootstrapDoTPort)
+		return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), strconv.Itoa(port))
+	}
+	return resolver
+}
+
+// exchangeWithBootstrapResolver sends a query to a bootstrap resolver, using its protocol.
+// `proto` is only used for plain DNS resolvers.
+func (xTransport *XTransport) exchangeWithBootstrapResolver(msg *dns.Msg, proto string, resolver string) (*dns.Msg, error) {
+	switch {
+	case strings.HasPrefix(resolver, BootstrapDoHPrefix):
+		resolverURL, err := url.Parse(resolver)
+		if err != nil {
+			return nil, err
+		}
+		query, err := msg.Pack()
+		if err != nil {
+			return nil, err
+		}
+		response, _, _, _, err := xTransport.DoHQuery(false, resolverURL, query, xTransport.timeout)
+		if err != nil {
+			return nil, err
+		}
+		in := dns.Msg{}
+		if err := in.Unpack(response); err != nil {
+			return nil, err
+		}
+		if in.Id != msg.Id {
+			return nil, errors.New("Unexpected response from the bootstrap resolver")
+		}
+		return &in, nil
+	case strings.HasPrefix(resolver, BootstrapDoTPrefix):
+		addr := bootstrapResolverAddress(resolver)
+		host, _, _ := net.SplitHostPort(addr)
+		dnsClient := dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   xTransport.timeout,
+			TLSConfig: &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12, CurvePreferences: xTransport.curvePreferences()},
+		}
+		in, _, err := dnsClient.Exchange(msg, addr)
+		return in, err
+	}
+	dnsClient := dns.Client{Net: proto}
+	in, _, err := dnsClient.Exchange(msg, resolver)
+	return in, err
+}
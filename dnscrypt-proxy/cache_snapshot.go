@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const cacheSnapshotFileFormat = 1
+
+// CacheSnapshot saves the content of the DNS cache to a file, so that it can be reloaded after a restart
+// instead of sending all the popular queries to the servers at once
+type CacheSnapshot struct {
+	fileName    string
+	interval    time.Duration
+	staleMaxAge time.Duration
+}
+
+type cacheSnapshotEntry struct {
+	Key        []byte `json:"key"`
+	Expiration int64  `json:"expiration"`
+	TTL        int64  `json:"ttl"`
+	Msg        []byte `json:"msg"`
+}
+
+type cacheSnapshotFile struct {
+	Format  int                  `json:"format"`
+	Entries []cacheSnapshotEntry `json:"entries"`
+}
+
+func NewCacheSnapshot(fileName string, interval time.Duration, staleMaxAge time.Duration) *CacheSnapshot {
+	return &CacheSnapshot{fileName: fileName, interval: interval, staleMaxAge: staleMaxAge}
+}
+
+func (snapshot *CacheSnapshot) save() {
+	cache := cachedResponses.Load()
+	if cache == nil {
+		return
+	}
+	snapshotFile := cacheSnapshotFile{Format: cacheSnapshotFileFormat}
+	cache.Walk(func(key [32]byte, cached *CachedResponse) {
+		packed, err := cached.msg.Pack()
+		if err != nil {
+			return
+		}
+		snapshotFile.Entries = append(snapshotFile.Entries, cacheSnapshotEntry{
+			Key:        key[:],
+			Expiration: cached.expiration.Unix(),
+			TTL:        int64(cached.ttl / time.Second),
+			Msg:        packed,
+		})
+	})
+	bin, err := json.Marshal(snapshotFile)
+	if err != nil {
+		dlog.Warnf("Unable to serialize the cache: %v", err)
+		return
+	}
+	if err := safefile.WriteFile(snapshot.fileName, bin, 0o600); err != nil {
+		dlog.Warnf("Unable to save the cache to [%s]: %v", snapshot.fileName, err)
+		return
+	}
+	cacheLog.Debugf("%d cache entries saved to [%s]", len(snapshotFile.Entries), snapshot.fileName)
+}
+
+// load adds the entries of a snapshot to the cache. Entries keep their original expiration, so that
+// their TTL is reduced by the time the proxy was down; entries expired for too long are skipped.
+func (snapshot *CacheSnapshot) load() error {
+	cache := cachedResponses.Load()
+	if cache == nil {
+		return nil
+	}
+	bin, err := os.ReadFile(snapshot.fileName)
+	if err != nil {
+		return err
+	}
+	var snapshotFile cacheSnapshotFile
+	if err := json.Unmarshal(bin, &snapshotFile); err != nil {
+		return err
+	}
+	if snapshotFile.Format != cacheSnapshotFileFormat {
+		return errors.New("Unsupported cache snapshot format")
+	}
+	now, loaded := time.Now(), 0
+	for _, entry := range snapshotFile.Entries {
+		expiration := time.Unix(entry.Expiration, 0)
+		if len(entry.Key) != 32 || now.Sub(expiration) > snapshot.staleMaxAge {
+			continue
+		}
+		msg := dns.Msg{}
+		if err := msg.Unpack(entry.Msg); err != nil {
+			continue
+		}
+		var key [32]byte
+		copy(key[:], entry.Key)
+		cache.Add(key, CachedResponse{
+			expiration: expiration,
+			ttl:        time.Duration(entry.TTL) * time.Second,
+			msg:        msg,
+			wire:       NewCachedWireResponse(&msg),
+		})
+		loaded++
+	}
+	dlog.Noticef("%d cache entries loaded from [%s]", loaded, snapshot.fileName)
+	return nil
+}
+
+func (snapshot *CacheSnapshot) run() {
+	if snapshot.interval <= 0 {
+		return
+	}
+	for {
+		time.Sleep(snapshot.interval)
+		snapshot.save()
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/sha512"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	c := check.T(t)
+	defer cachedResponses.Store(nil)
+	cache := NewShardedCache(100, 0)
+	cachedResponses.Store(cache)
+	fresh, expired := testCachedResponse("fresh.example.com"), testCachedResponse("expired.example.com")
+	fresh.expiration, expired.expiration = time.Now().Add(time.Hour), time.Now().Add(-2*time.Hour)
+	cache.Add(sha512.Sum512_256([]byte("fresh")), fresh)
+	cache.Add(sha512.Sum512_256([]byte("expired")), expired)
+
+	snapshot := NewCacheSnapshot(filepath.Join(t.TempDir(), "cache.json"), 0, time.Hour)
+	snapshot.save()
+	cachedResponses.Store(NewShardedCache(100, 0))
+	c.Nil(snapshot.load())
+	c.Equal(cachedResponses.Load().Len(), 1)
+	cached, ok := cachedResponses.Load().Get(sha512.Sum512_256([]byte("fresh")))
+	c.True(ok)
+	c.Equal(cached.expiration.Unix(), fresh.expiration.Unix())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+// CachedWireResponse is a cached response in wire format, along with the offsets of its TTLs.
+// On a cache hit, a copy of the packet is sent after patching the transaction ID, the case of the
+// question name and the TTLs, without unpacking and packing the message again.
+type CachedWireResponse struct {
+	packet     []byte
+	ttlOffsets []int
+}
+
+// NewCachedWireResponse returns nil if the message can't be patched, in which case the regular path has to be used
+func NewCachedWireResponse(msg *dns.Msg) *CachedWireResponse {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	packet, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	ttlOffsets, ok := wireTTLOffsets(packet)
+	if !ok {
+		return nil
+	}
+	return &CachedWireResponse{packet: packet, ttlOffsets: ttlOffsets}
+}
+
+func skipWireName(packet []byte, offset int) (int, bool) {
+	for offset < len(packet) {
+		length := int(packet[offset])
+		switch length & 0xc0 {
+		case 0x00:
+			if length == 0 {
+				return offset + 1, true
+			}
+			offset += 1 + length
+		case 0xc0:
+			if offset+2 > len(packet) {
+				return 0, false
+			}
+			return offset + 2, true
+		default:
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// wireTTLOffsets returns the offsets of the TTLs of all the records of a packet, except the OPT record
+func wireTTLOffsets(packet []byte) ([]int, bool) {
+	if len(packet) < 12 {
+		return nil, false
+	}
+	qdCount := int(binary.BigEndian.Uint16(packet[4:6]))
+	rrCount := int(binary.BigEndian.Uint16(packet[6:8])) +
+		int(binary.BigEndian.Uint16(packet[8:10])) +
+		int(binary.BigEndian.Uint16(packet[10:12]))
+	offset, ok := 12, true
+	for i := 0; i < qdCount; i++ {
+		if offset, ok = skipWireName(packet, offset); !ok || offset+4 > len(packet) {
+			return nil, false
+		}
+		offset += 4
+	}
+	ttlOffsets := make([]int, 0, rrCount)
+	for i := 0; i < rrCount; i++ {
+		if offset, ok = skipWireName(packet, offset); !ok || offset+10 > len(packet) {
+			return nil, false
+		}
+		if binary.BigEndian.Uint16(packet[offset:offset+2]) != dns.TypeOPT {
+			ttlOffsets = append(ttlOffsets, offset+4)
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(packet[offset+8:offset+10]))
+	}
+	if offset != len(packet) {
+		return nil, false
+	}
+	return ttlOffsets, true
+}
+
+// setEDNS0UDPSize changes the UDP payload size advertised in the OPT record of a packet, if it has one
+func setEDNS0UDPSize(packet []byte, size uint16) bool {
+	if len(packet) < 12 {
+		return false
+	}
+	qdCount := int(binary.BigEndian.Uint16(packet[4:6]))
+	rrCount := int(binary.BigEndian.Uint16(packet[6:8])) +
+		int(binary.BigEndian.Uint16(packet[8:10])) +
+		int(binary.BigEndian.Uint16(packet[10:12]))
+	offset, ok := 12, true
+	for i := 0; i < qdCount; i++ {
+		if offset, ok = skipWireName(packet, offset); !ok || offset+4 > len(packet) {
+			return false
+		}
+		offset += 4
+	}
+	for i := 0; i < rrCount; i++ {
+		if offset, ok = skipWireName(packet, offset); !ok || offset+10 > len(packet) {
+			return false
+		}
+		if binary.BigEndian.Uint16(packet[offset:offset+2]) == dns.TypeOPT {
+			binary.BigEndian.PutUint16(packet[offset+2:offset+4], size)
+			return true
+		}
+		offset += 10 + int(binary.BigEndian.Uint16(packet[offset+8:offset+10]))
+	}
+	return false
+}
+
+// Patch returns a copy of the response for a query, with all the TTLs set to `ttl`
+func (wire *CachedWireResponse) Patch(id uint16, qName string, ttl uint32) ([]byte, bool) {
+	nameEnd, ok := skipWireName(wire.packet, 12)
+	if !ok {
+		return nil, false
+	}
+	response := make([]byte, len(wire.packet))
+	copy(response, wire.packet)
+	binary.BigEndian.PutUint16(response[0:2], id)
+	// Names only differ by their case, so that the question name of the query has the same length
+	if offset, err := dns.PackDomainName(qName, response, 12, nil, false); err != nil || offset != nameEnd {
+		return nil, false
+	}
+	for _, offset := range wire.ttlOffsets {
+		binary.BigEndian.PutUint32(response[offset:offset+4], ttl)
+	}
+	return response, true
+}
+
+// AuthenticatedData returns the AD bit of the response
+func (wire *CachedWireResponse) AuthenticatedData() bool {
+	return wire.packet[3]&0x20 != 0
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func testCacheWireResponse() *dns.Msg {
+	query := dns.Msg{}
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	query.SetEdns0(4096, true)
+	msg := dns.Msg{}
+	msg.SetReply(&query)
+	msg.AuthenticatedData = true
+	msg.Compress = true
+	msg.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "example.com."},
+		&dns.A{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.IPv4(192, 0, 2, 1)},
+	}
+	msg.SetEdns0(4096, true)
+	return &msg
+}
+
+func TestCachedWireResponse(t *testing.T) {
+	c := check.T(t)
+	wire := NewCachedWireResponse(testCacheWireResponse())
+	c.NotNil(wire)
+	c.Len(wire.ttlOffsets, 2)
+	c.True(wire.AuthenticatedData())
+
+	packet, ok := wire.Patch(0x1234, "WWW.Example.COM.", 42)
+	c.True(ok)
+	msg := dns.Msg{}
+	c.Nil(msg.Unpack(packet))
+	c.Equal(msg.Id, uint16(0x1234))
+	c.Equal(msg.Question[0].Name, "WWW.Example.COM.")
+	c.Len(msg.Answer, 2)
+	for _, rr := range msg.Answer {
+		c.Equal(rr.Header().Ttl, uint32(42))
+	}
+	c.NotNil(msg.IsEdns0())
+
+	_, ok = wire.Patch(0x1234, "www.example.org.", 42)
+	c.True(ok)
+	_, ok = wire.Patch(0x1234, "www.example.co.", 42)
+	c.False(ok)
+}
+
+func TestSetEDNS0UDPSize(t *testing.T) {
+	c := check.T(t)
+	packet, err := testCacheWireResponse().Pack()
+	c.Nil(err)
+	c.True(setEDNS0UDPSize(packet, 1232))
+	msg := dns.Msg{}
+	c.Nil(msg.Unpack(packet))
+	c.Equal(msg.IsEdns0().UDPSize(), uint16(1232))
+	c.True(msg.IsEdns0().Do())
+
+	msg.Extra = nil
+	packet, err = msg.Pack()
+	c.Nil(err)
+	c.False(setEDNS0UDPSize(packet, 1232))
+}
+
+func BenchmarkCachedResponseWire(b *testing.B) {
+	wire := NewCachedWireResponse(testCacheWireResponse())
+	expiration := time.Now().Add(time.Minute)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		wire.Patch(uint16(i), "www.example.com.", remainingTTL(expiration))
+	}
+}
+
+func BenchmarkCachedResponseMsg(b *testing.B) {
+	cached := CachedResponse{msg: *testCacheWireResponse(), expiration: time.Now().Add(time.Minute)}
+	query := dns.Msg{}
+	query.SetQuestion("www.example.com.", dns.TypeA)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		synth := cachedSynthResponse(&cached, &query)
+		updateTTL(synth, cached.expiration)
+		synth.Pack()
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+const (
+	// How long probed capabilities are kept before servers are probed again
+	CapabilitiesTTL = 24 * time.Hour
+	// A zone with a deliberately broken DNSSEC signature, that validating resolvers refuse to resolve
+	CapabilitiesBogusName = "dnssec-failed.org."
+)
+
+// ServerCapabilities are the features of a server, as observed by sending it probe queries
+// rather than as advertised in its stamp
+type ServerCapabilities struct {
+	EDNS             bool      `json:"edns"`
+	EDNSBufferSize   uint16    `json:"edns_buffer_size,omitempty"`
+	DNSSECRecords    bool      `json:"dnssec_records"`
+	DNSSECValidation bool      `json:"dnssec_validation"`
+	TCP              bool      `json:"tcp"`
+	RTT              int       `json:"rtt_ms"`
+	Probed           time.Time `json:"probed"`
+}
+
+func capabilitiesProbeQuery(qName string, qType uint16) []byte {
+	msg := dns.Msg{}
+	msg.SetQuestion(qName, qType)
+	msg.Id = uint16(rand.Intn(0xffff))
+	msg.SetEdns0(uint16(MaxDNSPacketSize), true)
+	query, _ := msg.Pack()
+	return query
+}
+
+func (proxy *Proxy) capabilitiesExchange(serverInfo *ServerInfo, query []byte, serverProto string) *dns.Msg {
+	pluginsState := PluginsState{queryID: "capabilities"}
+	response, err := proxy.exchangeWithServer(&pluginsState, serverInfo, query, serverProto)
+	if err != nil || len(response) < MinDNSPacketSize {
+		return nil
+	}
+	msg := dns.Msg{}
+	if msg.Unpack(response) != nil {
+		return nil
+	}
+	return &msg
+}
+
+// probeCapabilities sends a few queries to a server to find out what it actually supports
+func (proxy *Proxy) probeCapabilities(serverInfo *ServerInfo) *ServerCapabilities {
+	capabilities := ServerCapabilities{Probed: time.Now()}
+	start := time.Now()
+	msg := proxy.capabilitiesExchange(serverInfo, capabilitiesProbeQuery(".", dns.TypeDNSKEY), "udp")
+	capabilities.RTT = int(time.Since(start).Milliseconds())
+	if msg != nil {
+		if opt := msg.IsEdns0(); opt != nil {
+			capabilities.EDNS = true
+			capabilities.EDNSBufferSize = opt.UDPSize()
+		}
+		for _, rr := range msg.Answer {
+			if rr.Header().Rrtype == dns.TypeRRSIG {
+				capabilities.DNSSECRecords = true
+			}
+		}
+	}
+	if msg := proxy.capabilitiesExchange(serverInfo, capabilitiesProbeQuery(CapabilitiesBogusName, dns.TypeA), "udp"); msg != nil {
+		capabilities.DNSSECValidation = msg.Rcode == dns.RcodeServerFailure
+	}
+	switch serverInfo.Proto {
+	case stamps.StampProtoTypeDNSCrypt, stamps.StampProtoTypePlain:
+		capabilities.TCP = proxy.capabilitiesExchange(serverInfo, capabilitiesProbeQuery(".", dns.TypeNS), "tcp") != nil
+	default:
+		capabilities.TCP = true
+	}
+	return &capabilities
+}
+
+// probeAllCapabilities probes the live servers that haven't been probed recently
+func (serversInfo *ServersInfo) probeAllCapabilities(proxy *Proxy) {
+	serversInfo.RLock()
+	servers := make([]*ServerInfo, 0, len(serversInfo.inner))
+	for _, serverInfo := range serversInfo.inner {
+		if capabilities, ok := serversInfo.capabilities[serverInfo.Name]; !ok || time.Since(capabilities.Probed) > CapabilitiesTTL {
+			servers = append(servers, serverInfo)
+		}
+	}
+	registeredServers := serversInfo.registeredServers
+	serversInfo.RUnlock()
+	for _, serverInfo := range servers {
+		capabilities := proxy.probeCapabilities(serverInfo)
+		serversLog.Debugf("[%s] capabilities: EDNS: %v (%d bytes) - DNSSEC records: %v - DNSSEC validation: %v - TCP: %v",
+			serverInfo.Name, capabilities.EDNS, capabilities.EDNSBufferSize, capabilities.DNSSECRecords,
+			capabilities.DNSSECValidation, capabilities.TCP)
+		for _, registeredServer := range registeredServers {
+			if registeredServer.name == serverInfo.Name &&
+				registeredServer.stamp.Props&stamps.ServerInformalPropertyDNSSEC != 0 && !capabilities.DNSSECRecords {
+				serversLog.Warnf("[%s] is supposed to support DNSSEC, but didn't return any signatures", serverInfo.Name)
+			}
+		}
+		serversInfo.Lock()
+		serversInfo.capabilities[serverInfo.Name] = capabilities
+		serversInfo.Unlock()
+	}
+}
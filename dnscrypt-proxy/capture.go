@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	pcapMagic         = 0xa1b2c3d4
+	pcapLinkTypeRaw   = 101
+	pcapSnapLen       = 65535
+	captureDNSPort    = 53
+	captureClientPort = 0
+)
+
+// PacketCapture writes DNS queries and responses matching a filter to a pcap file, for a limited time.
+// Queries received over TCP or DoH are written as UDP packets.
+type PacketCapture struct {
+	sync.Mutex
+	fileName     string
+	maxDuration  time.Duration
+	maxPackets   int
+	active       int32
+	fp           *os.File
+	writer       *bufio.Writer
+	until        time.Time
+	domainSuffix string
+	clientIPStr  string
+	blockedOnly  bool
+	packets      int
+}
+
+type PacketCaptureStatus struct {
+	Active       bool      `json:"active"`
+	File         string    `json:"file"`
+	Until        time.Time `json:"until,omitempty"`
+	DomainSuffix string    `json:"suffix,omitempty"`
+	ClientIP     string    `json:"client,omitempty"`
+	BlockedOnly  bool      `json:"blocked_only,omitempty"`
+	Packets      int       `json:"packets"`
+}
+
+func NewPacketCapture(fileName string, maxDuration time.Duration, maxPackets int) *PacketCapture {
+	return &PacketCapture{fileName: fileName, maxDuration: maxDuration, maxPackets: maxPackets}
+}
+
+func (capture *PacketCapture) Active() bool {
+	return capture != nil && atomic.LoadInt32(&capture.active) != 0
+}
+
+func (capture *PacketCapture) Start(duration time.Duration, domainSuffix string, clientIPStr string, blockedOnly bool) error {
+	if duration <= 0 || duration > capture.maxDuration {
+		duration = capture.maxDuration
+	}
+	if len(clientIPStr) > 0 && net.ParseIP(clientIPStr) == nil {
+		return errors.New("Invalid client IP address")
+	}
+	capture.Lock()
+	defer capture.Unlock()
+	capture.stop()
+	fp, err := os.OpenFile(capture.fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	capture.fp, capture.writer = fp, bufio.NewWriter(fp)
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:24], pcapLinkTypeRaw)
+	capture.writer.Write(header[:])
+	capture.until = time.Now().Add(duration)
+	capture.domainSuffix = strings.TrimSuffix(strings.ToLower(domainSuffix), ".")
+	capture.clientIPStr = clientIPStr
+	capture.blockedOnly = blockedOnly
+	capture.packets = 0
+	atomic.StoreInt32(&capture.active, 1)
+	dlog.Noticef("Capturing DNS packets to [%s] for %v", capture.fileName, duration)
+	return nil
+}
+
+func (capture *PacketCapture) Stop() {
+	capture.Lock()
+	capture.stop()
+	capture.Unlock()
+}
+
+func (capture *PacketCapture) stop() {
+	if atomic.LoadInt32(&capture.active) == 0 {
+		return
+	}
+	atomic.StoreInt32(&capture.active, 0)
+	capture.writer.Flush()
+	capture.fp.Close()
+	capture.fp, capture.writer = nil, nil
+	dlog.Noticef("Packet capture stopped - %d packets written to [%s]", capture.packets, capture.fileName)
+}
+
+func (capture *PacketCapture) Status() PacketCaptureStatus {
+	capture.Lock()
+	defer capture.Unlock()
+	status := PacketCaptureStatus{File: capture.fileName, Packets: capture.packets}
+	if capture.Active() {
+		status.Active = true
+		status.Until = capture.until
+		status.DomainSuffix = capture.domainSuffix
+		status.ClientIP = capture.clientIPStr
+		status.BlockedOnly = capture.blockedOnly
+	}
+	return status
+}
+
+// Record writes a query and its response, if they match the current filter
+func (capture *PacketCapture) Record(clientIP net.IP, serverIP net.IP, qName string, blocked bool, query []byte, response []byte) {
+	if !capture.Active() || clientIP == nil {
+		return
+	}
+	capture.Lock()
+	defer capture.Unlock()
+	if !capture.Active() {
+		return
+	}
+	now := time.Now()
+	if now.After(capture.until) || (capture.maxPackets > 0 && capture.packets >= capture.maxPackets) {
+		capture.stop()
+		return
+	}
+	if capture.blockedOnly && !blocked {
+		return
+	}
+	if len(capture.clientIPStr) > 0 && capture.clientIPStr != clientIP.String() {
+		return
+	}
+	if len(capture.domainSuffix) > 0 && qName != capture.domainSuffix && !strings.HasSuffix(qName, "."+capture.domainSuffix) {
+		return
+	}
+	if serverIP == nil || serverIP.IsUnspecified() || (serverIP.To4() == nil) != (clientIP.To4() == nil) {
+		if clientIP.To4() != nil {
+			serverIP = net.IPv4(127, 0, 0, 1)
+		} else {
+			serverIP = net.IPv6loopback
+		}
+	}
+	if len(query) > 0 {
+		capture.writePacket(now, clientIP, serverIP, captureClientPort, captureDNSPort, query)
+	}
+	if len(response) > 0 {
+		capture.writePacket(now, serverIP, clientIP, captureDNSPort, captureClientPort, response)
+	}
+	capture.writer.Flush()
+}
+
+func (capture *PacketCapture) writePacket(ts time.Time, srcIP, dstIP net.IP, srcPort, dstPort uint16, payload []byte) {
+	udpLen := 8 + len(payload)
+	var ipHeader []byte
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		ipHeader = make([]byte, 20)
+		ipHeader[0] = 0x45
+		binary.BigEndian.PutUint16(ipHeader[2:4], uint16(20+udpLen))
+		ipHeader[8] = 64
+		ipHeader[9] = 17
+		copy(ipHeader[12:16], src4)
+		copy(ipHeader[16:20], dst4)
+		var sum uint32
+		for i := 0; i < 20; i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(ipHeader[i : i+2]))
+		}
+		for sum > 0xffff {
+			sum = (sum >> 16) + (sum & 0xffff)
+		}
+		binary.BigEndian.PutUint16(ipHeader[10:12], ^uint16(sum))
+	} else {
+		ipHeader = make([]byte, 40)
+		ipHeader[0] = 0x60
+		binary.BigEndian.PutUint16(ipHeader[4:6], uint16(udpLen))
+		ipHeader[6] = 17
+		ipHeader[7] = 64
+		copy(ipHeader[8:24], srcIP.To16())
+		copy(ipHeader[24:40], dstIP.To16())
+	}
+	// The UDP checksum is left empty
+	var udpHeader [8]byte
+	binary.BigEndian.PutUint16(udpHeader[0:2], srcPort)
+	binary.BigEndian.PutUint16(udpHeader[2:4], dstPort)
+	binary.BigEndian.PutUint16(udpHeader[4:6], uint16(udpLen))
+
+	packetLen := len(ipHeader) + udpLen
+	var recordHeader [16]byte
+	binary.LittleEndian.PutUint32(recordHeader[0:4], uint32(ts.Unix()))
+	binary.LittleEndian.PutUint32(recordHeader[4:8], uint32(ts.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(recordHeader[8:12], uint32(packetLen))
+	binary.LittleEndian.PutUint32(recordHeader[12:16], uint32(packetLen))
+	capture.writer.Write(recordHeader[:])
+	capture.writer.Write(ipHeader)
+	capture.writer.Write(udpHeader[:])
+	capture.writer.Write(payload)
+	capture.packets++
+}
+
+// ServeHTTP starts (POST), stops (DELETE) or returns the status of a capture
+func (capture *PacketCapture) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "POST":
+		query := request.URL.Query()
+		duration, _ := strconv.Atoi(query.Get("duration"))
+		blockedOnly := query.Get("blocked") == "1" || query.Get("blocked") == "true"
+		if err := capture.Start(time.Duration(duration)*time.Second, query.Get("suffix"), query.Get("client"), blockedOnly); err != nil {
+			writer.WriteHeader(400)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+	case "DELETE":
+		capture.Stop()
+	case "GET":
+	default:
+		writer.WriteHeader(405)
+		return
+	}
+	body, err := json.MarshalIndent(capture.Status(), "", " ")
+	writeJSONResponse(writer, body, err)
+}
+
+func (proxy *Proxy) captureExchange(pluginsState *PluginsState, clientPc net.Conn, query []byte, response []byte) {
+	clientIP, ok := ExtractClientIP(pluginsState)
+	if !ok {
+		return
+	}
+	var serverIP net.IP
+	if clientPc != nil {
+		switch localAddr := clientPc.LocalAddr().(type) {
+		case *net.UDPAddr:
+			serverIP = localAddr.IP
+		case *net.TCPAddr:
+			serverIP = localAddr.IP
+		}
+	}
+	if pluginsState.clientProto == "tcp" && len(response) >= 2 {
+		response = response[2:]
+	}
+	blocked := pluginsState.returnCode == PluginsReturnCodeReject
+	proxy.capture.Record(clientIP, serverIP, pluginsState.qName, blocked, query, response)
+}
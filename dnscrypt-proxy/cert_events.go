@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	CertEventFetched  = "fetched"
+	CertEventRotated  = "rotated"
+	CertEventRejected = "rejected"
+	CertEventExpiring = "expiring"
+)
+
+type CertState struct {
+	ProviderName string    `json:"provider_name"`
+	Serial       uint32    `json:"serial"`
+	ValidFrom    time.Time `json:"valid_from"`
+	ValidUntil   time.Time `json:"valid_until"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	Rotations    uint64    `json:"rotations"`
+}
+
+type CertEventsReport struct {
+	Counters map[string]uint64     `json:"counters"`
+	Servers  map[string]*CertState `json:"servers"`
+}
+
+// CertEvents keeps track of DNSCrypt certificates: fetches, rotations, rejections and upcoming expirations.
+// Events are optionally written to a log file, and counters are exposed by the monitoring server.
+type CertEvents struct {
+	sync.Mutex
+	logger   io.Writer
+	format   string
+	counters map[string]uint64
+	servers  map[string]*CertState
+}
+
+func NewCertEvents(proxy *Proxy) *CertEvents {
+	certEvents := &CertEvents{
+		format:   proxy.certLogFormat,
+		counters: make(map[string]uint64),
+		servers:  make(map[string]*CertState),
+	}
+	if len(proxy.certLogFile) > 0 {
+		certEvents.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.logRotation, proxy.logCompression, proxy.certLogFile)
+	}
+	return certEvents
+}
+
+// Rejected records a certificate that cannot be used
+func (certEvents *CertEvents) Rejected(serverName string, providerName string, serial uint32, tsBegin uint32, tsEnd uint32, reason string) {
+	certEvents.event(CertEventRejected, serverName, providerName, serial, tsBegin, tsEnd, reason)
+}
+
+// Expiring records a certificate that will expire soon
+func (certEvents *CertEvents) Expiring(serverName string, providerName string, serial uint32, tsBegin uint32, tsEnd uint32) {
+	certEvents.event(CertEventExpiring, serverName, providerName, serial, tsBegin, tsEnd, "")
+}
+
+// Selected records the certificate that was retained for a server, and whether it replaces a different one
+func (certEvents *CertEvents) Selected(serverName string, providerName string, serial uint32, tsBegin uint32, tsEnd uint32) {
+	if certEvents == nil {
+		return
+	}
+	certEvents.Lock()
+	state, found := certEvents.servers[serverName]
+	rotated := found && (state.Serial != serial || state.ProviderName != providerName)
+	if !found {
+		state = &CertState{}
+		certEvents.servers[serverName] = state
+	}
+	state.ProviderName = providerName
+	state.Serial = serial
+	state.ValidFrom = time.Unix(int64(tsBegin), 0)
+	state.ValidUntil = time.Unix(int64(tsEnd), 0)
+	state.FetchedAt = time.Now()
+	if rotated {
+		state.Rotations++
+	}
+	certEvents.Unlock()
+	certEvents.event(CertEventFetched, serverName, providerName, serial, tsBegin, tsEnd, "")
+	if rotated {
+		certEvents.event(CertEventRotated, serverName, providerName, serial, tsBegin, tsEnd, "")
+	}
+}
+
+func (certEvents *CertEvents) event(event string, serverName string, providerName string, serial uint32, tsBegin uint32, tsEnd uint32, reason string) {
+	if certEvents == nil {
+		return
+	}
+	certEvents.Lock()
+	certEvents.counters[event]++
+	certEvents.Unlock()
+	if certEvents.logger == nil {
+		return
+	}
+	validity := func(ts uint32) string {
+		if ts == 0 {
+			return "-"
+		}
+		return time.Unix(int64(ts), 0).UTC().Format(time.RFC3339)
+	}
+	if len(reason) == 0 {
+		reason = "-"
+	}
+	var line string
+	if certEvents.format == "tsv" {
+		now := time.Now()
+		year, month, day := now.Date()
+		hour, minute, second := now.Clock()
+		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
+		line = fmt.Sprintf("%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			tsStr, event, StringQuote(serverName), StringQuote(providerName), serial, validity(tsBegin), validity(tsEnd), StringQuote(reason))
+	} else {
+		line = fmt.Sprintf("time:%d\tevent:%s\tserver:%s\tprovider:%s\tserial:%d\tvalid_from:%s\tvalid_until:%s\treason:%s\n",
+			time.Now().Unix(), event, StringQuote(serverName), StringQuote(providerName), serial, validity(tsBegin), validity(tsEnd), StringQuote(reason))
+	}
+	_, _ = certEvents.logger.Write([]byte(line))
+}
+
+func (certEvents *CertEvents) Report() CertEventsReport {
+	certEvents.Lock()
+	defer certEvents.Unlock()
+	report := CertEventsReport{Counters: make(map[string]uint64), Servers: make(map[string]*CertState)}
+	for _, event := range []string{CertEventFetched, CertEventRotated, CertEventRejected, CertEventExpiring} {
+		report.Counters[event] = certEvents.counters[event]
+	}
+	for name, state := range certEvents.servers {
+		stateCopy := *state
+		report.Servers[name] = &stateCopy
+	}
+	return report
+}
+
+func (certEvents *CertEvents) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	body, err := json.MarshalIndent(certEvents.Report(), "", " ")
+	writeJSONResponse(writer, body, err)
+}
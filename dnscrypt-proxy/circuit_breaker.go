@@ -0,0 +1,135 @@
+package main
+
+import (
+	"time"
+)
+
+// CircuitBreaker stops sending queries to servers failing too many of them. The circuit of a server is opened
+// when its error rate exceeds a threshold, and the server isn't used any more during a cool-down period.
+// The next query it receives afterwards is a probe: if it succeeds, the circuit is closed, otherwise the
+// circuit is opened again, for twice as long.
+type CircuitBreaker struct {
+	errorRate   float64
+	minQueries  int
+	window      time.Duration
+	cooldown    time.Duration
+	maxCooldown time.Duration
+}
+
+// serverCircuit is the state of the circuit of a server, protected by the ServersInfo lock
+type serverCircuit struct {
+	open        bool
+	probing     bool
+	openUntil   time.Time
+	openings    int // Consecutive openings, to compute the cool-down period
+	windowStart time.Time
+	successes   int
+	failures    int
+}
+
+func NewCircuitBreaker(config CircuitBreakerConfig) *CircuitBreaker {
+	if config.ErrorRate <= 0 {
+		return nil
+	}
+	return &CircuitBreaker{
+		errorRate:   float64(Min(100, config.ErrorRate)) / 100.0,
+		minQueries:  Max(1, config.MinQueries),
+		window:      time.Duration(Max(1, config.Window)) * time.Second,
+		cooldown:    time.Duration(Max(1, config.Cooldown)) * time.Second,
+		maxCooldown: time.Duration(Max(Max(1, config.Cooldown), config.MaxCooldown)) * time.Second,
+	}
+}
+
+func (circuitBreaker *CircuitBreaker) cooldownFor(openings int) time.Duration {
+	cooldown := circuitBreaker.cooldown
+	for i := 1; i < openings && cooldown < circuitBreaker.maxCooldown; i++ {
+		cooldown *= 2
+	}
+	return min(cooldown, circuitBreaker.maxCooldown)
+}
+
+// available returns false if queries must not be sent to the server
+func (circuit *serverCircuit) available(now time.Time) bool {
+	return !circuit.open || !now.Before(circuit.openUntil)
+}
+
+// record updates the circuit with the outcome of a query, and returns true if the circuit was opened or closed
+func (circuit *serverCircuit) record(circuitBreaker *CircuitBreaker, success bool, now time.Time) bool {
+	if circuit.open {
+		if !circuit.probing && now.Before(circuit.openUntil) {
+			// Response to a query sent before the circuit was opened
+			return false
+		}
+		circuit.probing = false
+		if success {
+			circuit.open = false
+			circuit.windowStart, circuit.successes, circuit.failures = now, 0, 0
+			return true
+		}
+		circuit.openings++
+		circuit.openUntil = now.Add(circuitBreaker.cooldownFor(circuit.openings))
+		return false
+	}
+	if now.Sub(circuit.windowStart) >= circuitBreaker.window {
+		if circuit.failures == 0 || float64(circuit.failures) < circuitBreaker.errorRate*float64(circuit.successes+circuit.failures) {
+			circuit.openings = 0
+		}
+		circuit.windowStart, circuit.successes, circuit.failures = now, 0, 0
+	}
+	if success {
+		circuit.successes++
+		return false
+	}
+	circuit.failures++
+	total := circuit.successes + circuit.failures
+	if total < circuitBreaker.minQueries || float64(circuit.failures) < circuitBreaker.errorRate*float64(total) {
+		return false
+	}
+	circuit.open = true
+	circuit.openings++
+	circuit.openUntil = now.Add(circuitBreaker.cooldownFor(circuit.openings))
+	return true
+}
+
+// noticeCircuit records the outcome of a query; it must be called with the lock held
+func (serversInfo *ServersInfo) noticeCircuit(name string, success bool) {
+	circuitBreaker := serversInfo.circuitBreaker
+	if circuitBreaker == nil {
+		return
+	}
+	now := time.Now()
+	circuit, ok := serversInfo.circuits[name]
+	if !ok {
+		circuit = &serverCircuit{windowStart: now}
+		serversInfo.circuits[name] = circuit
+	}
+	if !circuit.record(circuitBreaker, success, now) {
+		return
+	}
+	if circuit.open {
+		serversInfo.openCircuits++
+		serversLog.Warnf("[%s] is failing too many queries - not using it for %v", name, circuit.openUntil.Sub(now).Round(time.Second))
+	} else {
+		serversInfo.openCircuits--
+		serversLog.Noticef("[%s] is responding again", name)
+	}
+}
+
+// circuitAvailable returns false if the circuit of a server is open; it must be called with the lock held
+func (serversInfo *ServersInfo) circuitAvailable(name string, now time.Time) bool {
+	circuit, ok := serversInfo.circuits[name]
+	return !ok || circuit.available(now)
+}
+
+// startProbe marks a server whose cool-down period has elapsed as being probed, so that it only receives
+// a single query until the outcome of that query is known; it must be called with the write lock held
+func (serversInfo *ServersInfo) startProbe(name string, now time.Time) {
+	circuit, ok := serversInfo.circuits[name]
+	if !ok || !circuit.open || now.Before(circuit.openUntil) {
+		return
+	}
+	circuit.probing = true
+	// Try again later if the probe never completes
+	circuit.openUntil = now.Add(serversInfo.circuitBreaker.cooldown)
+	serversLog.Infof("[%s] Sending a probe query", name)
+}
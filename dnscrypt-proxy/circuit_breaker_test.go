@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	c := check.T(t)
+	c.Nil(NewCircuitBreaker(CircuitBreakerConfig{}))
+	circuitBreaker := NewCircuitBreaker(CircuitBreakerConfig{ErrorRate: 50, MinQueries: 4, Window: 60, Cooldown: 10, MaxCooldown: 30})
+	c.EQ(circuitBreaker.cooldownFor(1), 10*time.Second)
+	c.EQ(circuitBreaker.cooldownFor(2), 20*time.Second)
+	c.EQ(circuitBreaker.cooldownFor(5), 30*time.Second)
+
+	now := time.Now()
+	circuit := serverCircuit{windowStart: now}
+	c.False(circuit.record(circuitBreaker, true, now))
+	c.False(circuit.record(circuitBreaker, false, now))
+	c.False(circuit.record(circuitBreaker, true, now))
+	c.True(circuit.available(now))
+	c.True(circuit.record(circuitBreaker, false, now))
+	c.True(circuit.open)
+	c.False(circuit.available(now.Add(5 * time.Second)))
+
+	// Late responses don't change the state during the cool-down period
+	c.False(circuit.record(circuitBreaker, true, now.Add(5*time.Second)))
+	c.True(circuit.open)
+
+	// A failed probe opens the circuit for twice as long
+	now = now.Add(10 * time.Second)
+	c.True(circuit.available(now))
+	c.False(circuit.record(circuitBreaker, false, now))
+	c.False(circuit.available(now.Add(19 * time.Second)))
+	now = now.Add(20 * time.Second)
+	c.True(circuit.available(now))
+	c.True(circuit.record(circuitBreaker, true, now))
+	c.False(circuit.open)
+	c.EQ(circuit.openings, 2)
+}
+
+func TestServersInfoCircuits(t *testing.T) {
+	c := check.T(t)
+	serversInfo := NewServersInfo()
+	serversInfo.circuitBreaker = NewCircuitBreaker(CircuitBreakerConfig{ErrorRate: 50, MinQueries: 2, Window: 60, Cooldown: 10, MaxCooldown: 30})
+	serversInfo.noticeCircuit("failing", false)
+	c.False(serversInfo.isDown("failing"))
+	serversInfo.noticeCircuit("failing", false)
+	c.True(serversInfo.isDown("failing"))
+	c.EQ(serversInfo.openCircuits, 1)
+	c.False(serversInfo.isDown("other"))
+
+	serversInfo.circuits["failing"].openUntil = time.Now()
+	c.False(serversInfo.isDown("failing"))
+	serversInfo.startProbe("failing", time.Now())
+	c.True(serversInfo.isDown("failing"))
+	serversInfo.noticeCircuit("failing", true)
+	c.False(serversInfo.isDown("failing"))
+	c.EQ(serversInfo.openCircuits, 0)
+}
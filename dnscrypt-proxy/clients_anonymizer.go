@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/hmac"
+	crypto_rand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+type ClientsAnonymizerMode int
+
+const (
+	ClientsAnonymizerModeNone ClientsAnonymizerMode = iota
+	ClientsAnonymizerModeTruncate
+	ClientsAnonymizerModeHMAC
+)
+
+const (
+	DefaultAnonymizedIPv4PrefixLen = 24
+	DefaultAnonymizedIPv6PrefixLen = 56
+)
+
+type ClientsAnonymizer struct {
+	mode          ClientsAnonymizerMode
+	ipv4PrefixLen int
+	ipv6PrefixLen int
+	key           []byte
+}
+
+// NewClientsAnonymizer returns nil if client addresses don't need to be anonymized.
+// An empty key for the 'hmac' mode causes a random key to be generated, so that
+// pseudonyms are only stable for the lifetime of the process.
+func NewClientsAnonymizer(modeStr string, ipv4PrefixLen int, ipv6PrefixLen int, keyStr string) (*ClientsAnonymizer, error) {
+	anonymizer := ClientsAnonymizer{ipv4PrefixLen: ipv4PrefixLen, ipv6PrefixLen: ipv6PrefixLen}
+	switch strings.ToLower(modeStr) {
+	case "", "none":
+		return nil, nil
+	case "truncate":
+		anonymizer.mode = ClientsAnonymizerModeTruncate
+		if ipv4PrefixLen < 0 || ipv4PrefixLen > 32 {
+			return nil, fmt.Errorf("Invalid IPv4 prefix length for client anonymization: [%d]", ipv4PrefixLen)
+		}
+		if ipv6PrefixLen < 0 || ipv6PrefixLen > 128 {
+			return nil, fmt.Errorf("Invalid IPv6 prefix length for client anonymization: [%d]", ipv6PrefixLen)
+		}
+	case "hmac":
+		anonymizer.mode = ClientsAnonymizerModeHMAC
+		if len(keyStr) > 0 {
+			anonymizer.key = []byte(keyStr)
+		} else {
+			anonymizer.key = make([]byte, 32)
+			if _, err := crypto_rand.Read(anonymizer.key); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported client anonymization mode: [%s]", modeStr)
+	}
+	return &anonymizer, nil
+}
+
+func (anonymizer *ClientsAnonymizer) Anonymize(ip net.IP) string {
+	if anonymizer == nil || ip == nil {
+		return ip.String()
+	}
+	switch anonymizer.mode {
+	case ClientsAnonymizerModeTruncate:
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ipv4.Mask(net.CIDRMask(anonymizer.ipv4PrefixLen, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(anonymizer.ipv6PrefixLen, 128)).String()
+	case ClientsAnonymizerModeHMAC:
+		if ipv4 := ip.To4(); ipv4 != nil {
+			ip = ipv4
+		}
+		h := hmac.New(sha256.New, anonymizer.key)
+		h.Write(ip)
+		return "anon-" + hex.EncodeToString(h.Sum(nil)[:8])
+	}
+	return ip.String()
+}
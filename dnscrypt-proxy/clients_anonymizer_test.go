@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestClientsAnonymizerTruncate(t *testing.T) {
+	c := check.T(t)
+	anonymizer, err := NewClientsAnonymizer("truncate", 24, 56, "")
+	c.Nil(err)
+	c.Equal(anonymizer.Anonymize(net.ParseIP("192.0.2.123")), "192.0.2.0")
+	c.Equal(anonymizer.Anonymize(net.ParseIP("2001:db8:1234:5678::1")), "2001:db8:1234:5600::")
+}
+
+func TestClientsAnonymizerHMAC(t *testing.T) {
+	c := check.T(t)
+	anonymizer, err := NewClientsAnonymizer("hmac", 0, 0, "secret")
+	c.Nil(err)
+	pseudonym := anonymizer.Anonymize(net.ParseIP("192.0.2.123"))
+	c.True(strings.HasPrefix(pseudonym, "anon-"))
+	c.Equal(anonymizer.Anonymize(net.ParseIP("192.0.2.123")), pseudonym)
+	c.NotEqual(anonymizer.Anonymize(net.ParseIP("192.0.2.124")), pseudonym)
+}
+
+func TestClientsAnonymizerNone(t *testing.T) {
+	c := check.T(t)
+	anonymizer, err := NewClientsAnonymizer("none", 24, 56, "")
+	c.Nil(err)
+	c.Equal(anonymizer.Anonymize(net.ParseIP("192.0.2.123")), "192.0.2.123")
+	_, err = NewClientsAnonymizer("bogus", 24, 56, "")
+	c.NotNil(err)
+}
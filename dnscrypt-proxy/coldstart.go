@@ -117,6 +117,7 @@ func handleColdStartClient(clientPc *net.UDPConn, cancelChannel chan struct{}, i
 }
 
 func addColdStartListener(
+	proxy *Proxy,
 	ipsMap *CaptivePortalMap,
 	listenAddrStr string,
 	captivePortalHandler *CaptivePortalHandler,
@@ -130,7 +131,7 @@ func addColdStartListener(
 	if err != nil {
 		return err
 	}
-	clientPc, err := net.ListenUDP(network, listenUDPAddr)
+	clientPc, err := proxy.listenUDP(network, listenUDPAddr)
 	if err != nil {
 		return err
 	}
@@ -190,7 +191,7 @@ func ColdStart(proxy *Proxy) (*CaptivePortalHandler, error) {
 	}
 	ok := false
 	for _, listenAddrStr := range listenAddrStrs {
-		err = addColdStartListener(&ipsMap, listenAddrStr, &captivePortalHandler)
+		err = addColdStartListener(proxy, &ipsMap, listenAddrStr, &captivePortalHandler)
 		if err == nil {
 			ok = true
 		}
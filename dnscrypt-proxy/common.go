@@ -4,14 +4,18 @@
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"net"
 	"os"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unicode"
 
 	"github.com/jedisct1/dlog"
+	"golang.org/x/net/idna"
 )
 
 type CryptoConstruction uint16
@@ -60,26 +64,46 @@ func PrefixWithSize(packet []byte) ([]byte, error) {
 	return packet, nil
 }
 
+// Buffers used to receive packets, instead of allocating a large buffer for every query and every response.
+// Responses are copied out of them. Queries received over UDP are processed in place, and their buffer is
+// returned to the pool once they have been answered.
+var packetBufferPool = sync.Pool{
+	New: func() any {
+		buffer := make([]byte, 2+MaxDNSPacketSize)
+		return &buffer
+	},
+}
+
+func getPacketBuffer() *[]byte {
+	return packetBufferPool.Get().(*[]byte)
+}
+
+func putPacketBuffer(buffer *[]byte) {
+	packetBufferPool.Put(buffer)
+}
+
 func ReadPrefixed(conn *net.Conn) ([]byte, error) {
-	buf := make([]byte, 2+MaxDNSPacketSize)
+	buffer := getPacketBuffer()
+	defer putPacketBuffer(buffer)
+	buf := *buffer
 	packetLength, pos := -1, 0
 	for {
 		readnb, err := (*conn).Read(buf[pos:])
 		if err != nil {
-			return buf, err
+			return nil, err
 		}
 		pos += readnb
 		if pos >= 2 && packetLength < 0 {
 			packetLength = int(binary.BigEndian.Uint16(buf[0:2]))
 			if packetLength > MaxDNSPacketSize-1 {
-				return buf, errors.New("Packet too large")
+				return nil, errors.New("Packet too large")
 			}
 			if packetLength < MinDNSPacketSize {
-				return buf, errors.New("Packet too short")
+				return nil, errors.New("Packet too short")
 			}
 		}
 		if packetLength >= 0 && pos >= 2+packetLength {
-			return buf[2 : 2+packetLength], nil
+			return append([]byte{}, buf[2:2+packetLength]...), nil
 		}
 	}
 }
@@ -126,6 +150,24 @@ func StringQuote(str string) string {
 	return str[1 : len(str)-1]
 }
 
+// Set when names should be written to logs in their Unicode form
+var logUnicodeNames atomic.Bool
+
+// NameQuote returns a domain name suitable for logging.
+// Non-printable characters are always escaped. If log_unicode_names is set,
+// IDNA labels are decoded first; names that are not valid IDNs are left as-is.
+func NameQuote(name string) string {
+	if logUnicodeNames.Load() && strings.Contains(name, "xn--") {
+		if decoded, err := idna.Lookup.ToUnicode(strings.TrimSuffix(name, ".")); err == nil {
+			if strings.HasSuffix(name, ".") {
+				decoded += "."
+			}
+			name = decoded
+		}
+	}
+	return StringQuote(name)
+}
+
 func StringStripSpaces(str string) string {
 	return strings.Map(func(r rune) rune {
 		if unicode.IsSpace(r) {
@@ -195,3 +237,22 @@ func WarnIfMaybeWritableByOtherUsers(p string) {
 		dlog.Warnf("Error while checking if [%s] is accessible: [%s] : [%s]", p, px, err)
 	}
 }
+
+// ReadSecret returns a value, or reads it from an environment variable (`env:NAME`) or from a file (`file:/path`)
+func ReadSecret(value string) (string, error) {
+	if name, ok := strings.CutPrefix(value, "env:"); ok {
+		secret, found := os.LookupEnv(name)
+		if !found {
+			return "", fmt.Errorf("Environment variable [%s] is not set", name)
+		}
+		return secret, nil
+	}
+	if fileName, ok := strings.CutPrefix(value, "file:"); ok {
+		secret, err := os.ReadFile(fileName)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(secret)), nil
+	}
+	return value, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// CompressionCodec compresses rotated log files and cached sources.
+// Compressed data is recognized by its magic number, so that files can always be read back,
+// even after the codec has been changed.
+type CompressionCodec struct {
+	name      string
+	extension string
+	magic     []byte
+	newWriter func(w io.Writer) (io.WriteCloser, error)
+	newReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var compressionCodecs = map[string]*CompressionCodec{
+	CompressionGzip: {
+		name:      CompressionGzip,
+		extension: ".gz",
+		magic:     []byte{0x1f, 0x8b},
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	CompressionZstd: {
+		name:      CompressionZstd,
+		extension: ".zst",
+		magic:     []byte{0x28, 0xb5, 0x2f, 0xfd},
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	},
+}
+
+// CompressionCodecByName returns nil for `none`
+func CompressionCodecByName(name string) (*CompressionCodec, error) {
+	if name == CompressionNone {
+		return nil, nil
+	}
+	codec, ok := compressionCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported compression codec: [%s]", name)
+	}
+	return codec, nil
+}
+
+// Extension returns the extension of the compressed files, or an empty string if files are not compressed
+func (codec *CompressionCodec) Extension() string {
+	if codec == nil {
+		return ""
+	}
+	return codec.extension
+}
+
+func (codec *CompressionCodec) Compress(bin []byte) ([]byte, error) {
+	if codec == nil {
+		return bin, nil
+	}
+	var buf bytes.Buffer
+	w, err := codec.newWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(bin); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress returns data as is, unless it starts with the magic number of a known codec
+func Decompress(bin []byte, maxLength int64) ([]byte, error) {
+	for _, codec := range compressionCodecs {
+		if !bytes.HasPrefix(bin, codec.magic) {
+			continue
+		}
+		r, err := codec.newReader(bytes.NewReader(bin))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(io.LimitReader(r, maxLength))
+	}
+	return bin, nil
+}
+
+// CompressFile replaces a file with a compressed version, whose name has the extension of the codec
+func (codec *CompressionCodec) CompressFile(fileName string) error {
+	if codec == nil {
+		return nil
+	}
+	in, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	compressedFileName := fileName + codec.extension
+	out, err := os.OpenFile(compressedFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	w, err := codec.newWriter(out)
+	if err == nil {
+		if _, err = io.Copy(w, in); err == nil {
+			err = w.Close()
+		}
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(compressedFileName)
+		return err
+	}
+	return os.Remove(fileName)
+}
@@ -12,8 +12,11 @@
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/BurntSushi/toml"
@@ -28,40 +31,97 @@
 )
 
 type Config struct {
-	LogLevel                 int            `toml:"log_level"`
-	LogFile                  *string        `toml:"log_file"`
-	LogFileLatest            bool           `toml:"log_file_latest"`
-	UseSyslog                bool           `toml:"use_syslog"`
-	ServerNames              []string       `toml:"server_names"`
-	DisabledServerNames      []string       `toml:"disabled_server_names"`
-	ListenAddresses          []string       `toml:"listen_addresses"`
-	LocalDoH                 LocalDoHConfig `toml:"local_doh"`
-	UserName                 string         `toml:"user_name"`
-	ForceTCP                 bool           `toml:"force_tcp"`
-	HTTP3                    bool           `toml:"http3"`
-	Timeout                  int            `toml:"timeout"`
-	KeepAlive                int            `toml:"keepalive"`
-	Proxy                    string         `toml:"proxy"`
-	CertRefreshConcurrency   int            `toml:"cert_refresh_concurrency"`
-	CertRefreshDelay         int            `toml:"cert_refresh_delay"`
-	CertIgnoreTimestamp      bool           `toml:"cert_ignore_timestamp"`
-	EphemeralKeys            bool           `toml:"dnscrypt_ephemeral_keys"`
-	LBStrategy               string         `toml:"lb_strategy"`
-	LBEstimator              bool           `toml:"lb_estimator"`
-	BlockIPv6                bool           `toml:"block_ipv6"`
-	BlockUnqualified         bool           `toml:"block_unqualified"`
-	BlockUndelegated         bool           `toml:"block_undelegated"`
+	LogLevel                 int                              `toml:"log_level"`
+	LogFile                  *string                          `toml:"log_file"`
+	LogFileLatest            bool                             `toml:"log_file_latest"`
+	UseSyslog                bool                             `toml:"use_syslog"`
+	ServerNames              []string                         `toml:"server_names"`
+	DisabledServerNames      []string                         `toml:"disabled_server_names"`
+	ListenAddresses          []string                         `toml:"listen_addresses"`
+	TransparentAddresses     []string                         `toml:"transparent_listen_addresses"`
+	LocalDoH                 LocalDoHConfig                   `toml:"local_doh"`
+	LocalDNSCrypt            LocalDNSCryptConfig              `toml:"local_dnscrypt"`
+	LocalUnix                LocalUnixConfig                  `toml:"local_unix"`
+	ListenerACLs             map[string]ListenerACLConfig     `toml:"listener_acls"`
+	ListenerProfiles         map[string]ListenerProfileConfig `toml:"listener_profiles"`
+	ProxyProtocolFrontends   []string                         `toml:"proxy_protocol_frontends"`
+	ListenInterface          string                           `toml:"listen_interface"`
+	OutboundInterface        string                           `toml:"outbound_interface"`
+	UserName                 string                           `toml:"user_name"`
+	ForceTCP                 bool                             `toml:"force_tcp"`
+	HTTP3                    bool                             `toml:"http3"`
+	Timeout                  int                              `toml:"timeout"`
+	KeepAlive                int                              `toml:"keepalive"`
+	Proxy                    string                           `toml:"proxy"`
+	TorIsolation             bool                             `toml:"tor_isolation"`
+	TCPPipelining            bool                             `toml:"tcp_pipelining"`
+	EDNS0Padding             string                           `toml:"edns0_padding"`
+	EDNS0PaddingBlockSize    int                              `toml:"edns0_padding_block_size"`
+	CertRefreshConcurrency   int                              `toml:"cert_refresh_concurrency"`
+	CertRefreshTimeout       int                              `toml:"cert_refresh_timeout"`
+	AdaptiveTimeouts         bool                             `toml:"adaptive_timeouts"`
+	AdaptiveTimeoutMin       int                              `toml:"adaptive_timeout_min"`
+	AdaptiveTimeoutMargin    int                              `toml:"adaptive_timeout_margin"`
+	CertRefreshDelay         int                              `toml:"cert_refresh_delay"`
+	CertIgnoreTimestamp      bool                             `toml:"cert_ignore_timestamp"`
+	EphemeralKeys            bool                             `toml:"dnscrypt_ephemeral_keys"`
+	KeyRotation              int                              `toml:"dnscrypt_key_rotation"`
+	LBStrategy               string                           `toml:"lb_strategy"`
+	LBRaceRatio              int                              `toml:"lb_race_ratio"`
+	LBEWMADecay              float64                          `toml:"lb_ewma_decay"`
+	ServerWeights            map[string]float64               `toml:"server_weights"`
+	LBSticky                 string                           `toml:"lb_sticky"`
+	RebenchmarkInterval      int                              `toml:"rebenchmark_interval"`
+	RebenchmarkOnNetChange   bool                             `toml:"rebenchmark_on_network_change"`
+	NetworkProfileFile       string                           `toml:"network_profile_file"`
+	ProbeCapabilities        bool                             `toml:"probe_capabilities"`
+	LBEstimator              bool                             `toml:"lb_estimator"`
+	BlockIPv6                bool                             `toml:"block_ipv6"`
+	BlockUnqualified         bool                             `toml:"block_unqualified"`
+	MinimizeAny              bool                             `toml:"minimize_any"`
+	BlockUndelegated         bool                             `toml:"block_undelegated"`
 	Cache                    bool
 	CacheSize                int                         `toml:"cache_size"`
+	CacheMaxMemoryMB         int                         `toml:"cache_max_memory_mb"`
 	CacheNegTTL              uint32                      `toml:"cache_neg_ttl"`
 	CacheNegMinTTL           uint32                      `toml:"cache_neg_min_ttl"`
 	CacheNegMaxTTL           uint32                      `toml:"cache_neg_max_ttl"`
+	CacheNoDataMinTTL        uint32                      `toml:"cache_nodata_min_ttl"`
+	CacheNoDataMaxTTL        uint32                      `toml:"cache_nodata_max_ttl"`
+	CacheServFailTTL         uint32                      `toml:"cache_servfail_ttl"`
 	CacheMinTTL              uint32                      `toml:"cache_min_ttl"`
 	CacheMaxTTL              uint32                      `toml:"cache_max_ttl"`
+	CacheStaleMaxAge         int                         `toml:"cache_stale_max_age"`
+	CachePrefetchHits        int                         `toml:"cache_prefetch_hits"`
+	CachePrefetchPercent     int                         `toml:"cache_prefetch_percent"`
+	CacheOptimistic          bool                        `toml:"cache_optimistic"`
+	CacheOptimisticMaxAge    int                         `toml:"cache_optimistic_max_age"`
+	CachePartition           string                      `toml:"cache_partition"`
+	CacheSnapshotFile        string                      `toml:"cache_snapshot_file"`
+	CacheSnapshotInterval    int                         `toml:"cache_snapshot_interval"`
 	RejectTTL                uint32                      `toml:"reject_ttl"`
 	CloakTTL                 uint32                      `toml:"cloak_ttl"`
+	TTLClamping              TTLClampingConfig           `toml:"ttl_clamping"`
+	PatternMatcherBackend    string                      `toml:"pattern_matcher_backend"`
 	QueryLog                 QueryLogConfig              `toml:"query_log"`
 	NxLog                    NxLogConfig                 `toml:"nx_log"`
+	CacheLog                 CacheLogConfig              `toml:"cache_log"`
+	CertLog                  CertLogConfig               `toml:"cert_log"`
+	Capture                  CaptureConfig               `toml:"capture"`
+	Stats                    StatsConfig                 `toml:"stats"`
+	Monitoring               MonitoringConfig            `toml:"monitoring"`
+	Profiling                ProfilingConfig             `toml:"profiling"`
+	RRL                      RRLConfig                   `toml:"response_rate_limiting"`
+	ClientRateLimit          ClientRateLimitConfig       `toml:"client_rate_limit"`
+	Tracing                  TracingConfig               `toml:"tracing"`
+	MetricsExport            MetricsExportConfig         `toml:"metrics_export"`
+	Alerts                   AlertsConfig                `toml:"alerts"`
+	QueryLogExport           QueryLogExportConfig        `toml:"query_log_export"`
+	DoHClient                DoHClientConfig             `toml:"doh_client"`
+	Retry                    RetryConfig                 `toml:"retry"`
+	HealthCheck              HealthCheckConfig           `toml:"health_check"`
+	CircuitBreaker           CircuitBreakerConfig        `toml:"circuit_breaker"`
+	SystemFallback           SystemFallbackConfig        `toml:"system_fallback"`
 	BlockName                BlockNameConfig             `toml:"blocked_names"`
 	BlockNameLegacy          BlockNameConfigLegacy       `toml:"blacklist"`
 	WhitelistNameLegacy      WhitelistNameConfigLegacy   `toml:"whitelist"`
@@ -70,20 +130,44 @@ type Config struct {
 	BlockIPLegacy            BlockIPConfigLegacy         `toml:"ip_blacklist"`
 	AllowIP                  AllowIPConfig               `toml:"allowed_ips"`
 	ForwardFile              string                      `toml:"forwarding_rules"`
+	ForwardHealthInterval    int                         `toml:"forwarding_health_check_interval"`
+	DomainRoutes             map[string][]string         `toml:"domain_routes"`
+	NetworkProfiles          map[string]NetProfileConfig `toml:"network_profiles"`
 	CloakFile                string                      `toml:"cloaking_rules"`
+	LocalZoneFiles           []string                    `toml:"local_zones"`
+	QNameCaseRandomization   bool                        `toml:"qname_case_randomization"`
+	DHCPLeases               DHCPLeasesConfig            `toml:"dhcp_leases"`
+	MDNS                     MDNSConfig                  `toml:"mdns"`
+	UnsupportedQueries       UnsupportedQueriesConfig    `toml:"unsupported_queries"`
 	CaptivePortals           CaptivePortalsConfig        `toml:"captive_portals"`
+	Chaos                    ChaosConfig                 `toml:"chaos"`
 	StaticsConfig            map[string]StaticConfig     `toml:"static"`
 	SourcesConfig            map[string]SourceConfig     `toml:"sources"`
 	BrokenImplementations    BrokenImplementationsConfig `toml:"broken_implementations"`
 	SourceRequireDNSSEC      bool                        `toml:"require_dnssec"`
 	SourceRequireNoLog       bool                        `toml:"require_nolog"`
 	SourceRequireNoFilter    bool                        `toml:"require_nofilter"`
+	ServerFilters            ServerFiltersConfig         `toml:"server_filters"`
 	SourceDNSCrypt           bool                        `toml:"dnscrypt_servers"`
 	SourceDoH                bool                        `toml:"doh_servers"`
 	SourceODoH               bool                        `toml:"odoh_servers"`
+	SourceDoT                bool                        `toml:"dot_servers"`
+	SourceDoQ                bool                        `toml:"doq_servers"`
 	SourceIPv4               bool                        `toml:"ipv4_servers"`
 	SourceIPv6               bool                        `toml:"ipv6_servers"`
 	MaxClients               uint32                      `toml:"max_clients"`
+	MaxClientsPerIP          uint32                      `toml:"max_clients_per_ip"`
+	MaxQueuedClients         uint32                      `toml:"max_queued_clients"`
+	MaxTCPClients            uint32                      `toml:"max_tcp_clients"`
+	MaxTCPClientsPerIP       uint32                      `toml:"max_tcp_clients_per_ip"`
+	TCPReadTimeout           int                         `toml:"tcp_read_timeout"`
+	TCPIdleTimeout           int                         `toml:"tcp_idle_timeout"`
+	DrainTimeout             int                         `toml:"drain_timeout"`
+	OverloadAction           string                      `toml:"overload_action"`
+	UDPBatchSize             int                         `toml:"udp_batch_size"`
+	EDNSClientUDPSize        int                         `toml:"edns_client_udp_size"`
+	EDNSUpstreamUDPSize      int                         `toml:"edns_upstream_udp_size"`
+	ListenSockets            int                         `toml:"listen_sockets"`
 	BootstrapResolversLegacy []string                    `toml:"fallback_resolvers"`
 	BootstrapResolvers       []string                    `toml:"bootstrap_resolvers"`
 	IgnoreSystemDNS          bool                        `toml:"ignore_system_dns"`
@@ -91,8 +175,23 @@ type Config struct {
 	LogMaxSize               int                         `toml:"log_files_max_size"`
 	LogMaxAge                int                         `toml:"log_files_max_age"`
 	LogMaxBackups            int                         `toml:"log_files_max_backups"`
+	LogRotation              string                      `toml:"log_files_rotation"`
+	LogCompression           string                      `toml:"log_files_compression"`
+	LogQueryIDs              bool                        `toml:"log_query_ids"`
+	LogUnicodeNames          bool                        `toml:"log_unicode_names"`
+	ListenerLabels           map[string]string           `toml:"listener_labels"`
+	LogLevels                map[string]string           `toml:"log_levels"`
+	LogAnonymizeClients      string                      `toml:"log_anonymize_clients"`
+	LogAnonymizeIPv4Prefix   int                         `toml:"log_anonymize_ipv4_prefix"`
+	LogAnonymizeIPv6Prefix   int                         `toml:"log_anonymize_ipv6_prefix"`
+	LogAnonymizeKey          string                      `toml:"log_anonymize_key"`
 	TLSDisableSessionTickets bool                        `toml:"tls_disable_session_tickets"`
 	TLSCipherSuite           []uint16                    `toml:"tls_cipher_suite"`
+	TLSPostQuantum           bool                        `toml:"tls_post_quantum"`
+	TLSSessionFile           string                      `toml:"tls_session_file"`
+	TLSSessionKeyFile        string                      `toml:"tls_session_key_file"`
+	ECH                      bool                        `toml:"ech"`
+	DoHMethod                string                      `toml:"doh_method"`
 	TLSKeyLogFile            string                      `toml:"tls_key_log_file"`
 	NetprobeAddress          string                      `toml:"netprobe_address"`
 	NetprobeTimeout          int                         `toml:"netprobe_timeout"`
@@ -114,12 +213,19 @@ func newConfig() Config {
 		LogLevel:                 int(dlog.LogLevel()),
 		LogFileLatest:            true,
 		ListenAddresses:          []string{"127.0.0.1:53"},
-		LocalDoH:                 LocalDoHConfig{Path: "/dns-query"},
+		LocalDNSCrypt:            LocalDNSCryptConfig{ProviderKeyFile: "dnscrypt-provider.key", CertLifetime: 24},
+		LocalUnix:                LocalUnixConfig{Permissions: "0660"},
+		LocalDoH:                 LocalDoHConfig{Path: "/dns-query", ACMEDirectoryURL: ACMEDefaultDirectoryURL, ACMECacheDir: "acme"},
 		Timeout:                  5000,
 		KeepAlive:                5,
 		CertRefreshConcurrency:   10,
+		CertRefreshTimeout:       30,
+		AdaptiveTimeoutMin:       250,
+		AdaptiveTimeoutMargin:    100,
 		CertRefreshDelay:         240,
 		HTTP3:                    false,
+		EDNS0Padding:             "block",
+		EDNS0PaddingBlockSize:    128,
 		CertIgnoreTimestamp:      false,
 		EphemeralKeys:            false,
 		Cache:                    true,
@@ -127,10 +233,19 @@ func newConfig() Config {
 		CacheNegTTL:              0,
 		CacheNegMinTTL:           60,
 		CacheNegMaxTTL:           600,
+		CacheNoDataMinTTL:        60,
+		CacheNoDataMaxTTL:        600,
 		CacheMinTTL:              60,
 		CacheMaxTTL:              86400,
+		CacheStaleMaxAge:         86400,
+		CachePrefetchPercent:     10,
+		CacheOptimisticMaxAge:    3600,
+		CachePartition:           CachePartitionNone,
+		CacheSnapshotInterval:    60,
 		RejectTTL:                600,
 		CloakTTL:                 600,
+		MinimizeAny:              true,
+		PatternMatcherBackend:    PatternMatcherBackendCritbit,
 		SourceRequireNoLog:       true,
 		SourceRequireNoFilter:    true,
 		SourceIPv4:               true,
@@ -139,11 +254,37 @@ func newConfig() Config {
 		SourceDoH:                true,
 		SourceODoH:               false,
 		MaxClients:               250,
+		ListenSockets:            1,
+		TCPIdleTimeout:           30,
+		DrainTimeout:             5,
+		EDNSClientUDPSize:        MaxDNSUDPPacketSize,
+		EDNSUpstreamUDPSize:      MaxDNSUDPPacketSize,
+		OverloadAction:           OverloadActionCacheOnly,
+		RRL:                      RRLConfig{Window: 15, Slip: 2, IPv4Prefix: 24, IPv6Prefix: 56},
+		ClientRateLimit:          ClientRateLimitConfig{Burst: 100, Action: RateLimitActionRefused},
 		BootstrapResolvers:       []string{DefaultBootstrapResolver},
 		IgnoreSystemDNS:          false,
 		LogMaxSize:               10,
 		LogMaxAge:                7,
 		LogMaxBackups:            1,
+		LogRotation:              LogRotationSize,
+		LogCompression:           CompressionGzip,
+		LogAnonymizeClients:      "none",
+		LogAnonymizeIPv4Prefix:   DefaultAnonymizedIPv4PrefixLen,
+		LogAnonymizeIPv6Prefix:   DefaultAnonymizedIPv6PrefixLen,
+		Stats:                    StatsConfig{Interval: 60, TopK: 20},
+		DHCPLeases:               DHCPLeasesConfig{TTL: 60, RefreshInterval: 10},
+		MDNS:                     MDNSConfig{Timeout: 1000},
+		UnsupportedQueries:       UnsupportedQueriesConfig{Notify: QueryPolicyNotImp, Update: QueryPolicyRefused, OtherOpcodes: QueryPolicyNotImp, OtherClasses: QueryPolicyForward},
+		Capture:                  CaptureConfig{MaxDuration: 300, MaxPackets: 10000},
+		MetricsExport:            MetricsExportConfig{Interval: 10, StatsdPrefix: "dnscrypt_proxy", InfluxDBMeasurement: "dnscrypt_proxy"},
+		Alerts:                   AlertsConfig{Cooldown: 60, ServFailRateThreshold: 0.25, ServFailMinQueries: 50},
+		QueryLogExport:           QueryLogExportConfig{BatchSize: 500, FlushInterval: 5, MaxRetries: 3, MaxSpoolSize: 100},
+		DoHClient:                DoHClientConfig{MaxIdleConnsPerHost: 2, PingTimeout: 15},
+		Retry:                    RetryConfig{Backoff: 100, On: []string{RetryOnTimeout, RetryOnNetworkError}, SwitchServer: true},
+		HealthCheck:              HealthCheckConfig{QueryName: DefaultHealthQueryName, QueryType: DefaultHealthQueryType, Fall: 3, Rise: 2},
+		CircuitBreaker:           CircuitBreakerConfig{MinQueries: 10, Window: 60, Cooldown: 10, MaxCooldown: 600},
+		SystemFallback:           SystemFallbackConfig{Failures: DefaultSystemFallbackFailures, CheckInterval: DefaultSystemFallbackCheckInterval, ResolvConf: DefaultResolvConf},
 		TLSDisableSessionTickets: false,
 		TLSCipherSuite:           nil,
 		TLSKeyLogFile:            "",
@@ -151,6 +292,8 @@ func newConfig() Config {
 		OfflineMode:              false,
 		RefusedCodeInResponses:   false,
 		LBEstimator:              true,
+		LBRaceRatio:              100,
+		LBEWMADecay:              DefaultLBEWMADecay,
 		BlockedQueryResponse:     "hinfo",
 		BrokenImplementations: BrokenImplementationsConfig{
 			FragmentsBlocked: []string{
@@ -161,12 +304,31 @@ func newConfig() Config {
 		AnonymizedDNS: AnonymizedDNSConfig{
 			DirectCertFallback: true,
 		},
+		Tracing: TracingConfig{
+			OTLPEndpoint: "http://127.0.0.1:4318/v1/traces",
+			ServiceName:  "dnscrypt-proxy",
+			SampleRatio:  1.0,
+		},
 		CloakedPTR: false,
 	}
 }
 
 type StaticConfig struct {
-	Stamp string
+	Stamp         string
+	HTTP3         bool              `toml:"http3"`
+	Proxy         string            `toml:"proxy"`
+	HTTPProxy     string            `toml:"http_proxy"`
+	TLSSPKIPins   []string          `toml:"tls_spki_pins"`
+	TLSMinVersion string            `toml:"tls_min_version"`
+	TLSRootCA     string            `toml:"tls_root_ca"`
+	TLSClientCert string            `toml:"tls_client_cert"`
+	TLSClientKey  string            `toml:"tls_client_key"`
+	ECHConfig     string            `toml:"ech_config"`
+	Headers       map[string]string `toml:"headers"`
+	UserAgent     string            `toml:"user_agent"`
+	DoHMethod     string            `toml:"doh_method"`
+	DoHTemplate   string            `toml:"doh_template"`
+	Insecure      bool              `toml:"insecure"`
 }
 
 type SourceConfig struct {
@@ -177,23 +339,179 @@ type SourceConfig struct {
 	FormatStr      string `toml:"format"`
 	RefreshDelay   int    `toml:"refresh_delay"`
 	Prefix         string
+	Compression    string `toml:"cache_compression"`
 }
 
 type QueryLogConfig struct {
-	File          string
-	Format        string
-	IgnoredQtypes []string `toml:"ignored_qtypes"`
+	File              string
+	Format            string
+	IgnoredQtypes     []string `toml:"ignored_qtypes"`
+	Fields            []string `toml:"fields"`
+	SampleRate        int      `toml:"sample_rate"`
+	MaxLinesPerSecond int      `toml:"max_lines_per_second"`
 }
 
 type NxLogConfig struct {
+	File        string
+	Format      string
+	ReturnCodes []string `toml:"return_codes"`
+}
+
+type CaptureConfig struct {
+	File        string
+	MaxDuration int `toml:"max_duration"`
+	MaxPackets  int `toml:"max_packets"`
+}
+
+type CertLogConfig struct {
 	File   string
 	Format string
 }
 
+type CacheLogConfig struct {
+	File   string
+	Format string
+}
+
+type StatsConfig struct {
+	File     string
+	Interval int `toml:"interval"`
+	TopK     int `toml:"top_k"`
+}
+
+type RRLConfig struct {
+	ResponsesPerSecond int `toml:"responses_per_second"`
+	Window             int `toml:"window"`
+	Slip               int `toml:"slip"`
+	IPv4Prefix         int `toml:"ipv4_prefix"`
+	IPv6Prefix         int `toml:"ipv6_prefix"`
+}
+
+type ClientRateLimitConfig struct {
+	QueriesPerSecond int    `toml:"queries_per_second"`
+	Burst            int    `toml:"burst"`
+	Action           string `toml:"action"`
+}
+
+type ProfilingConfig struct {
+	ListenAddress string `toml:"listen_address"`
+	Enabled       bool   `toml:"enabled"`
+}
+
+type MonitoringConfig struct {
+	ListenAddress string `toml:"listen_address"`
+	APIToken      string `toml:"api_token"`
+	Stream        bool   `toml:"stream"`
+	Dashboard     bool   `toml:"dashboard"`
+	LatencySLOMs  int    `toml:"latency_slo_ms"`
+}
+
+type QueryLogExportConfig struct {
+	URL           string `toml:"url"`
+	Token         string `toml:"token"`
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval int    `toml:"flush_interval"`
+	MaxRetries    int    `toml:"max_retries"`
+	SpoolFile     string `toml:"spool_file"`
+	MaxSpoolSize  int    `toml:"max_spool_size"`
+}
+
+type DoHClientConfig struct {
+	MaxIdleConnsPerHost        int  `toml:"max_idle_conns_per_host"`
+	MaxConnsPerHost            int  `toml:"max_conns_per_host"`
+	IdleTimeout                int  `toml:"idle_timeout"`
+	StrictMaxConcurrentStreams bool `toml:"strict_max_concurrent_streams"`
+	PingInterval               int  `toml:"ping_interval"`
+	PingTimeout                int  `toml:"ping_timeout"`
+}
+
+type RetryConfig struct {
+	Attempts     int      `toml:"attempts"`
+	Backoff      int      `toml:"backoff"`
+	On           []string `toml:"on"`
+	SwitchServer bool     `toml:"switch_server"`
+}
+
+type TTLClampingConfig struct {
+	AnswersMinTTL uint32 `toml:"answers_min_ttl"`
+	AnswersMaxTTL uint32 `toml:"answers_max_ttl"`
+	CloakedMinTTL uint32 `toml:"cloaked_min_ttl"`
+	CloakedMaxTTL uint32 `toml:"cloaked_max_ttl"`
+	BlockedMinTTL uint32 `toml:"blocked_min_ttl"`
+	BlockedMaxTTL uint32 `toml:"blocked_max_ttl"`
+}
+
+type HealthCheckConfig struct {
+	Interval  int    `toml:"interval"`
+	QueryName string `toml:"query_name"`
+	QueryType string `toml:"query_type"`
+	Fall      int    `toml:"fall"`
+	Rise      int    `toml:"rise"`
+}
+
+type NetProfileConfig struct {
+	ServerNames []string `toml:"server_names"`
+	Interfaces  []string `toml:"interfaces"`
+	GatewayMACs []string `toml:"gateway_macs"`
+	Networks    []string `toml:"networks"`
+}
+
+type ServerFiltersConfig struct {
+	Countries         []string `toml:"countries"`
+	DisabledCountries []string `toml:"disabled_countries"`
+	ASNs              []uint32 `toml:"asns"`
+	DisabledASNs      []uint32 `toml:"disabled_asns"`
+	Operators         []string `toml:"operators"`
+	DisabledOperators []string `toml:"disabled_operators"`
+	GeoIPFile         string   `toml:"geoip_file"`
+}
+
+type CircuitBreakerConfig struct {
+	ErrorRate   int `toml:"error_rate"`
+	MinQueries  int `toml:"min_queries"`
+	Window      int `toml:"window"`
+	Cooldown    int `toml:"cooldown"`
+	MaxCooldown int `toml:"max_cooldown"`
+}
+
+type SystemFallbackConfig struct {
+	Enabled       bool   `toml:"enabled"`
+	Failures      int    `toml:"failures"`
+	CheckInterval int    `toml:"check_interval"`
+	ResolvConf    string `toml:"resolv_conf"`
+}
+
+type AlertsConfig struct {
+	WebhookURL            string   `toml:"webhook_url"`
+	Events                []string `toml:"events"`
+	Cooldown              int      `toml:"cooldown"`
+	ServFailRateThreshold float64  `toml:"servfail_rate_threshold"`
+	ServFailMinQueries    int      `toml:"servfail_min_queries"`
+}
+
+type MetricsExportConfig struct {
+	Interval            int               `toml:"interval"`
+	Tags                map[string]string `toml:"tags"`
+	StatsdAddress       string            `toml:"statsd_address"`
+	StatsdPrefix        string            `toml:"statsd_prefix"`
+	InfluxDBURL         string            `toml:"influxdb_url"`
+	InfluxDBToken       string            `toml:"influxdb_token"`
+	InfluxDBMeasurement string            `toml:"influxdb_measurement"`
+}
+
+type TracingConfig struct {
+	Enabled      bool    `toml:"enabled"`
+	OTLPEndpoint string  `toml:"otlp_endpoint"`
+	ServiceName  string  `toml:"service_name"`
+	SampleRatio  float64 `toml:"sample_ratio"`
+}
+
 type BlockNameConfig struct {
-	File    string `toml:"blocked_names_file"`
-	LogFile string `toml:"log_file"`
-	Format  string `toml:"log_format"`
+	File                 string `toml:"blocked_names_file"`
+	LogFile              string `toml:"log_file"`
+	Format               string `toml:"log_format"`
+	LogSampleRate        int    `toml:"log_sample_rate"`
+	LogMaxLinesPerSecond int    `toml:"log_max_lines_per_second"`
 }
 
 type BlockNameConfigLegacy struct {
@@ -235,6 +553,7 @@ type AllowIPConfig struct {
 type AnonymizedDNSRouteConfig struct {
 	ServerName string   `toml:"server_name"`
 	RelayNames []string `toml:"via"`
+	RelayChain []string `toml:"chain"`
 }
 
 type AnonymizedDNSConfig struct {
@@ -248,24 +567,52 @@ type BrokenImplementationsConfig struct {
 	FragmentsBlocked   []string `toml:"fragments_blocked"`
 }
 
-type LocalDoHConfig struct {
+type ListenerACLConfig struct {
+	AllowedClients []string `toml:"allowed_clients"`
+	Action         string   `toml:"action"`
+}
+
+type LocalUnixConfig struct {
+	StreamPath   string `toml:"stream_path"`
+	DatagramPath string `toml:"datagram_path"`
+	Permissions  string `toml:"permissions"`
+}
+
+type LocalDNSCryptConfig struct {
 	ListenAddresses []string `toml:"listen_addresses"`
-	Path            string   `toml:"path"`
-	CertFile        string   `toml:"cert_file"`
-	CertKeyFile     string   `toml:"cert_key_file"`
+	ProviderName    string   `toml:"provider_name"`
+	ProviderKeyFile string   `toml:"provider_key_file"`
+	CertLifetime    int      `toml:"cert_lifetime"`
+	ExternalAddress string   `toml:"external_address"`
+}
+
+type LocalDoHConfig struct {
+	ListenAddresses    []string `toml:"listen_addresses"`
+	Path               string   `toml:"path"`
+	DoTListenAddresses []string `toml:"dot_listen_addresses"`
+	DoQListenAddresses []string `toml:"doq_listen_addresses"`
+	CertFile           string   `toml:"cert_file"`
+	CertKeyFile        string   `toml:"cert_key_file"`
+	ACMEDomains        []string `toml:"acme_domains"`
+	ACMEEmail          string   `toml:"acme_email"`
+	ACMEDirectoryURL   string   `toml:"acme_directory_url"`
+	ACMECacheDir       string   `toml:"acme_cache_dir"`
+	ClientCAFile       string   `toml:"client_ca_file"`
+	AuthTokens         []string `toml:"auth_tokens"`
 }
 
 type ServerSummary struct {
-	Name        string   `json:"name"`
-	Proto       string   `json:"proto"`
-	IPv6        bool     `json:"ipv6"`
-	Addrs       []string `json:"addrs,omitempty"`
-	Ports       []int    `json:"ports"`
-	DNSSEC      *bool    `json:"dnssec,omitempty"`
-	NoLog       bool     `json:"nolog"`
-	NoFilter    bool     `json:"nofilter"`
-	Description string   `json:"description,omitempty"`
-	Stamp       string   `json:"stamp"`
+	Name         string              `json:"name"`
+	Proto        string              `json:"proto"`
+	IPv6         bool                `json:"ipv6"`
+	Addrs        []string            `json:"addrs,omitempty"`
+	Ports        []int               `json:"ports"`
+	DNSSEC       *bool               `json:"dnssec,omitempty"`
+	NoLog        bool                `json:"nolog"`
+	NoFilter     bool                `json:"nofilter"`
+	Description  string              `json:"description,omitempty"`
+	Stamp        string              `json:"stamp"`
+	Capabilities *ServerCapabilities `json:"capabilities,omitempty"`
 }
 
 type TLSClientAuthCredsConfig struct {
@@ -288,17 +635,48 @@ type CaptivePortalsConfig struct {
 	MapFile string `toml:"map_file"`
 }
 
+type DHCPLeasesConfig struct {
+	Files           []string `toml:"files"`
+	Suffix          string   `toml:"suffix"`
+	TTL             uint32   `toml:"ttl"`
+	RefreshInterval int      `toml:"refresh_interval"`
+}
+
+type MDNSConfig struct {
+	Enabled   bool   `toml:"enabled"`
+	Timeout   int    `toml:"timeout"`
+	Interface string `toml:"interface"`
+	IPv6      bool   `toml:"ipv6"`
+}
+
+type UnsupportedQueriesConfig struct {
+	Notify       string `toml:"notify"`
+	Update       string `toml:"update"`
+	OtherOpcodes string `toml:"other_opcodes"`
+	OtherClasses string `toml:"other_classes"`
+}
+
+type ChaosConfig struct {
+	Refuse bool              `toml:"refuse"`
+	TXT    map[string]string `toml:"txt"`
+}
+
 type ConfigFlags struct {
 	Resolve                 *string
 	List                    *bool
 	ListAll                 *bool
 	IncludeRelays           *bool
 	JSONOutput              *bool
+	Probe                   *bool
 	Check                   *bool
 	ConfigFile              *string
 	Child                   *bool
 	NetprobeTimeoutOverride *int
 	ShowCerts               *bool
+	Bench                   *string
+	BenchTarget             *string
+	BenchQueries            *int
+	BenchConcurrency        *int
 }
 
 func findConfigFile(configFile *string) (string, error) {
@@ -351,9 +729,13 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	if dlog.LogLevel() <= dlog.SeverityDebug && os.Getenv("DEBUG") == "" {
 		dlog.SetLogLevel(dlog.SeverityInfo)
 	}
+	if err := SetModuleLogLevels(config.LogLevels); err != nil {
+		return err
+	}
 	dlog.TruncateLogFile(config.LogFileLatest)
 	proxy.showCerts = *flags.ShowCerts || len(os.Getenv("SHOW_CERTS")) > 0
-	isCommandMode := *flags.Check || proxy.showCerts || *flags.List || *flags.ListAll
+	isBenchMode := flags.Bench != nil && len(*flags.Bench) > 0
+	isCommandMode := *flags.Check || proxy.showCerts || *flags.List || *flags.ListAll || isBenchMode
 	if isCommandMode {
 	} else if config.UseSyslog {
 		dlog.UseSyslog(true)
@@ -377,22 +759,65 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.logMaxSize = config.LogMaxSize
 	proxy.logMaxAge = config.LogMaxAge
 	proxy.logMaxBackups = config.LogMaxBackups
+	switch config.LogRotation {
+	case LogRotationSize, LogRotationHourly, LogRotationDaily:
+		proxy.logRotation = config.LogRotation
+	default:
+		return fmt.Errorf("Unsupported log files rotation: [%s]", config.LogRotation)
+	}
+	if proxy.logCompression, err = CompressionCodecByName(config.LogCompression); err != nil {
+		return err
+	}
+	proxy.clientsAnonymizer, err = NewClientsAnonymizer(
+		config.LogAnonymizeClients,
+		config.LogAnonymizeIPv4Prefix,
+		config.LogAnonymizeIPv6Prefix,
+		config.LogAnonymizeKey,
+	)
+	if err != nil {
+		return err
+	}
 
 	proxy.userName = config.UserName
 
 	proxy.child = *flags.Child
 	proxy.xTransport = NewXTransport()
 	proxy.xTransport.tlsDisableSessionTickets = config.TLSDisableSessionTickets
+	proxy.xTransport.tlsPostQuantum = config.TLSPostQuantum
+	if len(config.TLSSessionFile) > 0 && !config.TLSDisableSessionTickets {
+		sessionCache, err := NewPersistentSessionCache(config.TLSSessionFile, config.TLSSessionKeyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to use the TLS session file [%s]: %v", config.TLSSessionFile, err)
+		}
+		proxy.xTransport.tlsSessionCache = sessionCache
+		dotSessionCache = sessionCache
+		doqSessionCache = &prefixedSessionCache{prefix: "doq:", cache: sessionCache}
+	}
+	proxy.xTransport.ech.enabled = config.ECH
+	proxy.xTransport.dohMethod = strings.ToLower(config.DoHMethod)
+	if err := ValidateDoHMethod(proxy.xTransport.dohMethod); err != nil {
+		return err
+	}
 	proxy.xTransport.tlsCipherSuite = config.TLSCipherSuite
 	proxy.xTransport.mainProto = proxy.mainProto
 	proxy.xTransport.http3 = config.HTTP3
+	for name, staticConfig := range config.StaticsConfig {
+		if !staticConfig.HTTP3 {
+			continue
+		}
+		if stamp, err := ParseServerStamp(staticConfig.Stamp); err == nil && stamp.Proto == stamps.StampProtoTypeDoH {
+			proxy.xTransport.http3Hosts[stamp.ProviderName] = true
+		} else {
+			dlog.Warnf("[%s] is not a DoH server - Ignoring the http3 option", name)
+		}
+	}
 	if len(config.BootstrapResolvers) == 0 && len(config.BootstrapResolversLegacy) > 0 {
 		dlog.Warnf("fallback_resolvers was renamed to bootstrap_resolvers - Please update your configuration")
 		config.BootstrapResolvers = config.BootstrapResolversLegacy
 	}
 	if len(config.BootstrapResolvers) > 0 {
 		for _, resolver := range config.BootstrapResolvers {
-			if err := isIPAndPort(resolver); err != nil {
+			if err := validateBootstrapResolver(resolver); err != nil {
 				return fmt.Errorf("Bootstrap resolver [%v]: %v", resolver, err)
 			}
 		}
@@ -402,6 +827,29 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.xTransport.useIPv4 = config.SourceIPv4
 	proxy.xTransport.useIPv6 = config.SourceIPv6
 	proxy.xTransport.keepAlive = time.Duration(config.KeepAlive) * time.Second
+	proxy.xTransport.dohClient = config.DoHClient
+	if proxy.retryPolicy, err = NewRetryPolicy(config.Retry); err != nil {
+		return err
+	}
+	proxy.serversInfo.circuitBreaker = NewCircuitBreaker(config.CircuitBreaker)
+	proxy.systemFallback = NewSystemFallback(&config.SystemFallback)
+	if config.HealthCheck.Interval > 0 {
+		if proxy.healthChecker, err = NewHealthChecker(config.HealthCheck); err != nil {
+			return err
+		}
+	}
+	proxy.tcpPipelining = config.TCPPipelining
+	switch strings.ToLower(config.EDNS0Padding) {
+	case "block":
+		if config.EDNS0PaddingBlockSize < 1 || config.EDNS0PaddingBlockSize > 512 {
+			return fmt.Errorf("Invalid EDNS0 padding block size: %d", config.EDNS0PaddingBlockSize)
+		}
+		proxy.edns0PaddingBlockSize = config.EDNS0PaddingBlockSize
+	case "off", "none":
+		proxy.edns0PaddingBlockSize = 0
+	default:
+		return fmt.Errorf("Unsupported EDNS0 padding policy: [%s]", config.EDNS0Padding)
+	}
 	if len(config.HTTPProxyURL) > 0 {
 		httpProxyURL, err := url.Parse(config.HTTPProxyURL)
 		if err != nil {
@@ -420,8 +868,36 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 			return fmt.Errorf("Unable to use the proxy: [%v]", err)
 		}
 		proxy.xTransport.proxyDialer = &proxyDialer
+		proxy.xTransport.proxyURL = proxyDialerURL
 		proxy.mainProto = "tcp"
 	}
+	if config.TorIsolation {
+		proxy.xTransport.isolatedDialers = NewIsolatedDialers()
+	}
+	for name, staticConfig := range config.StaticsConfig {
+		if err := configureStaticProxy(proxy, name, &staticConfig); err != nil {
+			return err
+		}
+		if err := configureStaticTLS(proxy, name, &staticConfig); err != nil {
+			return err
+		}
+		if len(staticConfig.ECHConfig) > 0 {
+			stamp, err := ParseServerStamp(staticConfig.Stamp)
+			if err != nil || stamp.Proto != stamps.StampProtoTypeDoH {
+				return fmt.Errorf("ECH configurations can only be used with DoH servers, and [%s] isn't one", name)
+			}
+			host, _ := ExtractHostAndPort(stamp.ProviderName, -1)
+			if err := proxy.xTransport.SetStaticECHConfig(host, staticConfig.ECHConfig); err != nil {
+				return fmt.Errorf("[%s]: %v", name, err)
+			}
+		}
+		if err := configureStaticHeaders(proxy, name, &staticConfig); err != nil {
+			return err
+		}
+		if err := configureStaticDoHMethod(proxy, name, &staticConfig); err != nil {
+			return err
+		}
+	}
 
 	proxy.xTransport.rebuildTransport()
 
@@ -435,17 +911,85 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	}
 	proxy.blockedQueryResponse = config.BlockedQueryResponse
 	proxy.timeout = time.Duration(config.Timeout) * time.Millisecond
+	if config.AdaptiveTimeouts {
+		proxy.adaptiveTimeouts = NewAdaptiveTimeouts(
+			time.Duration(Max(0, config.AdaptiveTimeoutMin))*time.Millisecond,
+			time.Duration(Max(0, config.AdaptiveTimeoutMargin))*time.Millisecond,
+			proxy.timeout,
+		)
+	}
 	proxy.maxClients = config.MaxClients
+	if config.MaxClientsPerIP > 0 {
+		proxy.clientsLimiter = NewClientsLimiter(config.MaxClientsPerIP)
+	}
+	proxy.maxQueuedClients = config.MaxQueuedClients
+	if proxy.maxQueuedClients > 0 {
+		proxy.clientSlotFreed = make(chan struct{})
+	}
+	proxy.tcpConnLimiter = NewTCPConnLimiter(config.MaxTCPClients, config.MaxTCPClientsPerIP)
+	proxy.tcpReadTimeout = proxy.timeout
+	if config.TCPReadTimeout > 0 {
+		proxy.tcpReadTimeout = time.Duration(config.TCPReadTimeout) * time.Millisecond
+	}
+	proxy.tcpIdleTimeout = time.Duration(Max(1, config.TCPIdleTimeout)) * time.Second
+	proxy.drainTimeout = time.Duration(Max(0, config.DrainTimeout)) * time.Second
+	if err := ValidateOverloadAction(config.OverloadAction); err != nil {
+		return err
+	}
+	proxy.overloadAction = config.OverloadAction
+	proxy.rrl = NewResponseRateLimiter(
+		config.RRL.ResponsesPerSecond,
+		config.RRL.Window,
+		config.RRL.Slip,
+		config.RRL.IPv4Prefix,
+		config.RRL.IPv6Prefix,
+	)
+	if err := ValidateRateLimitAction(config.ClientRateLimit.Action); err != nil {
+		return err
+	}
+	proxy.clientRateLimitQPS = config.ClientRateLimit.QueriesPerSecond
+	proxy.clientRateLimitBurst = config.ClientRateLimit.Burst
+	proxy.clientRateLimitAction = config.ClientRateLimit.Action
+	if config.UDPBatchSize < 0 || config.UDPBatchSize > 1024 {
+		return errors.New("udp_batch_size must be between 0 and 1024")
+	}
+	proxy.udpBatchSize = config.UDPBatchSize
+	if config.EDNSClientUDPSize < 512 || config.EDNSClientUDPSize > MaxDNSUDPPacketSize {
+		return fmt.Errorf("edns_client_udp_size must be between 512 and %d", MaxDNSUDPPacketSize)
+	}
+	proxy.ednsClientUDPSize = config.EDNSClientUDPSize
+	if config.EDNSUpstreamUDPSize < 512 || config.EDNSUpstreamUDPSize > MaxDNSUDPPacketSize {
+		return fmt.Errorf("edns_upstream_udp_size must be between 512 and %d", MaxDNSUDPPacketSize)
+	}
+	proxy.ednsUpstreamUDPSize = config.EDNSUpstreamUDPSize
+	proxy.listenSockets = config.ListenSockets
+	if proxy.listenSockets <= 0 {
+		proxy.listenSockets = runtime.NumCPU()
+	}
+	if proxy.listenSockets > 1 && len(config.UserName) > 0 {
+		dlog.Warn("listen_sockets is not compatible with user_name - Only one socket will be used per address")
+		proxy.listenSockets = 1
+	}
 	proxy.mainProto = "udp"
 	if config.ForceTCP {
 		proxy.mainProto = "tcp"
 	}
 	proxy.certRefreshConcurrency = Max(1, config.CertRefreshConcurrency)
+	proxy.rebenchmarkInterval = time.Duration(Max(0, config.RebenchmarkInterval)) * time.Minute
+	proxy.rebenchmarkOnNetChange = config.RebenchmarkOnNetChange
+	proxy.certRefreshTimeout = time.Duration(Max(0, config.CertRefreshTimeout)) * time.Second
 	proxy.certRefreshDelay = time.Duration(Max(60, config.CertRefreshDelay)) * time.Minute
 	proxy.certRefreshDelayAfterFailure = time.Duration(10 * time.Second)
 	proxy.certIgnoreTimestamp = config.CertIgnoreTimestamp
 	proxy.ephemeralKeys = config.EphemeralKeys
-	if len(config.ListenAddresses) == 0 && len(config.LocalDoH.ListenAddresses) == 0 {
+	if config.KeyRotation > 0 {
+		proxy.keyRotation = time.Duration(config.KeyRotation) * time.Minute
+		proxy.clientKeys = NewClientKeys()
+	}
+	if len(config.ListenAddresses) == 0 && len(config.TransparentAddresses) == 0 &&
+		len(config.LocalDoH.ListenAddresses) == 0 && len(config.LocalDoH.DoTListenAddresses) == 0 && len(config.LocalDoH.DoQListenAddresses) == 0 &&
+		len(config.LocalDNSCrypt.ListenAddresses) == 0 && len(config.LocalUnix.StreamPath) == 0 &&
+		len(config.LocalUnix.DatagramPath) == 0 {
 		dlog.Debug("No local IP/port configured")
 	}
 	lbStrategy := LBStrategy(DefaultLBStrategy)
@@ -461,6 +1005,13 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		lbStrategy = LBStrategyFirst{}
 	case "random":
 		lbStrategy = LBStrategyRandom{}
+	case "race":
+		lbStrategy = LBStrategyRace{}
+	case "p2c":
+		if config.LBEWMADecay <= 0 || config.LBEWMADecay > 1 {
+			return fmt.Errorf("Invalid lb_ewma_decay value: [%v] (must be between 0 and 1)", config.LBEWMADecay)
+		}
+		lbStrategy = LBStrategyP2C{decay: config.LBEWMADecay}
 	default:
 		if strings.HasPrefix(lbStrategyStr, "p") {
 			n, err := strconv.ParseInt(strings.TrimPrefix(lbStrategyStr, "p"), 10, 32)
@@ -475,20 +1026,74 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	}
 	proxy.serversInfo.lbStrategy = lbStrategy
 	proxy.serversInfo.lbEstimator = config.LBEstimator
+	if proxy.serversInfo.weights, err = NewServerWeights(config.ServerWeights); err != nil {
+		return err
+	}
+	proxy.lbRaceRatio = Min(100, Max(0, config.LBRaceRatio))
+	switch config.LBSticky {
+	case "", LBStickyClient, LBStickyQName:
+		proxy.lbSticky = config.LBSticky
+	default:
+		return fmt.Errorf("Unsupported lb_sticky value: [%s]", config.LBSticky)
+	}
+	proxy.capabilitiesProbing = config.ProbeCapabilities
 
 	proxy.listenAddresses = config.ListenAddresses
+	proxy.transparentListenAddresses = config.TransparentAddresses
+	if len(proxy.transparentListenAddresses) > 0 && len(config.UserName) > 0 {
+		return errors.New("Transparent listeners require privileges that are lost when `user_name` is set")
+	}
+	proxy.listenInterface = config.ListenInterface
+	outboundInterface = config.OutboundInterface
 	proxy.localDoHListenAddresses = config.LocalDoH.ListenAddresses
+	proxy.localDoTListenAddresses = config.LocalDoH.DoTListenAddresses
+	proxy.localDoQListenAddresses = config.LocalDoH.DoQListenAddresses
 	if len(config.LocalDoH.Path) > 0 && config.LocalDoH.Path[0] != '/' {
 		return fmt.Errorf("local DoH: [%s] cannot be a valid URL path. Read the documentation", config.LocalDoH.Path)
 	}
 	proxy.localDoHPath = config.LocalDoH.Path
 	proxy.localDoHCertFile = config.LocalDoH.CertFile
 	proxy.localDoHCertKeyFile = config.LocalDoH.CertKeyFile
+	if proxy.localDoHACME, err = NewACMEClient(proxy.xTransport, &config.LocalDoH); err != nil {
+		return err
+	}
+	if proxy.localClientAuth, err = NewLocalClientAuth(config.LocalDoH.ClientCAFile, config.LocalDoH.AuthTokens); err != nil {
+		return fmt.Errorf("Local DoH client authentication: %v", err)
+	}
+	if proxy.localClientAuth != nil && !proxy.localClientAuth.RequiresCertificates() &&
+		(len(proxy.localDoTListenAddresses) > 0 || len(proxy.localDoQListenAddresses) > 0) {
+		return errors.New("Tokens only authenticate local DoH clients - Set `client_ca_file` to authenticate DoT and DoQ clients, or remove the DoT and DoQ listeners")
+	}
+	if proxy.localDNSCrypt, err = NewLocalDNSCryptServer(&config.LocalDNSCrypt); err != nil {
+		return err
+	}
+	proxy.localDNSCryptListenAddresses = config.LocalDNSCrypt.ListenAddresses
+	proxy.localDNSCryptExternalAddress = config.LocalDNSCrypt.ExternalAddress
+	proxy.localUnixStreamPath = config.LocalUnix.StreamPath
+	proxy.localUnixDatagramPath = config.LocalUnix.DatagramPath
+	localUnixPermissions, err := strconv.ParseUint(config.LocalUnix.Permissions, 8, 32)
+	if err != nil || localUnixPermissions > 0o777 {
+		return fmt.Errorf("Invalid permissions for the local unix sockets: [%s]", config.LocalUnix.Permissions)
+	}
+	proxy.localUnixPermissions = os.FileMode(localUnixPermissions)
+	proxy.listenerACLs = make(map[string]*ListenerACL, len(config.ListenerACLs))
+	for listenAddrStr, aclConfig := range config.ListenerACLs {
+		acl, err := NewListenerACL(aclConfig.AllowedClients, aclConfig.Action)
+		if err != nil {
+			return fmt.Errorf("Listener ACL for [%s]: %v", listenAddrStr, err)
+		}
+		proxy.listenerACLs[listenAddrStr] = acl
+	}
+	if proxy.proxyProtocol, err = NewProxyProtocol(config.ProxyProtocolFrontends); err != nil {
+		return err
+	}
 	proxy.pluginBlockIPv6 = config.BlockIPv6
 	proxy.pluginBlockUnqualified = config.BlockUnqualified
 	proxy.pluginBlockUndelegated = config.BlockUndelegated
+	proxy.pluginMinimizeAny = config.MinimizeAny
 	proxy.cache = config.Cache
 	proxy.cacheSize = config.CacheSize
+	proxy.cacheMaxMemory = config.CacheMaxMemoryMB * 1024 * 1024
 
 	if config.CacheNegTTL > 0 {
 		proxy.cacheNegMinTTL = config.CacheNegTTL
@@ -497,11 +1102,38 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		proxy.cacheNegMinTTL = config.CacheNegMinTTL
 		proxy.cacheNegMaxTTL = config.CacheNegMaxTTL
 	}
+	proxy.cacheNoDataMinTTL = config.CacheNoDataMinTTL
+	proxy.cacheNoDataMaxTTL = config.CacheNoDataMaxTTL
+	proxy.cacheServFailTTL = config.CacheServFailTTL
 
 	proxy.cacheMinTTL = config.CacheMinTTL
 	proxy.cacheMaxTTL = config.CacheMaxTTL
+	proxy.cacheStaleMaxAge = time.Duration(config.CacheStaleMaxAge) * time.Second
+	if config.CachePrefetchPercent < 1 || config.CachePrefetchPercent > 100 {
+		return errors.New("cache_prefetch_percent must be between 1 and 100")
+	}
+	proxy.cachePrefetchHits = config.CachePrefetchHits
+	proxy.cachePrefetchPercent = config.CachePrefetchPercent
+	switch config.CachePartition {
+	case CachePartitionNone:
+	case CachePartitionListener:
+		proxy.cachePartition = config.CachePartition
+	default:
+		return fmt.Errorf("Unsupported cache partitioning: [%s]", config.CachePartition)
+	}
+	if config.CacheOptimistic {
+		proxy.cacheOptimisticMaxAge = time.Duration(config.CacheOptimisticMaxAge) * time.Second
+	}
+	if config.Cache && len(config.CacheSnapshotFile) > 0 {
+		proxy.cacheSnapshot = NewCacheSnapshot(
+			config.CacheSnapshotFile,
+			time.Duration(config.CacheSnapshotInterval)*time.Minute,
+			proxy.cacheStaleMaxAge,
+		)
+	}
 	proxy.rejectTTL = config.RejectTTL
 	proxy.cloakTTL = config.CloakTTL
+	proxy.ttlClamping = NewTTLClamping(config.TTLClamping)
 	proxy.cloakedPTR = config.CloakedPTR
 
 	proxy.queryMeta = config.QueryMeta
@@ -528,6 +1160,14 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.queryLogFile = config.QueryLog.File
 	proxy.queryLogFormat = config.QueryLog.Format
 	proxy.queryLogIgnoredQtypes = config.QueryLog.IgnoredQtypes
+	if proxy.queryLogFields, err = queryLogFields(config.QueryLog.Format, config.QueryLog.Fields, config.LogQueryIDs); err != nil {
+		return err
+	}
+	proxy.logQueryIDs = config.LogQueryIDs
+	logUnicodeNames.Store(config.LogUnicodeNames)
+	proxy.listenerLabels = config.ListenerLabels
+	proxy.queryLogSampleRate = config.QueryLog.SampleRate
+	proxy.queryLogMaxLinesPerSecond = config.QueryLog.MaxLinesPerSecond
 
 	if len(config.NxLog.Format) == 0 {
 		config.NxLog.Format = "tsv"
@@ -539,6 +1179,107 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	}
 	proxy.nxLogFile = config.NxLog.File
 	proxy.nxLogFormat = config.NxLog.Format
+	proxy.nxLogReturnCodes = []string{"NXDOMAIN"}
+	if len(config.NxLog.ReturnCodes) > 0 {
+		proxy.nxLogReturnCodes = make([]string, len(config.NxLog.ReturnCodes))
+		for i, returnCode := range config.NxLog.ReturnCodes {
+			proxy.nxLogReturnCodes[i] = strings.ToUpper(returnCode)
+		}
+	}
+
+	if len(config.CacheLog.Format) == 0 {
+		config.CacheLog.Format = "tsv"
+	} else {
+		config.CacheLog.Format = strings.ToLower(config.CacheLog.Format)
+	}
+	if config.CacheLog.Format != "tsv" && config.CacheLog.Format != "ltsv" {
+		return errors.New("Unsupported cache log format")
+	}
+	proxy.cacheLogFile = config.CacheLog.File
+	proxy.cacheLogFormat = config.CacheLog.Format
+
+	if len(config.CertLog.Format) == 0 {
+		config.CertLog.Format = "tsv"
+	} else {
+		config.CertLog.Format = strings.ToLower(config.CertLog.Format)
+	}
+	if config.CertLog.Format != "tsv" && config.CertLog.Format != "ltsv" {
+		return errors.New("Unsupported certificate log format")
+	}
+	proxy.certLogFile = config.CertLog.File
+	proxy.certLogFormat = config.CertLog.Format
+
+	if len(config.Monitoring.ListenAddress) > 0 {
+		proxy.monitoringServer = NewMonitoringServer(config.Monitoring.ListenAddress, config.Monitoring.APIToken)
+		proxy.monitoringStream = config.Monitoring.Stream
+		if config.Monitoring.Dashboard {
+			proxy.monitoringServer.EnableDashboard()
+		}
+		if config.Monitoring.LatencySLOMs > 0 {
+			proxy.serversInfo.sloLatency = time.Duration(config.Monitoring.LatencySLOMs) * time.Millisecond
+		}
+	}
+	if len(proxy.certLogFile) > 0 || proxy.monitoringServer != nil {
+		proxy.certEvents = NewCertEvents(proxy)
+		proxy.monitoringServer.HandleFunc("/api/certs", proxy.certEvents.ServeHTTP)
+	}
+	alerter, err := NewAlerter(&config.Alerts)
+	if err != nil {
+		return err
+	}
+	proxy.alerter = alerter
+
+	if len(config.Capture.File) > 0 {
+		if proxy.monitoringServer == nil {
+			dlog.Warn("Packet capture requires the monitoring server to be enabled")
+		} else if config.Capture.MaxDuration <= 0 {
+			return errors.New("Packet capture maximum duration must be at least 1 second")
+		} else {
+			proxy.capture = NewPacketCapture(config.Capture.File, time.Duration(config.Capture.MaxDuration)*time.Second, config.Capture.MaxPackets)
+		}
+	}
+
+	if len(config.Profiling.ListenAddress) > 0 {
+		profiling, err := NewProfilingServer(config.Profiling.ListenAddress)
+		if err != nil {
+			return err
+		}
+		proxy.profiling = profiling
+		proxy.profilingEnabled = config.Profiling.Enabled
+	}
+
+	queryLogShipper, err := NewQueryLogShipper(&config.QueryLogExport)
+	if err != nil {
+		return err
+	}
+	proxy.queryLogShipper = queryLogShipper
+
+	metricsExporter, err := NewMetricsExporter(&config.MetricsExport)
+	if err != nil {
+		return err
+	}
+	proxy.metricsExporter = metricsExporter
+	if len(config.Stats.File) > 0 || proxy.monitoringServer != nil || proxy.metricsExporter != nil {
+		if config.Stats.Interval <= 0 {
+			return errors.New("Statistics interval must be at least 1 minute")
+		}
+		proxy.queryStats = NewQueryStats(Max(1, config.Stats.TopK))
+		proxy.statsFile = config.Stats.File
+		proxy.statsInterval = time.Duration(config.Stats.Interval) * time.Minute
+	}
+
+	if config.Tracing.Enabled {
+		tracer, err := NewTracer(config.Tracing.OTLPEndpoint, config.Tracing.ServiceName, config.Tracing.SampleRatio)
+		if err != nil {
+			return err
+		}
+		proxy.tracer = tracer
+	}
+
+	if err := ValidatePatternMatcherBackend(config.PatternMatcherBackend); err != nil {
+		return err
+	}
+	proxy.patternMatcherBackend = config.PatternMatcherBackend
 
 	if len(config.BlockName.File) > 0 && len(config.BlockNameLegacy.File) > 0 {
 		return errors.New("Don't specify both [blocked_names] and [blacklist] sections - Update your config file")
@@ -560,6 +1301,8 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.blockNameFile = config.BlockName.File
 	proxy.blockNameFormat = config.BlockName.Format
 	proxy.blockNameLogFile = config.BlockName.LogFile
+	proxy.blockNameLogSampleRate = config.BlockName.LogSampleRate
+	proxy.blockNameLogMaxLinesPerSecond = config.BlockName.LogMaxLinesPerSecond
 
 	if len(config.AllowedName.File) > 0 && len(config.WhitelistNameLegacy.File) > 0 {
 		return errors.New("Don't specify both [whitelist] and [allowed_names] sections - Update your config file")
@@ -616,8 +1359,51 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.allowedIPLogFile = config.AllowIP.LogFile
 
 	proxy.forwardFile = config.ForwardFile
+	proxy.forwardHealthCheckInterval = time.Duration(Max(0, config.ForwardHealthInterval)) * time.Second
+	if proxy.domainRoutes, err = NewDomainRoutes(config.DomainRoutes); err != nil {
+		return err
+	}
+	if proxy.domainRoutes != nil {
+		proxy.serversInfo.reserved = proxy.domainRoutes.reserved
+	}
 	proxy.cloakFile = config.CloakFile
+	proxy.localZoneFiles = config.LocalZoneFiles
+	proxy.qnameCaseRandomization = config.QNameCaseRandomization
+	proxy.dhcpLeaseFiles = config.DHCPLeases.Files
+	proxy.dhcpLeaseSuffix = config.DHCPLeases.Suffix
+	proxy.dhcpLeaseTTL = config.DHCPLeases.TTL
+	proxy.dhcpLeaseRefreshInterval = time.Duration(Max(0, config.DHCPLeases.RefreshInterval)) * time.Second
+	proxy.mdnsBridge = config.MDNS.Enabled
+	proxy.mdnsTimeout = time.Duration(Max(1, config.MDNS.Timeout)) * time.Millisecond
+	proxy.mdnsInterface = config.MDNS.Interface
+	proxy.mdnsIPv6 = config.MDNS.IPv6
+	proxy.listenerProfiles = make(map[string]*ListenerProfile, len(config.ListenerProfiles))
+	for listenAddrStr, profileConfig := range config.ListenerProfiles {
+		profile, err := NewListenerProfile(proxy.pluginSettings, &profileConfig, config.LogQueryIDs)
+		if err != nil {
+			return fmt.Errorf("Listener profile for [%s]: %v", listenAddrStr, err)
+		}
+		// Profiles are found using the label of the listener a query was received on, that has to be the
+		// same for all the queries received by a wildcard listener
+		if proxy.listenerLabels == nil {
+			proxy.listenerLabels = make(map[string]string)
+		}
+		label, ok := proxy.listenerLabels[listenAddrStr]
+		if !ok {
+			label = listenAddrStr
+			proxy.listenerLabels[listenAddrStr] = label
+		}
+		if _, ok := proxy.listenerProfiles[label]; ok {
+			return fmt.Errorf("Multiple listener profiles for listeners labeled [%s]", label)
+		}
+		proxy.listenerProfiles[label] = profile
+	}
 	proxy.captivePortalMapFile = config.CaptivePortals.MapFile
+	if proxy.queryPolicy, err = NewQueryPolicy(&config.UnsupportedQueries); err != nil {
+		return err
+	}
+	proxy.chaosTXT = config.Chaos.TXT
+	proxy.chaosRefuse = config.Chaos.Refuse
 
 	allWeeklyRanges, err := ParseAllWeeklyRanges(config.AllWeeklyRanges)
 	if err != nil {
@@ -627,10 +1413,22 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 
 	if configRoutes := config.AnonymizedDNS.Routes; configRoutes != nil {
 		routes := make(map[string][]string)
+		relayChains := make(map[string][]string)
 		for _, configRoute := range configRoutes {
-			routes[configRoute.ServerName] = configRoute.RelayNames
+			if len(configRoute.RelayChain) == 0 {
+				routes[configRoute.ServerName] = configRoute.RelayNames
+				continue
+			}
+			if len(configRoute.RelayNames) > 0 {
+				return fmt.Errorf("The route for [%v] cannot include both a relay set and a relay chain", configRoute.ServerName)
+			}
+			if len(configRoute.RelayChain) < 2 {
+				return fmt.Errorf("The relay chain for [%v] must include at least two relays", configRoute.ServerName)
+			}
+			relayChains[configRoute.ServerName] = configRoute.RelayChain
 		}
 		proxy.routes = &routes
+		proxy.relayChains = relayChains
 	}
 	proxy.skipAnonIncompatibleResolvers = config.AnonymizedDNS.SkipIncompatible
 	proxy.anonDirectCertFallback = config.AnonymizedDNS.DirectCertFallback
@@ -697,6 +1495,17 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		requiredProps |= stamps.ServerInformalPropertyNoFilter
 	}
 	proxy.requiredProps = requiredProps
+	if !*flags.ListAll {
+		if proxy.serverFilters, err = NewServerFilters(&config.ServerFilters); err != nil {
+			return err
+		}
+		if proxy.networkProfiles, err = NewNetworkProfiles(config.NetworkProfiles, config.ServerNames, config.NetworkProfileFile); err != nil {
+			return err
+		}
+		if proxy.networkProfiles != nil {
+			proxy.networkProfiles.apply(&proxy.serversInfo)
+		}
+	}
 	proxy.ServerNames = config.ServerNames
 	proxy.DisabledServerNames = config.DisabledServerNames
 	proxy.SourceIPv4 = config.SourceIPv4
@@ -704,6 +1513,8 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	proxy.SourceDNSCrypt = config.SourceDNSCrypt
 	proxy.SourceDoH = config.SourceDoH
 	proxy.SourceODoH = config.SourceODoH
+	proxy.SourceDoT = config.SourceDoT
+	proxy.SourceDoQ = config.SourceDoQ
 
 	netprobeTimeout := config.NetprobeTimeout
 	flag.Visit(func(flag *flag.Flag) {
@@ -715,7 +1526,7 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	if len(config.NetprobeAddress) > 0 {
 		netprobeAddress = config.NetprobeAddress
 	} else if len(config.BootstrapResolvers) > 0 {
-		netprobeAddress = config.BootstrapResolvers[0]
+		netprobeAddress = bootstrapResolverAddress(config.BootstrapResolvers[0])
 	}
 	if !isCommandMode {
 		if err := NetProbe(proxy, netprobeAddress, netprobeTimeout); err != nil {
@@ -727,6 +1538,19 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		for _, listenAddrStr := range proxy.localDoHListenAddresses {
 			proxy.addLocalDoHListener(listenAddrStr)
 		}
+		for _, listenAddrStr := range proxy.localDoTListenAddresses {
+			proxy.addLocalDoTListener(listenAddrStr)
+		}
+		for _, listenAddrStr := range proxy.localDoQListenAddresses {
+			proxy.addLocalDoQListener(listenAddrStr)
+		}
+		for _, listenAddrStr := range proxy.localDNSCryptListenAddresses {
+			proxy.addLocalDNSCryptListener(listenAddrStr)
+		}
+		for _, listenAddrStr := range proxy.transparentListenAddresses {
+			proxy.addTransparentListener(listenAddrStr)
+		}
+		proxy.addLocalUnixListeners()
 		if err := proxy.addSystemDListeners(); err != nil {
 			return err
 		}
@@ -747,13 +1571,35 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 		}
 	}
 	if *flags.List || *flags.ListAll {
-		if err := config.printRegisteredServers(proxy, *flags.JSONOutput, *flags.IncludeRelays); err != nil {
+		if err := config.printRegisteredServers(proxy, *flags.JSONOutput, *flags.IncludeRelays, *flags.Probe); err != nil {
 			return err
 		}
 		os.Exit(0)
 	}
-	if proxy.routes != nil && len(*proxy.routes) > 0 {
+	if isBenchMode {
+		options := BenchOptions{
+			source:      *flags.Bench,
+			target:      *flags.BenchTarget,
+			queries:     *flags.BenchQueries,
+			concurrency: *flags.BenchConcurrency,
+		}
+		if err := proxy.runBenchmark(&options, config.ListenAddresses); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
+	if proxy.routes != nil && (len(*proxy.routes) > 0 || len(proxy.relayChains) > 0) {
 		hasSpecificRoutes := false
+		for _, server := range proxy.registeredServers {
+			if chain, ok := proxy.relayChains[server.name]; ok {
+				if server.stamp.Proto != stamps.StampProtoTypeDNSCrypt {
+					dlog.Errorf("Relay chains are only supported with the DNSCrypt protocol - Connections to [%v] cannot be anonymized", server.name)
+				} else {
+					dlog.Noticef("Anonymized DNS: routing [%v] via the relay chain %v", server.name, chain)
+				}
+				hasSpecificRoutes = true
+			}
+		}
 		for _, server := range proxy.registeredServers {
 			if via, ok := (*proxy.routes)[server.name]; ok {
 				if server.stamp.Proto != stamps.StampProtoTypeDNSCrypt &&
@@ -768,6 +1614,9 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 				hasSpecificRoutes = true
 			}
 		}
+		if chain, ok := proxy.relayChains["*"]; ok {
+			dlog.Noticef("Anonymized DNS: routing servers without a specific route via the relay chain %v", chain)
+		}
 		if via, ok := (*proxy.routes)["*"]; ok {
 			if hasSpecificRoutes {
 				dlog.Noticef("Anonymized DNS: routing everything else via %v", via)
@@ -783,7 +1632,7 @@ func ConfigLoad(proxy *Proxy, flags *ConfigFlags) error {
 	return nil
 }
 
-func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, includeRelays bool) error {
+func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, includeRelays bool, probe bool) error {
 	var summary []ServerSummary
 	if includeRelays {
 		for _, registeredRelay := range proxy.registeredRelays {
@@ -850,7 +1699,12 @@ func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, incl
 			NoLog:       registeredServer.stamp.Props&stamps.ServerInformalPropertyNoLog != 0,
 			NoFilter:    registeredServer.stamp.Props&stamps.ServerInformalPropertyNoFilter != 0,
 			Description: registeredServer.description,
-			Stamp:       registeredServer.stamp.String(),
+			Stamp:       StampString(&registeredServer.stamp),
+		}
+		if jsonOutput && probe {
+			if serverInfo, err := fetchServerInfo(proxy, registeredServer.name, registeredServer.stamp, false); err == nil {
+				serverSummary.Capabilities = proxy.probeCapabilities(&serverInfo)
+			}
 		}
 		if jsonOutput {
 			summary = append(summary, serverSummary)
@@ -869,21 +1723,51 @@ func (config *Config) printRegisteredServers(proxy *Proxy, jsonOutput bool, incl
 }
 
 func (config *Config) loadSources(proxy *Proxy) error {
-	for cfgSourceName, cfgSource_ := range config.SourcesConfig {
-		cfgSource := cfgSource_
-		rand.Shuffle(len(cfgSource.URLs), func(i, j int) {
-			cfgSource.URLs[i], cfgSource.URLs[j] = cfgSource.URLs[j], cfgSource.URLs[i]
+	// Sources are downloaded concurrently, but added in a deterministic order
+	cfgSourceNames := make([]string, 0, len(config.SourcesConfig))
+	for cfgSourceName := range config.SourcesConfig {
+		cfgSourceNames = append(cfgSourceNames, cfgSourceName)
+	}
+	sort.Strings(cfgSourceNames)
+	sources := make([]*Source, len(cfgSourceNames))
+	errs := make([]error, len(cfgSourceNames))
+	var wg sync.WaitGroup
+	for i, cfgSourceName := range cfgSourceNames {
+		cfgSource := config.SourcesConfig[cfgSourceName]
+		rand.Shuffle(len(cfgSource.URLs), func(j, k int) {
+			cfgSource.URLs[j], cfgSource.URLs[k] = cfgSource.URLs[k], cfgSource.URLs[j]
 		})
-		if err := config.loadSource(proxy, cfgSourceName, &cfgSource); err != nil {
-			return err
+		wg.Add(1)
+		go func(i int, cfgSourceName string, cfgSource SourceConfig) {
+			defer wg.Done()
+			sources[i], errs[i] = config.loadSource(proxy, cfgSourceName, &cfgSource)
+		}(i, cfgSourceName, cfgSource)
+	}
+	wg.Wait()
+	for i := range sources {
+		if errs[i] != nil {
+			return errs[i]
 		}
+		proxy.sources = append(proxy.sources, sources[i])
 	}
 	for name, config := range config.StaticsConfig {
-		if stamp, err := stamps.NewServerStampFromString(config.Stamp); err == nil {
+		if stamp, err := ParseServerStamp(config.Stamp); err == nil {
 			if stamp.Proto == stamps.StampProtoTypeDNSCryptRelay || stamp.Proto == stamps.StampProtoTypeODoHRelay {
 				dlog.Debugf("Adding [%s] to the set of available static relays", name)
 				registeredServer := RegisteredServer{name: name, stamp: stamp, description: "static relay"}
 				proxy.registeredRelays = append(proxy.registeredRelays, registeredServer)
+			} else if stamp.Proto == stamps.StampProtoTypePlain {
+				if !config.Insecure {
+					return fmt.Errorf("[%s] is an unencrypted DNS server - Set `insecure = true` to use it as a last-resort server", name)
+				}
+				serverInfo, err := newLastResortServer(proxy, name, stamp)
+				if err != nil {
+					return err
+				}
+				dlog.Warnf("[%s] is an UNENCRYPTED server, that will only be used when no encrypted servers are available", name)
+				proxy.lastResortServers = append(proxy.lastResortServers, serverInfo)
+			} else if config.Insecure {
+				return fmt.Errorf("[%s]: `insecure` can only be set for plain DNS servers", name)
 			}
 		}
 	}
@@ -892,7 +1776,13 @@ func (config *Config) loadSources(proxy *Proxy) error {
 			config.ServerNames = append(config.ServerNames, serverName)
 		}
 	}
-	for _, serverName := range config.ServerNames {
+	staticNames := append([]string{}, config.ServerNames...)
+	for serverName := range config.StaticsConfig {
+		if !includesName(staticNames, serverName) && proxy.networkProfiles.hasServer(serverName) {
+			staticNames = append(staticNames, serverName)
+		}
+	}
+	for _, serverName := range staticNames {
 		staticConfig, ok := config.StaticsConfig[serverName]
 		if !ok {
 			continue
@@ -900,10 +1790,13 @@ func (config *Config) loadSources(proxy *Proxy) error {
 		if len(staticConfig.Stamp) == 0 {
 			return fmt.Errorf("Missing stamp for the static [%s] definition", serverName)
 		}
-		stamp, err := stamps.NewServerStampFromString(staticConfig.Stamp)
+		stamp, err := ParseServerStamp(staticConfig.Stamp)
 		if err != nil {
 			return fmt.Errorf("Stamp error for the static [%s] definition: [%v]", serverName, err)
 		}
+		if stamp.Proto == stamps.StampProtoTypePlain {
+			continue
+		}
 		proxy.registeredServers = append(proxy.registeredServers, RegisteredServer{name: serverName, stamp: stamp})
 	}
 	if err := proxy.updateRegisteredServers(); err != nil {
@@ -920,7 +1813,7 @@ func (config *Config) loadSources(proxy *Proxy) error {
 	return nil
 }
 
-func (config *Config) loadSource(proxy *Proxy, cfgSourceName string, cfgSource *SourceConfig) error {
+func (config *Config) loadSource(proxy *Proxy, cfgSourceName string, cfgSource *SourceConfig) (*Source, error) {
 	if len(cfgSource.URLs) == 0 {
 		if len(cfgSource.URL) == 0 {
 			dlog.Debugf("Missing URLs for source [%s]", cfgSourceName)
@@ -929,10 +1822,10 @@ func (config *Config) loadSource(proxy *Proxy, cfgSourceName string, cfgSource *
 		}
 	}
 	if cfgSource.MinisignKeyStr == "" {
-		return fmt.Errorf("Missing Minisign key for source [%s]", cfgSourceName)
+		return nil, fmt.Errorf("Missing Minisign key for source [%s]", cfgSourceName)
 	}
 	if cfgSource.CacheFile == "" {
-		return fmt.Errorf("Missing cache file for source [%s]", cfgSourceName)
+		return nil, fmt.Errorf("Missing cache file for source [%s]", cfgSourceName)
 	}
 	if cfgSource.FormatStr == "" {
 		cfgSource.FormatStr = "v2"
@@ -941,6 +1834,13 @@ func (config *Config) loadSource(proxy *Proxy, cfgSourceName string, cfgSource *
 		cfgSource.RefreshDelay = 72
 	}
 	cfgSource.RefreshDelay = Min(168, Max(24, cfgSource.RefreshDelay))
+	if cfgSource.Compression == "" {
+		cfgSource.Compression = CompressionNone
+	}
+	compression, err := CompressionCodecByName(cfgSource.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("Source [%s]: %v", cfgSourceName, err)
+	}
 	source, err := NewSource(
 		cfgSourceName,
 		proxy.xTransport,
@@ -950,16 +1850,17 @@ func (config *Config) loadSource(proxy *Proxy, cfgSourceName string, cfgSource *
 		cfgSource.FormatStr,
 		time.Duration(cfgSource.RefreshDelay)*time.Hour,
 		cfgSource.Prefix,
+		compression,
 	)
 	if err != nil {
 		if len(source.bin) <= 0 {
 			dlog.Criticalf("Unable to retrieve source [%s]: [%s]", cfgSourceName, err)
-			return err
+			return nil, err
 		}
 		dlog.Infof("Downloading [%s] failed: %v, using cache file to startup", source.name, err)
 	}
-	proxy.sources = append(proxy.sources, source)
-	return nil
+	source.alerter = proxy.alerter
+	return source, nil
 }
 
 func includesName(names []string, name string) bool {
@@ -998,3 +1899,161 @@ func isIPAndPort(addrStr string) error {
 	}
 	return nil
 }
+
+// configureStaticProxy overrides the global proxy settings for a static server.
+// The special value "direct" bypasses a globally configured proxy.
+func configureStaticProxy(proxy *Proxy, name string, staticConfig *StaticConfig) error {
+	if len(staticConfig.Proxy) == 0 && len(staticConfig.HTTPProxy) == 0 {
+		return nil
+	}
+	stamp, err := ParseServerStamp(staticConfig.Stamp)
+	if err != nil {
+		return fmt.Errorf("Stamp error for the static [%s] definition: [%v]", name, err)
+	}
+	var host string
+	switch stamp.Proto {
+	case stamps.StampProtoTypeDNSCrypt:
+		host, _ = ExtractHostAndPort(stamp.ServerAddrStr, -1)
+	case stamps.StampProtoTypeDoH, stamps.StampProtoTypeTLS:
+		host, _ = ExtractHostAndPort(stamp.ProviderName, -1)
+	default:
+		return fmt.Errorf("Proxies are not supported with the protocol used by [%s]", name)
+	}
+	hostProxy := HostProxy{}
+	if len(staticConfig.Proxy) > 0 && staticConfig.Proxy != "direct" {
+		proxyDialerURL, err := url.Parse(staticConfig.Proxy)
+		if err != nil {
+			return fmt.Errorf("Unable to parse the proxy URL [%v] for [%s]", staticConfig.Proxy, name)
+		}
+		proxyDialer, err := netproxy.FromURL(proxyDialerURL, netproxy.Direct)
+		if err != nil {
+			return fmt.Errorf("Unable to use the proxy for [%s]: [%v]", name, err)
+		}
+		hostProxy.proxyDialer = &proxyDialer
+		hostProxy.proxyURL = proxyDialerURL
+	}
+	if len(staticConfig.HTTPProxy) > 0 && staticConfig.HTTPProxy != "direct" {
+		if stamp.Proto != stamps.StampProtoTypeDoH {
+			return fmt.Errorf("HTTP proxies can only be used with DoH servers, and [%s] isn't one", name)
+		}
+		httpProxyURL, err := url.Parse(staticConfig.HTTPProxy)
+		if err != nil {
+			return fmt.Errorf("Unable to parse the HTTP proxy URL [%v] for [%s]", staticConfig.HTTPProxy, name)
+		}
+		hostProxy.httpProxyFunction = http.ProxyURL(httpProxyURL)
+	}
+	proxy.xTransport.SetHostProxy(host, &hostProxy)
+	dlog.Noticef("Using a dedicated proxy configuration for [%s]", name)
+	return nil
+}
+
+// configureStaticTLS applies TLS settings specific to a static DoH, DoT or DoQ server
+func configureStaticTLS(proxy *Proxy, name string, staticConfig *StaticConfig) error {
+	if len(staticConfig.TLSSPKIPins) == 0 && len(staticConfig.TLSMinVersion) == 0 && len(staticConfig.TLSRootCA) == 0 &&
+		len(staticConfig.TLSClientCert) == 0 {
+		return nil
+	}
+	stamp, err := ParseServerStamp(staticConfig.Stamp)
+	if err != nil {
+		return fmt.Errorf("Stamp error for the static [%s] definition: [%v]", name, err)
+	}
+	if stamp.Proto != stamps.StampProtoTypeDoH && stamp.Proto != stamps.StampProtoTypeTLS &&
+		stamp.Proto != stamps.StampProtoTypeDoQ {
+		return fmt.Errorf("TLS settings can only be used with DoH, DoT and DoQ servers, and [%s] isn't one", name)
+	}
+	hostTLS, err := NewHostTLS(
+		staticConfig.TLSSPKIPins,
+		staticConfig.TLSMinVersion,
+		staticConfig.TLSRootCA,
+		staticConfig.TLSClientCert,
+		staticConfig.TLSClientKey,
+	)
+	if err != nil {
+		return fmt.Errorf("TLS settings for [%s]: %v", name, err)
+	}
+	host, _ := ExtractHostAndPort(stamp.ProviderName, -1)
+	proxy.xTransport.SetHostTLS(host, hostTLS)
+	dlog.Noticef("Using dedicated TLS settings for [%s]", name)
+	return nil
+}
+
+// configureStaticHeaders adds custom HTTP headers, and a custom User-Agent, to the queries sent to a static DoH server.
+// Values can be read from an environment variable with `env:NAME`, or from a file with `file:/path`,
+// so that credentials don't have to be stored in the configuration file.
+func configureStaticHeaders(proxy *Proxy, name string, staticConfig *StaticConfig) error {
+	if len(staticConfig.Headers) == 0 && len(staticConfig.UserAgent) == 0 {
+		return nil
+	}
+	stamp, err := ParseServerStamp(staticConfig.Stamp)
+	if err != nil || stamp.Proto != stamps.StampProtoTypeDoH {
+		return fmt.Errorf("Custom HTTP headers can only be used with DoH servers, and [%s] isn't one", name)
+	}
+	headers := make(map[string]string)
+	for key, value := range staticConfig.Headers {
+		secret, err := ReadSecret(value)
+		if err != nil {
+			return fmt.Errorf("Header [%s] for [%s]: %v", key, name, err)
+		}
+		headers[http.CanonicalHeaderKey(key)] = secret
+	}
+	if len(staticConfig.UserAgent) > 0 {
+		headers["User-Agent"] = staticConfig.UserAgent
+	}
+	host, _ := ExtractHostAndPort(stamp.ProviderName, -1)
+	proxy.xTransport.SetHostHeaders(host, headers)
+	dlog.Noticef("Using %d custom HTTP header(s) for [%s]", len(headers), name)
+	return nil
+}
+
+// configureStaticDoHMethod sets the HTTP method, and optionally a URI template, used to send queries to a static DoH server
+func configureStaticDoHMethod(proxy *Proxy, name string, staticConfig *StaticConfig) error {
+	if len(staticConfig.DoHMethod) == 0 && len(staticConfig.DoHTemplate) == 0 {
+		return nil
+	}
+	stamp, err := ParseServerStamp(staticConfig.Stamp)
+	if err != nil || stamp.Proto != stamps.StampProtoTypeDoH {
+		return fmt.Errorf("DoH methods and URI templates can only be used with DoH servers, and [%s] isn't one", name)
+	}
+	method := strings.ToLower(staticConfig.DoHMethod)
+	if err := ValidateDoHMethod(method); err != nil {
+		return fmt.Errorf("[%s]: %v", name, err)
+	}
+	host, _ := ExtractHostAndPort(stamp.ProviderName, -1)
+	if len(staticConfig.DoHTemplate) > 0 {
+		dohTemplate, err := ParseDoHTemplate(staticConfig.DoHTemplate)
+		if err != nil {
+			return fmt.Errorf("[%s]: %v", name, err)
+		}
+		if templateURL, _ := dohTemplate.Expand(nil); !strings.EqualFold(templateURL.Hostname(), host) {
+			return fmt.Errorf("[%s]: the URI template must use the host name of the stamp [%s]", name, host)
+		}
+		proxy.xTransport.SetHostDoHTemplate(host, dohTemplate)
+	}
+	proxy.xTransport.SetHostDoHMethod(host, method)
+	return nil
+}
+
+// queryLogFields returns the normalized list of fields to write to a query log, or the default ones if none are given
+func queryLogFields(format string, fields []string, logQueryIDs bool) ([]string, error) {
+	if len(fields) == 0 {
+		if format == "ltsv" {
+			fields = []string{"time", "client_ip", "qname", "qtype", "return_code", "cached", "duration", "server"}
+		} else {
+			fields = []string{"time", "client_ip", "qname", "qtype", "return_code", "duration", "server"}
+		}
+		if logQueryIDs {
+			fields = append(fields, "query_id")
+		}
+	}
+	normalizedFields := make([]string, len(fields))
+	for i, field := range fields {
+		field = strings.ToLower(field)
+		switch field {
+		case "time", "client_ip", "client_proto", "qname", "qtype", "return_code", "cached", "duration", "server", "dnssec", "query_id", "listener", "original_dst":
+		default:
+			return nil, fmt.Errorf("Unsupported query log field: [%s]", field)
+		}
+		normalizedFields[i] = field
+	}
+	return normalizedFields, nil
+}
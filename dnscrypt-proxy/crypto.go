@@ -4,7 +4,10 @@
 	"bytes"
 	crypto_rand "crypto/rand"
 	"crypto/sha512"
+	"encoding/binary"
 	"errors"
+	"sync"
+	"time"
 
 	"github.com/jedisct1/dlog"
 	"github.com/jedisct1/xsecretbox"
@@ -77,11 +80,12 @@ func (proxy *Proxy) Encrypt(
 	packet []byte,
 	proto string,
 ) (sharedKey *[32]byte, encrypted []byte, clientNonce []byte, err error) {
-	nonce, clientNonce := make([]byte, NonceSize), make([]byte, HalfNonceSize)
+	var nonce [NonceSize]byte
+	clientNonce = make([]byte, HalfNonceSize)
 	if _, err := crypto_rand.Read(clientNonce); err != nil {
 		return nil, nil, nil, err
 	}
-	copy(nonce, clientNonce)
+	copy(nonce[:], clientNonce)
 	var publicKey *[PublicKeySize]byte
 	if proxy.ephemeralKeys {
 		h := sha512.New512_256()
@@ -94,6 +98,8 @@ func (proxy *Proxy) Encrypt(
 		publicKey = &xPublicKey
 		xsharedKey := ComputeSharedKey(serverInfo.CryptoConstruction, &ephSk, &serverInfo.ServerPk, nil)
 		sharedKey = &xsharedKey
+	} else if proxy.keyRotation > 0 {
+		publicKey, sharedKey = proxy.clientKeys.get(proxy, serverInfo)
 	} else {
 		sharedKey = &serverInfo.SharedKey
 		publicKey = &proxy.proxyPublicKey
@@ -122,10 +128,10 @@ func (proxy *Proxy) Encrypt(
 	encrypted = append(encrypted, nonce[:HalfNonceSize]...)
 	padded := pad(packet, paddedLength-QueryOverhead)
 	if serverInfo.CryptoConstruction == XChacha20Poly1305 {
-		encrypted = xsecretbox.Seal(encrypted, nonce, padded, sharedKey[:])
+		encrypted = xsecretbox.Seal(encrypted, nonce[:], padded, sharedKey[:])
 	} else {
 		var xsalsaNonce [24]byte
-		copy(xsalsaNonce[:], nonce)
+		copy(xsalsaNonce[:], nonce[:])
 		encrypted = secretbox.Seal(encrypted, padded, &xsalsaNonce, sharedKey)
 	}
 	return
@@ -170,3 +176,46 @@ func (proxy *Proxy) Decrypt(
 	}
 	return packet, nil
 }
+
+// ClientKeys holds client key pairs that are specific to each server, and replaced at regular intervals.
+// Keys are derived from the main secret key, the server name and the current time window, so that queries
+// sent to different servers, or during different time windows, can't be linked to the same client.
+type ClientKeys struct {
+	sync.Mutex
+	keys map[string]*clientKey
+}
+
+type clientKey struct {
+	window    int64
+	serverPk  [32]byte
+	publicKey [PublicKeySize]byte
+	sharedKey [32]byte
+}
+
+func NewClientKeys() ClientKeys {
+	return ClientKeys{keys: make(map[string]*clientKey)}
+}
+
+func (clientKeys *ClientKeys) get(proxy *Proxy, serverInfo *ServerInfo) (*[PublicKeySize]byte, *[32]byte) {
+	window := time.Now().Unix() / int64(proxy.keyRotation/time.Second)
+	clientKeys.Lock()
+	defer clientKeys.Unlock()
+	key, ok := clientKeys.keys[serverInfo.Name]
+	if !ok || key.window != window || key.serverPk != serverInfo.ServerPk {
+		h := sha512.New512_256()
+		h.Write([]byte("dnscrypt-proxy client key"))
+		h.Write(proxy.proxySecretKey[:])
+		h.Write([]byte(serverInfo.Name))
+		var windowBin [8]byte
+		binary.BigEndian.PutUint64(windowBin[:], uint64(window))
+		h.Write(windowBin[:])
+		var secretKey [32]byte
+		h.Sum(secretKey[:0])
+		key = &clientKey{window: window, serverPk: serverInfo.ServerPk}
+		curve25519.ScalarBaseMult(&key.publicKey, &secretKey)
+		key.sharedKey = ComputeSharedKey(serverInfo.CryptoConstruction, &secretKey, &serverInfo.ServerPk, nil)
+		clientKeys.keys[serverInfo.Name] = key
+		cryptoLog.Debugf("[%s] New client key for the current time window", serverInfo.Name)
+	}
+	return &key.publicKey, &key.sharedKey
+}
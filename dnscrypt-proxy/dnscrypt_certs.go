@@ -44,13 +44,13 @@ func FetchCurrentDNSCryptCert(
 	query.SetQuestion(providerName, dns.TypeTXT)
 	if !strings.HasPrefix(providerName, "2.dnscrypt-cert.") {
 		if relay != nil && !proxy.anonDirectCertFallback {
-			dlog.Warnf(
+			cryptoLog.Warnf(
 				"[%v] uses a non-standard provider name, enable direct cert fallback to use with a relay ('%v' doesn't start with '2.dnscrypt-cert.')",
 				*serverName,
 				providerName,
 			)
 		} else {
-			dlog.Warnf("[%v] uses a non-standard provider name ('%v' doesn't start with '2.dnscrypt-cert.')", *serverName, providerName)
+			cryptoLog.Warnf("[%v] uses a non-standard provider name ('%v' doesn't start with '2.dnscrypt-cert.')", *serverName, providerName)
 			relay = nil
 		}
 	}
@@ -68,28 +68,32 @@ func FetchCurrentDNSCryptCert(
 		tryFragmentsSupport,
 	)
 	if err != nil {
-		dlog.Noticef("[%s] TIMEOUT", *serverName)
+		cryptoLog.Noticef("[%s] TIMEOUT", *serverName)
 		return CertInfo{}, 0, fragmentsBlocked, err
 	}
 	now := uint32(time.Now().Unix())
 	certInfo := CertInfo{CryptoConstruction: UndefinedConstruction}
 	highestSerial := uint32(0)
+	var validFrom, validUntil uint32
+	certEvents := proxy.certEvents
 	var certCountStr string
 	for _, answerRr := range in.Answer {
 		var txt string
 		if t, ok := answerRr.(*dns.TXT); !ok {
-			dlog.Noticef("[%v] Extra record of type [%v] found in certificate", *serverName, answerRr.Header().Rrtype)
+			cryptoLog.Noticef("[%v] Extra record of type [%v] found in certificate", *serverName, answerRr.Header().Rrtype)
 			continue
 		} else {
 			txt = strings.Join(t.Txt, "")
 		}
 		binCert := PackTXTRR(txt)
 		if len(binCert) < 124 {
-			dlog.Warnf("[%v] Certificate too short", *serverName)
+			cryptoLog.Warnf("[%v] Certificate too short", *serverName)
+			certEvents.Rejected(*serverName, providerName, 0, 0, 0, "certificate too short")
 			continue
 		}
 		if !bytes.Equal(binCert[:4], CertMagic[:4]) {
-			dlog.Warnf("[%v] Invalid cert magic", *serverName)
+			cryptoLog.Warnf("[%v] Invalid cert magic", *serverName)
+			certEvents.Rejected(*serverName, providerName, 0, 0, 0, "invalid magic")
 			continue
 		}
 		cryptoConstruction := CryptoConstruction(0)
@@ -99,25 +103,28 @@ func FetchCurrentDNSCryptCert(
 		case 0x0002:
 			cryptoConstruction = XChacha20Poly1305
 		default:
-			dlog.Noticef("[%v] Unsupported crypto construction", *serverName)
+			cryptoLog.Noticef("[%v] Unsupported crypto construction", *serverName)
+			certEvents.Rejected(*serverName, providerName, 0, 0, 0, "unsupported crypto construction")
 			continue
 		}
 		signature := binCert[8:72]
 		signed := binCert[72:]
 		if !ed25519.Verify(pk, signed, signature) {
-			dlog.Warnf("[%v] Incorrect signature for provider name: [%v]", *serverName, providerName)
+			cryptoLog.Warnf("[%v] Incorrect signature for provider name: [%v]", *serverName, providerName)
+			certEvents.Rejected(*serverName, providerName, 0, 0, 0, "incorrect signature")
 			continue
 		}
 		serial := binary.BigEndian.Uint32(binCert[112:116])
 		tsBegin := binary.BigEndian.Uint32(binCert[116:120])
 		tsEnd := binary.BigEndian.Uint32(binCert[120:124])
 		if tsBegin >= tsEnd {
-			dlog.Warnf("[%v] certificate ends before it starts (%v >= %v)", *serverName, tsBegin, tsEnd)
+			cryptoLog.Warnf("[%v] certificate ends before it starts (%v >= %v)", *serverName, tsBegin, tsEnd)
+			certEvents.Rejected(*serverName, providerName, serial, tsBegin, tsEnd, "ends before it starts")
 			continue
 		}
 		ttl := tsEnd - tsBegin
 		if ttl > 86400*7 {
-			dlog.Infof(
+			cryptoLog.Infof(
 				"[%v] the key validity period for this server is excessively long (%d days), significantly reducing reliability and forward security.",
 				*serverName,
 				ttl/86400,
@@ -128,12 +135,16 @@ func FetchCurrentDNSCryptCert(
 					"[%v] certificate will expire today -- Switch to a different resolver as soon as possible",
 					*serverName,
 				)
+				proxy.alerter.Fire(AlertCertificateExpiring, *serverName, "[%v] certificate will expire today", *serverName)
+				certEvents.Expiring(*serverName, providerName, serial, tsBegin, tsEnd)
 			} else if daysLeft <= 7 {
-				dlog.Warnf("[%v] certificate is about to expire -- if you don't manage this server, tell the server operator about it", *serverName)
+				cryptoLog.Warnf("[%v] certificate is about to expire -- if you don't manage this server, tell the server operator about it", *serverName)
+				proxy.alerter.Fire(AlertCertificateExpiring, *serverName, "[%v] certificate will expire in %d days", *serverName, daysLeft)
+				certEvents.Expiring(*serverName, providerName, serial, tsBegin, tsEnd)
 			} else if daysLeft <= 30 {
-				dlog.Infof("[%v] certificate will expire in %d days", *serverName, daysLeft)
+				cryptoLog.Infof("[%v] certificate will expire in %d days", *serverName, daysLeft)
 			} else {
-				dlog.Debugf("[%v] certificate still valid for %d days", *serverName, daysLeft)
+				cryptoLog.Debugf("[%v] certificate still valid for %d days", *serverName, daysLeft)
 			}
 			certInfo.ForwardSecurity = false
 		} else {
@@ -141,30 +152,32 @@ func FetchCurrentDNSCryptCert(
 		}
 		if !proxy.certIgnoreTimestamp {
 			if now > tsEnd || now < tsBegin {
-				dlog.Debugf(
+				cryptoLog.Debugf(
 					"[%v] Certificate not valid at the current date (now: %v is not in [%v..%v])",
 					*serverName,
 					now,
 					tsBegin,
 					tsEnd,
 				)
+				certEvents.Rejected(*serverName, providerName, serial, tsBegin, tsEnd, "not valid at the current date")
 				continue
 			}
 		}
 		if serial < highestSerial {
-			dlog.Debugf("[%v] Superseded by a previous certificate", *serverName)
+			cryptoLog.Debugf("[%v] Superseded by a previous certificate", *serverName)
 			continue
 		}
 		if serial == highestSerial {
 			if cryptoConstruction < certInfo.CryptoConstruction {
-				dlog.Debugf("[%v] Keeping the previous, preferred crypto construction", *serverName)
+				cryptoLog.Debugf("[%v] Keeping the previous, preferred crypto construction", *serverName)
 				continue
 			} else {
-				dlog.Debugf("[%v] Upgrading the construction from %v to %v", *serverName, certInfo.CryptoConstruction, cryptoConstruction)
+				cryptoLog.Debugf("[%v] Upgrading the construction from %v to %v", *serverName, certInfo.CryptoConstruction, cryptoConstruction)
 			}
 		}
 		if cryptoConstruction != XChacha20Poly1305 && cryptoConstruction != XSalsa20Poly1305 {
-			dlog.Noticef("[%v] Cryptographic construction %v not supported", *serverName, cryptoConstruction)
+			cryptoLog.Noticef("[%v] Cryptographic construction %v not supported", *serverName, cryptoConstruction)
+			certEvents.Rejected(*serverName, providerName, serial, tsBegin, tsEnd, "unsupported crypto construction")
 			continue
 		}
 		var serverPk [32]byte
@@ -172,18 +185,20 @@ func FetchCurrentDNSCryptCert(
 		sharedKey := ComputeSharedKey(cryptoConstruction, &proxy.proxySecretKey, &serverPk, &providerName)
 		certInfo.SharedKey = sharedKey
 		highestSerial = serial
+		validFrom, validUntil = tsBegin, tsEnd
 		certInfo.CryptoConstruction = cryptoConstruction
 		copy(certInfo.ServerPk[:], serverPk[:])
 		copy(certInfo.MagicQuery[:], binCert[104:112])
 		if isNew {
-			dlog.Noticef("[%s] OK (DNSCrypt) - rtt: %dms%s", *serverName, rtt.Nanoseconds()/1000000, certCountStr)
+			cryptoLog.Noticef("[%s] OK (DNSCrypt) - rtt: %dms%s", *serverName, rtt.Nanoseconds()/1000000, certCountStr)
 		} else {
-			dlog.Infof("[%s] OK (DNSCrypt) - rtt: %dms%s", *serverName, rtt.Nanoseconds()/1000000, certCountStr)
+			cryptoLog.Infof("[%s] OK (DNSCrypt) - rtt: %dms%s", *serverName, rtt.Nanoseconds()/1000000, certCountStr)
 		}
 		certCountStr = " - additional certificate"
 	}
 	if certInfo.CryptoConstruction == UndefinedConstruction {
 		return certInfo, 0, fragmentsBlocked, errors.New("No usable certificate found")
 	}
+	certEvents.Selected(*serverName, providerName, highestSerial, validFrom, validUntil)
 	return certInfo, int(rtt.Nanoseconds() / 1000000), fragmentsBlocked, nil
 }
@@ -144,65 +144,65 @@ func NormalizeQName(str string) (string, error) {
 	return b.String(), nil
 }
 
-func getMinTTL(msg *dns.Msg, minTTL uint32, maxTTL uint32, cacheNegMinTTL uint32, cacheNegMaxTTL uint32) time.Duration {
-	if (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) ||
-		(len(msg.Answer) <= 0 && len(msg.Ns) <= 0) {
+// getMinTTL returns how long a response can be cached.
+// Negative responses are cached according to RFC 2308: NXDOMAIN and NODATA responses use the SOA record
+// of the authority section, and have their own limits. SERVFAIL responses are only cached for `cacheServFailTTL`.
+func getMinTTL(
+	msg *dns.Msg,
+	minTTL uint32,
+	maxTTL uint32,
+	cacheNegMinTTL uint32,
+	cacheNegMaxTTL uint32,
+	cacheNoDataMinTTL uint32,
+	cacheNoDataMaxTTL uint32,
+	cacheServFailTTL uint32,
+) time.Duration {
+	switch {
+	case msg.Rcode == dns.RcodeServerFailure:
+		return time.Duration(cacheServFailTTL) * time.Second
+	case msg.Rcode == dns.RcodeNameError:
+		return getNegativeTTL(msg, cacheNegMinTTL, cacheNegMaxTTL)
+	case msg.Rcode == dns.RcodeSuccess && len(msg.Answer) <= 0:
+		return getNegativeTTL(msg, cacheNoDataMinTTL, cacheNoDataMaxTTL)
+	case msg.Rcode != dns.RcodeSuccess:
 		return time.Duration(cacheNegMinTTL) * time.Second
 	}
-	var ttl uint32
-	if msg.Rcode == dns.RcodeSuccess {
-		ttl = uint32(maxTTL)
-	} else {
-		ttl = uint32(cacheNegMaxTTL)
-	}
-	if len(msg.Answer) > 0 {
-		for _, rr := range msg.Answer {
-			if rr.Header().Ttl < ttl {
-				ttl = rr.Header().Ttl
-			}
-		}
-	} else {
-		for _, rr := range msg.Ns {
-			if rr.Header().Ttl < ttl {
-				ttl = rr.Header().Ttl
-			}
+	ttl := maxTTL
+	for _, rr := range msg.Answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
 		}
 	}
-	if msg.Rcode == dns.RcodeSuccess {
-		if ttl < minTTL {
-			ttl = minTTL
-		}
-	} else {
-		if ttl < cacheNegMinTTL {
-			ttl = cacheNegMinTTL
-		}
+	if ttl < minTTL {
+		ttl = minTTL
 	}
 	return time.Duration(ttl) * time.Second
 }
 
-func setMaxTTL(msg *dns.Msg, ttl uint32) {
-	for _, rr := range msg.Answer {
-		if ttl < rr.Header().Ttl {
-			rr.Header().Ttl = ttl
-		}
+// getNegativeTTL returns the TTL of a negative response, which is the minimum of the TTL and
+// of the MINIMUM field of the SOA record (RFC 2308, section 5)
+func getNegativeTTL(msg *dns.Msg, minTTL uint32, maxTTL uint32) time.Duration {
+	if len(msg.Ns) <= 0 {
+		return time.Duration(minTTL) * time.Second
 	}
+	ttl := maxTTL
 	for _, rr := range msg.Ns {
-		if ttl < rr.Header().Ttl {
-			rr.Header().Ttl = ttl
-		}
-	}
-	for _, rr := range msg.Extra {
-		header := rr.Header()
-		if header.Rrtype == dns.TypeOPT {
-			continue
+		rrTTL := rr.Header().Ttl
+		if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < rrTTL {
+			rrTTL = soa.Minttl
 		}
-		if ttl < rr.Header().Ttl {
-			rr.Header().Ttl = ttl
+		if rrTTL < ttl {
+			ttl = rrTTL
 		}
 	}
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+	return time.Duration(ttl) * time.Second
 }
 
-func updateTTL(msg *dns.Msg, expiration time.Time) {
+// remainingTTL returns the number of seconds until `expiration`, rounded to the nearest second
+func remainingTTL(expiration time.Time) uint32 {
 	until := time.Until(expiration)
 	ttl := uint32(0)
 	if until > 0 {
@@ -211,6 +211,11 @@ func updateTTL(msg *dns.Msg, expiration time.Time) {
 			ttl += 1
 		}
 	}
+	return ttl
+}
+
+func updateTTL(msg *dns.Msg, expiration time.Time) {
+	ttl := remainingTTL(expiration)
 	for _, rr := range msg.Answer {
 		rr.Header().Ttl = ttl
 	}
@@ -239,6 +244,16 @@ func hasEDNS0Padding(packet []byte) (bool, error) {
 	return false, nil
 }
 
+// edns0PaddingLen returns the padding length required for a query to be a multiple of blockSize (RFC 8467),
+// including the padding option header, and the OPT record if it has to be added
+func edns0PaddingLen(msg *dns.Msg, packetLen int, blockSize int) int {
+	overhead := 4
+	if msg.IsEdns0() == nil {
+		overhead += 11
+	}
+	return (blockSize - (packetLen+overhead)%blockSize) % blockSize
+}
+
 func addEDNS0PaddingIfNoneFound(msg *dns.Msg, unpaddedPacket []byte, paddingLen int) ([]byte, error) {
 	edns0 := msg.IsEdns0()
 	if edns0 == nil {
@@ -263,6 +278,19 @@ func addEDNS0PaddingIfNoneFound(msg *dns.Msg, unpaddedPacket []byte, paddingLen
 	return msg.Pack()
 }
 
+// padQuery adds EDNS0 padding to a query that isn't padded yet
+func padQuery(query []byte, blockSize int) []byte {
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil {
+		return query
+	}
+	paddedQuery, err := addEDNS0PaddingIfNoneFound(&msg, query, edns0PaddingLen(&msg, len(query), blockSize))
+	if err != nil {
+		return query
+	}
+	return paddedQuery
+}
+
 func removeEDNS0Options(msg *dns.Msg) bool {
 	edns0 := msg.IsEdns0()
 	if edns0 == nil {
@@ -436,11 +464,11 @@ func _dnsExchange(
 		}
 		upstreamAddr := udpAddr
 		if relay != nil {
-			proxy.prepareForRelay(udpAddr.IP, udpAddr.Port, &binQuery)
+			proxy.prepareForRelayChain(relay, udpAddr.IP, udpAddr.Port, &binQuery)
 			upstreamAddr = relay.RelayUDPAddr
 		}
 		now := time.Now()
-		pc, err := net.DialUDP("udp", nil, upstreamAddr)
+		pc, err := outboundDialer(proxy.timeout).Dial("udp", upstreamAddr.String())
 		if err != nil {
 			return DNSExchangeResponse{err: err}
 		}
@@ -469,14 +497,14 @@ func _dnsExchange(
 		}
 		upstreamAddr := tcpAddr
 		if relay != nil {
-			proxy.prepareForRelay(tcpAddr.IP, tcpAddr.Port, &binQuery)
+			proxy.prepareForRelayChain(relay, tcpAddr.IP, tcpAddr.Port, &binQuery)
 			upstreamAddr = relay.RelayTCPAddr
 		}
 		now := time.Now()
 		var pc net.Conn
-		proxyDialer := proxy.xTransport.proxyDialer
+		proxyDialer := proxy.xTransport.dialerFor(tcpAddr.IP.String())
 		if proxyDialer == nil {
-			pc, err = net.DialTCP("tcp", nil, upstreamAddr)
+			pc, err = outboundDialer(proxy.timeout).Dial("tcp", upstreamAddr.String())
 		} else {
 			pc, err = (*proxyDialer).Dial("tcp", tcpAddr.String())
 		}
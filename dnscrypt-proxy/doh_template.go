@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	DoHMethodAuto = "auto"
+	DoHMethodGet  = "get"
+	DoHMethodPost = "post"
+)
+
+// DoHTemplate is a URI template with a `dns` variable (RFC 8484, section 4.1).
+// Only the expressions used by DoH servers are supported: `{?dns}`, `{&dns}` and `{dns}`.
+type DoHTemplate struct {
+	prefix   string
+	operator string
+	suffix   string
+}
+
+func ParseDoHTemplate(template string) (*DoHTemplate, error) {
+	start := strings.Index(template, "{")
+	end := strings.Index(template, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("No `dns` variable found in the URI template [%s]", template)
+	}
+	expression := template[start+1 : end]
+	operator := ""
+	if len(expression) > 0 && (expression[0] == '?' || expression[0] == '&') {
+		operator, expression = expression[0:1], expression[1:]
+	}
+	if expression != "dns" || strings.ContainsAny(template[end+1:], "{}") {
+		return nil, fmt.Errorf("Unsupported URI template: [%s]", template)
+	}
+	dohTemplate := DoHTemplate{prefix: template[:start], operator: operator, suffix: template[end+1:]}
+	url, err := dohTemplate.Expand(nil)
+	if err != nil {
+		return nil, err
+	}
+	if url.Scheme != "https" || len(url.Host) == 0 {
+		return nil, fmt.Errorf("URI template [%s] must be an https URL", template)
+	}
+	return &dohTemplate, nil
+}
+
+// Expand returns the URL for a query; with a nil query, the `dns` variable is left undefined, as required for POST requests
+func (dohTemplate *DoHTemplate) Expand(query []byte) (*url.URL, error) {
+	value := ""
+	if query != nil {
+		value = base64.RawURLEncoding.EncodeToString(query)
+		switch dohTemplate.operator {
+		case "?":
+			value = "?dns=" + value
+		case "&":
+			value = "&dns=" + value
+		}
+	}
+	return url.Parse(dohTemplate.prefix + value + dohTemplate.suffix)
+}
+
+func ValidateDoHMethod(method string) error {
+	switch method {
+	case "", DoHMethodAuto, DoHMethodGet, DoHMethodPost:
+		return nil
+	}
+	return errors.New("DoH method must be 'auto', 'get' or 'post'")
+}
+
+func (xTransport *XTransport) SetHostDoHMethod(host string, method string) {
+	xTransport.dohMethods[hostProxyKey(host)] = method
+}
+
+func (xTransport *XTransport) SetHostDoHTemplate(host string, dohTemplate *DoHTemplate) {
+	xTransport.dohTemplates[hostProxyKey(host)] = dohTemplate
+}
+
+// dohMethodFor returns the method to use with a DoH server: 'get', 'post', or 'auto' to probe for POST support
+func (xTransport *XTransport) dohMethodFor(host string) string {
+	if method, ok := xTransport.dohMethods[hostProxyKey(host)]; ok && len(method) > 0 {
+		return method
+	}
+	if len(xTransport.dohMethod) == 0 {
+		return DoHMethodAuto
+	}
+	return xTransport.dohMethod
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestDoHTemplate(t *testing.T) {
+	c := check.T(t)
+	dohTemplate, err := ParseDoHTemplate("https://dns.example.com/dns-query{?dns}")
+	c.Nil(err)
+	url, err := dohTemplate.Expand([]byte{0xfb, 0xff})
+	c.Nil(err)
+	c.EQ(url.String(), "https://dns.example.com/dns-query?dns=-_8")
+	url, err = dohTemplate.Expand(nil)
+	c.Nil(err)
+	c.EQ(url.String(), "https://dns.example.com/dns-query")
+
+	dohTemplate, err = ParseDoHTemplate("https://dns.example.com/q?ct{&dns}")
+	c.Nil(err)
+	url, _ = dohTemplate.Expand([]byte{0})
+	c.EQ(url.String(), "https://dns.example.com/q?ct&dns=AA")
+
+	_, err = ParseDoHTemplate("https://dns.example.com/dns-query{?name}")
+	c.NotNil(err)
+	_, err = ParseDoHTemplate("http://dns.example.com/dns-query{?dns}")
+	c.NotNil(err)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DomainRoutes sends queries for names matching patterns to a subset of the servers.
+// Servers that names are routed to are reserved for these names, and are not used for other queries.
+type DomainRoutes struct {
+	patternMatcher *PatternMatcher
+	reserved       map[string]bool
+}
+
+// NewDomainRoutes returns the routes for a map of patterns to server names, or nil if there are none
+func NewDomainRoutes(routes map[string][]string) (*DomainRoutes, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	domainRoutes := DomainRoutes{patternMatcher: NewPatternMatcher(), reserved: make(map[string]bool)}
+	patterns := make([]string, 0, len(routes))
+	for pattern := range routes {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	for i, pattern := range patterns {
+		serverNames := routes[pattern]
+		if len(serverNames) == 0 {
+			return nil, fmt.Errorf("No servers to route [%s] to", pattern)
+		}
+		if err := domainRoutes.patternMatcher.Add(pattern, serverNames, i+1); err != nil {
+			return nil, err
+		}
+		for _, serverName := range serverNames {
+			domainRoutes.reserved[serverName] = true
+		}
+	}
+	return &domainRoutes, nil
+}
+
+// serversFor returns the names of the servers a name is routed to, or nil if it doesn't match any routes
+func (domainRoutes *DomainRoutes) serversFor(qName string) []string {
+	if domainRoutes == nil {
+		return nil
+	}
+	matched, _, serverNames := domainRoutes.patternMatcher.Eval(qName)
+	if !matched || serverNames == nil {
+		return nil
+	}
+	return serverNames.([]string)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/VividCortex/ewma"
+	"github.com/powerman/check"
+)
+
+func TestDomainRoutes(t *testing.T) {
+	c := check.T(t)
+	routes, err := NewDomainRoutes(nil)
+	c.Nil(err)
+	c.Nil(routes)
+	c.Nil(routes.serversFor("example.com"))
+
+	routes, err = NewDomainRoutes(map[string][]string{
+		"*.corp.example":   {"corp-doh"},
+		"intranet.example": {"corp-doh", "corp-doh-backup"},
+	})
+	c.Nil(err)
+	c.DeepEqual(routes.serversFor("www.corp.example"), []string{"corp-doh"})
+	c.DeepEqual(routes.serversFor("corp.example"), []string{"corp-doh"})
+	c.DeepEqual(routes.serversFor("a.intranet.example"), []string{"corp-doh", "corp-doh-backup"})
+	c.Nil(routes.serversFor("example.com"))
+	c.True(routes.reserved["corp-doh"])
+	c.True(routes.reserved["corp-doh-backup"])
+
+	_, err = NewDomainRoutes(map[string][]string{"corp.example": {}})
+	c.NotNil(err)
+}
+
+func TestServersInfoReserved(t *testing.T) {
+	c := check.T(t)
+	serversInfo := NewServersInfo()
+	serversInfo.lbStrategy = LBStrategyFirst{}
+	serversInfo.lbEstimator = false
+	serversInfo.inner = []*ServerInfo{
+		{Name: "corp-doh", rtt: ewma.NewMovingAverage(RTTEwmaDecay)},
+		{Name: "public", rtt: ewma.NewMovingAverage(RTTEwmaDecay)},
+	}
+	serversInfo.reserved = map[string]bool{"corp-doh": true}
+	c.EQ(serversInfo.getOne().Name, "public")
+	c.EQ(serversInfo.getOneOf([]string{"corp-doh"}).Name, "corp-doh")
+	c.Nil(serversInfo.getOneOf([]string{"other"}))
+
+	serversInfo.inner = serversInfo.inner[:1]
+	c.Nil(serversInfo.getOne())
+}
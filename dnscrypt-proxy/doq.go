@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	DoQALPN               = "doq"
+	doqNoError            = 0x0
+	doqInternalError      = 0x1
+	doqDefaultIdleTimeout = 30 * time.Second
+)
+
+// Address validation tokens sent by DoQ servers, that avoid a round-trip when reconnecting.
+// quic-go doesn't allow tokens to be serialized, so unlike TLS sessions, they are only kept in memory.
+var doqTokenStore = quic.NewLRUTokenStore(dotSessionCacheSize, 4)
+
+// TLS sessions of DoQ servers. They are kept apart from DoT sessions, that are negotiated with another ALPN
+// for the same server names, and would otherwise replace them and make 0-RTT fail.
+var doqSessionCache = tls.NewLRUClientSessionCache(dotSessionCacheSize)
+
+// prefixedSessionCache stores sessions in another cache, under prefixed keys
+type prefixedSessionCache struct {
+	prefix string
+	cache  tls.ClientSessionCache
+}
+
+func (sessionCache *prefixedSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return sessionCache.cache.Get(sessionCache.prefix + sessionKey)
+}
+
+func (sessionCache *prefixedSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	sessionCache.cache.Put(sessionCache.prefix+sessionKey, cs)
+}
+
+// DoQClient sends queries to a DNS-over-QUIC server (RFC 9250).
+// A single connection is shared by all queries, each query being sent over its own stream.
+// When TLS session tickets are enabled, new connections are resumed using 0-RTT.
+// Connection migration is not supported, as the version of quic-go in use can't migrate client
+// connections; if the connection is lost after a network change, a new one is established.
+// QUIC runs over UDP, that proxies don't carry, so servers reached through a proxy are never used.
+type DoQClient struct {
+	sync.Mutex
+	proxy    *Proxy
+	host     string
+	port     int
+	hostName string
+	conn     *doqConn
+	closed   bool
+}
+
+// doqConn is a QUIC connection, and the UDP socket it was established over.
+// quic-go never closes sockets it didn't create, so the socket has to be closed with the connection.
+type doqConn struct {
+	quic.EarlyConnection
+	udpConn *net.UDPConn
+}
+
+func (conn *doqConn) close(code quic.ApplicationErrorCode) {
+	_ = conn.CloseWithError(code, "")
+	conn.udpConn.Close()
+}
+
+func NewDoQClient(proxy *Proxy, stamp *stamps.ServerStamp) *DoQClient {
+	host, port := ExtractHostAndPort(stamp.ProviderName, DoTDefaultPort)
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return &DoQClient{proxy: proxy, host: host, port: port, hostName: host}
+}
+
+func (client *DoQClient) dial(ctx context.Context) (*doqConn, error) {
+	xTransport := client.proxy.xTransport
+	if xTransport.proxied(client.host) {
+		// Proxies don't carry UDP; connecting directly would reveal the address of the client
+		return nil, fmt.Errorf("[%s] is configured to be reached through a proxy, which DoQ can't use", client.host)
+	}
+	ip := ParseIP(client.host)
+	if ip == nil {
+		if err := xTransport.resolveAndUpdateCache(client.host); err != nil {
+			return nil, err
+		}
+		ip, _ = xTransport.loadCachedIP(client.host)
+		if ip == nil {
+			return nil, fmt.Errorf("No IP address found for [%s]", client.host)
+		}
+	}
+	network := "udp4"
+	if ip.To4() == nil {
+		network = "udp6"
+	}
+	udpAddr, err := net.ResolveUDPAddr(network, net.JoinHostPort(ip.String(), strconv.Itoa(client.port)))
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := listenOutboundUDP(network)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:       client.hostName,
+		NextProtos:       []string{DoQALPN},
+		MinVersion:       tls.VersionTLS13,
+		KeyLogWriter:     xTransport.keyLogWriter,
+		CurvePreferences: xTransport.curvePreferences(),
+	}
+	if !xTransport.tlsDisableSessionTickets {
+		tlsConfig.ClientSessionCache = doqSessionCache
+	} else {
+		tlsConfig.SessionTicketsDisabled = true
+	}
+	xTransport.applyHostTLS(tlsConfig, client.host)
+	quicConfig := &quic.Config{
+		MaxIdleTimeout:  doqDefaultIdleTimeout,
+		KeepAlivePeriod: xTransport.keepAlive,
+		TokenStore:      doqTokenStore,
+	}
+	conn, err := quic.DialEarly(ctx, udpConn, udpAddr, tlsConfig, quicConfig)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+	return &doqConn{EarlyConnection: conn, udpConn: udpConn}, nil
+}
+
+func (client *DoQClient) getConn(ctx context.Context) (*doqConn, bool, error) {
+	client.Lock()
+	defer client.Unlock()
+	if client.closed {
+		return nil, false, errors.New("DoQ client is closed")
+	}
+	if client.conn != nil {
+		select {
+		case <-client.conn.Context().Done():
+			client.conn.close(doqNoError)
+			client.conn = nil
+		default:
+			return client.conn, true, nil
+		}
+	}
+	conn, err := client.dial(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	client.conn = conn
+	return conn, false, nil
+}
+
+func (client *DoQClient) dropConn(conn *doqConn) {
+	client.Lock()
+	if client.conn == conn {
+		client.conn = nil
+	}
+	client.Unlock()
+	conn.close(doqInternalError)
+}
+
+// Close closes the connection, if there is one; the client can't be used any more afterwards
+func (client *DoQClient) Close() {
+	client.Lock()
+	conn := client.conn
+	client.conn, client.closed = nil, true
+	client.Unlock()
+	if conn != nil {
+		conn.close(doqNoError)
+	}
+}
+
+// Exchange sends a query and returns the response, as well as the state of the connection it was sent over
+func (client *DoQClient) Exchange(query []byte, timeout time.Duration) ([]byte, *quic.ConnectionState, error) {
+	if len(query) < MinDNSPacketSize {
+		return nil, nil, errors.New("Query is too short")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// The message ID must be set to 0 (RFC 9250, section 4.2.1)
+	tid := TransactionID(query)
+	doqQuery := make([]byte, len(query))
+	copy(doqQuery, query)
+	SetTransactionID(doqQuery, 0)
+	prefixedQuery, err := PrefixWithSize(doqQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, reused, err := client.getConn(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		response, err := client.exchangeOverStream(ctx, conn, prefixedQuery)
+		if err == nil {
+			if len(response) >= MinDNSPacketSize {
+				SetTransactionID(response, tid)
+			}
+			state := conn.ConnectionState()
+			return response, &state, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, &net.OpError{Op: "read", Net: "quic", Err: context.DeadlineExceeded}
+		}
+		client.dropConn(conn)
+		// The server may have closed an idle connection; retry once over a new one
+		if !reused {
+			return nil, nil, err
+		}
+		dlog.Debugf("[%s] Reused DoQ connection failed, reconnecting", client.hostName)
+	}
+	return nil, nil, errors.New("Unable to send the query over DoQ")
+}
+
+func (client *DoQClient) exchangeOverStream(ctx context.Context, conn *doqConn, prefixedQuery []byte) ([]byte, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	if _, err := stream.Write(prefixedQuery); err != nil {
+		stream.CancelRead(doqInternalError)
+		return nil, err
+	}
+	// Closing the stream signals the end of the query
+	if err := stream.Close(); err != nil {
+		stream.CancelRead(doqInternalError)
+		return nil, err
+	}
+	var lengthPrefix [2]byte
+	if _, err := io.ReadFull(stream, lengthPrefix[:]); err != nil {
+		stream.CancelRead(doqInternalError)
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(lengthPrefix[:]))
+	if length < MinDNSPacketSize || length > MaxDNSPacketSize {
+		stream.CancelRead(doqInternalError)
+		return nil, errors.New("Invalid DoQ response length")
+	}
+	response := make([]byte, length)
+	if _, err := io.ReadFull(stream, response); err != nil {
+		stream.CancelRead(doqInternalError)
+		return nil, err
+	}
+	stream.CancelRead(doqNoError)
+	return response, nil
+}
+
+func fetchDoQServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	client := NewDoQClient(proxy, &stamp)
+	if proxy.xTransport.proxied(client.host) {
+		serversLog.Warnf("[%s] DoQ servers can't be reached through a proxy - Ignoring the server, so that queries don't bypass the proxy", name)
+		return ServerInfo{}, errors.New("DoQ servers can't be reached through a proxy")
+	}
+	if len(stamp.ServerAddrStr) > 0 {
+		ipOnly, _ := ExtractHostAndPort(stamp.ServerAddrStr, -1)
+		if ip := ParseIP(ipOnly); ip != nil {
+			host, _ := ExtractHostAndPort(stamp.ProviderName, -1)
+			proxy.xTransport.saveCachedIP(host, ip, -1*time.Second)
+		}
+	}
+	start := time.Now()
+	serverResponse, state, err := client.Exchange(dohNXTestPacket(0xcafe), proxy.timeout)
+	rtt := time.Since(start)
+	if err != nil {
+		client.Close()
+		serversLog.Infof("[%s] [%s]: %v", name, stamp.ProviderName, err)
+		return ServerInfo{}, err
+	}
+	serversLog.Infof("[%s] QUIC version: %v - Cipher suite: %v - 0-RTT: %v", name, state.Version, state.TLS.CipherSuite, state.Used0RTT)
+	if len(stamp.Hashes) > 0 {
+		found := false
+		for _, cert := range state.TLS.PeerCertificates {
+			h := sha256.Sum256(cert.RawTBSCertificate)
+			if proxy.showCerts {
+				serversLog.Noticef("Advertised cert: [%s] [%x]", cert.Subject, h)
+			} else {
+				serversLog.Debugf("Advertised cert: [%s] [%x]", cert.Subject, h)
+			}
+			for _, hash := range stamp.Hashes {
+				if len(hash) == len(h) && string(hash) == string(h[:]) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			client.Close()
+			dlog.Criticalf("[%s] Certificate hash not found", name)
+			return ServerInfo{}, errors.New("Certificate hash not found")
+		}
+	}
+	if len(serverResponse) < MinDNSPacketSize || serverResponse[0] != 0xca || serverResponse[1] != 0xfe {
+		client.Close()
+		return ServerInfo{}, errors.New("Server returned an unexpected response")
+	}
+	if Rcode(serverResponse) != dns.RcodeNameError {
+		dlog.Criticalf("[%s] may be a lying resolver", name)
+	}
+	xrtt := int(rtt.Nanoseconds() / 1000000)
+	if isNew {
+		serversLog.Noticef("[%s] OK (DoQ) - rtt: %dms", name, xrtt)
+	} else {
+		serversLog.Infof("[%s] OK (DoQ) - rtt: %dms", name, xrtt)
+	}
+	return ServerInfo{
+		Proto:      stamps.StampProtoTypeDoQ,
+		Name:       name,
+		Timeout:    proxy.timeout,
+		HostName:   stamp.ProviderName,
+		initialRtt: xrtt,
+		doq:        client,
+	}, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestDoQProxiedServer(t *testing.T) {
+	c := check.T(t)
+	proxy := Proxy{xTransport: NewXTransport()}
+	proxy.xTransport.httpProxyFunction = http.ProxyFromEnvironment
+	stamp, err := ParseServerStamp("quic://dns.example.com")
+	c.Must(c.Nil(err))
+	_, err = fetchDoQServerInfo(&proxy, "doq", stamp, true)
+	c.NotNil(err)
+	_, _, err = NewDoQClient(&proxy, &stamp).Exchange(dohNXTestPacket(0xcafe), time.Second)
+	c.NotNil(err)
+	ips, _ := proxy.xTransport.loadCachedIPs("dns.example.com")
+	c.Len(ips, 0)
+}
+
+func TestPrefixedSessionCache(t *testing.T) {
+	c := check.T(t)
+	cache := tls.NewLRUClientSessionCache(4)
+	doqCache := &prefixedSessionCache{prefix: "doq:", cache: cache}
+	session := &tls.ClientSessionState{}
+	doqCache.Put("dns.example.com", session)
+	_, found := cache.Get("dns.example.com")
+	c.False(found)
+	cs, found := doqCache.Get("dns.example.com")
+	c.True(found)
+	c.True(cs == session)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/miekg/dns"
+)
+
+const (
+	DoTDefaultPort      = 853
+	DoTMaxIdleConns     = 4
+	DoTSchemePrefix     = "tls://"
+	DoQSchemePrefix     = "quic://"
+	dotSessionCacheSize = 64
+)
+
+// TLS sessions are shared by all DoT servers, so that connections can be resumed after a refresh
+var dotSessionCache = tls.NewLRUClientSessionCache(dotSessionCacheSize)
+
+// ParseServerStamp parses a server stamp, including DoT and DoQ stamps that the stamps package doesn't support yet.
+// DoT and DoQ servers can also be given as `tls://host[:port]` and `quic://host[:port]`.
+func ParseServerStamp(stampStr string) (stamps.ServerStamp, error) {
+	if strings.HasPrefix(stampStr, DoTSchemePrefix) {
+		return newTLSServerStampFromAddress(stamps.StampProtoTypeTLS, stampStr[len(DoTSchemePrefix):])
+	}
+	if strings.HasPrefix(stampStr, DoQSchemePrefix) {
+		return newTLSServerStampFromAddress(stamps.StampProtoTypeDoQ, stampStr[len(DoQSchemePrefix):])
+	}
+	if strings.HasPrefix(stampStr, PlainDNSSchemePrefix) {
+		return newPlainServerStampFromAddress(stampStr[len(PlainDNSSchemePrefix):])
+	}
+	if strings.HasPrefix(stampStr, "sdns:") {
+		bin, err := base64.RawURLEncoding.Strict().DecodeString(strings.TrimPrefix(stampStr[5:], "//"))
+		if err == nil && len(bin) > 0 &&
+			(bin[0] == uint8(stamps.StampProtoTypeTLS) || bin[0] == uint8(stamps.StampProtoTypeDoQ)) {
+			return newTLSServerStamp(stamps.StampProtoType(bin[0]), bin)
+		}
+	}
+	return stamps.NewServerStampFromString(stampStr)
+}
+
+func newTLSServerStampFromAddress(proto stamps.StampProtoType, addrStr string) (stamps.ServerStamp, error) {
+	stamp := stamps.ServerStamp{Proto: proto}
+	host, port := ExtractHostAndPort(addrStr, DoTDefaultPort)
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if len(host) == 0 || port <= 0 || port > 65535 {
+		return stamp, fmt.Errorf("Invalid %s server address: [%s]", proto.String(), addrStr)
+	}
+	hostPort := net.JoinHostPort(host, strconv.Itoa(port))
+	if ParseIP(host) != nil {
+		stamp.ServerAddrStr = hostPort
+	}
+	stamp.ProviderName = hostPort
+	return stamp, nil
+}
+
+// id(u8)=0x03 (DoT) or 0x04 (DoQ) props addrLen(1) serverAddr hashLen(1) hash hostNameLen(1) hostName
+
+func newTLSServerStamp(proto stamps.StampProtoType, bin []byte) (stamps.ServerStamp, error) {
+	stamp := stamps.ServerStamp{Proto: proto}
+	if len(bin) < 13 {
+		return stamp, errors.New("Stamp is too short")
+	}
+	stamp.Props = stamps.ServerInformalProperties(binary.LittleEndian.Uint64(bin[1:9]))
+	binLen := len(bin)
+	pos := 9
+
+	length := int(bin[pos])
+	if 1+length >= binLen-pos {
+		return stamp, errors.New("Invalid stamp")
+	}
+	pos++
+	stamp.ServerAddrStr = string(bin[pos : pos+length])
+	pos += length
+
+	for {
+		vlen := int(bin[pos])
+		length = vlen & ^0x80
+		if 1+length >= binLen-pos {
+			return stamp, errors.New("Invalid stamp")
+		}
+		pos++
+		if length > 0 {
+			stamp.Hashes = append(stamp.Hashes, bin[pos:pos+length])
+		}
+		pos += length
+		if vlen&0x80 != 0x80 {
+			break
+		}
+	}
+
+	length = int(bin[pos])
+	if length >= binLen-pos {
+		return stamp, errors.New("Invalid stamp")
+	}
+	pos++
+	stamp.ProviderName = string(bin[pos : pos+length])
+	pos += length
+
+	if pos != binLen {
+		return stamp, errors.New("Invalid stamp (garbage after end)")
+	}
+	if len(stamp.ServerAddrStr) > 0 {
+		host, port := ExtractHostAndPort(stamp.ServerAddrStr, DoTDefaultPort)
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		if ParseIP(host) == nil || port <= 0 || port > 65535 {
+			return stamp, errors.New("Invalid stamp (IP address)")
+		}
+		stamp.ServerAddrStr = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return stamp, nil
+}
+
+// StampString returns the text representation of a stamp, including DoT and DoQ stamps
+func StampString(stamp *stamps.ServerStamp) string {
+	if stamp.Proto != stamps.StampProtoTypeTLS && stamp.Proto != stamps.StampProtoTypeDoQ {
+		return stamp.String()
+	}
+	bin := make([]uint8, 9)
+	bin[0] = uint8(stamp.Proto)
+	binary.LittleEndian.PutUint64(bin[1:9], uint64(stamp.Props))
+	serverAddrStr := strings.TrimSuffix(stamp.ServerAddrStr, ":"+strconv.Itoa(DoTDefaultPort))
+	bin = append(bin, uint8(len(serverAddrStr)))
+	bin = append(bin, []uint8(serverAddrStr)...)
+	if len(stamp.Hashes) == 0 {
+		bin = append(bin, uint8(0))
+	} else {
+		last := len(stamp.Hashes) - 1
+		for i, hash := range stamp.Hashes {
+			vlen := len(hash)
+			if i < last {
+				vlen |= 0x80
+			}
+			bin = append(bin, uint8(vlen))
+			bin = append(bin, hash...)
+		}
+	}
+	bin = append(bin, uint8(len(stamp.ProviderName)))
+	bin = append(bin, []uint8(stamp.ProviderName)...)
+	return stamps.StampScheme + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+// ---
+
+type dotConn struct {
+	conn     *tls.Conn
+	lastUsed time.Time
+}
+
+// DoTClient sends queries to a DNS-over-TLS server, reusing idle connections
+type DoTClient struct {
+	sync.Mutex
+	proxy    *Proxy
+	host     string
+	port     int
+	hostName string
+	idle     []dotConn
+}
+
+func NewDoTClient(proxy *Proxy, stamp *stamps.ServerStamp) *DoTClient {
+	host, port := ExtractHostAndPort(stamp.ProviderName, DoTDefaultPort)
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return &DoTClient{proxy: proxy, host: host, port: port, hostName: host}
+}
+
+func (client *DoTClient) dial(timeout time.Duration) (*tls.Conn, error) {
+	xTransport := client.proxy.xTransport
+	ipOnly := client.host
+	proxyDialer := xTransport.dialerFor(client.host)
+	happyEyeballs := false
+	if ParseIP(client.host) == nil && proxyDialer == nil {
+		if err := xTransport.resolveAndUpdateCache(client.host); err != nil {
+			return nil, err
+		}
+		cachedIPs, _ := xTransport.loadCachedIPs(client.host)
+		if len(cachedIPs) == 0 {
+			return nil, fmt.Errorf("No IP address found for [%s]", client.host)
+		}
+		ipOnly = cachedIPs[0].String()
+		happyEyeballs = len(cachedIPs) > 1
+	}
+	addrStr := net.JoinHostPort(ipOnly, strconv.Itoa(client.port))
+	var rawConn net.Conn
+	var err error
+	if happyEyeballs {
+		rawConn, err = xTransport.dialHappyEyeballs(context.Background(), "tcp", client.host, client.port, timeout)
+	} else if proxyDialer == nil {
+		rawConn, err = outboundDialer(timeout).Dial("tcp", addrStr)
+	} else {
+		rawConn, err = (*proxyDialer).Dial("tcp", addrStr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		ServerName:       client.hostName,
+		MinVersion:       tls.VersionTLS12,
+		KeyLogWriter:     xTransport.keyLogWriter,
+		CurvePreferences: xTransport.curvePreferences(),
+	}
+	if !xTransport.tlsDisableSessionTickets {
+		tlsConfig.ClientSessionCache = dotSessionCache
+	} else {
+		tlsConfig.SessionTicketsDisabled = true
+	}
+	if xTransport.tlsCipherSuite != nil {
+		tlsConfig.CipherSuites = xTransport.tlsCipherSuite
+	}
+	xTransport.applyHostTLS(tlsConfig, client.host)
+	conn := tls.Client(rawConn, tlsConfig)
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (client *DoTClient) getConn(timeout time.Duration) (*tls.Conn, bool, error) {
+	now := time.Now()
+	client.Lock()
+	for len(client.idle) > 0 {
+		last := client.idle[len(client.idle)-1]
+		client.idle = client.idle[:len(client.idle)-1]
+		if now.Sub(last.lastUsed) < client.proxy.xTransport.keepAlive {
+			client.Unlock()
+			return last.conn, true, nil
+		}
+		last.conn.Close()
+	}
+	client.Unlock()
+	conn, err := client.dial(timeout)
+	return conn, false, err
+}
+
+func (client *DoTClient) putConn(conn *tls.Conn) {
+	client.Lock()
+	defer client.Unlock()
+	if len(client.idle) >= DoTMaxIdleConns {
+		conn.Close()
+		return
+	}
+	client.idle = append(client.idle, dotConn{conn: conn, lastUsed: time.Now()})
+}
+
+// Exchange sends a query and returns the response, as well as the state of the TLS connection it was sent over
+func (client *DoTClient) Exchange(query []byte, timeout time.Duration) ([]byte, *tls.ConnectionState, error) {
+	prefixedQuery, err := PrefixWithSize(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, reused, err := client.getConn(timeout)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err = conn.SetDeadline(time.Now().Add(timeout)); err == nil {
+			if _, err = conn.Write(prefixedQuery); err == nil {
+				var netConn net.Conn = conn
+				var response []byte
+				if response, err = ReadPrefixed(&netConn); err == nil {
+					state := conn.ConnectionState()
+					client.putConn(conn)
+					return response, &state, nil
+				}
+			}
+		}
+		conn.Close()
+		// The server may have closed an idle connection; retry once over a new one
+		if !reused {
+			return nil, nil, err
+		}
+		dlog.Debugf("[%s] Reused DoT connection failed, reconnecting", client.hostName)
+	}
+	return nil, nil, errors.New("Unable to send the query over DoT")
+}
+
+func fetchDoTServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
+	// If an IP has been provided, use it forever, as with DoH servers
+	if len(stamp.ServerAddrStr) > 0 {
+		ipOnly, _ := ExtractHostAndPort(stamp.ServerAddrStr, -1)
+		if ip := ParseIP(ipOnly); ip != nil {
+			host, _ := ExtractHostAndPort(stamp.ProviderName, -1)
+			proxy.xTransport.saveCachedIP(host, ip, -1*time.Second)
+		}
+	}
+	client := NewDoTClient(proxy, &stamp)
+	start := time.Now()
+	serverResponse, tlsState, err := client.Exchange(dohNXTestPacket(0xcafe), proxy.timeout)
+	rtt := time.Since(start)
+	if err != nil {
+		serversLog.Infof("[%s] [%s]: %v", name, stamp.ProviderName, err)
+		return ServerInfo{}, err
+	}
+	serversLog.Infof("[%s] TLS version: %x - Cipher suite: %v - Resumed: %v", name, tlsState.Version, tlsState.CipherSuite, tlsState.DidResume)
+	if len(stamp.Hashes) > 0 {
+		found := false
+		for _, cert := range tlsState.PeerCertificates {
+			h := sha256.Sum256(cert.RawTBSCertificate)
+			if proxy.showCerts {
+				serversLog.Noticef("Advertised cert: [%s] [%x]", cert.Subject, h)
+			} else {
+				serversLog.Debugf("Advertised cert: [%s] [%x]", cert.Subject, h)
+			}
+			for _, hash := range stamp.Hashes {
+				if len(hash) == len(h) && string(hash) == string(h[:]) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			dlog.Criticalf("[%s] Certificate hash not found", name)
+			return ServerInfo{}, errors.New("Certificate hash not found")
+		}
+	}
+	if len(serverResponse) < MinDNSPacketSize || serverResponse[0] != 0xca || serverResponse[1] != 0xfe {
+		return ServerInfo{}, errors.New("Server returned an unexpected response")
+	}
+	if Rcode(serverResponse) != dns.RcodeNameError {
+		dlog.Criticalf("[%s] may be a lying resolver", name)
+	}
+	xrtt := int(rtt.Nanoseconds() / 1000000)
+	if isNew {
+		serversLog.Noticef("[%s] OK (DoT) - rtt: %dms", name, xrtt)
+	} else {
+		serversLog.Infof("[%s] OK (DoT) - rtt: %dms", name, xrtt)
+	}
+	return ServerInfo{
+		Proto:      stamps.StampProtoTypeTLS,
+		Name:       name,
+		Timeout:    proxy.timeout,
+		HostName:   stamp.ProviderName,
+		initialRtt: xrtt,
+		dot:        client,
+	}, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/powerman/check"
+)
+
+func TestParseDoTServerStamp(t *testing.T) {
+	c := check.T(t)
+	stamp, err := ParseServerStamp("tls://dns.example.com")
+	c.Nil(err)
+	c.Equal(stamp.Proto, stamps.StampProtoTypeTLS)
+	c.Equal(stamp.ProviderName, "dns.example.com:853")
+	c.Equal(stamp.ServerAddrStr, "")
+
+	stamp, err = ParseServerStamp("tls://[2001:db8::1]:8853")
+	c.Nil(err)
+	c.Equal(stamp.ServerAddrStr, "[2001:db8::1]:8853")
+
+	stamp = stamps.ServerStamp{
+		Proto:         stamps.StampProtoTypeTLS,
+		Props:         stamps.ServerInformalPropertyDNSSEC,
+		ServerAddrStr: "192.0.2.1:853",
+		Hashes:        [][]byte{make([]byte, 32)},
+		ProviderName:  "dns.example.com",
+	}
+	parsed, err := ParseServerStamp(StampString(&stamp))
+	c.Nil(err)
+	c.Equal(parsed.Proto, stamp.Proto)
+	c.Equal(parsed.Props, stamp.Props)
+	c.Equal(parsed.ServerAddrStr, stamp.ServerAddrStr)
+	c.Equal(parsed.ProviderName, stamp.ProviderName)
+	c.Len(parsed.Hashes, 1)
+
+	stamp, err = ParseServerStamp("quic://dns.example.com:8853")
+	c.Nil(err)
+	c.Equal(stamp.Proto, stamps.StampProtoTypeDoQ)
+	parsed, err = ParseServerStamp(StampString(&stamp))
+	c.Nil(err)
+	c.Equal(parsed.Proto, stamps.StampProtoTypeDoQ)
+	c.Equal(parsed.ProviderName, "dns.example.com:8853")
+
+	_, err = ParseServerStamp("tls://")
+	c.NotNil(err)
+}
+
+func TestParsePlainServerStamp(t *testing.T) {
+	c := check.T(t)
+	stamp, err := ParseServerStamp("dns://192.0.2.53")
+	c.Nil(err)
+	c.Equal(stamp.Proto, stamps.StampProtoTypePlain)
+	c.Equal(stamp.ServerAddrStr, "192.0.2.53:53")
+
+	stamp, err = ParseServerStamp("dns://[2001:db8::53]:5353")
+	c.Nil(err)
+	c.Equal(stamp.ServerAddrStr, "[2001:db8::53]:5353")
+
+	_, err = ParseServerStamp("dns://dns.example.com")
+	c.NotNil(err)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+// ECHState keeps the Encrypted Client Hello configurations of DoH servers.
+// Since configurations are specific to each server, every server using ECH gets its own HTTP transport.
+type ECHState struct {
+	sync.RWMutex
+	enabled    bool
+	configs    map[string][]byte
+	static     map[string]bool
+	transports map[string]*http.Transport
+}
+
+func NewECHState() ECHState {
+	return ECHState{
+		configs:    make(map[string][]byte),
+		static:     make(map[string]bool),
+		transports: make(map[string]*http.Transport),
+	}
+}
+
+// SetStaticECHConfig sets a base64-encoded ECHConfigList for a host, that will never be replaced by HTTPS records
+func (xTransport *XTransport) SetStaticECHConfig(host string, echConfigB64 string) error {
+	echConfigList, err := base64.StdEncoding.DecodeString(echConfigB64)
+	if err != nil || len(echConfigList) < 2 {
+		return errors.New("Invalid ECH configuration")
+	}
+	xTransport.ech.Lock()
+	xTransport.ech.static[host] = true
+	xTransport.ech.Unlock()
+	xTransport.setECHConfig(host, echConfigList)
+	return nil
+}
+
+func (xTransport *XTransport) setECHConfig(host string, echConfigList []byte) {
+	xTransport.ech.Lock()
+	defer xTransport.ech.Unlock()
+	if string(xTransport.ech.configs[host]) == string(echConfigList) && xTransport.ech.transports[host] != nil {
+		return
+	}
+	xTransport.ech.configs[host] = echConfigList
+	if xTransport.tlsClientConfig == nil {
+		return
+	}
+	if previous := xTransport.ech.transports[host]; previous != nil {
+		previous.CloseIdleConnections()
+	}
+	xTransport.ech.transports[host] = xTransport.newECHTransport(host, echConfigList)
+}
+
+func (xTransport *XTransport) newECHTransport(host string, echConfigList []byte) *http.Transport {
+	tlsClientConfig := xTransport.hostTLSConfig(host)
+	if tlsClientConfig == nil {
+		tlsClientConfig = xTransport.tlsClientConfig.Clone()
+	}
+	tlsClientConfig.EncryptedClientHelloConfigList = echConfigList
+	tlsClientConfig.MinVersion = tls.VersionTLS13
+	tlsClientConfig.MaxVersion = 0
+	return xTransport.newHTTPTransport(tlsClientConfig)
+}
+
+func (xTransport *XTransport) rebuildECHTransports() {
+	xTransport.ech.Lock()
+	defer xTransport.ech.Unlock()
+	for host, echConfigList := range xTransport.ech.configs {
+		if previous := xTransport.ech.transports[host]; previous != nil {
+			previous.CloseIdleConnections()
+		}
+		xTransport.ech.transports[host] = xTransport.newECHTransport(host, echConfigList)
+	}
+}
+
+func (xTransport *XTransport) echTransportFor(host string) *http.Transport {
+	xTransport.ech.RLock()
+	defer xTransport.ech.RUnlock()
+	return xTransport.ech.transports[host]
+}
+
+// refreshECHConfig retrieves the ECH configuration of a host from its HTTPS record, using the encrypted bootstrap
+// resolvers. Without them, the lookup is skipped, since sending it in plaintext would reveal the name ECH hides.
+// Hosts reached through a proxy are skipped, so that their names are never resolved locally.
+func (xTransport *XTransport) refreshECHConfig(host string) {
+	if !xTransport.ech.enabled || xTransport.proxied(host) || ParseIP(host) != nil {
+		return
+	}
+	xTransport.ech.RLock()
+	static := xTransport.ech.static[host]
+	xTransport.ech.RUnlock()
+	if static {
+		return
+	}
+	msg := dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(host), dns.TypeHTTPS)
+	msg.SetEdns0(uint16(MaxDNSPacketSize), true)
+	lookedUp := false
+	for _, resolver := range xTransport.bootstrapResolvers {
+		if !isEncryptedBootstrapResolver(resolver) {
+			continue
+		}
+		lookedUp = true
+		in, err := xTransport.exchangeWithBootstrapResolver(&msg, "udp", resolver)
+		if err != nil {
+			dlog.Debugf("Unable to retrieve the HTTPS record of [%s] using [%s]: %v", host, resolver, err)
+			continue
+		}
+		for _, answer := range in.Answer {
+			https, ok := answer.(*dns.HTTPS)
+			if !ok {
+				continue
+			}
+			for _, kv := range https.Value {
+				if echConfig, ok := kv.(*dns.SVCBECHConfig); ok && len(echConfig.ECH) > 0 {
+					dlog.Debugf("[%s] supports ECH", host)
+					xTransport.setECHConfig(host, echConfig.ECH)
+					return
+				}
+			}
+		}
+		return
+	}
+	if !lookedUp {
+		dlog.Debugf("No encrypted bootstrap resolvers - Not retrieving the ECH configuration of [%s]", host)
+	}
+}
+
+// echRetry updates the ECH configuration of a host if the server rejected it, but sent a new one.
+// It returns true if the request can be retried.
+func (xTransport *XTransport) echRetry(host string, err error) bool {
+	var echErr *tls.ECHRejectionError
+	if !errors.As(err, &echErr) || len(echErr.RetryConfigList) == 0 {
+		return false
+	}
+	dlog.Infof("[%s] rejected the ECH configuration, retrying with the configuration sent by the server", host)
+	xTransport.setECHConfig(host, echErr.RetryConfigList)
+	return true
+}
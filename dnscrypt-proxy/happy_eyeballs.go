@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// Delay before trying the next address family (RFC 8305, section 8)
+const HappyEyeballsDelay = 250 * time.Millisecond
+
+type happyEyeballsResult struct {
+	conn net.Conn
+	ip   net.IP
+	err  error
+}
+
+// dialHappyEyeballs connects to the cached addresses of a host (RFC 8305).
+// Addresses are tried in order, the next one being tried if the previous one didn't connect
+// within `HappyEyeballsDelay`. The first established connection is kept, and its address
+// becomes the preferred one for the host.
+func (xTransport *XTransport) dialHappyEyeballs(ctx context.Context, network string, host string, port int, timeout time.Duration) (net.Conn, error) {
+	ips, _ := xTransport.loadCachedIPs(host)
+	if len(ips) == 0 {
+		return nil, errors.New("No IP address found for [" + host + "]")
+	}
+	dialer := outboundDialer(timeout)
+	if len(ips) == 1 {
+		return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), strconv.Itoa(port)))
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan happyEyeballsResult, len(ips))
+	dial := func(ip net.IP) {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		results <- happyEyeballsResult{conn: conn, ip: ip, err: err}
+	}
+	next, pending := 0, 0
+	var lastErr error
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if next < len(ips) {
+				go dial(ips[next])
+				next++
+				pending++
+				timer.Reset(HappyEyeballsDelay)
+			}
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				if !result.ip.Equal(ips[0]) {
+					dlog.Debugf("[%s] Happy Eyeballs: [%s] is now the preferred address", host, result.ip)
+					xTransport.setPreferredIP(host, result.ip)
+				}
+				go closeLateConns(results, pending)
+				return result.conn, nil
+			}
+			lastErr = result.err
+			if next < len(ips) {
+				// Don't wait for the delay if an attempt already failed
+				go dial(ips[next])
+				next++
+				pending++
+				timer.Reset(HappyEyeballsDelay)
+			} else if pending == 0 {
+				return nil, lastErr
+			}
+		case <-ctx.Done():
+			go closeLateConns(results, pending)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// closeLateConns closes the connections established after another one has been selected
+func closeLateConns(results chan happyEyeballsResult, pending int) {
+	for ; pending > 0; pending-- {
+		if late := <-results; late.conn != nil {
+			late.conn.Close()
+		}
+	}
+}
+
+// setPreferredIP moves an address to the front of the cached addresses of a host
+func (xTransport *XTransport) setPreferredIP(host string, ip net.IP) {
+	xTransport.cachedIPs.Lock()
+	defer xTransport.cachedIPs.Unlock()
+	item, ok := xTransport.cachedIPs.cache[host]
+	if !ok || len(item.ips) < 2 || item.ips[0].Equal(ip) {
+		return
+	}
+	ips := []net.IP{ip}
+	for _, cachedIP := range item.ips {
+		if !cachedIP.Equal(ip) {
+			ips = append(ips, cachedIP)
+		}
+	}
+	xTransport.cachedIPs.cache[host] = &CachedIPItem{ips: ips, expiration: item.expiration}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestHappyEyeballsFallback(t *testing.T) {
+	c := check.T(t)
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	c.Must(c.Nil(err))
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	xTransport := NewXTransport()
+	xTransport.saveCachedIPs("dns.example.com", []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, -1)
+	conn, err := xTransport.dialHappyEyeballs(context.Background(), "tcp", "dns.example.com", port, time.Second)
+	c.Must(c.Nil(err))
+	conn.Close()
+	ips, _ := xTransport.loadCachedIPs("dns.example.com")
+	c.True(ips[0].Equal(net.ParseIP("127.0.0.1")))
+}
+
+func TestLoadCachedIPPrefersIPv4(t *testing.T) {
+	c := check.T(t)
+	xTransport := NewXTransport()
+	xTransport.saveCachedIPs("dns.example.com", []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}, -1)
+	ip, _ := xTransport.loadCachedIP("dns.example.com")
+	c.True(ip.Equal(net.ParseIP("192.0.2.1")))
+	xTransport.saveCachedIPs("ipv6.example.com", []net.IP{net.ParseIP("2001:db8::1")}, -1)
+	ip, _ = xTransport.loadCachedIP("ipv6.example.com")
+	c.True(ip.Equal(net.ParseIP("2001:db8::1")))
+}
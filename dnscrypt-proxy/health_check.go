@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	clocksmith "github.com/jedisct1/go-clocksmith"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Flap damping (similar to RFC 2439): every state change adds a penalty that decays exponentially.
+	// A server whose penalty exceeds the suppress threshold stays down until it decays below the reuse threshold.
+	HealthFlapPenalty      = 1.0
+	HealthFlapHalfLife     = 5 * time.Minute
+	HealthSuppressPenalty  = 3.0
+	HealthReusePenalty     = 1.5
+	DefaultHealthQueryName = "."
+	DefaultHealthQueryType = "NS"
+)
+
+// ServerHealth is the state of a server, as seen by the health checks
+type ServerHealth struct {
+	down                 bool
+	suppressed           bool
+	consecutiveFailures  int
+	consecutiveSuccesses int
+	penalty              float64
+	penaltyUpdated       time.Time
+}
+
+type HealthChecker struct {
+	interval time.Duration
+	qName    string
+	qType    uint16
+	fall     int
+	rise     int
+}
+
+func NewHealthChecker(config HealthCheckConfig) (*HealthChecker, error) {
+	qType, ok := dns.StringToType[config.QueryType]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported health check query type: [%s]", config.QueryType)
+	}
+	return &HealthChecker{
+		interval: time.Duration(config.Interval) * time.Second,
+		qName:    dns.Fqdn(config.QueryName),
+		qType:    qType,
+		fall:     Max(1, config.Fall),
+		rise:     Max(1, config.Rise),
+	}, nil
+}
+
+func (health *ServerHealth) decayPenalty(now time.Time) {
+	if !health.penaltyUpdated.IsZero() {
+		elapsed := now.Sub(health.penaltyUpdated)
+		health.penalty *= math.Pow(0.5, float64(elapsed)/float64(HealthFlapHalfLife))
+	}
+	health.penaltyUpdated = now
+}
+
+// update records the result of a health check, and returns true if the server changed state
+func (health *ServerHealth) update(healthy bool, fall int, rise int, now time.Time) bool {
+	health.decayPenalty(now)
+	if health.suppressed && health.penalty < HealthReusePenalty {
+		health.suppressed = false
+	}
+	if healthy {
+		health.consecutiveFailures = 0
+		health.consecutiveSuccesses++
+		if health.down && health.consecutiveSuccesses >= rise && !health.suppressed {
+			health.down = false
+			health.penalty += HealthFlapPenalty
+			return true
+		}
+		return false
+	}
+	health.consecutiveSuccesses = 0
+	health.consecutiveFailures++
+	if !health.down && health.consecutiveFailures >= fall {
+		health.down = true
+		health.penalty += HealthFlapPenalty
+		if health.penalty >= HealthSuppressPenalty {
+			health.suppressed = true
+		}
+		return true
+	}
+	return false
+}
+
+func (healthChecker *HealthChecker) probeQuery() []byte {
+	msg := dns.Msg{}
+	msg.SetQuestion(healthChecker.qName, healthChecker.qType)
+	msg.Id = uint16(rand.Intn(0xffff))
+	msg.SetEdns0(uint16(MaxDNSPacketSize), false)
+	query, _ := msg.Pack()
+	return query
+}
+
+func (healthChecker *HealthChecker) probe(proxy *Proxy, serverInfo *ServerInfo) bool {
+	pluginsState := PluginsState{queryID: "health-check"}
+	response, err := proxy.exchangeWithServer(&pluginsState, serverInfo, healthChecker.probeQuery(), "udp")
+	if err != nil || len(response) < MinDNSPacketSize {
+		serversLog.Debugf("[%s] Health check failed: %v", serverInfo.Name, err)
+		return false
+	}
+	rcode := Rcode(response)
+	return rcode != dns.RcodeServerFailure && rcode != dns.RcodeRefused
+}
+
+type healthCheckResult struct {
+	name    string
+	healthy bool
+}
+
+// checkAll probes all the servers concurrently, and updates their state
+func (healthChecker *HealthChecker) checkAll(proxy *Proxy) {
+	serversInfo := &proxy.serversInfo
+	serversInfo.RLock()
+	servers := append([]*ServerInfo{}, serversInfo.inner...)
+	serversInfo.RUnlock()
+	results := make(chan healthCheckResult, len(servers))
+	for _, serverInfo := range servers {
+		go func(serverInfo *ServerInfo) {
+			results <- healthCheckResult{name: serverInfo.Name, healthy: healthChecker.probe(proxy, serverInfo)}
+		}(serverInfo)
+	}
+	now := time.Now()
+	for range servers {
+		result := <-results
+		serversInfo.updateHealth(result.name, result.healthy, healthChecker.fall, healthChecker.rise, now)
+	}
+}
+
+func (healthChecker *HealthChecker) run(proxy *Proxy) {
+	for {
+		clocksmith.Sleep(healthChecker.interval)
+		healthChecker.checkAll(proxy)
+	}
+}
+
+func (serversInfo *ServersInfo) updateHealth(name string, healthy bool, fall int, rise int, now time.Time) {
+	serversInfo.Lock()
+	defer serversInfo.Unlock()
+	health, ok := serversInfo.health[name]
+	if !ok {
+		health = &ServerHealth{}
+		serversInfo.health[name] = health
+	}
+	if !health.update(healthy, fall, rise, now) {
+		return
+	}
+	if health.down {
+		serversInfo.downCount++
+		if health.suppressed {
+			serversLog.Warnf("[%s] is down, and will not be used until it becomes stable (flapping)", name)
+		} else {
+			serversLog.Warnf("[%s] is down", name)
+		}
+	} else {
+		serversInfo.downCount--
+		serversLog.Noticef("[%s] is up again", name)
+	}
+}
+
+// isDown returns true if a server failed its health checks, or if its circuit is open.
+// It must be called with the servers lock held.
+func (serversInfo *ServersInfo) isDown(name string) bool {
+	health, ok := serversInfo.health[name]
+	return (ok && health.down) || !serversInfo.circuitAvailable(name, time.Now())
+}
+
+// allDown returns true if none of the servers that regular queries can be sent to are live.
+// Servers reserved for domain routes, or that are not part of the active network profile, are ignored.
+func (serversInfo *ServersInfo) allDown() bool {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	for _, serverInfo := range serversInfo.inner {
+		if !serversInfo.excluded(serverInfo.Name) && !serversInfo.isDown(serverInfo.Name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestServerHealthFlapDamping(t *testing.T) {
+	c := check.T(t)
+	health := ServerHealth{}
+	now := time.Now()
+	c.False(health.update(false, 2, 2, now))
+	c.True(health.update(false, 2, 2, now))
+	c.True(health.down)
+	c.False(health.update(true, 2, 2, now))
+	c.True(health.update(true, 2, 2, now))
+	c.False(health.down)
+
+	// A third state change within a short period suppresses the server
+	health.update(false, 2, 2, now)
+	c.True(health.update(false, 2, 2, now))
+	c.True(health.suppressed)
+	health.update(true, 2, 2, now)
+	health.update(true, 2, 2, now)
+	c.True(health.down)
+
+	// Once the penalty has decayed, the server can be used again
+	later := now.Add(3 * HealthFlapHalfLife)
+	health.update(true, 2, 2, later)
+	c.False(health.down)
+}
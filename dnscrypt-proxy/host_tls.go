@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HostTLS holds TLS settings that only apply to a single DoH, DoT or DoQ server
+type HostTLS struct {
+	spkiPins   [][]byte
+	minVersion uint16
+	rootCAs    *x509.CertPool
+	clientCert *tls.Certificate
+}
+
+func NewHostTLS(pins []string, minVersion string, rootCA string, clientCert string, clientKey string) (*HostTLS, error) {
+	hostTLS := HostTLS{}
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("Invalid SPKI pin: [%s]", pin)
+		}
+		hostTLS.spkiPins = append(hostTLS.spkiPins, hash)
+	}
+	switch minVersion {
+	case "":
+	case "1.2":
+		hostTLS.minVersion = tls.VersionTLS12
+	case "1.3":
+		hostTLS.minVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("Unsupported minimum TLS version: [%s]", minVersion)
+	}
+	if len(rootCA) > 0 {
+		pem, err := os.ReadFile(rootCA)
+		if err != nil {
+			return nil, err
+		}
+		hostTLS.rootCAs = x509.NewCertPool()
+		if !hostTLS.rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in [%s]", rootCA)
+		}
+	}
+	if len(clientCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to use certificate [%v] (key: [%v]): %v", clientCert, clientKey, err)
+		}
+		hostTLS.clientCert = &cert
+	}
+	return &hostTLS, nil
+}
+
+// checkPins verifies that one of the certificates of the chain has a pinned public key
+func (hostTLS *HostTLS) checkPins(certs []*x509.Certificate) error {
+	if len(hostTLS.spkiPins) == 0 {
+		return nil
+	}
+	for _, cert := range certs {
+		h := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range hostTLS.spkiPins {
+			if bytes.Equal(pin, h[:]) {
+				return nil
+			}
+		}
+	}
+	return errors.New("No pinned public key found in the certificate chain")
+}
+
+// Apply adds the settings to a TLS configuration dedicated to the host
+func (hostTLS *HostTLS) Apply(tlsConfig *tls.Config) {
+	if hostTLS.minVersion > tlsConfig.MinVersion {
+		tlsConfig.MinVersion = hostTLS.minVersion
+	}
+	if hostTLS.rootCAs != nil {
+		tlsConfig.RootCAs = hostTLS.rootCAs
+	}
+	if hostTLS.clientCert != nil {
+		tlsConfig.Certificates = []tls.Certificate{*hostTLS.clientCert}
+	}
+	tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+		return hostTLS.checkPins(cs.PeerCertificates)
+	}
+}
+
+func (xTransport *XTransport) SetHostTLS(host string, hostTLS *HostTLS) {
+	xTransport.hostTLS[hostProxyKey(host)] = hostTLS
+}
+
+// applyHostTLS adds the settings of a host, if there are any, to a TLS configuration used only for that host
+func (xTransport *XTransport) applyHostTLS(tlsConfig *tls.Config, host string) {
+	if hostTLS, ok := xTransport.hostTLS[hostProxyKey(host)]; ok {
+		hostTLS.Apply(tlsConfig)
+	}
+}
+
+// hostTLSConfig returns a TLS configuration dedicated to a host that has its own TLS settings, or nil if it has
+// none. The CAs and the client certificate of a host are never used to connect to other hosts.
+func (xTransport *XTransport) hostTLSConfig(host string) *tls.Config {
+	hostTLS, ok := xTransport.hostTLS[hostProxyKey(host)]
+	if !ok || xTransport.tlsClientConfig == nil {
+		return nil
+	}
+	tlsConfig := xTransport.tlsClientConfig.Clone()
+	hostTLS.Apply(tlsConfig)
+	return tlsConfig
+}
+
+// rebuildHostTransports creates an HTTP transport, and an HTTP/3 transport if needed, for every host that has
+// its own TLS settings
+func (xTransport *XTransport) rebuildHostTransports() {
+	for _, transport := range xTransport.hostTransports {
+		transport.CloseIdleConnections()
+	}
+	hostTransports := make(map[string]*http.Transport)
+	hostH3Transports := make(map[string]*http3.RoundTripper)
+	for key := range xTransport.hostTLS {
+		hostTransports[key] = xTransport.newHTTPTransport(xTransport.hostTLSConfig(key))
+		if xTransport.h3Transport != nil {
+			hostH3Transports[key] = xTransport.newH3Transport(xTransport.hostTLSConfig(key))
+		}
+	}
+	xTransport.hostTransports, xTransport.hostH3Transports = hostTransports, hostH3Transports
+}
+
+// transportFor returns the HTTP transport to use for a host
+func (xTransport *XTransport) transportFor(host string) *http.Transport {
+	if transport, ok := xTransport.hostTransports[hostProxyKey(host)]; ok {
+		return transport
+	}
+	return xTransport.transport
+}
+
+// h3TransportFor returns the HTTP/3 transport to use for a host
+func (xTransport *XTransport) h3TransportFor(host string) *http3.RoundTripper {
+	if h3Transport, ok := xTransport.hostH3Transports[hostProxyKey(host)]; ok {
+		return h3Transport
+	}
+	return xTransport.h3Transport
+}
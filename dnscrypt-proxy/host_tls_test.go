@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestHostTransports(t *testing.T) {
+	c := check.T(t)
+	xTransport := NewXTransport()
+	xTransport.http3 = true
+	certA, certB := &tls.Certificate{Certificate: [][]byte{{1}}}, &tls.Certificate{Certificate: [][]byte{{2}}}
+	rootsA := x509.NewCertPool()
+	xTransport.SetHostTLS("a.example.com", &HostTLS{rootCAs: rootsA, clientCert: certA})
+	xTransport.SetHostTLS("b.example.com", &HostTLS{minVersion: tls.VersionTLS13, clientCert: certB})
+	xTransport.rebuildTransport()
+
+	c.Equal(xTransport.transportFor("other.example.com"), xTransport.transport)
+	c.Equal(xTransport.h3TransportFor("other.example.com"), xTransport.h3Transport)
+	c.Len(xTransport.transport.TLSClientConfig.Certificates, 0)
+
+	tlsConfigA := xTransport.transportFor("a.example.com").TLSClientConfig
+	c.False(tlsConfigA.InsecureSkipVerify)
+	c.True(tlsConfigA.RootCAs == rootsA)
+	c.DeepEqual(tlsConfigA.Certificates, []tls.Certificate{*certA})
+	c.Nil(tlsConfigA.GetClientCertificate)
+
+	tlsConfigB := xTransport.transportFor("b.example.com").TLSClientConfig
+	c.False(tlsConfigB.InsecureSkipVerify)
+	c.True(tlsConfigB.RootCAs == xTransport.tlsClientConfig.RootCAs)
+	c.DeepEqual(tlsConfigB.Certificates, []tls.Certificate{*certB})
+	c.EQ(tlsConfigB.MinVersion, uint16(tls.VersionTLS13))
+	c.DeepEqual(xTransport.h3TransportFor("b.example.com").TLSClientConfig.Certificates, []tls.Certificate{*certB})
+}
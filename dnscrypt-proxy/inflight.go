@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"sync"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+type inflightQuery struct {
+	done       chan struct{}
+	response   []byte
+	serverInfo *ServerInfo
+	err        error
+}
+
+// InflightQueries coalesces identical queries received while a query is already being sent to a server,
+// so that they all get the response to a single upstream exchange
+type InflightQueries struct {
+	sync.Mutex
+	queries map[[32]byte]*inflightQuery
+}
+
+// inflightKey identifies the queries that can share a response: same name, type and class, same DNSSEC bits,
+// same EDNS buffer size and client subnet, and sent to the server using the same protocol
+func inflightKey(pluginsState *PluginsState, serverProto string) ([32]byte, bool) {
+	var key [32]byte
+	msg := pluginsState.questionMsg
+	if msg == nil || len(msg.Question) != 1 {
+		return key, false
+	}
+	question := msg.Question[0]
+	h := sha512.New512_256()
+	var tmp [8]byte
+	binary.LittleEndian.PutUint16(tmp[0:2], question.Qtype)
+	binary.LittleEndian.PutUint16(tmp[2:4], question.Qclass)
+	if msg.CheckingDisabled {
+		tmp[4] = 1
+	}
+	if edns0 := msg.IsEdns0(); edns0 != nil {
+		if edns0.Do() {
+			tmp[5] = 1
+		}
+		binary.LittleEndian.PutUint16(tmp[6:8], edns0.UDPSize())
+		for _, option := range edns0.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				h.Write(subnet.Address)
+				h.Write([]byte{subnet.SourceNetmask})
+			}
+		}
+	}
+	h.Write(tmp[:])
+	h.Write([]byte(serverProto))
+	h.Write([]byte(question.Name)) // not normalized, since the response includes the question
+
+	h.Sum(key[:0])
+	return key, true
+}
+
+// exchangeCoalesced sends a query to a server, unless an identical query is already in flight,
+// in which case the response to that query is returned instead
+func (proxy *Proxy) exchangeCoalesced(
+	pluginsState *PluginsState,
+	serverInfo *ServerInfo,
+	query []byte,
+	serverProto string,
+) ([]byte, *ServerInfo, error) {
+	key, ok := inflightKey(pluginsState, serverProto)
+	if !ok {
+		return proxy.exchangeWithRetries(pluginsState, serverInfo, query, serverProto)
+	}
+	inflight := &proxy.inflightQueries
+	inflight.Lock()
+	if inflight.queries == nil {
+		inflight.queries = make(map[[32]byte]*inflightQuery)
+	}
+	if pending, found := inflight.queries[key]; found {
+		inflight.Unlock()
+		<-pending.done
+		if pending.err != nil {
+			return nil, pending.serverInfo, pending.err
+		}
+		response := append([]byte{}, pending.response...)
+		if len(response) >= 2 && len(query) >= 2 {
+			copy(response[0:2], query[0:2])
+		}
+		dlog.Debugf("[%s] Response shared with an identical query in flight", pluginsState.queryID)
+		return response, pending.serverInfo, nil
+	}
+	pending := &inflightQuery{done: make(chan struct{})}
+	inflight.queries[key] = pending
+	inflight.Unlock()
+
+	response, serverInfo, err := proxy.exchangeWithRetries(pluginsState, serverInfo, query, serverProto)
+	pending.response = append([]byte{}, response...)
+	pending.serverInfo, pending.err = serverInfo, err
+	inflight.Lock()
+	delete(inflight.queries, key)
+	inflight.Unlock()
+	close(pending.done)
+	return response, serverInfo, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+)
+
+// DefaultLBEWMADecay is the weight of the latest measurement in the moving averages used by the 'p2c' strategy
+const DefaultLBEWMADecay = 0.1
+
+// LBStrategyP2C picks two random servers, and sends queries to the one with the best recent latency and
+// success rate ("power of two choices"). Slow servers still get some queries, so their scores stay current.
+type LBStrategyP2C struct {
+	decay float64
+}
+
+func (LBStrategyP2C) getCandidate(serversCount int) int {
+	return rand.Intn(serversCount)
+}
+
+func (LBStrategyP2C) getActiveCount(serversCount int) int {
+	return serversCount
+}
+
+// p2cScore returns the expected cost of sending a query to a server; lower is better.
+// Servers without measurements yet are scored using the RTT estimated at startup.
+func p2cScore(serverInfo *ServerInfo) float64 {
+	latency, success := 0.0, 1.0
+	if stats := serverInfo.stats; stats != nil {
+		latency, success = stats.ewmaLatency, stats.ewmaSuccess
+	}
+	if latency <= 0 && serverInfo.rtt != nil {
+		latency = serverInfo.rtt.Value()
+	}
+	return math.Max(latency, 1.0) / math.Max(success, 0.01)
+}
+
+// pickCandidate returns the position of the server to use among `servers`; it must be called with the lock held
+func (serversInfo *ServersInfo) pickCandidate(servers []*ServerInfo) int {
+	switch serversInfo.lbStrategy.(type) {
+	case LBStrategyP2C:
+		if len(servers) >= 2 {
+			return serversInfo.p2cCandidate(servers)
+		}
+	case LBStrategyFirst, LBStrategyRace:
+	default:
+		if len(serversInfo.weights) > 0 && len(servers) > 0 {
+			return serversInfo.weightedCandidate(servers, serversInfo.lbStrategy.getActiveCount(len(servers)))
+		}
+	}
+	return serversInfo.lbStrategy.getCandidate(len(servers))
+}
+
+// p2cCandidate compares two random servers, and returns the position of the best one
+func (serversInfo *ServersInfo) p2cCandidate(servers []*ServerInfo) int {
+	first := rand.Intn(len(servers))
+	second := rand.Intn(len(servers) - 1)
+	if second >= first {
+		second++
+	}
+	firstScore := p2cScore(servers[first]) / serversInfo.weight(servers[first])
+	secondScore := p2cScore(servers[second]) / serversInfo.weight(servers[second])
+	if secondScore < firstScore {
+		return second
+	}
+	return first
+}
+
+// noticeP2C updates the moving averages of a server; it must be called with the lock held
+func (serversInfo *ServersInfo) noticeP2C(stats *ServerStats, latencyMs float64, success bool) {
+	strategy, ok := serversInfo.lbStrategy.(LBStrategyP2C)
+	if !ok {
+		return
+	}
+	outcome := 0.0
+	if success {
+		outcome = 1.0
+	}
+	if stats.ewmaLatency <= 0 {
+		stats.ewmaLatency = latencyMs
+	} else {
+		stats.ewmaLatency += strategy.decay * (latencyMs - stats.ewmaLatency)
+	}
+	stats.ewmaSuccess += strategy.decay * (outcome - stats.ewmaSuccess)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/VividCortex/ewma"
+	"github.com/powerman/check"
+)
+
+func TestLBStrategyP2C(t *testing.T) {
+	c := check.T(t)
+	serversInfo := NewServersInfo()
+	serversInfo.lbStrategy = LBStrategyP2C{decay: 0.5}
+	fast := &ServerInfo{Name: "fast", rtt: ewma.NewMovingAverage(RTTEwmaDecay), stats: NewServerStats()}
+	slow := &ServerInfo{Name: "slow", rtt: ewma.NewMovingAverage(RTTEwmaDecay), stats: NewServerStats()}
+	serversInfo.noticeP2C(fast.stats, 10, true)
+	serversInfo.noticeP2C(slow.stats, 100, true)
+	c.EQ(fast.stats.ewmaLatency, 10.0)
+	for i := 0; i < 10; i++ {
+		c.EQ(serversInfo.pickCandidate([]*ServerInfo{fast, slow}), 0)
+		c.EQ(serversInfo.pickCandidate([]*ServerInfo{slow, fast}), 1)
+	}
+
+	// Failures make a fast server less attractive than a slower, reliable one
+	serversInfo.noticeP2C(fast.stats, 2000, false)
+	serversInfo.noticeP2C(fast.stats, 2000, false)
+	c.EQ(fast.stats.ewmaSuccess, 0.25)
+	c.EQ(serversInfo.pickCandidate([]*ServerInfo{fast, slow}), 1)
+
+	serversInfo.lbStrategy = LBStrategyFirst{}
+	serversInfo.noticeP2C(slow.stats, 1000, false)
+	c.EQ(slow.stats.ewmaSuccess, 1.0)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+const (
+	LBStickyClient = "client"
+	LBStickyQName  = "qname"
+)
+
+// stickyKey returns the key used to map a query to a server, or an empty string if queries are not sticky
+func (proxy *Proxy) stickyKey(pluginsState *PluginsState) string {
+	switch proxy.lbSticky {
+	case LBStickyClient:
+		if clientIP, ok := ExtractClientIP(pluginsState); ok {
+			return clientIP.String()
+		}
+	case LBStickyQName:
+		return pluginsState.qName
+	}
+	return ""
+}
+
+// getSticky always returns the same live server for a given key, using rendezvous hashing, so that adding
+// or removing a server only moves the keys of that server. Weights are taken into account.
+func (serversInfo *ServersInfo) getSticky(key string) *ServerInfo {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	var best, bestDown *ServerInfo
+	bestScore, bestDownScore := math.Inf(-1), math.Inf(-1)
+	for _, serverInfo := range serversInfo.inner {
+		if serversInfo.excluded(serverInfo.Name) {
+			continue
+		}
+		score := serversInfo.stickyScore(serverInfo, key)
+		if serversInfo.isDown(serverInfo.Name) {
+			if score > bestDownScore {
+				bestDown, bestDownScore = serverInfo, score
+			}
+		} else if score > bestScore {
+			best, bestScore = serverInfo, score
+		}
+	}
+	if best == nil {
+		return bestDown
+	}
+	return best
+}
+
+func (serversInfo *ServersInfo) stickyScore(serverInfo *ServerInfo, key string) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(serverInfo.Name))
+	// Map the hash to (0, 1), so that the weighted score is -weight/ln(u)
+	u := (float64(h.Sum64()>>11) + 0.5) / float64(1<<53)
+	return -serversInfo.weight(serverInfo) / math.Log(u)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestGetSticky(t *testing.T) {
+	c := check.T(t)
+	serversInfo := NewServersInfo()
+	c.Nil(serversInfo.getSticky("192.0.2.1"))
+	for _, name := range []string{"a", "b", "c", "d"} {
+		serversInfo.inner = append(serversInfo.inner, &ServerInfo{Name: name})
+	}
+	assignments := make(map[string]string)
+	used := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("192.0.2.%d", i)
+		assignments[key] = serversInfo.getSticky(key).Name
+		used[assignments[key]] = true
+		c.EQ(serversInfo.getSticky(key).Name, assignments[key])
+	}
+	c.Len(used, 4)
+
+	// Removing a server only moves the keys of that server
+	serversInfo.inner = serversInfo.inner[1:]
+	for key, name := range assignments {
+		if name != "a" {
+			c.EQ(serversInfo.getSticky(key).Name, name)
+		} else {
+			c.NotEqual(serversInfo.getSticky(key).Name, "a")
+		}
+	}
+
+	serversInfo.reserved = map[string]bool{"b": true, "c": true, "d": true}
+	c.Nil(serversInfo.getSticky("192.0.2.1"))
+}
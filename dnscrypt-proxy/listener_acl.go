@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type ListenerACLAction int
+
+const (
+	// Respond with REFUSED
+	ListenerACLActionRefuse ListenerACLAction = iota
+	// Silently ignore the query
+	ListenerACLActionDrop
+)
+
+// ListenerACL is the list of client networks allowed to send queries to a listener
+type ListenerACL struct {
+	allowedClients []*net.IPNet
+	action         ListenerACLAction
+}
+
+func NewListenerACL(allowedClients []string, actionStr string) (*ListenerACL, error) {
+	acl := ListenerACL{allowedClients: make([]*net.IPNet, 0, len(allowedClients))}
+	switch strings.ToLower(actionStr) {
+	case "", "refuse":
+		acl.action = ListenerACLActionRefuse
+	case "drop":
+		acl.action = ListenerACLActionDrop
+	default:
+		return nil, fmt.Errorf("Unsupported listener ACL action: [%s]", actionStr)
+	}
+	for _, cidr := range allowedClients {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid allowed client network: [%s]", cidr)
+		}
+		acl.allowedClients = append(acl.allowedClients, ipNet)
+	}
+	return &acl, nil
+}
+
+// Allows returns true if a client is allowed to send queries; a nil ACL allows all the clients
+func (acl *ListenerACL) Allows(clientAddr net.Addr) bool {
+	if acl == nil {
+		return true
+	}
+	var ip net.IP
+	switch addr := clientAddr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+	for _, ipNet := range acl.allowedClients {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Drops returns true if queries from clients that are not allowed are silently ignored
+func (acl *ListenerACL) Drops() bool {
+	return acl.action == ListenerACLActionDrop
+}
+
+// Reject returns the response to a query from a client that is not allowed, or nil if the query should be dropped
+func (acl *ListenerACL) Reject(packet []byte) []byte {
+	if acl.Drops() {
+		return nil
+	}
+	msg := dns.Msg{}
+	if msg.Unpack(packet) != nil || len(msg.Question) != 1 {
+		return nil
+	}
+	response, err := RefusedResponseFromMessage(&msg, true, nil, nil, 0).Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// listenerACL returns the ACL of the listener a query was received on, or nil if it accepts queries from all the clients
+func (proxy *Proxy) listenerACL(localAddr net.Addr) *ListenerACL {
+	if localAddr == nil || len(proxy.listenerACLs) == 0 {
+		return nil
+	}
+	key, ok := listenerKey(localAddr, func(key string) bool {
+		_, ok := proxy.listenerACLs[key]
+		return ok
+	})
+	if !ok {
+		return nil
+	}
+	return proxy.listenerACLs[key]
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// pluginSettings are the settings of the plugins that listener profiles can override
+type pluginSettings struct {
+	blockNameFile                 string
+	blockNameFormat               string
+	blockNameLogFile              string
+	blockNameLogSampleRate        int
+	blockNameLogMaxLinesPerSecond int
+	allowNameFile                 string
+	allowNameFormat               string
+	allowNameLogFile              string
+	blockIPFile                   string
+	blockIPFormat                 string
+	blockIPLogFile                string
+	allowedIPFile                 string
+	allowedIPFormat               string
+	allowedIPLogFile              string
+	queryLogFile                  string
+	queryLogFormat                string
+	queryLogIgnoredQtypes         []string
+	queryLogFields                []string
+	queryLogSampleRate            int
+	queryLogMaxLinesPerSecond     int
+	nxLogFile                     string
+	nxLogFormat                   string
+	nxLogReturnCodes              []string
+	forwardFile                   string
+	cloakFile                     string
+	blockedQueryResponse          string
+	cache                         bool
+	pluginBlockIPv6               bool
+}
+
+// ListenerProfileConfig overrides the global settings for queries received on a listener; sections that are not
+// present keep the global settings
+type ListenerProfileConfig struct {
+	BlockName            *BlockNameConfig   `toml:"blocked_names"`
+	AllowedName          *AllowedNameConfig `toml:"allowed_names"`
+	BlockIP              *BlockIPConfig     `toml:"blocked_ips"`
+	AllowIP              *AllowIPConfig     `toml:"allowed_ips"`
+	QueryLog             *QueryLogConfig    `toml:"query_log"`
+	NxLog                *NxLogConfig       `toml:"nx_log"`
+	ForwardFile          *string            `toml:"forwarding_rules"`
+	CloakFile            *string            `toml:"cloaking_rules"`
+	BlockedQueryResponse *string            `toml:"blocked_query_response"`
+	Cache                *bool              `toml:"cache"`
+	BlockIPv6            *bool              `toml:"block_ipv6"`
+}
+
+// ListenerProfile is a set of plugins dedicated to the queries received on a listener
+type ListenerProfile struct {
+	pluginSettings
+	pluginsGlobals PluginsGlobals
+	// Plugins that have to be initialized with the settings of the profile instead of being shared with the
+	// global plugins
+	overriddenPlugins map[reflect.Type]bool
+}
+
+func NewListenerProfile(settings pluginSettings, config *ListenerProfileConfig, logQueryIDs bool) (*ListenerProfile, error) {
+	profile := ListenerProfile{pluginSettings: settings, overriddenPlugins: make(map[reflect.Type]bool)}
+	var err error
+	if config.BlockName != nil {
+		if profile.blockNameFormat, err = normalizeLogFormat(config.BlockName.Format); err != nil {
+			return nil, err
+		}
+		profile.blockNameFile = config.BlockName.File
+		profile.blockNameLogFile = config.BlockName.LogFile
+		profile.blockNameLogSampleRate = config.BlockName.LogSampleRate
+		profile.blockNameLogMaxLinesPerSecond = config.BlockName.LogMaxLinesPerSecond
+		profile.override(new(PluginBlockName), new(PluginBlockNameResponse))
+	}
+	if config.AllowedName != nil {
+		if profile.allowNameFormat, err = normalizeLogFormat(config.AllowedName.Format); err != nil {
+			return nil, err
+		}
+		profile.allowNameFile = config.AllowedName.File
+		profile.allowNameLogFile = config.AllowedName.LogFile
+		profile.override(new(PluginAllowName))
+	}
+	if config.BlockIP != nil {
+		if profile.blockIPFormat, err = normalizeLogFormat(config.BlockIP.Format); err != nil {
+			return nil, err
+		}
+		profile.blockIPFile = config.BlockIP.File
+		profile.blockIPLogFile = config.BlockIP.LogFile
+		profile.override(new(PluginBlockIP))
+	}
+	if config.AllowIP != nil {
+		if profile.allowedIPFormat, err = normalizeLogFormat(config.AllowIP.Format); err != nil {
+			return nil, err
+		}
+		profile.allowedIPFile = config.AllowIP.File
+		profile.allowedIPLogFile = config.AllowIP.LogFile
+		profile.override(new(PluginAllowedIP))
+	}
+	if config.QueryLog != nil {
+		if profile.queryLogFormat, err = normalizeLogFormat(config.QueryLog.Format); err != nil {
+			return nil, err
+		}
+		if profile.queryLogFields, err = queryLogFields(profile.queryLogFormat, config.QueryLog.Fields, logQueryIDs); err != nil {
+			return nil, err
+		}
+		profile.queryLogFile = config.QueryLog.File
+		profile.queryLogIgnoredQtypes = config.QueryLog.IgnoredQtypes
+		profile.queryLogSampleRate = config.QueryLog.SampleRate
+		profile.queryLogMaxLinesPerSecond = config.QueryLog.MaxLinesPerSecond
+		profile.override(new(PluginQueryLog))
+	}
+	if config.NxLog != nil {
+		if profile.nxLogFormat, err = normalizeLogFormat(config.NxLog.Format); err != nil {
+			return nil, err
+		}
+		profile.nxLogFile = config.NxLog.File
+		profile.nxLogReturnCodes = []string{"NXDOMAIN"}
+		if len(config.NxLog.ReturnCodes) > 0 {
+			profile.nxLogReturnCodes = make([]string, len(config.NxLog.ReturnCodes))
+			for i, returnCode := range config.NxLog.ReturnCodes {
+				profile.nxLogReturnCodes[i] = strings.ToUpper(returnCode)
+			}
+		}
+		profile.override(new(PluginNxLog), new(PluginNxLogTimeout))
+	}
+	if config.ForwardFile != nil {
+		profile.forwardFile = *config.ForwardFile
+		profile.override(new(PluginForward))
+	}
+	if config.CloakFile != nil {
+		profile.cloakFile = *config.CloakFile
+		profile.override(new(PluginCloak))
+	}
+	if config.BlockedQueryResponse != nil {
+		profile.blockedQueryResponse = *config.BlockedQueryResponse
+	}
+	if config.Cache != nil {
+		profile.cache = *config.Cache
+	}
+	if config.BlockIPv6 != nil {
+		profile.pluginBlockIPv6 = *config.BlockIPv6
+	}
+	return &profile, nil
+}
+
+func (profile *ListenerProfile) override(plugins ...Plugin) {
+	for _, plugin := range plugins {
+		profile.overriddenPlugins[reflect.TypeOf(plugin)] = true
+	}
+}
+
+// sharedPlugins returns the global plugins that the profile can use as is
+func (profile *ListenerProfile) sharedPlugins(pluginsGlobals *PluginsGlobals) map[reflect.Type]Plugin {
+	sharedPlugins := make(map[reflect.Type]Plugin)
+	for _, plugins := range []*[]Plugin{pluginsGlobals.queryPlugins, pluginsGlobals.responsePlugins, pluginsGlobals.loggingPlugins} {
+		for _, plugin := range *plugins {
+			if pluginType := reflect.TypeOf(plugin); !profile.overriddenPlugins[pluginType] {
+				sharedPlugins[pluginType] = plugin
+			}
+		}
+	}
+	return sharedPlugins
+}
+
+// initListenerProfiles creates the plugins of every listener profile
+func (proxy *Proxy) initListenerProfiles() error {
+	globalSettings := proxy.pluginSettings
+	defer func() {
+		proxy.pluginSettings = globalSettings
+	}()
+	for listener, profile := range proxy.listenerProfiles {
+		proxy.pluginSettings = profile.pluginSettings
+		if err := proxy.initPlugins(&profile.pluginsGlobals, profile.sharedPlugins(&proxy.pluginsGlobals)); err != nil {
+			return fmt.Errorf("Listener profile for [%s]: %v", listener, err)
+		}
+	}
+	return nil
+}
+
+// listenerPluginsGlobals returns the plugins to apply to queries received on a listener
+func (proxy *Proxy) listenerPluginsGlobals(listener string) (*PluginsGlobals, bool) {
+	if profile, ok := proxy.listenerProfiles[listener]; ok {
+		return &profile.pluginsGlobals, true
+	}
+	return &proxy.pluginsGlobals, false
+}
+
+// normalizeLogFormat returns the lowercase name of a log format, or "tsv" if none is given
+func normalizeLogFormat(format string) (string, error) {
+	if len(format) == 0 {
+		return "tsv", nil
+	}
+	format = strings.ToLower(format)
+	if format != "tsv" && format != "ltsv" {
+		return "", fmt.Errorf("Unsupported log format: [%s]", format)
+	}
+	return format, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestNewListenerProfile(t *testing.T) {
+	c := check.T(t)
+	settings := pluginSettings{
+		blockNameFile:  "blocked-names.txt",
+		queryLogFile:   "query.log",
+		queryLogFormat: "tsv",
+		cache:          true,
+	}
+	cache := false
+	profile, err := NewListenerProfile(settings, &ListenerProfileConfig{
+		BlockName: &BlockNameConfig{File: "blocked-names-kids.txt", Format: "LTSV"},
+		Cache:     &cache,
+	}, false)
+	c.Nil(err)
+	c.Equal(profile.blockNameFile, "blocked-names-kids.txt")
+	c.Equal(profile.blockNameFormat, "ltsv")
+	c.Equal(profile.queryLogFile, "query.log")
+	c.False(profile.cache)
+	c.Equal(settings.blockNameFile, "blocked-names.txt")
+
+	blockName := new(PluginBlockName)
+	firefox := new(PluginFirefox)
+	pluginsGlobals := PluginsGlobals{
+		queryPlugins:    &[]Plugin{firefox, blockName},
+		responsePlugins: &[]Plugin{&PluginBlockNameResponse{blockName: blockName}},
+		loggingPlugins:  &[]Plugin{},
+	}
+	sharedPlugins := profile.sharedPlugins(&pluginsGlobals)
+	c.Len(sharedPlugins, 1)
+	c.Equal(sharedPlugins[reflect.TypeOf(firefox)], Plugin(firefox))
+
+	_, err = NewListenerProfile(settings, &ListenerProfileConfig{QueryLog: &QueryLogConfig{Format: "json"}}, false)
+	c.NotNil(err)
+	_, err = NewListenerProfile(settings, &ListenerProfileConfig{QueryLog: &QueryLogConfig{Fields: []string{"unknown"}}}, false)
+	c.NotNil(err)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// LocalClientAuth authenticates the clients of the local DoH, DoT and DoQ servers, using
+// certificates signed by a dedicated CA, or static tokens sent by DoH clients
+type LocalClientAuth struct {
+	clientCAs *x509.CertPool
+	tokens    [][]byte
+}
+
+// NewLocalClientAuth returns nil if clients don't have to be authenticated
+func NewLocalClientAuth(clientCAFile string, tokens []string) (*LocalClientAuth, error) {
+	if len(clientCAFile) == 0 && len(tokens) == 0 {
+		return nil, nil
+	}
+	auth := LocalClientAuth{}
+	if len(clientCAFile) > 0 {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.clientCAs = x509.NewCertPool()
+		if !auth.clientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in [" + clientCAFile + "]")
+		}
+	}
+	for _, token := range tokens {
+		if len(token) == 0 {
+			return nil, errors.New("Authentication tokens cannot be empty")
+		}
+		auth.tokens = append(auth.tokens, []byte(token))
+	}
+	return &auth, nil
+}
+
+// applyTLSConfig makes a TLS server ask clients for a certificate. Unless `verifiedLater` is set,
+// connections from clients without a valid certificate are rejected during the handshake.
+func (auth *LocalClientAuth) applyTLSConfig(tlsConfig *tls.Config, verifiedLater bool) {
+	if auth == nil || auth.clientCAs == nil {
+		return
+	}
+	tlsConfig.ClientCAs = auth.clientCAs
+	if verifiedLater {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	} else {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+}
+
+// AuthenticateRequest returns true if a DoH client sent a valid certificate or a valid bearer token
+func (auth *LocalClientAuth) AuthenticateRequest(request *http.Request) bool {
+	if auth == nil {
+		return true
+	}
+	if auth.clientCAs != nil && request.TLS != nil && len(request.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	valid := 0
+	for _, expected := range auth.tokens {
+		valid |= subtle.ConstantTimeCompare([]byte(token), expected)
+	}
+	return valid == 1
+}
+
+// RequiresCertificates returns true if DoT and DoQ clients have to be authenticated; they can't send tokens
+func (auth *LocalClientAuth) RequiresCertificates() bool {
+	return auth != nil && auth.clientCAs != nil
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+	"github.com/jedisct1/xsecretbox"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const (
+	localDNSCryptCertSize = 124
+	// Certificates are valid a bit before they are created, in case clocks are not perfectly synchronized
+	localDNSCryptClockSkew = 1 * time.Hour
+)
+
+// LocalDNSCryptServer answers DNSCrypt queries from remote clients.
+// Short-term resolver keys and the certificates signing them are generated from the provider key,
+// and replaced every half lifetime. Previous certificates remain usable until they expire.
+type LocalDNSCryptServer struct {
+	sync.RWMutex
+	providerName string
+	providerSk   ed25519.PrivateKey
+	lifetime     time.Duration
+	certs        []*localDNSCryptCert
+}
+
+type localDNSCryptCert struct {
+	construction CryptoConstruction
+	clientMagic  [ClientMagicLen]byte
+	secretKey    [32]byte
+	tsEnd        time.Time
+	txt          string
+}
+
+func NewLocalDNSCryptServer(config *LocalDNSCryptConfig) (*LocalDNSCryptServer, error) {
+	if len(config.ListenAddresses) == 0 {
+		return nil, nil
+	}
+	providerName := config.ProviderName
+	if !strings.HasPrefix(providerName, "2.dnscrypt-cert.") {
+		return nil, fmt.Errorf("local DNSCrypt: the provider name [%s] must start with `2.dnscrypt-cert.`", providerName)
+	}
+	if config.CertLifetime <= 0 {
+		return nil, errors.New("local DNSCrypt: the certificate lifetime must be at least 1 hour")
+	}
+	providerSk, err := loadOrCreateProviderKey(config.ProviderKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	server := LocalDNSCryptServer{
+		providerName: dns.Fqdn(providerName),
+		providerSk:   providerSk,
+		lifetime:     time.Duration(config.CertLifetime) * time.Hour,
+	}
+	if err := server.rotate(); err != nil {
+		return nil, err
+	}
+	return &server, nil
+}
+
+// loadOrCreateProviderKey reads a hex-encoded Ed25519 secret key, or creates it if the file doesn't exist
+func loadOrCreateProviderKey(fileName string) (ed25519.PrivateKey, error) {
+	if bin, err := os.ReadFile(fileName); err == nil {
+		providerSk, err := hex.DecodeString(strings.TrimSpace(string(bin)))
+		if err != nil || len(providerSk) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("Invalid DNSCrypt provider key in [%s]", fileName)
+		}
+		return ed25519.PrivateKey(providerSk), nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	_, providerSk, err := ed25519.GenerateKey(crypto_rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := safefile.WriteFile(fileName, []byte(hex.EncodeToString(providerSk)+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	dlog.Noticef("New DNSCrypt provider key created in [%s]", fileName)
+	return providerSk, nil
+}
+
+// Stamp returns the stamp clients can use to connect to the server
+func (server *LocalDNSCryptServer) Stamp(serverAddrStr string) string {
+	stamp := stamps.ServerStamp{
+		Proto:         stamps.StampProtoTypeDNSCrypt,
+		ServerAddrStr: serverAddrStr,
+		ServerPk:      server.providerSk.Public().(ed25519.PublicKey),
+		ProviderName:  strings.TrimSuffix(server.providerName, "."),
+	}
+	return stamp.String()
+}
+
+// rotate creates new resolver keys, and removes expired certificates
+func (server *LocalDNSCryptServer) rotate() error {
+	now := time.Now()
+	var newCerts []*localDNSCryptCert
+	for _, construction := range []CryptoConstruction{XChacha20Poly1305, XSalsa20Poly1305} {
+		cert, err := server.newCert(construction, now)
+		if err != nil {
+			return err
+		}
+		newCerts = append(newCerts, cert)
+	}
+	server.Lock()
+	for _, cert := range server.certs {
+		if now.Before(cert.tsEnd) {
+			newCerts = append(newCerts, cert)
+		}
+	}
+	server.certs = newCerts
+	server.Unlock()
+	cryptoLog.Infof("New DNSCrypt resolver keys for [%s]", server.providerName)
+	return nil
+}
+
+func (server *LocalDNSCryptServer) newCert(construction CryptoConstruction, now time.Time) (*localDNSCryptCert, error) {
+	cert := localDNSCryptCert{construction: construction, tsEnd: now.Add(server.lifetime)}
+	if _, err := crypto_rand.Read(cert.secretKey[:]); err != nil {
+		return nil, err
+	}
+	var publicKey [32]byte
+	curve25519.ScalarBaseMult(&publicKey, &cert.secretKey)
+	copy(cert.clientMagic[:], publicKey[:ClientMagicLen])
+	bin := make([]byte, localDNSCryptCertSize)
+	copy(bin[0:4], CertMagic[:])
+	binary.BigEndian.PutUint16(bin[4:6], uint16(construction))
+	copy(bin[72:104], publicKey[:])
+	copy(bin[104:112], cert.clientMagic[:])
+	binary.BigEndian.PutUint32(bin[112:116], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(bin[116:120], uint32(now.Add(-localDNSCryptClockSkew).Unix()))
+	binary.BigEndian.PutUint32(bin[120:124], uint32(cert.tsEnd.Unix()))
+	copy(bin[8:72], ed25519.Sign(server.providerSk, bin[72:]))
+	cert.txt = binaryToTXT(bin)
+	return &cert, nil
+}
+
+// binaryToTXT returns the presentation format of a TXT string, that PackTXTRR() reverses
+func binaryToTXT(bin []byte) string {
+	var txt strings.Builder
+	for _, c := range bin {
+		if c < 0x20 || c > 0x7e || c == '"' || c == '\\' {
+			fmt.Fprintf(&txt, "\\%03d", c)
+		} else {
+			txt.WriteByte(c)
+		}
+	}
+	return txt.String()
+}
+
+func (server *LocalDNSCryptServer) run() {
+	for {
+		time.Sleep(server.lifetime / 2)
+		if err := server.rotate(); err != nil {
+			dlog.Errorf("Unable to rotate the DNSCrypt resolver keys: [%v]", err)
+		}
+	}
+}
+
+// certResponse returns the certificates if the packet is an unencrypted query for them
+func (server *LocalDNSCryptServer) certResponse(packet []byte) []byte {
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil || len(msg.Question) != 1 || msg.Response {
+		return nil
+	}
+	question := msg.Question[0]
+	if question.Qtype != dns.TypeTXT || !strings.EqualFold(question.Name, server.providerName) {
+		return nil
+	}
+	synth := EmptyResponseFromMessage(&msg)
+	synth.Authoritative = true
+	server.RLock()
+	for _, cert := range server.certs {
+		rr := new(dns.TXT)
+		rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 3600}
+		rr.Txt = []string{cert.txt}
+		synth.Answer = append(synth.Answer, rr)
+	}
+	server.RUnlock()
+	response, err := synth.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// localDNSCryptSession holds what is required to encrypt the response to a query
+type localDNSCryptSession struct {
+	construction CryptoConstruction
+	sharedKey    [32]byte
+	clientNonce  [HalfNonceSize]byte
+	queryLen     int
+}
+
+func (server *LocalDNSCryptServer) decrypt(encrypted []byte) ([]byte, *localDNSCryptSession, error) {
+	if len(encrypted) < QueryOverhead+MinDNSPacketSize {
+		return nil, nil, errors.New("Short DNSCrypt query")
+	}
+	var cert *localDNSCryptCert
+	server.RLock()
+	for _, candidate := range server.certs {
+		if bytes.Equal(candidate.clientMagic[:], encrypted[:ClientMagicLen]) {
+			cert = candidate
+			break
+		}
+	}
+	server.RUnlock()
+	if cert == nil {
+		return nil, nil, errors.New("Unknown client magic")
+	}
+	var clientPk [PublicKeySize]byte
+	copy(clientPk[:], encrypted[ClientMagicLen:ClientMagicLen+PublicKeySize])
+	session := localDNSCryptSession{construction: cert.construction, queryLen: len(encrypted)}
+	copy(session.clientNonce[:], encrypted[ClientMagicLen+PublicKeySize:])
+	session.sharedKey = ComputeSharedKey(cert.construction, &cert.secretKey, &clientPk, &server.providerName)
+	var nonce [NonceSize]byte
+	copy(nonce[:], session.clientNonce[:])
+	ciphertext := encrypted[ClientMagicLen+PublicKeySize+HalfNonceSize:]
+	var packet []byte
+	if cert.construction == XChacha20Poly1305 {
+		var err error
+		if packet, err = xsecretbox.Open(nil, nonce[:], ciphertext, session.sharedKey[:]); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		var ok bool
+		if packet, ok = secretbox.Open(nil, ciphertext, &nonce, &session.sharedKey); !ok {
+			return nil, nil, errors.New("Incorrect tag")
+		}
+	}
+	packet, err := unpad(packet)
+	if err != nil || len(packet) < MinDNSPacketSize {
+		return nil, nil, errors.New("Incorrect padding")
+	}
+	return packet, &session, nil
+}
+
+// encrypt returns an encrypted response. Over UDP, responses are never larger than queries,
+// so that the server can't be used for amplification: truncated responses are sent instead.
+func (server *LocalDNSCryptServer) encrypt(response []byte, session *localDNSCryptSession, proto string) ([]byte, error) {
+	maxLength := MaxDNSPacketSize + ResponseOverhead + 1
+	if proto == "udp" {
+		maxLength = session.queryLen
+		if ResponseOverhead+len(response)+1 > maxLength {
+			var err error
+			if response, err = TruncatedResponse(response); err != nil {
+				return nil, err
+			}
+		}
+	}
+	var xpad [1]byte
+	if _, err := crypto_rand.Read(xpad[:]); err != nil {
+		return nil, err
+	}
+	paddedLength := Min(maxLength-ResponseOverhead, (len(response)+1+int(xpad[0])+63) & ^63)
+	if len(response)+1 > paddedLength {
+		return nil, errors.New("Response too large; cannot be padded")
+	}
+	var nonce [NonceSize]byte
+	copy(nonce[:], session.clientNonce[:])
+	if _, err := crypto_rand.Read(nonce[HalfNonceSize:]); err != nil {
+		return nil, err
+	}
+	encrypted := append(ServerMagic[:], nonce[:]...)
+	padded := pad(append([]byte{}, response...), paddedLength)
+	if session.construction == XChacha20Poly1305 {
+		return xsecretbox.Seal(encrypted, nonce[:], padded, session.sharedKey[:]), nil
+	}
+	return secretbox.Seal(encrypted, padded, &nonce, &session.sharedKey), nil
+}
+
+// handleLocalDNSCryptQuery returns the response to a DNSCrypt query, or to a query for the certificates
+func (proxy *Proxy) handleLocalDNSCryptQuery(encrypted []byte, proto string, clientAddr net.Addr, localAddr net.Addr, start time.Time) []byte {
+	server := proxy.localDNSCrypt
+	packet, session, err := server.decrypt(encrypted)
+	if err != nil {
+		return server.certResponse(encrypted)
+	}
+	var response []byte
+	if acl := proxy.listenerACL(localAddr); acl.Allows(clientAddr) {
+		listener := proxy.listenerLabel(localAddr)
+		response = proxy.processIncomingQueryFrom(listener, "dnscrypt", proxy.mainProto, packet, &clientAddr, nil, start, false)
+	} else {
+		dlog.Debugf("Client [%v] is not allowed to use this listener", clientAddr)
+		response = acl.Reject(packet)
+	}
+	if len(response) == 0 {
+		return nil
+	}
+	encryptedResponse, err := server.encrypt(response, session, proto)
+	if err != nil {
+		dlog.Debugf("Unable to encrypt a DNSCrypt response: [%v]", err)
+		return nil
+	}
+	return encryptedResponse
+}
+
+func (proxy *Proxy) addLocalDNSCryptListener(listenAddrStr string) {
+	udp := "udp"
+	tcp := "tcp"
+	isIPv4 := isDigit(listenAddrStr[0])
+	if isIPv4 {
+		udp = "udp4"
+		tcp = "tcp4"
+	}
+	listenUDPAddr, err := net.ResolveUDPAddr(udp, listenAddrStr)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	listenTCPAddr, err := net.ResolveTCPAddr(tcp, listenAddrStr)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+
+	// if 'userName' is not set, continue as before
+	if len(proxy.userName) <= 0 {
+		listenerUDP, err := proxy.listenUDP(udp, listenUDPAddr)
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		listenerTCP, err := proxy.listenTCP(tcp, listenTCPAddr)
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		proxy.localDNSCryptUDPListeners = append(proxy.localDNSCryptUDPListeners, listenerUDP)
+		proxy.localDNSCryptTCPListeners = append(proxy.localDNSCryptTCPListeners, listenerTCP)
+		dlog.Noticef("Now listening to %v [DNSCrypt]", listenAddrStr)
+		return
+	}
+
+	// if 'userName' is set and we are the parent process
+	if !proxy.child {
+		// parent
+		listenerUDP, err := proxy.listenUDP(udp, listenUDPAddr)
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		listenerTCP, err := proxy.listenTCP(tcp, listenTCPAddr)
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		fdUDP, err := listenerUDP.File() // On Windows, the File method of UDPConn is not implemented.
+		if err != nil {
+			dlog.Fatalf("Unable to switch to a different user: %v", err)
+		}
+		fdTCP, err := listenerTCP.File() // On Windows, the File method of TCPListener is not implemented.
+		if err != nil {
+			dlog.Fatalf("Unable to switch to a different user: %v", err)
+		}
+		defer listenerUDP.Close()
+		defer listenerTCP.Close()
+		FileDescriptors = append(FileDescriptors, fdUDP)
+		FileDescriptors = append(FileDescriptors, fdTCP)
+		return
+	}
+
+	// child
+	listenerUDP, err := net.FilePacketConn(os.NewFile(InheritedDescriptorsBase+FileDescriptorNum, "listenerUDP"))
+	if err != nil {
+		dlog.Fatalf("Unable to switch to a different user: %v", err)
+	}
+	FileDescriptorNum++
+
+	listenerTCP, err := net.FileListener(os.NewFile(InheritedDescriptorsBase+FileDescriptorNum, "listenerTCP"))
+	if err != nil {
+		dlog.Fatalf("Unable to switch to a different user: %v", err)
+	}
+	FileDescriptorNum++
+
+	proxy.localDNSCryptUDPListeners = append(proxy.localDNSCryptUDPListeners, listenerUDP.(*net.UDPConn))
+	proxy.localDNSCryptTCPListeners = append(proxy.localDNSCryptTCPListeners, listenerTCP.(*net.TCPListener))
+	dlog.Noticef("Now listening to %v [DNSCrypt]", listenAddrStr)
+}
+
+func (proxy *Proxy) localDNSCryptUDPListener(clientPc *net.UDPConn) {
+	defer clientPc.Close()
+	for {
+		buffer := make([]byte, MaxDNSPacketSize)
+		length, clientAddr, err := clientPc.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		start := time.Now()
+		if !proxy.clientsCountInc() {
+			dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
+			continue
+		}
+		go func() {
+			defer proxy.clientsCountDec()
+			response := proxy.handleLocalDNSCryptQuery(buffer[:length], "udp", clientAddr, clientPc.LocalAddr(), start)
+			if len(response) > 0 {
+				clientPc.WriteTo(response, clientAddr)
+			}
+		}()
+	}
+}
+
+func (proxy *Proxy) localDNSCryptTCPListener(acceptPc *net.TCPListener) {
+	defer acceptPc.Close()
+	for {
+		clientPc, err := acceptPc.Accept()
+		if err != nil {
+			continue
+		}
+		if !proxy.clientsCountInc() {
+			dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
+			clientPc.Close()
+			continue
+		}
+		go func() {
+			defer proxy.clientsCountDec()
+			defer clientPc.Close()
+			reader := bufio.NewReader(clientPc)
+			for {
+				if err := clientPc.SetDeadline(time.Now().Add(proxy.timeout)); err != nil {
+					return
+				}
+				var lengthPrefix [2]byte
+				if _, err := io.ReadFull(reader, lengthPrefix[:]); err != nil {
+					return
+				}
+				encrypted := make([]byte, binary.BigEndian.Uint16(lengthPrefix[:]))
+				if _, err := io.ReadFull(reader, encrypted); err != nil {
+					return
+				}
+				response := proxy.handleLocalDNSCryptQuery(encrypted, "tcp", clientPc.RemoteAddr(), clientPc.LocalAddr(), time.Now())
+				if len(response) == 0 {
+					return
+				}
+				prefixedResponse, err := PrefixWithSize(response)
+				if err != nil {
+					return
+				}
+				if _, err := clientPc.Write(prefixedResponse); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
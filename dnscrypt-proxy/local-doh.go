@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -30,6 +31,11 @@ func (handler localDoHHandler) ServeHTTP(writer http.ResponseWriter, request *ht
 		writer.WriteHeader(404)
 		return
 	}
+	if !proxy.localClientAuth.AuthenticateRequest(request) {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		writer.WriteHeader(401)
+		return
+	}
 	packet := []byte{}
 	var err error
 	start := time.Now()
@@ -62,6 +68,19 @@ func (handler localDoHHandler) ServeHTTP(writer http.ResponseWriter, request *ht
 		return
 	}
 	xClientAddr := net.Addr(clientAddr)
+	localAddr, _ := request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if acl := proxy.listenerACL(localAddr); !acl.Allows(xClientAddr) {
+		dlog.Debugf("Client [%v] is not allowed to use this listener", xClientAddr)
+		response := acl.Reject(packet)
+		if len(response) == 0 {
+			writer.WriteHeader(403)
+			return
+		}
+		writer.Header().Set("Content-Type", dataType)
+		writer.WriteHeader(200)
+		writer.Write(response)
+		return
+	}
 	hasEDNS0Padding, err := hasEDNS0Padding(packet)
 	if err != nil {
 		writer.WriteHeader(400)
@@ -98,16 +117,31 @@ func (handler localDoHHandler) ServeHTTP(writer http.ResponseWriter, request *ht
 
 func (proxy *Proxy) localDoHListener(acceptPc *net.TCPListener) {
 	defer acceptPc.Close()
-	if len(proxy.localDoHCertFile) == 0 || len(proxy.localDoHCertKeyFile) == 0 {
-		dlog.Fatal("A certificate and a key are required to start a local DoH service")
+	if proxy.localDoHACME == nil && (len(proxy.localDoHCertFile) == 0 || len(proxy.localDoHCertKeyFile) == 0) {
+		dlog.Fatal("A certificate and a key, or ACME domains, are required to start a local DoH service")
 	}
 	httpServer := &http.Server{
-		ReadTimeout:  proxy.timeout,
-		WriteTimeout: proxy.timeout,
-		Handler:      localDoHHandler{proxy: proxy},
+		ReadHeaderTimeout: proxy.tcpReadTimeout,
+		ReadTimeout:       proxy.timeout,
+		WriteTimeout:      proxy.timeout,
+		IdleTimeout:       proxy.tcpIdleTimeout,
+		Handler:           localDoHHandler{proxy: proxy},
 	}
+	httpServer.TLSConfig = &tls.Config{}
+	if proxy.localDoHACME != nil {
+		httpServer.TLSConfig.GetCertificate = proxy.localDoHACME.GetCertificate
+		httpServer.TLSConfig.NextProtos = []string{"h2", "http/1.1", acmeTLSALPNProto}
+	}
+	// Clients without a certificate may still send a token, and ACME validation servers don't send certificates
+	proxy.localClientAuth.applyTLSConfig(httpServer.TLSConfig, true)
 	httpServer.SetKeepAlivesEnabled(true)
-	if err := httpServer.ServeTLS(acceptPc, proxy.localDoHCertFile, proxy.localDoHCertKeyFile); err != nil {
+	var listener net.Listener = acceptPc
+	if proxy.proxyProtocol != nil {
+		listener = &proxyProtocolListener{Listener: listener, proxyProtocol: proxy.proxyProtocol, timeout: proxy.timeout}
+	}
+	// Connections are counted once the PROXY protocol header has been read, so that limits apply to actual clients
+	listener = proxy.tcpConnLimiter.Wrap(listener)
+	if err := httpServer.ServeTLS(listener, proxy.localDoHCertFile, proxy.localDoHCertKeyFile); err != nil {
 		dlog.Fatal(err)
 	}
 }
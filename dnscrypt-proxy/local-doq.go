@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/quic-go/quic-go"
+)
+
+func (proxy *Proxy) registerLocalDoQListener(listener *net.UDPConn) {
+	proxy.localDoQListeners = append(proxy.localDoQListeners, listener)
+}
+
+func (proxy *Proxy) addLocalDoQListener(listenAddrStr string) {
+	network := "udp"
+	isIPv4 := isDigit(listenAddrStr[0])
+	if isIPv4 {
+		network = "udp4"
+	}
+	listenUDPAddr, err := net.ResolveUDPAddr(network, listenAddrStr)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+
+	// if 'userName' is not set, continue as before
+	if len(proxy.userName) <= 0 {
+		listenerUDP, err := proxy.listenUDP(network, listenUDPAddr)
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		proxy.registerLocalDoQListener(listenerUDP)
+		dlog.Noticef("Now listening to quic://%v [DoQ]", listenUDPAddr)
+		return
+	}
+
+	// if 'userName' is set and we are the parent process
+	if !proxy.child {
+		// parent
+		listenerUDP, err := proxy.listenUDP(network, listenUDPAddr)
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		fdUDP, err := listenerUDP.File() // On Windows, the File method of UDPConn is not implemented.
+		if err != nil {
+			dlog.Fatalf("Unable to switch to a different user: %v", err)
+		}
+		defer listenerUDP.Close()
+		FileDescriptors = append(FileDescriptors, fdUDP)
+		return
+	}
+
+	// child
+	listenerUDP, err := net.FilePacketConn(os.NewFile(InheritedDescriptorsBase+FileDescriptorNum, "listenerUDP"))
+	if err != nil {
+		dlog.Fatalf("Unable to switch to a different user: %v", err)
+	}
+	FileDescriptorNum++
+
+	proxy.registerLocalDoQListener(listenerUDP.(*net.UDPConn))
+	dlog.Noticef("Now listening to quic://%v [DoQ]", listenAddrStr)
+}
+
+// localDoQListener accepts DNS-over-QUIC connections (RFC 9250); every query is sent over its own stream
+func (proxy *Proxy) localDoQListener(clientPc *net.UDPConn) {
+	defer clientPc.Close()
+	tlsConfig, err := proxy.localTLSConfig(DoQALPN)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	quicConfig := &quic.Config{MaxIdleTimeout: doqDefaultIdleTimeout}
+	listener, err := quic.Listen(clientPc, tlsConfig, quicConfig)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			dlog.Errorf("Local DoQ server: [%v]", err)
+			return
+		}
+		acl := proxy.listenerACL(clientPc.LocalAddr())
+		if !acl.Allows(conn.RemoteAddr()) && acl.Drops() {
+			conn.CloseWithError(doqNoError, "")
+			continue
+		}
+		if !proxy.clientsCountInc() {
+			dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
+			conn.CloseWithError(doqNoError, "")
+			continue
+		}
+		go func() {
+			defer proxy.clientsCountDec()
+			proxy.localDoQConnection(conn, acl)
+		}()
+	}
+}
+
+func (proxy *Proxy) localDoQConnection(conn quic.Connection, acl *ListenerACL) {
+	clientAddr := conn.RemoteAddr()
+	listener := proxy.listenerLabel(conn.LocalAddr())
+	allowed := acl.Allows(clientAddr)
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			if err := stream.SetDeadline(time.Now().Add(proxy.timeout)); err != nil {
+				return
+			}
+			start := time.Now()
+			var lengthPrefix [2]byte
+			if _, err := io.ReadFull(stream, lengthPrefix[:]); err != nil {
+				stream.CancelRead(doqInternalError)
+				return
+			}
+			length := int(binary.BigEndian.Uint16(lengthPrefix[:]))
+			if length < MinDNSPacketSize || length > MaxDNSPacketSize {
+				stream.CancelRead(doqInternalError)
+				return
+			}
+			packet := make([]byte, length)
+			if _, err := io.ReadFull(stream, packet); err != nil {
+				stream.CancelRead(doqInternalError)
+				return
+			}
+			var response []byte
+			if allowed {
+				response = proxy.processIncomingQueryFrom(listener, "local_doq", proxy.mainProto, packet, &clientAddr, nil, start, false)
+			} else {
+				response = acl.Reject(packet)
+			}
+			if len(response) == 0 {
+				stream.CancelWrite(doqInternalError)
+				return
+			}
+			prefixedResponse, err := PrefixWithSize(response)
+			if err != nil {
+				stream.CancelWrite(doqInternalError)
+				return
+			}
+			stream.Write(prefixedResponse)
+		}()
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	DoTALPN                    = "dot"
+	localDoTMaxQueriesInFlight = 16
+)
+
+// localTLSConfig returns the TLS configuration of the local DoT and DoQ servers.
+// They share the certificate of the local DoH server.
+func (proxy *Proxy) localTLSConfig(alpn string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, NextProtos: []string{alpn}}
+	proxy.localClientAuth.applyTLSConfig(tlsConfig, false)
+	if proxy.localDoHACME != nil {
+		tlsConfig.GetCertificate = proxy.localDoHACME.GetCertificate
+		return tlsConfig, nil
+	}
+	if len(proxy.localDoHCertFile) == 0 || len(proxy.localDoHCertKeyFile) == 0 {
+		return nil, errors.New("A certificate and a key, or ACME domains, are required to start a local DoT or DoQ service")
+	}
+	certificate, err := tls.LoadX509KeyPair(proxy.localDoHCertFile, proxy.localDoHCertKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.Certificates = []tls.Certificate{certificate}
+	return tlsConfig, nil
+}
+
+func (proxy *Proxy) registerLocalDoTListener(listener *net.TCPListener) {
+	proxy.localDoTListeners = append(proxy.localDoTListeners, listener)
+}
+
+func (proxy *Proxy) addLocalDoTListener(listenAddrStr string) {
+	network := "tcp"
+	isIPv4 := isDigit(listenAddrStr[0])
+	if isIPv4 {
+		network = "tcp4"
+	}
+	listenTCPAddr, err := net.ResolveTCPAddr(network, listenAddrStr)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+
+	// if 'userName' is not set, continue as before
+	if len(proxy.userName) <= 0 {
+		listenConfig, err := proxy.tcpListenerConfig()
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		listenConfig = proxy.bindListenConfig(listenConfig)
+		acceptPc, err := listenConfig.Listen(context.Background(), network, listenTCPAddr.String())
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		proxy.registerLocalDoTListener(acceptPc.(*net.TCPListener))
+		dlog.Noticef("Now listening to tls://%v [DoT]", listenTCPAddr)
+		return
+	}
+
+	// if 'userName' is set and we are the parent process
+	if !proxy.child {
+		// parent
+		listenerTCP, err := proxy.listenTCP(network, listenTCPAddr)
+		if err != nil {
+			dlog.Fatal(err)
+		}
+		fdTCP, err := listenerTCP.File() // On Windows, the File method of TCPListener is not implemented.
+		if err != nil {
+			dlog.Fatalf("Unable to switch to a different user: %v", err)
+		}
+		defer listenerTCP.Close()
+		FileDescriptors = append(FileDescriptors, fdTCP)
+		return
+	}
+
+	// child
+	listenerTCP, err := net.FileListener(os.NewFile(InheritedDescriptorsBase+FileDescriptorNum, "listenerTCP"))
+	if err != nil {
+		dlog.Fatalf("Unable to switch to a different user: %v", err)
+	}
+	FileDescriptorNum++
+
+	proxy.registerLocalDoTListener(listenerTCP.(*net.TCPListener))
+	dlog.Noticef("Now listening to tls://%v [DoT]", listenAddrStr)
+}
+
+// localDoTListener accepts DNS-over-TLS connections (RFC 7858).
+// Clients usually keep connections open and send multiple queries, that are processed concurrently.
+func (proxy *Proxy) localDoTListener(acceptPc *net.TCPListener) {
+	defer acceptPc.Close()
+	tlsConfig, err := proxy.localTLSConfig(DoTALPN)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	listener := proxy.tcpConnLimiter.Wrap(acceptPc)
+	for {
+		clientPc, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		acl := proxy.listenerACL(clientPc.LocalAddr())
+		if !acl.Allows(clientPc.RemoteAddr()) && acl.Drops() {
+			clientPc.Close()
+			continue
+		}
+		if !proxy.clientsCountInc() {
+			dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
+			clientPc.Close()
+			continue
+		}
+		go func() {
+			defer proxy.clientsCountDec()
+			proxy.localDoTConnection(tls.Server(clientPc, tlsConfig), acl)
+		}()
+	}
+}
+
+func (proxy *Proxy) localDoTConnection(tlsConn *tls.Conn, acl *ListenerACL) {
+	defer tlsConn.Close()
+	if err := tlsConn.SetDeadline(time.Now().Add(proxy.tcpReadTimeout)); err != nil {
+		return
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		dlog.Debugf("Local DoT handshake failed: [%v]", err)
+		return
+	}
+	clientAddr := tlsConn.RemoteAddr()
+	listener := proxy.listenerLabel(tlsConn.LocalAddr())
+	allowed := acl.Allows(clientAddr)
+	reader := bufio.NewReader(tlsConn)
+	var writeLock sync.Mutex
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	inFlight := make(chan struct{}, localDoTMaxQueriesInFlight)
+	for {
+		if err := tlsConn.SetReadDeadline(time.Now().Add(proxy.tcpIdleTimeout)); err != nil {
+			return
+		}
+		// Queries can be pipelined, so that a read may return more than one query
+		var lengthPrefix [2]byte
+		if _, err := io.ReadFull(reader, lengthPrefix[:]); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(lengthPrefix[:]))
+		if length < MinDNSPacketSize || length > MaxDNSPacketSize {
+			return
+		}
+		// Once a query has started, the rest of it has to be received quickly
+		if err := tlsConn.SetReadDeadline(time.Now().Add(proxy.tcpReadTimeout)); err != nil {
+			return
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(reader, packet); err != nil {
+			return
+		}
+		start := time.Now()
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inFlight
+				wg.Done()
+			}()
+			var response []byte
+			if allowed {
+				response = proxy.processIncomingQueryFrom(listener, "local_dot", proxy.mainProto, packet, &clientAddr, nil, start, false)
+			} else {
+				response = acl.Reject(packet)
+			}
+			if len(response) == 0 {
+				return
+			}
+			prefixedResponse, err := PrefixWithSize(response)
+			if err != nil {
+				return
+			}
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			if err := tlsConn.SetWriteDeadline(time.Now().Add(proxy.timeout)); err != nil {
+				return
+			}
+			tlsConn.Write(prefixedResponse)
+		}()
+	}
+}
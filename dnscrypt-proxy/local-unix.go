@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// removeStaleUnixSocket removes a socket left over by a previous instance, so that it can be created again.
+// Files that are not sockets are never removed.
+func removeStaleUnixSocket(path string) error {
+	fileInfo, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fileInfo.Mode()&fs.ModeSocket == 0 {
+		return errors.New("[" + path + "] exists and is not a socket")
+	}
+	return os.Remove(path)
+}
+
+func (proxy *Proxy) addLocalUnixListeners() {
+	if len(proxy.localUnixStreamPath) > 0 {
+		proxy.addLocalUnixStreamListener(proxy.localUnixStreamPath)
+	}
+	if len(proxy.localUnixDatagramPath) > 0 {
+		proxy.addLocalUnixDatagramListener(proxy.localUnixDatagramPath)
+	}
+}
+
+func (proxy *Proxy) addLocalUnixStreamListener(path string) {
+	// if 'userName' is set and we are the child process, the socket was created by the parent
+	if len(proxy.userName) > 0 && proxy.child {
+		listener, err := net.FileListener(os.NewFile(InheritedDescriptorsBase+FileDescriptorNum, "listenerUnix"))
+		if err != nil {
+			dlog.Fatalf("Unable to switch to a different user: %v", err)
+		}
+		FileDescriptorNum++
+		proxy.localUnixStreamListeners = append(proxy.localUnixStreamListeners, listener.(*net.UnixListener))
+		dlog.Noticef("Now listening to unix://%v [stream]", path)
+		return
+	}
+
+	if err := removeStaleUnixSocket(path); err != nil {
+		dlog.Fatal(err)
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	if err := os.Chmod(path, proxy.localUnixPermissions); err != nil {
+		dlog.Fatal(err)
+	}
+
+	// if 'userName' is not set, continue as before
+	if len(proxy.userName) <= 0 {
+		proxy.localUnixStreamListeners = append(proxy.localUnixStreamListeners, listener)
+		dlog.Noticef("Now listening to unix://%v [stream]", path)
+		return
+	}
+
+	// parent - the socket must outlive this listener, as it is going to be used by the child
+	listener.SetUnlinkOnClose(false)
+	fd, err := listener.File()
+	if err != nil {
+		dlog.Fatalf("Unable to switch to a different user: %v", err)
+	}
+	defer listener.Close()
+	FileDescriptors = append(FileDescriptors, fd)
+}
+
+func (proxy *Proxy) addLocalUnixDatagramListener(path string) {
+	// if 'userName' is set and we are the child process, the socket was created by the parent
+	if len(proxy.userName) > 0 && proxy.child {
+		clientPc, err := net.FilePacketConn(os.NewFile(InheritedDescriptorsBase+FileDescriptorNum, "listenerUnixgram"))
+		if err != nil {
+			dlog.Fatalf("Unable to switch to a different user: %v", err)
+		}
+		FileDescriptorNum++
+		proxy.localUnixDatagramListeners = append(proxy.localUnixDatagramListeners, clientPc.(*net.UnixConn))
+		dlog.Noticef("Now listening to unix://%v [datagram]", path)
+		return
+	}
+
+	if err := removeStaleUnixSocket(path); err != nil {
+		dlog.Fatal(err)
+	}
+	clientPc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	if err := os.Chmod(path, proxy.localUnixPermissions); err != nil {
+		dlog.Fatal(err)
+	}
+
+	// if 'userName' is not set, continue as before
+	if len(proxy.userName) <= 0 {
+		proxy.localUnixDatagramListeners = append(proxy.localUnixDatagramListeners, clientPc)
+		dlog.Noticef("Now listening to unix://%v [datagram]", path)
+		return
+	}
+
+	// parent
+	fd, err := clientPc.File()
+	if err != nil {
+		dlog.Fatalf("Unable to switch to a different user: %v", err)
+	}
+	defer clientPc.Close()
+	FileDescriptors = append(FileDescriptors, fd)
+}
+
+// localUnixStreamListener accepts connections from local clients; queries are prefixed with their length, as over TCP
+func (proxy *Proxy) localUnixStreamListener(acceptPc *net.UnixListener) {
+	defer acceptPc.Close()
+	for {
+		clientPc, err := acceptPc.Accept()
+		if err != nil {
+			continue
+		}
+		if !proxy.clientsCountInc() {
+			dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
+			clientPc.Close()
+			continue
+		}
+		go func() {
+			defer clientPc.Close()
+			defer proxy.clientsCountDec()
+			proxy.localUnixStreamConnection(clientPc)
+		}()
+	}
+}
+
+func (proxy *Proxy) localUnixStreamConnection(clientPc net.Conn) {
+	clientAddr := clientPc.RemoteAddr()
+	listener := proxy.listenerLabel(clientPc.LocalAddr())
+	for {
+		if err := clientPc.SetDeadline(time.Now().Add(proxy.timeout)); err != nil {
+			return
+		}
+		packet, err := ReadPrefixed(&clientPc)
+		if err != nil {
+			return
+		}
+		start := time.Now()
+		response := proxy.processIncomingQueryFrom(listener, "unix", proxy.mainProto, packet, &clientAddr, nil, start, false)
+		if len(response) == 0 {
+			return
+		}
+		prefixedResponse, err := PrefixWithSize(response)
+		if err != nil {
+			return
+		}
+		if _, err := clientPc.Write(prefixedResponse); err != nil {
+			return
+		}
+	}
+}
+
+// localUnixDatagramListener receives queries from local clients, that must be bound to their own socket to get responses
+func (proxy *Proxy) localUnixDatagramListener(clientPc *net.UnixConn) {
+	defer clientPc.Close()
+	listener := proxy.listenerLabel(clientPc.LocalAddr())
+	for {
+		buffer := getPacketBuffer()
+		length, clientAddr, err := clientPc.ReadFrom((*buffer)[:MaxDNSPacketSize-1])
+		if err != nil {
+			putPacketBuffer(buffer)
+			return
+		}
+		packet := append([]byte{}, (*buffer)[:length]...)
+		putPacketBuffer(buffer)
+		if clientAddr == nil {
+			continue
+		}
+		if !proxy.clientsCountInc() {
+			dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
+			continue
+		}
+		start := time.Now()
+		go func() {
+			defer proxy.clientsCountDec()
+			response := proxy.processIncomingQueryFrom(listener, "unix", proxy.mainProto, packet, &clientAddr, nil, start, false)
+			if len(response) == 0 {
+				return
+			}
+			clientPc.WriteTo(response, clientAddr)
+		}()
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestLocalClientAuthTokens(t *testing.T) {
+	c := check.T(t)
+	auth, err := NewLocalClientAuth("", nil)
+	c.Nil(err)
+	c.Nil(auth)
+	c.True(auth.AuthenticateRequest(httptest.NewRequest("GET", "/dns-query", nil)))
+
+	_, err = NewLocalClientAuth("", []string{""})
+	c.NotNil(err)
+
+	auth, err = NewLocalClientAuth("", []string{"token-1", "token-2"})
+	c.Nil(err)
+	c.False(auth.RequiresCertificates())
+	request := httptest.NewRequest("GET", "/dns-query", nil)
+	c.False(auth.AuthenticateRequest(request))
+	request.Header.Set("Authorization", "Bearer token-2")
+	c.True(auth.AuthenticateRequest(request))
+	request.Header.Set("Authorization", "Bearer token-3")
+	c.False(auth.AuthenticateRequest(request))
+	request.Header.Set("Authorization", "token-1")
+	c.False(auth.AuthenticateRequest(request))
+
+	// Certificates are only accepted if a CA is configured
+	request = httptest.NewRequest("GET", "/dns-query", nil)
+	request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+	c.False(auth.AuthenticateRequest(request))
+	auth.clientCAs = x509.NewCertPool()
+	c.True(auth.AuthenticateRequest(request))
+	c.True(auth.RequiresCertificates())
+}
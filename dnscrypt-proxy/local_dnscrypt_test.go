@@ -0,0 +1,71 @@
+package main
+
+import (
+	crypto_rand "crypto/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestLocalDNSCryptServer(t *testing.T) {
+	c := check.T(t)
+	config := LocalDNSCryptConfig{
+		ListenAddresses: []string{"127.0.0.1:0"},
+		ProviderName:    "2.dnscrypt-cert.example.com",
+		ProviderKeyFile: filepath.Join(t.TempDir(), "provider.key"),
+		CertLifetime:    24,
+	}
+	server, err := NewLocalDNSCryptServer(&config)
+	c.Nil(err)
+	reloaded, err := NewLocalDNSCryptServer(&config)
+	c.Nil(err)
+	c.DeepEqual(reloaded.providerSk, server.providerSk)
+
+	certQuery := dns.Msg{}
+	certQuery.SetQuestion("2.dnscrypt-cert.example.com.", dns.TypeTXT)
+	packet, err := certQuery.Pack()
+	c.Nil(err)
+	certMsg := dns.Msg{}
+	c.Nil(certMsg.Unpack(server.certResponse(packet)))
+	c.Len(certMsg.Answer, 2)
+
+	proxy := Proxy{questionSizeEstimator: NewQuestionSizeEstimator()}
+	_, err = crypto_rand.Read(proxy.proxySecretKey[:])
+	c.Nil(err)
+	curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
+	pk := server.providerSk.Public().(ed25519.PublicKey)
+	for _, answer := range certMsg.Answer {
+		binCert := PackTXTRR(answer.(*dns.TXT).Txt[0])
+		c.Len(binCert, localDNSCryptCertSize)
+		c.True(ed25519.Verify(pk, binCert[72:], binCert[8:72]))
+		serverInfo := ServerInfo{CryptoConstruction: CryptoConstruction(binCert[5])}
+		copy(serverInfo.ServerPk[:], binCert[72:104])
+		copy(serverInfo.MagicQuery[:], binCert[104:112])
+		serverInfo.SharedKey = ComputeSharedKey(serverInfo.CryptoConstruction, &proxy.proxySecretKey, &serverInfo.ServerPk, nil)
+
+		query := dns.Msg{}
+		query.SetQuestion("example.com.", dns.TypeA)
+		packet, err := query.Pack()
+		c.Nil(err)
+		sharedKey, encrypted, clientNonce, err := proxy.Encrypt(&serverInfo, packet, "udp")
+		c.Nil(err)
+		decrypted, session, err := server.decrypt(encrypted)
+		c.Nil(err)
+		c.DeepEqual(decrypted, packet)
+
+		response := dns.Msg{}
+		response.SetReply(&query)
+		packet, err = response.Pack()
+		c.Nil(err)
+		encryptedResponse, err := server.encrypt(packet, session, "udp")
+		c.Nil(err)
+		c.True(len(encryptedResponse) <= len(encrypted))
+		decrypted, err = proxy.Decrypt(&serverInfo, sharedKey, encryptedResponse, clientNonce)
+		c.Nil(err)
+		c.DeepEqual(decrypted, packet)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LogSampler decides whether a log line should be written, keeping 1 out of
+// `rate` lines, and at most `maxPerSecond` lines per second.
+// A nil sampler keeps everything.
+type LogSampler struct {
+	sync.Mutex
+	rate          uint64
+	maxPerSecond  int
+	counter       uint64
+	currentSecond int64
+	currentCount  int
+}
+
+func NewLogSampler(rate int, maxPerSecond int) *LogSampler {
+	if rate <= 1 && maxPerSecond <= 0 {
+		return nil
+	}
+	if rate < 1 {
+		rate = 1
+	}
+	return &LogSampler{rate: uint64(rate), maxPerSecond: maxPerSecond}
+}
+
+func (sampler *LogSampler) Keep() bool {
+	if sampler == nil {
+		return true
+	}
+	if sampler.rate > 1 && (atomic.AddUint64(&sampler.counter, 1)-1)%sampler.rate != 0 {
+		return false
+	}
+	if sampler.maxPerSecond <= 0 {
+		return true
+	}
+	now := time.Now().Unix()
+	sampler.Lock()
+	defer sampler.Unlock()
+	if now != sampler.currentSecond {
+		sampler.currentSecond = now
+		sampler.currentCount = 0
+	}
+	if sampler.currentCount >= sampler.maxPerSecond {
+		return false
+	}
+	sampler.currentCount++
+	return true
+}
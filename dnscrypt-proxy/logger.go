@@ -2,13 +2,24 @@
 
 import (
 	"io"
+	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/jedisct1/dlog"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func Logger(logMaxSize int, logMaxAge int, logMaxBackups int, fileName string) io.Writer {
+func Logger(
+	logMaxSize int,
+	logMaxAge int,
+	logMaxBackups int,
+	logRotation string,
+	logCompression *CompressionCodec,
+	fileName string,
+) io.Writer {
 	if fileName == "/dev/stdout" {
 		return os.Stdout
 	}
@@ -27,14 +38,126 @@ func Logger(logMaxSize int, logMaxAge int, logMaxBackups int, fileName string) i
 	} else {
 		dlog.Errorf("Unable to create [%v]: [%v]", fileName, err)
 	}
+	// lumberjack only compresses rotated files with gzip
+	if logRotation == LogRotationHourly || logRotation == LogRotationDaily ||
+		(logCompression != nil && logCompression.name != CompressionGzip) {
+		return NewTimeRotatingLogger(fileName, logRotation, int64(logMaxSize)*1024*1024, logMaxAge, logMaxBackups, logCompression)
+	}
 	logger := &lumberjack.Logger{
 		LocalTime:  true,
 		MaxSize:    logMaxSize,
 		MaxAge:     logMaxAge,
 		MaxBackups: logMaxBackups,
 		Filename:   fileName,
-		Compress:   true,
+		Compress:   logCompression != nil && logCompression.name == CompressionGzip,
 	}
 
 	return logger
 }
+
+// closeLogger flushes and closes a log file; log files are reopened if something is written to them afterwards
+func closeLogger(writer io.Writer) error {
+	if writer == nil || writer == os.Stdout {
+		return nil
+	}
+	if closer, ok := writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+const listenerPlaceholder = "{listener}"
+
+// ListenerLogger writes to a different file for every listener, if the file name
+// contains the `{listener}` placeholder. Files are opened the first time they are needed.
+type ListenerLogger struct {
+	sync.Mutex
+	proxy    *Proxy
+	fileName string
+	writers  map[string]io.Writer
+}
+
+func NewListenerLogger(proxy *Proxy, fileName string) *ListenerLogger {
+	listenerLogger := &ListenerLogger{proxy: proxy, fileName: fileName, writers: make(map[string]io.Writer)}
+	if !strings.Contains(fileName, listenerPlaceholder) {
+		listenerLogger.writers[""] = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.logRotation, proxy.logCompression, fileName)
+	}
+	return listenerLogger
+}
+
+func (listenerLogger *ListenerLogger) For(listener string) io.Writer {
+	listenerLogger.Lock()
+	defer listenerLogger.Unlock()
+	if writer, ok := listenerLogger.writers[""]; ok {
+		return writer
+	}
+	if writer, ok := listenerLogger.writers[listener]; ok {
+		return writer
+	}
+	safeListener := strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '[', ']', '/', '\\', '%':
+			return '_'
+		}
+		return r
+	}, listener)
+	if len(safeListener) == 0 {
+		safeListener = "unknown"
+	}
+	proxy := listenerLogger.proxy
+	fileName := strings.ReplaceAll(listenerLogger.fileName, listenerPlaceholder, safeListener)
+	writer := Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.logRotation, proxy.logCompression, fileName)
+	listenerLogger.writers[listener] = writer
+	return writer
+}
+
+func (listenerLogger *ListenerLogger) Close() error {
+	listenerLogger.Lock()
+	defer listenerLogger.Unlock()
+	var lastErr error
+	for _, writer := range listenerLogger.writers {
+		if err := closeLogger(writer); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// listenerLabel returns the label of the listener a query was received on, or its address if it doesn't have a label
+func (proxy *Proxy) listenerLabel(localAddr net.Addr) string {
+	if localAddr == nil {
+		return "local_doh"
+	}
+	key, ok := listenerKey(localAddr, func(key string) bool {
+		_, ok := proxy.listenerLabels[key]
+		return ok
+	})
+	if !ok {
+		return localAddr.String()
+	}
+	return proxy.listenerLabels[key]
+}
+
+// listenerKey returns the key of a listener in a set of per-listener settings: its address,
+// or the wildcard address with the same port, for queries received by wildcard listeners
+func listenerKey(localAddr net.Addr, exists func(key string) bool) (string, bool) {
+	addrStr := localAddr.String()
+	if exists(addrStr) {
+		return addrStr, true
+	}
+	var port int
+	switch addr := localAddr.(type) {
+	case *net.UDPAddr:
+		port = addr.Port
+	case *net.TCPAddr:
+		port = addr.Port
+	default:
+		return "", false
+	}
+	for _, wildcard := range []string{"0.0.0.0", "::"} {
+		if key := net.JoinHostPort(wildcard, strconv.Itoa(port)); exists(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	LogRotationSize   = "size"
+	LogRotationHourly = "hourly"
+	LogRotationDaily  = "daily"
+)
+
+// TimeRotatingLogger writes to a file that is rotated at the beginning of every hour or day.
+// Rotated files are renamed with the date of the period they cover (e.g. `query-2021-01-31.log`), and compressed.
+// It also rotates files by size with codecs that lumberjack doesn't support; rotated files are then renamed
+// with the time they were rotated at (e.g. `query-2021-01-31T05-42-17.123.log`).
+type TimeRotatingLogger struct {
+	sync.Mutex
+	fileName    string
+	rotation    string
+	maxSize     int64
+	maxAge      int
+	maxBackups  int
+	compression *CompressionCodec
+	fp          *os.File
+	size        int64
+	periodStart time.Time
+}
+
+func NewTimeRotatingLogger(
+	fileName string,
+	rotation string,
+	maxSize int64,
+	maxAge int,
+	maxBackups int,
+	compression *CompressionCodec,
+) *TimeRotatingLogger {
+	return &TimeRotatingLogger{
+		fileName:    fileName,
+		rotation:    rotation,
+		maxSize:     maxSize,
+		maxAge:      maxAge,
+		maxBackups:  maxBackups,
+		compression: compression,
+	}
+}
+
+func (logger *TimeRotatingLogger) periodOf(ts time.Time) time.Time {
+	if logger.rotation == LogRotationHourly {
+		return time.Date(ts.Year(), ts.Month(), ts.Day(), ts.Hour(), 0, 0, 0, ts.Location())
+	}
+	return time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, ts.Location())
+}
+
+func (logger *TimeRotatingLogger) layout() string {
+	switch logger.rotation {
+	case LogRotationSize:
+		return "2006-01-02T15-04-05.000"
+	case LogRotationHourly:
+		return "2006-01-02T15"
+	}
+	return "2006-01-02"
+}
+
+// mustRotate returns true if the current file has to be rotated before `length` more bytes are written to it
+func (logger *TimeRotatingLogger) mustRotate(now time.Time, length int) bool {
+	if logger.rotation == LogRotationSize {
+		return logger.maxSize > 0 && logger.size > 0 && logger.size+int64(length) > logger.maxSize
+	}
+	return !logger.periodOf(now).Equal(logger.periodStart)
+}
+
+func (logger *TimeRotatingLogger) stampedFileName(periodStart time.Time) string {
+	ext := filepath.Ext(logger.fileName)
+	prefix := strings.TrimSuffix(logger.fileName, ext)
+	return prefix + "-" + periodStart.Format(logger.layout()) + ext
+}
+
+// isRotatedFileName returns true if a file has been rotated by the logger: its name is the name of the log file
+// with the period it covers, an optional sequence number, and the compression extension if it was compressed
+func (logger *TimeRotatingLogger) isRotatedFileName(fileName string) bool {
+	ext := filepath.Ext(logger.fileName)
+	stamped, ok := strings.CutPrefix(fileName, strings.TrimSuffix(logger.fileName, ext)+"-")
+	layout := logger.layout()
+	if !ok || len(stamped) < len(layout) {
+		return false
+	}
+	if _, err := time.Parse(layout, stamped[:len(layout)]); err != nil {
+		return false
+	}
+	suffix, ok := strings.CutPrefix(stamped[len(layout):], ext)
+	if !ok {
+		return false
+	}
+	suffix = strings.TrimSuffix(suffix, logger.compression.Extension())
+	if len(suffix) == 0 {
+		return true
+	}
+	seqStr, ok := strings.CutPrefix(suffix, ".")
+	seq, err := strconv.Atoi(seqStr)
+	return ok && err == nil && seq > 0 && strconv.Itoa(seq) == seqStr
+}
+
+func (logger *TimeRotatingLogger) Write(p []byte) (int, error) {
+	logger.Lock()
+	defer logger.Unlock()
+	now := time.Now()
+	if logger.fp != nil && logger.mustRotate(now, len(p)) {
+		if logger.rotation == LogRotationSize {
+			// Files rotated by size are named after the time they were rotated at
+			logger.periodStart = now
+		}
+		logger.rotate()
+	}
+	if logger.fp == nil {
+		logger.size = 0
+		if st, err := os.Stat(logger.fileName); err == nil && st.Size() > 0 {
+			if logger.rotation == LogRotationSize {
+				logger.size = st.Size()
+			} else if periodStart := logger.periodOf(st.ModTime()); !periodStart.Equal(logger.periodOf(now)) {
+				// A file left over from a previous period is rotated before anything gets appended to it
+				logger.periodStart = periodStart
+				logger.rotateFile()
+			}
+		}
+		fp, err := os.OpenFile(logger.fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return 0, err
+		}
+		logger.fp, logger.periodStart = fp, logger.periodOf(now)
+	}
+	n, err := logger.fp.Write(p)
+	logger.size += int64(n)
+	return n, err
+}
+
+func (logger *TimeRotatingLogger) Close() error {
+	logger.Lock()
+	defer logger.Unlock()
+	if logger.fp == nil {
+		return nil
+	}
+	err := logger.fp.Close()
+	logger.fp = nil
+	return err
+}
+
+func (logger *TimeRotatingLogger) rotate() {
+	logger.fp.Close()
+	logger.fp = nil
+	logger.rotateFile()
+}
+
+func (logger *TimeRotatingLogger) rotateFile() {
+	exists := func(fileName string) bool {
+		_, err := os.Stat(fileName)
+		return err == nil
+	}
+	rotatedFileName := logger.stampedFileName(logger.periodStart)
+	for i := 1; exists(rotatedFileName) || exists(rotatedFileName+logger.compression.Extension()); i++ {
+		rotatedFileName = fmt.Sprintf("%s.%d", logger.stampedFileName(logger.periodStart), i)
+	}
+	if err := os.Rename(logger.fileName, rotatedFileName); err != nil {
+		dlog.Warnf("Unable to rotate [%s]: [%v]", logger.fileName, err)
+		return
+	}
+	go logger.compressAndPrune(rotatedFileName)
+}
+
+func (logger *TimeRotatingLogger) compressAndPrune(rotatedFileName string) {
+	if err := logger.compression.CompressFile(rotatedFileName); err != nil {
+		dlog.Warnf("Unable to compress [%s]: [%v]", rotatedFileName, err)
+	}
+	ext := filepath.Ext(logger.fileName)
+	pattern := strings.TrimSuffix(logger.fileName, ext) + "-*"
+	candidates, err := filepath.Glob(pattern)
+	if err != nil {
+		return
+	}
+	var matches []string
+	for _, candidate := range candidates {
+		if logger.isRotatedFileName(candidate) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(matches)))
+	cutoff := time.Now().Add(-time.Duration(logger.maxAge) * 24 * time.Hour)
+	for i, match := range matches {
+		remove := logger.maxBackups > 0 && i >= logger.maxBackups
+		if !remove && logger.maxAge > 0 {
+			if st, err := os.Stat(match); err == nil && st.ModTime().Before(cutoff) {
+				remove = true
+			}
+		}
+		if remove {
+			if err := os.Remove(match); err != nil {
+				dlog.Warnf("Unable to remove [%s]: [%v]", match, err)
+			}
+		}
+	}
+}
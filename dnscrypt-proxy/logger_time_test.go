@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestIsRotatedFileName(t *testing.T) {
+	c := check.T(t)
+	gzip, _ := CompressionCodecByName(CompressionGzip)
+	logger := NewTimeRotatingLogger("/var/log/query.log", LogRotationDaily, 0, 0, 0, gzip)
+	c.True(logger.isRotatedFileName("/var/log/query-2021-01-31.log"))
+	c.True(logger.isRotatedFileName("/var/log/query-2021-01-31.log.gz"))
+	c.True(logger.isRotatedFileName("/var/log/query-2021-01-31.log.2"))
+	c.True(logger.isRotatedFileName("/var/log/query-2021-01-31.log.2.gz"))
+	c.False(logger.isRotatedFileName("/var/log/query.log"))
+	c.False(logger.isRotatedFileName("/var/log/query-errors.log"))
+	c.False(logger.isRotatedFileName("/var/log/query-2021-01-31-backup.log"))
+	c.False(logger.isRotatedFileName("/var/log/query-2021-13-31.log"))
+	c.False(logger.isRotatedFileName("/var/log/query-2021-01-31.log.old"))
+	c.False(logger.isRotatedFileName("/var/log/query-2021-01-31T05.log"))
+
+	logger = NewTimeRotatingLogger("/var/log/query.log", LogRotationHourly, 0, 0, 0, nil)
+	c.True(logger.isRotatedFileName("/var/log/query-2021-01-31T05.log"))
+	c.True(logger.isRotatedFileName("/var/log/query-2021-01-31T05.log.1"))
+	c.False(logger.isRotatedFileName("/var/log/query-2021-01-31.log"))
+	c.False(logger.isRotatedFileName("/var/log/query-2021-01-31T05.log.gz"))
+}
+
+func TestSizeRotatingLogger(t *testing.T) {
+	c := check.T(t)
+	zstd, _ := CompressionCodecByName(CompressionZstd)
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "query.log")
+	logger := NewTimeRotatingLogger(fileName, LogRotationSize, 100, 0, 0, zstd)
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := 0; i < 3; i++ {
+		_, err := logger.Write(line)
+		c.Must(c.Nil(err))
+	}
+	c.Nil(logger.Close())
+	st, err := os.Stat(fileName)
+	c.Must(c.Nil(err))
+	c.EQ(st.Size(), int64(len(line)))
+	var rotated []string
+	for i := 0; i < 50 && len(rotated) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		rotated, _ = filepath.Glob(filepath.Join(dir, "query-*.zst"))
+	}
+	c.Len(rotated, 2)
+	for _, rotatedFileName := range rotated {
+		c.True(logger.isRotatedFileName(rotatedFileName))
+		bin, err := os.ReadFile(rotatedFileName)
+		c.Must(c.Nil(err))
+		bin, err = Decompress(bin, 1024)
+		c.Nil(err)
+		c.DeepEqual(bin, line)
+	}
+}
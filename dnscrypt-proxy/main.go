@@ -53,11 +53,16 @@ func main() {
 	flags.ListAll = flag.Bool("list-all", false, "print the complete list of available resolvers, ignoring filters")
 	flags.IncludeRelays = flag.Bool("include-relays", false, "include the list of available relays in the output of -list and -list-all")
 	flags.JSONOutput = flag.Bool("json", false, "output list as JSON")
+	flags.Probe = flag.Bool("probe", false, "connect to the servers, and include their observed capabilities in the JSON output of -list and -list-all")
 	flags.Check = flag.Bool("check", false, "check the configuration file and exit")
 	flags.ConfigFile = flag.String("config", DefaultConfigFileName, "Path to the configuration file")
 	flags.Child = flag.Bool("child", false, "Invokes program as a child process")
 	flags.NetprobeTimeoutOverride = flag.Int("netprobe-timeout", 60, "Override the netprobe timeout")
 	flags.ShowCerts = flag.Bool("show-certs", false, "print DoH certificate chain hashes")
+	flags.Bench = flag.String("bench", "", "send queries from a file (one `<name> [<type>]` per line), or \"synthetic\" queries, print performance statistics and exit")
+	flags.BenchTarget = flag.String("bench-target", BenchTargetServers, "send -bench queries to the configured \"servers\", to the first \"listener\", or to a given address")
+	flags.BenchQueries = flag.Int("bench-queries", 1000, "number of queries to send with -bench")
+	flags.BenchConcurrency = flag.Int("bench-concurrency", 16, "number of concurrent queries with -bench")
 
 	flag.Parse()
 
@@ -149,6 +154,9 @@ func (app *App) AppMain() {
 }
 
 func (app *App) Stop(service service.Service) error {
+	if app.proxy != nil {
+		app.proxy.Shutdown()
+	}
 	if err := PidFileRemove(); err != nil {
 		dlog.Warnf("Failed to remove the PID file: [%v]", err)
 	}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// MetricsExporter periodically pushes the query statistics to statsd and/or InfluxDB
+type MetricsExporter struct {
+	interval            time.Duration
+	tags                [][2]string
+	statsdAddress       string
+	statsdPrefix        string
+	influxDBURL         string
+	influxDBToken       string
+	influxDBMeasurement string
+	httpClient          *http.Client
+	previous            QueryStatsCounters
+}
+
+func NewMetricsExporter(config *MetricsExportConfig) (*MetricsExporter, error) {
+	if len(config.StatsdAddress) == 0 && len(config.InfluxDBURL) == 0 {
+		return nil, nil
+	}
+	if config.Interval <= 0 {
+		return nil, errors.New("Metrics export interval must be at least 1 second")
+	}
+	exporter := &MetricsExporter{
+		interval:            time.Duration(config.Interval) * time.Second,
+		statsdAddress:       config.StatsdAddress,
+		statsdPrefix:        config.StatsdPrefix,
+		influxDBURL:         config.InfluxDBURL,
+		influxDBToken:       config.InfluxDBToken,
+		influxDBMeasurement: config.InfluxDBMeasurement,
+		httpClient:          &http.Client{Timeout: 10 * time.Second},
+	}
+	if len(exporter.statsdPrefix) > 0 && !strings.HasSuffix(exporter.statsdPrefix, ".") {
+		exporter.statsdPrefix += "."
+	}
+	for key, value := range config.Tags {
+		exporter.tags = append(exporter.tags, [2]string{key, value})
+	}
+	sort.Slice(exporter.tags, func(i, j int) bool { return exporter.tags[i][0] < exporter.tags[j][0] })
+	return exporter, nil
+}
+
+func (exporter *MetricsExporter) Start(stats *QueryStats) {
+	if exporter == nil {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(exporter.interval)
+			exporter.flush(stats.Counters(), time.Now())
+		}
+	}()
+}
+
+func (exporter *MetricsExporter) flush(counters QueryStatsCounters, now time.Time) {
+	if len(exporter.statsdAddress) > 0 {
+		if err := exporter.sendStatsd(counters); err != nil {
+			dlog.Warnf("Unable to send metrics to statsd [%s]: [%v]", exporter.statsdAddress, err)
+		}
+	}
+	if len(exporter.influxDBURL) > 0 {
+		if err := exporter.sendInfluxDB(counters, now); err != nil {
+			dlog.Warnf("Unable to send metrics to InfluxDB: [%v]", err)
+		}
+	}
+	exporter.previous = counters
+}
+
+func averageDurationMs(counters QueryStatsCounters) float64 {
+	if counters.AnsweredCount == 0 {
+		return 0.0
+	}
+	return float64(counters.TotalDuration/time.Microsecond) / float64(counters.AnsweredCount) / 1000.0
+}
+
+// statsd counters are sent as deltas since the previous flush, with DogStatsD-style tags
+func (exporter *MetricsExporter) sendStatsd(counters QueryStatsCounters) error {
+	tags := make([]string, 0, len(exporter.tags))
+	for _, tag := range exporter.tags {
+		tags = append(tags, tag[0]+":"+tag[1])
+	}
+	suffix := ""
+	if len(tags) > 0 {
+		suffix = "|#" + strings.Join(tags, ",")
+	}
+	var lines []string
+	counter := func(name string, value uint64, extraTag string) {
+		line := fmt.Sprintf("%s%s:%d|c", exporter.statsdPrefix, name, value)
+		switch {
+		case len(extraTag) > 0 && len(suffix) > 0:
+			line += suffix + "," + extraTag
+		case len(extraTag) > 0:
+			line += "|#" + extraTag
+		default:
+			line += suffix
+		}
+		lines = append(lines, line)
+	}
+	previous := exporter.previous
+	counter("queries", counters.Queries-previous.Queries, "")
+	counter("cache_hits", counters.CacheHits-previous.CacheHits, "")
+	counter("blocked", counters.Blocked-previous.Blocked, "")
+	for returnCode, count := range counters.ReturnCodes {
+		counter("return_codes", count-previous.ReturnCodes[returnCode], "return_code:"+returnCode)
+	}
+	lines = append(lines, fmt.Sprintf("%savg_duration_ms:%.3f|g%s", exporter.statsdPrefix, averageDurationMs(counters), suffix))
+
+	conn, err := net.Dial("udp", exporter.statsdAddress)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Keep datagrams small enough to avoid fragmentation
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > 1400 {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	_, err = conn.Write(packet.Bytes())
+	return err
+}
+
+func influxDBEscape(s string) string {
+	return strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ").Replace(s)
+}
+
+// InfluxDB points contain the cumulative counters, using the line protocol
+func (exporter *MetricsExporter) sendInfluxDB(counters QueryStatsCounters, now time.Time) error {
+	var tagSet strings.Builder
+	for _, tag := range exporter.tags {
+		tagSet.WriteString("," + influxDBEscape(tag[0]) + "=" + influxDBEscape(tag[1]))
+	}
+	measurement := influxDBEscape(exporter.influxDBMeasurement)
+	ts := now.UnixNano()
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s%s queries=%di,cache_hits=%di,blocked=%di,avg_duration_ms=%.3f %d\n",
+		measurement, tagSet.String(), counters.Queries, counters.CacheHits, counters.Blocked, averageDurationMs(counters), ts)
+	for returnCode, count := range counters.ReturnCodes {
+		fmt.Fprintf(&body, "%s_return_codes%s,return_code=%s count=%di %d\n",
+			measurement, tagSet.String(), influxDBEscape(returnCode), count, ts)
+	}
+	req, err := http.NewRequest("POST", exporter.influxDBURL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(exporter.influxDBToken) > 0 {
+		req.Header.Set("Authorization", "Token "+exporter.influxDBToken)
+	}
+	resp, err := exporter.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
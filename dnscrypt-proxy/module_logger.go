@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/jedisct1/dlog"
+)
+
+const moduleLogLevelInherit = -1
+
+// ModuleLogger filters log messages of a subsystem according to its own log level.
+// Messages that are more verbose than the global log level are still written, using
+// the global level, and are tagged with the module name and their actual severity.
+type ModuleLogger struct {
+	name  string
+	level int32
+}
+
+var (
+	sourcesLog = &ModuleLogger{name: "sources", level: moduleLogLevelInherit}
+	cryptoLog  = &ModuleLogger{name: "crypto", level: moduleLogLevelInherit}
+	cacheLog   = &ModuleLogger{name: "cache", level: moduleLogLevelInherit}
+	pluginsLog = &ModuleLogger{name: "plugins", level: moduleLogLevelInherit}
+	serversLog = &ModuleLogger{name: "servers", level: moduleLogLevelInherit}
+)
+
+var moduleLoggers = []*ModuleLogger{sourcesLog, cryptoLog, cacheLog, pluginsLog, serversLog}
+
+func ParseLogSeverity(name string) (dlog.Severity, error) {
+	name = strings.ToUpper(name)
+	if name == "WARN" {
+		name = "WARNING"
+	}
+	for severity, severityName := range dlog.SeverityName {
+		if severityName == name {
+			return dlog.Severity(severity), nil
+		}
+	}
+	return dlog.SeverityLast, fmt.Errorf("Unsupported log level: [%s]", name)
+}
+
+func SetModuleLogLevels(levels map[string]string) error {
+	for _, logger := range moduleLoggers {
+		atomic.StoreInt32(&logger.level, moduleLogLevelInherit)
+	}
+	for name, levelName := range levels {
+		var found *ModuleLogger
+		for _, logger := range moduleLoggers {
+			if logger.name == name {
+				found = logger
+				break
+			}
+		}
+		if found == nil {
+			return fmt.Errorf("Unknown module in log_levels: [%s]", name)
+		}
+		severity, err := ParseLogSeverity(levelName)
+		if err != nil {
+			return err
+		}
+		atomic.StoreInt32(&found.level, int32(severity))
+	}
+	return nil
+}
+
+func (logger *ModuleLogger) logf(severity dlog.Severity, format string, args ...interface{}) {
+	globalLevel := dlog.LogLevel()
+	level := dlog.Severity(atomic.LoadInt32(&logger.level))
+	if level == moduleLogLevelInherit {
+		level = globalLevel
+	}
+	if severity < level {
+		return
+	}
+	if severity < globalLevel {
+		format = "[" + logger.name + "/" + dlog.SeverityName[severity] + "] " + format
+		severity = globalLevel
+	}
+	switch severity {
+	case dlog.SeverityDebug:
+		dlog.Debugf(format, args...)
+	case dlog.SeverityInfo:
+		dlog.Infof(format, args...)
+	case dlog.SeverityNotice:
+		dlog.Noticef(format, args...)
+	case dlog.SeverityWarning:
+		dlog.Warnf(format, args...)
+	case dlog.SeverityError:
+		dlog.Errorf(format, args...)
+	default:
+		dlog.Criticalf(format, args...)
+	}
+}
+
+func (logger *ModuleLogger) Debugf(format string, args ...interface{}) {
+	logger.logf(dlog.SeverityDebug, format, args...)
+}
+
+func (logger *ModuleLogger) Infof(format string, args ...interface{}) {
+	logger.logf(dlog.SeverityInfo, format, args...)
+}
+
+func (logger *ModuleLogger) Noticef(format string, args ...interface{}) {
+	logger.logf(dlog.SeverityNotice, format, args...)
+}
+
+func (logger *ModuleLogger) Warnf(format string, args ...interface{}) {
+	logger.logf(dlog.SeverityWarning, format, args...)
+}
+
+func (logger *ModuleLogger) Errorf(format string, args ...interface{}) {
+	logger.logf(dlog.SeverityError, format, args...)
+}
+
+func (logger *ModuleLogger) Debug(message interface{}) {
+	logger.logf(dlog.SeverityDebug, "%v", message)
+}
+
+func (logger *ModuleLogger) Info(message interface{}) {
+	logger.logf(dlog.SeverityInfo, "%v", message)
+}
+
+func (logger *ModuleLogger) Notice(message interface{}) {
+	logger.logf(dlog.SeverityNotice, "%v", message)
+}
+
+func (logger *ModuleLogger) Warn(message interface{}) {
+	logger.logf(dlog.SeverityWarning, "%v", message)
+}
+
+func (logger *ModuleLogger) Error(message interface{}) {
+	logger.logf(dlog.SeverityError, "%v", message)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/jedisct1/dlog"
+)
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// MonitoringServer is a local HTTP server exposing internal state.
+// Components register their routes before the server is started.
+type MonitoringServer struct {
+	listenAddress string
+	apiToken      string
+	mux           *http.ServeMux
+}
+
+func NewMonitoringServer(listenAddress string, apiToken string) *MonitoringServer {
+	return &MonitoringServer{
+		listenAddress: listenAddress,
+		apiToken:      apiToken,
+		mux:           http.NewServeMux(),
+	}
+}
+
+func (monitoring *MonitoringServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	if monitoring == nil {
+		return
+	}
+	monitoring.mux.HandleFunc(pattern, func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Server", "dnscrypt-proxy")
+		writer.Header().Set("Cache-Control", "no-store")
+		handler(writer, request)
+	})
+}
+
+// HandleMutatingFunc registers a route whose requests, other than GET requests, change the state of the proxy.
+// These requests must include the API token, and are rejected if they are sent from another origin.
+func (monitoring *MonitoringServer) HandleMutatingFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	monitoring.HandleFunc(pattern, func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" && request.Method != "HEAD" {
+			if status := monitoring.authorize(request); status != 200 {
+				writer.WriteHeader(status)
+				return
+			}
+		}
+		handler(writer, request)
+	})
+}
+
+// authorize returns the HTTP status code a request that changes the state of the proxy is rejected with, or 200
+func (monitoring *MonitoringServer) authorize(request *http.Request) int {
+	if site := request.Header.Get("Sec-Fetch-Site"); len(site) > 0 && site != "same-origin" && site != "none" {
+		return 403
+	}
+	if origin := request.Header.Get("Origin"); len(origin) > 0 {
+		if originURL, err := url.Parse(origin); err != nil || originURL.Host != request.Host {
+			return 403
+		}
+	}
+	if len(monitoring.apiToken) == 0 {
+		return 403
+	}
+	expected := "Bearer " + monitoring.apiToken
+	if subtle.ConstantTimeCompare([]byte(request.Header.Get("Authorization")), []byte(expected)) != 1 {
+		return 401
+	}
+	return 200
+}
+
+// EnableDashboard serves a web page showing the statistics and the state of the servers
+func (monitoring *MonitoringServer) EnableDashboard() {
+	monitoring.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != "/" {
+			http.NotFound(writer, request)
+			return
+		}
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		writer.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		writer.WriteHeader(200)
+		writer.Write(dashboardHTML)
+	})
+}
+
+func (monitoring *MonitoringServer) Start() error {
+	if monitoring == nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", monitoring.listenAddress)
+	if err != nil {
+		return err
+	}
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); ok && !tcpAddr.IP.IsLoopback() {
+		dlog.Warnf("The monitoring server is listening to a non-loopback address [%v] - It doesn't require any authentication", tcpAddr)
+	}
+	dlog.Noticef("Now listening to http://%v [monitoring]", listener.Addr())
+	httpServer := &http.Server{Handler: monitoring.mux}
+	go func() {
+		if err := httpServer.Serve(listener); err != nil {
+			dlog.Errorf("Monitoring server: [%v]", err)
+		}
+	}()
+	return nil
+}
+
+func writeJSONResponse(writer http.ResponseWriter, body []byte, err error) {
+	if err != nil {
+		writer.WriteHeader(500)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(200)
+	writer.Write(body)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestMonitoringMutatingRequests(t *testing.T) {
+	c := check.T(t)
+	request := func(monitoring *MonitoringServer, method string, headers map[string]string) int {
+		req := httptest.NewRequest(method, "http://127.0.0.1:8053/api/capture", nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		recorder := httptest.NewRecorder()
+		monitoring.mux.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	handler := func(writer http.ResponseWriter, request *http.Request) { writer.WriteHeader(200) }
+
+	monitoring := NewMonitoringServer("127.0.0.1:8053", "")
+	monitoring.HandleMutatingFunc("/api/capture", handler)
+	c.Equal(request(monitoring, "GET", nil), 200)
+	c.Equal(request(monitoring, "POST", nil), 403)
+
+	monitoring = NewMonitoringServer("127.0.0.1:8053", "secret")
+	monitoring.HandleMutatingFunc("/api/capture", handler)
+	auth := "Bearer secret"
+	c.Equal(request(monitoring, "GET", nil), 200)
+	c.Equal(request(monitoring, "POST", nil), 401)
+	c.Equal(request(monitoring, "DELETE", map[string]string{"Authorization": "Bearer wrong"}), 401)
+	c.Equal(request(monitoring, "POST", map[string]string{"Authorization": auth}), 200)
+	c.Equal(request(monitoring, "POST", map[string]string{"Authorization": auth, "Origin": "http://127.0.0.1:8053"}), 200)
+	c.Equal(request(monitoring, "POST", map[string]string{"Authorization": auth, "Origin": "http://evil.example"}), 403)
+	c.Equal(request(monitoring, "POST", map[string]string{"Authorization": auth, "Sec-Fetch-Site": "same-origin"}), 200)
+	c.Equal(request(monitoring, "POST", map[string]string{"Authorization": auth, "Sec-Fetch-Site": "cross-site"}), 403)
+}
@@ -32,7 +32,7 @@ func NetProbe(proxy *Proxy, address string, timeout int) error {
 		timeout = Min(MaxTimeout, timeout)
 	}
 	for tries := timeout; tries > 0; tries-- {
-		pc, err := net.DialUDP("udp", nil, remoteUDPAddr)
+		pc, err := outboundDialer(0).Dial("udp", remoteUDPAddr.String())
 		if err != nil {
 			if !retried {
 				retried = true
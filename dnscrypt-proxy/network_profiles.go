@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	clocksmith "github.com/jedisct1/go-clocksmith"
+)
+
+// NetworkProfile is a set of servers used on some networks. All the conditions that are set have to match
+// for the profile to be selected; a profile without conditions can only be selected by the trigger file.
+type NetworkProfile struct {
+	name        string
+	serverNames []string
+	interfaces  []string
+	gatewayMACs []string
+	networks    []*net.IPNet
+}
+
+// networkState is what is known about the networks the host is connected to
+type networkState struct {
+	interfaces []string
+	addrs      []net.IP
+	gatewayMAC string
+}
+
+func currentNetworkState() networkState {
+	state := networkState{gatewayMAC: defaultGatewayMAC()}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return state
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		state.interfaces = append(state.interfaces, iface.Name)
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				state.addrs = append(state.addrs, ipNet.IP)
+			}
+		}
+	}
+	return state
+}
+
+// defaultGatewayMAC returns the hardware address of the IPv4 default gateway, or an empty string if it is unknown.
+// Only Linux is supported.
+func defaultGatewayMAC() string {
+	routes, err := os.ReadFile("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	var gateway net.IP
+	for _, line := range strings.Split(string(routes), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 3 || parts[1] != "00000000" {
+			continue
+		}
+		// Addresses are in host byte order, which is little-endian on all the platforms this matters for
+		if raw, err := hex.DecodeString(parts[2]); err == nil && len(raw) == 4 {
+			gateway = make(net.IP, 4)
+			binary.BigEndian.PutUint32(gateway, binary.LittleEndian.Uint32(raw))
+			break
+		}
+	}
+	if gateway == nil {
+		return ""
+	}
+	arp, err := os.ReadFile("/proc/net/arp")
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(arp), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 4 || !gateway.Equal(net.ParseIP(parts[0])) {
+			continue
+		}
+		if mac, err := net.ParseMAC(parts[3]); err == nil {
+			return mac.String()
+		}
+	}
+	return ""
+}
+
+func (profile *NetworkProfile) matches(state *networkState) bool {
+	if len(profile.interfaces)+len(profile.gatewayMACs)+len(profile.networks) == 0 {
+		return false
+	}
+	if len(profile.interfaces) > 0 && !slices.ContainsFunc(state.interfaces, func(iface string) bool {
+		return slices.ContainsFunc(profile.interfaces, func(pattern string) bool {
+			matched, _ := path.Match(pattern, iface)
+			return matched
+		})
+	}) {
+		return false
+	}
+	if len(profile.gatewayMACs) > 0 && !slices.Contains(profile.gatewayMACs, state.gatewayMAC) {
+		return false
+	}
+	if len(profile.networks) > 0 && !slices.ContainsFunc(state.addrs, func(ip net.IP) bool {
+		return slices.ContainsFunc(profile.networks, func(network *net.IPNet) bool {
+			return network.Contains(ip)
+		})
+	}) {
+		return false
+	}
+	return true
+}
+
+// NetworkProfiles selects the set of servers to use according to the network the host is connected to.
+// Servers that are listed in profiles, but not in `server_names`, are only used while one of their profiles
+// is active. When no profiles match, the other servers are used.
+type NetworkProfiles struct {
+	sync.Mutex
+	profiles    []*NetworkProfile
+	serverNames map[string]bool
+	profileOnly map[string]bool
+	triggerFile string
+	active      *NetworkProfile
+}
+
+// NewNetworkProfiles returns the profiles of the configuration, or nil if there are none
+func NewNetworkProfiles(configs map[string]NetProfileConfig, serverNames []string, triggerFile string) (*NetworkProfiles, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	networkProfiles := NetworkProfiles{
+		serverNames: make(map[string]bool),
+		profileOnly: make(map[string]bool),
+		triggerFile: triggerFile,
+	}
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		config := configs[name]
+		if len(config.ServerNames) == 0 {
+			return nil, fmt.Errorf("No servers in network profile [%s]", name)
+		}
+		profile := NetworkProfile{name: name, serverNames: config.ServerNames, interfaces: config.Interfaces}
+		for _, macStr := range config.GatewayMACs {
+			mac, err := net.ParseMAC(macStr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid gateway MAC address [%s] in network profile [%s]", macStr, name)
+			}
+			profile.gatewayMACs = append(profile.gatewayMACs, mac.String())
+		}
+		for _, networkStr := range config.Networks {
+			_, network, err := net.ParseCIDR(networkStr)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid network [%s] in network profile [%s]", networkStr, name)
+			}
+			profile.networks = append(profile.networks, network)
+		}
+		for _, serverName := range config.ServerNames {
+			networkProfiles.serverNames[serverName] = true
+			if !includesName(serverNames, serverName) {
+				networkProfiles.profileOnly[serverName] = true
+			}
+		}
+		networkProfiles.profiles = append(networkProfiles.profiles, &profile)
+	}
+	return &networkProfiles, nil
+}
+
+// hasServer returns true if a server is part of a profile
+func (networkProfiles *NetworkProfiles) hasServer(name string) bool {
+	return networkProfiles != nil && networkProfiles.serverNames[name]
+}
+
+// triggeredProfile returns the name of the profile written to the trigger file, or an empty string
+func (networkProfiles *NetworkProfiles) triggeredProfile() string {
+	if len(networkProfiles.triggerFile) == 0 {
+		return ""
+	}
+	content, err := os.ReadFile(networkProfiles.triggerFile)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// selectProfile returns the profile to use: the one named in the trigger file if there is one, or else the
+// first profile, in alphabetical order, matching the current network. `nil` means that no profiles apply.
+func (networkProfiles *NetworkProfiles) selectProfile(triggered string, state *networkState) *NetworkProfile {
+	if len(triggered) > 0 {
+		for _, profile := range networkProfiles.profiles {
+			if profile.name == triggered {
+				return profile
+			}
+		}
+		if triggered != "default" {
+			serversLog.Warnf("Unknown network profile [%s] in [%s]", triggered, networkProfiles.triggerFile)
+		}
+		return nil
+	}
+	for _, profile := range networkProfiles.profiles {
+		if profile.matches(state) {
+			return profile
+		}
+	}
+	return nil
+}
+
+// update selects the profile for the current network, and returns true if it changed
+func (networkProfiles *NetworkProfiles) update(serversInfo *ServersInfo) bool {
+	state := currentNetworkState()
+	profile := networkProfiles.selectProfile(networkProfiles.triggeredProfile(), &state)
+	networkProfiles.Lock()
+	changed := profile != networkProfiles.active
+	networkProfiles.active = profile
+	networkProfiles.Unlock()
+	if !changed {
+		return false
+	}
+	if profile == nil {
+		serversLog.Notice("No network profiles match the current network - using the default servers")
+	} else {
+		serversLog.Noticef("Switching to network profile [%s] - using servers %v", profile.name, profile.serverNames)
+	}
+	networkProfiles.apply(serversInfo)
+	return true
+}
+
+// apply restricts the servers used for queries to the servers of the active profile
+func (networkProfiles *NetworkProfiles) apply(serversInfo *ServersInfo) {
+	networkProfiles.Lock()
+	var profileServers map[string]bool
+	if networkProfiles.active != nil {
+		profileServers = make(map[string]bool)
+		for _, serverName := range networkProfiles.active.serverNames {
+			profileServers[serverName] = true
+		}
+	}
+	networkProfiles.Unlock()
+	serversInfo.Lock()
+	serversInfo.profileServers = profileServers
+	serversInfo.profileOnly = networkProfiles.profileOnly
+	serversInfo.Unlock()
+}
+
+// run checks the network periodically, and switches profiles when it changes
+func (networkProfiles *NetworkProfiles) run(proxy *Proxy) {
+	for {
+		clocksmith.Sleep(NetworkChangeCheckInterval)
+		networkProfiles.update(&proxy.serversInfo)
+	}
+}
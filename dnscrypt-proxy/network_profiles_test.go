@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/VividCortex/ewma"
+	"github.com/powerman/check"
+)
+
+func TestNetworkProfiles(t *testing.T) {
+	c := check.T(t)
+	profiles, err := NewNetworkProfiles(nil, nil, "")
+	c.Nil(err)
+	c.Nil(profiles)
+	c.False(profiles.hasServer("corp-doh"))
+
+	triggerFile := filepath.Join(t.TempDir(), "network_profile")
+	profiles, err = NewNetworkProfiles(map[string]NetProfileConfig{
+		"vpn":  {ServerNames: []string{"corp-doh"}, Interfaces: []string{"tun*"}},
+		"work": {ServerNames: []string{"corp-doh", "public"}, GatewayMACs: []string{"00-11-22-33-44-55"}, Networks: []string{"10.1.0.0/16"}},
+	}, []string{"public"}, triggerFile)
+	c.Nil(err)
+	c.True(profiles.hasServer("corp-doh"))
+	c.DeepEqual(profiles.profileOnly, map[string]bool{"corp-doh": true})
+
+	c.Nil(profiles.selectProfile("", &networkState{interfaces: []string{"eth0"}}))
+	c.EQ(profiles.selectProfile("", &networkState{interfaces: []string{"eth0", "tun0"}}).name, "vpn")
+	c.Nil(profiles.selectProfile("", &networkState{addrs: []net.IP{net.ParseIP("10.1.2.3")}}))
+	c.EQ(profiles.selectProfile("", &networkState{
+		addrs:      []net.IP{net.ParseIP("10.1.2.3")},
+		gatewayMAC: "00:11:22:33:44:55",
+	}).name, "work")
+	c.EQ(profiles.selectProfile("work", &networkState{}).name, "work")
+	c.Nil(profiles.selectProfile("default", &networkState{interfaces: []string{"tun0"}}))
+
+	c.Must(c.Nil(os.WriteFile(triggerFile, []byte("work\n"), 0o600)))
+	c.EQ(profiles.triggeredProfile(), "work")
+
+	_, err = NewNetworkProfiles(map[string]NetProfileConfig{"work": {}}, nil, "")
+	c.NotNil(err)
+	_, err = NewNetworkProfiles(map[string]NetProfileConfig{"work": {ServerNames: []string{"corp-doh"}, Networks: []string{"10.1.0.0"}}}, nil, "")
+	c.NotNil(err)
+}
+
+func TestServersInfoNetworkProfile(t *testing.T) {
+	c := check.T(t)
+	serversInfo := NewServersInfo()
+	serversInfo.lbStrategy = LBStrategyFirst{}
+	serversInfo.lbEstimator = false
+	serversInfo.inner = []*ServerInfo{
+		{Name: "corp-doh", rtt: ewma.NewMovingAverage(RTTEwmaDecay)},
+		{Name: "public", rtt: ewma.NewMovingAverage(RTTEwmaDecay)},
+	}
+	serversInfo.profileOnly = map[string]bool{"corp-doh": true}
+	c.EQ(serversInfo.getOne().Name, "public")
+	serversInfo.profileServers = map[string]bool{"corp-doh": true}
+	c.EQ(serversInfo.getOne().Name, "corp-doh")
+	c.EQ(serversInfo.getSticky("key").Name, "corp-doh")
+}
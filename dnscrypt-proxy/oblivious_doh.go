@@ -5,7 +5,6 @@
 	"encoding/binary"
 	"fmt"
 
-	"github.com/jedisct1/dlog"
 	hpkecompact "github.com/jedisct1/go-hpke-compact"
 )
 
@@ -81,7 +80,7 @@ func parseODoHTargetConfigs(configs []byte) ([]ODoHTargetConfig, error) {
 		configLength := binary.BigEndian.Uint16(configs[offset+2 : offset+4])
 		if configVersion == odohVersion || configVersion == odohTestVersion {
 			if configVersion != odohVersion {
-				dlog.Debugf("Server still uses the legacy 0x%x ODoH version", configVersion)
+				cryptoLog.Debugf("Server still uses the legacy 0x%x ODoH version", configVersion)
 			}
 			target, err := parseODoHTargetConfig(configs[offset+4 : offset+4+int(configLength)])
 			if err == nil {
@@ -178,10 +177,16 @@ func (q ODoHQuery) decryptResponse(response []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	if len(responsePlaintext) < 4 {
+		return nil, fmt.Errorf("Malformed response")
+	}
 	responseLength := binary.BigEndian.Uint16(responsePlaintext[0:2])
+	if 4+int(responseLength) > len(responsePlaintext) {
+		return nil, fmt.Errorf("Malformed response")
+	}
 	valid := 1
 	for i := 4 + int(responseLength); i < len(responsePlaintext); i++ {
-		valid &= subtle.ConstantTimeByteEq(response[i], 0x00)
+		valid &= subtle.ConstantTimeByteEq(responsePlaintext[i], 0x00)
 	}
 	if valid != 1 {
 		return nil, fmt.Errorf("Malformed response")
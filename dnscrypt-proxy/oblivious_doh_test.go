@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	hpkecompact "github.com/jedisct1/go-hpke-compact"
+	"github.com/powerman/check"
+)
+
+// testODoHTarget is the server side of ODoH (RFC 9230), used to check that queries and responses round-trip
+type testODoHTarget struct {
+	suite   *hpkecompact.Suite
+	keyPair hpkecompact.KeyPair
+}
+
+func newTestODoHTarget(c *check.C) *testODoHTarget {
+	suite, err := hpkecompact.NewSuite(hpkecompact.KemX25519HkdfSha256, hpkecompact.KdfHkdfSha256, hpkecompact.AeadAes128Gcm)
+	c.Nil(err)
+	keyPair, err := suite.GenerateKeyPair()
+	c.Nil(err)
+	return &testODoHTarget{suite: suite, keyPair: keyPair}
+}
+
+func (target *testODoHTarget) configs(version uint16) []byte {
+	config := binary.BigEndian.AppendUint16(nil, uint16(hpkecompact.KemX25519HkdfSha256))
+	config = binary.BigEndian.AppendUint16(config, uint16(hpkecompact.KdfHkdfSha256))
+	config = binary.BigEndian.AppendUint16(config, uint16(hpkecompact.AeadAes128Gcm))
+	config = append(config, encodeLengthValue(target.keyPair.PublicKey)...)
+	versioned := binary.BigEndian.AppendUint16(nil, version)
+	versioned = append(versioned, encodeLengthValue(config)...)
+	return encodeLengthValue(versioned)
+}
+
+// respond decrypts an ODoH query, and returns the encrypted response, with `padding` zero bytes
+func (target *testODoHTarget) respond(c *check.C, message []byte, response []byte, padding int) []byte {
+	c.Equal(message[0], uint8(0x01))
+	keyIDLength := int(binary.BigEndian.Uint16(message[1:3]))
+	aad := message[0 : 3+keyIDLength]
+	encrypted := message[5+keyIDLength:]
+	// The encapsulated key is copied, as the HPKE library appends to it
+	enc := append([]byte{}, encrypted[:32]...)
+	serverCtx, err := target.suite.NewServerContext(enc, target.keyPair, []byte("odoh query"), nil)
+	c.Nil(err)
+	queryPlaintext, err := serverCtx.DecryptFromClient(encrypted[32:], aad)
+	c.Nil(err)
+
+	secret, err := serverCtx.Export([]byte("odoh response"), target.suite.KeyBytes)
+	c.Nil(err)
+	responseNonceEnc := encodeLengthValue(make([]byte, target.suite.KeyBytes))
+	prk := target.suite.Extract(secret, append(append([]byte{}, queryPlaintext...), responseNonceEnc...))
+	key, err := target.suite.Expand(prk, []byte("odoh key"), target.suite.KeyBytes)
+	c.Nil(err)
+	nonce, err := target.suite.Expand(prk, []byte("odoh nonce"), target.suite.NonceBytes)
+	c.Nil(err)
+	cipher, err := target.suite.NewRawCipher(key)
+	c.Nil(err)
+	responsePlaintext := append(encodeLengthValue(response), encodeLengthValue(make([]byte, padding))...)
+	responseAad := append([]byte{0x02}, responseNonceEnc...)
+	ct := cipher.Seal(nil, nonce, responsePlaintext, responseAad)
+	return append(append([]byte{}, responseAad...), encodeLengthValue(ct)...)
+}
+
+func TestODoHTargetConfigs(t *testing.T) {
+	c := check.T(t)
+	target := newTestODoHTarget(c)
+	for _, version := range []uint16{odohVersion, odohTestVersion} {
+		configs, err := parseODoHTargetConfigs(target.configs(version))
+		c.Nil(err)
+		c.Len(configs, 1)
+		c.DeepEqual(configs[0].publicKey, target.keyPair.PublicKey)
+	}
+	configs, err := parseODoHTargetConfigs(target.configs(0x1234))
+	c.Nil(err)
+	c.Len(configs, 0)
+	_, err = parseODoHTargetConfigs([]byte{0, 0})
+	c.NotNil(err)
+}
+
+func TestODoHExchange(t *testing.T) {
+	c := check.T(t)
+	target := newTestODoHTarget(c)
+	configs, err := parseODoHTargetConfigs(target.configs(odohVersion))
+	c.Nil(err)
+	query, response := []byte("odoh test query"), []byte("odoh test response")
+	for _, padding := range []int{0, 64} {
+		odohQuery, err := configs[0].encryptQuery(query)
+		c.Nil(err)
+		encryptedResponse := target.respond(c, odohQuery.odohMessage, response, padding)
+		decrypted, err := odohQuery.decryptResponse(encryptedResponse)
+		c.Nil(err, padding)
+		c.DeepEqual(decrypted, response, padding)
+
+		encryptedResponse[len(encryptedResponse)-1] ^= 1
+		_, err = odohQuery.decryptResponse(encryptedResponse)
+		c.NotNil(err)
+	}
+}
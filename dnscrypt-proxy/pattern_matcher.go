@@ -23,19 +23,27 @@
 
 type PatternMatcher struct {
 	blockedPrefixes   *critbitgo.Trie
-	blockedSuffixes   *critbitgo.Trie
+	blockedSuffixes   suffixMatcher
 	blockedSubstrings []string
 	blockedPatterns   []string
 	blockedExact      map[string]interface{}
 	indirectVals      map[string]interface{}
+	// Exact and suffix rules, checked first so that names that can't match them skip the lookups
+	prefilter *BloomFilter
 }
 
 func NewPatternMatcher() *PatternMatcher {
+	return NewPatternMatcherWithBackend(PatternMatcherBackendCritbit)
+}
+
+// NewPatternMatcherWithBackend returns a PatternMatcher storing the suffix rules with the given backend
+func NewPatternMatcherWithBackend(backend string) *PatternMatcher {
 	patternMatcher := PatternMatcher{
 		blockedPrefixes: critbitgo.NewTrie(),
-		blockedSuffixes: critbitgo.NewTrie(),
+		blockedSuffixes: newSuffixMatcher(backend),
 		blockedExact:    make(map[string]interface{}),
 		indirectVals:    make(map[string]interface{}),
+		prefilter:       NewBloomFilter(0),
 	}
 	return &patternMatcher
 }
@@ -106,38 +114,38 @@ func (patternMatcher *PatternMatcher) Add(pattern string, val interface{}, posit
 	case PatternTypePrefix:
 		patternMatcher.blockedPrefixes.Insert([]byte(pattern), val)
 	case PatternTypeSuffix:
-		patternMatcher.blockedSuffixes.Insert([]byte(StringReverse(pattern)), val)
+		patternMatcher.blockedSuffixes.Insert(pattern, val)
+		patternMatcher.addToPrefilter(pattern)
 	case PatternTypeExact:
 		patternMatcher.blockedExact[pattern] = val
+		patternMatcher.addToPrefilter(pattern)
 	default:
 		dlog.Fatal("Unexpected block type")
 	}
 	return nil
 }
 
+// addToPrefilter adds a rule to the prefilter, after resizing it if it is full
+func (patternMatcher *PatternMatcher) addToPrefilter(pattern string) {
+	if patternMatcher.prefilter.Full() {
+		prefilter := NewBloomFilter(patternMatcher.prefilter.capacity * 2)
+		for exact := range patternMatcher.blockedExact {
+			prefilter.Add(exact)
+		}
+		patternMatcher.blockedSuffixes.Walk(prefilter.Add)
+		patternMatcher.prefilter = prefilter
+	}
+	patternMatcher.prefilter.Add(pattern)
+}
+
 func (patternMatcher *PatternMatcher) Eval(qName string) (reject bool, reason string, val interface{}) {
 	if len(qName) < 2 {
 		return false, "", nil
 	}
 
-	if xval := patternMatcher.blockedExact[qName]; xval != nil {
-		return true, qName, xval
-	}
-
-	revQname := StringReverse(qName)
-	if match, xval, found := patternMatcher.blockedSuffixes.LongestPrefix([]byte(revQname)); found {
-		if len(match) == len(revQname) || revQname[len(match)] == '.' {
-			return true, "*." + StringReverse(string(match)), xval
-		}
-		if len(match) < len(revQname) && len(revQname) > 0 {
-			if i := strings.LastIndex(revQname, "."); i > 0 {
-				pName := revQname[:i]
-				if match, _, found := patternMatcher.blockedSuffixes.LongestPrefix([]byte(pName)); found {
-					if len(match) == len(pName) || pName[len(match)] == '.' {
-						return true, "*." + StringReverse(string(match)), xval
-					}
-				}
-			}
+	if patternMatcher.prefilter.MayContainSuffixOf(qName) {
+		if reject, reason, val := patternMatcher.evalExactAndSuffixes(qName); reject {
+			return reject, reason, val
 		}
 	}
 
@@ -159,3 +167,15 @@ func (patternMatcher *PatternMatcher) Eval(qName string) (reject bool, reason st
 
 	return false, "", nil
 }
+
+func (patternMatcher *PatternMatcher) evalExactAndSuffixes(qName string) (reject bool, reason string, val interface{}) {
+	if xval := patternMatcher.blockedExact[qName]; xval != nil {
+		return true, qName, xval
+	}
+
+	if match, xval, found := patternMatcher.blockedSuffixes.Match(qName); found {
+		return true, "*." + match, xval
+	}
+
+	return false, "", nil
+}
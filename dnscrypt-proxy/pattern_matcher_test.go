@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+var patternMatcherBackends = []string{PatternMatcherBackendCritbit, PatternMatcherBackendLabelTrie}
+
+func TestPatternMatcherBackends(t *testing.T) {
+	for _, backend := range patternMatcherBackends {
+		t.Run(backend, func(tt *testing.T) {
+			c := check.T(tt)
+			patternMatcher := NewPatternMatcherWithBackend(backend)
+			for i := 0; i < 2000; i++ {
+				c.Nil(patternMatcher.Add(fmt.Sprintf("blocked%d.example", i), i, i))
+				c.Nil(patternMatcher.Add(fmt.Sprintf("=exact%d.example", i), i, i))
+			}
+			c.Nil(patternMatcher.Add("*.sub.blocked1.example", "sub", 0))
+			c.Nil(patternMatcher.Add("ads.*", "ads", 0))
+			c.True(patternMatcher.prefilter.capacity >= 4000)
+
+			for qName, expected := range map[string]string{
+				"blocked42.example":        "*.blocked42.example",
+				"www.blocked1999.example":  "*.blocked1999.example",
+				"www.sub.blocked1.example": "*.sub.blocked1.example",
+				"exact0.example":           "exact0.example",
+				"ads.example.com":          "ads.*",
+			} {
+				reject, reason, _ := patternMatcher.Eval(qName)
+				c.True(reject, qName)
+				c.Equal(reason, expected)
+			}
+			for _, qName := range []string{"example", "notblocked42.example", "www.exact0.example", "allowed.example.com"} {
+				reject, _, _ := patternMatcher.Eval(qName)
+				c.False(reject, qName)
+			}
+		})
+	}
+}
+
+// benchmarkBlocklist returns names similar to the ones found in large hosts files
+func benchmarkBlocklist(count int) []string {
+	rng := rand.New(rand.NewSource(1))
+	tlds := []string{"com", "net", "org", "info", "io", "ru", "de", "xyz", "top", "co.uk"}
+	domains := make([]string, count/20+1)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("domain%x.%s", rng.Int63n(1<<40), tlds[rng.Intn(len(tlds))])
+	}
+	names := make([]string, count)
+	for i := range names {
+		names[i] = fmt.Sprintf("host%x.%s", rng.Int31(), domains[rng.Intn(len(domains))])
+	}
+	return names
+}
+
+// benchmarkPatternMatcherLoad returns a PatternMatcher for a list, and the heap size it uses for each rule
+func benchmarkPatternMatcherLoad(backend string, names []string) (*PatternMatcher, float64) {
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	patternMatcher := NewPatternMatcherWithBackend(backend)
+	for i, name := range names {
+		patternMatcher.Add(name, true, i)
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	return patternMatcher, float64(after.HeapAlloc-before.HeapAlloc) / float64(len(names))
+}
+
+func BenchmarkPatternMatcher(b *testing.B) {
+	names := benchmarkBlocklist(200000)
+	queries := []string{"www.allowed.example.com", "cdn.domain1234.net", names[len(names)/2], "x." + names[len(names)/3]}
+	for _, backend := range patternMatcherBackends {
+		b.Run(backend+"/NotBlocked", func(b *testing.B) {
+			patternMatcher, heapPerRule := benchmarkPatternMatcherLoad(backend, names)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				patternMatcher.Eval(queries[i%2])
+			}
+			b.ReportMetric(heapPerRule, "heap-B/rule")
+		})
+		b.Run(backend+"/Blocked", func(b *testing.B) {
+			patternMatcher, heapPerRule := benchmarkPatternMatcherLoad(backend, names)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				patternMatcher.Eval(queries[2+i%2])
+			}
+			b.ReportMetric(heapPerRule, "heap-B/rule")
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VividCortex/ewma"
+	"github.com/jedisct1/dlog"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+const (
+	PlainDNSSchemePrefix = "dns://"
+	PlainDNSDefaultPort  = 53
+)
+
+// Plain DNS servers can be given as `dns://ip[:port]`
+func newPlainServerStampFromAddress(addrStr string) (stamps.ServerStamp, error) {
+	stamp := stamps.ServerStamp{Proto: stamps.StampProtoTypePlain}
+	host, port := ExtractHostAndPort(addrStr, PlainDNSDefaultPort)
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ParseIP(host) == nil || port <= 0 || port > 65535 {
+		return stamp, fmt.Errorf("Invalid plain DNS server address: [%s] (an IP address is required)", addrStr)
+	}
+	stamp.ServerAddrStr = net.JoinHostPort(host, strconv.Itoa(port))
+	return stamp, nil
+}
+
+// newLastResortServer returns the description of an unencrypted server, only used when no encrypted servers are available
+func newLastResortServer(proxy *Proxy, name string, stamp stamps.ServerStamp) (*ServerInfo, error) {
+	host, port := ExtractHostAndPort(stamp.ServerAddrStr, PlainDNSDefaultPort)
+	ip := ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid address for the plain DNS server [%s]: [%s]", name, stamp.ServerAddrStr)
+	}
+	serverInfo := &ServerInfo{
+		Proto:   stamps.StampProtoTypePlain,
+		Name:    name,
+		Timeout: proxy.timeout,
+		UDPAddr: &net.UDPAddr{IP: ip, Port: port},
+		TCPAddr: &net.TCPAddr{IP: ip, Port: port},
+		rtt:     ewma.NewMovingAverage(RTTEwmaDecay),
+	}
+	if proxy.tcpPipelining {
+		serverInfo.tcpPipeline = newPlainTCPPipeline(proxy, serverInfo.TCPAddr)
+	}
+	return serverInfo, nil
+}
+
+// newPlainTCPPipeline returns a pipeline to a plain DNS server, whose responses are matched using their transaction ID
+func newPlainTCPPipeline(proxy *Proxy, remoteTCPAddr *net.TCPAddr) *TCPPipeline {
+	dial := func() (net.Conn, error) {
+		return outboundDialer(proxy.timeout).Dial("tcp", remoteTCPAddr.String())
+	}
+	keyOf := func(packet []byte) (string, bool) {
+		if len(packet) < 2 {
+			return "", false
+		}
+		return string(packet[0:2]), true
+	}
+	return NewTCPPipeline(dial, keyOf)
+}
+
+// lastResortServer returns one of the insecure servers, if any, and warns that queries are going to be sent in clear text
+func (proxy *Proxy) lastResortServer() *ServerInfo {
+	if len(proxy.lastResortServers) == 0 {
+		return nil
+	}
+	serverInfo := proxy.lastResortServers[rand.Intn(len(proxy.lastResortServers))]
+	dlog.Warnf("No encrypted servers are available - Sending the query UNENCRYPTED to the last-resort server [%s]", serverInfo.Name)
+	return serverInfo
+}
+
+func (proxy *Proxy) exchangeWithPlainServer(serverInfo *ServerInfo, query []byte, serverProto string) ([]byte, error) {
+	sentQuery, randomized := query, false
+	if proxy.qnameCaseRandomization {
+		sentQuery, randomized = randomizeQNameCasePacket(query)
+	}
+	var response []byte
+	var err error
+	if serverProto == "udp" {
+		response, err = proxy.exchangeWithPlainServerOver("udp", serverInfo.UDPAddr.String(), sentQuery, serverInfo.currentTimeout())
+		if err == nil && len(response) >= MinDNSPacketSize && response[2]&0x02 == 0x02 {
+			dlog.Debugf("[%s] Truncated response, retrying over TCP", serverInfo.Name)
+			response = nil
+		}
+	}
+	if response == nil && err == nil {
+		if serverInfo.tcpPipeline != nil {
+			response, err = exchangeOverPlainTCPPipeline(serverInfo.tcpPipeline, sentQuery, serverInfo.currentTimeout())
+		} else {
+			response, err = proxy.exchangeWithPlainServerOver("tcp", serverInfo.TCPAddr.String(), sentQuery, serverInfo.currentTimeout())
+		}
+	}
+	if err == nil && randomized {
+		err = restoreQNameCasePacket(response, sentQuery, query)
+	}
+	return response, err
+}
+
+// exchangeOverPlainTCPPipeline sends a query over a connection shared with other queries to the same server.
+// The query gets a random transaction ID, so that responses can be matched even if clients use the same IDs.
+func exchangeOverPlainTCPPipeline(pipeline *TCPPipeline, query []byte, timeout time.Duration) ([]byte, error) {
+	if len(query) < MinDNSPacketSize {
+		return nil, errors.New("Short query")
+	}
+	tid := TransactionID(query)
+	pipelinedQuery := append([]byte{}, query...)
+	SetTransactionID(pipelinedQuery, uint16(rand.Intn(0x10000)))
+	response, err := pipeline.Exchange(pipelinedQuery, string(pipelinedQuery[0:2]), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < MinDNSPacketSize {
+		return nil, errors.New("Unexpected response from the plain DNS server")
+	}
+	SetTransactionID(response, tid)
+	return response, nil
+}
+
+func (proxy *Proxy) exchangeWithPlainServerOver(network string, addr string, query []byte, timeout time.Duration) ([]byte, error) {
+	pc, err := outboundDialer(timeout).Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	if err := pc.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	var response []byte
+	if network == "udp" {
+		if _, err := pc.Write(query); err != nil {
+			return nil, err
+		}
+		buffer := getPacketBuffer()
+		defer putPacketBuffer(buffer)
+		length, err := pc.Read((*buffer)[:MaxDNSPacketSize])
+		if err != nil {
+			return nil, err
+		}
+		response = append([]byte{}, (*buffer)[:length]...)
+	} else {
+		prefixedQuery, err := PrefixWithSize(append([]byte{}, query...))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pc.Write(prefixedQuery); err != nil {
+			return nil, err
+		}
+		if response, err = ReadPrefixed(&pc); err != nil {
+			return nil, err
+		}
+	}
+	if len(response) < MinDNSPacketSize || TransactionID(response) != TransactionID(query) {
+		return nil, errors.New("Unexpected response from the plain DNS server")
+	}
+	return response, nil
+}
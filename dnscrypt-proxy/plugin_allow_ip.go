@@ -29,7 +29,7 @@ func (plugin *PluginAllowedIP) Description() string {
 }
 
 func (plugin *PluginAllowedIP) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of allowed IP rules from [%s]", proxy.allowedIPFile)
+	pluginsLog.Noticef("Loading the set of allowed IP rules from [%s]", proxy.allowedIPFile)
 	lines, err := ReadTextFile(proxy.allowedIPFile)
 	if err != nil {
 		return err
@@ -44,7 +44,7 @@ func (plugin *PluginAllowedIP) Init(proxy *Proxy) error {
 		ip := net.ParseIP(line)
 		trailingStar := strings.HasSuffix(line, "*")
 		if len(line) < 2 || (ip != nil && trailingStar) {
-			dlog.Errorf("Suspicious allowed IP rule [%s] at line %d", line, lineNo)
+			pluginsLog.Errorf("Suspicious allowed IP rule [%s] at line %d", line, lineNo)
 			continue
 		}
 		if trailingStar {
@@ -54,11 +54,11 @@ func (plugin *PluginAllowedIP) Init(proxy *Proxy) error {
 			line = line[:len(line)-1]
 		}
 		if len(line) == 0 {
-			dlog.Errorf("Empty allowed IP rule at line %d", lineNo)
+			pluginsLog.Errorf("Empty allowed IP rule at line %d", lineNo)
 			continue
 		}
 		if strings.Contains(line, "*") {
-			dlog.Errorf("Invalid rule: [%s] - wildcards can only be used as a suffix at line %d", line, lineNo)
+			pluginsLog.Errorf("Invalid rule: [%s] - wildcards can only be used as a suffix at line %d", line, lineNo)
 			continue
 		}
 		line = strings.ToLower(line)
@@ -71,14 +71,14 @@ func (plugin *PluginAllowedIP) Init(proxy *Proxy) error {
 	if len(proxy.allowedIPLogFile) == 0 {
 		return nil
 	}
-	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.allowedIPLogFile)
+	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.logRotation, proxy.logCompression, proxy.allowedIPLogFile)
 	plugin.format = proxy.allowedIPFormat
 
 	return nil
 }
 
 func (plugin *PluginAllowedIP) Drop() error {
-	return nil
+	return closeLogger(plugin.logger)
 }
 
 func (plugin *PluginAllowedIP) Reload() error {
@@ -118,13 +118,8 @@ func (plugin *PluginAllowedIP) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 		pluginsState.sessionData["whitelisted"] = true
 		if plugin.logger != nil {
 			qName := pluginsState.qName
-			var clientIPStr string
-			switch pluginsState.clientProto {
-			case "udp":
-				clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
-			case "tcp", "local_doh":
-				clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
-			default:
+			clientIPStr, ok := ExtractLoggedClientIPStr(pluginsState)
+			if !ok {
 				// Ignore internal flow.
 				return nil
 			}
@@ -138,19 +133,19 @@ func (plugin *PluginAllowedIP) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 					"%s\t%s\t%s\t%s\t%s\n",
 					tsStr,
 					clientIPStr,
-					StringQuote(qName),
+					NameQuote(qName),
 					StringQuote(ipStr),
 					StringQuote(reason),
 				)
 			} else if plugin.format == "ltsv" {
-				line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tip:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(ipStr), StringQuote(reason))
+				line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tip:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, NameQuote(qName), StringQuote(ipStr), StringQuote(reason))
 			} else {
 				dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 			}
 			if plugin.logger == nil {
 				return errors.New("Log file not initialized")
 			}
-			_, _ = plugin.logger.Write([]byte(line))
+			_, _ = plugin.logger.Write([]byte(pluginsState.withQueryID(line, plugin.format)))
 		}
 	}
 	return nil
@@ -4,7 +4,6 @@
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"strings"
 	"time"
 
@@ -28,13 +27,13 @@ func (plugin *PluginAllowName) Description() string {
 }
 
 func (plugin *PluginAllowName) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of allowed names from [%s]", proxy.allowNameFile)
+	pluginsLog.Noticef("Loading the set of allowed names from [%s]", proxy.allowNameFile)
 	lines, err := ReadTextFile(proxy.allowNameFile)
 	if err != nil {
 		return err
 	}
 	plugin.allWeeklyRanges = proxy.allWeeklyRanges
-	plugin.patternMatcher = NewPatternMatcher()
+	plugin.patternMatcher = NewPatternMatcherWithBackend(proxy.patternMatcherBackend)
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
 		if len(line) == 0 {
@@ -46,34 +45,34 @@ func (plugin *PluginAllowName) Init(proxy *Proxy) error {
 			line = strings.TrimSpace(parts[0])
 			timeRangeName = strings.TrimSpace(parts[1])
 		} else if len(parts) > 2 {
-			dlog.Errorf("Syntax error in allowed names at line %d -- Unexpected @ character", 1+lineNo)
+			pluginsLog.Errorf("Syntax error in allowed names at line %d -- Unexpected @ character", 1+lineNo)
 			continue
 		}
 		var weeklyRanges *WeeklyRanges
 		if len(timeRangeName) > 0 {
 			weeklyRangesX, ok := (*plugin.allWeeklyRanges)[timeRangeName]
 			if !ok {
-				dlog.Errorf("Time range [%s] not found at line %d", timeRangeName, 1+lineNo)
+				pluginsLog.Errorf("Time range [%s] not found at line %d", timeRangeName, 1+lineNo)
 			} else {
 				weeklyRanges = &weeklyRangesX
 			}
 		}
 		if err := plugin.patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
-			dlog.Error(err)
+			pluginsLog.Error(err)
 			continue
 		}
 	}
 	if len(proxy.allowNameLogFile) == 0 {
 		return nil
 	}
-	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.allowNameLogFile)
+	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.logRotation, proxy.logCompression, proxy.allowNameLogFile)
 	plugin.format = proxy.allowNameFormat
 
 	return nil
 }
 
 func (plugin *PluginAllowName) Drop() error {
-	return nil
+	return closeLogger(plugin.logger)
 }
 
 func (plugin *PluginAllowName) Reload() error {
@@ -95,13 +94,8 @@ func (plugin *PluginAllowName) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 	if allowList {
 		pluginsState.sessionData["whitelisted"] = true
 		if plugin.logger != nil {
-			var clientIPStr string
-			switch pluginsState.clientProto {
-			case "udp":
-				clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
-			case "tcp", "local_doh":
-				clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
-			default:
+			clientIPStr, ok := ExtractLoggedClientIPStr(pluginsState)
+			if !ok {
 				// Ignore internal flow.
 				return nil
 			}
@@ -111,16 +105,16 @@ func (plugin *PluginAllowName) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 				year, month, day := now.Date()
 				hour, minute, second := now.Clock()
 				tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
-				line = fmt.Sprintf("%s\t%s\t%s\t%s\n", tsStr, clientIPStr, StringQuote(qName), StringQuote(reason))
+				line = fmt.Sprintf("%s\t%s\t%s\t%s\n", tsStr, clientIPStr, NameQuote(qName), StringQuote(reason))
 			} else if plugin.format == "ltsv" {
-				line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(reason))
+				line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, NameQuote(qName), StringQuote(reason))
 			} else {
 				dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 			}
 			if plugin.logger == nil {
 				return errors.New("Log file not initialized")
 			}
-			_, _ = plugin.logger.Write([]byte(line))
+			_, _ = plugin.logger.Write([]byte(pluginsState.withQueryID(line, plugin.format)))
 		}
 	}
 	return nil
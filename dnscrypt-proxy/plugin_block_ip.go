@@ -3,7 +3,6 @@
 import (
 	"errors"
 	"fmt"
-	"io"
 	"net"
 	"strings"
 	"time"
@@ -16,7 +15,7 @@
 type PluginBlockIP struct {
 	blockedPrefixes *iradix.Tree
 	blockedIPs      map[string]interface{}
-	logger          io.Writer
+	logger          *ListenerLogger
 	format          string
 }
 
@@ -29,7 +28,7 @@ func (plugin *PluginBlockIP) Description() string {
 }
 
 func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of IP blocking rules from [%s]", proxy.blockIPFile)
+	pluginsLog.Noticef("Loading the set of IP blocking rules from [%s]", proxy.blockIPFile)
 	lines, err := ReadTextFile(proxy.blockIPFile)
 	if err != nil {
 		return err
@@ -44,7 +43,7 @@ func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 		ip := net.ParseIP(line)
 		trailingStar := strings.HasSuffix(line, "*")
 		if len(line) < 2 || (ip != nil && trailingStar) {
-			dlog.Errorf("Suspicious IP blocking rule [%s] at line %d", line, lineNo)
+			pluginsLog.Errorf("Suspicious IP blocking rule [%s] at line %d", line, lineNo)
 			continue
 		}
 		if trailingStar {
@@ -54,11 +53,11 @@ func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 			line = line[:len(line)-1]
 		}
 		if len(line) == 0 {
-			dlog.Errorf("Empty IP blocking rule at line %d", lineNo)
+			pluginsLog.Errorf("Empty IP blocking rule at line %d", lineNo)
 			continue
 		}
 		if strings.Contains(line, "*") {
-			dlog.Errorf("Invalid rule: [%s] - wildcards can only be used as a suffix at line %d", line, lineNo)
+			pluginsLog.Errorf("Invalid rule: [%s] - wildcards can only be used as a suffix at line %d", line, lineNo)
 			continue
 		}
 		line = strings.ToLower(line)
@@ -71,14 +70,17 @@ func (plugin *PluginBlockIP) Init(proxy *Proxy) error {
 	if len(proxy.blockIPLogFile) == 0 {
 		return nil
 	}
-	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockIPLogFile)
+	plugin.logger = NewListenerLogger(proxy, proxy.blockIPLogFile)
 	plugin.format = proxy.blockIPFormat
 
 	return nil
 }
 
 func (plugin *PluginBlockIP) Drop() error {
-	return nil
+	if plugin.logger == nil {
+		return nil
+	}
+	return plugin.logger.Close()
 }
 
 func (plugin *PluginBlockIP) Reload() error {
@@ -122,13 +124,8 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 		pluginsState.returnCode = PluginsReturnCodeReject
 		if plugin.logger != nil {
 			qName := pluginsState.qName
-			var clientIPStr string
-			switch pluginsState.clientProto {
-			case "udp":
-				clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
-			case "tcp", "local_doh":
-				clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
-			default:
+			clientIPStr, ok := ExtractLoggedClientIPStr(pluginsState)
+			if !ok {
 				// Ignore internal flow.
 				return nil
 			}
@@ -142,19 +139,19 @@ func (plugin *PluginBlockIP) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 					"%s\t%s\t%s\t%s\t%s\n",
 					tsStr,
 					clientIPStr,
-					StringQuote(qName),
+					NameQuote(qName),
 					StringQuote(ipStr),
 					StringQuote(reason),
 				)
 			} else if plugin.format == "ltsv" {
-				line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tip:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(ipStr), StringQuote(reason))
+				line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tip:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, NameQuote(qName), StringQuote(ipStr), StringQuote(reason))
 			} else {
 				dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 			}
 			if plugin.logger == nil {
 				return errors.New("Log file not initialized")
 			}
-			_, _ = plugin.logger.Write([]byte(line))
+			_, _ = plugin.logger.For(pluginsState.listener).Write([]byte(pluginsState.withQueryID(line, plugin.format)))
 		}
 	}
 	return nil
@@ -3,8 +3,6 @@
 import (
 	"errors"
 	"fmt"
-	"io"
-	"net"
 	"strings"
 	"time"
 
@@ -15,14 +13,13 @@
 type BlockedNames struct {
 	allWeeklyRanges *map[string]WeeklyRanges
 	patternMatcher  *PatternMatcher
-	logger          io.Writer
+	logger          *ListenerLogger
 	format          string
+	sampler         *LogSampler
 }
 
 const aliasesLimit = 8
 
-var blockedNames *BlockedNames
-
 func (blockedNames *BlockedNames) check(pluginsState *PluginsState, qName string, aliasFor *string) (bool, error) {
 	reject, reason, xweeklyRanges := blockedNames.patternMatcher.Eval(qName)
 	if aliasFor != nil {
@@ -42,14 +39,9 @@ func (blockedNames *BlockedNames) check(pluginsState *PluginsState, qName string
 	}
 	pluginsState.action = PluginsActionReject
 	pluginsState.returnCode = PluginsReturnCodeReject
-	if blockedNames.logger != nil {
-		var clientIPStr string
-		switch pluginsState.clientProto {
-		case "udp":
-			clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
-		case "tcp", "local_doh":
-			clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
-		default:
+	if blockedNames.logger != nil && blockedNames.sampler.Keep() {
+		clientIPStr, ok := ExtractLoggedClientIPStr(pluginsState)
+		if !ok {
 			// Ignore internal flow.
 			return false, nil
 		}
@@ -59,23 +51,25 @@ func (blockedNames *BlockedNames) check(pluginsState *PluginsState, qName string
 			year, month, day := now.Date()
 			hour, minute, second := now.Clock()
 			tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
-			line = fmt.Sprintf("%s\t%s\t%s\t%s\n", tsStr, clientIPStr, StringQuote(qName), StringQuote(reason))
+			line = fmt.Sprintf("%s\t%s\t%s\t%s\n", tsStr, clientIPStr, NameQuote(qName), StringQuote(reason))
 		} else if blockedNames.format == "ltsv" {
-			line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, StringQuote(qName), StringQuote(reason))
+			line = fmt.Sprintf("time:%d\thost:%s\tqname:%s\tmessage:%s\n", time.Now().Unix(), clientIPStr, NameQuote(qName), StringQuote(reason))
 		} else {
 			dlog.Fatalf("Unexpected log format: [%s]", blockedNames.format)
 		}
 		if blockedNames.logger == nil {
 			return false, errors.New("Log file not initialized")
 		}
-		_, _ = blockedNames.logger.Write([]byte(line))
+		_, _ = blockedNames.logger.For(pluginsState.listener).Write([]byte(pluginsState.withQueryID(line, blockedNames.format)))
 	}
 	return true, nil
 }
 
 // ---
 
-type PluginBlockName struct{}
+type PluginBlockName struct {
+	blockedNames *BlockedNames
+}
 
 func (plugin *PluginBlockName) Name() string {
 	return "block_name"
@@ -86,14 +80,14 @@ func (plugin *PluginBlockName) Description() string {
 }
 
 func (plugin *PluginBlockName) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of blocking rules from [%s]", proxy.blockNameFile)
+	pluginsLog.Noticef("Loading the set of blocking rules from [%s]", proxy.blockNameFile)
 	lines, err := ReadTextFile(proxy.blockNameFile)
 	if err != nil {
 		return err
 	}
 	xBlockedNames := BlockedNames{
 		allWeeklyRanges: proxy.allWeeklyRanges,
-		patternMatcher:  NewPatternMatcher(),
+		patternMatcher:  NewPatternMatcherWithBackend(proxy.patternMatcherBackend),
 	}
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
@@ -106,35 +100,39 @@ func (plugin *PluginBlockName) Init(proxy *Proxy) error {
 			line = strings.TrimSpace(parts[0])
 			timeRangeName = strings.TrimSpace(parts[1])
 		} else if len(parts) > 2 {
-			dlog.Errorf("Syntax error in block rules at line %d -- Unexpected @ character", 1+lineNo)
+			pluginsLog.Errorf("Syntax error in block rules at line %d -- Unexpected @ character", 1+lineNo)
 			continue
 		}
 		var weeklyRanges *WeeklyRanges
 		if len(timeRangeName) > 0 {
 			weeklyRangesX, ok := (*xBlockedNames.allWeeklyRanges)[timeRangeName]
 			if !ok {
-				dlog.Errorf("Time range [%s] not found at line %d", timeRangeName, 1+lineNo)
+				pluginsLog.Errorf("Time range [%s] not found at line %d", timeRangeName, 1+lineNo)
 			} else {
 				weeklyRanges = &weeklyRangesX
 			}
 		}
 		if err := xBlockedNames.patternMatcher.Add(line, weeklyRanges, lineNo+1); err != nil {
-			dlog.Error(err)
+			pluginsLog.Error(err)
 			continue
 		}
 	}
-	blockedNames = &xBlockedNames
+	plugin.blockedNames = &xBlockedNames
 	if len(proxy.blockNameLogFile) == 0 {
 		return nil
 	}
-	blockedNames.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.blockNameLogFile)
-	blockedNames.format = proxy.blockNameFormat
+	xBlockedNames.logger = NewListenerLogger(proxy, proxy.blockNameLogFile)
+	xBlockedNames.format = proxy.blockNameFormat
+	xBlockedNames.sampler = NewLogSampler(proxy.blockNameLogSampleRate, proxy.blockNameLogMaxLinesPerSecond)
 
 	return nil
 }
 
 func (plugin *PluginBlockName) Drop() error {
-	return nil
+	if plugin.blockedNames == nil || plugin.blockedNames.logger == nil {
+		return nil
+	}
+	return plugin.blockedNames.logger.Close()
 }
 
 func (plugin *PluginBlockName) Reload() error {
@@ -142,6 +140,7 @@ func (plugin *PluginBlockName) Reload() error {
 }
 
 func (plugin *PluginBlockName) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	blockedNames := plugin.blockedNames
 	if blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
 		return nil
 	}
@@ -151,7 +150,9 @@ func (plugin *PluginBlockName) Eval(pluginsState *PluginsState, msg *dns.Msg) er
 
 // ---
 
-type PluginBlockNameResponse struct{}
+type PluginBlockNameResponse struct {
+	blockName *PluginBlockName
+}
 
 func (plugin *PluginBlockNameResponse) Name() string {
 	return "block_name"
@@ -174,6 +175,7 @@ func (plugin *PluginBlockNameResponse) Reload() error {
 }
 
 func (plugin *PluginBlockNameResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	blockedNames := plugin.blockName.blockedNames
 	if blockedNames == nil || pluginsState.sessionData["whitelisted"] != nil {
 		return nil
 	}
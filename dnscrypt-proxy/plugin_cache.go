@@ -3,28 +3,44 @@
 import (
 	"crypto/sha512"
 	"encoding/binary"
-	"sync"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
-	sieve "github.com/opencoff/go-sieve"
 )
 
-const StaleResponseTTL = 30 * time.Second
+const (
+	// All clients share the same cache entries
+	CachePartitionNone = "none"
+	// Clients of listeners with different labels have separate cache entries
+	CachePartitionListener = "listener"
+)
+
+const (
+	StaleResponseTTL = 30 * time.Second
+	// TTL of the expired entries served by the optimistic cache, while they are being refreshed
+	OptimisticResponseTTL = 10 * time.Second
+)
 
 type CachedResponse struct {
 	expiration time.Time
+	ttl        time.Duration
+	hits       int
 	msg        dns.Msg
+	wire       *CachedWireResponse
 }
 
-type CachedResponses struct {
-	sync.RWMutex
-	cache *sieve.Sieve[[32]byte, CachedResponse]
-}
+// The cache is shared by all the cache plugins, and created when the writer is initialized
+var cachedResponses atomic.Pointer[ShardedCache]
 
-var cachedResponses CachedResponses
+// Scope prefixes of the cached responses specific to a client subnet, for IPv4 and IPv6, so that lookups
+// only try the prefixes that may have an entry. Bit n is set for a prefix of n+1 bits.
+var cachedSubnetScopes [2][2]atomic.Uint64
 
-func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) [32]byte {
+// computeCacheKey returns the key of a cache entry. Responses specific to a client subnet have their own entries,
+// and so do responses for different cache partitions.
+func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg, subnet *dns.EDNS0_SUBNET) [32]byte {
 	question := msg.Question[0]
 	h := sha512.New512_256()
 	var tmp [5]byte
@@ -37,15 +53,117 @@ func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) [32]byte {
 	normalizedRawQName := []byte(question.Name)
 	NormalizeRawQName(&normalizedRawQName)
 	h.Write(normalizedRawQName)
+	if len(pluginsState.cachePartition) > 0 {
+		h.Write([]byte{0})
+		h.Write([]byte(pluginsState.cachePartition))
+	}
+	if subnet != nil {
+		bits := 32
+		if subnet.Family == 2 {
+			bits = 128
+		}
+		var tmp [3]byte
+		binary.LittleEndian.PutUint16(tmp[0:2], subnet.Family)
+		tmp[2] = subnet.SourceNetmask
+		h.Write(tmp[:])
+		h.Write(subnet.Address.Mask(net.CIDRMask(int(subnet.SourceNetmask), bits)))
+	}
 	var sum [32]byte
 	h.Sum(sum[:0])
 
 	return sum
 }
 
+// ednsClientSubnet returns the EDNS-client-subnet option of a message, if there is one
+func ednsClientSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if msg == nil {
+		return nil
+	}
+	edns0 := msg.IsEdns0()
+	if edns0 == nil {
+		return nil
+	}
+	for _, option := range edns0.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// responseClientSubnet returns the subnet a response was tailored for, or nil if the response is valid
+// for all clients, i.e. if the server ignored the option or returned a scope prefix of 0 (RFC 7871, section 7.3.1).
+// The subnet is truncated to the scope prefix, or to the source prefix if the scope is longer (section 7.3.1 too).
+func responseClientSubnet(query *dns.Msg, response *dns.Msg) *dns.EDNS0_SUBNET {
+	querySubnet := ednsClientSubnet(query)
+	if querySubnet == nil {
+		return nil
+	}
+	responseSubnet := ednsClientSubnet(response)
+	if responseSubnet == nil || responseSubnet.SourceScope == 0 || querySubnet.SourceNetmask == 0 {
+		return nil
+	}
+	subnet := *querySubnet
+	subnet.SourceNetmask = min(querySubnet.SourceNetmask, responseSubnet.SourceScope)
+	return &subnet
+}
+
+// addCachedSubnetScope records that responses may be cached for a subnet prefix
+func addCachedSubnetScope(subnet *dns.EDNS0_SUBNET) {
+	if (subnet.Family != 1 && subnet.Family != 2) || subnet.SourceNetmask == 0 || subnet.SourceNetmask > 128 {
+		return
+	}
+	bit := subnet.SourceNetmask - 1
+	scopes := &cachedSubnetScopes[subnet.Family-1][bit/64]
+	mask := uint64(1) << (bit % 64)
+	if scopes.Load()&mask == 0 {
+		scopes.Or(mask)
+	}
+}
+
+// cachedSubnetPrefixes returns the prefixes, longest first, that responses to a query for a subnet may be cached for
+func cachedSubnetPrefixes(subnet *dns.EDNS0_SUBNET) []uint8 {
+	if subnet.Family != 1 && subnet.Family != 2 {
+		return nil
+	}
+	var prefixes []uint8
+	for prefix := min(int(subnet.SourceNetmask), 128); prefix > 0; prefix-- {
+		bit := prefix - 1
+		if cachedSubnetScopes[subnet.Family-1][bit/64].Load()&(uint64(1)<<(bit%64)) != 0 {
+			prefixes = append(prefixes, uint8(prefix))
+		}
+	}
+	return prefixes
+}
+
+// getCachedResponse looks up the cached response to a query. A response for a client subnet is cached for the
+// scope returned by the server, so the scopes that the query subnet belongs to are tried, longest first, before
+// the response valid for all clients.
+func getCachedResponse(cache *ShardedCache, pluginsState *PluginsState, msg *dns.Msg) ([32]byte, CachedResponse, bool) {
+	if subnet := ednsClientSubnet(msg); subnet != nil {
+		for _, prefix := range cachedSubnetPrefixes(subnet) {
+			scopedSubnet := *subnet
+			scopedSubnet.SourceNetmask = prefix
+			cacheKey := computeCacheKey(pluginsState, msg, &scopedSubnet)
+			if cached, ok := cache.Get(cacheKey); ok {
+				return cacheKey, cached, true
+			}
+		}
+	}
+	cacheKey := computeCacheKey(pluginsState, msg, nil)
+	cached, ok := cache.Get(cacheKey)
+	return cacheKey, cached, ok
+}
+
 // ---
 
-type PluginCache struct{}
+type PluginCache struct {
+	proxy            *Proxy
+	eventLogger      *CacheEventLogger
+	prefetchHits     int
+	prefetchPercent  int
+	optimisticMaxAge time.Duration
+}
 
 func (plugin *PluginCache) Name() string {
 	return "cache"
@@ -56,6 +174,11 @@ func (plugin *PluginCache) Description() string {
 }
 
 func (plugin *PluginCache) Init(proxy *Proxy) error {
+	plugin.proxy = proxy
+	plugin.eventLogger = proxy.cacheEventLogger
+	plugin.prefetchHits = proxy.cachePrefetchHits
+	plugin.prefetchPercent = proxy.cachePrefetchPercent
+	plugin.optimisticMaxAge = proxy.cacheOptimisticMaxAge
 	return nil
 }
 
@@ -68,45 +191,83 @@ func (plugin *PluginCache) Reload() error {
 }
 
 func (plugin *PluginCache) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
-	cacheKey := computeCacheKey(pluginsState, msg)
-
-	cachedResponses.RLock()
-	if cachedResponses.cache == nil {
-		cachedResponses.RUnlock()
+	if pluginsState.clientProto == CacheRefreshProto {
 		return nil
 	}
-	cached, ok := cachedResponses.cache.Get(cacheKey)
+	cache := cachedResponses.Load()
+	if cache == nil {
+		return nil
+	}
+	cacheKey, cached, ok := getCachedResponse(cache, pluginsState, msg)
 	if !ok {
-		cachedResponses.RUnlock()
 		return nil
 	}
 	expiration := cached.expiration
-	synth := cached.msg.Copy()
-	cachedResponses.RUnlock()
-
-	synth.Id = msg.Id
-	synth.Response = true
-	synth.Compress = true
-	synth.Question = msg.Question
-
-	if time.Now().After(expiration) {
+	if time.Now().After(expiration) && time.Since(expiration) <= plugin.optimisticMaxAge && pluginsState.questionMsg != nil {
+		// Optimistic cache: answer right away, and refresh the entry in the background
+		cacheLog.Debugf("[%s] Expired entry for [%s] served optimistically", pluginsState.queryID, NameQuote(pluginsState.qName))
+		plugin.proxy.refreshCacheEntry(pluginsState, 0)
+		plugin.eventLogger.Log(CacheEventStaleServed, &cacheKey, &cached.msg, OptimisticResponseTTL)
+		expiration = time.Now().Add(OptimisticResponseTTL)
+	} else if time.Now().After(expiration) {
+		if time.Since(expiration) > pluginsState.cacheStaleMaxAge {
+			return nil
+		}
+		synth := cachedSynthResponse(&cached, msg)
 		expiration2 := time.Now().Add(StaleResponseTTL)
 		updateTTL(synth, expiration2)
 		pluginsState.sessionData["stale"] = synth
+		cacheLog.Debugf("[%s] Expired entry for [%s] kept as a stale response", pluginsState.queryID, NameQuote(pluginsState.qName))
+		plugin.eventLogger.Log(CacheEventExpired, &cacheKey, synth, 0)
 		return nil
+	} else {
+		cacheLog.Debugf("[%s] Cache hit for [%s]", pluginsState.queryID, NameQuote(pluginsState.qName))
+		plugin.prefetch(pluginsState, &cached)
 	}
 
-	updateTTL(synth, expiration)
-
-	pluginsState.synthResponse = synth
 	pluginsState.action = PluginsActionSynth
 	pluginsState.cacheHit = true
+	if cached.wire != nil {
+		if packet, ok := cached.wire.Patch(msg.Id, msg.Question[0].Name, remainingTTL(expiration)); ok {
+			pluginsState.synthPacket = packet
+			pluginsState.authenticatedData = cached.wire.AuthenticatedData()
+			return nil
+		}
+	}
+	synth := cachedSynthResponse(&cached, msg)
+	updateTTL(synth, expiration)
+	pluginsState.synthResponse = synth
+	pluginsState.authenticatedData = synth.AuthenticatedData
 	return nil
 }
 
+// cachedSynthResponse returns a copy of a cached response, for a query
+func cachedSynthResponse(cached *CachedResponse, msg *dns.Msg) *dns.Msg {
+	synth := cached.msg.Copy()
+	synth.Id = msg.Id
+	synth.Response = true
+	synth.Compress = true
+	synth.Question = msg.Question
+	return synth
+}
+
+// prefetch refreshes popular entries before they expire, so that they keep being served from the cache
+func (plugin *PluginCache) prefetch(pluginsState *PluginsState, cached *CachedResponse) {
+	if plugin.prefetchHits <= 0 || cached.hits < plugin.prefetchHits || pluginsState.questionMsg == nil {
+		return
+	}
+	if time.Until(cached.expiration) > cached.ttl*time.Duration(plugin.prefetchPercent)/100 {
+		return
+	}
+	cacheLog.Debugf("[%s] Prefetching [%s] (%d hits)", pluginsState.queryID, NameQuote(pluginsState.qName), cached.hits)
+	plugin.proxy.refreshCacheEntry(pluginsState, 0)
+}
+
 // ---
 
-type PluginCacheResponse struct{}
+type PluginCacheResponse struct {
+	eventLogger *CacheEventLogger
+}
 
 func (plugin *PluginCacheResponse) Name() string {
 	return "cache_response"
@@ -117,6 +278,10 @@ func (plugin *PluginCacheResponse) Description() string {
 }
 
 func (plugin *PluginCacheResponse) Init(proxy *Proxy) error {
+	plugin.eventLogger = proxy.cacheEventLogger
+	if cachedResponses.Load() == nil {
+		cachedResponses.CompareAndSwap(nil, NewShardedCache(proxy.cacheSize, proxy.cacheMaxMemory))
+	}
 	return nil
 }
 
@@ -129,36 +294,54 @@ func (plugin *PluginCacheResponse) Reload() error {
 }
 
 func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
-	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError && msg.Rcode != dns.RcodeNotAuth {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError && msg.Rcode != dns.RcodeNotAuth &&
+		(msg.Rcode != dns.RcodeServerFailure || pluginsState.cacheServFailTTL == 0) {
 		return nil
 	}
-	if msg.Truncated {
+	if msg.Truncated || pluginsState.staleServed {
 		return nil
 	}
-	cacheKey := computeCacheKey(pluginsState, msg)
+	if _, hasStale := pluginsState.sessionData["stale"]; hasStale && msg.Rcode == dns.RcodeServerFailure {
+		// Don't replace an expired response that could still be served
+		return nil
+	}
+	subnet := responseClientSubnet(pluginsState.questionMsg, msg)
+	cacheKey := computeCacheKey(pluginsState, msg, subnet)
 	ttl := getMinTTL(
 		msg,
 		pluginsState.cacheMinTTL,
 		pluginsState.cacheMaxTTL,
 		pluginsState.cacheNegMinTTL,
 		pluginsState.cacheNegMaxTTL,
+		pluginsState.cacheNoDataMinTTL,
+		pluginsState.cacheNoDataMaxTTL,
+		pluginsState.cacheServFailTTL,
 	)
 	cachedResponse := CachedResponse{
 		expiration: time.Now().Add(ttl),
+		ttl:        ttl,
 		msg:        *msg,
+		wire:       NewCachedWireResponse(msg),
 	}
-	cachedResponses.Lock()
-	if cachedResponses.cache == nil {
-		var err error
-		cachedResponses.cache = sieve.New[[32]byte, CachedResponse](pluginsState.cacheSize)
-		if cachedResponses.cache == nil {
-			cachedResponses.Unlock()
-			return err
-		}
+	cache := cachedResponses.Load()
+	if cache == nil {
+		return nil
+	}
+	if subnet != nil {
+		addCachedSubnetScope(subnet)
 	}
-	cachedResponses.cache.Add(cacheKey, cachedResponse)
-	cachedResponses.Unlock()
+	replaced, evicted := cache.Add(cacheKey, cachedResponse)
 	updateTTL(msg, cachedResponse.expiration)
+	if plugin.eventLogger != nil {
+		if replaced {
+			plugin.eventLogger.Log(CacheEventReplace, &cacheKey, msg, ttl)
+		} else {
+			for ; evicted > 0; evicted-- {
+				plugin.eventLogger.Log(CacheEventEvict, nil, msg, 0)
+			}
+			plugin.eventLogger.Log(CacheEventInsert, &cacheKey, msg, ttl)
+		}
+	}
 
 	return nil
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	CacheEventInsert      = "insert"
+	CacheEventReplace     = "replace"
+	CacheEventEvict       = "evict"
+	CacheEventExpired     = "expired"
+	CacheEventStaleServed = "stale_served"
+)
+
+// CacheEventLogger logs what happens to cache entries, to help understanding why
+// a response is, or is not served from the cache.
+// The cache doesn't tell which entry gets evicted to make room for a new one, so
+// evictions are logged with the name of the entry being inserted.
+type CacheEventLogger struct {
+	logger io.Writer
+	format string
+}
+
+func NewCacheEventLogger(proxy *Proxy) *CacheEventLogger {
+	if len(proxy.cacheLogFile) == 0 {
+		return nil
+	}
+	return &CacheEventLogger{
+		logger: Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.logRotation, proxy.logCompression, proxy.cacheLogFile),
+		format: proxy.cacheLogFormat,
+	}
+}
+
+func (eventLogger *CacheEventLogger) Log(event string, cacheKey *[32]byte, msg *dns.Msg, ttl time.Duration) {
+	if eventLogger == nil || msg == nil || len(msg.Question) == 0 {
+		return
+	}
+	question := msg.Question[0]
+	qType, ok := dns.TypeToString[question.Qtype]
+	if !ok {
+		qType = fmt.Sprintf("TYPE%d", question.Qtype)
+	}
+	keyStr := "-"
+	if cacheKey != nil {
+		keyStr = hex.EncodeToString(cacheKey[:8])
+	}
+	entries, capacity := 0, 0
+	if cache := cachedResponses.Load(); cache != nil {
+		entries, capacity = cache.Len(), cache.Cap()
+	}
+	ttlSecs := int64(ttl / time.Second)
+	var line string
+	if eventLogger.format == "tsv" {
+		now := time.Now()
+		year, month, day := now.Date()
+		hour, minute, second := now.Clock()
+		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
+		line = fmt.Sprintf("%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d/%d\n",
+			tsStr, event, NameQuote(question.Name), qType, keyStr, ttlSecs, msg.Len(), entries, capacity)
+	} else {
+		line = fmt.Sprintf("time:%d\tevent:%s\tqname:%s\ttype:%s\tkey:%s\tttl:%d\tsize:%d\tentries:%d\tcapacity:%d\n",
+			time.Now().Unix(), event, NameQuote(question.Name), qType, keyStr, ttlSecs, msg.Len(), entries, capacity)
+	}
+	_, _ = eventLogger.logger.Write([]byte(line))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func ecsMsg(name string, subnet string, scope uint8) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	_, ipNet, _ := net.ParseCIDR(subnet)
+	prefix, _ := ipNet.Mask.Size()
+	family := uint16(1)
+	if ipNet.IP.To4() == nil {
+		family = 2
+	}
+	msg.SetEdns0(4096, false)
+	edns0 := msg.IsEdns0()
+	edns0.Option = append(edns0.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(prefix),
+		SourceScope:   scope,
+		Address:       ipNet.IP,
+	})
+	return msg
+}
+
+func TestCacheClientSubnetScope(t *testing.T) {
+	c := check.T(t)
+	cache := NewShardedCache(64, 0)
+	pluginsState := &PluginsState{}
+
+	query := ecsMsg("scoped.example.", "192.0.2.0/24", 0)
+	response := ecsMsg("scoped.example.", "192.0.2.0/24", 16)
+	subnet := responseClientSubnet(query, response)
+	c.NotNil(subnet)
+	c.EQ(subnet.SourceNetmask, uint8(16))
+	addCachedSubnetScope(subnet)
+	cache.Add(computeCacheKey(pluginsState, response, subnet), CachedResponse{msg: *response})
+
+	// Another network within the scope shares the entry
+	_, _, ok := getCachedResponse(cache, pluginsState, ecsMsg("scoped.example.", "192.0.77.0/24", 0))
+	c.True(ok)
+	_, _, ok = getCachedResponse(cache, pluginsState, ecsMsg("scoped.example.", "198.51.100.0/24", 0))
+	c.False(ok)
+
+	// A scope longer than the source prefix is truncated to it
+	response = ecsMsg("longer.example.", "192.0.2.0/24", 32)
+	subnet = responseClientSubnet(query, response)
+	c.EQ(subnet.SourceNetmask, uint8(24))
+
+	// A scope of 0 means the response is valid for all clients
+	c.Nil(responseClientSubnet(query, ecsMsg("global.example.", "192.0.2.0/24", 0)))
+}
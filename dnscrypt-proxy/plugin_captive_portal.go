@@ -1,7 +1,6 @@
 package main
 
 import (
-	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
 )
 
@@ -19,7 +18,7 @@ func (plugin *PluginCaptivePortal) Description() string {
 
 func (plugin *PluginCaptivePortal) Init(proxy *Proxy) error {
 	plugin.captivePortalMap = proxy.captivePortalMap
-	dlog.Notice("Captive portals handler enabled")
+	pluginsLog.Notice("Captive portals handler enabled")
 	return nil
 }
 
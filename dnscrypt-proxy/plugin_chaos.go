@@ -0,0 +1,64 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// PluginChaos answers CHAOS-class queries such as version.bind and hostname.bind locally
+type PluginChaos struct {
+	txt    map[string]string
+	refuse bool
+}
+
+func (plugin *PluginChaos) Name() string {
+	return "chaos"
+}
+
+func (plugin *PluginChaos) Description() string {
+	return "Answer or refuse CHAOS-class queries."
+}
+
+func (plugin *PluginChaos) Init(proxy *Proxy) error {
+	plugin.txt = make(map[string]string, len(proxy.chaosTXT))
+	for name, txt := range proxy.chaosTXT {
+		qName, err := NormalizeQName(name)
+		if err != nil {
+			return err
+		}
+		plugin.txt[qName] = txt
+	}
+	plugin.refuse = proxy.chaosRefuse
+	return nil
+}
+
+func (plugin *PluginChaos) Drop() error {
+	return nil
+}
+
+func (plugin *PluginChaos) Reload() error {
+	return nil
+}
+
+func (plugin *PluginChaos) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	question := msg.Question[0]
+	if question.Qclass != dns.ClassCHAOS {
+		return nil
+	}
+	txt, ok := plugin.txt[pluginsState.qName]
+	if !ok && !plugin.refuse {
+		return nil
+	}
+	synth := EmptyResponseFromMessage(msg)
+	if !ok {
+		synth.Rcode = dns.RcodeRefused
+	} else if question.Qtype == dns.TypeTXT || question.Qtype == dns.TypeANY {
+		rr := new(dns.TXT)
+		rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+		rr.Txt = []string{txt}
+		synth.Answer = []dns.RR{rr}
+	}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	return nil
+}
@@ -8,7 +8,6 @@
 	"time"
 	"unicode"
 
-	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
 )
 
@@ -20,6 +19,50 @@ type CloakedName struct {
 	lineNo     int
 	isIP       bool
 	PTR        []string
+	templates  map[uint16]*SynthTemplate
+}
+
+// answers returns the records for a query, in the order they were defined
+func (cloakedName *CloakedName) answers(qName string, qType uint16, ttl uint32) []dns.RR {
+	answers := []dns.RR{}
+	switch qType {
+	case dns.TypeA:
+		for _, ip := range cloakedName.ipv4 {
+			rr := new(dns.A)
+			rr.Hdr = dns.RR_Header{Name: qName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
+			rr.A = ip
+			answers = append(answers, rr)
+		}
+	case dns.TypeAAAA:
+		for _, ip := range cloakedName.ipv6 {
+			rr := new(dns.AAAA)
+			rr.Hdr = dns.RR_Header{Name: qName, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}
+			rr.AAAA = ip
+			answers = append(answers, rr)
+		}
+	case dns.TypePTR:
+		for _, ptr := range cloakedName.PTR {
+			rr := new(dns.PTR)
+			rr.Hdr = dns.RR_Header{Name: qName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}
+			rr.Ptr = ptr
+			answers = append(answers, rr)
+		}
+	}
+	return answers
+}
+
+// updateTemplates precomputes the responses to A, AAAA and PTR queries in wire format
+func (cloakedName *CloakedName) updateTemplates() {
+	templates := make(map[uint16]*SynthTemplate, 3)
+	for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypePTR} {
+		template, err := NewSynthTemplate(dns.RcodeSuccess, cloakedName.answers(".", qType, 0), nil)
+		if err != nil {
+			pluginsLog.Debugf("Unable to precompute a cloaked response: %v", err)
+			continue
+		}
+		templates[qType] = template
+	}
+	cloakedName.templates = templates
 }
 
 type PluginCloak struct {
@@ -38,14 +81,14 @@ func (plugin *PluginCloak) Description() string {
 }
 
 func (plugin *PluginCloak) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of cloaking rules from [%s]", proxy.cloakFile)
+	pluginsLog.Noticef("Loading the set of cloaking rules from [%s]", proxy.cloakFile)
 	lines, err := ReadTextFile(proxy.cloakFile)
 	if err != nil {
 		return err
 	}
 	plugin.ttl = proxy.cloakTTL
 	plugin.createPTR = proxy.cloakedPTR
-	plugin.patternMatcher = NewPatternMatcher()
+	plugin.patternMatcher = NewPatternMatcherWithBackend(proxy.patternMatcherBackend)
 	cloakedNames := make(map[string]*CloakedName)
 	for lineNo, line := range strings.Split(lines, "\n") {
 		line = TrimAndStripInlineComments(line)
@@ -58,11 +101,11 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 			line = strings.TrimSpace(parts[0])
 			target = strings.TrimSpace(parts[1])
 		} else if len(parts) > 2 {
-			dlog.Errorf("Syntax error in cloaking rules at line %d -- Unexpected space character", 1+lineNo)
+			pluginsLog.Errorf("Syntax error in cloaking rules at line %d -- Unexpected space character", 1+lineNo)
 			continue
 		}
 		if len(line) == 0 || len(target) == 0 {
-			dlog.Errorf("Syntax error in cloaking rules at line %d -- Missing name or target", 1+lineNo)
+			pluginsLog.Errorf("Syntax error in cloaking rules at line %d -- Missing name or target", 1+lineNo)
 			continue
 		}
 		line = strings.ToLower(line)
@@ -77,7 +120,7 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 			} else if ipv6 := ip.To16(); ipv6 != nil {
 				cloakedName.ipv6 = append(cloakedName.ipv6, ipv6)
 			} else {
-				dlog.Errorf("Invalid IP address in cloaking rule at line %d", 1+lineNo)
+				pluginsLog.Errorf("Invalid IP address in cloaking rule at line %d", 1+lineNo)
 				continue
 			}
 			cloakedName.isIP = true
@@ -110,6 +153,9 @@ func (plugin *PluginCloak) Init(proxy *Proxy) error {
 		cloakedNames[ptrQueryLine] = ptrCloakedName
 	}
 	for line, cloakedName := range cloakedNames {
+		if cloakedName.isIP {
+			cloakedName.updateTemplates()
+		}
 		if err := plugin.patternMatcher.Add(line, cloakedName, cloakedName.lineNo); err != nil {
 			return err
 		}
@@ -185,40 +231,26 @@ func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 				}
 			}
 		}
+		cloakedName.updateTemplates()
 		plugin.Unlock()
 		plugin.RLock()
 	}
+	template := cloakedName.templates[question.Qtype]
 	plugin.RUnlock()
-	synth := EmptyResponseFromMessage(msg)
-	synth.Answer = []dns.RR{}
-	if question.Qtype == dns.TypeA {
-		for _, ip := range cloakedName.ipv4 {
-			rr := new(dns.A)
-			rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
-			rr.A = ip
-			synth.Answer = append(synth.Answer, rr)
-		}
-	} else if question.Qtype == dns.TypeAAAA {
-		for _, ip := range cloakedName.ipv6 {
-			rr := new(dns.AAAA)
-			rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: ttl}
-			rr.AAAA = ip
-			synth.Answer = append(synth.Answer, rr)
-		}
-	} else if question.Qtype == dns.TypePTR {
-		for _, ptr := range cloakedName.PTR {
-			rr := new(dns.PTR)
-			rr.Hdr = dns.RR_Header{Name: question.Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}
-			rr.Ptr = ptr
-			synth.Answer = append(synth.Answer, rr)
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeCloak
+	if template != nil {
+		if packet, err := template.Build(msg, ttl, true); err == nil {
+			pluginsState.synthPacket = packet
+			return nil
 		}
 	}
+	synth := EmptyResponseFromMessage(msg)
+	synth.Answer = cloakedName.answers(question.Name, question.Qtype, ttl)
 	rand.Shuffle(
 		len(synth.Answer),
 		func(i, j int) { synth.Answer[i], synth.Answer[j] = synth.Answer[j], synth.Answer[i] },
 	)
 	pluginsState.synthResponse = synth
-	pluginsState.action = PluginsActionSynth
-	pluginsState.returnCode = PluginsReturnCodeCloak
 	return nil
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/csv"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DHCPLeaseFormatDnsmasq = "dnsmasq"
+	DHCPLeaseFormatISC     = "isc"
+	DHCPLeaseFormatKea     = "kea"
+)
+
+// DHCPLease is an address assigned to a LAN host; a zero expiry means that the lease never expires
+type DHCPLease struct {
+	hostname string
+	ip       net.IP
+	expiry   time.Time
+}
+
+func (lease *DHCPLease) expired(now time.Time) bool {
+	return !lease.expiry.IsZero() && !now.Before(lease.expiry)
+}
+
+// ttl returns the TTL of a record, which never outlives the lease
+func (lease *DHCPLease) ttl(now time.Time, maxTTL uint32) uint32 {
+	if lease.expiry.IsZero() {
+		return maxTTL
+	}
+	return uint32(Min(int(maxTTL), int(lease.expiry.Sub(now).Seconds())))
+}
+
+// dhcpHostname returns the first label of a hostname found in a lease file, or an empty string if it is not valid
+func dhcpHostname(hostname string) string {
+	hostname = strings.ToLower(strings.Trim(hostname, `"`))
+	if i := strings.IndexByte(hostname, '.'); i >= 0 {
+		hostname = hostname[:i]
+	}
+	if len(hostname) == 0 || len(hostname) > 63 || hostname[0] == '-' {
+		return ""
+	}
+	for i := 0; i < len(hostname); i++ {
+		if c := hostname[i]; !(c >= 'a' && c <= 'z') && !isDigit(c) && c != '-' {
+			return ""
+		}
+	}
+	return hostname
+}
+
+// detectDHCPLeaseFormat guesses the format of a lease file from its content
+func detectDHCPLeaseFormat(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "address,") {
+			return DHCPLeaseFormatKea
+		}
+		if strings.HasPrefix(line, "lease ") || strings.HasSuffix(line, ";") {
+			return DHCPLeaseFormatISC
+		}
+		return DHCPLeaseFormatDnsmasq
+	}
+	return DHCPLeaseFormatDnsmasq
+}
+
+// parseDnsmasqLeases parses lines such as `<expiry> <mac or iaid> <ip> <hostname> <client id>`
+func parseDnsmasqLeases(content string) []DHCPLease {
+	var leases []DHCPLease
+	for _, line := range strings.Split(content, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 4 || parts[0] == "duid" {
+			continue
+		}
+		expiry, err := strconv.ParseInt(parts[0], 10, 64)
+		ip := net.ParseIP(parts[2])
+		hostname := dhcpHostname(parts[3])
+		if err != nil || ip == nil || len(hostname) == 0 {
+			continue
+		}
+		lease := DHCPLease{hostname: hostname, ip: ip}
+		if expiry > 0 {
+			lease.expiry = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return leases
+}
+
+// parseISCLeases parses `lease <ip> { ... }` blocks; later blocks for an address replace the previous ones
+func parseISCLeases(content string) []DHCPLease {
+	byIP := make(map[string]int)
+	var leases []DHCPLease
+	var lease *DHCPLease
+	active := false
+	for _, line := range strings.Split(content, "\n") {
+		parts := strings.Fields(strings.TrimSuffix(strings.TrimSpace(line), ";"))
+		if len(parts) == 0 {
+			continue
+		}
+		switch {
+		case parts[0] == "lease" && len(parts) >= 2:
+			lease, active = &DHCPLease{ip: net.ParseIP(parts[1])}, true
+		case lease == nil:
+		case parts[0] == "}":
+			if lease.ip != nil {
+				key := lease.ip.String()
+				if i, ok := byIP[key]; ok {
+					leases[i] = DHCPLease{}
+				}
+				if active && len(lease.hostname) > 0 {
+					byIP[key] = len(leases)
+					leases = append(leases, *lease)
+				} else {
+					delete(byIP, key)
+				}
+			}
+			lease = nil
+		case parts[0] == "client-hostname" && len(parts) >= 2:
+			lease.hostname = dhcpHostname(parts[1])
+		case parts[0] == "binding" && len(parts) >= 3 && parts[1] == "state":
+			active = parts[2] == "active"
+		case parts[0] == "ends" && len(parts) >= 4:
+			if expiry, err := time.Parse("2006/01/02 15:04:05", parts[2]+" "+parts[3]); err == nil {
+				lease.expiry = expiry
+			}
+		}
+	}
+	compacted := leases[:0]
+	for _, lease := range leases {
+		if lease.ip != nil {
+			compacted = append(compacted, lease)
+		}
+	}
+	return compacted
+}
+
+// parseKeaLeases parses the CSV files of the Kea memfile lease backend
+func parseKeaLeases(content string) []DHCPLease {
+	reader := csv.NewReader(strings.NewReader(content))
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil && len(records) == 0 {
+		pluginsLog.Warnf("Unable to parse Kea leases: [%v]", err)
+		return nil
+	}
+	columns := make(map[string]int)
+	var leases []DHCPLease
+	for _, record := range records {
+		if len(record) > 0 && record[0] == "address" {
+			for i, column := range record {
+				columns[column] = i
+			}
+			continue
+		}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		ip := net.ParseIP(field("address"))
+		hostname := dhcpHostname(field("hostname"))
+		if ip == nil || len(hostname) == 0 || (field("state") != "" && field("state") != "0") {
+			continue
+		}
+		lease := DHCPLease{hostname: hostname, ip: ip}
+		if expiry, err := strconv.ParseInt(field("expire"), 10, 64); err == nil && expiry > 0 {
+			lease.expiry = time.Unix(expiry, 0)
+		}
+		leases = append(leases, lease)
+	}
+	return leases
+}
+
+func loadDHCPLeases(fileName string) ([]DHCPLease, error) {
+	content, err := ReadTextFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	switch detectDHCPLeaseFormat(content) {
+	case DHCPLeaseFormatKea:
+		return parseKeaLeases(content), nil
+	case DHCPLeaseFormatISC:
+		return parseISCLeases(content), nil
+	default:
+		return parseDnsmasqLeases(content), nil
+	}
+}
+
+type dhcpLeaseFileState struct {
+	modTime time.Time
+	size    int64
+}
+
+type PluginDHCPLeases struct {
+	sync.RWMutex
+	files  []string
+	suffix string
+	ttl    uint32
+	// hosts maps host names to their leases, and reverse maps reverse names to the leases of their address
+	hosts      map[string][]DHCPLease
+	reverse    map[string][]DHCPLease
+	fileStates map[string]dhcpLeaseFileState
+}
+
+func (plugin *PluginDHCPLeases) Name() string {
+	return "dhcp_leases"
+}
+
+func (plugin *PluginDHCPLeases) Description() string {
+	return "Resolve LAN hostnames using DHCP leases."
+}
+
+func (plugin *PluginDHCPLeases) Init(proxy *Proxy) error {
+	plugin.files = proxy.dhcpLeaseFiles
+	plugin.ttl = proxy.dhcpLeaseTTL
+	plugin.suffix = strings.ToLower(strings.Trim(proxy.dhcpLeaseSuffix, "."))
+	plugin.fileStates = make(map[string]dhcpLeaseFileState)
+	for _, fileName := range plugin.files {
+		pluginsLog.Noticef("Loading DHCP leases from [%s]", fileName)
+	}
+	plugin.refresh()
+	if proxy.dhcpLeaseRefreshInterval > 0 {
+		go func() {
+			for {
+				time.Sleep(proxy.dhcpLeaseRefreshInterval)
+				plugin.refresh()
+			}
+		}()
+	}
+	return nil
+}
+
+// refresh reloads the leases if any of the files changed
+func (plugin *PluginDHCPLeases) refresh() {
+	changed := false
+	for _, fileName := range plugin.files {
+		state := dhcpLeaseFileState{}
+		if st, err := os.Stat(fileName); err == nil {
+			state = dhcpLeaseFileState{modTime: st.ModTime(), size: st.Size()}
+		}
+		if previous, ok := plugin.fileStates[fileName]; !ok || !previous.modTime.Equal(state.modTime) || previous.size != state.size {
+			plugin.fileStates[fileName] = state
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	hosts := make(map[string][]DHCPLease)
+	reverse := make(map[string][]DHCPLease)
+	for _, fileName := range plugin.files {
+		leases, err := loadDHCPLeases(fileName)
+		if err != nil {
+			pluginsLog.Warnf("Unable to load DHCP leases from [%s]: [%v]", fileName, err)
+			continue
+		}
+		for _, lease := range leases {
+			name := lease.hostname
+			if len(plugin.suffix) > 0 {
+				name = name + "." + plugin.suffix
+			}
+			hosts[name] = append(hosts[name], lease)
+			if reverseName, err := dns.ReverseAddr(lease.ip.String()); err == nil {
+				reverseName = strings.TrimSuffix(reverseName, ".")
+				reverse[reverseName] = append(reverse[reverseName], lease)
+			}
+		}
+	}
+	pluginsLog.Infof("Loaded %d DHCP host names", len(hosts))
+	plugin.Lock()
+	plugin.hosts, plugin.reverse = hosts, reverse
+	plugin.Unlock()
+}
+
+func (plugin *PluginDHCPLeases) Drop() error {
+	return nil
+}
+
+func (plugin *PluginDHCPLeases) Reload() error {
+	return nil
+}
+
+func (plugin *PluginDHCPLeases) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	question := msg.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return nil
+	}
+	now := time.Now()
+	plugin.RLock()
+	leases, isHost := plugin.hosts[pluginsState.qName]
+	if !isHost {
+		leases = plugin.reverse[pluginsState.qName]
+	}
+	plugin.RUnlock()
+	var answers []dns.RR
+	found := false
+	for _, lease := range leases {
+		if lease.expired(now) {
+			continue
+		}
+		found = true
+		header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: lease.ttl(now, plugin.ttl)}
+		if !isHost {
+			if question.Qtype == dns.TypePTR {
+				name := lease.hostname
+				if len(plugin.suffix) > 0 {
+					name = name + "." + plugin.suffix
+				}
+				answers = append(answers, &dns.PTR{Hdr: header, Ptr: dns.Fqdn(name)})
+			}
+		} else if ipv4 := lease.ip.To4(); ipv4 != nil && question.Qtype == dns.TypeA {
+			answers = append(answers, &dns.A{Hdr: header, A: ipv4})
+		} else if ipv4 == nil && question.Qtype == dns.TypeAAAA {
+			answers = append(answers, &dns.AAAA{Hdr: header, AAAA: lease.ip})
+		}
+	}
+	if !found {
+		return nil
+	}
+	synth := EmptyResponseFromMessage(msg)
+	synth.Answer = answers
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestParseDHCPLeases(t *testing.T) {
+	c := check.T(t)
+
+	dnsmasq := "1700000000 aa:bb:cc:dd:ee:ff 192.168.1.10 NAS 01:aa:bb:cc:dd:ee:ff\n" +
+		"0 11:22:33:44:55:66 192.168.1.11 * *\n" +
+		"duid 00:01:00:01\n" +
+		"1700000000 1234 fd00::10 nas 00:01:00:01\n"
+	c.EQ(detectDHCPLeaseFormat(dnsmasq), DHCPLeaseFormatDnsmasq)
+	leases := parseDnsmasqLeases(dnsmasq)
+	c.Len(leases, 2)
+	c.EQ(leases[0].hostname, "nas")
+	c.EQ(leases[0].expiry.Unix(), int64(1700000000))
+	c.EQ(leases[1].ip.String(), "fd00::10")
+
+	isc := "# comment\nlease 192.168.1.20 {\n  starts 1 2024/01/01 00:00:00;\n  ends 1 2024/01/01 01:00:00;\n" +
+		"  binding state active;\n  next binding state free;\n  client-hostname \"printer\";\n}\n" +
+		"lease 192.168.1.21 {\n  ends never;\n  binding state active;\n  client-hostname \"tv\";\n}\n" +
+		"lease 192.168.1.21 {\n  binding state free;\n  client-hostname \"tv\";\n}\n"
+	c.EQ(detectDHCPLeaseFormat(isc), DHCPLeaseFormatISC)
+	leases = parseISCLeases(isc)
+	c.Len(leases, 1)
+	c.EQ(leases[0].hostname, "printer")
+	c.EQ(leases[0].expiry, time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC))
+
+	kea := "address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state\n" +
+		"192.168.1.30,aa:bb:cc:dd:ee:01,,3600,0,1,0,0,laptop.example.org.,0\n" +
+		"192.168.1.31,aa:bb:cc:dd:ee:02,,3600,0,1,0,0,phone,1\n"
+	c.EQ(detectDHCPLeaseFormat(kea), DHCPLeaseFormatKea)
+	leases = parseKeaLeases(kea)
+	c.Len(leases, 1)
+	c.EQ(leases[0].hostname, "laptop")
+	c.True(leases[0].expiry.IsZero())
+}
+
+func TestPluginDHCPLeases(t *testing.T) {
+	c := check.T(t)
+	leaseFile := filepath.Join(t.TempDir(), "dnsmasq.leases")
+	content := "0 aa:bb:cc:dd:ee:ff 192.168.1.10 nas *\n1 aa:bb:cc:dd:ee:00 192.168.1.12 old *\n"
+	c.Must(c.Nil(os.WriteFile(leaseFile, []byte(content), 0o600)))
+	plugin := new(PluginDHCPLeases)
+	c.Must(c.Nil(plugin.Init(&Proxy{dhcpLeaseFiles: []string{leaseFile}, dhcpLeaseSuffix: "lan.", dhcpLeaseTTL: 60})))
+
+	eval := func(name string, qType uint16) *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, qType)
+		qName, _ := NormalizeQName(name)
+		pluginsState := PluginsState{qName: qName, action: PluginsActionContinue}
+		c.Nil(plugin.Eval(&pluginsState, msg))
+		return pluginsState.synthResponse
+	}
+	resp := eval("nas.lan.", dns.TypeA)
+	c.Must(c.Len(resp.Answer, 1))
+	c.EQ(resp.Answer[0].(*dns.A).A.String(), "192.168.1.10")
+	c.EQ(resp.Answer[0].Header().Ttl, uint32(60))
+
+	resp = eval("nas.lan.", dns.TypeAAAA)
+	c.Len(resp.Answer, 0)
+
+	resp = eval("10.1.168.192.in-addr.arpa.", dns.TypePTR)
+	c.Must(c.Len(resp.Answer, 1))
+	c.EQ(resp.Answer[0].(*dns.PTR).Ptr, "nas.lan.")
+
+	c.Nil(eval("nas.", dns.TypeA))
+	c.Nil(eval("old.lan.", dns.TypeA))
+}
@@ -6,7 +6,6 @@
 	"sync"
 	"time"
 
-	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
 )
 
@@ -49,7 +48,7 @@ func (plugin *PluginDNS64) Init(proxy *Proxy) error {
 			if err != nil {
 				return err
 			}
-			dlog.Noticef("Registered DNS64 prefix [%s]", pref.String())
+			pluginsLog.Noticef("Registered DNS64 prefix [%s]", pref.String())
 			plugin.pref64 = append(plugin.pref64, pref)
 		}
 	} else if len(proxy.dns64Resolvers) != 0 {
@@ -60,7 +59,7 @@ func (plugin *PluginDNS64) Init(proxy *Proxy) error {
 	} else {
 		return nil
 	}
-	dlog.Notice("DNS64 map enabled")
+	pluginsLog.Notice("DNS64 map enabled")
 
 	return nil
 }
@@ -231,7 +230,7 @@ func (plugin *PluginDNS64) fetchPref64(resolver string) error {
 					if _, ok := uniqPrefixes[prefix.String()]; !ok {
 						prefixes = append(prefixes, prefix)
 						uniqPrefixes[prefix.String()] = struct{}{}
-						dlog.Infof("Registered DNS64 prefix [%s]", prefix.String())
+						pluginsLog.Infof("Registered DNS64 prefix [%s]", prefix.String())
 					}
 				}
 			}
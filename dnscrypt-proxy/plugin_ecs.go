@@ -4,7 +4,6 @@
 	"math/rand"
 	"net"
 
-	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
 )
 
@@ -22,7 +21,7 @@ func (plugin *PluginECS) Description() string {
 
 func (plugin *PluginECS) Init(proxy *Proxy) error {
 	plugin.nets = proxy.ednsClientSubnets
-	dlog.Notice("ECS plugin enabled")
+	pluginsLog.Notice("ECS plugin enabled")
 	return nil
 }
 
@@ -5,7 +5,6 @@
 import (
 	"strings"
 
-	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
 )
 
@@ -20,7 +19,7 @@ func (plugin *PluginFirefox) Description() string {
 }
 
 func (plugin *PluginFirefox) Init(proxy *Proxy) error {
-	dlog.Noticef("Firefox workaround initialized")
+	pluginsLog.Noticef("Firefox workaround initialized")
 	return nil
 }
 
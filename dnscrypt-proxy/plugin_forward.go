@@ -1,22 +1,45 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
 )
 
+// Servers from the resolver lists are referenced with this prefix, e.g. `@cloudflare`
+const forwardServerNamePrefix = "@"
+
+const (
+	ForwardStrategyRandom     = "random"
+	ForwardStrategyFailover   = "failover"
+	ForwardStrategyRoundRobin = "round_robin"
+)
+
 type PluginForwardEntry struct {
-	domain  string
-	servers []string
+	domain   string
+	servers  []string
+	strategy string
+	timeout  time.Duration
+	next     *atomic.Uint32
 }
 
 type PluginForward struct {
-	forwardMap []PluginForwardEntry
+	proxy                  *Proxy
+	forwardMap             []PluginForwardEntry
+	tcpPipelining          bool
+	qnameCaseRandomization bool
+	pipelinesMutex         sync.Mutex
+	pipelines              map[string]*TCPPipeline
+	downServersMutex       sync.Mutex
+	downServers            map[string]bool
 }
 
 func (plugin *PluginForward) Name() string {
@@ -28,7 +51,12 @@ func (plugin *PluginForward) Description() string {
 }
 
 func (plugin *PluginForward) Init(proxy *Proxy) error {
-	dlog.Noticef("Loading the set of forwarding rules from [%s]", proxy.forwardFile)
+	pluginsLog.Noticef("Loading the set of forwarding rules from [%s]", proxy.forwardFile)
+	plugin.proxy = proxy
+	plugin.tcpPipelining = proxy.tcpPipelining
+	plugin.qnameCaseRandomization = proxy.qnameCaseRandomization
+	plugin.pipelines = make(map[string]*TCPPipeline)
+	plugin.downServers = make(map[string]bool)
 	lines, err := ReadTextFile(proxy.forwardFile)
 	if err != nil {
 		return err
@@ -38,40 +66,94 @@ func (plugin *PluginForward) Init(proxy *Proxy) error {
 		if len(line) == 0 {
 			continue
 		}
-		domain, serversStr, ok := StringTwoFields(line)
-		if !ok {
-			return fmt.Errorf(
-				"Syntax error for a forwarding rule at line %d. Expected syntax: example.com 9.9.9.9,8.8.8.8",
-				1+lineNo,
-			)
-		}
-		domain = strings.ToLower(domain)
-		var servers []string
-		for _, server := range strings.Split(serversStr, ",") {
-			server = strings.TrimSpace(server)
-			server = strings.TrimPrefix(server, "[")
-			server = strings.TrimSuffix(server, "]")
-			if ip := net.ParseIP(server); ip != nil {
-				if ip.To4() != nil {
-					server = fmt.Sprintf("%s:%d", server, 53)
-				} else {
-					server = fmt.Sprintf("[%s]:%d", server, 53)
-				}
-			}
-			dlog.Infof("Forwarding [%s] to %s", domain, server)
-			servers = append(servers, server)
+		entry, err := parseForwardRule(line)
+		if err != nil {
+			return fmt.Errorf("%v for a forwarding rule at line %d", err, 1+lineNo)
 		}
-		if len(servers) == 0 {
+		if len(entry.servers) == 0 {
 			continue
 		}
-		plugin.forwardMap = append(plugin.forwardMap, PluginForwardEntry{
-			domain:  domain,
-			servers: servers,
-		})
+		for _, server := range entry.servers {
+			pluginsLog.Infof("Forwarding [%s] to %s", entry.domain, server)
+			if name := strings.TrimPrefix(server, forwardServerNamePrefix); name != server && !isRegisteredServer(proxy, name) {
+				pluginsLog.Warnf("Forwarding rule for [%s]: [%s] is not in the set of servers to use", entry.domain, name)
+			}
+		}
+		plugin.forwardMap = append(plugin.forwardMap, entry)
+	}
+	if proxy.forwardHealthCheckInterval > 0 && len(plugin.forwardMap) > 0 {
+		go func() {
+			for {
+				time.Sleep(proxy.forwardHealthCheckInterval)
+				plugin.checkServers(proxy.timeout)
+			}
+		}()
 	}
 	return nil
 }
 
+func isRegisteredServer(proxy *Proxy, name string) bool {
+	for _, registeredServer := range proxy.registeredServers {
+		if registeredServer.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardRule parses a line such as `example.com 9.9.9.9,8.8.8.8 strategy=failover timeout=500`.
+// Servers can also be names of servers from the resolver lists, such as `@cloudflare`.
+func parseForwardRule(line string) (PluginForwardEntry, error) {
+	entry := PluginForwardEntry{strategy: ForwardStrategyRandom, next: &atomic.Uint32{}}
+	domain, serversStr, ok := StringTwoFields(line)
+	if !ok {
+		return entry, errors.New("Syntax error. Expected syntax: example.com 9.9.9.9,8.8.8.8 [strategy=failover] [timeout=500]")
+	}
+	entry.domain = strings.ToLower(domain)
+	var serverParts []string
+	for _, part := range strings.Fields(serversStr) {
+		name, value, isOption := strings.Cut(part, "=")
+		if !isOption {
+			serverParts = append(serverParts, part)
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "strategy":
+			switch value {
+			case ForwardStrategyRandom, ForwardStrategyFailover, ForwardStrategyRoundRobin:
+				entry.strategy = value
+			default:
+				return entry, fmt.Errorf("Unsupported strategy [%s]", value)
+			}
+		case "timeout":
+			timeout, err := strconv.Atoi(value)
+			if err != nil || timeout <= 0 {
+				return entry, fmt.Errorf("Invalid timeout [%s]", value)
+			}
+			entry.timeout = time.Duration(timeout) * time.Millisecond
+		default:
+			return entry, fmt.Errorf("Unknown option [%s]", name)
+		}
+	}
+	for _, server := range strings.Split(strings.Join(serverParts, ""), ",") {
+		server = strings.TrimSpace(server)
+		server = strings.TrimPrefix(server, "[")
+		server = strings.TrimSuffix(server, "]")
+		if len(server) == 0 {
+			continue
+		}
+		if ip := net.ParseIP(server); ip != nil {
+			if ip.To4() != nil {
+				server = fmt.Sprintf("%s:%d", server, 53)
+			} else {
+				server = fmt.Sprintf("[%s]:%d", server, 53)
+			}
+		}
+		entry.servers = append(entry.servers, server)
+	}
+	return entry, nil
+}
+
 func (plugin *PluginForward) Drop() error {
 	return nil
 }
@@ -83,8 +165,8 @@ func (plugin *PluginForward) Reload() error {
 func (plugin *PluginForward) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	qName := pluginsState.qName
 	qNameLen := len(qName)
-	var servers []string
-	for _, candidate := range plugin.forwardMap {
+	var entry *PluginForwardEntry
+	for i, candidate := range plugin.forwardMap {
 		candidateLen := len(candidate.domain)
 		if candidateLen > qNameLen {
 			continue
@@ -92,33 +174,201 @@ func (plugin *PluginForward) Eval(pluginsState *PluginsState, msg *dns.Msg) erro
 		if (qName[qNameLen-candidateLen:] == candidate.domain &&
 			(candidateLen == qNameLen || (qName[qNameLen-candidateLen-1] == '.'))) ||
 			(candidate.domain == ".") {
-			servers = candidate.servers
+			entry = &plugin.forwardMap[i]
 			break
 		}
 	}
-	if len(servers) == 0 {
+	if entry == nil {
 		return nil
 	}
-	server := servers[rand.Intn(len(servers))]
-	pluginsState.serverName = server
-	client := dns.Client{Net: pluginsState.serverProto, Timeout: pluginsState.timeout}
-	respMsg, _, err := client.Exchange(msg, server)
-	if err != nil {
-		return err
+	timeout := pluginsState.timeout
+	if entry.timeout > 0 {
+		timeout = entry.timeout
 	}
-	if respMsg.Truncated {
-		client.Net = "tcp"
-		respMsg, _, err = client.Exchange(msg, server)
-		if err != nil {
-			return err
+	var respMsg *dns.Msg
+	var err error
+	for _, server := range plugin.candidates(entry) {
+		pluginsState.serverName = strings.TrimPrefix(server, forwardServerNamePrefix)
+		if strings.HasPrefix(server, forwardServerNamePrefix) {
+			respMsg, err = plugin.exchangeWithNamedServer(pluginsState, msg, pluginsState.serverName)
+		} else {
+			respMsg, err = plugin.exchange(msg, server, pluginsState.serverProto, timeout)
 		}
+		if err == nil {
+			plugin.setServerUp(server, true)
+			break
+		}
+		if errors.Is(err, ErrQNameCaseMismatch) {
+			pluginsLog.Debugf("Discarding the response from [%s]: %v", server, err)
+		} else {
+			plugin.setServerUp(server, false)
+		}
+	}
+	if err != nil {
+		return err
 	}
 	if edns0 := respMsg.IsEdns0(); edns0 == nil || !edns0.Do() {
 		respMsg.AuthenticatedData = false
 	}
 	respMsg.Id = msg.Id
+	respMsg.Compress = true
 	pluginsState.synthResponse = respMsg
 	pluginsState.action = PluginsActionSynth
 	pluginsState.returnCode = PluginsReturnCodeForward
 	return nil
 }
+
+// candidates returns the servers of a rule in the order they should be tried.
+// The first server depends on the strategy; servers that are down are only tried after the other ones.
+func (plugin *PluginForward) candidates(entry *PluginForwardEntry) []string {
+	count := len(entry.servers)
+	first := 0
+	switch entry.strategy {
+	case ForwardStrategyRoundRobin:
+		first = int((entry.next.Add(1) - 1) % uint32(count))
+	case ForwardStrategyRandom:
+		first = rand.Intn(count)
+	}
+	up := make([]string, 0, count)
+	var down []string
+	plugin.downServersMutex.Lock()
+	for i := 0; i < count; i++ {
+		server := entry.servers[(first+i)%count]
+		if plugin.downServers[server] {
+			down = append(down, server)
+		} else {
+			up = append(up, server)
+		}
+	}
+	plugin.downServersMutex.Unlock()
+	return append(up, down...)
+}
+
+func (plugin *PluginForward) setServerUp(server string, up bool) {
+	plugin.downServersMutex.Lock()
+	wasDown := plugin.downServers[server]
+	if up {
+		delete(plugin.downServers, server)
+	} else {
+		plugin.downServers[server] = true
+	}
+	plugin.downServersMutex.Unlock()
+	if up && wasDown {
+		pluginsLog.Noticef("Forwarding server [%s] is up again", server)
+	} else if !up && !wasDown {
+		pluginsLog.Warnf("Forwarding server [%s] is not responding", server)
+	}
+}
+
+// checkServers sends a SOA query for the domain of every rule to its servers, and updates their status
+func (plugin *PluginForward) checkServers(defaultTimeout time.Duration) {
+	for _, entry := range plugin.forwardMap {
+		timeout := defaultTimeout
+		if entry.timeout > 0 {
+			timeout = entry.timeout
+		}
+		probe := new(dns.Msg)
+		probe.SetQuestion(dns.Fqdn(entry.domain), dns.TypeSOA)
+		for _, server := range entry.servers {
+			if strings.HasPrefix(server, forwardServerNamePrefix) {
+				// Servers from the resolver lists have their own health checks
+				continue
+			}
+			client := dns.Client{Net: "udp", Timeout: timeout}
+			respMsg, _, err := client.Exchange(probe, server)
+			plugin.setServerUp(server, err == nil && respMsg.Rcode != dns.RcodeServerFailure && respMsg.Rcode != dns.RcodeRefused)
+		}
+	}
+}
+
+// exchangeWithNamedServer sends a query to a server from the resolver lists, using its own protocol
+func (plugin *PluginForward) exchangeWithNamedServer(pluginsState *PluginsState, msg *dns.Msg, name string) (*dns.Msg, error) {
+	serverInfo := plugin.proxy.serversInfo.getByName(name)
+	if serverInfo == nil {
+		return nil, fmt.Errorf("Server [%s] is not available", name)
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	serverInfo.noticeBegin(plugin.proxy)
+	response, err := plugin.proxy.exchangeWithServer(pluginsState, serverInfo, query, pluginsState.serverProto)
+	if err != nil {
+		serverInfo.noticeFailure(plugin.proxy)
+		return nil, err
+	}
+	respMsg := dns.Msg{}
+	if err := respMsg.Unpack(response); err != nil {
+		serverInfo.noticeFailure(plugin.proxy)
+		return nil, err
+	}
+	serverInfo.noticeSuccess(plugin.proxy)
+	return &respMsg, nil
+}
+
+func (plugin *PluginForward) exchange(msg *dns.Msg, server string, proto string, timeout time.Duration) (*dns.Msg, error) {
+	query := msg
+	if plugin.qnameCaseRandomization {
+		query = randomizeQNameCase(msg)
+	}
+	var respMsg *dns.Msg
+	var err error
+	if proto == "tcp" && plugin.tcpPipelining {
+		respMsg, err = plugin.exchangeOverPipeline(query, server, timeout)
+	} else {
+		client := dns.Client{Net: proto, Timeout: timeout}
+		respMsg, _, err = client.Exchange(query, server)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if respMsg.Truncated {
+		if plugin.tcpPipelining {
+			respMsg, err = plugin.exchangeOverPipeline(query, server, timeout)
+		} else {
+			client := dns.Client{Net: "tcp", Timeout: timeout}
+			respMsg, _, err = client.Exchange(query, server)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if plugin.qnameCaseRandomization {
+		if err := restoreQNameCase(respMsg, query.Question[0].Name, msg.Question[0].Name); err != nil {
+			return nil, err
+		}
+	}
+	return respMsg, nil
+}
+
+// exchangeOverPipeline sends a query over a persistent TCP connection shared with other queries to the same server.
+// Queries get a random transaction ID, so that responses can be matched even if clients use the same IDs.
+func (plugin *PluginForward) exchangeOverPipeline(msg *dns.Msg, server string, timeout time.Duration) (*dns.Msg, error) {
+	plugin.pipelinesMutex.Lock()
+	pipeline, ok := plugin.pipelines[server]
+	if !ok {
+		pipeline = NewTCPPipeline(func() (net.Conn, error) {
+			return outboundDialer(timeout).Dial("tcp", server)
+		}, func(packet []byte) (string, bool) {
+			return string(packet[0:2]), true
+		})
+		plugin.pipelines[server] = pipeline
+	}
+	plugin.pipelinesMutex.Unlock()
+
+	query := msg.Copy()
+	query.Id = dns.Id()
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	response, err := pipeline.Exchange(packet, string(packet[0:2]), timeout)
+	if err != nil {
+		return nil, err
+	}
+	respMsg := dns.Msg{}
+	if err := respMsg.Unpack(response); err != nil {
+		return nil, err
+	}
+	return &respMsg, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestParseForwardRule(t *testing.T) {
+	c := check.T(t)
+	entry, err := parseForwardRule("Example.com 9.9.9.9, [2001:db8::1] ,192.0.2.1:5353")
+	c.Nil(err)
+	c.EQ(entry.domain, "example.com")
+	c.DeepEqual(entry.servers, []string{"9.9.9.9:53", "[2001:db8::1]:53", "192.0.2.1:5353"})
+	c.EQ(entry.strategy, ForwardStrategyRandom)
+	c.EQ(entry.timeout, time.Duration(0))
+
+	entry, err = parseForwardRule("corp.example 10.0.0.1,10.0.0.2 strategy=failover timeout=500")
+	c.Nil(err)
+	c.DeepEqual(entry.servers, []string{"10.0.0.1:53", "10.0.0.2:53"})
+	c.EQ(entry.strategy, ForwardStrategyFailover)
+	c.EQ(entry.timeout, 500*time.Millisecond)
+
+	_, err = parseForwardRule("corp.example 10.0.0.1 strategy=fastest")
+	c.NotNil(err)
+	_, err = parseForwardRule("corp.example 10.0.0.1 timeout=0")
+	c.NotNil(err)
+	_, err = parseForwardRule("corp.example 10.0.0.1 retries=3")
+	c.NotNil(err)
+	_, err = parseForwardRule("corp.example")
+	c.NotNil(err)
+}
+
+func TestPluginForwardCandidates(t *testing.T) {
+	c := check.T(t)
+	plugin := PluginForward{downServers: make(map[string]bool)}
+	entry, err := parseForwardRule("corp.example 10.0.0.1,10.0.0.2,10.0.0.3 strategy=failover")
+	c.Nil(err)
+	c.DeepEqual(plugin.candidates(&entry), []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"})
+	plugin.setServerUp("10.0.0.1:53", false)
+	c.DeepEqual(plugin.candidates(&entry), []string{"10.0.0.2:53", "10.0.0.3:53", "10.0.0.1:53"})
+	plugin.setServerUp("10.0.0.1:53", true)
+	c.DeepEqual(plugin.candidates(&entry), []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"})
+
+	entry, err = parseForwardRule("corp.example 10.0.0.1,10.0.0.2,10.0.0.3 strategy=round_robin")
+	c.Nil(err)
+	c.DeepEqual(plugin.candidates(&entry), []string{"10.0.0.1:53", "10.0.0.2:53", "10.0.0.3:53"})
+	c.DeepEqual(plugin.candidates(&entry), []string{"10.0.0.2:53", "10.0.0.3:53", "10.0.0.1:53"})
+	c.DeepEqual(plugin.candidates(&entry), []string{"10.0.0.3:53", "10.0.0.1:53", "10.0.0.2:53"})
+}
+
+func TestParseForwardRuleServerNames(t *testing.T) {
+	c := check.T(t)
+	entry, err := parseForwardRule("corp.example @corp-doh,10.0.0.1 strategy=failover")
+	c.Nil(err)
+	c.DeepEqual(entry.servers, []string{"@corp-doh", "10.0.0.1:53"})
+}
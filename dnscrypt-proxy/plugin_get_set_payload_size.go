@@ -2,7 +2,9 @@
 
 import "github.com/miekg/dns"
 
-type PluginGetSetPayloadSize struct{}
+type PluginGetSetPayloadSize struct {
+	upstreamUDPSize int
+}
 
 func (plugin *PluginGetSetPayloadSize) Name() string {
 	return "get_set_payload_size"
@@ -13,6 +15,7 @@ func (plugin *PluginGetSetPayloadSize) Description() string {
 }
 
 func (plugin *PluginGetSetPayloadSize) Init(proxy *Proxy) error {
+	plugin.upstreamUDPSize = proxy.ednsUpstreamUDPSize
 	return nil
 }
 
@@ -29,9 +32,8 @@ func (plugin *PluginGetSetPayloadSize) Eval(pluginsState *PluginsState, msg *dns
 	edns0 := msg.IsEdns0()
 	dnssec := false
 	if edns0 != nil {
-		pluginsState.maxUnencryptedUDPSafePayloadSize = int(edns0.UDPSize())
 		pluginsState.originalMaxPayloadSize = Max(
-			pluginsState.maxUnencryptedUDPSafePayloadSize-ResponseOverhead,
+			int(edns0.UDPSize())-ResponseOverhead,
 			pluginsState.originalMaxPayloadSize,
 		)
 		dnssec = edns0.Do()
@@ -39,7 +41,7 @@ func (plugin *PluginGetSetPayloadSize) Eval(pluginsState *PluginsState, msg *dns
 	var options *[]dns.EDNS0
 	pluginsState.dnssec = dnssec
 	pluginsState.maxPayloadSize = Min(
-		MaxDNSUDPPacketSize-ResponseOverhead,
+		plugin.upstreamUDPSize-ResponseOverhead,
 		Max(pluginsState.originalMaxPayloadSize, pluginsState.maxPayloadSize),
 	)
 	if pluginsState.maxPayloadSize > 512 {
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// localZoneMaxCNAMEChain is the maximum number of in-zone CNAME records followed to answer a query
+const localZoneMaxCNAMEChain = 8
+
+// LocalZone is an authoritative zone loaded from a standard zone file
+type LocalZone struct {
+	origin string
+	soa    *dns.SOA
+	// records maps lowercase, fully qualified owner names to their record sets
+	records map[string]map[uint16][]dns.RR
+	// names contains the owner names as well as the empty non-terminals
+	names map[string]bool
+}
+
+// LoadLocalZone parses a zone file; the zone apex is the owner of the SOA record
+func LoadLocalZone(fileName string) (*LocalZone, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	zone := LocalZone{records: make(map[string]map[uint16][]dns.RR), names: make(map[string]bool)}
+	parser := dns.NewZoneParser(file, "", fileName)
+	parser.SetIncludeAllowed(false)
+	var rrs []dns.RR
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		if rr.Header().Class != dns.ClassINET {
+			continue
+		}
+		rr.Header().Name = strings.ToLower(rr.Header().Name)
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			if zone.soa != nil {
+				return nil, fmt.Errorf("Multiple SOA records in [%s]", fileName)
+			}
+			zone.soa = soa
+			zone.origin = soa.Hdr.Name
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, err
+	}
+	if zone.soa == nil {
+		return nil, fmt.Errorf("No SOA record in [%s]", fileName)
+	}
+	for _, rr := range rrs {
+		name := rr.Header().Name
+		if !dns.IsSubDomain(zone.origin, name) {
+			pluginsLog.Warnf("Ignoring [%s] in [%s]: out of zone [%s]", name, fileName, zone.origin)
+			continue
+		}
+		rrsets, ok := zone.records[name]
+		if !ok {
+			rrsets = make(map[uint16][]dns.RR)
+			zone.records[name] = rrsets
+		}
+		rrsets[rr.Header().Rrtype] = append(rrsets[rr.Header().Rrtype], rr)
+		for ; len(name) >= len(zone.origin); name = parentName(name) {
+			zone.names[name] = true
+		}
+	}
+	return &zone, nil
+}
+
+func parentName(name string) string {
+	if off, end := dns.NextLabel(name, 0); !end {
+		return name[off:]
+	}
+	return ""
+}
+
+// negativeTTL returns the TTL of negative answers, as defined in RFC 2308
+func (zone *LocalZone) negativeTTL() uint32 {
+	return min(zone.soa.Hdr.Ttl, zone.soa.Minttl)
+}
+
+// delegation returns the NS records of the closest zone cut above or at `name`, if any
+func (zone *LocalZone) delegation(name string) (string, []dns.RR) {
+	var cut string
+	var nsRRs []dns.RR
+	for ; len(name) > len(zone.origin); name = parentName(name) {
+		if ns, ok := zone.records[name][dns.TypeNS]; ok {
+			cut, nsRRs = name, ns
+		}
+	}
+	return cut, nsRRs
+}
+
+// glue returns the addresses of in-zone name servers
+func (zone *LocalZone) glue(nsRRs []dns.RR) []dns.RR {
+	var extra []dns.RR
+	for _, rr := range nsRRs {
+		target := strings.ToLower(rr.(*dns.NS).Ns)
+		extra = append(extra, zone.records[target][dns.TypeA]...)
+		extra = append(extra, zone.records[target][dns.TypeAAAA]...)
+	}
+	return extra
+}
+
+func (zone *LocalZone) soaAuthority() []dns.RR {
+	soa := dns.Copy(zone.soa).(*dns.SOA)
+	soa.Hdr.Ttl = zone.negativeTTL()
+	return []dns.RR{soa}
+}
+
+// resolve fills in the answer to a query for a name within the zone
+func (zone *LocalZone) resolve(synth *dns.Msg, qName string, ownerName string, qType uint16) {
+	synth.Authoritative = true
+	if cut, nsRRs := zone.delegation(qName); nsRRs != nil && !(cut == qName && qType == dns.TypeDS) {
+		synth.Authoritative = false
+		synth.Ns = nsRRs
+		synth.Extra = append(synth.Extra, zone.glue(nsRRs)...)
+		return
+	}
+	rrsets, found := zone.records[qName]
+	if !found && !zone.names[qName] {
+		for encloser := parentName(qName); len(encloser) >= len(zone.origin); encloser = parentName(encloser) {
+			if zone.names[encloser] {
+				rrsets, found = zone.records["*."+encloser]
+				break
+			}
+		}
+		if !found {
+			synth.Rcode = dns.RcodeNameError
+			synth.Ns = zone.soaAuthority()
+			return
+		}
+	}
+	var answers []dns.RR
+	switch {
+	case qType == dns.TypeANY:
+		for _, rrset := range rrsets {
+			answers = append(answers, rrset...)
+		}
+	case rrsets[qType] != nil:
+		answers = rrsets[qType]
+	case rrsets[dns.TypeCNAME] != nil:
+		answers = rrsets[dns.TypeCNAME]
+	}
+	if len(answers) == 0 {
+		synth.Ns = zone.soaAuthority()
+		return
+	}
+	for _, rr := range answers {
+		rr = dns.Copy(rr)
+		rr.Header().Name = ownerName
+		synth.Answer = append(synth.Answer, rr)
+	}
+	if qType == dns.TypeNS && qName == zone.origin {
+		synth.Extra = append(synth.Extra, zone.glue(answers)...)
+	}
+	if cname, ok := answers[0].(*dns.CNAME); ok && qType != dns.TypeCNAME && qType != dns.TypeANY &&
+		len(synth.Answer) < localZoneMaxCNAMEChain {
+		target := strings.ToLower(cname.Target)
+		if dns.IsSubDomain(zone.origin, target) {
+			zone.resolve(synth, target, target, qType)
+		}
+	}
+}
+
+type PluginLocalZones struct {
+	zones []*LocalZone
+}
+
+func (plugin *PluginLocalZones) Name() string {
+	return "local_zones"
+}
+
+func (plugin *PluginLocalZones) Description() string {
+	return "Serve authoritative zones loaded from zone files."
+}
+
+func (plugin *PluginLocalZones) Init(proxy *Proxy) error {
+	origins := make(map[string]string)
+	for _, fileName := range proxy.localZoneFiles {
+		pluginsLog.Noticef("Loading the local zone from [%s]", fileName)
+		zone, err := LoadLocalZone(fileName)
+		if err != nil {
+			return err
+		}
+		if previous, ok := origins[zone.origin]; ok {
+			return fmt.Errorf("Zone [%s] is defined in both [%s] and [%s]", zone.origin, previous, fileName)
+		}
+		origins[zone.origin] = fileName
+		plugin.zones = append(plugin.zones, zone)
+	}
+	if len(plugin.zones) == 0 {
+		return errors.New("No local zones to serve")
+	}
+	return nil
+}
+
+func (plugin *PluginLocalZones) Drop() error {
+	return nil
+}
+
+func (plugin *PluginLocalZones) Reload() error {
+	return nil
+}
+
+// zoneFor returns the most specific zone `qName` belongs to
+func (plugin *PluginLocalZones) zoneFor(qName string) *LocalZone {
+	var found *LocalZone
+	for _, zone := range plugin.zones {
+		if dns.IsSubDomain(zone.origin, qName) && (found == nil || len(zone.origin) > len(found.origin)) {
+			found = zone
+		}
+	}
+	return found
+}
+
+func (plugin *PluginLocalZones) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	question := msg.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return nil
+	}
+	qName := dns.Fqdn(pluginsState.qName)
+	zone := plugin.zoneFor(qName)
+	if zone == nil {
+		return nil
+	}
+	synth := EmptyResponseFromMessage(msg)
+	zone.resolve(synth, qName, question.Name, question.Qtype)
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	return nil
+}
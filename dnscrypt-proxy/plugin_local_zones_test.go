@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+const testLocalZone = `$ORIGIN lan.
+$TTL 3600
+@        IN SOA ns.lan. hostmaster.lan. 1 3600 600 86400 300
+@        IN NS  ns.lan.
+ns       IN A   192.168.1.1
+nas      IN A   192.168.1.10
+www      IN CNAME nas
+*.dyn    IN A   192.168.1.20
+a.b.deep IN TXT "deep"
+sub      IN NS  ns.sub.lan.
+ns.sub   IN A   192.168.2.1
+`
+
+func evalLocalZone(c *check.C, plugin *PluginLocalZones, name string, qType uint16) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, qType)
+	qName, err := NormalizeQName(name)
+	c.Must(c.Nil(err))
+	pluginsState := PluginsState{qName: qName, action: PluginsActionContinue}
+	c.Nil(plugin.Eval(&pluginsState, msg))
+	if pluginsState.action != PluginsActionSynth {
+		return nil
+	}
+	return pluginsState.synthResponse
+}
+
+func TestPluginLocalZones(t *testing.T) {
+	c := check.T(t)
+	zoneFile := filepath.Join(t.TempDir(), "lan.zone")
+	c.Must(c.Nil(os.WriteFile(zoneFile, []byte(testLocalZone), 0o600)))
+	plugin := new(PluginLocalZones)
+	c.Must(c.Nil(plugin.Init(&Proxy{localZoneFiles: []string{zoneFile}})))
+
+	c.Nil(evalLocalZone(c, plugin, "example.com.", dns.TypeA))
+
+	resp := evalLocalZone(c, plugin, "NAS.lan.", dns.TypeA)
+	c.True(resp.Authoritative)
+	c.Len(resp.Answer, 1)
+	c.EQ(resp.Answer[0].Header().Name, "NAS.lan.")
+	c.EQ(resp.Answer[0].(*dns.A).A.String(), "192.168.1.10")
+
+	resp = evalLocalZone(c, plugin, "www.lan.", dns.TypeA)
+	c.Len(resp.Answer, 2)
+	c.EQ(resp.Answer[0].Header().Rrtype, dns.TypeCNAME)
+	c.EQ(resp.Answer[1].(*dns.A).A.String(), "192.168.1.10")
+
+	resp = evalLocalZone(c, plugin, "nas.lan.", dns.TypeAAAA)
+	c.EQ(resp.Rcode, dns.RcodeSuccess)
+	c.Len(resp.Answer, 0)
+	c.Len(resp.Ns, 1)
+	c.EQ(resp.Ns[0].Header().Ttl, uint32(300))
+
+	resp = evalLocalZone(c, plugin, "missing.lan.", dns.TypeA)
+	c.EQ(resp.Rcode, dns.RcodeNameError)
+	c.EQ(resp.Ns[0].Header().Rrtype, dns.TypeSOA)
+
+	resp = evalLocalZone(c, plugin, "deep.lan.", dns.TypeA)
+	c.EQ(resp.Rcode, dns.RcodeSuccess)
+
+	resp = evalLocalZone(c, plugin, "host.dyn.lan.", dns.TypeA)
+	c.Len(resp.Answer, 1)
+	c.EQ(resp.Answer[0].Header().Name, "host.dyn.lan.")
+
+	resp = evalLocalZone(c, plugin, "host.sub.lan.", dns.TypeA)
+	c.False(resp.Authoritative)
+	c.Len(resp.Answer, 0)
+	c.Len(resp.Ns, 1)
+	c.Len(resp.Extra, 1)
+
+	resp = evalLocalZone(c, plugin, "lan.", dns.TypeSOA)
+	c.Len(resp.Answer, 1)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const mdnsCacheFlushBit = 1 << 15
+
+var (
+	mdnsIPv4Addr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+	mdnsIPv6Addr = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: 5353}
+)
+
+// PluginMDNS resolves `.local` names with multicast DNS, for clients that don't do mDNS themselves.
+// Queries are sent from an ephemeral port, so that responders answer them directly, as described
+// in RFC 6762 section 6.7.
+type PluginMDNS struct {
+	timeout time.Duration
+	iface   *net.Interface
+	ipv6    bool
+}
+
+type mdnsResult struct {
+	answers []dns.RR
+	exists  bool
+}
+
+func (plugin *PluginMDNS) Name() string {
+	return "mdns"
+}
+
+func (plugin *PluginMDNS) Description() string {
+	return "Resolve .local names using multicast DNS."
+}
+
+func (plugin *PluginMDNS) Init(proxy *Proxy) error {
+	plugin.timeout = proxy.mdnsTimeout
+	plugin.ipv6 = proxy.mdnsIPv6
+	if len(proxy.mdnsInterface) > 0 {
+		iface, err := net.InterfaceByName(proxy.mdnsInterface)
+		if err != nil {
+			return err
+		}
+		plugin.iface = iface
+	}
+	return nil
+}
+
+func (plugin *PluginMDNS) Drop() error {
+	return nil
+}
+
+func (plugin *PluginMDNS) Reload() error {
+	return nil
+}
+
+func (plugin *PluginMDNS) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	question := msg.Question[0]
+	if question.Qclass != dns.ClassINET || !strings.HasSuffix(pluginsState.qName, ".local") {
+		return nil
+	}
+	result := plugin.resolve(dns.Question{Name: question.Name, Qtype: question.Qtype, Qclass: dns.ClassINET})
+	synth := EmptyResponseFromMessage(msg)
+	if len(result.answers) == 0 && !result.exists {
+		synth.Rcode = dns.RcodeNameError
+	}
+	synth.Answer = result.answers
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	return nil
+}
+
+// resolve queries all the configured networks, and returns the first positive response
+func (plugin *PluginMDNS) resolve(question dns.Question) mdnsResult {
+	networks := []string{"udp4"}
+	if plugin.ipv6 {
+		networks = append(networks, "udp6")
+	}
+	results := make(chan mdnsResult, len(networks))
+	for _, network := range networks {
+		go func(network string) {
+			result, err := plugin.query(network, question)
+			if err != nil {
+				pluginsLog.Debugf("mDNS query for [%s] over %s failed: [%v]", question.Name, network, err)
+			}
+			results <- result
+		}(network)
+	}
+	merged := mdnsResult{}
+	for range networks {
+		result := <-results
+		if len(result.answers) > 0 {
+			return result
+		}
+		merged.exists = merged.exists || result.exists
+	}
+	return merged
+}
+
+func (plugin *PluginMDNS) query(network string, question dns.Question) (mdnsResult, error) {
+	result := mdnsResult{}
+	query := new(dns.Msg)
+	query.Id = dns.Id()
+	query.Question = []dns.Question{question}
+	packet, err := query.Pack()
+	if err != nil {
+		return result, err
+	}
+	conn, err := net.ListenUDP(network, nil)
+	if err != nil {
+		return result, err
+	}
+	defer conn.Close()
+	dst := mdnsIPv4Addr
+	if network == "udp6" {
+		dst = &net.UDPAddr{IP: mdnsIPv6Addr.IP, Port: mdnsIPv6Addr.Port}
+		if plugin.iface != nil {
+			dst.Zone = plugin.iface.Name
+			if err := ipv6.NewPacketConn(conn).SetMulticastInterface(plugin.iface); err != nil {
+				return result, err
+			}
+		}
+	} else if plugin.iface != nil {
+		if err := ipv4.NewPacketConn(conn).SetMulticastInterface(plugin.iface); err != nil {
+			return result, err
+		}
+	}
+	if _, err := conn.WriteTo(packet, dst); err != nil {
+		return result, err
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(plugin.timeout)); err != nil {
+		return result, err
+	}
+	buf := make([]byte, MaxDNSUDPPacketSize)
+	for {
+		length, err := conn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return result, nil
+			}
+			return result, err
+		}
+		response := new(dns.Msg)
+		if response.Unpack(buf[:length]) != nil || !response.Response || response.Id != query.Id {
+			continue
+		}
+		for _, rr := range response.Extra {
+			result.exists = result.exists || strings.EqualFold(rr.Header().Name, question.Name)
+		}
+		for _, rr := range response.Answer {
+			header := rr.Header()
+			if !strings.EqualFold(header.Name, question.Name) {
+				continue
+			}
+			// Any record, including an NSEC record denying the other types, proves that the name exists
+			result.exists = true
+			if header.Rrtype == dns.TypeNSEC ||
+				(header.Rrtype != question.Qtype && header.Rrtype != dns.TypeCNAME && question.Qtype != dns.TypeANY) {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = question.Name
+			rr.Header().Class &^= mdnsCacheFlushBit
+			result.answers = append(result.answers, rr)
+		}
+		if len(result.answers) > 0 {
+			return result, nil
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// PluginMinimizeAny answers ANY queries with a single HINFO record, as described in RFC 8482
+type PluginMinimizeAny struct{}
+
+func (plugin *PluginMinimizeAny) Name() string {
+	return "minimize_any"
+}
+
+func (plugin *PluginMinimizeAny) Description() string {
+	return "Immediately return a minimal response to ANY queries."
+}
+
+func (plugin *PluginMinimizeAny) Init(proxy *Proxy) error {
+	return nil
+}
+
+func (plugin *PluginMinimizeAny) Drop() error {
+	return nil
+}
+
+func (plugin *PluginMinimizeAny) Reload() error {
+	return nil
+}
+
+func (plugin *PluginMinimizeAny) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	question := msg.Question[0]
+	if question.Qclass != dns.ClassINET || question.Qtype != dns.TypeANY {
+		return nil
+	}
+	synth := EmptyResponseFromMessage(msg)
+	hinfo := new(dns.HINFO)
+	hinfo.Hdr = dns.RR_Header{
+		Name: question.Name, Rrtype: dns.TypeHINFO,
+		Class: dns.ClassINET, Ttl: 86400,
+	}
+	hinfo.Cpu = "RFC8482"
+	synth.Answer = []dns.RR{hinfo}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	pluginsState.returnCode = PluginsReturnCodeSynth
+	return nil
+}
@@ -4,16 +4,19 @@
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"time"
 
 	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
 )
 
+const NxLogTimeout = "TIMEOUT"
+
 type PluginNxLog struct {
-	logger io.Writer
-	format string
+	logger  io.Writer
+	format  string
+	rcodes  map[int]bool
+	timeout bool
 }
 
 func (plugin *PluginNxLog) Name() string {
@@ -21,18 +24,30 @@ func (plugin *PluginNxLog) Name() string {
 }
 
 func (plugin *PluginNxLog) Description() string {
-	return "Log DNS queries for nonexistent zones."
+	return "Log DNS queries for nonexistent zones, and optionally server errors."
 }
 
 func (plugin *PluginNxLog) Init(proxy *Proxy) error {
-	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.nxLogFile)
+	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.logRotation, proxy.logCompression, proxy.nxLogFile)
 	plugin.format = proxy.nxLogFormat
+	plugin.rcodes = make(map[int]bool)
+	for _, returnCode := range proxy.nxLogReturnCodes {
+		if returnCode == NxLogTimeout {
+			plugin.timeout = true
+			continue
+		}
+		rcode, ok := dns.StringToRcode[returnCode]
+		if !ok {
+			return fmt.Errorf("Unsupported return code in nx_log: [%s]", returnCode)
+		}
+		plugin.rcodes[rcode] = true
+	}
 
 	return nil
 }
 
 func (plugin *PluginNxLog) Drop() error {
-	return nil
+	return closeLogger(plugin.logger)
 }
 
 func (plugin *PluginNxLog) Reload() error {
@@ -40,16 +55,15 @@ func (plugin *PluginNxLog) Reload() error {
 }
 
 func (plugin *PluginNxLog) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
-	if msg.Rcode != dns.RcodeNameError {
+	if !plugin.rcodes[msg.Rcode] {
 		return nil
 	}
-	var clientIPStr string
-	switch pluginsState.clientProto {
-	case "udp":
-		clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
-	case "tcp", "local_doh":
-		clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
-	default:
+	return plugin.log(pluginsState, msg, dns.RcodeToString[msg.Rcode])
+}
+
+func (plugin *PluginNxLog) log(pluginsState *PluginsState, msg *dns.Msg, returnCode string) error {
+	clientIPStr, ok := ExtractLoggedClientIPStr(pluginsState)
+	if !ok {
 		// Ignore internal flow.
 		return nil
 	}
@@ -60,23 +74,66 @@ func (plugin *PluginNxLog) Eval(pluginsState *PluginsState, msg *dns.Msg) error
 	}
 	qName := pluginsState.qName
 
+	// NXDOMAIN lines are kept in their original form, other outcomes also include the server
 	var line string
 	if plugin.format == "tsv" {
 		now := time.Now()
 		year, month, day := now.Date()
 		hour, minute, second := now.Clock()
 		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
-		line = fmt.Sprintf("%s\t%s\t%s\t%s\n", tsStr, clientIPStr, StringQuote(qName), qType)
+		line = fmt.Sprintf("%s\t%s\t%s\t%s", tsStr, clientIPStr, NameQuote(qName), qType)
+		if returnCode != "NXDOMAIN" {
+			line += fmt.Sprintf("\t%s\t%s", returnCode, StringQuote(pluginsState.serverName))
+		}
 	} else if plugin.format == "ltsv" {
-		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s\n",
-			time.Now().Unix(), clientIPStr, StringQuote(qName), qType)
+		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s",
+			time.Now().Unix(), clientIPStr, NameQuote(qName), qType)
+		if returnCode != "NXDOMAIN" {
+			line += fmt.Sprintf("\treturn:%s\tserver:%s", returnCode, StringQuote(pluginsState.serverName))
+		}
 	} else {
 		dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
 	}
+	line += "\n"
 	if plugin.logger == nil {
 		return errors.New("Log file not initialized")
 	}
-	_, _ = plugin.logger.Write([]byte(line))
+	_, _ = plugin.logger.Write([]byte(pluginsState.withQueryID(line, plugin.format)))
+
+	return nil
+}
+
+// ---
+
+// PluginNxLogTimeout logs queries that timed out using the nx_log plugin.
+// Timeouts don't go through response plugins, so this is a logging plugin.
+type PluginNxLogTimeout struct {
+	nxLog *PluginNxLog
+}
+
+func (plugin *PluginNxLogTimeout) Name() string {
+	return "nx_log_timeout"
+}
+
+func (plugin *PluginNxLogTimeout) Description() string {
+	return "Log DNS queries that timed out."
+}
 
+func (plugin *PluginNxLogTimeout) Init(proxy *Proxy) error {
 	return nil
 }
+
+func (plugin *PluginNxLogTimeout) Drop() error {
+	return nil
+}
+
+func (plugin *PluginNxLogTimeout) Reload() error {
+	return nil
+}
+
+func (plugin *PluginNxLogTimeout) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if !plugin.nxLog.timeout || pluginsState.returnCode != PluginsReturnCodeServerTimeout {
+		return nil
+	}
+	return plugin.nxLog.log(pluginsState, msg, NxLogTimeout)
+}
@@ -3,8 +3,7 @@
 import (
 	"errors"
 	"fmt"
-	"io"
-	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -13,9 +12,11 @@
 )
 
 type PluginQueryLog struct {
-	logger        io.Writer
+	logger        *ListenerLogger
 	format        string
 	ignoredQtypes []string
+	fields        []string
+	sampler       *LogSampler
 }
 
 func (plugin *PluginQueryLog) Name() string {
@@ -27,15 +28,20 @@ func (plugin *PluginQueryLog) Description() string {
 }
 
 func (plugin *PluginQueryLog) Init(proxy *Proxy) error {
-	plugin.logger = Logger(proxy.logMaxSize, proxy.logMaxAge, proxy.logMaxBackups, proxy.queryLogFile)
+	plugin.logger = NewListenerLogger(proxy, proxy.queryLogFile)
 	plugin.format = proxy.queryLogFormat
 	plugin.ignoredQtypes = proxy.queryLogIgnoredQtypes
+	plugin.fields = proxy.queryLogFields
+	plugin.sampler = NewLogSampler(proxy.queryLogSampleRate, proxy.queryLogMaxLinesPerSecond)
 
 	return nil
 }
 
 func (plugin *PluginQueryLog) Drop() error {
-	return nil
+	if plugin.logger == nil {
+		return nil
+	}
+	return plugin.logger.Close()
 }
 
 func (plugin *PluginQueryLog) Reload() error {
@@ -43,13 +49,8 @@ func (plugin *PluginQueryLog) Reload() error {
 }
 
 func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
-	var clientIPStr string
-	switch pluginsState.clientProto {
-	case "udp":
-		clientIPStr = (*pluginsState.clientAddr).(*net.UDPAddr).IP.String()
-	case "tcp", "local_doh":
-		clientIPStr = (*pluginsState.clientAddr).(*net.TCPAddr).IP.String()
-	default:
+	clientIPStr, ok := ExtractLoggedClientIPStr(pluginsState)
+	if !ok {
 		// Ignore internal flow.
 		return nil
 	}
@@ -65,6 +66,9 @@ func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) err
 			}
 		}
 	}
+	if !plugin.sampler.Keep() {
+		return nil
+	}
 	qName := pluginsState.qName
 
 	if pluginsState.cacheHit {
@@ -84,36 +88,76 @@ func (plugin *PluginQueryLog) Eval(pluginsState *PluginsState, msg *dns.Msg) err
 	if !pluginsState.requestStart.IsZero() && !pluginsState.requestEnd.IsZero() {
 		requestDuration = pluginsState.requestEnd.Sub(pluginsState.requestStart)
 	}
-	var line string
-	if plugin.format == "tsv" {
-		now := time.Now()
-		year, month, day := now.Date()
-		hour, minute, second := now.Clock()
-		tsStr := fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
-		line = fmt.Sprintf(
-			"%s\t%s\t%s\t%s\t%s\t%dms\t%s\n",
-			tsStr,
-			clientIPStr,
-			StringQuote(qName),
-			qType,
-			returnCode,
-			requestDuration/time.Millisecond,
-			StringQuote(pluginsState.serverName),
-		)
-	} else if plugin.format == "ltsv" {
-		cached := 0
-		if pluginsState.cacheHit {
-			cached = 1
+	var line strings.Builder
+	now := time.Now()
+	for i, field := range plugin.fields {
+		var key, value string
+		switch field {
+		case "time":
+			if plugin.format == "tsv" {
+				year, month, day := now.Date()
+				hour, minute, second := now.Clock()
+				value = fmt.Sprintf("[%d-%02d-%02d %02d:%02d:%02d]", year, int(month), day, hour, minute, second)
+			} else {
+				value = strconv.FormatInt(now.Unix(), 10)
+			}
+			key = "time"
+		case "client_ip":
+			key, value = "host", clientIPStr
+		case "client_proto":
+			key, value = "proto", pluginsState.clientProto
+		case "qname":
+			key, value = "message", NameQuote(qName)
+		case "qtype":
+			key, value = "type", qType
+		case "return_code":
+			key, value = "return", returnCode
+		case "cached":
+			key, value = "cached", "0"
+			if pluginsState.cacheHit {
+				value = "1"
+			}
+		case "duration":
+			key = "duration"
+			if plugin.format == "tsv" {
+				value = fmt.Sprintf("%dms", requestDuration/time.Millisecond)
+			} else {
+				value = strconv.FormatInt(int64(requestDuration/time.Millisecond), 10)
+			}
+		case "server":
+			key, value = "server", StringQuote(pluginsState.serverName)
+		case "query_id":
+			key, value = "id", pluginsState.queryID
+		case "listener":
+			key, value = "listener", StringQuote(pluginsState.listener)
+		case "original_dst":
+			key, value = "dst", "-"
+			if len(pluginsState.originalDst) > 0 {
+				value = pluginsState.originalDst
+			}
+		case "dnssec":
+			key, value = "dnssec", "insecure"
+			if pluginsState.authenticatedData {
+				value = "secure"
+			}
+		default:
+			dlog.Fatalf("Unexpected query log field: [%s]", field)
 		}
-		line = fmt.Sprintf("time:%d\thost:%s\tmessage:%s\ttype:%s\treturn:%s\tcached:%d\tduration:%d\tserver:%s\n",
-			time.Now().Unix(), clientIPStr, StringQuote(qName), qType, returnCode, cached, requestDuration/time.Millisecond, StringQuote(pluginsState.serverName))
-	} else {
-		dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
+		if i > 0 {
+			line.WriteByte('\t')
+		}
+		if plugin.format == "ltsv" {
+			line.WriteString(key + ":")
+		} else if plugin.format != "tsv" {
+			dlog.Fatalf("Unexpected log format: [%s]", plugin.format)
+		}
+		line.WriteString(value)
 	}
+	line.WriteByte('\n')
 	if plugin.logger == nil {
 		return errors.New("Log file not initialized")
 	}
-	_, _ = plugin.logger.Write([]byte(line))
+	_, _ = plugin.logger.For(pluginsState.listener).Write([]byte(line.String()))
 
 	return nil
 }
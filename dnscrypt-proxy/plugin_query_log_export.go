@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+type QueryLogEvent struct {
+	Time        time.Time `json:"time"`
+	ID          string    `json:"id,omitempty"`
+	ClientIP    string    `json:"client_ip"`
+	ClientProto string    `json:"client_proto"`
+	Listener    string    `json:"listener,omitempty"`
+	QName       string    `json:"qname"`
+	QType       string    `json:"qtype"`
+	ReturnCode  string    `json:"return_code"`
+	Cached      bool      `json:"cached"`
+	DurationMs  int64     `json:"duration_ms"`
+	Server      string    `json:"server,omitempty"`
+	DNSSEC      bool      `json:"dnssec"`
+}
+
+// QueryLogShipper sends query log events to an HTTP endpoint, as batches of NDJSON documents.
+// Batches that can't be delivered after a few attempts are appended to a spool file,
+// and sent again once the endpoint is reachable.
+type QueryLogShipper struct {
+	sync.Mutex
+	url          string
+	token        string
+	batchSize    int
+	interval     time.Duration
+	maxRetries   int
+	spoolFile    string
+	maxSpoolSize int64
+	httpClient   *http.Client
+	events       chan *QueryLogEvent
+	stop         chan chan struct{}
+	dropped      uint64
+}
+
+func NewQueryLogShipper(config *QueryLogExportConfig) (*QueryLogShipper, error) {
+	if len(config.URL) == 0 {
+		return nil, nil
+	}
+	if !strings.HasPrefix(config.URL, "http://") && !strings.HasPrefix(config.URL, "https://") {
+		return nil, fmt.Errorf("Unsupported query log export URL: [%s]", config.URL)
+	}
+	if config.BatchSize <= 0 || config.FlushInterval <= 0 {
+		return nil, errors.New("Query log export batch size and flush interval must be positive")
+	}
+	return &QueryLogShipper{
+		url:          config.URL,
+		token:        config.Token,
+		batchSize:    config.BatchSize,
+		interval:     time.Duration(config.FlushInterval) * time.Second,
+		maxRetries:   Max(0, config.MaxRetries),
+		spoolFile:    config.SpoolFile,
+		maxSpoolSize: int64(config.MaxSpoolSize) * 1024 * 1024,
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+		events:       make(chan *QueryLogEvent, config.BatchSize*10),
+		stop:         make(chan chan struct{}),
+	}, nil
+}
+
+// Push queues an event without blocking; events are dropped if the queue is full
+func (shipper *QueryLogShipper) Push(event *QueryLogEvent) {
+	select {
+	case shipper.events <- event:
+	default:
+		shipper.Lock()
+		shipper.dropped++
+		shipper.Unlock()
+	}
+}
+
+func (shipper *QueryLogShipper) Start() {
+	if shipper == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(shipper.interval)
+		defer ticker.Stop()
+		batch := make([]*QueryLogEvent, 0, shipper.batchSize)
+		for {
+			select {
+			case event := <-shipper.events:
+				batch = append(batch, event)
+				if len(batch) < shipper.batchSize {
+					continue
+				}
+			case <-ticker.C:
+				if len(batch) == 0 {
+					shipper.sendSpooled()
+					continue
+				}
+			case done := <-shipper.stop:
+				shipper.flush(batch)
+				close(done)
+				return
+			}
+			shipper.ship(batch)
+			batch = batch[:0]
+		}
+	}()
+}
+
+// Stop saves the events that haven't been exported yet, and returns once this is done
+func (shipper *QueryLogShipper) Stop() {
+	if shipper == nil {
+		return
+	}
+	done := make(chan struct{})
+	shipper.stop <- done
+	<-done
+}
+
+// flush writes the pending events to the spool file, so that they are exported after a restart;
+// without a spool file, they are sent right away, without retrying
+func (shipper *QueryLogShipper) flush(batch []*QueryLogEvent) {
+pending:
+	for {
+		select {
+		case event := <-shipper.events:
+			batch = append(batch, event)
+		default:
+			break pending
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+	body := shipper.encode(batch)
+	if len(shipper.spoolFile) > 0 {
+		shipper.spool(body)
+		return
+	}
+	shipper.maxRetries = 0
+	if err := shipper.send(body); err != nil {
+		dlog.Warnf("Unable to export the query log: [%v]", err)
+	}
+}
+
+func (shipper *QueryLogShipper) encode(batch []*QueryLogEvent) []byte {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range batch {
+		if err := encoder.Encode(event); err != nil {
+			dlog.Warnf("Unable to encode a query log event: [%v]", err)
+		}
+	}
+	return body.Bytes()
+}
+
+func (shipper *QueryLogShipper) ship(batch []*QueryLogEvent) {
+	body := shipper.encode(batch)
+	shipper.Lock()
+	if dropped := shipper.dropped; dropped > 0 {
+		shipper.dropped = 0
+		shipper.Unlock()
+		dlog.Warnf("Query log export queue full - %d events dropped", dropped)
+	} else {
+		shipper.Unlock()
+	}
+	if err := shipper.send(body); err != nil {
+		dlog.Warnf("Unable to export the query log: [%v]", err)
+		shipper.spool(body)
+		return
+	}
+	shipper.sendSpooled()
+}
+
+func (shipper *QueryLogShipper) send(body []byte) error {
+	var err error
+	for attempt := 0; attempt <= shipper.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var req *http.Request
+		req, err = http.NewRequest("POST", shipper.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		if len(shipper.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+shipper.token)
+		}
+		var resp *http.Response
+		resp, err = shipper.httpClient.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+			return nil
+		}
+		err = errors.New(resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode <= 499 && resp.StatusCode != 429 {
+			return err
+		}
+	}
+	return err
+}
+
+func (shipper *QueryLogShipper) spool(body []byte) {
+	if len(shipper.spoolFile) == 0 {
+		return
+	}
+	if st, err := os.Stat(shipper.spoolFile); err == nil && shipper.maxSpoolSize > 0 &&
+		st.Size()+int64(len(body)) > shipper.maxSpoolSize {
+		dlog.Warnf("Query log export spool file [%s] is full - discarding %d bytes", shipper.spoolFile, len(body))
+		return
+	}
+	fp, err := os.OpenFile(shipper.spoolFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		dlog.Warnf("Unable to write to [%s]: [%v]", shipper.spoolFile, err)
+		return
+	}
+	defer fp.Close()
+	if _, err := fp.Write(body); err != nil {
+		dlog.Warnf("Unable to write to [%s]: [%v]", shipper.spoolFile, err)
+	}
+}
+
+// sendSpooled sends the content of the spool file, in batches, and removes it once everything has been delivered
+func (shipper *QueryLogShipper) sendSpooled() {
+	if len(shipper.spoolFile) == 0 {
+		return
+	}
+	fp, err := os.Open(shipper.spoolFile)
+	if err != nil {
+		return
+	}
+	scanner := bufio.NewScanner(fp)
+	scanner.Buffer(make([]byte, 0, 64*1024), MaxDNSPacketSize*4)
+	var batch bytes.Buffer
+	lines, sent := 0, 0
+	for {
+		more := scanner.Scan()
+		if more {
+			batch.Write(scanner.Bytes())
+			batch.WriteByte('\n')
+			lines++
+			if lines < shipper.batchSize {
+				continue
+			}
+		}
+		if lines > 0 {
+			if err := shipper.send(batch.Bytes()); err != nil {
+				fp.Close()
+				if sent > 0 {
+					shipper.truncateSpool(sent)
+				}
+				return
+			}
+			sent += lines
+			lines = 0
+			batch.Reset()
+		}
+		if !more {
+			break
+		}
+	}
+	fp.Close()
+	if sent > 0 {
+		dlog.Noticef("%d spooled query log events have been exported", sent)
+	}
+	if err := os.Remove(shipper.spoolFile); err != nil && !os.IsNotExist(err) {
+		dlog.Warnf("Unable to remove [%s]: [%v]", shipper.spoolFile, err)
+	}
+}
+
+// truncateSpool removes the first `count` lines of the spool file
+func (shipper *QueryLogShipper) truncateSpool(count int) {
+	content, err := os.ReadFile(shipper.spoolFile)
+	if err != nil {
+		return
+	}
+	for ; count > 0 && len(content) > 0; count-- {
+		idx := bytes.IndexByte(content, '\n')
+		if idx < 0 {
+			content = nil
+			break
+		}
+		content = content[idx+1:]
+	}
+	if err := os.WriteFile(shipper.spoolFile, content, 0o600); err != nil {
+		dlog.Warnf("Unable to write to [%s]: [%v]", shipper.spoolFile, err)
+	}
+}
+
+// ---
+
+type PluginQueryLogExport struct {
+	shipper *QueryLogShipper
+}
+
+func (plugin *PluginQueryLogExport) Name() string {
+	return "query_log_export"
+}
+
+func (plugin *PluginQueryLogExport) Description() string {
+	return "Export DNS queries to an HTTP endpoint."
+}
+
+func (plugin *PluginQueryLogExport) Init(proxy *Proxy) error {
+	plugin.shipper = proxy.queryLogShipper
+	return nil
+}
+
+func (plugin *PluginQueryLogExport) Drop() error {
+	return nil
+}
+
+func (plugin *PluginQueryLogExport) Reload() error {
+	return nil
+}
+
+func (plugin *PluginQueryLogExport) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	clientIPStr, ok := ExtractLoggedClientIPStr(pluginsState)
+	if !ok {
+		// Ignore internal flow.
+		return nil
+	}
+	question := msg.Question[0]
+	qType, ok := dns.TypeToString[question.Qtype]
+	if !ok {
+		qType = fmt.Sprintf("TYPE%d", question.Qtype)
+	}
+	returnCode, ok := PluginsReturnCodeToString[pluginsState.returnCode]
+	if !ok {
+		returnCode = fmt.Sprintf("%d", pluginsState.returnCode)
+	}
+	event := QueryLogEvent{
+		Time:        pluginsState.requestStart,
+		ClientIP:    clientIPStr,
+		ClientProto: pluginsState.clientProto,
+		Listener:    pluginsState.listener,
+		QName:       pluginsState.qName,
+		QType:       qType,
+		ReturnCode:  returnCode,
+		Cached:      pluginsState.cacheHit,
+		DurationMs:  int64(pluginsState.requestEnd.Sub(pluginsState.requestStart) / time.Millisecond),
+		DNSSEC:      pluginsState.authenticatedData,
+	}
+	if pluginsState.logQueryIDs {
+		event.ID = pluginsState.queryID
+	}
+	if pluginsState.serverName != "-" {
+		event.Server = pluginsState.serverName
+	}
+	plugin.shipper.Push(&event)
+	return nil
+}
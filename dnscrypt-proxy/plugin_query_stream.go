@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const queryStreamSubscriberBufferSize = 256
+
+type QueryStreamEvent struct {
+	Time       time.Time `json:"time"`
+	ID         string    `json:"id"`
+	ClientIP   string    `json:"client_ip"`
+	QName      string    `json:"qname"`
+	QType      string    `json:"qtype"`
+	ReturnCode string    `json:"return_code"`
+	Cached     bool      `json:"cached"`
+	DurationMs int64     `json:"duration_ms"`
+	Server     string    `json:"server"`
+}
+
+type queryStreamSubscriber struct {
+	events       chan *QueryStreamEvent
+	clientIPStr  string
+	domainSuffix string
+}
+
+func (subscriber *queryStreamSubscriber) matches(event *QueryStreamEvent) bool {
+	if len(subscriber.clientIPStr) > 0 && subscriber.clientIPStr != event.ClientIP {
+		return false
+	}
+	if len(subscriber.domainSuffix) > 0 {
+		qName := event.QName
+		if qName != subscriber.domainSuffix && !strings.HasSuffix(qName, "."+subscriber.domainSuffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// QueryStream fans query events out to the connected clients.
+// Events are dropped for clients that don't keep up.
+type QueryStream struct {
+	sync.Mutex
+	subscribers      map[*queryStreamSubscriber]struct{}
+	subscribersCount int32
+}
+
+func NewQueryStream() *QueryStream {
+	return &QueryStream{subscribers: make(map[*queryStreamSubscriber]struct{})}
+}
+
+func (stream *QueryStream) subscribe(subscriber *queryStreamSubscriber) {
+	stream.Lock()
+	stream.subscribers[subscriber] = struct{}{}
+	atomic.StoreInt32(&stream.subscribersCount, int32(len(stream.subscribers)))
+	stream.Unlock()
+}
+
+func (stream *QueryStream) unsubscribe(subscriber *queryStreamSubscriber) {
+	stream.Lock()
+	delete(stream.subscribers, subscriber)
+	atomic.StoreInt32(&stream.subscribersCount, int32(len(stream.subscribers)))
+	stream.Unlock()
+}
+
+func (stream *QueryStream) hasSubscribers() bool {
+	return atomic.LoadInt32(&stream.subscribersCount) > 0
+}
+
+func (stream *QueryStream) publish(event *QueryStreamEvent) {
+	stream.Lock()
+	defer stream.Unlock()
+	for subscriber := range stream.subscribers {
+		if !subscriber.matches(event) {
+			continue
+		}
+		select {
+		case subscriber.events <- event:
+		default:
+		}
+	}
+}
+
+func (stream *QueryStream) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writer.WriteHeader(500)
+		return
+	}
+	query := request.URL.Query()
+	subscriber := &queryStreamSubscriber{
+		events:       make(chan *QueryStreamEvent, queryStreamSubscriberBufferSize),
+		clientIPStr:  query.Get("client"),
+		domainSuffix: strings.TrimSuffix(strings.ToLower(query.Get("suffix")), "."),
+	}
+	stream.subscribe(subscriber)
+	defer stream.unsubscribe(subscriber)
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.WriteHeader(200)
+	flusher.Flush()
+	keepAlive := time.NewTicker(30 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-request.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := writer.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		case event := <-subscriber.events:
+			body, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(writer, "data: %s\n\n", body); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+type PluginQueryStream struct {
+	stream *QueryStream
+}
+
+func (plugin *PluginQueryStream) Name() string {
+	return "query_stream"
+}
+
+func (plugin *PluginQueryStream) Description() string {
+	return "Stream queries to local monitoring clients."
+}
+
+func (plugin *PluginQueryStream) Init(proxy *Proxy) error {
+	plugin.stream = NewQueryStream()
+	proxy.monitoringServer.HandleFunc("/api/stream", plugin.stream.ServeHTTP)
+	return nil
+}
+
+func (plugin *PluginQueryStream) Drop() error {
+	return nil
+}
+
+func (plugin *PluginQueryStream) Reload() error {
+	return nil
+}
+
+func (plugin *PluginQueryStream) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if !plugin.stream.hasSubscribers() {
+		return nil
+	}
+	clientIPStr, ok := ExtractLoggedClientIPStr(pluginsState)
+	if !ok {
+		// Ignore internal flow.
+		return nil
+	}
+	question := msg.Question[0]
+	qType, ok := dns.TypeToString[question.Qtype]
+	if !ok {
+		qType = fmt.Sprintf("TYPE%d", question.Qtype)
+	}
+	returnCode, ok := PluginsReturnCodeToString[pluginsState.returnCode]
+	if !ok {
+		returnCode = "UNKNOWN"
+	}
+	serverName := pluginsState.serverName
+	if pluginsState.cacheHit || len(serverName) == 0 {
+		serverName = "-"
+	}
+	var requestDuration time.Duration
+	if !pluginsState.requestStart.IsZero() && !pluginsState.requestEnd.IsZero() {
+		requestDuration = pluginsState.requestEnd.Sub(pluginsState.requestStart)
+	}
+	plugin.stream.publish(&QueryStreamEvent{
+		Time:       time.Now(),
+		ID:         pluginsState.queryID,
+		ClientIP:   clientIPStr,
+		QName:      pluginsState.qName,
+		QType:      qType,
+		ReturnCode: returnCode,
+		Cached:     pluginsState.cacheHit,
+		DurationMs: int64(requestDuration / time.Millisecond),
+		Server:     serverName,
+	})
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	RateLimitActionDrop     = "drop"
+	RateLimitActionRefused  = "refused"
+	RateLimitActionServFail = "servfail"
+)
+
+func ValidateRateLimitAction(action string) error {
+	switch action {
+	case RateLimitActionDrop, RateLimitActionRefused, RateLimitActionServFail:
+		return nil
+	}
+	return fmt.Errorf("Unsupported client rate limit action: [%s]", action)
+}
+
+type PluginRateLimit struct {
+	sync.Mutex
+	buckets *tokenBuckets
+	action  string
+}
+
+func (plugin *PluginRateLimit) Name() string {
+	return "rate_limit"
+}
+
+func (plugin *PluginRateLimit) Description() string {
+	return "Limit the number of queries per second from every client IP address."
+}
+
+func (plugin *PluginRateLimit) Init(proxy *Proxy) error {
+	burst := Max(proxy.clientRateLimitBurst, 1)
+	plugin.buckets = newTokenBuckets(float64(proxy.clientRateLimitQPS), float64(burst))
+	plugin.action = proxy.clientRateLimitAction
+	pluginsLog.Noticef("Client rate limit: %d queries per second, bursts of %d queries", proxy.clientRateLimitQPS, burst)
+	return nil
+}
+
+func (plugin *PluginRateLimit) Drop() error {
+	return nil
+}
+
+func (plugin *PluginRateLimit) Reload() error {
+	return nil
+}
+
+func (plugin *PluginRateLimit) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	clientIP, ok := ExtractClientIP(pluginsState)
+	if !ok {
+		return nil
+	}
+	if ipv4 := clientIP.To4(); ipv4 != nil {
+		clientIP = ipv4
+	}
+	plugin.Lock()
+	limited := plugin.buckets.take(string(clientIP), time.Now())
+	plugin.Unlock()
+	if limited == 0 {
+		return nil
+	}
+	if limited == 1 {
+		clientIPStr, _ := ExtractLoggedClientIPStr(pluginsState)
+		pluginsLog.Warnf("Client [%s] exceeded the query rate limit", clientIPStr)
+	}
+	switch plugin.action {
+	case RateLimitActionDrop:
+		pluginsState.action = PluginsActionDrop
+		pluginsState.returnCode = PluginsReturnCodeDrop
+		return nil
+	case RateLimitActionServFail:
+		synth := EmptyResponseFromMessage(msg)
+		synth.Rcode = dns.RcodeServerFailure
+		pluginsState.synthResponse = synth
+		pluginsState.returnCode = PluginsReturnCodeServFail
+	default:
+		synth := EmptyResponseFromMessage(msg)
+		synth.Rcode = dns.RcodeRefused
+		pluginsState.synthResponse = synth
+		pluginsState.returnCode = PluginsReturnCodeReject
+	}
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
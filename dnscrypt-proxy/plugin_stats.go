@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/miekg/dns"
+)
+
+type PluginStats struct {
+	stats *QueryStats
+}
+
+func (plugin *PluginStats) Name() string {
+	return "stats"
+}
+
+func (plugin *PluginStats) Description() string {
+	return "Collect statistics about queries, clients and blocked names."
+}
+
+func (plugin *PluginStats) Init(proxy *Proxy) error {
+	plugin.stats = proxy.queryStats
+	proxy.monitoringServer.HandleFunc("/api/stats", func(writer http.ResponseWriter, request *http.Request) {
+		body, err := plugin.stats.ReportJSON()
+		writeJSONResponse(writer, body, err)
+	})
+	proxy.metricsExporter.Start(plugin.stats)
+	if len(proxy.statsFile) == 0 {
+		return nil
+	}
+	statsFile, interval := proxy.statsFile, proxy.statsInterval
+	go func() {
+		for {
+			time.Sleep(interval)
+			body, err := plugin.stats.ReportJSON()
+			if err == nil {
+				err = safefile.WriteFile(statsFile, body, 0o644)
+			}
+			if err != nil {
+				pluginsLog.Warnf("Unable to write statistics to [%s]: [%v]", statsFile, err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (plugin *PluginStats) Drop() error {
+	return nil
+}
+
+func (plugin *PluginStats) Reload() error {
+	return nil
+}
+
+func (plugin *PluginStats) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	clientIPStr, ok := ExtractLoggedClientIPStr(pluginsState)
+	if !ok {
+		// Ignore internal flow.
+		return nil
+	}
+	plugin.stats.Record(pluginsState, clientIPStr)
+	return nil
+}
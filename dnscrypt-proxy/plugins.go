@@ -3,11 +3,13 @@
 import (
 	"errors"
 	"net"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/jedisct1/dlog"
 	"github.com/miekg/dns"
 )
 
@@ -29,6 +31,7 @@ type PluginsGlobals struct {
 	refusedCodeInResponses bool
 	respondWithIPv4        net.IP
 	respondWithIPv6        net.IP
+	rejectTemplates        map[uint16]*SynthTemplate
 }
 
 type PluginsReturnCode int
@@ -70,34 +73,65 @@ type PluginsState struct {
 	requestEnd                       time.Time
 	clientProto                      string
 	serverName                       string
+	listener                         string
+	originalDst                      string
+	queryPolicy                      *QueryPolicy
+	routedServers                    []string
 	serverProto                      string
 	qName                            string
+	queryID                          string
 	clientAddr                       *net.Addr
+	clientsAnonymizer                *ClientsAnonymizer
+	tracer                           *Tracer
+	trace                            *QueryTrace
 	synthResponse                    *dns.Msg
+	synthPacket                      []byte
 	questionMsg                      *dns.Msg
 	sessionData                      map[string]interface{}
 	action                           PluginsAction
 	timeout                          time.Duration
 	returnCode                       PluginsReturnCode
 	maxPayloadSize                   int
-	cacheSize                        int
 	originalMaxPayloadSize           int
 	maxUnencryptedUDPSafePayloadSize int
 	rejectTTL                        uint32
 	cacheMaxTTL                      uint32
 	cacheNegMaxTTL                   uint32
 	cacheNegMinTTL                   uint32
+	cacheNoDataMinTTL                uint32
+	cacheNoDataMaxTTL                uint32
+	cacheServFailTTL                 uint32
 	cacheMinTTL                      uint32
+	cacheStaleMaxAge                 time.Duration
 	cacheHit                         bool
+	cachePartition                   string
+	staleServed                      bool
 	dnssec                           bool
+	logQueryIDs                      bool
+	authenticatedData                bool
 }
 
 func (proxy *Proxy) InitPluginsGlobals() error {
+	if err := proxy.initPlugins(&proxy.pluginsGlobals, nil); err != nil {
+		return err
+	}
+	return proxy.initListenerProfiles()
+}
+
+// initPlugins creates the plugins for the current settings; plugins found in `sharedPlugins` are used as is
+// instead of being initialized again
+func (proxy *Proxy) initPlugins(pluginsGlobals *PluginsGlobals, sharedPlugins map[reflect.Type]Plugin) error {
 	queryPlugins := &[]Plugin{}
 
+	if proxy.clientRateLimitQPS > 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginRateLimit)))
+	}
 	if proxy.captivePortalMap != nil {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCaptivePortal)))
 	}
+	if len(proxy.chaosTXT) != 0 || proxy.chaosRefuse {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginChaos)))
+	}
 	if len(proxy.queryMeta) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginQueryMeta)))
 	}
@@ -110,12 +144,26 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	if len(proxy.ednsClientSubnets) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginECS)))
 	}
+	var blockName *PluginBlockName
 	if len(proxy.blockNameFile) != 0 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockName)))
+		blockName = new(PluginBlockName)
+		*queryPlugins = append(*queryPlugins, Plugin(blockName))
 	}
 	if proxy.pluginBlockIPv6 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockIPv6)))
 	}
+	if proxy.pluginMinimizeAny {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginMinimizeAny)))
+	}
+	if len(proxy.localZoneFiles) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginLocalZones)))
+	}
+	if len(proxy.dhcpLeaseFiles) != 0 {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginDHCPLeases)))
+	}
+	if proxy.mdnsBridge {
+		*queryPlugins = append(*queryPlugins, Plugin(new(PluginMDNS)))
+	}
 	if len(proxy.cloakFile) != 0 {
 		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCloak)))
 	}
@@ -134,14 +182,16 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	}
 
 	responsePlugins := &[]Plugin{}
+	var nxLog *PluginNxLog
 	if len(proxy.nxLogFile) != 0 {
-		*responsePlugins = append(*responsePlugins, Plugin(new(PluginNxLog)))
+		nxLog = new(PluginNxLog)
+		*responsePlugins = append(*responsePlugins, Plugin(nxLog))
 	}
 	if len(proxy.allowedIPFile) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginAllowedIP)))
 	}
-	if len(proxy.blockNameFile) != 0 {
-		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockNameResponse)))
+	if blockName != nil {
+		*responsePlugins = append(*responsePlugins, Plugin(&PluginBlockNameResponse{blockName: blockName}))
 	}
 	if len(proxy.blockIPFile) != 0 {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginBlockIP)))
@@ -151,34 +201,46 @@ func (proxy *Proxy) InitPluginsGlobals() error {
 	}
 	if proxy.cache {
 		*responsePlugins = append(*responsePlugins, Plugin(new(PluginCacheResponse)))
+		if proxy.cacheEventLogger == nil {
+			proxy.cacheEventLogger = NewCacheEventLogger(proxy)
+		}
 	}
 
 	loggingPlugins := &[]Plugin{}
+	if nxLog != nil && slices.Contains(proxy.nxLogReturnCodes, NxLogTimeout) {
+		*loggingPlugins = append(*loggingPlugins, Plugin(&PluginNxLogTimeout{nxLog: nxLog}))
+	}
 	if len(proxy.queryLogFile) != 0 {
 		*loggingPlugins = append(*loggingPlugins, Plugin(new(PluginQueryLog)))
 	}
-
-	for _, plugin := range *queryPlugins {
-		if err := plugin.Init(proxy); err != nil {
-			return err
-		}
+	if proxy.queryLogShipper != nil {
+		*loggingPlugins = append(*loggingPlugins, Plugin(new(PluginQueryLogExport)))
 	}
-	for _, plugin := range *responsePlugins {
-		if err := plugin.Init(proxy); err != nil {
-			return err
-		}
+	if proxy.queryStats != nil {
+		*loggingPlugins = append(*loggingPlugins, Plugin(new(PluginStats)))
 	}
-	for _, plugin := range *loggingPlugins {
-		if err := plugin.Init(proxy); err != nil {
-			return err
+	if proxy.monitoringStream {
+		*loggingPlugins = append(*loggingPlugins, Plugin(new(PluginQueryStream)))
+	}
+
+	for _, plugins := range []*[]Plugin{queryPlugins, responsePlugins, loggingPlugins} {
+		for i, plugin := range *plugins {
+			if sharedPlugin, ok := sharedPlugins[reflect.TypeOf(plugin)]; ok {
+				(*plugins)[i] = sharedPlugin
+				continue
+			}
+			if err := plugin.Init(proxy); err != nil {
+				return err
+			}
 		}
 	}
 
-	proxy.pluginsGlobals.queryPlugins = queryPlugins
-	proxy.pluginsGlobals.responsePlugins = responsePlugins
-	proxy.pluginsGlobals.loggingPlugins = loggingPlugins
+	pluginsGlobals.queryPlugins = queryPlugins
+	pluginsGlobals.responsePlugins = responsePlugins
+	pluginsGlobals.loggingPlugins = loggingPlugins
 
-	parseBlockedQueryResponse(proxy.blockedQueryResponse, &proxy.pluginsGlobals)
+	parseBlockedQueryResponse(proxy.blockedQueryResponse, pluginsGlobals)
+	pluginsGlobals.updateRejectTemplates()
 
 	return nil
 }
@@ -192,7 +254,7 @@ func parseBlockedQueryResponse(blockedResponse string, pluginsGlobals *PluginsGl
 		pluginsGlobals.respondWithIPv4 = net.ParseIP(strings.TrimPrefix(blockedIPStrings[0], "a:"))
 
 		if pluginsGlobals.respondWithIPv4 == nil {
-			dlog.Notice("Error parsing IPv4 response given in blocked_query_response option, defaulting to `hinfo`")
+			pluginsLog.Notice("Error parsing IPv4 response given in blocked_query_response option, defaulting to `hinfo`")
 			pluginsGlobals.refusedCodeInResponses = false
 			return
 		}
@@ -206,12 +268,12 @@ func parseBlockedQueryResponse(blockedResponse string, pluginsGlobals *PluginsGl
 				pluginsGlobals.respondWithIPv6 = net.ParseIP(ipv6Response)
 
 				if pluginsGlobals.respondWithIPv6 == nil {
-					dlog.Notice(
+					pluginsLog.Notice(
 						"Error parsing IPv6 response given in blocked_query_response option, defaulting to IPv4",
 					)
 				}
 			} else {
-				dlog.Noticef("Invalid IPv6 response given in blocked_query_response option [%s], the option should take the form 'a:<IPv4>,aaaa:<IPv6>'", blockedIPStrings[1])
+				pluginsLog.Noticef("Invalid IPv6 response given in blocked_query_response option [%s], the option should take the form 'a:<IPv4>,aaaa:<IPv6>'", blockedIPStrings[1])
 			}
 		}
 
@@ -225,12 +287,59 @@ func parseBlockedQueryResponse(blockedResponse string, pluginsGlobals *PluginsGl
 		case "hinfo":
 			pluginsGlobals.refusedCodeInResponses = false
 		default:
-			dlog.Noticef("Invalid blocked_query_response option [%s], defaulting to `hinfo`", blockedResponse)
+			pluginsLog.Noticef("Invalid blocked_query_response option [%s], defaulting to `hinfo`", blockedResponse)
 			pluginsGlobals.refusedCodeInResponses = false
 		}
 	}
 }
 
+// updateRejectTemplates precomputes the responses to blocked queries. Responses to A and AAAA queries
+// can include an IP address, and a single response is used for all the other query types.
+func (pluginsGlobals *PluginsGlobals) updateRejectTemplates() {
+	pluginsGlobals.rejectTemplates = make(map[uint16]*SynthTemplate, 3)
+	for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeNone} {
+		msg := dns.Msg{}
+		msg.SetQuestion(".", qType)
+		msg.SetEdns0(uint16(MaxDNSPacketSize), false)
+		synth := RefusedResponseFromMessage(
+			&msg,
+			pluginsGlobals.refusedCodeInResponses,
+			pluginsGlobals.respondWithIPv4,
+			pluginsGlobals.respondWithIPv6,
+			0,
+		)
+		template, err := NewSynthTemplateFromResponse(synth)
+		if err != nil {
+			pluginsLog.Debugf("Unable to precompute the response to blocked queries: %v", err)
+			continue
+		}
+		pluginsGlobals.rejectTemplates[qType] = template
+	}
+}
+
+// synthRejectResponse sets the response to a blocked query
+func (pluginsGlobals *PluginsGlobals) synthRejectResponse(pluginsState *PluginsState, msg *dns.Msg) {
+	if len(msg.Question) == 1 {
+		qType := msg.Question[0].Qtype
+		if qType != dns.TypeA && qType != dns.TypeAAAA {
+			qType = dns.TypeNone
+		}
+		if template := pluginsGlobals.rejectTemplates[qType]; template != nil {
+			if packet, err := template.Build(msg, pluginsState.rejectTTL, false); err == nil {
+				pluginsState.synthPacket = packet
+				return
+			}
+		}
+	}
+	pluginsState.synthResponse = RefusedResponseFromMessage(
+		msg,
+		pluginsGlobals.refusedCodeInResponses,
+		pluginsGlobals.respondWithIPv4,
+		pluginsGlobals.respondWithIPv6,
+		pluginsState.rejectTTL,
+	)
+}
+
 type Plugin interface {
 	Name() string
 	Description() string
@@ -250,30 +359,83 @@ func NewPluginsState(
 	return PluginsState{
 		action:                           PluginsActionContinue,
 		returnCode:                       PluginsReturnCodePass,
-		maxPayloadSize:                   MaxDNSUDPPacketSize - ResponseOverhead,
+		maxPayloadSize:                   proxy.ednsUpstreamUDPSize - ResponseOverhead,
 		clientProto:                      clientProto,
 		clientAddr:                       clientAddr,
-		cacheSize:                        proxy.cacheSize,
+		clientsAnonymizer:                proxy.clientsAnonymizer,
+		queryID:                          NewQueryID(),
+		logQueryIDs:                      proxy.logQueryIDs,
+		tracer:                           proxy.tracer,
+		trace:                            proxy.tracer.NewTrace("dns.query", start),
 		cacheNegMinTTL:                   proxy.cacheNegMinTTL,
 		cacheNegMaxTTL:                   proxy.cacheNegMaxTTL,
+		cacheNoDataMinTTL:                proxy.cacheNoDataMinTTL,
+		cacheNoDataMaxTTL:                proxy.cacheNoDataMaxTTL,
+		cacheServFailTTL:                 proxy.cacheServFailTTL,
 		cacheMinTTL:                      proxy.cacheMinTTL,
 		cacheMaxTTL:                      proxy.cacheMaxTTL,
+		cacheStaleMaxAge:                 proxy.cacheStaleMaxAge,
 		rejectTTL:                        proxy.rejectTTL,
+		queryPolicy:                      proxy.queryPolicy,
 		questionMsg:                      nil,
 		qName:                            "",
 		serverName:                       "-",
 		serverProto:                      serverProto,
 		timeout:                          proxy.timeout,
 		requestStart:                     start,
-		maxUnencryptedUDPSafePayloadSize: MaxDNSUDPSafePacketSize,
+		maxUnencryptedUDPSafePayloadSize: proxy.ednsClientUDPSize,
 		sessionData:                      make(map[string]interface{}),
 	}
 }
 
+func ExtractClientIP(pluginsState *PluginsState) (net.IP, bool) {
+	if pluginsState.clientAddr == nil {
+		return nil, false
+	}
+	switch pluginsState.clientProto {
+	case "udp", "local_doq":
+		return (*pluginsState.clientAddr).(*net.UDPAddr).IP, true
+	case "tcp", "local_doh", "local_dot":
+		return (*pluginsState.clientAddr).(*net.TCPAddr).IP, true
+	case "dnscrypt":
+		switch clientAddr := (*pluginsState.clientAddr).(type) {
+		case *net.UDPAddr:
+			return clientAddr.IP, true
+		case *net.TCPAddr:
+			return clientAddr.IP, true
+		}
+		return nil, false
+	default:
+		// Ignore internal flow.
+		return nil, false
+	}
+}
+
+// ExtractLoggedClientIPStr returns the client address the way it should be written to log files
+func ExtractLoggedClientIPStr(pluginsState *PluginsState) (string, bool) {
+	clientIP, ok := ExtractClientIP(pluginsState)
+	if !ok {
+		return "", false
+	}
+	return pluginsState.clientsAnonymizer.Anonymize(clientIP), true
+}
+
+// withQueryID appends the query identifier to a log line, if query identifiers have to be logged
+func (pluginsState *PluginsState) withQueryID(line string, format string) string {
+	if !pluginsState.logQueryIDs || !strings.HasSuffix(line, "\n") {
+		return line
+	}
+	line = line[:len(line)-1]
+	if format == "ltsv" {
+		return line + "\tid:" + pluginsState.queryID + "\n"
+	}
+	return line + "\t" + pluginsState.queryID + "\n"
+}
+
 func (pluginsState *PluginsState) ApplyQueryPlugins(
 	pluginsGlobals *PluginsGlobals,
 	packet []byte,
-	needsEDNS0Padding bool,
+	paddingBlockSize int,
 ) ([]byte, error) {
 	msg := dns.Msg{}
 	if err := msg.Unpack(packet); err != nil {
@@ -286,28 +448,43 @@ func (pluginsState *PluginsState) ApplyQueryPlugins(
 	if err != nil {
 		return packet, err
 	}
-	dlog.Debugf("Handling query for [%v]", qName)
+	pluginsLog.Debugf("[%s] Handling query for [%v]", pluginsState.queryID, NameQuote(qName))
 	pluginsState.qName = qName
 	pluginsState.questionMsg = &msg
-	if len(*pluginsGlobals.queryPlugins) == 0 && len(*pluginsGlobals.loggingPlugins) == 0 {
+	// Responses sent over UDP must fit in the payload size advertised by the client, or 512 bytes without EDNS
+	if edns0 := msg.IsEdns0(); edns0 != nil {
+		pluginsState.maxUnencryptedUDPSafePayloadSize = Min(
+			pluginsState.maxUnencryptedUDPSafePayloadSize,
+			Max(int(edns0.UDPSize()), 512),
+		)
+	} else {
+		pluginsState.maxUnencryptedUDPSafePayloadSize = 512
+	}
+	if rcode := pluginsState.queryPolicy.rcode(&msg); rcode != queryPolicyForward {
+		synth := EmptyResponseFromMessage(&msg)
+		synth.Rcode = rcode
+		pluginsState.synthResponse = synth
+		pluginsState.action = PluginsActionSynth
+		pluginsState.returnCode = PluginsReturnCodeSynth
+		return packet, nil
+	}
+	if len(*pluginsGlobals.queryPlugins) == 0 && len(*pluginsGlobals.loggingPlugins) == 0 && paddingBlockSize <= 0 {
 		return packet, nil
 	}
 	pluginsGlobals.RLock()
 	defer pluginsGlobals.RUnlock()
+	phaseSpan := pluginsState.trace.StartSpan("query_plugins", 0)
+	defer pluginsState.trace.EndSpan(phaseSpan)
 	for _, plugin := range *pluginsGlobals.queryPlugins {
-		if err := plugin.Eval(pluginsState, &msg); err != nil {
+		pluginSpan := pluginsState.trace.StartSpan(plugin.Name(), phaseSpan)
+		err := plugin.Eval(pluginsState, &msg)
+		pluginsState.trace.EndSpan(pluginSpan)
+		if err != nil {
 			pluginsState.action = PluginsActionDrop
 			return packet, err
 		}
 		if pluginsState.action == PluginsActionReject {
-			synth := RefusedResponseFromMessage(
-				&msg,
-				pluginsGlobals.refusedCodeInResponses,
-				pluginsGlobals.respondWithIPv4,
-				pluginsGlobals.respondWithIPv6,
-				pluginsState.rejectTTL,
-			)
-			pluginsState.synthResponse = synth
+			pluginsGlobals.synthRejectResponse(pluginsState, &msg)
 		}
 		if pluginsState.action != PluginsActionContinue {
 			break
@@ -318,8 +495,8 @@ func (pluginsState *PluginsState) ApplyQueryPlugins(
 	if err != nil {
 		return packet, err
 	}
-	if needsEDNS0Padding && pluginsState.action == PluginsActionContinue {
-		padLen := 63 - ((len(packet2) + 63) & 63)
+	if paddingBlockSize > 0 && pluginsState.action == PluginsActionContinue {
+		padLen := edns0PaddingLen(&msg, len(packet2), paddingBlockSize)
 		if paddedPacket2, _ := addEDNS0PaddingIfNoneFound(&msg, packet2, padLen); paddedPacket2 != nil {
 			return paddedPacket2, nil
 		}
@@ -330,7 +507,6 @@ func (pluginsState *PluginsState) ApplyQueryPlugins(
 func (pluginsState *PluginsState) ApplyResponsePlugins(
 	pluginsGlobals *PluginsGlobals,
 	packet []byte,
-	ttl *uint32,
 ) ([]byte, error) {
 	msg := dns.Msg{Compress: true}
 	if err := msg.Unpack(packet); err != nil {
@@ -350,30 +526,26 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(
 		pluginsState.returnCode = PluginsReturnCodeResponseError
 	}
 	removeEDNS0Options(&msg)
+	pluginsState.authenticatedData = msg.AuthenticatedData
 	pluginsGlobals.RLock()
 	defer pluginsGlobals.RUnlock()
+	phaseSpan := pluginsState.trace.StartSpan("response_plugins", 0)
+	defer pluginsState.trace.EndSpan(phaseSpan)
 	for _, plugin := range *pluginsGlobals.responsePlugins {
-		if err := plugin.Eval(pluginsState, &msg); err != nil {
+		pluginSpan := pluginsState.trace.StartSpan(plugin.Name(), phaseSpan)
+		err := plugin.Eval(pluginsState, &msg)
+		pluginsState.trace.EndSpan(pluginSpan)
+		if err != nil {
 			pluginsState.action = PluginsActionDrop
 			return packet, err
 		}
 		if pluginsState.action == PluginsActionReject {
-			synth := RefusedResponseFromMessage(
-				&msg,
-				pluginsGlobals.refusedCodeInResponses,
-				pluginsGlobals.respondWithIPv4,
-				pluginsGlobals.respondWithIPv6,
-				pluginsState.rejectTTL,
-			)
-			pluginsState.synthResponse = synth
+			pluginsGlobals.synthRejectResponse(pluginsState, &msg)
 		}
 		if pluginsState.action != PluginsActionContinue {
 			break
 		}
 	}
-	if ttl != nil {
-		setMaxTTL(&msg, *ttl)
-	}
 	packet2, err := msg.PackBuffer(packet)
 	if err != nil {
 		return packet, err
@@ -381,11 +553,28 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(
 	return packet2, nil
 }
 
+func (pluginsState *PluginsState) finishTrace() {
+	trace := pluginsState.trace
+	trace.SetAttribute(0, "dns.query_id", pluginsState.queryID)
+	trace.SetAttribute(0, "dns.question.name", pluginsState.qName)
+	if pluginsState.questionMsg != nil && len(pluginsState.questionMsg.Question) > 0 {
+		trace.SetAttribute(0, "dns.question.type", dns.TypeToString[pluginsState.questionMsg.Question[0].Qtype])
+	}
+	trace.SetAttribute(0, "dns.return_code", PluginsReturnCodeToString[pluginsState.returnCode])
+	trace.SetAttribute(0, "dns.cached", strconv.FormatBool(pluginsState.cacheHit))
+	trace.SetAttribute(0, "network.client.protocol", pluginsState.clientProto)
+	trace.SetAttribute(0, "server.name", pluginsState.serverName)
+	pluginsState.tracer.Finish(trace)
+}
+
 func (pluginsState *PluginsState) ApplyLoggingPlugins(pluginsGlobals *PluginsGlobals) error {
+	pluginsState.requestEnd = time.Now()
+	if pluginsState.trace != nil {
+		defer pluginsState.finishTrace()
+	}
 	if len(*pluginsGlobals.loggingPlugins) == 0 {
 		return nil
 	}
-	pluginsState.requestEnd = time.Now()
 	questionMsg := pluginsState.questionMsg
 	if questionMsg == nil {
 		return errors.New("Question not found")
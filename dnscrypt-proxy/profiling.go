@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// ProfilingServer exposes the net/http/pprof handlers on a loopback address.
+// It can be started and stopped at runtime, so that profiles can be captured
+// from a running instance without restarting it.
+type ProfilingServer struct {
+	sync.Mutex
+	listenAddress string
+	httpServer    *http.Server
+	address       string
+}
+
+type ProfilingStatus struct {
+	Enabled bool   `json:"enabled"`
+	Address string `json:"address,omitempty"`
+}
+
+func NewProfilingServer(listenAddress string) (*ProfilingServer, error) {
+	host, _, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("The profiling server can only listen to a loopback address, not [%s]", listenAddress)
+		}
+	}
+	return &ProfilingServer{listenAddress: listenAddress}, nil
+}
+
+func (profiling *ProfilingServer) Enable() error {
+	profiling.Lock()
+	defer profiling.Unlock()
+	if profiling.httpServer != nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", profiling.listenAddress)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	httpServer := &http.Server{Handler: mux}
+	profiling.httpServer = httpServer
+	profiling.address = listener.Addr().String()
+	dlog.Noticef("Now listening to http://%v/debug/pprof/ [profiling]", listener.Addr())
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			dlog.Errorf("Profiling server: [%v]", err)
+		}
+	}()
+	return nil
+}
+
+func (profiling *ProfilingServer) Disable() {
+	profiling.Lock()
+	httpServer := profiling.httpServer
+	profiling.httpServer, profiling.address = nil, ""
+	profiling.Unlock()
+	if httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		httpServer.Close()
+	}
+	dlog.Notice("Profiling server stopped")
+}
+
+// Toggle stops the server if it is running, and starts it otherwise
+func (profiling *ProfilingServer) Toggle() error {
+	if profiling.Status().Enabled {
+		profiling.Disable()
+		return nil
+	}
+	return profiling.Enable()
+}
+
+func (profiling *ProfilingServer) Status() ProfilingStatus {
+	profiling.Lock()
+	defer profiling.Unlock()
+	return ProfilingStatus{Enabled: profiling.httpServer != nil, Address: profiling.address}
+}
+
+// ServeHTTP starts (POST), stops (DELETE) or returns the status of the profiling server
+func (profiling *ProfilingServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	switch request.Method {
+	case "POST":
+		if err := profiling.Enable(); err != nil {
+			writer.WriteHeader(500)
+			writer.Write([]byte(err.Error()))
+			return
+		}
+	case "DELETE":
+		profiling.Disable()
+	case "GET":
+	default:
+		writer.WriteHeader(405)
+		return
+	}
+	body, err := json.MarshalIndent(profiling.Status(), "", " ")
+	writeJSONResponse(writer, body, err)
+}
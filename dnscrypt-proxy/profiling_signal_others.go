@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/jedisct1/dlog"
+)
+
+// handleProfilingSignal toggles the profiling server every time SIGUSR2 is received
+func (profiling *ProfilingServer) handleProfilingSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	go func() {
+		for range signals {
+			if err := profiling.Toggle(); err != nil {
+				dlog.Errorf("Unable to start the profiling server: [%v]", err)
+			}
+		}
+	}()
+}
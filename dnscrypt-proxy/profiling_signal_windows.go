@@ -0,0 +1,4 @@
+package main
+
+// There is no SIGUSR2 on Windows - The monitoring server can be used instead
+func (profiling *ProfilingServer) handleProfilingSignal() {}
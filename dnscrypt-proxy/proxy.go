@@ -4,8 +4,12 @@
 	"context"
 	crypto_rand "crypto/rand"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
@@ -20,7 +24,8 @@
 )
 
 type Proxy struct {
-	pluginsGlobals                PluginsGlobals
+	pluginsGlobals PluginsGlobals
+	pluginSettings
 	serversInfo                   ServersInfo
 	questionSizeEstimator         QuestionSizeEstimator
 	registeredServers             []RegisteredServer
@@ -28,54 +33,131 @@ type Proxy struct {
 	dns64Prefixes                 []string
 	serversBlockingFragments      []string
 	ednsClientSubnets             []*net.IPNet
-	queryLogIgnoredQtypes         []string
 	localDoHListeners             []*net.TCPListener
+	localDoTListeners             []*net.TCPListener
+	localDoQListeners             []*net.UDPConn
+	localDNSCryptUDPListeners     []*net.UDPConn
+	localDNSCryptTCPListeners     []*net.TCPListener
+	localUnixStreamListeners      []*net.UnixListener
+	localUnixDatagramListeners    []*net.UnixConn
+	transparentUDPListeners       []*net.UDPConn
+	transparentTCPListeners       []*net.TCPListener
 	queryMeta                     []string
 	udpListeners                  []*net.UDPConn
 	sources                       []*Source
 	tcpListeners                  []*net.TCPListener
 	registeredRelays              []RegisteredServer
+	lastResortServers             []*ServerInfo
+	systemFallback                *SystemFallback
+	retryPolicy                   RetryPolicy
+	ttlClamping                   *TTLClamping
+	patternMatcherBackend         string
+	healthChecker                 *HealthChecker
+	cacheSnapshot                 *CacheSnapshot
+	inflightQueries               InflightQueries
+	clientsLimiter                *ClientsLimiter
+	tcpConnLimiter                *TCPConnLimiter
+	tcpReadTimeout                time.Duration
+	tcpIdleTimeout                time.Duration
+	queryDrainer                  QueryDrainer
+	drainTimeout                  time.Duration
+	rrl                           *ResponseRateLimiter
+	clientRateLimitQPS            int
+	clientRateLimitBurst          int
+	clientRateLimitAction         string
+	clientSlotFreed               chan struct{}
+	overloadAction                string
+	lbRaceRatio                   int
+	lbSticky                      string
+	capabilitiesProbing           bool
 	listenAddresses               []string
 	localDoHListenAddresses       []string
+	localDoTListenAddresses       []string
+	localDoQListenAddresses       []string
+	localDNSCryptListenAddresses  []string
+	transparentListenAddresses    []string
+	localDNSCryptExternalAddress  string
+	localDNSCrypt                 *LocalDNSCryptServer
+	localUnixStreamPath           string
+	localUnixDatagramPath         string
+	localUnixPermissions          os.FileMode
 	xTransport                    *XTransport
 	allWeeklyRanges               *map[string]WeeklyRanges
 	routes                        *map[string][]string
+	relayChains                   map[string][]string
+	tcpPipelining                 bool
+	forwardHealthCheckInterval    time.Duration
+	edns0PaddingBlockSize         int
 	captivePortalMap              *CaptivePortalMap
-	nxLogFormat                   string
+	chaosTXT                      map[string]string
+	localZoneFiles                []string
+	queryPolicy                   *QueryPolicy
+	domainRoutes                  *DomainRoutes
+	networkProfiles               *NetworkProfiles
+	dhcpLeaseFiles                []string
+	dhcpLeaseSuffix               string
+	dhcpLeaseTTL                  uint32
+	dhcpLeaseRefreshInterval      time.Duration
+	mdnsTimeout                   time.Duration
+	mdnsInterface                 string
+	clientsAnonymizer             *ClientsAnonymizer
+	tracer                        *Tracer
+	queryStats                    *QueryStats
+	metricsExporter               *MetricsExporter
+	capture                       *PacketCapture
+	profiling                     *ProfilingServer
+	profilingEnabled              bool
+	listenerLabels                map[string]string
+	listenerACLs                  map[string]*ListenerACL
+	listenerProfiles              map[string]*ListenerProfile
+	proxyProtocol                 *ProxyProtocol
+	listenInterface               string
+	cacheEventLogger              *CacheEventLogger
+	alerter                       *Alerter
+	queryLogShipper               *QueryLogShipper
+	monitoringServer              *MonitoringServer
 	localDoHCertFile              string
 	localDoHCertKeyFile           string
+	localDoHACME                  *ACMEClient
+	localClientAuth               *LocalClientAuth
 	captivePortalMapFile          string
 	localDoHPath                  string
 	mainProto                     string
-	cloakFile                     string
-	forwardFile                   string
-	blockIPFormat                 string
-	blockIPLogFile                string
-	allowedIPFile                 string
-	allowedIPFormat               string
-	allowedIPLogFile              string
-	queryLogFormat                string
-	blockIPFile                   string
-	allowNameFile                 string
-	allowNameFormat               string
-	allowNameLogFile              string
-	blockNameLogFile              string
-	blockNameFormat               string
-	blockNameFile                 string
-	queryLogFile                  string
-	blockedQueryResponse          string
 	userName                      string
-	nxLogFile                     string
+	statsFile                     string
+	cacheLogFile                  string
+	cacheLogFormat                string
+	certLogFile                   string
+	certLogFormat                 string
+	certEvents                    *CertEvents
+	logRotation                   string
+	logCompression                *CompressionCodec
 	proxySecretKey                [32]byte
 	proxyPublicKey                [32]byte
 	ServerNames                   []string
 	DisabledServerNames           []string
 	requiredProps                 stamps.ServerInformalProperties
+	serverFilters                 *ServerFilters
 	certRefreshDelayAfterFailure  time.Duration
 	timeout                       time.Duration
+	cacheStaleMaxAge              time.Duration
 	certRefreshDelay              time.Duration
+	statsInterval                 time.Duration
 	certRefreshConcurrency        int
+	rebenchmarkInterval           time.Duration
+	rebenchmarkOnNetChange        bool
+	certRefreshTimeout            time.Duration
+	adaptiveTimeouts              *AdaptiveTimeouts
 	cacheSize                     int
+	cacheMaxMemory                int
+	cachePrefetchHits             int
+	cachePrefetchPercent          int
+	cacheOptimisticMaxAge         time.Duration
+	cachePartition                string
+	udpBatchSize                  int
+	ednsClientUDPSize             int
+	ednsUpstreamUDPSize           int
+	listenSockets                 int
 	logMaxBackups                 int
 	logMaxAge                     int
 	logMaxSize                    int
@@ -84,25 +166,39 @@ type Proxy struct {
 	cacheMaxTTL                   uint32
 	clientsCount                  uint32
 	maxClients                    uint32
+	maxQueuedClients              uint32
+	queuedClients                 uint32
 	cacheMinTTL                   uint32
 	cacheNegMaxTTL                uint32
+	cacheNoDataMinTTL             uint32
+	cacheNoDataMaxTTL             uint32
+	cacheServFailTTL              uint32
 	cloakTTL                      uint32
 	cloakedPTR                    bool
-	cache                         bool
-	pluginBlockIPv6               bool
+	monitoringStream              bool
+	logQueryIDs                   bool
 	ephemeralKeys                 bool
+	keyRotation                   time.Duration
+	clientKeys                    ClientKeys
 	pluginBlockUnqualified        bool
 	showCerts                     bool
 	certIgnoreTimestamp           bool
 	skipAnonIncompatibleResolvers bool
 	anonDirectCertFallback        bool
 	pluginBlockUndelegated        bool
+	pluginMinimizeAny             bool
+	mdnsBridge                    bool
+	mdnsIPv6                      bool
+	qnameCaseRandomization        bool
+	chaosRefuse                   bool
 	child                         bool
 	SourceIPv4                    bool
 	SourceIPv6                    bool
 	SourceDNSCrypt                bool
 	SourceDoH                     bool
 	SourceODoH                    bool
+	SourceDoT                     bool
+	SourceDoQ                     bool
 }
 
 func (proxy *Proxy) registerUDPListener(conn *net.UDPConn) {
@@ -148,11 +244,11 @@ func (proxy *Proxy) addDNSListener(listenAddrStr string) {
 	// if 'userName' is set and we are the parent process
 	if !proxy.child {
 		// parent
-		listenerUDP, err := net.ListenUDP(udp, listenUDPAddr)
+		listenerUDP, err := proxy.listenUDP(udp, listenUDPAddr)
 		if err != nil {
 			dlog.Fatal(err)
 		}
-		listenerTCP, err := net.ListenTCP(tcp, listenTCPAddr)
+		listenerTCP, err := proxy.listenTCP(tcp, listenTCPAddr)
 		if err != nil {
 			dlog.Fatal(err)
 		}
@@ -214,7 +310,7 @@ func (proxy *Proxy) addLocalDoHListener(listenAddrStr string) {
 	// if 'userName' is set and we are the parent process
 	if !proxy.child {
 		// parent
-		listenerTCP, err := net.ListenTCP(network, listenTCPAddr)
+		listenerTCP, err := proxy.listenTCP(network, listenTCPAddr)
 		if err != nil {
 			dlog.Fatal(err)
 		}
@@ -245,7 +341,51 @@ func (proxy *Proxy) StartProxy() {
 		dlog.Fatal(err)
 	}
 	curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
+	if proxy.cacheSnapshot != nil {
+		if err := proxy.cacheSnapshot.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			dlog.Warnf("Unable to load the cache snapshot: %v", err)
+		}
+		go proxy.cacheSnapshot.run()
+	}
+	if proxy.localDoHACME != nil && len(proxy.localDoHListeners)+len(proxy.localDoTListeners)+len(proxy.localDoQListeners) > 0 {
+		if err := proxy.localDoHACME.Start(); err != nil {
+			dlog.Fatal(err)
+		}
+	}
+	if proxy.localDNSCrypt != nil {
+		go proxy.localDNSCrypt.run()
+		for _, listenAddrStr := range proxy.localDNSCryptListenAddresses {
+			if len(proxy.localDNSCryptExternalAddress) > 0 {
+				listenAddrStr = proxy.localDNSCryptExternalAddress
+			}
+			dlog.Noticef("DNSCrypt server stamp: %s", proxy.localDNSCrypt.Stamp(listenAddrStr))
+			if len(proxy.localDNSCryptExternalAddress) > 0 {
+				break
+			}
+		}
+	}
 	proxy.startAcceptingClients()
+	if proxy.capture != nil {
+		proxy.monitoringServer.HandleMutatingFunc("/api/capture", proxy.capture.ServeHTTP)
+	}
+	if proxy.profiling != nil {
+		proxy.profiling.handleProfilingSignal()
+		proxy.monitoringServer.HandleMutatingFunc("/api/profiling", proxy.profiling.ServeHTTP)
+		if proxy.profilingEnabled {
+			if err := proxy.profiling.Enable(); err != nil {
+				dlog.Fatal(err)
+			}
+		}
+	}
+	proxy.monitoringServer.HandleFunc("/api/servers", func(writer http.ResponseWriter, request *http.Request) {
+		body, err := json.MarshalIndent(proxy.serversInfo.statsReport(), "", " ")
+		writeJSONResponse(writer, body, err)
+	})
+	if err := proxy.monitoringServer.Start(); err != nil {
+		dlog.Fatal(err)
+	}
+	proxy.alerter.Start(proxy)
+	proxy.queryLogShipper.Start()
 	if !proxy.child {
 		// Notify the service manager that dnscrypt-proxy is ready. dnscrypt-proxy manages itself in case
 		// servers are not immediately live/reachable. The service manager may assume it is initialized and
@@ -266,6 +406,9 @@ func (proxy *Proxy) StartProxy() {
 	}
 	if liveServers > 0 {
 		dlog.Noticef("dnscrypt-proxy is ready - live servers: %d", liveServers)
+		if proxy.capabilitiesProbing {
+			go proxy.serversInfo.probeAllCapabilities(proxy)
+		}
 	} else if err != nil {
 		dlog.Error(err)
 		dlog.Notice("dnscrypt-proxy is waiting for at least one server to be reachable")
@@ -288,11 +431,24 @@ func (proxy *Proxy) StartProxy() {
 				liveServers, _ = proxy.serversInfo.refresh(proxy)
 				if liveServers > 0 {
 					proxy.certIgnoreTimestamp = false
+					if proxy.capabilitiesProbing {
+						proxy.serversInfo.probeAllCapabilities(proxy)
+					}
 				}
 				runtime.GC()
 			}
 		}()
 	}
+	if proxy.healthChecker != nil {
+		go proxy.healthChecker.run(proxy)
+	}
+	if proxy.rebenchmarkInterval > 0 || proxy.rebenchmarkOnNetChange {
+		go proxy.runRebenchmarks()
+	}
+	if proxy.networkProfiles != nil {
+		proxy.networkProfiles.update(&proxy.serversInfo)
+		go proxy.networkProfiles.run(proxy)
+	}
 }
 
 func (proxy *Proxy) updateRegisteredServers() error {
@@ -314,11 +470,19 @@ func (proxy *Proxy) updateRegisteredServers() error {
 			if registeredServer.stamp.Proto != stamps.StampProtoTypeDNSCryptRelay &&
 				registeredServer.stamp.Proto != stamps.StampProtoTypeODoHRelay {
 				if len(proxy.ServerNames) > 0 {
-					if !includesName(proxy.ServerNames, registeredServer.name) {
+					if !includesName(proxy.ServerNames, registeredServer.name) &&
+						!proxy.networkProfiles.hasServer(registeredServer.name) {
+						continue
+					}
+				} else if !proxy.networkProfiles.hasServer(registeredServer.name) {
+					// Servers of network profiles are explicitly named, so they don't have to match the requirements
+					if registeredServer.stamp.Props&proxy.requiredProps != proxy.requiredProps {
+						continue
+					}
+					if !proxy.serverFilters.allows(&registeredServer) {
+						dlog.Debugf("[%s] doesn't match the server filters", registeredServer.name)
 						continue
 					}
-				} else if registeredServer.stamp.Props&proxy.requiredProps != proxy.requiredProps {
-					continue
 				}
 			}
 			if includesName(proxy.DisabledServerNames, registeredServer.name) {
@@ -361,15 +525,17 @@ func (proxy *Proxy) updateRegisteredServers() error {
 			} else {
 				if !((proxy.SourceDNSCrypt && registeredServer.stamp.Proto == stamps.StampProtoTypeDNSCrypt) ||
 					(proxy.SourceDoH && registeredServer.stamp.Proto == stamps.StampProtoTypeDoH) ||
-					(proxy.SourceODoH && registeredServer.stamp.Proto == stamps.StampProtoTypeODoHTarget)) {
+					(proxy.SourceODoH && registeredServer.stamp.Proto == stamps.StampProtoTypeODoHTarget) ||
+					(proxy.SourceDoT && registeredServer.stamp.Proto == stamps.StampProtoTypeTLS) ||
+					(proxy.SourceDoQ && registeredServer.stamp.Proto == stamps.StampProtoTypeDoQ)) {
 					continue
 				}
 				var found bool
 				for i, currentRegisteredServer := range proxy.registeredServers {
 					if currentRegisteredServer.name == registeredServer.name {
 						found = true
-						if currentRegisteredServer.stamp.String() != registeredServer.stamp.String() {
-							dlog.Infof("Updating stamp for [%s] was: %s now: %s", registeredServer.name, currentRegisteredServer.stamp.String(), registeredServer.stamp.String())
+						if StampString(&currentRegisteredServer.stamp) != StampString(&registeredServer.stamp) {
+							dlog.Infof("Updating stamp for [%s] was: %s now: %s", registeredServer.name, StampString(&currentRegisteredServer.stamp), StampString(&registeredServer.stamp))
 							proxy.registeredServers[i].stamp = registeredServer.stamp
 						}
 					}
@@ -394,58 +560,99 @@ func (proxy *Proxy) updateRegisteredServers() error {
 func (proxy *Proxy) udpListener(clientPc *net.UDPConn) {
 	defer clientPc.Close()
 	for {
-		buffer := make([]byte, MaxDNSPacketSize-1)
-		length, clientAddr, err := clientPc.ReadFrom(buffer)
+		buffer := getPacketBuffer()
+		length, clientAddr, err := clientPc.ReadFrom((*buffer)[:MaxDNSPacketSize-1])
 		if err != nil {
+			putPacketBuffer(buffer)
 			return
 		}
-		packet := buffer[:length]
-		if !proxy.clientsCountInc() {
-			dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
-			proxy.processIncomingQuery(
-				"udp",
-				proxy.mainProto,
-				packet,
-				&clientAddr,
-				clientPc,
-				time.Now(),
-				true,
-			) // respond synchronously, but only to cached/synthesized queries
-			continue
-		}
-		go func() {
-			defer proxy.clientsCountDec()
-			proxy.processIncomingQuery("udp", proxy.mainProto, packet, &clientAddr, clientPc, time.Now(), false)
-		}()
+		proxy.handleUDPQuery((*buffer)[:length], buffer, clientAddr, clientPc, time.Now())
 	}
 }
 
 func (proxy *Proxy) tcpListener(acceptPc *net.TCPListener) {
 	defer acceptPc.Close()
+	var listener net.Listener = acceptPc
+	if proxy.proxyProtocol != nil {
+		listener = &proxyProtocolListener{Listener: listener, proxyProtocol: proxy.proxyProtocol, timeout: proxy.timeout}
+	}
+	// Connections are counted once the PROXY protocol header has been read, so that limits apply to actual clients
+	listener = proxy.tcpConnLimiter.Wrap(listener)
 	for {
-		clientPc, err := acceptPc.Accept()
+		clientPc, err := listener.Accept()
 		if err != nil {
 			continue
 		}
-		if !proxy.clientsCountInc() {
-			dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
-			clientPc.Close()
+		if proxy.proxyProtocol != nil {
+			// Wait for the PROXY protocol header without blocking other clients
+			go proxy.acceptTCPClient(clientPc)
 			continue
 		}
-		go func() {
-			defer clientPc.Close()
-			defer proxy.clientsCountDec()
-			if err := clientPc.SetDeadline(time.Now().Add(proxy.timeout)); err != nil {
-				return
-			}
-			start := time.Now()
-			packet, err := ReadPrefixed(&clientPc)
-			if err != nil {
-				return
-			}
-			clientAddr := clientPc.RemoteAddr()
-			proxy.processIncomingQuery("tcp", "tcp", packet, &clientAddr, clientPc, start, false)
-		}()
+		proxy.acceptTCPClient(clientPc)
+	}
+}
+
+func (proxy *Proxy) acceptTCPClient(clientPc net.Conn) {
+	clientAddr := clientPc.RemoteAddr()
+	if acl := proxy.listenerACL(clientPc.LocalAddr()); !acl.Allows(clientAddr) {
+		dlog.Debugf("Client [%v] is not allowed to use this listener", clientAddr)
+		if acl.Drops() {
+			clientPc.Close()
+			return
+		}
+		go proxy.rejectTCPClient(acl, clientPc)
+		return
+	}
+	if !proxy.clientsLimiter.acquire(clientAddr) {
+		dlog.Debugf("Too many concurrent queries from [%v]", clientAddr)
+		clientPc.Close()
+		return
+	}
+	admitted := proxy.clientsCountInc()
+	if !admitted && !proxy.clientsCountQueue() {
+		dlog.Warnf("Too many incoming connections (max=%d)", proxy.maxClients)
+		proxy.clientsLimiter.release(clientAddr)
+		clientPc.Close()
+		return
+	}
+	go func() {
+		defer clientPc.Close()
+		defer proxy.clientsLimiter.release(clientAddr)
+		if !admitted && !proxy.clientsCountWait() {
+			return
+		}
+		defer proxy.clientsCountDec()
+		if err := clientPc.SetDeadline(time.Now().Add(proxy.tcpReadTimeout)); err != nil {
+			return
+		}
+		packet, err := ReadPrefixed(&clientPc)
+		if err != nil {
+			return
+		}
+		start := time.Now()
+		if err := clientPc.SetDeadline(start.Add(proxy.timeout)); err != nil {
+			return
+		}
+		proxy.processIncomingQuery("tcp", "tcp", packet, &clientAddr, clientPc, start, false)
+	}()
+}
+
+// rejectTCPClient responds to a single query from a client that is not allowed to use a listener
+func (proxy *Proxy) rejectTCPClient(acl *ListenerACL, clientPc net.Conn) {
+	defer clientPc.Close()
+	if err := clientPc.SetDeadline(time.Now().Add(proxy.tcpReadTimeout)); err != nil {
+		return
+	}
+	packet, err := ReadPrefixed(&clientPc)
+	if err != nil {
+		return
+	}
+	response := acl.Reject(packet)
+	if len(response) == 0 {
+		return
+	}
+	if response, err = PrefixWithSize(response); err == nil {
+		clientPc.Write(response)
 	}
 }
 
@@ -454,17 +661,25 @@ func (proxy *Proxy) udpListenerFromAddr(listenAddr *net.UDPAddr) error {
 	if err != nil {
 		return err
 	}
+	listenConfig = proxy.bindListenConfig(listenConfig)
 	listenAddrStr := listenAddr.String()
 	network := "udp"
 	isIPv4 := isDigit(listenAddrStr[0])
 	if isIPv4 {
 		network = "udp4"
 	}
-	clientPc, err := listenConfig.ListenPacket(context.Background(), network, listenAddrStr)
-	if err != nil {
-		return err
+	if proxy.listenSockets > 1 {
+		if err := setReusePort(listenConfig); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < Max(1, proxy.listenSockets); i++ {
+		clientPc, err := listenConfig.ListenPacket(context.Background(), network, listenAddrStr)
+		if err != nil {
+			return err
+		}
+		proxy.registerUDPListener(clientPc.(*net.UDPConn))
 	}
-	proxy.registerUDPListener(clientPc.(*net.UDPConn))
 	dlog.Noticef("Now listening to %v [UDP]", listenAddr)
 	return nil
 }
@@ -474,17 +689,25 @@ func (proxy *Proxy) tcpListenerFromAddr(listenAddr *net.TCPAddr) error {
 	if err != nil {
 		return err
 	}
+	listenConfig = proxy.bindListenConfig(listenConfig)
 	listenAddrStr := listenAddr.String()
 	network := "tcp"
 	isIPv4 := isDigit(listenAddrStr[0])
 	if isIPv4 {
 		network = "tcp4"
 	}
-	acceptPc, err := listenConfig.Listen(context.Background(), network, listenAddrStr)
-	if err != nil {
-		return err
+	if proxy.listenSockets > 1 {
+		if err := setReusePort(listenConfig); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < Max(1, proxy.listenSockets); i++ {
+		acceptPc, err := listenConfig.Listen(context.Background(), network, listenAddrStr)
+		if err != nil {
+			return err
+		}
+		proxy.registerTCPListener(acceptPc.(*net.TCPListener))
 	}
-	proxy.registerTCPListener(acceptPc.(*net.TCPListener))
 	dlog.Noticef("Now listening to %v [TCP]", listenAddr)
 	return nil
 }
@@ -494,6 +717,7 @@ func (proxy *Proxy) localDoHListenerFromAddr(listenAddr *net.TCPAddr) error {
 	if err != nil {
 		return err
 	}
+	listenConfig = proxy.bindListenConfig(listenConfig)
 	listenAddrStr := listenAddr.String()
 	network := "tcp"
 	isIPv4 := isDigit(listenAddrStr[0])
@@ -511,7 +735,11 @@ func (proxy *Proxy) localDoHListenerFromAddr(listenAddr *net.TCPAddr) error {
 
 func (proxy *Proxy) startAcceptingClients() {
 	for _, clientPc := range proxy.udpListeners {
-		go proxy.udpListener(clientPc)
+		if proxy.udpBatchSize > 1 {
+			go proxy.udpBatchListener(clientPc)
+		} else {
+			go proxy.udpListener(clientPc)
+		}
 	}
 	proxy.udpListeners = nil
 	for _, acceptPc := range proxy.tcpListeners {
@@ -522,6 +750,38 @@ func (proxy *Proxy) startAcceptingClients() {
 		go proxy.localDoHListener(acceptPc)
 	}
 	proxy.localDoHListeners = nil
+	for _, acceptPc := range proxy.localDoTListeners {
+		go proxy.localDoTListener(acceptPc)
+	}
+	proxy.localDoTListeners = nil
+	for _, clientPc := range proxy.localDoQListeners {
+		go proxy.localDoQListener(clientPc)
+	}
+	proxy.localDoQListeners = nil
+	for _, clientPc := range proxy.localDNSCryptUDPListeners {
+		go proxy.localDNSCryptUDPListener(clientPc)
+	}
+	proxy.localDNSCryptUDPListeners = nil
+	for _, acceptPc := range proxy.localDNSCryptTCPListeners {
+		go proxy.localDNSCryptTCPListener(acceptPc)
+	}
+	proxy.localDNSCryptTCPListeners = nil
+	for _, acceptPc := range proxy.localUnixStreamListeners {
+		go proxy.localUnixStreamListener(acceptPc)
+	}
+	proxy.localUnixStreamListeners = nil
+	for _, clientPc := range proxy.localUnixDatagramListeners {
+		go proxy.localUnixDatagramListener(clientPc)
+	}
+	proxy.localUnixDatagramListeners = nil
+	for _, clientPc := range proxy.transparentUDPListeners {
+		go proxy.transparentUDPListener(clientPc)
+	}
+	proxy.transparentUDPListeners = nil
+	for _, acceptPc := range proxy.transparentTCPListeners {
+		go proxy.transparentTCPListener(acceptPc)
+	}
+	proxy.transparentTCPListeners = nil
 }
 
 func (proxy *Proxy) prepareForRelay(ip net.IP, port int, encryptedQuery *[]byte) {
@@ -534,6 +794,15 @@ func (proxy *Proxy) prepareForRelay(ip net.IP, port int, encryptedQuery *[]byte)
 	*encryptedQuery = relayedQuery
 }
 
+// prepareForRelayChain encapsulates a query for the server, then for every hop after the first relay,
+// the outermost header being for the second relay, so that each relay forwards the query to the next hop
+func (proxy *Proxy) prepareForRelayChain(relay *DNSCryptRelay, ip net.IP, port int, encryptedQuery *[]byte) {
+	proxy.prepareForRelay(ip, port, encryptedQuery)
+	for i := len(relay.NextHops) - 1; i >= 0; i-- {
+		proxy.prepareForRelay(relay.NextHops[i].IP, relay.NextHops[i].Port, encryptedQuery)
+	}
+}
+
 func (proxy *Proxy) exchangeWithUDPServer(
 	serverInfo *ServerInfo,
 	sharedKey *[32]byte,
@@ -546,9 +815,9 @@ func (proxy *Proxy) exchangeWithUDPServer(
 	}
 	var err error
 	var pc net.Conn
-	proxyDialer := proxy.xTransport.proxyDialer
+	proxyDialer := proxy.xTransport.dialerFor(serverInfo.UDPAddr.IP.String())
 	if proxyDialer == nil {
-		pc, err = net.DialTimeout("udp", upstreamAddr.String(), serverInfo.Timeout)
+		pc, err = outboundDialer(serverInfo.currentTimeout()).Dial("udp", upstreamAddr.String())
 	} else {
 		pc, err = (*proxyDialer).Dial("udp", upstreamAddr.String())
 	}
@@ -556,13 +825,15 @@ func (proxy *Proxy) exchangeWithUDPServer(
 		return nil, err
 	}
 	defer pc.Close()
-	if err := pc.SetDeadline(time.Now().Add(serverInfo.Timeout)); err != nil {
+	if err := pc.SetDeadline(time.Now().Add(serverInfo.currentTimeout())); err != nil {
 		return nil, err
 	}
 	if serverInfo.Relay != nil && serverInfo.Relay.Dnscrypt != nil {
-		proxy.prepareForRelay(serverInfo.UDPAddr.IP, serverInfo.UDPAddr.Port, &encryptedQuery)
+		proxy.prepareForRelayChain(serverInfo.Relay.Dnscrypt, serverInfo.UDPAddr.IP, serverInfo.UDPAddr.Port, &encryptedQuery)
 	}
-	encryptedResponse := make([]byte, MaxDNSPacketSize)
+	buffer := getPacketBuffer()
+	defer putPacketBuffer(buffer)
+	encryptedResponse := (*buffer)[:MaxDNSPacketSize]
 	for tries := 2; tries > 0; tries-- {
 		if _, err := pc.Write(encryptedQuery); err != nil {
 			return nil, err
@@ -574,7 +845,12 @@ func (proxy *Proxy) exchangeWithUDPServer(
 		}
 		dlog.Debugf("[%v] Retry on timeout", serverInfo.Name)
 	}
-	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+	// The decrypted response is a new buffer, that doesn't share anything with the pooled one
+	response, err := proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
 }
 
 func (proxy *Proxy) exchangeWithTCPServer(
@@ -583,15 +859,22 @@ func (proxy *Proxy) exchangeWithTCPServer(
 	encryptedQuery []byte,
 	clientNonce []byte,
 ) ([]byte, error) {
+	if serverInfo.tcpPipeline != nil {
+		encryptedResponse, err := serverInfo.tcpPipeline.Exchange(encryptedQuery, string(clientNonce), serverInfo.currentTimeout())
+		if err != nil {
+			return nil, err
+		}
+		return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+	}
 	upstreamAddr := serverInfo.TCPAddr
 	if serverInfo.Relay != nil && serverInfo.Relay.Dnscrypt != nil {
 		upstreamAddr = serverInfo.Relay.Dnscrypt.RelayTCPAddr
 	}
 	var err error
 	var pc net.Conn
-	proxyDialer := proxy.xTransport.proxyDialer
+	proxyDialer := proxy.xTransport.dialerFor(serverInfo.TCPAddr.IP.String())
 	if proxyDialer == nil {
-		pc, err = net.DialTimeout("tcp", upstreamAddr.String(), serverInfo.Timeout)
+		pc, err = outboundDialer(serverInfo.currentTimeout()).Dial("tcp", upstreamAddr.String())
 	} else {
 		pc, err = (*proxyDialer).Dial("tcp", upstreamAddr.String())
 	}
@@ -599,11 +882,11 @@ func (proxy *Proxy) exchangeWithTCPServer(
 		return nil, err
 	}
 	defer pc.Close()
-	if err := pc.SetDeadline(time.Now().Add(serverInfo.Timeout)); err != nil {
+	if err := pc.SetDeadline(time.Now().Add(serverInfo.currentTimeout())); err != nil {
 		return nil, err
 	}
 	if serverInfo.Relay != nil && serverInfo.Relay.Dnscrypt != nil {
-		proxy.prepareForRelay(serverInfo.TCPAddr.IP, serverInfo.TCPAddr.Port, &encryptedQuery)
+		proxy.prepareForRelayChain(serverInfo.Relay.Dnscrypt, serverInfo.TCPAddr.IP, serverInfo.TCPAddr.Port, &encryptedQuery)
 	}
 	encryptedQuery, err = PrefixWithSize(encryptedQuery)
 	if err != nil {
@@ -639,6 +922,10 @@ func (proxy *Proxy) clientsCountDec() {
 			break
 		}
 	}
+	select {
+	case proxy.clientSlotFreed <- struct{}{}:
+	default:
+	}
 }
 
 func (proxy *Proxy) processIncomingQuery(
@@ -649,26 +936,69 @@ func (proxy *Proxy) processIncomingQuery(
 	clientPc net.Conn,
 	start time.Time,
 	onlyCached bool,
+) []byte {
+	listener := proxy.listenerLabel(nil)
+	if clientPc != nil {
+		listener = proxy.listenerLabel(clientPc.LocalAddr())
+	}
+	return proxy.processIncomingQueryFrom(listener, clientProto, serverProto, query, clientAddr, clientPc, start, onlyCached)
+}
+
+// processIncomingQueryFrom is the same as processIncomingQuery, for a query received by a given listener
+func (proxy *Proxy) processIncomingQueryFrom(
+	listener string,
+	clientProto string,
+	serverProto string,
+	query []byte,
+	clientAddr *net.Addr,
+	clientPc net.Conn,
+	start time.Time,
+	onlyCached bool,
 ) []byte {
 	var response []byte
-	if len(query) < MinDNSPacketSize {
+	if len(query) < MinDNSPacketSize || !proxy.queryDrainer.enter() {
 		return response
 	}
+	defer proxy.queryDrainer.leave()
 	pluginsState := NewPluginsState(proxy, clientProto, clientAddr, serverProto, start)
+	pluginsState.listener = listener
+	if conn, ok := clientPc.(transparentConn); ok {
+		if origDst := conn.OriginalDestination(); origDst != nil {
+			pluginsState.originalDst = origDst.String()
+		}
+	}
+	pluginsGlobals, hasProfile := proxy.listenerPluginsGlobals(listener)
+	if proxy.cachePartition == CachePartitionListener || hasProfile {
+		pluginsState.cachePartition = listener
+	}
+	if proxy.capture.Active() {
+		rawQuery := append([]byte{}, query...)
+		defer func() {
+			proxy.captureExchange(&pluginsState, clientPc, rawQuery, response)
+		}()
+	}
 	serverName := "-"
-	needsEDNS0Padding := false
+	paddingBlockSize := 0
 	serverInfo := proxy.serversInfo.getOne()
+	if serverInfo == nil && !onlyCached {
+		serverInfo = proxy.lastResortServer()
+	}
+	if !onlyCached && (serverInfo == nil || serverInfo.Proto != stamps.StampProtoTypePlain) {
+		if systemServerInfo := proxy.systemFallback.server(proxy); systemServerInfo != nil {
+			serverInfo = systemServerInfo
+		}
+	}
 	if serverInfo != nil {
 		serverName = serverInfo.Name
-		needsEDNS0Padding = (serverInfo.Proto == stamps.StampProtoTypeDoH || serverInfo.Proto == stamps.StampProtoTypeTLS)
+		paddingBlockSize = proxy.paddingBlockSize(serverInfo)
 	}
-	query, _ = pluginsState.ApplyQueryPlugins(&proxy.pluginsGlobals, query, needsEDNS0Padding)
+	query, _ = pluginsState.ApplyQueryPlugins(pluginsGlobals, query, paddingBlockSize)
 	if len(query) < MinDNSPacketSize || len(query) > MaxDNSPacketSize {
 		return response
 	}
 	if pluginsState.action == PluginsActionDrop {
 		pluginsState.returnCode = PluginsReturnCodeDrop
-		pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+		pluginsState.ApplyLoggingPlugins(pluginsGlobals)
 		return response
 	}
 	var err error
@@ -676,179 +1006,93 @@ func (proxy *Proxy) processIncomingQuery(
 		response, err = pluginsState.synthResponse.PackBuffer(response)
 		if err != nil {
 			pluginsState.returnCode = PluginsReturnCodeParseError
-			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+			pluginsState.ApplyLoggingPlugins(pluginsGlobals)
 			return response
 		}
+	} else if pluginsState.synthPacket != nil {
+		response = pluginsState.synthPacket
 	}
 	if onlyCached {
 		if len(response) == 0 {
 			return response
 		}
 		serverInfo = nil
+	} else if routedServers := proxy.domainRoutes.serversFor(pluginsState.qName); routedServers != nil {
+		// Names routed to specific servers are never sent to other servers
+		pluginsState.routedServers = routedServers
+		serverInfo = proxy.serversInfo.getOneOf(routedServers)
+		if serverInfo != nil {
+			serverName = serverInfo.Name
+		}
+	} else if key := proxy.stickyKey(&pluginsState); len(key) > 0 && !proxy.systemFallback.isActive() {
+		if stickyServerInfo := proxy.serversInfo.getSticky(key); stickyServerInfo != nil {
+			serverInfo, serverName = stickyServerInfo, stickyServerInfo.Name
+		}
 	}
 	if len(response) == 0 && serverInfo != nil {
-		var ttl *uint32
 		pluginsState.serverName = serverName
-		if serverInfo.Proto == stamps.StampProtoTypeDNSCrypt {
-			sharedKey, encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, serverProto)
-			if err != nil && serverProto == "udp" {
-				dlog.Debug("Unable to pad for UDP, re-encrypting query for TCP")
-				serverProto = "tcp"
-				sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, serverProto)
-			}
-			if err != nil {
+		if serverInfo.Proto == stamps.StampProtoTypePlain && proxy.systemFallback.isActive() {
+			dlog.Debugf("Break-glass mode - Sending the query UNENCRYPTED to [%s]", serverName)
+		}
+		exchangeSpan := pluginsState.trace.StartSpan("exchange", 0)
+		pluginsState.trace.SetAttribute(exchangeSpan, "server.name", serverName)
+		pluginsState.trace.SetAttribute(exchangeSpan, "server.protocol", serverInfo.Proto.String())
+		response, serverInfo, err = proxy.exchangeCoalesced(&pluginsState, serverInfo, query, serverProto)
+		if err != nil {
+			var encryptionErr *QueryEncryptionError
+			if errors.As(err, &encryptionErr) {
 				pluginsState.returnCode = PluginsReturnCodeParseError
-				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+				pluginsState.ApplyLoggingPlugins(pluginsGlobals)
 				return response
 			}
-			serverInfo.noticeBegin(proxy)
-			if serverProto == "udp" {
-				response, err = proxy.exchangeWithUDPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
-				retryOverTCP := false
-				if err == nil && len(response) >= MinDNSPacketSize && response[2]&0x02 == 0x02 {
-					retryOverTCP = true
-				} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-					dlog.Debugf("[%v] Retry over TCP after UDP timeouts", serverName)
-					retryOverTCP = true
-				}
-				if retryOverTCP {
-					serverProto = "tcp"
-					sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, serverProto)
-					if err != nil {
-						pluginsState.returnCode = PluginsReturnCodeParseError
-						pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
-						return response
-					}
-					response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
-				}
-			} else {
-				response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
-			}
-			if err != nil {
-				if stale, ok := pluginsState.sessionData["stale"]; ok {
-					dlog.Debug("Serving stale response")
-					response, err = (stale.(*dns.Msg)).Pack()
-				}
-			}
-			if err != nil {
-				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-					pluginsState.returnCode = PluginsReturnCodeServerTimeout
-				} else {
-					pluginsState.returnCode = PluginsReturnCodeNetworkError
-				}
-				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
-				serverInfo.noticeFailure(proxy)
-				return response
-			}
-		} else if serverInfo.Proto == stamps.StampProtoTypeDoH {
-			tid := TransactionID(query)
-			SetTransactionID(query, 0)
-			serverInfo.noticeBegin(proxy)
-			serverResponse, _, tls, _, err := proxy.xTransport.DoHQuery(serverInfo.useGet, serverInfo.URL, query, proxy.timeout)
-			SetTransactionID(query, tid)
-
-			if err != nil || tls == nil || !tls.HandshakeComplete {
-				if stale, ok := pluginsState.sessionData["stale"]; ok {
-					dlog.Debug("Serving stale response")
-					response, err = (stale.(*dns.Msg)).Pack()
-				}
-			}
-			if err != nil {
-				pluginsState.returnCode = PluginsReturnCodeNetworkError
-				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
-				serverInfo.noticeFailure(proxy)
-				return response
-			}
-			if response == nil {
-				response = serverResponse
-			}
-			if len(response) >= MinDNSPacketSize {
-				SetTransactionID(response, tid)
-			}
-		} else if serverInfo.Proto == stamps.StampProtoTypeODoHTarget {
-			tid := TransactionID(query)
-			if len(serverInfo.odohTargetConfigs) == 0 {
-				return response
+			if staleResponse := proxy.serveStale(&pluginsState); staleResponse != nil {
+				response, err = staleResponse, nil
 			}
-			target := serverInfo.odohTargetConfigs[rand.Intn(len(serverInfo.odohTargetConfigs))]
-			odohQuery, err := target.encryptQuery(query)
-			if err != nil {
-				dlog.Errorf("Failed to encrypt query for [%v]", serverName)
-				response = nil
+		}
+		if err != nil {
+			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				pluginsState.returnCode = PluginsReturnCodeServerTimeout
+				serverInfo.noticeTimeout(proxy)
 			} else {
-				targetURL := serverInfo.URL
-				if serverInfo.Relay != nil && serverInfo.Relay.ODoH != nil {
-					targetURL = serverInfo.Relay.ODoH.URL
-				}
-				responseBody, responseCode, _, _, err := proxy.xTransport.ObliviousDoHQuery(serverInfo.useGet, targetURL, odohQuery.odohMessage, proxy.timeout)
-				if err == nil && len(responseBody) > 0 && responseCode == 200 {
-					response, err = odohQuery.decryptResponse(responseBody)
-					if err != nil {
-						dlog.Warnf("Failed to decrypt response from [%v]", serverName)
-						response = nil
-					}
-				} else if responseCode == 401 || (responseCode == 200 && len(responseBody) == 0) {
-					if responseCode == 200 {
-						dlog.Warnf("ODoH relay for [%v] is buggy and returns a 200 status code instead of 401 after a key update", serverInfo.Name)
-					}
-					dlog.Infof("Forcing key update for [%v]", serverInfo.Name)
-					for _, registeredServer := range proxy.serversInfo.registeredServers {
-						if registeredServer.name == serverInfo.Name {
-							if err = proxy.serversInfo.refreshServer(proxy, registeredServer.name, registeredServer.stamp); err != nil {
-								// Failed to refresh the proxy server information.
-								dlog.Noticef("Key update failed for [%v]", serverName)
-								serverInfo.noticeFailure(proxy)
-								clocksmith.Sleep(10 * time.Second)
-							}
-							break
-						}
-					}
-					response = nil
-				} else {
-					dlog.Warnf("Failed to receive successful response from [%v]", serverName)
-				}
-			}
-
-			if len(response) >= MinDNSPacketSize {
-				SetTransactionID(response, tid)
-			} else if response == nil {
 				pluginsState.returnCode = PluginsReturnCodeNetworkError
-				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
 				serverInfo.noticeFailure(proxy)
-				return response
 			}
-		} else {
-			dlog.Fatal("Unsupported protocol")
+			pluginsState.ApplyLoggingPlugins(pluginsGlobals)
+			return response
 		}
 		if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
 			pluginsState.returnCode = PluginsReturnCodeParseError
-			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+			pluginsState.ApplyLoggingPlugins(pluginsGlobals)
 			serverInfo.noticeFailure(proxy)
 			return response
 		}
-		response, err = pluginsState.ApplyResponsePlugins(&proxy.pluginsGlobals, response, ttl)
+		pluginsState.trace.EndSpan(exchangeSpan)
+		response, err = pluginsState.ApplyResponsePlugins(pluginsGlobals, response)
 		if err != nil {
 			pluginsState.returnCode = PluginsReturnCodeParseError
-			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+			pluginsState.ApplyLoggingPlugins(pluginsGlobals)
 			serverInfo.noticeFailure(proxy)
 			return response
 		}
 		if pluginsState.action == PluginsActionDrop {
 			pluginsState.returnCode = PluginsReturnCodeDrop
-			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+			pluginsState.ApplyLoggingPlugins(pluginsGlobals)
 			return response
 		}
 		if pluginsState.synthResponse != nil {
 			response, err = pluginsState.synthResponse.PackBuffer(response)
 			if err != nil {
 				pluginsState.returnCode = PluginsReturnCodeParseError
-				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+				pluginsState.ApplyLoggingPlugins(pluginsGlobals)
 				return response
 			}
+		} else if pluginsState.synthPacket != nil {
+			response = pluginsState.synthPacket
 		}
 		if rcode := Rcode(response); rcode == dns.RcodeServerFailure { // SERVFAIL
+			serverInfo.noticeServFail(proxy)
 			if pluginsState.dnssec {
-				dlog.Debug("A response had an invalid DNSSEC signature")
+				dlog.Debugf("[%s] A response had an invalid DNSSEC signature", pluginsState.queryID)
 			} else {
 				dlog.Infof("A response with status code 2 was received - this is usually a temporary, remote issue with the configuration of the domain name")
 				serverInfo.noticeFailure(proxy)
@@ -856,6 +1100,9 @@ func (proxy *Proxy) processIncomingQuery(
 		} else {
 			serverInfo.noticeSuccess(proxy)
 		}
+	} else if len(response) == 0 && !onlyCached {
+		// No servers are available
+		response = proxy.serveStale(&pluginsState)
 	}
 	if len(response) < MinDNSPacketSize || len(response) > MaxDNSPacketSize {
 		if len(response) == 0 {
@@ -863,18 +1110,32 @@ func (proxy *Proxy) processIncomingQuery(
 		} else {
 			pluginsState.returnCode = PluginsReturnCodeParseError
 		}
-		pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+		pluginsState.ApplyLoggingPlugins(pluginsGlobals)
 		if serverInfo != nil {
 			serverInfo.noticeFailure(proxy)
 		}
 		return response
 	}
+	proxy.ttlClamping.apply(&pluginsState, response)
+	setEDNS0UDPSize(response, uint16(proxy.ednsClientUDPSize))
 	if clientProto == "udp" {
+		switch proxy.rrl.Limit(*clientAddr, clientPc.LocalAddr()) {
+		case RRLActionDrop:
+			pluginsState.returnCode = PluginsReturnCodeDrop
+			pluginsState.ApplyLoggingPlugins(pluginsGlobals)
+			return nil
+		case RRLActionSlip:
+			if response, err = TruncatedResponse(response); err != nil {
+				pluginsState.returnCode = PluginsReturnCodeParseError
+				pluginsState.ApplyLoggingPlugins(pluginsGlobals)
+				return response
+			}
+		}
 		if len(response) > pluginsState.maxUnencryptedUDPSafePayloadSize {
 			response, err = TruncatedResponse(response)
 			if err != nil {
 				pluginsState.returnCode = PluginsReturnCodeParseError
-				pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+				pluginsState.ApplyLoggingPlugins(pluginsGlobals)
 				return response
 			}
 		}
@@ -888,7 +1149,7 @@ func (proxy *Proxy) processIncomingQuery(
 		response, err = PrefixWithSize(response)
 		if err != nil {
 			pluginsState.returnCode = PluginsReturnCodeParseError
-			pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+			pluginsState.ApplyLoggingPlugins(pluginsGlobals)
 			if serverInfo != nil {
 				serverInfo.noticeFailure(proxy)
 			}
@@ -898,7 +1159,7 @@ func (proxy *Proxy) processIncomingQuery(
 			clientPc.Write(response)
 		}
 	}
-	pluginsState.ApplyLoggingPlugins(&proxy.pluginsGlobals)
+	pluginsState.ApplyLoggingPlugins(pluginsGlobals)
 
 	return response
 }
@@ -908,3 +1169,136 @@ func NewProxy() *Proxy {
 		serversInfo: NewServersInfo(),
 	}
 }
+
+// QueryEncryptionError is returned when a query couldn't be encrypted for a server; it is never retried
+type QueryEncryptionError struct {
+	err error
+}
+
+func (e *QueryEncryptionError) Error() string {
+	return e.err.Error()
+}
+
+// paddingBlockSize returns the block size queries sent to a server are padded to, or 0 if they are not padded
+func (proxy *Proxy) paddingBlockSize(serverInfo *ServerInfo) int {
+	switch serverInfo.Proto {
+	case stamps.StampProtoTypeDoH, stamps.StampProtoTypeTLS, stamps.StampProtoTypeDoQ:
+		return proxy.edns0PaddingBlockSize
+	}
+	return 0
+}
+
+// exchangeWithServer sends a query to a server, using its protocol, and returns the response
+func (proxy *Proxy) exchangeWithServer(pluginsState *PluginsState, serverInfo *ServerInfo, query []byte, serverProto string) ([]byte, error) {
+	switch serverInfo.Proto {
+	case stamps.StampProtoTypeDNSCrypt:
+		if serverProto == "udp" && proxy.xTransport.dialerFor(serverInfo.TCPAddr.IP.String()) != nil {
+			// Proxies only support TCP
+			serverProto = "tcp"
+		}
+		sharedKey, encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, serverProto)
+		if err != nil && serverProto == "udp" {
+			dlog.Debugf("[%s] Unable to pad for UDP, re-encrypting query for TCP", pluginsState.queryID)
+			serverProto = "tcp"
+			sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, serverProto)
+		}
+		if err != nil {
+			return nil, &QueryEncryptionError{err: err}
+		}
+		if serverProto == "udp" {
+			response, err := proxy.exchangeWithUDPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
+			retryOverTCP := false
+			if err == nil && len(response) >= MinDNSPacketSize && response[2]&0x02 == 0x02 {
+				retryOverTCP = true
+			} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				dlog.Debugf("[%s] [%v] Retry over TCP after UDP timeouts", pluginsState.queryID, serverInfo.Name)
+				retryOverTCP = true
+			}
+			if !retryOverTCP {
+				return response, err
+			}
+			sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, "tcp")
+			if err != nil {
+				return nil, &QueryEncryptionError{err: err}
+			}
+		}
+		return proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
+	case stamps.StampProtoTypeDoH:
+		// The HTTP client may still read the body after returning, so it gets its own copy of the query
+		tid := TransactionID(query)
+		dohQuery := append([]byte{}, query...)
+		SetTransactionID(dohQuery, 0)
+		response, _, tls, _, err := proxy.xTransport.DoHQuery(serverInfo.useGet, serverInfo.URL, dohQuery, serverInfo.currentTimeout())
+		if err == nil && (tls == nil || !tls.HandshakeComplete) {
+			err = errors.New("TLS handshake with the DoH server was not completed")
+		}
+		if err == nil && len(response) >= MinDNSPacketSize {
+			SetTransactionID(response, tid)
+		}
+		return response, err
+	case stamps.StampProtoTypeTLS:
+		response, _, err := serverInfo.dot.Exchange(query, serverInfo.currentTimeout())
+		return response, err
+	case stamps.StampProtoTypeDoQ:
+		response, _, err := serverInfo.doq.Exchange(query, serverInfo.currentTimeout())
+		return response, err
+	case stamps.StampProtoTypeODoHTarget:
+		return proxy.exchangeWithODoHServer(serverInfo, query)
+	case stamps.StampProtoTypePlain:
+		return proxy.exchangeWithPlainServer(serverInfo, query, serverProto)
+	}
+	dlog.Fatal("Unsupported protocol")
+	return nil, nil
+}
+
+func (proxy *Proxy) exchangeWithODoHServer(serverInfo *ServerInfo, query []byte) ([]byte, error) {
+	tid := TransactionID(query)
+	if len(serverInfo.odohTargetConfigs) == 0 {
+		return nil, errors.New("No ODoH target configuration")
+	}
+	target := serverInfo.odohTargetConfigs[rand.Intn(len(serverInfo.odohTargetConfigs))]
+	odohQuery, err := target.encryptQuery(query)
+	if err != nil {
+		dlog.Errorf("Failed to encrypt query for [%v]", serverInfo.Name)
+		return nil, err
+	}
+	targetURL := serverInfo.URL
+	if serverInfo.Relay != nil && serverInfo.Relay.ODoH != nil {
+		targetURL = serverInfo.Relay.ODoH.URL
+	}
+	responseBody, responseCode, _, _, err := proxy.xTransport.ObliviousDoHQuery(serverInfo.useGet, targetURL, odohQuery.odohMessage, serverInfo.currentTimeout())
+	if err == nil && len(responseBody) > 0 && responseCode == 200 {
+		response, err := odohQuery.decryptResponse(responseBody)
+		if err != nil {
+			dlog.Warnf("Failed to decrypt response from [%v]", serverInfo.Name)
+			return nil, err
+		}
+		if len(response) >= MinDNSPacketSize {
+			SetTransactionID(response, tid)
+		}
+		return response, nil
+	}
+	if responseCode == 401 || (responseCode == 200 && len(responseBody) == 0) {
+		if responseCode == 200 {
+			dlog.Warnf("ODoH relay for [%v] is buggy and returns a 200 status code instead of 401 after a key update", serverInfo.Name)
+		}
+		dlog.Infof("Forcing key update for [%v]", serverInfo.Name)
+		for _, registeredServer := range proxy.serversInfo.registeredServers {
+			if registeredServer.name == serverInfo.Name {
+				if err = proxy.serversInfo.refreshServer(proxy, registeredServer.name, registeredServer.stamp); err != nil {
+					// Failed to refresh the proxy server information.
+					dlog.Noticef("Key update failed for [%v]", serverInfo.Name)
+					serverInfo.noticeFailure(proxy)
+					clocksmith.Sleep(10 * time.Second)
+				}
+				break
+			}
+		}
+		return nil, errors.New("The ODoH key had to be updated")
+	}
+	dlog.Warnf("Failed to receive successful response from [%v]", serverInfo.Name)
+	if err == nil {
+		err = fmt.Errorf("Unexpected HTTP status code: %d", responseCode)
+	}
+	return nil, err
+}
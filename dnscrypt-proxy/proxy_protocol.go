@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtocolV2CommandLocal = 0x20
+	proxyProtocolV2CommandProxy = 0x21
+	proxyProtocolV2FamilyTCP4   = 0x11
+	proxyProtocolV2FamilyTCP6   = 0x21
+)
+
+// ProxyProtocol accepts PROXY protocol (version 2) headers from trusted frontends, such as load balancers,
+// so that the actual addresses of their clients can be used instead of their own address.
+type ProxyProtocol struct {
+	trustedFrontends []*net.IPNet
+}
+
+// NewProxyProtocol returns nil if no frontends are trusted
+func NewProxyProtocol(trustedFrontends []string) (*ProxyProtocol, error) {
+	if len(trustedFrontends) == 0 {
+		return nil, nil
+	}
+	proxyProtocol := ProxyProtocol{}
+	for _, cidr := range trustedFrontends {
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid PROXY protocol frontend: [%s]", cidr)
+		}
+		proxyProtocol.trustedFrontends = append(proxyProtocol.trustedFrontends, ipNet)
+	}
+	return &proxyProtocol, nil
+}
+
+func (proxyProtocol *ProxyProtocol) trusts(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range proxyProtocol.trustedFrontends {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns a connection whose remote address is the one sent by the frontend, if the connection
+// was made by a trusted frontend. The header is read when the connection is first used.
+func (proxyProtocol *ProxyProtocol) Wrap(conn net.Conn, timeout time.Duration) net.Conn {
+	if proxyProtocol == nil || !proxyProtocol.trusts(conn.RemoteAddr()) {
+		return conn
+	}
+	return &proxyProtocolConn{Conn: conn, timeout: timeout}
+}
+
+// readProxyProtocolHeader reads a PROXY protocol header, and returns the address of the client.
+// The address is nil if the frontend doesn't proxy a client, for example to check that the service is up.
+func readProxyProtocolHeader(reader io.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:12], proxyProtocolV2Signature) {
+		return nil, errors.New("Missing PROXY protocol header")
+	}
+	command, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	switch command {
+	case proxyProtocolV2CommandLocal:
+		return nil, nil
+	case proxyProtocolV2CommandProxy:
+	default:
+		return nil, fmt.Errorf("Unsupported PROXY protocol command: [%x]", command)
+	}
+	switch family {
+	case proxyProtocolV2FamilyTCP4:
+		if len(payload) < 12 {
+			return nil, errors.New("Short PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case proxyProtocolV2FamilyTCP6:
+		if len(payload) < 36 {
+			return nil, errors.New("Short PROXY protocol header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	once       sync.Once
+	timeout    time.Duration
+	remoteAddr net.Addr
+	err        error
+}
+
+func (conn *proxyProtocolConn) readHeader() {
+	conn.once.Do(func() {
+		conn.remoteAddr = conn.Conn.RemoteAddr()
+		if conn.err = conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout)); conn.err != nil {
+			return
+		}
+		var clientAddr net.Addr
+		if clientAddr, conn.err = readProxyProtocolHeader(conn.Conn); conn.err != nil {
+			dlog.Debugf("Invalid PROXY protocol header from [%v]: %v", conn.remoteAddr, conn.err)
+			return
+		}
+		if clientAddr != nil {
+			conn.remoteAddr = clientAddr
+		}
+		conn.err = conn.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (conn *proxyProtocolConn) Read(b []byte) (int, error) {
+	conn.readHeader()
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn *proxyProtocolConn) RemoteAddr() net.Addr {
+	conn.readHeader()
+	return conn.remoteAddr
+}
+
+// proxyProtocolListener accepts connections that may start with a PROXY protocol header
+type proxyProtocolListener struct {
+	net.Listener
+	proxyProtocol *ProxyProtocol
+	timeout       time.Duration
+}
+
+func (listener *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return listener.proxyProtocol.Wrap(conn, listener.timeout), nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	c := check.T(t)
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, proxyProtocolV2CommandProxy, proxyProtocolV2FamilyTCP4, 0, 12)
+	header = append(header, 192, 0, 2, 1, 10, 0, 0, 1, 0x30, 0x39, 0, 53)
+	reader := bytes.NewReader(append(header, "query"...))
+	clientAddr, err := readProxyProtocolHeader(reader)
+	c.Nil(err)
+	c.Equal(clientAddr.String(), "192.0.2.1:12345")
+	c.Equal(reader.Len(), len("query"))
+
+	header = append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, proxyProtocolV2CommandLocal, 0, 0, 0)
+	clientAddr, err = readProxyProtocolHeader(bytes.NewReader(header))
+	c.Nil(err)
+	c.Nil(clientAddr)
+
+	_, err = readProxyProtocolHeader(bytes.NewReader([]byte("PROXY TCP4 192.0.2.1 10.0.0.1 12345 53\r\n")))
+	c.NotNil(err)
+
+	proxyProtocol, err := NewProxyProtocol([]string{"10.0.0.0/8"})
+	c.Nil(err)
+	c.True(proxyProtocol.trusts(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+	c.False(proxyProtocol.trusts(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}))
+}
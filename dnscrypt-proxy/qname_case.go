@@ -0,0 +1,88 @@
+package main
+
+import (
+	crypto_rand "crypto/rand"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Randomizing the case of query names sent over unauthenticated transports (a.k.a. DNS 0x20) makes
+// spoofed responses harder to forge, as servers copy the question as is in their responses.
+
+var ErrQNameCaseMismatch = errors.New("The case of the query name was not preserved in the response")
+
+func isASCIILetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// randomizeCase randomly switches the case of the letters of a name, in wire or text format
+func randomizeCase(name []byte) {
+	bits := make([]byte, (len(name)+7)/8)
+	if _, err := crypto_rand.Read(bits); err != nil {
+		return
+	}
+	for i, c := range name {
+		if !isASCIILetter(c) {
+			continue
+		}
+		if bits[i/8]&(1<<(i%8)) != 0 {
+			name[i] = c | 0x20
+		} else {
+			name[i] = c &^ 0x20
+		}
+	}
+}
+
+// randomizeQNameCase returns a copy of a query message whose question name has a random case
+func randomizeQNameCase(msg *dns.Msg) *dns.Msg {
+	query := msg.Copy()
+	name := []byte(query.Question[0].Name)
+	randomizeCase(name)
+	query.Question[0].Name = string(name)
+	return query
+}
+
+// restoreQNameCase checks that a response has the question of the query sent to the server,
+// and restores the original case of the name
+func restoreQNameCase(response *dns.Msg, sentName string, originalName string) error {
+	if len(response.Question) != 1 || response.Question[0].Name != sentName {
+		return ErrQNameCaseMismatch
+	}
+	response.Question[0].Name = originalName
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if header := rr.Header(); strings.EqualFold(header.Name, originalName) {
+				header.Name = originalName
+			}
+		}
+	}
+	return nil
+}
+
+// randomizeQNameCasePacket returns a copy of a query packet whose question name has a random case
+func randomizeQNameCasePacket(query []byte) ([]byte, bool) {
+	if len(query) < MinDNSPacketSize || query[4] != 0 || query[5] != 1 {
+		return query, false
+	}
+	nameEnd, ok := skipWireName(query, 12)
+	if !ok {
+		return query, false
+	}
+	randomized := append([]byte{}, query...)
+	randomizeCase(randomized[12:nameEnd])
+	return randomized, true
+}
+
+// restoreQNameCasePacket checks that the question name of a response packet is exactly the one that
+// was sent, and restores the name of the original query; names pointing to the question are restored as well
+func restoreQNameCasePacket(response []byte, sentQuery []byte, originalQuery []byte) error {
+	nameEnd, _ := skipWireName(sentQuery, 12)
+	if len(response) < nameEnd || response[4] != 0 || response[5] != 1 ||
+		string(response[12:nameEnd]) != string(sentQuery[12:nameEnd]) {
+		return ErrQNameCaseMismatch
+	}
+	copy(response[12:nameEnd], originalQuery[12:nameEnd])
+	return nil
+}
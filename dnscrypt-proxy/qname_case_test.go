@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestQNameCaseRandomization(t *testing.T) {
+	c := check.T(t)
+	msg := new(dns.Msg)
+	msg.SetQuestion("www.example-domain.com.", dns.TypeA)
+	query, err := msg.Pack()
+	c.Must(c.Nil(err))
+
+	sentQuery, ok := randomizeQNameCasePacket(query)
+	c.Must(c.True(ok))
+	c.Len(sentQuery, len(query))
+	sentMsg := new(dns.Msg)
+	c.Must(c.Nil(sentMsg.Unpack(sentQuery)))
+	c.True(strings.EqualFold(sentMsg.Question[0].Name, msg.Question[0].Name))
+
+	response := new(dns.Msg)
+	response.SetReply(sentMsg)
+	rr, _ := dns.NewRR(sentMsg.Question[0].Name + " 60 IN A 192.0.2.1")
+	response.Answer = []dns.RR{rr}
+	response.Compress = true
+	packet, err := response.Pack()
+	c.Must(c.Nil(err))
+	c.Nil(restoreQNameCasePacket(packet, sentQuery, query))
+	c.Must(c.Nil(response.Unpack(packet)))
+	c.EQ(response.Question[0].Name, "www.example-domain.com.")
+	c.EQ(response.Answer[0].Header().Name, "www.example-domain.com.")
+
+	// A response whose name differs by case only is rejected
+	response.Question[0].Name = "WWW.EXAMPLE-DOMAIN.COM."
+	packet, err = response.Pack()
+	c.Must(c.Nil(err))
+	if sentMsg.Question[0].Name != response.Question[0].Name {
+		c.Err(restoreQNameCasePacket(packet, sentQuery, query), ErrQNameCaseMismatch)
+	}
+
+	randomized := randomizeQNameCase(msg)
+	c.EQ(msg.Question[0].Name, "www.example-domain.com.")
+	response = new(dns.Msg)
+	response.SetReply(randomized)
+	rr, _ = dns.NewRR(randomized.Question[0].Name + " 60 IN A 192.0.2.1")
+	response.Answer = []dns.RR{rr}
+	c.Nil(restoreQNameCase(response, randomized.Question[0].Name, msg.Question[0].Name))
+	c.EQ(response.Question[0].Name, msg.Question[0].Name)
+	c.EQ(response.Answer[0].Header().Name, msg.Question[0].Name)
+	c.Err(restoreQNameCase(response, randomized.Question[0].Name+"x", msg.Question[0].Name), ErrQNameCaseMismatch)
+}
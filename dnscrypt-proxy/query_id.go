@@ -0,0 +1,28 @@
+package main
+
+import (
+	crypto_rand "crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+)
+
+// Query identifiers are made of a random per-process prefix and a counter,
+// so that they remain unique across restarts without requiring any coordination.
+var (
+	queryIDPrefix  uint32
+	queryIDCounter uint32
+)
+
+func init() {
+	var prefix [4]byte
+	_, _ = crypto_rand.Read(prefix[:])
+	queryIDPrefix = binary.BigEndian.Uint32(prefix[:])
+}
+
+func NewQueryID() string {
+	var id [8]byte
+	binary.BigEndian.PutUint32(id[0:4], queryIDPrefix)
+	binary.BigEndian.PutUint32(id[4:8], atomic.AddUint32(&queryIDCounter, 1))
+	return hex.EncodeToString(id[:])
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	QueryPolicyForward = "forward"
+	QueryPolicyNotImp  = "notimp"
+	QueryPolicyRefused = "refused"
+)
+
+// queryPolicyForward is the rcode of queries that are forwarded as is
+const queryPolicyForward = -1
+
+// QueryPolicy decides how to handle opcodes other than QUERY, and classes other than IN and CHAOS,
+// before any plugins are applied
+type QueryPolicy struct {
+	notify       int
+	update       int
+	otherOpcodes int
+	otherClasses int
+}
+
+func parseQueryPolicyAction(name string, action string) (int, error) {
+	switch strings.ToLower(action) {
+	case QueryPolicyForward:
+		return queryPolicyForward, nil
+	case QueryPolicyNotImp:
+		return dns.RcodeNotImplemented, nil
+	case QueryPolicyRefused:
+		return dns.RcodeRefused, nil
+	default:
+		return 0, fmt.Errorf("Unsupported action for %s queries: [%s] - Use 'notimp', 'refused' or 'forward'", name, action)
+	}
+}
+
+func NewQueryPolicy(config *UnsupportedQueriesConfig) (*QueryPolicy, error) {
+	policy := QueryPolicy{}
+	var err error
+	if policy.notify, err = parseQueryPolicyAction("NOTIFY", config.Notify); err != nil {
+		return nil, err
+	}
+	if policy.update, err = parseQueryPolicyAction("UPDATE", config.Update); err != nil {
+		return nil, err
+	}
+	if policy.otherOpcodes, err = parseQueryPolicyAction("other opcode", config.OtherOpcodes); err != nil {
+		return nil, err
+	}
+	if policy.otherClasses, err = parseQueryPolicyAction("other class", config.OtherClasses); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// rcode returns the response code to immediately return to a query, or queryPolicyForward if the
+// query has to go through the plugins
+func (policy *QueryPolicy) rcode(msg *dns.Msg) int {
+	if policy == nil {
+		return queryPolicyForward
+	}
+	switch msg.Opcode {
+	case dns.OpcodeQuery:
+	case dns.OpcodeNotify:
+		return policy.notify
+	case dns.OpcodeUpdate:
+		return policy.update
+	default:
+		return policy.otherOpcodes
+	}
+	if qClass := msg.Question[0].Qclass; qClass != dns.ClassINET && qClass != dns.ClassCHAOS {
+		return policy.otherClasses
+	}
+	return queryPolicyForward
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestQueryPolicy(t *testing.T) {
+	c := check.T(t)
+	config := newConfig().UnsupportedQueries
+	policy, err := NewQueryPolicy(&config)
+	c.Must(c.Nil(err))
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	c.EQ(policy.rcode(msg), queryPolicyForward)
+	msg.Question[0].Qclass = dns.ClassCHAOS
+	c.EQ(policy.rcode(msg), queryPolicyForward)
+	msg.Question[0].Qclass = dns.ClassHESIOD
+	c.EQ(policy.rcode(msg), queryPolicyForward)
+
+	msg.SetNotify("example.com.")
+	c.EQ(policy.rcode(msg), dns.RcodeNotImplemented)
+	msg.SetUpdate("example.com.")
+	c.EQ(policy.rcode(msg), dns.RcodeRefused)
+	msg.Opcode = dns.OpcodeStatus
+	c.EQ(policy.rcode(msg), dns.RcodeNotImplemented)
+
+	config.OtherClasses = "REFUSED"
+	policy, err = NewQueryPolicy(&config)
+	c.Must(c.Nil(err))
+	msg = new(dns.Msg)
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Question[0].Qclass = dns.ClassANY
+	c.EQ(policy.rcode(msg), dns.RcodeRefused)
+
+	config.Update = "drop"
+	_, err = NewQueryPolicy(&config)
+	c.NotNil(err)
+
+	var noPolicy *QueryPolicy
+	c.EQ(noPolicy.rcode(msg), queryPolicyForward)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math/rand"
+
+	"github.com/miekg/dns"
+)
+
+// LBStrategyRace sends queries to the fastest server, and races it against the second fastest one
+type LBStrategyRace struct{}
+
+func (LBStrategyRace) getCandidate(int) int {
+	return 0
+}
+
+func (LBStrategyRace) getActiveCount(serversCount int) int {
+	return Min(serversCount, 2)
+}
+
+type raceResult struct {
+	serverInfo *ServerInfo
+	response   []byte
+	err        error
+}
+
+func (result *raceResult) valid() bool {
+	return result.err == nil && len(result.response) >= MinDNSPacketSize && Rcode(result.response) != dns.RcodeServerFailure
+}
+
+// raceCandidate returns the fastest live server other than `serverInfo`, or nil
+func (serversInfo *ServersInfo) raceCandidate(serverInfo *ServerInfo) *ServerInfo {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	for _, candidate := range serversInfo.inner {
+		if candidate.Name != serverInfo.Name && !serversInfo.isDown(candidate.Name) && !serversInfo.excluded(candidate.Name) {
+			return candidate
+		}
+	}
+	return nil
+}
+
+// exchangeOnce sends a query to a server, or to two servers at once if queries are raced.
+// It returns the response and the server it was received from.
+func (proxy *Proxy) exchangeOnce(
+	pluginsState *PluginsState,
+	serverInfo *ServerInfo,
+	query []byte,
+	serverProto string,
+) ([]byte, *ServerInfo, error) {
+	if proxy.lbRaceRatio > 0 && pluginsState.routedServers == nil && rand.Intn(100) < proxy.lbRaceRatio {
+		if _, racing := proxy.serversInfo.lbStrategy.(LBStrategyRace); racing {
+			if other := proxy.serversInfo.raceCandidate(serverInfo); other != nil {
+				return proxy.exchangeRacing(pluginsState, []*ServerInfo{serverInfo, other}, query, serverProto)
+			}
+		}
+	}
+	serverInfo.noticeBegin(proxy)
+	response, err := proxy.exchangeWithServer(pluginsState, serverInfo, query, serverProto)
+	return response, serverInfo, err
+}
+
+// exchangeRacing sends a query to several servers simultaneously, and returns the first valid response.
+// Exchanges can't be interrupted; the responses received after the first valid one are only used to update
+// the statistics of their servers.
+func (proxy *Proxy) exchangeRacing(
+	pluginsState *PluginsState,
+	servers []*ServerInfo,
+	query []byte,
+	serverProto string,
+) ([]byte, *ServerInfo, error) {
+	results := make(chan raceResult, len(servers))
+	for _, serverInfo := range servers {
+		serverQuery := append([]byte{}, query...)
+		// The query was only padded if the first server required it
+		if blockSize := proxy.paddingBlockSize(serverInfo); blockSize > 0 {
+			serverQuery = padQuery(serverQuery, blockSize)
+		}
+		serverInfo.noticeBegin(proxy)
+		go func(serverInfo *ServerInfo, query []byte) {
+			response, err := proxy.exchangeWithServer(pluginsState, serverInfo, query, serverProto)
+			results <- raceResult{serverInfo: serverInfo, response: response, err: err}
+		}(serverInfo, serverQuery)
+	}
+	var result raceResult
+	for pending := len(servers); pending > 0; {
+		result = <-results
+		pending--
+		if !result.valid() && pending > 0 {
+			proxy.noticeRaceResult(&result)
+			continue
+		}
+		if result.valid() {
+			pluginsState.serverName = result.serverInfo.Name
+			go func(pending int) {
+				for ; pending > 0; pending-- {
+					late := <-results
+					proxy.noticeRaceResult(&late)
+				}
+			}(pending)
+		}
+		break
+	}
+	return result.response, result.serverInfo, result.err
+}
+
+func (proxy *Proxy) noticeRaceResult(result *raceResult) {
+	if result.valid() {
+		result.serverInfo.noticeSuccess(proxy)
+	} else {
+		result.serverInfo.noticeFailure(proxy)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	clocksmith "github.com/jedisct1/go-clocksmith"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Number of queries sent to every server to measure its latency
+	RebenchmarkSamples = 3
+	// Delay between checks of the network interfaces, to detect network changes
+	NetworkChangeCheckInterval = 10 * time.Second
+)
+
+// rebenchmark measures the latency of every live server, including the ones that are not currently
+// selected by the load-balancing strategy, and sorts the servers again
+func (proxy *Proxy) rebenchmark() {
+	serversInfo := &proxy.serversInfo
+	serversInfo.RLock()
+	servers := append([]*ServerInfo{}, serversInfo.inner...)
+	serversInfo.RUnlock()
+	if len(servers) == 0 {
+		return
+	}
+	serversLog.Noticef("Measuring the latency of %d servers", len(servers))
+	rtts := make([]time.Duration, len(servers))
+	semaphore := make(chan struct{}, proxy.certRefreshConcurrency)
+	done := make(chan struct{}, len(servers))
+	for i, serverInfo := range servers {
+		go func(i int, serverInfo *ServerInfo) {
+			semaphore <- struct{}{}
+			rtts[i] = proxy.measureServerRTT(serverInfo)
+			<-semaphore
+			done <- struct{}{}
+		}(i, serverInfo)
+	}
+	for range servers {
+		<-done
+	}
+	serversInfo.Lock()
+	for i, serverInfo := range servers {
+		rtt := rtts[i]
+		if rtt <= 0 {
+			rtt = proxy.timeout
+		}
+		serverInfo.initialRtt = int(rtt.Milliseconds())
+		serverInfo.rtt.Set(float64(serverInfo.initialRtt))
+	}
+	sort.SliceStable(serversInfo.inner, func(i, j int) bool {
+		return serversInfo.weightedRTT(serversInfo.inner[i], serversInfo.inner[i].rtt.Value()) <
+			serversInfo.weightedRTT(serversInfo.inner[j], serversInfo.inner[j].rtt.Value())
+	})
+	if len(serversInfo.inner) > 0 {
+		serversLog.Noticef("Server with the lowest latency: %s (rtt: %dms)", serversInfo.inner[0].Name, serversInfo.inner[0].initialRtt)
+	}
+	serversInfo.Unlock()
+}
+
+// measureServerRTT returns the lowest latency of a few queries sent to a server, or 0 if none of them succeeded
+func (proxy *Proxy) measureServerRTT(serverInfo *ServerInfo) time.Duration {
+	var best time.Duration
+	for i := 0; i < RebenchmarkSamples; i++ {
+		msg := dns.Msg{}
+		msg.SetQuestion(".", dns.TypeNS)
+		msg.Id = dns.Id()
+		msg.SetEdns0(uint16(MaxDNSPacketSize), false)
+		query, err := msg.Pack()
+		if err != nil {
+			return 0
+		}
+		pluginsState := PluginsState{queryID: "rebenchmark"}
+		start := time.Now()
+		response, err := proxy.exchangeWithServer(&pluginsState, serverInfo, query, "udp")
+		elapsed := time.Since(start)
+		if err != nil || len(response) < MinDNSPacketSize || Rcode(response) == dns.RcodeServerFailure {
+			serversLog.Debugf("[%s] Latency measurement failed: %v", serverInfo.Name, err)
+			continue
+		}
+		if best == 0 || elapsed < best {
+			best = elapsed
+		}
+	}
+	return best
+}
+
+// networkFingerprint returns a string that changes when the addresses of the network interfaces change
+func networkFingerprint() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	fingerprint := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		fingerprint = append(fingerprint, addr.String())
+	}
+	sort.Strings(fingerprint)
+	return strings.Join(fingerprint, ",")
+}
+
+// runRebenchmarks measures the latency of the servers on a schedule, and after network changes
+func (proxy *Proxy) runRebenchmarks() {
+	lastRun := time.Now()
+	fingerprint := networkFingerprint()
+	for {
+		clocksmith.Sleep(NetworkChangeCheckInterval)
+		reason := ""
+		if proxy.rebenchmarkInterval > 0 && time.Since(lastRun) >= proxy.rebenchmarkInterval {
+			reason = "scheduled"
+		}
+		if proxy.rebenchmarkOnNetChange {
+			if newFingerprint := networkFingerprint(); newFingerprint != fingerprint {
+				fingerprint = newFingerprint
+				reason = "network change"
+			}
+		}
+		if len(reason) == 0 {
+			continue
+		}
+		serversLog.Infof("Benchmarking servers again (%s)", reason)
+		proxy.rebenchmark()
+		lastRun = time.Now()
+	}
+}
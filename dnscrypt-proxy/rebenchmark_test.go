@@ -0,0 +1,12 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestNetworkFingerprint(t *testing.T) {
+	c := check.T(t)
+	c.EQ(networkFingerprint(), networkFingerprint())
+}
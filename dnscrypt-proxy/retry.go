@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	clocksmith "github.com/jedisct1/go-clocksmith"
+	"github.com/miekg/dns"
+)
+
+const (
+	RetryOnTimeout      = "timeout"
+	RetryOnNetworkError = "network_error"
+	RetryOnServFail     = "servfail"
+)
+
+// RetryPolicy decides whether a query that failed is sent again, and to which server
+type RetryPolicy struct {
+	attempts       int
+	backoff        time.Duration
+	onTimeout      bool
+	onNetworkError bool
+	onServFail     bool
+	switchServer   bool
+}
+
+func NewRetryPolicy(config RetryConfig) (RetryPolicy, error) {
+	policy := RetryPolicy{
+		attempts:     Max(0, config.Attempts),
+		backoff:      time.Duration(Max(0, config.Backoff)) * time.Millisecond,
+		switchServer: config.SwitchServer,
+	}
+	for _, condition := range config.On {
+		switch condition {
+		case RetryOnTimeout:
+			policy.onTimeout = true
+		case RetryOnNetworkError:
+			policy.onNetworkError = true
+		case RetryOnServFail:
+			policy.onServFail = true
+		default:
+			return policy, fmt.Errorf("Unsupported retry condition: [%s]", condition)
+		}
+	}
+	return policy, nil
+}
+
+// retryReason returns the condition that makes an exchange eligible for a retry, or an empty string
+func (policy *RetryPolicy) retryReason(response []byte, err error) string {
+	if err != nil {
+		var encryptionErr *QueryEncryptionError
+		if errors.As(err, &encryptionErr) {
+			return ""
+		}
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			if policy.onTimeout {
+				return RetryOnTimeout
+			}
+			return ""
+		}
+		if policy.onNetworkError {
+			return RetryOnNetworkError
+		}
+		return ""
+	}
+	if policy.onServFail && len(response) >= MinDNSPacketSize && Rcode(response) == dns.RcodeServerFailure {
+		return RetryOnServFail
+	}
+	return ""
+}
+
+// exchangeWithRetries sends a query, and sends it again according to the retry policy if it failed.
+// It returns the last response or error, as well as the server it was received from.
+func (proxy *Proxy) exchangeWithRetries(
+	pluginsState *PluginsState,
+	serverInfo *ServerInfo,
+	query []byte,
+	serverProto string,
+) ([]byte, *ServerInfo, error) {
+	policy := &proxy.retryPolicy
+	backoff := policy.backoff
+	for attempt := 1; ; attempt++ {
+		response, usedServerInfo, err := proxy.exchangeOnce(pluginsState, serverInfo, query, serverProto)
+		serverInfo = usedServerInfo
+		if attempt > policy.attempts {
+			return response, serverInfo, err
+		}
+		reason := policy.retryReason(response, err)
+		if len(reason) == 0 {
+			return response, serverInfo, err
+		}
+		switch reason {
+		case RetryOnTimeout:
+			serverInfo.noticeTimeout(proxy)
+		case RetryOnServFail:
+			serverInfo.noticeServFail(proxy)
+			serverInfo.noticeFailure(proxy)
+		default:
+			serverInfo.noticeFailure(proxy)
+		}
+		if backoff > 0 {
+			clocksmith.Sleep(backoff)
+			backoff *= 2
+		}
+		if policy.switchServer {
+			otherServerInfo := proxy.otherServer(serverInfo, pluginsState.routedServers)
+			if otherServerInfo != serverInfo {
+				// The query was only padded if the first server required it
+				if blockSize := proxy.paddingBlockSize(otherServerInfo); blockSize > 0 {
+					query = padQuery(query, blockSize)
+				}
+			}
+			serverInfo = otherServerInfo
+			pluginsState.serverName = serverInfo.Name
+		}
+		dlog.Debugf("[%s] Retrying (%s) with [%s] - attempt %d/%d", pluginsState.queryID, reason, serverInfo.Name, attempt, policy.attempts)
+	}
+}
+
+// otherServer returns a live server other than `serverInfo` if there is one, or `serverInfo` itself.
+// If `routedServers` is set, the server is one of these.
+func (proxy *Proxy) otherServer(serverInfo *ServerInfo, routedServers []string) *ServerInfo {
+	for i := 0; i < 4; i++ {
+		var candidate *ServerInfo
+		if routedServers != nil {
+			candidate = proxy.serversInfo.getOneOf(routedServers)
+		} else {
+			candidate = proxy.serversInfo.getOne()
+		}
+		if candidate == nil {
+			break
+		}
+		if candidate.Name != serverInfo.Name {
+			return candidate
+		}
+	}
+	return serverInfo
+}
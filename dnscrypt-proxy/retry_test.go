@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestRetryReason(t *testing.T) {
+	c := check.T(t)
+	_, err := NewRetryPolicy(RetryConfig{On: []string{"nxdomain"}})
+	c.NotNil(err)
+
+	policy, err := NewRetryPolicy(RetryConfig{Attempts: 1, On: []string{RetryOnTimeout, RetryOnServFail}})
+	c.Nil(err)
+	timeout := &net.OpError{Op: "read", Net: "udp", Err: context.DeadlineExceeded}
+	c.Equal(policy.retryReason(nil, timeout), RetryOnTimeout)
+	c.Equal(policy.retryReason(nil, errors.New("connection refused")), "")
+	c.Equal(policy.retryReason(nil, &QueryEncryptionError{err: errors.New("too large")}), "")
+
+	msg := dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	msg.Rcode = dns.RcodeServerFailure
+	response, _ := msg.Pack()
+	c.Equal(policy.retryReason(response, nil), RetryOnServFail)
+	msg.Rcode = dns.RcodeSuccess
+	response, _ = msg.Pack()
+	c.Equal(policy.retryReason(response, nil), "")
+}
+
+func TestPadQuery(t *testing.T) {
+	c := check.T(t)
+	msg := dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	query, _ := msg.Pack()
+	paddedQuery := padQuery(query, 128)
+	c.Zero(len(paddedQuery) % 128)
+	padded, err := hasEDNS0Padding(paddedQuery)
+	c.Nil(err)
+	c.True(padded)
+	c.Equal(len(padQuery(paddedQuery, 128)), len(paddedQuery))
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// setReusePort allows several sockets to be bound to the same address; the kernel then distributes
+// incoming packets and connections among them
+func setReusePort(listenConfig *net.ListenConfig) error {
+	control := listenConfig.Control
+	listenConfig.Control = func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+	return nil
+}
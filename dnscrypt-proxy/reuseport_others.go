@@ -0,0 +1,13 @@
+//go:build !linux && !freebsd
+// +build !linux,!freebsd
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func setReusePort(listenConfig *net.ListenConfig) error {
+	return errors.New("Multiple listening sockets per address are not supported on this platform")
+}
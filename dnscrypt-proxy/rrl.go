@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+type RRLAction int
+
+const (
+	// Send the response
+	RRLActionPass RRLAction = iota
+	// Send a truncated response, so that legitimate clients retry over TCP
+	RRLActionSlip
+	// Don't respond
+	RRLActionDrop
+)
+
+const tokenBucketsPruneInterval = 10 * time.Second
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limited uint32
+}
+
+// tokenBuckets keeps a token bucket for every key. Buckets are refilled at `rate` tokens per second,
+// up to `burst` tokens; missing buckets are full. Callers are responsible for locking.
+type tokenBuckets struct {
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newTokenBuckets(rate float64, burst float64) *tokenBuckets {
+	return &tokenBuckets{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket), lastPrune: time.Now()}
+}
+
+// take removes a token from a bucket. If the bucket is empty, it returns the number of
+// consecutive attempts that failed, including this one. Otherwise, it returns 0.
+func (tb *tokenBuckets) take(key string, now time.Time) uint32 {
+	if now.Sub(tb.lastPrune) > tokenBucketsPruneInterval {
+		tb.prune(now)
+	}
+	bucket, ok := tb.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: tb.burst, updated: now}
+		tb.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * tb.rate
+	if bucket.tokens > tb.burst {
+		bucket.tokens = tb.burst
+	}
+	bucket.updated = now
+	if bucket.tokens >= 1.0 {
+		bucket.tokens -= 1.0
+		bucket.limited = 0
+		return 0
+	}
+	bucket.limited++
+	return bucket.limited
+}
+
+// prune removes the buckets that have been refilled, as they are equivalent to missing buckets
+func (tb *tokenBuckets) prune(now time.Time) {
+	for key, bucket := range tb.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*tb.rate >= tb.burst {
+			delete(tb.buckets, key)
+		}
+	}
+	tb.lastPrune = now
+}
+
+// ResponseRateLimiter limits the rate of UDP responses sent to every client network, so that
+// the proxy cannot be used to reflect and amplify traffic towards spoofed addresses.
+// Clients and listeners using loopback addresses are never limited.
+type ResponseRateLimiter struct {
+	sync.Mutex
+	buckets       *tokenBuckets
+	slip          uint32
+	ipv4PrefixLen int
+	ipv6PrefixLen int
+}
+
+// NewResponseRateLimiter returns nil if responses are not rate limited.
+// `window` is the number of seconds of responses a client can receive in a burst.
+func NewResponseRateLimiter(responsesPerSecond int, window int, slip int, ipv4PrefixLen int, ipv6PrefixLen int) *ResponseRateLimiter {
+	if responsesPerSecond <= 0 {
+		return nil
+	}
+	window = Max(1, window)
+	return &ResponseRateLimiter{
+		buckets:       newTokenBuckets(float64(responsesPerSecond), float64(responsesPerSecond*window)),
+		slip:          uint32(Max(0, slip)),
+		ipv4PrefixLen: Min(32, Max(0, ipv4PrefixLen)),
+		ipv6PrefixLen: Min(128, Max(0, ipv6PrefixLen)),
+	}
+}
+
+func (limiter *ResponseRateLimiter) clientKey(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return string(ipv4.Mask(net.CIDRMask(limiter.ipv4PrefixLen, 32)))
+	}
+	return string(ip.Mask(net.CIDRMask(limiter.ipv6PrefixLen, 128)))
+}
+
+// Limit returns what to do with a response to a client
+func (limiter *ResponseRateLimiter) Limit(clientAddr net.Addr, localAddr net.Addr) RRLAction {
+	if limiter == nil {
+		return RRLActionPass
+	}
+	udpClientAddr, ok := clientAddr.(*net.UDPAddr)
+	if !ok || udpClientAddr.IP.IsLoopback() {
+		return RRLActionPass
+	}
+	if udpLocalAddr, ok := localAddr.(*net.UDPAddr); ok && udpLocalAddr.IP.IsLoopback() {
+		return RRLActionPass
+	}
+	key := limiter.clientKey(udpClientAddr.IP)
+	limiter.Lock()
+	limited := limiter.buckets.take(key, time.Now())
+	limiter.Unlock()
+	if limited == 0 {
+		return RRLActionPass
+	}
+	if limiter.slip > 0 && limited%limiter.slip == 0 {
+		return RRLActionSlip
+	}
+	return RRLActionDrop
+}
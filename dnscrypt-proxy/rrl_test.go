@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestResponseRateLimiter(t *testing.T) {
+	c := check.T(t)
+	c.Nil(NewResponseRateLimiter(0, 15, 2, 24, 56))
+
+	limiter := NewResponseRateLimiter(1, 3, 2, 24, 56)
+	localAddr := &net.UDPAddr{IP: net.ParseIP("0.0.0.0"), Port: 53}
+	client := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	neighbor := &net.UDPAddr{IP: net.ParseIP("192.0.2.200"), Port: 1234}
+	for i := 0; i < 3; i++ {
+		c.Equal(limiter.Limit(client, localAddr), RRLActionPass)
+	}
+	c.Equal(limiter.Limit(neighbor, localAddr), RRLActionDrop)
+	c.Equal(limiter.Limit(client, localAddr), RRLActionSlip)
+	c.Equal(limiter.Limit(client, localAddr), RRLActionDrop)
+
+	other := &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 1234}
+	c.Equal(limiter.Limit(other, localAddr), RRLActionPass)
+	loopback := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1234}
+	for i := 0; i < 10; i++ {
+		c.Equal(limiter.Limit(loopback, localAddr), RRLActionPass)
+		c.Equal(limiter.Limit(client, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}), RRLActionPass)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Country codes accepted as an alias for all the member states of the European Union
+var euCountries = []string{
+	"AT", "BE", "BG", "CY", "CZ", "DE", "DK", "EE", "ES", "FI", "FR", "GR", "HR", "HU",
+	"IE", "IT", "LT", "LU", "LV", "MT", "NL", "PL", "PT", "RO", "SE", "SI", "SK",
+}
+
+// ServerMetadata describes where a server is hosted, and by whom; fields are empty when unknown
+type ServerMetadata struct {
+	country  string
+	asn      uint32
+	operator string
+}
+
+// sourceMetadata reads `Country:`, `ASN:` and `Operator:` lines from the description of a server
+func sourceMetadata(description string) ServerMetadata {
+	metadata := ServerMetadata{}
+	for _, line := range strings.Split(description, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "country":
+			metadata.country = strings.ToUpper(value)
+		case "asn":
+			if asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(value), "AS"), 10, 32); err == nil {
+				metadata.asn = uint32(asn)
+			}
+		case "operator":
+			metadata.operator = value
+		}
+	}
+	return metadata
+}
+
+type geoIPRange struct {
+	start, end net.IP
+	metadata   ServerMetadata
+}
+
+// GeoIPDatabase maps IP ranges to countries and networks, using the format of the `ip2asn-combined.tsv`
+// file from iptoasn.com: `<range start> <range end> <AS number> <country code> <AS description>`
+type GeoIPDatabase struct {
+	ranges []geoIPRange
+}
+
+func LoadGeoIPDatabase(fileName string) (*GeoIPDatabase, error) {
+	content, err := ReadTextFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	database := GeoIPDatabase{}
+	for lineNo, line := range strings.Split(content, "\n") {
+		if len(strings.TrimSpace(line)) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "\t", 5)
+		if len(parts) < 4 {
+			return nil, fmt.Errorf("Syntax error in [%s] at line %d", fileName, 1+lineNo)
+		}
+		start, end := net.ParseIP(parts[0]).To16(), net.ParseIP(parts[1]).To16()
+		asn, err := strconv.ParseUint(parts[2], 10, 32)
+		if start == nil || end == nil || err != nil {
+			return nil, fmt.Errorf("Syntax error in [%s] at line %d", fileName, 1+lineNo)
+		}
+		if asn == 0 {
+			// Not routed
+			continue
+		}
+		metadata := ServerMetadata{country: strings.ToUpper(parts[3]), asn: uint32(asn)}
+		if len(parts) > 4 {
+			metadata.operator = strings.TrimSpace(parts[4])
+		}
+		database.ranges = append(database.ranges, geoIPRange{start: start, end: end, metadata: metadata})
+	}
+	sort.Slice(database.ranges, func(i, j int) bool {
+		return bytes.Compare(database.ranges[i].start, database.ranges[j].start) < 0
+	})
+	return &database, nil
+}
+
+func (database *GeoIPDatabase) lookup(ip net.IP) (ServerMetadata, bool) {
+	ip = ip.To16()
+	if database == nil || ip == nil {
+		return ServerMetadata{}, false
+	}
+	i := sort.Search(len(database.ranges), func(i int) bool {
+		return bytes.Compare(database.ranges[i].start, ip) > 0
+	})
+	if i == 0 || bytes.Compare(database.ranges[i-1].end, ip) < 0 {
+		return ServerMetadata{}, false
+	}
+	return database.ranges[i-1].metadata, true
+}
+
+// ServerFilters only keeps servers hosted in some countries and networks, or by some operators
+type ServerFilters struct {
+	countries         map[string]bool
+	disabledCountries map[string]bool
+	asns              map[uint32]bool
+	disabledASNs      map[uint32]bool
+	operators         []string
+	disabledOperators []string
+	geoIP             *GeoIPDatabase
+}
+
+// NewServerFilters returns the filters for the configuration, or nil if servers are not filtered
+func NewServerFilters(config *ServerFiltersConfig) (*ServerFilters, error) {
+	if len(config.Countries)+len(config.DisabledCountries)+len(config.ASNs)+len(config.DisabledASNs)+
+		len(config.Operators)+len(config.DisabledOperators) == 0 {
+		return nil, nil
+	}
+	countries := func(codes []string) map[string]bool {
+		set := make(map[string]bool)
+		for _, code := range codes {
+			code = strings.ToUpper(strings.TrimSpace(code))
+			if code == "EU" {
+				for _, euCode := range euCountries {
+					set[euCode] = true
+				}
+			} else {
+				set[code] = true
+			}
+		}
+		return set
+	}
+	asns := func(numbers []uint32) map[uint32]bool {
+		set := make(map[uint32]bool)
+		for _, number := range numbers {
+			set[number] = true
+		}
+		return set
+	}
+	operators := func(names []string) []string {
+		var lowercased []string
+		for _, name := range names {
+			lowercased = append(lowercased, strings.ToLower(name))
+		}
+		return lowercased
+	}
+	filters := ServerFilters{
+		countries:         countries(config.Countries),
+		disabledCountries: countries(config.DisabledCountries),
+		asns:              asns(config.ASNs),
+		disabledASNs:      asns(config.DisabledASNs),
+		operators:         operators(config.Operators),
+		disabledOperators: operators(config.DisabledOperators),
+	}
+	if len(config.GeoIPFile) > 0 {
+		geoIP, err := LoadGeoIPDatabase(config.GeoIPFile)
+		if err != nil {
+			return nil, err
+		}
+		filters.geoIP = geoIP
+	} else if len(filters.countries)+len(filters.asns)+len(filters.operators) > 0 {
+		sourcesLog.Notice("No GeoIP database - servers without country, ASN and operator information in their description will be ignored")
+	}
+	if len(filters.countries) > 0 && len(filters.disabledCountries) > 0 {
+		return nil, errors.New("Countries can't be both allowed and disabled")
+	}
+	return &filters, nil
+}
+
+// metadata returns the information available about a server: from its description first, then from the
+// GeoIP database, if its address is in the stamp
+func (filters *ServerFilters) metadata(registeredServer *RegisteredServer) ServerMetadata {
+	metadata := sourceMetadata(registeredServer.description)
+	addrStr := registeredServer.stamp.ServerAddrStr
+	if host, _, err := net.SplitHostPort(addrStr); err == nil {
+		addrStr = host
+	}
+	ip := net.ParseIP(strings.Trim(addrStr, "[]"))
+	if ip == nil {
+		return metadata
+	}
+	if geoMetadata, found := filters.geoIP.lookup(ip); found {
+		if len(metadata.country) == 0 {
+			metadata.country = geoMetadata.country
+		}
+		if metadata.asn == 0 {
+			metadata.asn = geoMetadata.asn
+		}
+		if len(metadata.operator) == 0 {
+			metadata.operator = geoMetadata.operator
+		}
+	}
+	return metadata
+}
+
+func matchesOperator(operator string, names []string) bool {
+	operator = strings.ToLower(operator)
+	for _, name := range names {
+		if len(operator) > 0 && strings.Contains(operator, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns true if a server can be used. Servers with unknown metadata are only excluded by allow lists.
+func (filters *ServerFilters) allows(registeredServer *RegisteredServer) bool {
+	if filters == nil {
+		return true
+	}
+	metadata := filters.metadata(registeredServer)
+	if filters.disabledCountries[metadata.country] || filters.disabledASNs[metadata.asn] ||
+		matchesOperator(metadata.operator, filters.disabledOperators) {
+		return false
+	}
+	if len(filters.countries) > 0 && !filters.countries[metadata.country] {
+		return false
+	}
+	if len(filters.asns) > 0 && !filters.asns[metadata.asn] {
+		return false
+	}
+	if len(filters.operators) > 0 && !matchesOperator(metadata.operator, filters.operators) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jedisct1/go-dnsstamps"
+	"github.com/powerman/check"
+)
+
+func TestSourceMetadata(t *testing.T) {
+	c := check.T(t)
+	metadata := sourceMetadata("A resolver\nCountry: de\nASN: AS13335\nOperator: Example Inc.")
+	c.EQ(metadata.country, "DE")
+	c.EQ(metadata.asn, uint32(13335))
+	c.EQ(metadata.operator, "Example Inc.")
+	c.EQ(sourceMetadata("No metadata: here"), ServerMetadata{})
+}
+
+func TestServerFilters(t *testing.T) {
+	c := check.T(t)
+	geoIPFile := filepath.Join(t.TempDir(), "ip2asn.tsv")
+	c.Must(c.Nil(os.WriteFile(geoIPFile, []byte(
+		"1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n"+
+			"9.9.9.0\t9.9.9.255\t19281\tCH\tQUAD9-AS-1\n"+
+			"10.0.0.0\t10.255.255.255\t0\tNone\tNot routed\n"), 0o600)))
+	server := func(addr string, description string) *RegisteredServer {
+		return &RegisteredServer{stamp: dnsstamps.ServerStamp{ServerAddrStr: addr}, description: description}
+	}
+
+	filters, err := NewServerFilters(&ServerFiltersConfig{})
+	c.Nil(err)
+	c.Nil(filters)
+	c.True(filters.allows(server("1.0.0.1:443", "")))
+
+	filters, err = NewServerFilters(&ServerFiltersConfig{Countries: []string{"EU", "CH"}, GeoIPFile: geoIPFile})
+	c.Nil(err)
+	c.False(filters.allows(server("1.0.0.1:443", "")))
+	c.True(filters.allows(server("9.9.9.9", "")))
+	c.True(filters.allows(server("1.0.0.1:443", "Country: FR")))
+	c.False(filters.allows(server("10.0.0.1", "")))
+
+	filters, err = NewServerFilters(&ServerFiltersConfig{DisabledASNs: []uint32{13335}, DisabledOperators: []string{"quad9"}, GeoIPFile: geoIPFile})
+	c.Nil(err)
+	c.False(filters.allows(server("1.0.0.1:443", "")))
+	c.False(filters.allows(server("9.9.9.9", "")))
+	c.True(filters.allows(server("[2001:db8::1]:443", "")))
+
+	_, err = NewServerFilters(&ServerFiltersConfig{Countries: []string{"FR"}, DisabledCountries: []string{"DE"}})
+	c.NotNil(err)
+}
+
+func TestGeoIPDatabaseLookup(t *testing.T) {
+	c := check.T(t)
+	var database *GeoIPDatabase
+	_, found := database.lookup(net.ParseIP("1.0.0.1"))
+	c.False(found)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds, in milliseconds, of the latency histogram buckets.
+// The last bucket has no upper bound.
+var latencyHistogramBounds = []float64{
+	1, 2, 5, 10, 15, 20, 30, 40, 50, 75, 100, 150, 200, 300, 500, 750, 1000, 1500, 2000, 3000, 5000,
+}
+
+type LatencyHistogram struct {
+	counts []uint64
+	count  uint64
+}
+
+func NewLatencyHistogram() LatencyHistogram {
+	return LatencyHistogram{counts: make([]uint64, len(latencyHistogramBounds)+1)}
+}
+
+func (histogram *LatencyHistogram) Add(latencyMs float64) {
+	i := 0
+	for i < len(latencyHistogramBounds) && latencyMs > latencyHistogramBounds[i] {
+		i++
+	}
+	histogram.counts[i]++
+	histogram.count++
+}
+
+// Percentile returns an estimate of the given percentile (0-100), interpolating within buckets
+func (histogram *LatencyHistogram) Percentile(p float64) float64 {
+	if histogram.count == 0 {
+		return 0.0
+	}
+	rank := p / 100.0 * float64(histogram.count)
+	cumulative := 0.0
+	for i, count := range histogram.counts {
+		if count == 0 {
+			continue
+		}
+		if cumulative+float64(count) >= rank {
+			if i >= len(latencyHistogramBounds) {
+				return latencyHistogramBounds[len(latencyHistogramBounds)-1]
+			}
+			lower := 0.0
+			if i > 0 {
+				lower = latencyHistogramBounds[i-1]
+			}
+			upper := latencyHistogramBounds[i]
+			return lower + (upper-lower)*math.Max(0.0, rank-cumulative)/float64(count)
+		}
+		cumulative += float64(count)
+	}
+	return latencyHistogramBounds[len(latencyHistogramBounds)-1]
+}
+
+// ServerStats keeps track of the responses of an upstream server.
+// It is shared by successive ServerInfo instances for the same server, and protected by the ServersInfo lock.
+type ServerStats struct {
+	latency   LatencyHistogram
+	queries   uint64
+	successes uint64
+	failures  uint64
+	timeouts  uint64
+	servFails uint64
+	withinSLO uint64
+	// Adaptive timeout, in nanoseconds (0 = global timeout); read without holding the lock
+	timeout             atomic.Int64
+	consecutiveTimeouts int
+	// Moving averages of the latency, in milliseconds, and of the success rate, used by the 'p2c' strategy
+	ewmaLatency float64
+	ewmaSuccess float64
+}
+
+func NewServerStats() *ServerStats {
+	return &ServerStats{latency: NewLatencyHistogram(), ewmaSuccess: 1.0}
+}
+
+type ServerStatsReport struct {
+	Name          string  `json:"name"`
+	Proto         string  `json:"proto"`
+	RTTEstimateMs float64 `json:"rtt_estimate_ms"`
+	Queries       uint64  `json:"queries"`
+	Successes     uint64  `json:"successes"`
+	Failures      uint64  `json:"failures"`
+	Timeouts      uint64  `json:"timeouts"`
+	ServFails     uint64  `json:"servfails"`
+	TimeoutRate   float64 `json:"timeout_rate"`
+	ServFailRate  float64 `json:"servfail_rate"`
+	SLOCompliance float64 `json:"slo_compliance"`
+	P50Ms         float64 `json:"p50_ms"`
+	P95Ms         float64 `json:"p95_ms"`
+	P99Ms         float64 `json:"p99_ms"`
+	TimeoutMs     int64   `json:"timeout_ms"`
+}
+
+type ServersStatsReport struct {
+	SLOLatencyMs int64               `json:"slo_latency_ms"`
+	Servers      []ServerStatsReport `json:"servers"`
+}
+
+func (serversInfo *ServersInfo) statsReport() ServersStatsReport {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	report := ServersStatsReport{
+		SLOLatencyMs: int64(serversInfo.sloLatency / time.Millisecond),
+		Servers:      make([]ServerStatsReport, 0, len(serversInfo.inner)),
+	}
+	for _, serverInfo := range serversInfo.inner {
+		stats := serverInfo.stats
+		if stats == nil {
+			continue
+		}
+		serverReport := ServerStatsReport{
+			Name:          serverInfo.Name,
+			Proto:         serverInfo.Proto.String(),
+			RTTEstimateMs: serverInfo.rtt.Value(),
+			Queries:       stats.queries,
+			Successes:     stats.successes,
+			Failures:      stats.failures,
+			Timeouts:      stats.timeouts,
+			ServFails:     stats.servFails,
+			P50Ms:         stats.latency.Percentile(50),
+			P95Ms:         stats.latency.Percentile(95),
+			P99Ms:         stats.latency.Percentile(99),
+			TimeoutMs:     int64(serverInfo.currentTimeout() / time.Millisecond),
+		}
+		if stats.queries > 0 {
+			serverReport.TimeoutRate = float64(stats.timeouts) / float64(stats.queries)
+			serverReport.ServFailRate = float64(stats.servFails) / float64(stats.queries)
+			serverReport.SLOCompliance = float64(stats.withinSLO) / float64(stats.queries)
+		}
+		report.Servers = append(report.Servers, serverReport)
+	}
+	return report
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestLatencyHistogramPercentile(t *testing.T) {
+	c := check.T(t)
+	histogram := NewLatencyHistogram()
+	c.Equal(histogram.Percentile(50), 0.0)
+	for i := 0; i < 90; i++ {
+		histogram.Add(8)
+	}
+	for i := 0; i < 10; i++ {
+		histogram.Add(400)
+	}
+	c.Between(histogram.Percentile(50), 5.0, 10.0)
+	c.Between(histogram.Percentile(99), 300.0, 500.0)
+	histogram.Add(60000)
+	c.Equal(histogram.Percentile(100), 5000.0)
+}
+
+func TestAdaptiveTimeouts(t *testing.T) {
+	c := check.T(t)
+	adaptive := NewAdaptiveTimeouts(250*time.Millisecond, 100*time.Millisecond, 5*time.Second)
+	serverInfo := ServerInfo{Timeout: 5 * time.Second, stats: NewServerStats()}
+	for i := 0; i < AdaptiveTimeoutMinSamples-1; i++ {
+		serverInfo.stats.latency.Add(40)
+		adaptive.update(serverInfo.stats)
+	}
+	c.Equal(serverInfo.currentTimeout(), 5*time.Second)
+	serverInfo.stats.latency.Add(40)
+	adaptive.update(serverInfo.stats)
+	c.Equal(serverInfo.currentTimeout(), 250*time.Millisecond)
+
+	adaptive.backoff(serverInfo.stats)
+	c.Equal(serverInfo.currentTimeout(), 500*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		adaptive.backoff(serverInfo.stats)
+	}
+	c.Equal(serverInfo.currentTimeout(), 5*time.Second)
+}
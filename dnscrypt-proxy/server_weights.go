@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// NewServerWeights checks the weights assigned to servers; servers without a weight have a weight of 1
+func NewServerWeights(weights map[string]float64) (map[string]float64, error) {
+	if len(weights) == 0 {
+		return nil, nil
+	}
+	for name, weight := range weights {
+		if weight <= 0 {
+			return nil, fmt.Errorf("Invalid weight for [%s]: [%v] (must be positive)", name, weight)
+		}
+	}
+	return weights, nil
+}
+
+func (serversInfo *ServersInfo) weight(serverInfo *ServerInfo) float64 {
+	if weight, ok := serversInfo.weights[serverInfo.Name]; ok {
+		return weight
+	}
+	return 1.0
+}
+
+// weightedRTT returns the latency used to rank a server: a server with a weight of 4 ranks like a server
+// 4 times faster
+func (serversInfo *ServersInfo) weightedRTT(serverInfo *ServerInfo, rtt float64) float64 {
+	if len(serversInfo.weights) == 0 {
+		return rtt
+	}
+	return rtt / serversInfo.weight(serverInfo)
+}
+
+// weightedCandidate picks one of the `activeCount` first servers, with a probability proportional to its weight
+func (serversInfo *ServersInfo) weightedCandidate(servers []*ServerInfo, activeCount int) int {
+	total := 0.0
+	for _, serverInfo := range servers[:activeCount] {
+		total += serversInfo.weight(serverInfo)
+	}
+	r := rand.Float64() * total
+	for i, serverInfo := range servers[:activeCount] {
+		r -= serversInfo.weight(serverInfo)
+		if r < 0 {
+			return i
+		}
+	}
+	return activeCount - 1
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/VividCortex/ewma"
+	"github.com/powerman/check"
+)
+
+func TestServerWeights(t *testing.T) {
+	c := check.T(t)
+	weights, err := NewServerWeights(nil)
+	c.Nil(err)
+	c.Nil(weights)
+	_, err = NewServerWeights(map[string]float64{"my-resolver": 0})
+	c.NotNil(err)
+
+	serversInfo := NewServersInfo()
+	serversInfo.lbStrategy = LBStrategyRandom{}
+	serversInfo.weights, err = NewServerWeights(map[string]float64{"my-resolver": 4})
+	c.Nil(err)
+	mine := &ServerInfo{Name: "my-resolver", rtt: ewma.NewMovingAverage(RTTEwmaDecay)}
+	public := &ServerInfo{Name: "public", rtt: ewma.NewMovingAverage(RTTEwmaDecay)}
+	c.EQ(serversInfo.weight(mine), 4.0)
+	c.EQ(serversInfo.weight(public), 1.0)
+	c.EQ(serversInfo.weightedRTT(mine, 40), 10.0)
+	c.EQ(serversInfo.weightedRTT(public, 40), 40.0)
+
+	counts := make([]int, 2)
+	for i := 0; i < 10000; i++ {
+		counts[serversInfo.pickCandidate([]*ServerInfo{mine, public})]++
+	}
+	c.Between(counts[0], 7500, 8500)
+
+	serversInfo.lbStrategy = LBStrategyFirst{}
+	c.EQ(serversInfo.pickCandidate([]*ServerInfo{public, mine}), 0)
+}
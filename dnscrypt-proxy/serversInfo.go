@@ -10,6 +10,7 @@
 	"math/rand"
 	"net"
 	"net/url"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -63,6 +64,10 @@ type ServerInfo struct {
 	Proto              stamps.StampProtoType
 	useGet             bool
 	odohTargetConfigs  []ODoHTargetConfig
+	dot                *DoTClient
+	tcpPipeline        *TCPPipeline
+	doq                *DoQClient
+	stats              *ServerStats
 }
 
 type LBStrategy interface {
@@ -122,9 +127,12 @@ func (LBStrategyRandom) getActiveCount(serversCount int) int {
 
 var DefaultLBStrategy = LBStrategyP2{}
 
+const DefaultSLOLatency = 200 * time.Millisecond
+
 type DNSCryptRelay struct {
 	RelayUDPAddr *net.UDPAddr
 	RelayTCPAddr *net.TCPAddr
+	NextHops     []*net.UDPAddr // Relays after the first one, for multi-hop chains
 }
 
 type ODoHRelay struct {
@@ -144,14 +152,29 @@ type ServersInfo struct {
 	registeredRelays  []RegisteredServer
 	lbStrategy        LBStrategy
 	lbEstimator       bool
+	sloLatency        time.Duration
+	health            map[string]*ServerHealth
+	downCount         int
+	capabilities      map[string]*ServerCapabilities
+	reserved          map[string]bool // Servers only used for the names routed to them
+	profileServers    map[string]bool // Servers of the active network profile, if there is one
+	profileOnly       map[string]bool // Servers only used by network profiles
+	weights           map[string]float64
+	circuitBreaker    *CircuitBreaker
+	circuits          map[string]*serverCircuit
+	openCircuits      int
 }
 
 func NewServersInfo() ServersInfo {
 	return ServersInfo{
 		lbStrategy:        DefaultLBStrategy,
 		lbEstimator:       true,
+		sloLatency:        DefaultSLOLatency,
 		registeredServers: make([]RegisteredServer, 0),
 		registeredRelays:  make([]RegisteredServer, 0),
+		health:            make(map[string]*ServerHealth),
+		capabilities:      make(map[string]*ServerCapabilities),
+		circuits:          make(map[string]*serverCircuit),
 	}
 }
 
@@ -200,20 +223,26 @@ func (serversInfo *ServersInfo) refreshServer(proxy *Proxy, name string, stamp s
 	}
 	newServer.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
 	newServer.rtt.Set(float64(newServer.initialRtt))
+	newServer.stats = NewServerStats()
 	isNew = true
 	serversInfo.Lock()
 	for i, oldServer := range serversInfo.inner {
 		if oldServer.Name == name {
+			newServer.stats = oldServer.stats
 			serversInfo.inner[i] = &newServer
 			isNew = false
+			if oldClient := oldServer.doq; oldClient != nil && oldClient != newServer.doq {
+				// Let queries that are still using the previous client complete
+				time.AfterFunc(proxy.timeout, oldClient.Close)
+			}
 			break
 		}
 	}
-	serversInfo.Unlock()
 	if isNew {
-		serversInfo.Lock()
 		serversInfo.inner = append(serversInfo.inner, &newServer)
-		serversInfo.Unlock()
+	}
+	serversInfo.Unlock()
+	if isNew {
 		proxy.serversInfo.registerServer(name, stamp)
 	}
 
@@ -221,7 +250,7 @@ func (serversInfo *ServersInfo) refreshServer(proxy *Proxy, name string, stamp s
 }
 
 func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
-	dlog.Debug("Refreshing certificates")
+	serversLog.Debug("Refreshing certificates")
 	serversInfo.RLock()
 	// Appending registeredServers slice from sources may allocate new memory.
 	serversCount := len(serversInfo.registeredServers)
@@ -230,42 +259,66 @@ func (serversInfo *ServersInfo) refresh(proxy *Proxy) (int, error) {
 	serversInfo.RUnlock()
 	countChannel := make(chan struct{}, proxy.certRefreshConcurrency)
 	errorChannel := make(chan error, serversCount)
-	for i := range registeredServers {
-		countChannel <- struct{}{}
-		go func(registeredServer *RegisteredServer) {
-			err := serversInfo.refreshServer(proxy, registeredServer.name, registeredServer.stamp)
-			if err == nil {
-				proxy.xTransport.internalResolverReady = true
-			}
-			errorChannel <- err
-			<-countChannel
-		}(&registeredServers[i])
+	go func() {
+		for i := range registeredServers {
+			countChannel <- struct{}{}
+			go func(registeredServer *RegisteredServer) {
+				err := serversInfo.refreshServer(proxy, registeredServer.name, registeredServer.stamp)
+				if err == nil {
+					proxy.xTransport.internalResolverReady = true
+				} else {
+					proxy.alerter.Fire(AlertServerUnreachable, registeredServer.name, "[%s] is unreachable: [%v]", registeredServer.name, err)
+				}
+				errorChannel <- err
+				<-countChannel
+			}(&registeredServers[i])
+		}
+	}()
+	// Servers that didn't respond before the deadline keep being refreshed in the background,
+	// and are added to the set of live servers as soon as they respond
+	var deadline <-chan time.Time
+	if proxy.certRefreshTimeout > 0 {
+		timer := time.NewTimer(proxy.certRefreshTimeout)
+		defer timer.Stop()
+		deadline = timer.C
 	}
 	liveServers := 0
 	var err error
+wait:
 	for i := 0; i < serversCount; i++ {
-		err = <-errorChannel
-		if err == nil {
-			liveServers++
+		select {
+		case err = <-errorChannel:
+			if err == nil {
+				liveServers++
+			}
+		case <-deadline:
+			serversLog.Noticef("%d servers are still being refreshed in the background", serversCount-i)
+			if liveServers == 0 {
+				err = errors.New("No servers responded before the certificate refresh timeout")
+			}
+			break wait
 		}
 	}
 	if liveServers > 0 {
 		err = nil
+	} else if serversCount > 0 {
+		proxy.alerter.Fire(AlertNoLiveServers, "", "None of the %d configured servers is reachable", serversCount)
 	}
 	serversInfo.Lock()
 	sort.SliceStable(serversInfo.inner, func(i, j int) bool {
-		return serversInfo.inner[i].initialRtt < serversInfo.inner[j].initialRtt
+		return serversInfo.weightedRTT(serversInfo.inner[i], float64(serversInfo.inner[i].initialRtt)) <
+			serversInfo.weightedRTT(serversInfo.inner[j], float64(serversInfo.inner[j].initialRtt))
 	})
 	inner := serversInfo.inner
 	innerLen := len(inner)
 	if innerLen > 1 {
-		dlog.Notice("Sorted latencies:")
+		serversLog.Notice("Sorted latencies:")
 		for i := 0; i < innerLen; i++ {
-			dlog.Noticef("- %5dms %s", inner[i].initialRtt, inner[i].Name)
+			serversLog.Noticef("- %5dms %s", inner[i].initialRtt, inner[i].Name)
 		}
 	}
 	if innerLen > 0 {
-		dlog.Noticef("Server with the lowest initial latency: %s (rtt: %dms)", inner[0].Name, inner[0].initialRtt)
+		serversLog.Noticef("Server with the lowest initial latency: %s (rtt: %dms)", inner[0].Name, inner[0].initialRtt)
 	}
 	serversInfo.Unlock()
 	return liveServers, err
@@ -286,9 +339,10 @@ func (serversInfo *ServersInfo) estimatorUpdate(currentActive int) {
 		return
 	}
 	partialSort := false
-	if candidateRtt < currentActiveRtt {
+	if serversInfo.weightedRTT(serversInfo.inner[candidate], candidateRtt) <
+		serversInfo.weightedRTT(serversInfo.inner[currentActive], currentActiveRtt) {
 		serversInfo.inner[candidate], serversInfo.inner[currentActive] = serversInfo.inner[currentActive], serversInfo.inner[candidate]
-		dlog.Debugf(
+		serversLog.Debugf(
 			"New preferred candidate: %s (RTT: %d vs previous: %d)",
 			serversInfo.inner[currentActive].Name,
 			int(candidateRtt),
@@ -298,7 +352,7 @@ func (serversInfo *ServersInfo) estimatorUpdate(currentActive int) {
 	} else if candidateRtt > 0 && candidateRtt >= (serversInfo.inner[0].rtt.Value()+serversInfo.inner[activeCount-1].rtt.Value())/2.0*4.0 {
 		if time.Since(serversInfo.inner[candidate].lastActionTS) > time.Duration(1*time.Minute) {
 			serversInfo.inner[candidate].rtt.Add(candidateRtt / 2.0)
-			dlog.Debugf(
+			serversLog.Debugf(
 				"Giving a new chance to candidate [%s], lowering its RTT from %d to %d (best: %d)",
 				serversInfo.inner[candidate].Name,
 				int(candidateRtt),
@@ -310,7 +364,8 @@ func (serversInfo *ServersInfo) estimatorUpdate(currentActive int) {
 	}
 	if partialSort {
 		for i := 1; i < serversCount; i++ {
-			if serversInfo.inner[i-1].rtt.Value() > serversInfo.inner[i].rtt.Value() {
+			if serversInfo.weightedRTT(serversInfo.inner[i-1], serversInfo.inner[i-1].rtt.Value()) >
+				serversInfo.weightedRTT(serversInfo.inner[i], serversInfo.inner[i].rtt.Value()) {
 				serversInfo.inner[i-1], serversInfo.inner[i] = serversInfo.inner[i], serversInfo.inner[i-1]
 			}
 		}
@@ -324,22 +379,102 @@ func (serversInfo *ServersInfo) getOne() *ServerInfo {
 		serversInfo.Unlock()
 		return nil
 	}
-	candidate := serversInfo.lbStrategy.getCandidate(serversCount)
+	candidate := serversInfo.pickCandidate(serversInfo.inner)
+	if serversInfo.downCount > 0 || len(serversInfo.reserved) > 0 || serversInfo.openCircuits > 0 ||
+		serversInfo.profileServers != nil || len(serversInfo.profileOnly) > 0 {
+		// Skip reserved servers and servers of other network profiles, as well as servers that failed their
+		// health checks, unless they are all down
+		up, upServers := make([]int, 0, serversCount), make([]*ServerInfo, 0, serversCount)
+		unreserved, unreservedServers := make([]int, 0, serversCount), make([]*ServerInfo, 0, serversCount)
+		for i, serverInfo := range serversInfo.inner {
+			if serversInfo.excluded(serverInfo.Name) {
+				continue
+			}
+			unreserved, unreservedServers = append(unreserved, i), append(unreservedServers, serverInfo)
+			if !serversInfo.isDown(serverInfo.Name) {
+				up, upServers = append(up, i), append(upServers, serverInfo)
+			}
+		}
+		if len(up) == 0 {
+			up, upServers = unreserved, unreservedServers
+		}
+		if len(up) == 0 {
+			serversInfo.Unlock()
+			return nil
+		}
+		candidate = up[serversInfo.pickCandidate(upServers)]
+	}
 	if serversInfo.lbEstimator {
 		serversInfo.estimatorUpdate(candidate)
 	}
 	serverInfo := serversInfo.inner[candidate]
-	dlog.Debugf("Using candidate [%s] RTT: %d", serverInfo.Name, int(serverInfo.rtt.Value()))
+	if serversInfo.openCircuits > 0 {
+		serversInfo.startProbe(serverInfo.Name, time.Now())
+	}
+	serversLog.Debugf("Using candidate [%s] RTT: %d", serverInfo.Name, int(serverInfo.rtt.Value()))
 	serversInfo.Unlock()
 
 	return serverInfo
 }
 
+// excluded returns true if a server must not be used for regular queries, because it is reserved for the names
+// routed to it, or because it is not part of the active network profile
+func (serversInfo *ServersInfo) excluded(name string) bool {
+	if serversInfo.reserved[name] {
+		return true
+	}
+	if serversInfo.profileServers != nil {
+		return !serversInfo.profileServers[name]
+	}
+	return serversInfo.profileOnly[name]
+}
+
+// getOneOf returns one of the live servers with the given names, or nil if none of them are live.
+// Servers that are down are only returned if all of them are down.
+func (serversInfo *ServersInfo) getOneOf(names []string) *ServerInfo {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	var up, down []*ServerInfo
+	for _, serverInfo := range serversInfo.inner {
+		if !slices.Contains(names, serverInfo.Name) {
+			continue
+		}
+		if serversInfo.isDown(serverInfo.Name) {
+			down = append(down, serverInfo)
+		} else {
+			up = append(up, serverInfo)
+		}
+	}
+	if len(up) == 0 {
+		up = down
+	}
+	if len(up) == 0 {
+		return nil
+	}
+	return up[serversInfo.pickCandidate(up)]
+}
+
+// getByName returns a live server, or nil if there is no server with that name
+func (serversInfo *ServersInfo) getByName(name string) *ServerInfo {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	for _, serverInfo := range serversInfo.inner {
+		if serverInfo.Name == name {
+			return serverInfo
+		}
+	}
+	return nil
+}
+
 func fetchServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isNew bool) (ServerInfo, error) {
 	if stamp.Proto == stamps.StampProtoTypeDNSCrypt {
 		return fetchDNSCryptServerInfo(proxy, name, stamp, isNew)
 	} else if stamp.Proto == stamps.StampProtoTypeDoH {
 		return fetchDoHServerInfo(proxy, name, stamp, isNew)
+	} else if stamp.Proto == stamps.StampProtoTypeTLS {
+		return fetchDoTServerInfo(proxy, name, stamp, isNew)
+	} else if stamp.Proto == stamps.StampProtoTypeDoQ {
+		return fetchDoQServerInfo(proxy, name, stamp, isNew)
 	} else if stamp.Proto == stamps.StampProtoTypeODoHTarget {
 		return fetchODoHTargetInfo(proxy, name, stamp, isNew)
 	}
@@ -385,6 +520,9 @@ func findFarthestRoute(proxy *Proxy, name string, relayStamps []stamps.ServerSta
 	if len(proxy.serversInfo.registeredRelays) == 0 {
 		return nil
 	}
+	if relayStamp := fastestDistinctRelay(proxy, name, server.stamp, serverAddr, relayStamps); relayStamp != nil {
+		return relayStamp
+	}
 	bestRelayIdxs := make([]int, 0)
 	bestRelaySamePrefixBits := 128
 	for relayIdx, relayStamp := range relayStamps {
@@ -420,6 +558,89 @@ func findFarthestRoute(proxy *Proxy, name string, relayStamps []stamps.ServerSta
 	return &relayStamps[bestRelayIdxs[rand.Intn(len(bestRelayIdxs))]]
 }
 
+const MaxRelayProbes = 8
+
+// sameProvider returns true if both addresses are likely to be operated by the same provider.
+// Without an AS database, a shared /16 (IPv4) or /32 (IPv6) prefix is used as an approximation.
+func sameProvider(a net.IP, b net.IP) bool {
+	a4, b4 := a.To4(), b.To4()
+	if a4 != nil || b4 != nil {
+		return a4 != nil && b4 != nil && a4.Mask(net.CIDRMask(16, 32)).Equal(b4.Mask(net.CIDRMask(16, 32)))
+	}
+	return a.Mask(net.CIDRMask(32, 128)).Equal(b.Mask(net.CIDRMask(32, 128)))
+}
+
+// fastestDistinctRelay sends a certificate query to a server through a random sample of relays
+// that are not operated by the same provider, and returns the relay with the lowest latency.
+// Since routes are computed every time certificates are refreshed, the selection is periodically re-evaluated.
+func fastestDistinctRelay(
+	proxy *Proxy,
+	name string,
+	serverStamp stamps.ServerStamp,
+	serverAddr net.IP,
+	relayStamps []stamps.ServerStamp,
+) *stamps.ServerStamp {
+	candidates := make([]int, 0)
+	for relayIdx, relayStamp := range relayStamps {
+		if relayStamp.Proto != stamps.StampProtoTypeDNSCryptRelay {
+			continue
+		}
+		relayAddrStr, _ := ExtractHostAndPort(relayStamp.ServerAddrStr, 443)
+		relayAddr := ParseIP(relayAddrStr)
+		if relayAddr == nil || (relayAddr.To4() == nil) != (serverAddr.To4() == nil) || sameProvider(serverAddr, relayAddr) {
+			continue
+		}
+		candidates = append(candidates, relayIdx)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > MaxRelayProbes {
+		candidates = candidates[:MaxRelayProbes]
+	}
+	providerName := serverStamp.ProviderName
+	if !strings.HasSuffix(providerName, ".") {
+		providerName += "."
+	}
+	type relayProbe struct {
+		relayIdx int
+		rtt      time.Duration
+		err      error
+	}
+	probes := make(chan relayProbe, len(candidates))
+	for _, relayIdx := range candidates {
+		go func(relayIdx int) {
+			relayUDPAddr, err := net.ResolveUDPAddr("udp", relayStamps[relayIdx].ServerAddrStr)
+			if err != nil {
+				probes <- relayProbe{relayIdx: relayIdx, err: err}
+				return
+			}
+			query := dns.Msg{}
+			query.SetQuestion(providerName, dns.TypeTXT)
+			response := _dnsExchange(proxy, "udp", &query, serverStamp.ServerAddrStr, &DNSCryptRelay{RelayUDPAddr: relayUDPAddr}, 480)
+			probes <- relayProbe{relayIdx: relayIdx, rtt: response.rtt, err: response.err}
+		}(relayIdx)
+	}
+	bestRelayIdx := -1
+	var bestRtt time.Duration
+	for range candidates {
+		probe := <-probes
+		if probe.err != nil {
+			serversLog.Debugf("[%v] unreachable via relay [%v]: %v", name, relayStamps[probe.relayIdx].ServerAddrStr, probe.err)
+			continue
+		}
+		if bestRelayIdx < 0 || probe.rtt < bestRtt {
+			bestRelayIdx, bestRtt = probe.relayIdx, probe.rtt
+		}
+	}
+	if bestRelayIdx < 0 {
+		return nil
+	}
+	serversLog.Infof("Fastest relay for [%v]: [%v] - rtt: %dms", name, relayStamps[bestRelayIdx].ServerAddrStr, bestRtt.Milliseconds())
+	return &relayStamps[bestRelayIdx]
+}
+
 func relayProtoForServerProto(proto stamps.StampProtoType) (stamps.StampProtoType, error) {
 	switch proto {
 	case stamps.StampProtoTypeDNSCrypt:
@@ -431,11 +652,100 @@ func relayProtoForServerProto(proto stamps.StampProtoType) (stamps.StampProtoTyp
 	}
 }
 
+// sameNetwork returns true if both addresses are in the same /24 (IPv4) or /48 (IPv6) network
+func sameNetwork(a net.IP, b net.IP) bool {
+	a4, b4 := a.To4(), b.To4()
+	if a4 != nil || b4 != nil {
+		return a4 != nil && b4 != nil && a4.Mask(net.CIDRMask(24, 32)).Equal(b4.Mask(net.CIDRMask(24, 32)))
+	}
+	return a.Mask(net.CIDRMask(48, 128)).Equal(b.Mask(net.CIDRMask(48, 128)))
+}
+
+func registeredServerIP(proxy *Proxy, name string) net.IP {
+	proxy.serversInfo.RLock()
+	defer proxy.serversInfo.RUnlock()
+	for _, registeredServer := range proxy.serversInfo.registeredServers {
+		if registeredServer.name == name {
+			serverAddrStr, _ := ExtractHostAndPort(registeredServer.stamp.ServerAddrStr, 443)
+			return ParseIP(serverAddrStr)
+		}
+	}
+	return nil
+}
+
+func lookupDNSCryptRelayStamp(proxy *Proxy, relayName string) (stamps.ServerStamp, bool) {
+	if relayStamp, err := stamps.NewServerStampFromString(relayName); err == nil {
+		return relayStamp, relayStamp.Proto == stamps.StampProtoTypeDNSCryptRelay
+	}
+	proxy.serversInfo.RLock()
+	defer proxy.serversInfo.RUnlock()
+	for _, registeredServer := range proxy.serversInfo.registeredRelays {
+		if registeredServer.name == relayName && registeredServer.stamp.Proto == stamps.StampProtoTypeDNSCryptRelay {
+			return registeredServer.stamp, true
+		}
+	}
+	return stamps.ServerStamp{}, false
+}
+
+// routeChain builds a route going through every relay of a chain, in order.
+// Routes are refused if a relay is on the same network as the server or as another relay of the chain.
+func routeChain(proxy *Proxy, name string, serverProto stamps.StampProtoType, relayNames []string) (*Relay, error) {
+	if serverProto != stamps.StampProtoTypeDNSCrypt {
+		return nil, fmt.Errorf("Relay chains are only supported with DNSCrypt servers, and [%v] isn't one", name)
+	}
+	serverIP := registeredServerIP(proxy, name)
+	hops := make([]*net.UDPAddr, 0, len(relayNames))
+	var relayTCPAddr *net.TCPAddr
+	for i, relayName := range relayNames {
+		relayStamp, ok := lookupDNSCryptRelayStamp(proxy, relayName)
+		if !ok {
+			return nil, fmt.Errorf("Relay [%v] of the chain for server [%v] not found", relayName, name)
+		}
+		relayUDPAddr, err := net.ResolveUDPAddr("udp", relayStamp.ServerAddrStr)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			if relayTCPAddr, err = net.ResolveTCPAddr("tcp", relayStamp.ServerAddrStr); err != nil {
+				return nil, err
+			}
+		}
+		if serverIP != nil && sameNetwork(serverIP, relayUDPAddr.IP) {
+			return nil, fmt.Errorf("Relay [%v] is on the same network as server [%v]", relayName, name)
+		}
+		for j, hop := range hops {
+			if sameNetwork(hop.IP, relayUDPAddr.IP) {
+				return nil, fmt.Errorf("Relays [%v] and [%v] of the chain for server [%v] are on the same network",
+					relayNames[j], relayName, name)
+			}
+		}
+		hops = append(hops, relayUDPAddr)
+	}
+	serversLog.Noticef("Anonymizing queries for [%v] via the relay chain %v", name, relayNames)
+	return &Relay{
+		Proto: stamps.StampProtoTypeDNSCryptRelay,
+		Dnscrypt: &DNSCryptRelay{
+			RelayUDPAddr: hops[0],
+			RelayTCPAddr: relayTCPAddr,
+			NextHops:     hops[1:],
+		},
+	}, nil
+}
+
 func route(proxy *Proxy, name string, serverProto stamps.StampProtoType) (*Relay, error) {
 	routes := proxy.routes
 	if routes == nil {
 		return nil, nil
 	}
+	relayChain, ok := proxy.relayChains[name]
+	if !ok {
+		if _, hasRoute := (*routes)[name]; !hasRoute {
+			relayChain, ok = proxy.relayChains["*"]
+		}
+	}
+	if ok {
+		return routeChain(proxy, name, serverProto, relayChain)
+	}
 	wildcard := false
 	relayNames, ok := (*routes)[name]
 	if !ok {
@@ -448,7 +758,7 @@ func route(proxy *Proxy, name string, serverProto stamps.StampProtoType) (*Relay
 
 	relayProto, err := relayProtoForServerProto(serverProto)
 	if err != nil {
-		dlog.Errorf("Server [%v]'s protocol doesn't support anonymization", name)
+		serversLog.Errorf("Server [%v]'s protocol doesn't support anonymization", name)
 		return nil, nil
 	}
 	relayStamps := make([]stamps.ServerStamp, 0)
@@ -506,7 +816,10 @@ func route(proxy *Proxy, name string, serverProto stamps.StampProtoType) (*Relay
 		if err != nil {
 			return nil, err
 		}
-		dlog.Noticef("Anonymizing queries for [%v] via [%v]", name, relayName)
+		if serverIP := registeredServerIP(proxy, name); serverIP != nil && sameNetwork(serverIP, relayUDPAddr.IP) {
+			serversLog.Warnf("Relay [%v] is on the same network as server [%v] - Anonymization is ineffective", relayName, name)
+		}
+		serversLog.Noticef("Anonymizing queries for [%v] via [%v]", name, relayName)
 		return &Relay{
 			Proto:    stamps.StampProtoTypeDNSCryptRelay,
 			Dnscrypt: &DNSCryptRelay{RelayUDPAddr: relayUDPAddr, RelayTCPAddr: relayTCPAddr},
@@ -541,7 +854,7 @@ func route(proxy *Proxy, name string, serverProto stamps.StampProtoType) (*Relay
 				proxy.xTransport.saveCachedIP(host, ip, -1*time.Second)
 			}
 		}
-		dlog.Noticef("Anonymizing queries for [%v] via [%v]", name, relayName)
+		serversLog.Noticef("Anonymizing queries for [%v] via [%v]", name, relayName)
 		return &Relay{Proto: stamps.StampProtoTypeODoHRelay, ODoH: &ODoHRelay{
 			URL: relayURLforTarget,
 		}}, nil
@@ -555,14 +868,14 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 		if err != nil || len(serverPk) != ed25519.PublicKeySize {
 			dlog.Fatalf("Unsupported public key for [%s]: [%s]", name, stamp.ServerPk)
 		}
-		dlog.Warnf("Public key [%s] shouldn't be hex-encoded any more", string(stamp.ServerPk))
+		serversLog.Warnf("Public key [%s] shouldn't be hex-encoded any more", string(stamp.ServerPk))
 		stamp.ServerPk = serverPk
 	}
 	knownBugs := ServerBugs{}
 	for _, buggyServerName := range proxy.serversBlockingFragments {
 		if buggyServerName == name {
 			knownBugs.fragmentsBlocked = true
-			dlog.Infof("Known bug in [%v]: fragmented questions over UDP are blocked", name)
+			serversLog.Infof("Known bug in [%v]: fragmented questions over UDP are blocked", name)
 			break
 		}
 	}
@@ -574,10 +887,14 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 	if relay != nil {
 		dnscryptRelay = relay.Dnscrypt
 	}
+	certProto := proxy.mainProto
+	if serverHost, _ := ExtractHostAndPort(stamp.ServerAddrStr, -1); proxy.xTransport.dialerFor(serverHost) != nil {
+		certProto = "tcp"
+	}
 	certInfo, rtt, fragmentsBlocked, err := FetchCurrentDNSCryptCert(
 		proxy,
 		&name,
-		proxy.mainProto,
+		certProto,
 		stamp.ServerPk,
 		stamp.ServerAddrStr,
 		stamp.ProviderName,
@@ -586,16 +903,16 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 		knownBugs,
 	)
 	if !knownBugs.fragmentsBlocked && fragmentsBlocked {
-		dlog.Debugf("[%v] drops fragmented queries", name)
+		serversLog.Debugf("[%v] drops fragmented queries", name)
 		knownBugs.fragmentsBlocked = true
 	}
 	if knownBugs.fragmentsBlocked && relay != nil && relay.Dnscrypt != nil {
 		relay = nil
 		if proxy.skipAnonIncompatibleResolvers {
-			dlog.Infof("[%v] couldn't be reached anonymously, it will be ignored", name)
+			serversLog.Infof("[%v] couldn't be reached anonymously, it will be ignored", name)
 			return ServerInfo{}, errors.New("Resolver couldn't be reached anonymously")
 		}
-		dlog.Warnf("[%v] couldn't be reached anonymously", name)
+		serversLog.Warnf("[%v] couldn't be reached anonymously", name)
 	}
 	if err != nil {
 		return ServerInfo{}, err
@@ -608,6 +925,11 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 	if err != nil {
 		return ServerInfo{}, err
 	}
+	// Relays forward a single query per connection, so pipelining is only used for direct connections
+	var tcpPipeline *TCPPipeline
+	if proxy.tcpPipelining && relay == nil {
+		tcpPipeline = newDNSCryptTCPPipeline(proxy, remoteTCPAddr)
+	}
 	return ServerInfo{
 		Proto:              stamps.StampProtoTypeDNSCrypt,
 		MagicQuery:         certInfo.MagicQuery,
@@ -621,9 +943,27 @@ func fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp
 		Relay:              relay,
 		initialRtt:         rtt,
 		knownBugs:          knownBugs,
+		tcpPipeline:        tcpPipeline,
 	}, nil
 }
 
+func newDNSCryptTCPPipeline(proxy *Proxy, remoteTCPAddr *net.TCPAddr) *TCPPipeline {
+	dial := func() (net.Conn, error) {
+		if proxyDialer := proxy.xTransport.dialerFor(remoteTCPAddr.IP.String()); proxyDialer != nil {
+			return (*proxyDialer).Dial("tcp", remoteTCPAddr.String())
+		}
+		return outboundDialer(proxy.timeout).Dial("tcp", remoteTCPAddr.String())
+	}
+	// Responses are matched using the client half of the nonce, that the server copies into its response
+	keyOf := func(packet []byte) (string, bool) {
+		if len(packet) < len(ServerMagic)+HalfNonceSize {
+			return "", false
+		}
+		return string(packet[len(ServerMagic) : len(ServerMagic)+HalfNonceSize]), true
+	}
+	return NewTCPPipeline(dial, keyOf)
+}
+
 func dohTestPacket(msgID uint16) []byte {
 	msg := dns.Msg{}
 	msg.SetQuestion(".", dns.TypeNS)
@@ -677,6 +1017,8 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 			proxy.xTransport.saveCachedIP(host, ip, -1*time.Second)
 		}
 	}
+	echHost, _ := ExtractHostAndPort(stamp.ProviderName, -1)
+	proxy.xTransport.refreshECHConfig(echHost)
 	url := &url.URL{
 		Scheme: "https",
 		Host:   stamp.ProviderName,
@@ -684,17 +1026,23 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 	}
 	body := dohTestPacket(0xcafe)
 	useGet := false
-	if _, _, _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout); err != nil {
+	switch proxy.xTransport.dohMethodFor(echHost) {
+	case DoHMethodGet:
 		useGet = true
+	case DoHMethodPost:
+	default:
 		if _, _, _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout); err != nil {
-			return ServerInfo{}, err
+			useGet = true
+			if _, _, _, _, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout); err != nil {
+				return ServerInfo{}, err
+			}
+			serversLog.Debugf("Server [%s] doesn't appear to support POST; falling back to GET requests", name)
 		}
-		dlog.Debugf("Server [%s] doesn't appear to support POST; falling back to GET requests", name)
 	}
 	body = dohNXTestPacket(0xcafe)
 	serverResponse, _, tls, rtt, err := proxy.xTransport.DoHQuery(useGet, url, body, proxy.timeout)
 	if err != nil {
-		dlog.Infof("[%s] [%s]: %v", name, url, err)
+		serversLog.Infof("[%s] [%s]: %v", name, url, err)
 		return ServerInfo{}, err
 	}
 	if tls == nil || !tls.HandshakeComplete {
@@ -702,7 +1050,7 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 	}
 	msg := dns.Msg{}
 	if err := msg.Unpack(serverResponse); err != nil {
-		dlog.Warnf("[%s]: %v", name, err)
+		serversLog.Warnf("[%s]: %v", name, err)
 		return ServerInfo{}, err
 	}
 	if msg.Rcode != dns.RcodeNameError {
@@ -713,18 +1061,18 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 		protocol = "http/1.x"
 	}
 	if strings.HasPrefix(protocol, "http/1.") {
-		dlog.Warnf("[%s] does not support HTTP/2 nor HTTP/3", name)
+		serversLog.Warnf("[%s] does not support HTTP/2 nor HTTP/3", name)
 	}
-	dlog.Infof("[%s] TLS version: %x - Protocol: %v - Cipher suite: %v", name, tls.Version, protocol, tls.CipherSuite)
+	serversLog.Infof("[%s] TLS version: %x - Protocol: %v - Cipher suite: %v", name, tls.Version, protocol, tls.CipherSuite)
 	showCerts := proxy.showCerts
 	found := false
 	var wantedHash [32]byte
 	for _, cert := range tls.PeerCertificates {
 		h := sha256.Sum256(cert.RawTBSCertificate)
 		if showCerts {
-			dlog.Noticef("Advertised cert: [%s] [%x]", cert.Subject, h)
+			serversLog.Noticef("Advertised cert: [%s] [%x]", cert.Subject, h)
 		} else {
-			dlog.Debugf("Advertised cert: [%s] [%x]", cert.Subject, h)
+			serversLog.Debugf("Advertised cert: [%s] [%x]", cert.Subject, h)
 		}
 		for _, hash := range stamp.Hashes {
 			if len(hash) == len(wantedHash) {
@@ -745,14 +1093,14 @@ func fetchDoHServerInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, isN
 	}
 	if len(serverResponse) < MinDNSPacketSize || len(serverResponse) > MaxDNSPacketSize ||
 		serverResponse[0] != 0xca || serverResponse[1] != 0xfe || serverResponse[4] != 0x00 || serverResponse[5] != 0x01 {
-		dlog.Info("Webserver returned an unexpected response")
+		serversLog.Info("Webserver returned an unexpected response")
 		return ServerInfo{}, errors.New("Webserver returned an unexpected response")
 	}
 	xrtt := int(rtt.Nanoseconds() / 1000000)
 	if isNew {
-		dlog.Noticef("[%s] OK (DoH) - rtt: %dms", name, xrtt)
+		serversLog.Noticef("[%s] OK (DoH) - rtt: %dms", name, xrtt)
 	} else {
-		dlog.Infof("[%s] OK (DoH) - rtt: %dms", name, xrtt)
+		serversLog.Infof("[%s] OK (DoH) - rtt: %dms", name, xrtt)
 	}
 	return ServerInfo{
 		Proto:      stamps.StampProtoTypeDoH,
@@ -780,10 +1128,10 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 	configURL := &url.URL{Scheme: "https", Host: stamp.ProviderName, Path: "/.well-known/odohconfigs"}
 	odohTargetConfigs, err := fetchTargetConfigsFromWellKnown(proxy, configURL)
 	if err != nil {
-		dlog.Debug(configURL)
+		serversLog.Debug(configURL)
 		return ServerInfo{}, fmt.Errorf("[%s] didn't return an ODoH configuration - [%v]", name, err)
 	} else if len(odohTargetConfigs) == 0 {
-		dlog.Debug(configURL)
+		serversLog.Debug(configURL)
 		return ServerInfo{}, fmt.Errorf("[%s] has an empty ODoH configuration", name)
 	}
 
@@ -805,10 +1153,10 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 		}
 	}
 
-	dlog.Debugf("Pausing after ODoH configuration retrieval")
+	serversLog.Debugf("Pausing after ODoH configuration retrieval")
 	delay := time.Duration(rand.Intn(5*1000)) * time.Millisecond
 	clocksmith.Sleep(time.Duration(delay))
-	dlog.Debugf("Pausing done")
+	serversLog.Debugf("Pausing done")
 
 	targetURL := &url.URL{
 		Scheme: "https",
@@ -835,7 +1183,7 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 			if _, _, _, _, err := proxy.xTransport.ObliviousDoHQuery(useGet, url, odohQuery.odohMessage, proxy.timeout); err != nil {
 				continue
 			}
-			dlog.Debugf("Server [%s] doesn't appear to support POST; falling back to GET requests", name)
+			serversLog.Debugf("Server [%s] doesn't appear to support POST; falling back to GET requests", name)
 		}
 
 		query = dohNXTestPacket(0xcafe)
@@ -858,14 +1206,14 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 		}
 		serverResponse, err := odohQuery.decryptResponse(responseBody)
 		if err != nil {
-			dlog.Warnf("Unable to decrypt response from [%v]: [%v]", name, err)
+			serversLog.Warnf("Unable to decrypt response from [%v]: [%v]", name, err)
 			continue
 		}
 		workingConfigs = append(workingConfigs, odohTargetConfig)
 
 		msg := dns.Msg{}
 		if err := msg.Unpack(serverResponse); err != nil {
-			dlog.Warnf("[%s]: %v", name, err)
+			serversLog.Warnf("[%s]: %v", name, err)
 			return ServerInfo{}, err
 		}
 		if msg.Rcode != dns.RcodeNameError {
@@ -884,9 +1232,9 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 			}
 		}
 		if strings.HasPrefix(protocol, "http/1.") {
-			dlog.Warnf("[%s] does not support HTTP/2", name)
+			serversLog.Warnf("[%s] does not support HTTP/2", name)
 		}
-		dlog.Infof(
+		serversLog.Infof(
 			"[%s] TLS version: %x - Protocol: %v - Cipher suite: %v",
 			name,
 			tlsVersion,
@@ -900,9 +1248,9 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 			for _, cert := range tls.PeerCertificates {
 				h := sha256.Sum256(cert.RawTBSCertificate)
 				if showCerts {
-					dlog.Noticef("Advertised relay cert: [%s] [%x]", cert.Subject, h)
+					serversLog.Noticef("Advertised relay cert: [%s] [%x]", cert.Subject, h)
 				} else {
-					dlog.Debugf("Advertised relay cert: [%s] [%x]", cert.Subject, h)
+					serversLog.Debugf("Advertised relay cert: [%s] [%x]", cert.Subject, h)
 				}
 				for _, hash := range stamp.Hashes {
 					if len(hash) == len(wantedHash) {
@@ -924,14 +1272,14 @@ func _fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, i
 		}
 		if len(serverResponse) < MinDNSPacketSize || len(serverResponse) > MaxDNSPacketSize ||
 			serverResponse[0] != 0xca || serverResponse[1] != 0xfe || serverResponse[4] != 0x00 || serverResponse[5] != 0x01 {
-			dlog.Info("Webserver returned an unexpected response")
+			serversLog.Info("Webserver returned an unexpected response")
 			return ServerInfo{}, errors.New("Webserver returned an unexpected response")
 		}
 		xrtt := int(rtt.Nanoseconds() / 1000000)
 		if isNew {
-			dlog.Noticef("[%s] OK (ODoH) - rtt: %dms", name, xrtt)
+			serversLog.Noticef("[%s] OK (ODoH) - rtt: %dms", name, xrtt)
 		} else {
-			dlog.Infof("[%s] OK (ODoH) - rtt: %dms", name, xrtt)
+			serversLog.Infof("[%s] OK (ODoH) - rtt: %dms", name, xrtt)
 		}
 		return ServerInfo{
 			Proto:             stamps.StampProtoTypeODoHTarget,
@@ -956,7 +1304,7 @@ func fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, is
 		if err == nil {
 			break
 		}
-		dlog.Infof("Trying to fetch the [%v] configuration again", name)
+		serversLog.Infof("Trying to fetch the [%v] configuration again", name)
 	}
 	return serverInfo, err
 }
@@ -964,12 +1312,41 @@ func fetchODoHTargetInfo(proxy *Proxy, name string, stamp stamps.ServerStamp, is
 func (serverInfo *ServerInfo) noticeFailure(proxy *Proxy) {
 	proxy.serversInfo.Lock()
 	serverInfo.rtt.Add(float64(proxy.timeout.Nanoseconds() / 1000000))
+	if serverInfo.stats != nil {
+		serverInfo.stats.failures++
+		proxy.serversInfo.noticeP2C(serverInfo.stats, float64(proxy.timeout.Milliseconds()), false)
+	}
+	proxy.serversInfo.noticeCircuit(serverInfo.Name, false)
+	proxy.serversInfo.Unlock()
+	if serverInfo.Proto != stamps.StampProtoTypePlain {
+		proxy.systemFallback.notice(proxy, false)
+	}
+}
+
+func (serverInfo *ServerInfo) noticeTimeout(proxy *Proxy) {
+	proxy.serversInfo.Lock()
+	if serverInfo.stats != nil {
+		serverInfo.stats.timeouts++
+	}
+	proxy.adaptiveTimeouts.backoff(serverInfo.stats)
+	proxy.serversInfo.Unlock()
+	serverInfo.noticeFailure(proxy)
+}
+
+func (serverInfo *ServerInfo) noticeServFail(proxy *Proxy) {
+	proxy.serversInfo.Lock()
+	if serverInfo.stats != nil {
+		serverInfo.stats.servFails++
+	}
 	proxy.serversInfo.Unlock()
 }
 
 func (serverInfo *ServerInfo) noticeBegin(proxy *Proxy) {
 	proxy.serversInfo.Lock()
 	serverInfo.lastActionTS = time.Now()
+	if serverInfo.stats != nil {
+		serverInfo.stats.queries++
+	}
 	proxy.serversInfo.Unlock()
 }
 
@@ -981,5 +1358,20 @@ func (serverInfo *ServerInfo) noticeSuccess(proxy *Proxy) {
 	if elapsedMs > 0 && elapsed < proxy.timeout {
 		serverInfo.rtt.Add(float64(elapsedMs))
 	}
+	if stats := serverInfo.stats; stats != nil {
+		stats.successes++
+		if elapsed < proxy.timeout {
+			stats.latency.Add(float64(elapsed.Microseconds()) / 1000.0)
+			proxy.serversInfo.noticeP2C(stats, float64(elapsed.Microseconds())/1000.0, true)
+			if elapsed <= proxy.serversInfo.sloLatency {
+				stats.withinSLO++
+			}
+		}
+	}
+	proxy.adaptiveTimeouts.update(serverInfo.stats)
+	proxy.serversInfo.noticeCircuit(serverInfo.Name, true)
 	proxy.serversInfo.Unlock()
+	if serverInfo.Proto != stamps.StampProtoTypePlain {
+		proxy.systemFallback.notice(proxy, true)
+	}
 }
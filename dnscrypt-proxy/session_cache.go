@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/cipher"
+	crypto_rand "crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/jedisct1/dlog"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	PersistentSessionCacheSize  = 128
+	PersistentSessionSaveDelay  = 10 * time.Second
+	persistentSessionKeySuffix  = ".key"
+	persistentSessionFileFormat = 1
+)
+
+// PersistentSessionCache is a TLS client session cache whose content is saved to a file, so that connections
+// can be resumed after a restart. It is shared by DoH, DoT and DoQ; QUIC session tickets are regular TLS tickets.
+// The file is encrypted with a key stored in a separate file, readable only by its owner. Unless another
+// location is given, the key is stored next to the sessions, which only protects them if that file is copied alone.
+type PersistentSessionCache struct {
+	sync.Mutex
+	cache    tls.ClientSessionCache
+	sessions map[string]persistentSession
+	fileName string
+	aead     cipher.AEAD
+	saving   bool
+}
+
+type persistentSession struct {
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+type persistentSessionFile struct {
+	Format   int                          `json:"format"`
+	Sessions map[string]persistentSession `json:"sessions"`
+}
+
+func NewPersistentSessionCache(fileName string, keyFileName string) (*PersistentSessionCache, error) {
+	if len(keyFileName) == 0 {
+		keyFileName = fileName + persistentSessionKeySuffix
+	}
+	key, err := loadOrCreateSessionKey(keyFileName)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	sessionCache := PersistentSessionCache{
+		cache:    tls.NewLRUClientSessionCache(PersistentSessionCacheSize),
+		sessions: make(map[string]persistentSession),
+		fileName: fileName,
+		aead:     aead,
+	}
+	if err := sessionCache.load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		dlog.Warnf("Unable to load the TLS sessions from [%s]: %v", fileName, err)
+	}
+	return &sessionCache, nil
+}
+
+func loadOrCreateSessionKey(keyFileName string) ([]byte, error) {
+	key, err := os.ReadFile(keyFileName)
+	if err == nil {
+		if len(key) != chacha20poly1305.KeySize {
+			return nil, errors.New("Invalid TLS session cache key in [" + keyFileName + "]")
+		}
+		return key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key = make([]byte, chacha20poly1305.KeySize)
+	if _, err := crypto_rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(keyFileName, key, 0o600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (sessionCache *PersistentSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return sessionCache.cache.Get(sessionKey)
+}
+
+func (sessionCache *PersistentSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	sessionCache.cache.Put(sessionKey, cs)
+	sessionCache.Lock()
+	defer sessionCache.Unlock()
+	if cs == nil {
+		delete(sessionCache.sessions, sessionKey)
+	} else {
+		ticket, state, err := cs.ResumptionState()
+		if err != nil || state == nil {
+			return
+		}
+		stateBin, err := state.Bytes()
+		if err != nil {
+			return
+		}
+		if _, found := sessionCache.sessions[sessionKey]; !found && len(sessionCache.sessions) >= PersistentSessionCacheSize {
+			for evictedKey := range sessionCache.sessions {
+				delete(sessionCache.sessions, evictedKey)
+				break
+			}
+		}
+		sessionCache.sessions[sessionKey] = persistentSession{Ticket: ticket, State: stateBin}
+	}
+	if !sessionCache.saving {
+		sessionCache.saving = true
+		time.AfterFunc(PersistentSessionSaveDelay, sessionCache.save)
+	}
+}
+
+func (sessionCache *PersistentSessionCache) load() error {
+	encrypted, err := os.ReadFile(sessionCache.fileName)
+	if err != nil {
+		return err
+	}
+	nonceSize := sessionCache.aead.NonceSize()
+	if len(encrypted) < nonceSize {
+		return errors.New("File is too short")
+	}
+	bin, err := sessionCache.aead.Open(nil, encrypted[:nonceSize], encrypted[nonceSize:], nil)
+	if err != nil {
+		return err
+	}
+	var sessionFile persistentSessionFile
+	if err := json.Unmarshal(bin, &sessionFile); err != nil {
+		return err
+	}
+	if sessionFile.Format != persistentSessionFileFormat {
+		return errors.New("Unsupported file format")
+	}
+	for sessionKey, session := range sessionFile.Sessions {
+		state, err := tls.ParseSessionState(session.State)
+		if err != nil {
+			continue
+		}
+		cs, err := tls.NewResumptionState(session.Ticket, state)
+		if err != nil {
+			continue
+		}
+		sessionCache.cache.Put(sessionKey, cs)
+		sessionCache.sessions[sessionKey] = session
+	}
+	dlog.Debugf("%d TLS session(s) loaded from [%s]", len(sessionCache.sessions), sessionCache.fileName)
+	return nil
+}
+
+func (sessionCache *PersistentSessionCache) save() {
+	sessionCache.Lock()
+	sessionCache.saving = false
+	bin, err := json.Marshal(persistentSessionFile{Format: persistentSessionFileFormat, Sessions: sessionCache.sessions})
+	sessionCache.Unlock()
+	if err != nil {
+		dlog.Warnf("Unable to serialize the TLS sessions: %v", err)
+		return
+	}
+	nonce := make([]byte, sessionCache.aead.NonceSize())
+	if _, err := crypto_rand.Read(nonce); err != nil {
+		return
+	}
+	encrypted := sessionCache.aead.Seal(nonce, nonce, bin, nil)
+	if err := safefile.WriteFile(sessionCache.fileName, encrypted, 0o600); err != nil {
+		dlog.Warnf("Unable to save the TLS sessions to [%s]: %v", sessionCache.fileName, err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestPersistentSessionCacheKeyFile(t *testing.T) {
+	c := check.T(t)
+	dir := t.TempDir()
+	sessionFile := filepath.Join(dir, "tls-sessions")
+
+	_, err := NewPersistentSessionCache(sessionFile, "")
+	c.Nil(err)
+	_, err = os.Stat(sessionFile + persistentSessionKeySuffix)
+	c.Nil(err)
+
+	keyFile := filepath.Join(dir, "keys", "tls-sessions.key")
+	c.Nil(os.Mkdir(filepath.Dir(keyFile), 0o700))
+	sessionCache, err := NewPersistentSessionCache(sessionFile, keyFile)
+	c.Nil(err)
+	key, err := os.ReadFile(keyFile)
+	c.Nil(err)
+	c.Len(key, 32)
+	sessionCache.save()
+
+	_, err = NewPersistentSessionCache(sessionFile, keyFile)
+	c.Nil(err)
+	reloaded, err := NewPersistentSessionCache(sessionFile, "")
+	c.Nil(err)
+	c.Len(reloaded.sessions, 0)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"sync"
+)
+
+const (
+	// Number of independent shards of the DNS cache; each shard has its own lock
+	CacheShards = 32
+	// Estimated memory used by a cache entry, in addition to the size of the response itself
+	CacheEntryOverhead = 256
+)
+
+type cacheEntry struct {
+	key      [32]byte
+	response CachedResponse
+	size     int
+}
+
+type cacheShard struct {
+	sync.Mutex
+	entries    map[[32]byte]*list.Element
+	lru        *list.List
+	bytes      int
+	maxEntries int
+	maxBytes   int
+}
+
+// ShardedCache is an LRU cache split into shards selected by key, so that concurrent queries rarely contend
+// on the same lock. Its size is bounded by a number of entries and, optionally, by the memory used by the entries.
+type ShardedCache struct {
+	shards     []*cacheShard
+	maxEntries int
+}
+
+// NewShardedCache creates a cache holding up to `maxEntries` responses, and up to `maxBytes` bytes if `maxBytes` is not 0
+func NewShardedCache(maxEntries int, maxBytes int) *ShardedCache {
+	maxEntries = Max(1, maxEntries)
+	shardsCount := CacheShards
+	for shardsCount > 1 && (maxEntries/shardsCount < 16 || (maxBytes > 0 && maxBytes/shardsCount < 64*1024)) {
+		shardsCount /= 2
+	}
+	shardMaxEntries := Max(1, maxEntries/shardsCount)
+	cache := ShardedCache{shards: make([]*cacheShard, shardsCount), maxEntries: shardMaxEntries * shardsCount}
+	for i := range cache.shards {
+		cache.shards[i] = &cacheShard{
+			entries:    make(map[[32]byte]*list.Element),
+			lru:        list.New(),
+			maxEntries: shardMaxEntries,
+			maxBytes:   maxBytes / shardsCount,
+		}
+	}
+	return &cache
+}
+
+func (cache *ShardedCache) shard(key *[32]byte) *cacheShard {
+	return cache.shards[binary.LittleEndian.Uint64(key[:8])%uint64(len(cache.shards))]
+}
+
+// Get returns a cached response, and counts the hit.
+// Cached responses are never modified; callers must copy the message before modifying it.
+func (cache *ShardedCache) Get(key [32]byte) (CachedResponse, bool) {
+	shard := cache.shard(&key)
+	shard.Lock()
+	defer shard.Unlock()
+	element, ok := shard.entries[key]
+	if !ok {
+		return CachedResponse{}, false
+	}
+	shard.lru.MoveToFront(element)
+	entry := element.Value.(*cacheEntry)
+	entry.response.hits++
+	return entry.response, true
+}
+
+// Add stores a response, and returns whether an existing entry was replaced, and how many entries were evicted
+func (cache *ShardedCache) Add(key [32]byte, response CachedResponse) (replaced bool, evicted int) {
+	size := response.msg.Len() + CacheEntryOverhead
+	if response.wire != nil {
+		size += len(response.wire.packet) + 8*len(response.wire.ttlOffsets)
+	}
+	shard := cache.shard(&key)
+	shard.Lock()
+	defer shard.Unlock()
+	if element, ok := shard.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		shard.bytes += size - entry.size
+		entry.response, entry.size = response, size
+		shard.lru.MoveToFront(element)
+		replaced = true
+	} else {
+		shard.entries[key] = shard.lru.PushFront(&cacheEntry{key: key, response: response, size: size})
+		shard.bytes += size
+	}
+	for shard.lru.Len() > 1 &&
+		(shard.lru.Len() > shard.maxEntries || (shard.maxBytes > 0 && shard.bytes > shard.maxBytes)) {
+		oldest := shard.lru.Back()
+		entry := oldest.Value.(*cacheEntry)
+		shard.lru.Remove(oldest)
+		delete(shard.entries, entry.key)
+		shard.bytes -= entry.size
+		evicted++
+	}
+	return
+}
+
+// Len returns the number of cached responses
+func (cache *ShardedCache) Len() int {
+	count := 0
+	for _, shard := range cache.shards {
+		shard.Lock()
+		count += shard.lru.Len()
+		shard.Unlock()
+	}
+	return count
+}
+
+// Cap returns the maximum number of cached responses
+func (cache *ShardedCache) Cap() int {
+	return cache.maxEntries
+}
+
+// Bytes returns the estimated memory used by the cached responses
+func (cache *ShardedCache) Bytes() int {
+	bytes := 0
+	for _, shard := range cache.shards {
+		shard.Lock()
+		bytes += shard.bytes
+		shard.Unlock()
+	}
+	return bytes
+}
+
+// Walk calls `fn` for every cached response, from the least to the most recently used in each shard
+func (cache *ShardedCache) Walk(fn func(key [32]byte, cached *CachedResponse)) {
+	for _, shard := range cache.shards {
+		shard.Lock()
+		entries := make([]cacheEntry, 0, shard.lru.Len())
+		for element := shard.lru.Back(); element != nil; element = element.Prev() {
+			entries = append(entries, *element.Value.(*cacheEntry))
+		}
+		shard.Unlock()
+		for i := range entries {
+			fn(entries[i].key, &entries[i].response)
+		}
+	}
+}
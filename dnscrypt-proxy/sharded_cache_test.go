@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/sha512"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func testCachedResponse(name string) CachedResponse {
+	msg := dns.Msg{}
+	msg.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	return CachedResponse{msg: msg}
+}
+
+func TestShardedCache(t *testing.T) {
+	c := check.T(t)
+	cache := NewShardedCache(1000, 0)
+	c.Equal(cache.Cap(), 992)
+	for i := 0; i < 2000; i++ {
+		name := strconv.Itoa(i) + ".example.com"
+		cache.Add(sha512.Sum512_256([]byte(name)), testCachedResponse(name))
+	}
+	c.LE(cache.Len(), cache.Cap())
+	c.GT(cache.Len(), cache.Cap()/2)
+
+	key := sha512.Sum512_256([]byte("1999.example.com"))
+	cached, ok := cache.Get(key)
+	c.True(ok)
+	c.Equal(cached.msg.Question[0].Name, "1999.example.com.")
+	replaced, evicted := cache.Add(key, testCachedResponse("1999.example.com"))
+	c.True(replaced)
+	c.Zero(evicted)
+
+	small := NewShardedCache(1000, 16*(CacheEntryOverhead+100))
+	for i := 0; i < 100; i++ {
+		name := strconv.Itoa(i) + ".example.com"
+		small.Add(sha512.Sum512_256([]byte(name)), testCachedResponse(name))
+	}
+	c.LE(small.Bytes(), 16*(CacheEntryOverhead+100))
+	c.GT(small.Len(), 0)
+}
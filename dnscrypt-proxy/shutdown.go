@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// QueryDrainer keeps track of the queries being processed, so that they can complete before the proxy exits
+type QueryDrainer struct {
+	draining atomic.Bool
+	inFlight atomic.Int64
+}
+
+// enter registers a new query; it returns false if the proxy is shutting down and the query must be ignored
+func (drainer *QueryDrainer) enter() bool {
+	if drainer.draining.Load() {
+		return false
+	}
+	drainer.inFlight.Add(1)
+	if drainer.draining.Load() {
+		drainer.inFlight.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (drainer *QueryDrainer) leave() {
+	drainer.inFlight.Add(-1)
+}
+
+// drain stops accepting new queries, and waits for the current ones to complete, for at most `timeout`.
+// It returns the number of queries that were still being processed when it gave up.
+func (drainer *QueryDrainer) drain(timeout time.Duration) int64 {
+	drainer.draining.Store(true)
+	deadline := time.Now().Add(timeout)
+	for {
+		inFlight := drainer.inFlight.Load()
+		if inFlight <= 0 || !time.Now().Before(deadline) {
+			return max(0, inFlight)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Shutdown lets in-flight queries complete, then flushes the logs and saves the state that persists across restarts
+func (proxy *Proxy) Shutdown() {
+	dlog.Notice("Shutting down - waiting for in-flight queries to complete")
+	if pending := proxy.queryDrainer.drain(proxy.drainTimeout); pending > 0 {
+		dlog.Warnf("%d queries were still being processed after %v", pending, proxy.drainTimeout)
+	}
+	proxy.queryLogShipper.Stop()
+	proxy.dropPlugins()
+	if proxy.xTransport != nil {
+		if sessionCache, ok := proxy.xTransport.tlsSessionCache.(*PersistentSessionCache); ok {
+			sessionCache.save()
+		}
+	}
+	if proxy.cacheSnapshot != nil {
+		proxy.cacheSnapshot.save()
+	}
+}
+
+// dropPlugins calls Drop() on every plugin, including the ones of listener profiles, so that they can close their files
+func (proxy *Proxy) dropPlugins() {
+	dropped := make(map[Plugin]bool)
+	drop := func(pluginsGlobals *PluginsGlobals) {
+		pluginsGlobals.RLock()
+		defer pluginsGlobals.RUnlock()
+		for _, plugins := range []*[]Plugin{pluginsGlobals.queryPlugins, pluginsGlobals.responsePlugins, pluginsGlobals.loggingPlugins} {
+			if plugins == nil {
+				continue
+			}
+			for _, plugin := range *plugins {
+				if dropped[plugin] {
+					continue
+				}
+				dropped[plugin] = true
+				if err := plugin.Drop(); err != nil {
+					dlog.Warnf("Unable to stop the [%s] plugin: [%v]", plugin.Name(), err)
+				}
+			}
+		}
+	}
+	drop(&proxy.pluginsGlobals)
+	for _, profile := range proxy.listenerProfiles {
+		drop(&profile.pluginsGlobals)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestQueryDrainer(t *testing.T) {
+	c := check.T(t)
+	drainer := QueryDrainer{}
+	c.True(drainer.enter())
+	c.True(drainer.enter())
+	drainer.leave()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		drainer.leave()
+	}()
+	c.EQ(drainer.drain(5*time.Second), int64(0))
+	c.False(drainer.enter())
+
+	drainer = QueryDrainer{}
+	c.True(drainer.enter())
+	c.EQ(drainer.drain(20*time.Millisecond), int64(1))
+}
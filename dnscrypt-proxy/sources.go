@@ -38,6 +38,8 @@ type Source struct {
 	cacheTTL, prefetchDelay time.Duration
 	refresh                 time.Time
 	prefix                  string
+	compression             *CompressionCodec
+	alerter                 *Alerter
 }
 
 // timeNow() is replaced by tests to provide a static value
@@ -57,6 +59,9 @@ func (source *Source) fetchFromCache(now time.Time) (time.Duration, error) {
 	if bin, err = os.ReadFile(source.cacheFile); err != nil {
 		return 0, err
 	}
+	if bin, err = Decompress(bin, MaxHTTPBodyLength); err != nil {
+		return 0, err
+	}
 	if sig, err = os.ReadFile(source.cacheFile + ".minisig"); err != nil {
 		return 0, err
 	}
@@ -71,15 +76,18 @@ func (source *Source) fetchFromCache(now time.Time) (time.Duration, error) {
 	var ttl time.Duration = 0
 	if elapsed := now.Sub(fi.ModTime()); elapsed < source.cacheTTL {
 		ttl = source.prefetchDelay - elapsed
-		dlog.Debugf("Source [%s] cache file [%s] is still fresh, next update: %v", source.name, source.cacheFile, ttl)
+		sourcesLog.Debugf("Source [%s] cache file [%s] is still fresh, next update: %v", source.name, source.cacheFile, ttl)
 	} else {
-		dlog.Debugf("Source [%s] cache file [%s] needs to be refreshed", source.name, source.cacheFile)
+		sourcesLog.Debugf("Source [%s] cache file [%s] needs to be refreshed", source.name, source.cacheFile)
 	}
 	return ttl, nil
 }
 
-func writeSource(f string, bin, sig []byte) error {
+func writeSource(f string, bin, sig []byte, compression *CompressionCodec) error {
 	var err error
+	if bin, err = compression.Compress(bin); err != nil {
+		return err
+	}
 	var fSrc, fSig *safefile.File
 	if fSrc, err = safefile.Create(f, 0o644); err != nil {
 		return err
@@ -109,12 +117,12 @@ func (source *Source) updateCache(bin, sig []byte, now time.Time) {
 	}
 
 	if !bytes.Equal(source.bin, bin) {
-		if err := writeSource(file, bin, sig); err != nil {
-			dlog.Warnf("Couldn't write cache file [%s]: %s", absPath, err) // an error writing to the cache isn't fatal
+		if err := writeSource(file, bin, sig, source.compression); err != nil {
+			sourcesLog.Warnf("Couldn't write cache file [%s]: %s", absPath, err) // an error writing to the cache isn't fatal
 		}
 	}
 	if err := os.Chtimes(file, now, now); err != nil {
-		dlog.Warnf("Couldn't update cache file [%s]: %s", absPath, err)
+		sourcesLog.Warnf("Couldn't update cache file [%s]: %s", absPath, err)
 	}
 
 	source.bin = bin
@@ -123,7 +131,7 @@ func (source *Source) updateCache(bin, sig []byte, now time.Time) {
 func (source *Source) parseURLs(urls []string) {
 	for _, urlStr := range urls {
 		if srcURL, err := url.Parse(urlStr); err != nil {
-			dlog.Warnf("Source [%s] failed to parse URL [%s]", source.name, urlStr)
+			sourcesLog.Warnf("Source [%s] failed to parse URL [%s]", source.name, urlStr)
 		} else {
 			source.urls = append(source.urls, srcURL)
 		}
@@ -140,10 +148,10 @@ func (source *Source) fetchWithCache(xTransport *XTransport, now time.Time) (tim
 	var ttl time.Duration
 	if ttl, err = source.fetchFromCache(now); err != nil {
 		if len(source.urls) == 0 {
-			dlog.Errorf("Source [%s] cache file [%s] not present and no valid URL", source.name, source.cacheFile)
+			sourcesLog.Errorf("Source [%s] cache file [%s] not present and no valid URL", source.name, source.cacheFile)
 			return 0, err
 		}
-		dlog.Debugf("Source [%s] cache file [%s] not present", source.name, source.cacheFile)
+		sourcesLog.Debugf("Source [%s] cache file [%s] not present", source.name, source.cacheFile)
 	}
 
 	if len(source.urls) == 0 {
@@ -158,20 +166,20 @@ func (source *Source) fetchWithCache(xTransport *XTransport, now time.Time) (tim
 	source.refresh = now.Add(ttl)
 	var bin, sig []byte
 	for _, srcURL := range source.urls {
-		dlog.Infof("Source [%s] loading from URL [%s]", source.name, srcURL)
+		sourcesLog.Infof("Source [%s] loading from URL [%s]", source.name, srcURL)
 		sigURL := &url.URL{}
 		*sigURL = *srcURL // deep copy to avoid parsing twice
 		sigURL.Path += ".minisig"
 		if bin, err = fetchFromURL(xTransport, srcURL); err != nil {
-			dlog.Debugf("Source [%s] failed to download from URL [%s]", source.name, srcURL)
+			sourcesLog.Debugf("Source [%s] failed to download from URL [%s]", source.name, srcURL)
 			continue
 		}
 		if sig, err = fetchFromURL(xTransport, sigURL); err != nil {
-			dlog.Debugf("Source [%s] failed to download signature from URL [%s]", source.name, sigURL)
+			sourcesLog.Debugf("Source [%s] failed to download signature from URL [%s]", source.name, sigURL)
 			continue
 		}
 		if err = source.checkSignature(bin, sig); err != nil {
-			dlog.Debugf("Source [%s] failed signature check using URL [%s]", source.name, srcURL)
+			sourcesLog.Debugf("Source [%s] failed signature check using URL [%s]", source.name, srcURL)
 			continue
 		}
 		break // valid signature
@@ -195,6 +203,7 @@ func NewSource(
 	formatStr string,
 	refreshDelay time.Duration,
 	prefix string,
+	compression *CompressionCodec,
 ) (*Source, error) {
 	if refreshDelay < DefaultPrefetchDelay {
 		refreshDelay = DefaultPrefetchDelay
@@ -206,6 +215,7 @@ func NewSource(
 		cacheTTL:      refreshDelay,
 		prefetchDelay: DefaultPrefetchDelay,
 		prefix:        prefix,
+		compression:   compression,
 	}
 	if formatStr == "v2" {
 		source.format = SourceFormatV2
@@ -220,7 +230,7 @@ func NewSource(
 	source.parseURLs(urls)
 	_, err := source.fetchWithCache(xTransport, timeNow())
 	if err == nil {
-		dlog.Noticef("Source [%s] loaded", name)
+		sourcesLog.Noticef("Source [%s] loaded", name)
 	}
 	return source, err
 }
@@ -233,11 +243,12 @@ func PrefetchSources(xTransport *XTransport, sources []*Source) time.Duration {
 		if source.refresh.IsZero() || source.refresh.After(now) {
 			continue
 		}
-		dlog.Debugf("Prefetching [%s]", source.name)
+		sourcesLog.Debugf("Prefetching [%s]", source.name)
 		if delay, err := source.fetchWithCache(xTransport, now); err != nil {
-			dlog.Infof("Prefetching [%s] failed: %v, will retry in %v", source.name, err, interval)
+			sourcesLog.Infof("Prefetching [%s] failed: %v, will retry in %v", source.name, err, interval)
+			source.alerter.Fire(AlertSourceRefreshFailed, source.name, "Refreshing source [%s] failed: [%v]", source.name, err)
 		} else {
-			dlog.Debugf("Prefetching [%s] succeeded, next update in %v min", source.name, delay)
+			sourcesLog.Debugf("Prefetching [%s] succeeded, next update in %v min", source.name, delay)
 			if delay >= MinimumPrefetchInterval && (interval == MinimumPrefetchInterval || interval > delay) {
 				interval = delay
 			}
@@ -260,7 +271,7 @@ func (source *Source) parseV2() ([]RegisteredServer, error) {
 	appendStampErr := func(format string, a ...interface{}) {
 		stampErr := fmt.Sprintf(format, a...)
 		stampErrs = append(stampErrs, stampErr)
-		dlog.Warn(stampErr)
+		sourcesLog.Warn(stampErr)
 	}
 	in := string(source.bin)
 	parts := strings.Split(in, "## ")
@@ -305,7 +316,7 @@ func (source *Source) parseV2() ([]RegisteredServer, error) {
 		var stamp dnsstamps.ServerStamp
 		var err error
 		for _, stampStr = range stampStrs {
-			stamp, err = dnsstamps.NewServerStampFromString(stampStr)
+			stamp, err = ParseServerStamp(stampStr)
 			if err == nil {
 				break
 			}
@@ -317,7 +328,7 @@ func (source *Source) parseV2() ([]RegisteredServer, error) {
 		registeredServer := RegisteredServer{
 			name: name, stamp: stamp, description: description,
 		}
-		dlog.Debugf("Registered [%s] with stamp [%s]", name, stamp.String())
+		sourcesLog.Debugf("Registered [%s] with stamp [%s]", name, StampString(&stamp))
 		registeredServers = append(registeredServers, registeredServer)
 	}
 	if len(stampErrs) > 0 {
@@ -419,6 +419,7 @@ func TestNewSource(t *testing.T) {
 				tt.v,
 				tt.refreshDelay,
 				tt.e.prefix,
+				nil,
 			)
 			checkResult(t, tt.e, got, err)
 		})
@@ -438,6 +439,7 @@ func TestNewSource(t *testing.T) {
 						"v2",
 						DefaultPrefetchDelay*3,
 						"",
+						nil,
 					)
 					checkResult(t, e, got, err)
 				})
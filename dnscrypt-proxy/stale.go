@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	// Delay before an expired entry that has been served is refreshed
+	StaleRefreshDelay = 5 * time.Second
+	// Client protocol of the queries sent to refresh cache entries; the cache is bypassed for these queries
+	CacheRefreshProto = "cache_refresh"
+)
+
+// Names whose cache entries are being refreshed, so that an outage or a popular name doesn't trigger a refresh per query
+var cacheRefreshes sync.Map
+
+// serveStale returns the expired cache entry for the current query, if there is one that isn't too old,
+// and schedules a refresh of that entry in the background (RFC 8767)
+func (proxy *Proxy) serveStale(pluginsState *PluginsState) []byte {
+	stale, ok := pluginsState.sessionData["stale"]
+	if !ok {
+		return nil
+	}
+	staleMsg := stale.(*dns.Msg)
+	response, err := staleMsg.Pack()
+	if err != nil {
+		return nil
+	}
+	dlog.Debugf("[%s] Serving stale response", pluginsState.queryID)
+	proxy.cacheEventLogger.Log(CacheEventStaleServed, nil, staleMsg, StaleResponseTTL)
+	pluginsState.staleServed = true
+	proxy.refreshCacheEntry(pluginsState, StaleRefreshDelay)
+	return response
+}
+
+// refreshCacheEntry resends the current query in the background after `delay`, bypassing the cache, so that the
+// cache entry for that query gets updated even if clients don't ask for that name again
+func (proxy *Proxy) refreshCacheEntry(pluginsState *PluginsState, delay time.Duration) {
+	if pluginsState.questionMsg == nil || len(pluginsState.questionMsg.Question) == 0 {
+		return
+	}
+	msg, listener := pluginsState.questionMsg.Copy(), pluginsState.listener
+	question := msg.Question[0]
+	refreshKey := pluginsState.cachePartition + "/" + question.Name + "/" + dns.TypeToString[question.Qtype]
+	if _, inFlight := cacheRefreshes.LoadOrStore(refreshKey, true); inFlight {
+		return
+	}
+	go func() {
+		defer cacheRefreshes.Delete(refreshKey)
+		time.Sleep(delay)
+		msg.Id = dns.Id()
+		query, err := msg.Pack()
+		if err != nil {
+			return
+		}
+		if !proxy.clientsCountInc() {
+			return
+		}
+		defer proxy.clientsCountDec()
+		proxy.processIncomingQueryFrom(listener, CacheRefreshProto, proxy.mainProto, query, nil, nil, time.Now(), false)
+	}()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TopCounter keeps approximate counts for the most frequent keys.
+// When more than `capacity` keys are tracked, the least frequent half is discarded.
+type TopCounter struct {
+	counts   map[string]uint64
+	capacity int
+}
+
+type TopCounterEntry struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+func NewTopCounter(capacity int) *TopCounter {
+	return &TopCounter{counts: make(map[string]uint64), capacity: Max(16, capacity)}
+}
+
+func (counter *TopCounter) Add(key string) {
+	if _, found := counter.counts[key]; !found && len(counter.counts) >= counter.capacity {
+		counter.prune()
+	}
+	counter.counts[key]++
+}
+
+func (counter *TopCounter) prune() {
+	entries := counter.Top(len(counter.counts))
+	counter.counts = make(map[string]uint64, counter.capacity)
+	for _, entry := range entries[:len(entries)/2] {
+		counter.counts[entry.Key] = entry.Count
+	}
+}
+
+func (counter *TopCounter) Top(k int) []TopCounterEntry {
+	entries := make([]TopCounterEntry, 0, len(counter.counts))
+	for key, count := range counter.counts {
+		entries = append(entries, TopCounterEntry{Key: key, Count: count})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Count == entries[j].Count {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Count > entries[j].Count
+	})
+	if len(entries) > k {
+		entries = entries[:k]
+	}
+	return entries
+}
+
+type QueryStats struct {
+	sync.Mutex
+	since         time.Time
+	topK          int
+	queries       uint64
+	cacheHits     uint64
+	blocked       uint64
+	returnCodes   map[string]uint64
+	topDomains    *TopCounter
+	topBlocked    *TopCounter
+	topClients    *TopCounter
+	totalDuration time.Duration
+	answeredCount uint64
+}
+
+type QueryStatsReport struct {
+	Since          time.Time         `json:"since"`
+	Now            time.Time         `json:"now"`
+	Queries        uint64            `json:"queries"`
+	CacheHits      uint64            `json:"cache_hits"`
+	Blocked        uint64            `json:"blocked"`
+	AvgDurationMs  float64           `json:"avg_duration_ms"`
+	ReturnCodes    map[string]uint64 `json:"return_codes"`
+	TopDomains     []TopCounterEntry `json:"top_domains"`
+	TopBlocked     []TopCounterEntry `json:"top_blocked_domains"`
+	TopClients     []TopCounterEntry `json:"top_clients"`
+	QueriesPerSec  float64           `json:"queries_per_sec"`
+	CacheHitsRatio float64           `json:"cache_hits_ratio"`
+}
+
+func NewQueryStats(topK int) *QueryStats {
+	return &QueryStats{
+		since:       time.Now(),
+		topK:        topK,
+		returnCodes: make(map[string]uint64),
+		topDomains:  NewTopCounter(topK * 100),
+		topBlocked:  NewTopCounter(topK * 100),
+		topClients:  NewTopCounter(topK * 100),
+	}
+}
+
+func (stats *QueryStats) Record(pluginsState *PluginsState, clientIPStr string) {
+	returnCode, ok := PluginsReturnCodeToString[pluginsState.returnCode]
+	if !ok {
+		returnCode = "UNKNOWN"
+	}
+	stats.Lock()
+	defer stats.Unlock()
+	stats.queries++
+	stats.returnCodes[returnCode]++
+	stats.topDomains.Add(pluginsState.qName)
+	if len(clientIPStr) > 0 {
+		stats.topClients.Add(clientIPStr)
+	}
+	if pluginsState.cacheHit {
+		stats.cacheHits++
+	}
+	if pluginsState.returnCode == PluginsReturnCodeReject {
+		stats.blocked++
+		stats.topBlocked.Add(pluginsState.qName)
+	}
+	if !pluginsState.requestStart.IsZero() && !pluginsState.requestEnd.IsZero() {
+		stats.totalDuration += pluginsState.requestEnd.Sub(pluginsState.requestStart)
+		stats.answeredCount++
+	}
+}
+
+func (stats *QueryStats) Report() QueryStatsReport {
+	stats.Lock()
+	defer stats.Unlock()
+	now := time.Now()
+	report := QueryStatsReport{
+		Since:       stats.since,
+		Now:         now,
+		Queries:     stats.queries,
+		CacheHits:   stats.cacheHits,
+		Blocked:     stats.blocked,
+		ReturnCodes: make(map[string]uint64, len(stats.returnCodes)),
+		TopDomains:  stats.topDomains.Top(stats.topK),
+		TopBlocked:  stats.topBlocked.Top(stats.topK),
+		TopClients:  stats.topClients.Top(stats.topK),
+	}
+	for returnCode, count := range stats.returnCodes {
+		report.ReturnCodes[returnCode] = count
+	}
+	if stats.answeredCount > 0 {
+		report.AvgDurationMs = float64(stats.totalDuration/time.Microsecond) / float64(stats.answeredCount) / 1000.0
+	}
+	if elapsed := now.Sub(stats.since).Seconds(); elapsed > 0 {
+		report.QueriesPerSec = float64(stats.queries) / elapsed
+	}
+	if stats.queries > 0 {
+		report.CacheHitsRatio = float64(stats.cacheHits) / float64(stats.queries)
+	}
+	return report
+}
+
+func (stats *QueryStats) ReportJSON() ([]byte, error) {
+	return json.MarshalIndent(stats.Report(), "", " ")
+}
+
+// QueryStatsCounters is a snapshot of the cumulative counters
+type QueryStatsCounters struct {
+	Queries       uint64
+	CacheHits     uint64
+	Blocked       uint64
+	ReturnCodes   map[string]uint64
+	TotalDuration time.Duration
+	AnsweredCount uint64
+}
+
+func (stats *QueryStats) Counters() QueryStatsCounters {
+	stats.Lock()
+	defer stats.Unlock()
+	counters := QueryStatsCounters{
+		Queries:       stats.queries,
+		CacheHits:     stats.cacheHits,
+		Blocked:       stats.blocked,
+		ReturnCodes:   make(map[string]uint64, len(stats.returnCodes)),
+		TotalDuration: stats.totalDuration,
+		AnsweredCount: stats.answeredCount,
+	}
+	for returnCode, count := range stats.returnCodes {
+		counters.ReturnCodes[returnCode] = count
+	}
+	return counters
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/k-sone/critbitgo"
+)
+
+const (
+	// Crit-bit tree of the reversed names: fast inserts, but every name is stored twice
+	PatternMatcherBackendCritbit = "critbit"
+	// Tree of labels, from the TLD down: parent domains are shared, and names are not copied
+	PatternMatcherBackendLabelTrie = "label_trie"
+)
+
+func ValidatePatternMatcherBackend(backend string) error {
+	switch backend {
+	case PatternMatcherBackendCritbit, PatternMatcherBackendLabelTrie:
+		return nil
+	}
+	return fmt.Errorf("Unsupported pattern matcher backend: [%s]", backend)
+}
+
+// suffixMatcher stores the suffix rules of a PatternMatcher
+type suffixMatcher interface {
+	Insert(suffix string, val interface{})
+	// Match returns the most specific rule matching a name or one of its parent domains
+	Match(qName string) (suffix string, val interface{}, found bool)
+	Walk(handle func(suffix string))
+}
+
+func newSuffixMatcher(backend string) suffixMatcher {
+	if backend == PatternMatcherBackendLabelTrie {
+		return &labelTrieSuffixMatcher{}
+	}
+	return &critbitSuffixMatcher{trie: critbitgo.NewTrie()}
+}
+
+// ---
+
+type critbitSuffixMatcher struct {
+	trie *critbitgo.Trie
+}
+
+func (matcher *critbitSuffixMatcher) Insert(suffix string, val interface{}) {
+	matcher.trie.Insert([]byte(StringReverse(suffix)), val)
+}
+
+func (matcher *critbitSuffixMatcher) Match(qName string) (string, interface{}, bool) {
+	revQname := StringReverse(qName)
+	if match, xval, found := matcher.trie.LongestPrefix([]byte(revQname)); found {
+		if len(match) == len(revQname) || revQname[len(match)] == '.' {
+			return StringReverse(string(match)), xval, true
+		}
+		if len(match) < len(revQname) && len(revQname) > 0 {
+			if i := strings.LastIndex(revQname, "."); i > 0 {
+				pName := revQname[:i]
+				if match, _, found := matcher.trie.LongestPrefix([]byte(pName)); found {
+					if len(match) == len(pName) || pName[len(match)] == '.' {
+						return StringReverse(string(match)), xval, true
+					}
+				}
+			}
+		}
+	}
+	return "", nil, false
+}
+
+func (matcher *critbitSuffixMatcher) Walk(handle func(suffix string)) {
+	matcher.trie.Walk(nil, func(key []byte, _ interface{}) bool {
+		handle(StringReverse(string(key)))
+		return true
+	})
+}
+
+// ---
+
+type labelTrieNode struct {
+	children map[string]*labelTrieNode
+	val      interface{}
+	terminal bool
+}
+
+type labelTrieSuffixMatcher struct {
+	root labelTrieNode
+}
+
+func (matcher *labelTrieSuffixMatcher) Insert(suffix string, val interface{}) {
+	node := &matcher.root
+	for end := len(suffix); end > 0; {
+		start := strings.LastIndexByte(suffix[:end], '.') + 1
+		label := suffix[start:end]
+		child, ok := node.children[label]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*labelTrieNode, 1)
+			}
+			child = &labelTrieNode{}
+			node.children[label] = child
+		}
+		node = child
+		end = start - 1
+	}
+	node.val, node.terminal = val, true
+}
+
+func (matcher *labelTrieSuffixMatcher) Match(qName string) (string, interface{}, bool) {
+	node := &matcher.root
+	var matchStart int
+	var matchVal interface{}
+	found := false
+	for end := len(qName); end > 0; {
+		start := strings.LastIndexByte(qName[:end], '.') + 1
+		child, ok := node.children[qName[start:end]]
+		if !ok {
+			break
+		}
+		node = child
+		if node.terminal {
+			matchStart, matchVal, found = start, node.val, true
+		}
+		end = start - 1
+	}
+	if !found {
+		return "", nil, false
+	}
+	return qName[matchStart:], matchVal, true
+}
+
+func (matcher *labelTrieSuffixMatcher) Walk(handle func(suffix string)) {
+	var walk func(node *labelTrieNode, suffix string)
+	walk = func(node *labelTrieNode, suffix string) {
+		if node.terminal {
+			handle(suffix)
+		}
+		for label, child := range node.children {
+			if len(suffix) == 0 {
+				walk(child, label)
+			} else {
+				walk(child, label+"."+suffix)
+			}
+		}
+	}
+	walk(&matcher.root, "")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand"
+
+	"github.com/miekg/dns"
+)
+
+// SynthTemplate is a synthesized response in wire format, that doesn't depend on the question.
+// Answers are stored without their owner name, which is always a compression pointer to the question name,
+// so that responses for a rule can be built by copying bytes instead of packing a new message every time.
+type SynthTemplate struct {
+	rcode       int
+	answers     [][]byte // TYPE, CLASS, TTL, RDLENGTH and RDATA of every record
+	ednsOptions []byte
+}
+
+// NewSynthTemplate returns a template for a response with the given code, answers and EDNS options.
+// The owner names of the answers are ignored.
+func NewSynthTemplate(rcode int, answers []dns.RR, ednsOptions []dns.EDNS0) (*SynthTemplate, error) {
+	if rcode > 0xf {
+		return nil, errors.New("Extended response codes are not supported in templates")
+	}
+	template := SynthTemplate{rcode: rcode, answers: make([][]byte, 0, len(answers))}
+	for _, answer := range answers {
+		rr := dns.Copy(answer)
+		rr.Header().Name = "."
+		packed, err := packRootRR(rr)
+		if err != nil {
+			return nil, err
+		}
+		template.answers = append(template.answers, packed)
+	}
+	if len(ednsOptions) > 0 {
+		opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}, Option: ednsOptions}
+		packed, err := packRootRR(opt)
+		if err != nil {
+			return nil, err
+		}
+		template.ednsOptions = packed[10:]
+	}
+	return &template, nil
+}
+
+// NewSynthTemplateFromResponse returns a template for a response built for a single question
+func NewSynthTemplateFromResponse(response *dns.Msg) (*SynthTemplate, error) {
+	if len(response.Ns) > 0 || len(response.Extra) > 1 || (len(response.Extra) == 1 && response.IsEdns0() == nil) {
+		return nil, errors.New("Only answers and EDNS options are supported in templates")
+	}
+	var ednsOptions []dns.EDNS0
+	if edns0 := response.IsEdns0(); edns0 != nil {
+		ednsOptions = edns0.Option
+	}
+	return NewSynthTemplate(response.Rcode, response.Answer, ednsOptions)
+}
+
+// packRootRR returns a record owned by the root, without its name
+func packRootRR(rr dns.RR) ([]byte, error) {
+	buf := make([]byte, dns.Len(rr))
+	length, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return buf[1:length], nil
+}
+
+// Build returns a response to a query, with all the TTLs set to `ttl`.
+// EDNS options are only included if the query included an OPT record.
+func (template *SynthTemplate) Build(msg *dns.Msg, ttl uint32, shuffle bool) ([]byte, error) {
+	if len(msg.Question) != 1 {
+		return nil, errors.New("Unexpected number of questions")
+	}
+	question := msg.Question[0]
+	edns0 := msg.IsEdns0()
+	size := 12 + len(question.Name) + 2 + 4
+	for _, answer := range template.answers {
+		size += 2 + len(answer)
+	}
+	if edns0 != nil {
+		size += 11 + len(template.ednsOptions)
+	}
+	packet := make([]byte, size)
+	binary.BigEndian.PutUint16(packet[0:2], msg.Id)
+	packet[2] = 0x80 | byte(msg.Opcode&0xf)<<3
+	if msg.RecursionDesired {
+		packet[2] |= 0x01
+	}
+	packet[3] = 0x80 | byte(template.rcode)
+	binary.BigEndian.PutUint16(packet[4:6], 1)
+	binary.BigEndian.PutUint16(packet[6:8], uint16(len(template.answers)))
+	if edns0 != nil {
+		binary.BigEndian.PutUint16(packet[10:12], 1)
+	}
+	offset, err := dns.PackDomainName(question.Name, packet, 12, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint16(packet[offset:offset+2], question.Qtype)
+	binary.BigEndian.PutUint16(packet[offset+2:offset+4], question.Qclass)
+	offset += 4
+	var order []int
+	if shuffle {
+		order = rand.Perm(len(template.answers))
+	}
+	for i, answer := range template.answers {
+		if order != nil {
+			answer = template.answers[order[i]]
+		}
+		packet[offset], packet[offset+1] = 0xc0, 12
+		copy(packet[offset+2:], answer)
+		binary.BigEndian.PutUint32(packet[offset+6:offset+10], ttl)
+		offset += 2 + len(answer)
+	}
+	if edns0 != nil {
+		packet[offset] = 0
+		binary.BigEndian.PutUint16(packet[offset+1:offset+3], dns.TypeOPT)
+		binary.BigEndian.PutUint16(packet[offset+3:offset+5], edns0.UDPSize())
+		if edns0.Do() {
+			packet[offset+7] = 0x80
+		}
+		binary.BigEndian.PutUint16(packet[offset+9:offset+11], uint16(len(template.ednsOptions)))
+		copy(packet[offset+11:], template.ednsOptions)
+		offset += 11 + len(template.ednsOptions)
+	}
+	return packet[:offset], nil
+}
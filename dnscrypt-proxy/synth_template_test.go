@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestSynthTemplates(t *testing.T) {
+	c := check.T(t)
+	for _, blockedQueryResponse := range []string{"refused", "hinfo", "a:192.0.2.1,aaaa:2001:db8::1"} {
+		pluginsGlobals := PluginsGlobals{}
+		parseBlockedQueryResponse(blockedQueryResponse, &pluginsGlobals)
+		pluginsGlobals.updateRejectTemplates()
+		for _, qType := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeMX} {
+			for _, edns := range []bool{false, true} {
+				msg := dns.Msg{}
+				msg.SetQuestion("Blocked.Example.COM.", qType)
+				if edns {
+					msg.SetEdns0(1232, true)
+				}
+				expected, err := RefusedResponseFromMessage(&msg, pluginsGlobals.refusedCodeInResponses,
+					pluginsGlobals.respondWithIPv4, pluginsGlobals.respondWithIPv6, 600).Pack()
+				c.Nil(err)
+				pluginsState := PluginsState{rejectTTL: 600}
+				pluginsGlobals.synthRejectResponse(&pluginsState, &msg)
+				c.Nil(pluginsState.synthResponse)
+				c.DeepEqual(pluginsState.synthPacket, expected, blockedQueryResponse, qType, edns)
+			}
+		}
+	}
+
+	cloakedName := CloakedName{ipv4: []net.IP{net.IPv4(192, 0, 2, 1).To4(), net.IPv4(192, 0, 2, 2).To4()}}
+	cloakedName.updateTemplates()
+	msg := dns.Msg{}
+	msg.SetQuestion("cloaked.example.com.", dns.TypeA)
+	synth := EmptyResponseFromMessage(&msg)
+	synth.Answer = cloakedName.answers("cloaked.example.com.", dns.TypeA, 60)
+	expected, err := synth.Pack()
+	c.Nil(err)
+	packet, err := cloakedName.templates[dns.TypeA].Build(&msg, 60, false)
+	c.Nil(err)
+	c.DeepEqual(packet, expected)
+	packet, err = cloakedName.templates[dns.TypeA].Build(&msg, 60, true)
+	c.Nil(err)
+	c.Len(packet, len(expected))
+	c.Equal(len(cloakedName.templates[dns.TypeAAAA].answers), 0)
+}
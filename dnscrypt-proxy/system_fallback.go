@@ -0,0 +1,202 @@
+package main
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	clocksmith "github.com/jedisct1/go-clocksmith"
+	stamps "github.com/jedisct1/go-dnsstamps"
+)
+
+const (
+	DefaultSystemFallbackFailures      = 5
+	DefaultSystemFallbackCheckInterval = 30
+	DefaultResolvConf                  = "/etc/resolv.conf"
+	// Number of encrypted servers probed by every recovery check
+	SystemFallbackProbedServers = 3
+)
+
+// SystemFallback sends queries, UNENCRYPTED, to the resolvers of the system (usually provided by DHCP) when none
+// of the encrypted servers can be reached. Encrypted servers are checked periodically, and used again as soon as
+// one of them responds.
+type SystemFallback struct {
+	sync.Mutex
+	resolvConf    string
+	maxFailures   int
+	checkInterval time.Duration
+	failures      int
+	lastAttempt   time.Time
+	active        bool
+	since         time.Time
+	servers       []*ServerInfo
+}
+
+func NewSystemFallback(config *SystemFallbackConfig) *SystemFallback {
+	if !config.Enabled {
+		return nil
+	}
+	systemFallback := SystemFallback{
+		resolvConf:    config.ResolvConf,
+		maxFailures:   Max(1, config.Failures),
+		checkInterval: time.Duration(Max(1, config.CheckInterval)) * time.Second,
+	}
+	if len(systemFallback.resolvConf) == 0 {
+		systemFallback.resolvConf = DefaultResolvConf
+	}
+	return &systemFallback
+}
+
+// systemResolvers returns the addresses of the name servers of a `resolv.conf` file. Loopback addresses are
+// ignored, as they are usually dnscrypt-proxy itself, or another local stub resolver forwarding to it.
+func systemResolvers(content string) []string {
+	var addrs []string
+	for _, line := range strings.Split(content, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 2 || parts[0] != "nameserver" {
+			continue
+		}
+		host, _, _ := strings.Cut(parts[1], "%")
+		ip := net.ParseIP(host)
+		if ip == nil || ip.IsLoopback() || ip.IsUnspecified() {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(parts[1], strconv.Itoa(PlainDNSDefaultPort)))
+	}
+	return addrs
+}
+
+// loadServers reads the system resolvers again, as they may have changed since the last time the fallback was used
+func (systemFallback *SystemFallback) loadServers(proxy *Proxy) []*ServerInfo {
+	content, err := ReadTextFile(systemFallback.resolvConf)
+	if err != nil {
+		dlog.Errorf("Unable to read the system resolvers from [%s]: [%v]", systemFallback.resolvConf, err)
+		return nil
+	}
+	var servers []*ServerInfo
+	for _, addr := range systemResolvers(content) {
+		serverInfo, err := newLastResortServer(proxy, "system:"+addr, stamps.ServerStamp{Proto: stamps.StampProtoTypePlain, ServerAddrStr: addr})
+		if err != nil {
+			continue
+		}
+		servers = append(servers, serverInfo)
+	}
+	if len(servers) == 0 {
+		dlog.Errorf("No usable system resolvers in [%s]", systemFallback.resolvConf)
+	}
+	return servers
+}
+
+// notice records the outcome of a query sent to an encrypted server, and switches to the system resolvers
+// after too many consecutive failures
+func (systemFallback *SystemFallback) notice(proxy *Proxy, success bool) {
+	if systemFallback == nil {
+		return
+	}
+	systemFallback.Lock()
+	if success {
+		systemFallback.failures = 0
+		systemFallback.Unlock()
+		return
+	}
+	systemFallback.failures++
+	trigger := !systemFallback.active && systemFallback.failures >= systemFallback.maxFailures
+	systemFallback.Unlock()
+	if trigger {
+		systemFallback.activate(proxy, strconv.Itoa(systemFallback.maxFailures)+" consecutive queries to encrypted servers failed")
+	}
+}
+
+func (systemFallback *SystemFallback) activate(proxy *Proxy, reason string) {
+	systemFallback.Lock()
+	if time.Since(systemFallback.lastAttempt) < systemFallback.checkInterval {
+		// The system resolvers were unusable a moment ago
+		systemFallback.Unlock()
+		return
+	}
+	systemFallback.lastAttempt = time.Now()
+	systemFallback.Unlock()
+	servers := systemFallback.loadServers(proxy)
+	if len(servers) == 0 {
+		return
+	}
+	systemFallback.Lock()
+	if systemFallback.active {
+		systemFallback.Unlock()
+		return
+	}
+	systemFallback.active, systemFallback.since, systemFallback.servers = true, time.Now(), servers
+	systemFallback.Unlock()
+	names := make([]string, len(servers))
+	for i, serverInfo := range servers {
+		names[i] = serverInfo.Name
+	}
+	dlog.Criticalf("BREAK-GLASS MODE: no encrypted servers are reachable (%s) - "+
+		"Queries are now sent UNENCRYPTED to the system resolvers %v", reason, names)
+	proxy.alerter.Fire(AlertSystemFallback, "", "No encrypted servers are reachable (%s) - Using the system resolvers %v", reason, names)
+	go systemFallback.recover(proxy)
+}
+
+// server returns one of the system resolvers if the fallback is active, or nil. The fallback is activated
+// if none of the encrypted servers that regular queries can be sent to are live.
+func (systemFallback *SystemFallback) server(proxy *Proxy) *ServerInfo {
+	if systemFallback == nil {
+		return nil
+	}
+	systemFallback.Lock()
+	active := systemFallback.active
+	systemFallback.Unlock()
+	if !active && proxy.serversInfo.allDown() {
+		systemFallback.activate(proxy, "all the servers are down")
+	}
+	systemFallback.Lock()
+	defer systemFallback.Unlock()
+	if !systemFallback.active {
+		return nil
+	}
+	return systemFallback.servers[rand.Intn(len(systemFallback.servers))]
+}
+
+// isActive returns true if queries are currently sent to the system resolvers
+func (systemFallback *SystemFallback) isActive() bool {
+	if systemFallback == nil {
+		return false
+	}
+	systemFallback.Lock()
+	defer systemFallback.Unlock()
+	return systemFallback.active
+}
+
+// recover checks periodically if encrypted servers can be reached again, and disables the fallback if they can
+func (systemFallback *SystemFallback) recover(proxy *Proxy) {
+	for {
+		clocksmith.Sleep(systemFallback.checkInterval)
+		var servers []*ServerInfo
+		proxy.serversInfo.RLock()
+		for _, serverInfo := range proxy.serversInfo.inner {
+			if len(servers) < SystemFallbackProbedServers && !proxy.serversInfo.excluded(serverInfo.Name) {
+				servers = append(servers, serverInfo)
+			}
+		}
+		proxy.serversInfo.RUnlock()
+		for _, serverInfo := range servers {
+			if proxy.serversInfo.allDown() {
+				break
+			}
+			if rtt := proxy.measureServerRTT(serverInfo); rtt > 0 {
+				systemFallback.Lock()
+				since := systemFallback.since
+				systemFallback.active, systemFallback.failures, systemFallback.servers = false, 0, nil
+				systemFallback.Unlock()
+				dlog.Noticef("[%s] is reachable again - Leaving break-glass mode after %v, queries are encrypted again",
+					serverInfo.Name, time.Since(since).Round(time.Second))
+				return
+			}
+		}
+		dlog.Warnf("Break-glass mode - Encrypted servers are still unreachable")
+	}
+}
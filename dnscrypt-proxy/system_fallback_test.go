@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestSystemResolvers(t *testing.T) {
+	c := check.T(t)
+	c.DeepEqual(systemResolvers("# Generated by DHCP\nnameserver 127.0.0.53\nnameserver 192.168.1.1\n"+
+		"nameserver ::1\nnameserver fe80::1%eth0\nsearch lan\n"), []string{"192.168.1.1:53", "[fe80::1%eth0]:53"})
+	c.Nil(systemResolvers("nameserver 127.0.0.1\n"))
+}
+
+func TestSystemFallback(t *testing.T) {
+	c := check.T(t)
+	c.Nil(NewSystemFallback(&SystemFallbackConfig{}))
+	resolvConf := filepath.Join(t.TempDir(), "resolv.conf")
+	c.Must(c.Nil(os.WriteFile(resolvConf, []byte("nameserver 192.168.1.1\n"), 0o600)))
+	proxy := Proxy{timeout: time.Second}
+	systemFallback := NewSystemFallback(&SystemFallbackConfig{Enabled: true, Failures: 2, CheckInterval: 3600, ResolvConf: resolvConf})
+
+	systemFallback.notice(&proxy, false)
+	systemFallback.notice(&proxy, true)
+	systemFallback.notice(&proxy, false)
+	c.False(systemFallback.isActive())
+	systemFallback.notice(&proxy, false)
+	c.True(systemFallback.isActive())
+	serverInfo := systemFallback.server(&proxy)
+	c.Must(c.NotNil(serverInfo))
+	c.EQ(serverInfo.Name, "system:192.168.1.1:53")
+	c.EQ(serverInfo.UDPAddr.String(), "192.168.1.1:53")
+}
+
+func TestServersInfoAllDown(t *testing.T) {
+	c := check.T(t)
+	serversInfo := NewServersInfo()
+	c.True(serversInfo.allDown())
+	serversInfo.inner = []*ServerInfo{{Name: "corp-doh"}, {Name: "public"}}
+	c.False(serversInfo.allDown())
+	serversInfo.profileServers = map[string]bool{"corp-doh": true}
+	serversInfo.health["corp-doh"] = &ServerHealth{down: true}
+	c.True(serversInfo.allDown())
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/jedisct1/dlog"
+)
+
+var ErrTooManyTCPConnections = errors.New("Too many TCP connections")
+
+// TCPConnLimiter limits the number of simultaneous connections to the TCP-based listeners,
+// overall and for each client IP address
+type TCPConnLimiter struct {
+	sync.Mutex
+	counts   map[string]uint32
+	count    uint32
+	max      uint32
+	maxPerIP uint32
+}
+
+// NewTCPConnLimiter returns nil if the number of connections is not limited
+func NewTCPConnLimiter(max uint32, maxPerIP uint32) *TCPConnLimiter {
+	if max == 0 && maxPerIP == 0 {
+		return nil
+	}
+	return &TCPConnLimiter{counts: make(map[string]uint32), max: max, maxPerIP: maxPerIP}
+}
+
+func (limiter *TCPConnLimiter) acquire(clientAddr net.Addr) bool {
+	key := clientIPKey(clientAddr)
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.max > 0 && limiter.count >= limiter.max {
+		return false
+	}
+	if limiter.maxPerIP > 0 && limiter.counts[key] >= limiter.maxPerIP {
+		return false
+	}
+	limiter.count++
+	limiter.counts[key]++
+	return true
+}
+
+func (limiter *TCPConnLimiter) release(clientAddr net.Addr) {
+	key := clientIPKey(clientAddr)
+	limiter.Lock()
+	defer limiter.Unlock()
+	if limiter.count > 0 {
+		limiter.count--
+	}
+	if count := limiter.counts[key]; count <= 1 {
+		delete(limiter.counts, key)
+	} else {
+		limiter.counts[key] = count - 1
+	}
+}
+
+// Wrap returns a listener whose connections fail as soon as they are used, if they exceed the limits.
+// Connections are only counted when they are first used, so that the address of clients behind a PROXY
+// protocol frontend is known: the listener must wrap the PROXY protocol listener, if there is one.
+func (limiter *TCPConnLimiter) Wrap(listener net.Listener) net.Listener {
+	if limiter == nil {
+		return listener
+	}
+	return &tcpLimitedListener{Listener: listener, limiter: limiter}
+}
+
+type tcpLimitedListener struct {
+	net.Listener
+	limiter *TCPConnLimiter
+}
+
+func (listener *tcpLimitedListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &tcpLimitedConn{Conn: conn, limiter: listener.limiter}, nil
+}
+
+// tcpLimitedConn takes a slot when it is first used, and releases it when it is closed
+type tcpLimitedConn struct {
+	net.Conn
+	limiter    *TCPConnLimiter
+	admitOnce  sync.Once
+	admitted   bool
+	clientAddr net.Addr
+	closeOnce  sync.Once
+}
+
+func (conn *tcpLimitedConn) admit() bool {
+	conn.admitOnce.Do(func() {
+		conn.clientAddr = conn.Conn.RemoteAddr()
+		if conn.admitted = conn.limiter.acquire(conn.clientAddr); !conn.admitted {
+			dlog.Debugf("Too many TCP connections, closing the connection from [%v]", conn.clientAddr)
+		}
+	})
+	return conn.admitted
+}
+
+func (conn *tcpLimitedConn) Read(b []byte) (int, error) {
+	if !conn.admit() {
+		return 0, ErrTooManyTCPConnections
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn *tcpLimitedConn) Write(b []byte) (int, error) {
+	if !conn.admit() {
+		return 0, ErrTooManyTCPConnections
+	}
+	return conn.Conn.Write(b)
+}
+
+func (conn *tcpLimitedConn) Close() error {
+	conn.closeOnce.Do(func() {
+		// A connection closed before being used never takes a slot
+		conn.admitOnce.Do(func() {})
+		if conn.admitted {
+			conn.limiter.release(conn.clientAddr)
+		}
+	})
+	return conn.Conn.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestTCPConnLimiter(t *testing.T) {
+	c := check.T(t)
+	c.Nil(NewTCPConnLimiter(0, 0))
+
+	limiter := NewTCPConnLimiter(3, 2)
+	client1 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	client1b := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1001}
+	client2 := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+	client3 := &net.TCPAddr{IP: net.ParseIP("192.0.2.3"), Port: 1000}
+	c.True(limiter.acquire(client1))
+	c.True(limiter.acquire(client1b))
+	c.False(limiter.acquire(client1))
+	c.True(limiter.acquire(client2))
+	c.False(limiter.acquire(client3))
+	limiter.release(client1b)
+	c.True(limiter.acquire(client3))
+	c.False(limiter.acquire(client1))
+	limiter.release(client2)
+	c.True(limiter.acquire(client1))
+	c.Len(limiter.counts, 2)
+}
+
+type remoteAddrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (conn *remoteAddrConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func TestTCPLimitedConn(t *testing.T) {
+	c := check.T(t)
+	limiter := NewTCPConnLimiter(0, 1)
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	newConn := func() *tcpLimitedConn {
+		conn, peer := net.Pipe()
+		t.Cleanup(func() { peer.Close() })
+		go func() { _, _ = peer.Write([]byte{0}) }()
+		return &tcpLimitedConn{Conn: &remoteAddrConn{Conn: conn, remoteAddr: client}, limiter: limiter}
+	}
+
+	// Connections only take a slot when they are used
+	unused := newConn()
+	conn1, conn2 := newConn(), newConn()
+	_, err := conn1.Read(make([]byte, 1))
+	c.Nil(err)
+	_, err = conn2.Read(make([]byte, 1))
+	c.Err(err, ErrTooManyTCPConnections)
+	c.Nil(unused.Close())
+	c.Nil(conn2.Close())
+	c.EQ(limiter.counts[clientIPKey(client)], uint32(1))
+	c.Nil(conn1.Close())
+	c.Len(limiter.counts, 0)
+}
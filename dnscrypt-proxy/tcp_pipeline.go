@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const TCPPipelineIdleTimeout = 10 * time.Second
+
+// TCPPipeline sends queries over a persistent TCP connection without waiting for previous responses (RFC 7766).
+// Responses can be received in any order, and are matched to queries using a key computed by `keyOf`:
+// the transaction ID for plain DNS, the client nonce for DNSCrypt.
+type TCPPipeline struct {
+	sync.Mutex
+	dial  func() (net.Conn, error)
+	keyOf func(packet []byte) (string, bool)
+	conn  *pipelinedConn
+}
+
+type pipelinedConn struct {
+	sync.Mutex
+	conn      net.Conn
+	writeLock sync.Mutex
+	pending   map[string]chan []byte
+	done      chan struct{}
+	err       error
+}
+
+func NewTCPPipeline(dial func() (net.Conn, error), keyOf func(packet []byte) (string, bool)) *TCPPipeline {
+	return &TCPPipeline{dial: dial, keyOf: keyOf}
+}
+
+func (pipeline *TCPPipeline) getConn() (*pipelinedConn, bool, error) {
+	pipeline.Lock()
+	defer pipeline.Unlock()
+	if pipeline.conn != nil {
+		select {
+		case <-pipeline.conn.done:
+			pipeline.conn = nil
+		default:
+			return pipeline.conn, true, nil
+		}
+	}
+	conn, err := pipeline.dial()
+	if err != nil {
+		return nil, false, err
+	}
+	pc := &pipelinedConn{conn: conn, pending: make(map[string]chan []byte), done: make(chan struct{})}
+	go pc.readResponses(pipeline.keyOf)
+	pipeline.conn = pc
+	return pc, false, nil
+}
+
+// Exchange sends a query, whose key is `key`, and waits for the matching response
+func (pipeline *TCPPipeline) Exchange(query []byte, key string, timeout time.Duration) ([]byte, error) {
+	prefixedQuery, err := PrefixWithSize(append([]byte{}, query...))
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for attempt := 0; attempt < 2; attempt++ {
+		pc, reused, err := pipeline.getConn()
+		if err != nil {
+			return nil, err
+		}
+		response, err := pc.exchange(prefixedQuery, key, deadline)
+		if err == nil {
+			return response, nil
+		}
+		var neterr net.Error
+		if errors.As(err, &neterr) && neterr.Timeout() {
+			return nil, err
+		}
+		// The server may have closed an idle connection; retry once over a new one
+		if !reused || time.Now().After(deadline) {
+			return nil, err
+		}
+		dlog.Debugf("Reused pipelined TCP connection failed, reconnecting: [%v]", err)
+	}
+	return nil, errors.New("Unable to send the query over TCP")
+}
+
+func (pc *pipelinedConn) exchange(prefixedQuery []byte, key string, deadline time.Time) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	pc.Lock()
+	if pc.err != nil {
+		pc.Unlock()
+		return nil, pc.err
+	}
+	if _, found := pc.pending[key]; found {
+		pc.Unlock()
+		return nil, errors.New("Duplicate query key in the TCP pipeline")
+	}
+	pc.pending[key] = ch
+	pc.Unlock()
+	defer func() {
+		pc.Lock()
+		delete(pc.pending, key)
+		pc.Unlock()
+	}()
+
+	pc.writeLock.Lock()
+	_ = pc.conn.SetWriteDeadline(deadline)
+	_, err := pc.conn.Write(prefixedQuery)
+	pc.writeLock.Unlock()
+	if err != nil {
+		pc.close(err)
+		return nil, err
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case response := <-ch:
+		return response, nil
+	case <-pc.done:
+		return nil, pc.err
+	case <-timer.C:
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: context.DeadlineExceeded}
+	}
+}
+
+func (pc *pipelinedConn) readResponses(keyOf func(packet []byte) (string, bool)) {
+	reader := bufio.NewReader(pc.conn)
+	for {
+		_ = pc.conn.SetReadDeadline(time.Now().Add(TCPPipelineIdleTimeout))
+		var lengthPrefix [2]byte
+		if n, err := io.ReadFull(reader, lengthPrefix[:]); err != nil {
+			// Keep waiting if queries are still pending, close the connection if it is idle
+			var neterr net.Error
+			if n == 0 && errors.As(err, &neterr) && neterr.Timeout() && pc.hasPending() {
+				continue
+			}
+			pc.close(err)
+			return
+		}
+		length := int(binary.BigEndian.Uint16(lengthPrefix[:]))
+		if length < MinDNSPacketSize || length > MaxDNSPacketSize {
+			pc.close(errors.New("Invalid response length"))
+			return
+		}
+		response := make([]byte, length)
+		if _, err := io.ReadFull(reader, response); err != nil {
+			pc.close(err)
+			return
+		}
+		key, ok := keyOf(response)
+		if !ok {
+			continue
+		}
+		pc.Lock()
+		ch, found := pc.pending[key]
+		pc.Unlock()
+		if found {
+			select {
+			case ch <- response:
+			default:
+			}
+		}
+	}
+}
+
+func (pc *pipelinedConn) hasPending() bool {
+	pc.Lock()
+	defer pc.Unlock()
+	return len(pc.pending) > 0
+}
+
+func (pc *pipelinedConn) close(err error) {
+	pc.Lock()
+	defer pc.Unlock()
+	if pc.err != nil {
+		return
+	}
+	if err == nil || errors.Is(err, io.EOF) {
+		err = errors.New("Connection closed by the server")
+	}
+	pc.err = err
+	pc.conn.Close()
+	close(pc.done)
+}
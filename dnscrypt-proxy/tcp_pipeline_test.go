@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestTCPPipelineOutOfOrder(t *testing.T) {
+	c := check.T(t)
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		queries := make([][]byte, 0, 2)
+		for len(queries) < 2 {
+			var lengthPrefix [2]byte
+			if _, err := io.ReadFull(server, lengthPrefix[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(lengthPrefix[:]))
+			if _, err := io.ReadFull(server, query); err != nil {
+				return
+			}
+			queries = append(queries, query)
+		}
+		// Respond in reverse order
+		for i := len(queries) - 1; i >= 0; i-- {
+			response, _ := PrefixWithSize(queries[i])
+			if _, err := server.Write(response); err != nil {
+				return
+			}
+		}
+	}()
+	pipeline := NewTCPPipeline(func() (net.Conn, error) {
+		return client, nil
+	}, func(packet []byte) (string, bool) {
+		return string(packet[0:2]), true
+	})
+	queries := [][]byte{make([]byte, MinDNSPacketSize), make([]byte, MinDNSPacketSize)}
+	queries[0][0], queries[1][0] = 1, 2
+	matched := make(chan bool, 2)
+	for _, query := range queries {
+		go func(query []byte) {
+			response, err := pipeline.Exchange(query, string(query[0:2]), time.Second)
+			matched <- err == nil && len(response) == MinDNSPacketSize && response[0] == query[0]
+		}(query)
+	}
+	for range queries {
+		c.True(<-matched)
+	}
+}
+
+func TestPlainTCPPipelineSameTransactionID(t *testing.T) {
+	c := check.T(t)
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		for {
+			var lengthPrefix [2]byte
+			if _, err := io.ReadFull(server, lengthPrefix[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(lengthPrefix[:]))
+			if _, err := io.ReadFull(server, query); err != nil {
+				return
+			}
+			response, _ := PrefixWithSize(query)
+			if _, err := server.Write(response); err != nil {
+				return
+			}
+		}
+	}()
+	pipeline := newPlainTCPPipeline(&Proxy{timeout: time.Second}, &net.TCPAddr{})
+	pipeline.dial = func() (net.Conn, error) {
+		return client, nil
+	}
+	queries := [][]byte{make([]byte, MinDNSPacketSize), make([]byte, MinDNSPacketSize)}
+	for i, query := range queries {
+		SetTransactionID(query, 0x1234)
+		query[MinDNSPacketSize-1] = byte(i)
+	}
+	matched := make(chan bool, 2)
+	for _, query := range queries {
+		go func(query []byte) {
+			response, err := exchangeOverPlainTCPPipeline(pipeline, query, time.Second)
+			matched <- err == nil && TransactionID(response) == 0x1234 &&
+				response[MinDNSPacketSize-1] == query[MinDNSPacketSize-1]
+		}(query)
+	}
+	for range queries {
+		c.True(<-matched)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	crypto_rand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	TracerQueueSize     = 1024
+	TracerMaxBatchSize  = 256
+	TracerFlushInterval = 5 * time.Second
+)
+
+type traceSpan struct {
+	name       string
+	spanID     [8]byte
+	parent     int
+	start      time.Time
+	end        time.Time
+	attributes [][2]string
+}
+
+// QueryTrace records the spans of a single query.
+// A nil trace records nothing, so that call sites don't have to check whether tracing is enabled.
+type QueryTrace struct {
+	traceID [16]byte
+	spans   []traceSpan
+}
+
+// StartSpan opens a new span, and returns its index. The root span has index 0.
+func (trace *QueryTrace) StartSpan(name string, parent int) int {
+	if trace == nil {
+		return -1
+	}
+	span := traceSpan{name: name, parent: parent, start: time.Now()}
+	_, _ = crypto_rand.Read(span.spanID[:])
+	trace.spans = append(trace.spans, span)
+	return len(trace.spans) - 1
+}
+
+func (trace *QueryTrace) EndSpan(index int) {
+	if trace == nil || index < 0 || index >= len(trace.spans) {
+		return
+	}
+	if trace.spans[index].end.IsZero() {
+		trace.spans[index].end = time.Now()
+	}
+}
+
+func (trace *QueryTrace) SetAttribute(index int, key string, value string) {
+	if trace == nil || index < 0 || index >= len(trace.spans) {
+		return
+	}
+	trace.spans[index].attributes = append(trace.spans[index].attributes, [2]string{key, value})
+}
+
+// Tracer samples queries and exports their traces to an OpenTelemetry collector,
+// using the OTLP/HTTP protocol with JSON encoding.
+type Tracer struct {
+	endpoint    string
+	serviceName string
+	sampleRatio float64
+	queue       chan *QueryTrace
+	httpClient  *http.Client
+}
+
+func NewTracer(endpoint string, serviceName string, sampleRatio float64) (*Tracer, error) {
+	if len(endpoint) == 0 {
+		return nil, errors.New("Tracing requires an OTLP endpoint")
+	}
+	if sampleRatio <= 0.0 || sampleRatio > 1.0 {
+		return nil, errors.New("Tracing sample ratio must be between 0 and 1")
+	}
+	tracer := &Tracer{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		sampleRatio: sampleRatio,
+		queue:       make(chan *QueryTrace, TracerQueueSize),
+		httpClient:  &http.Client{Timeout: 10 * time.Second},
+	}
+	go tracer.exportLoop()
+	return tracer, nil
+}
+
+// NewTrace starts a trace with a root span, or returns nil if the query is not sampled
+func (tracer *Tracer) NewTrace(name string, start time.Time) *QueryTrace {
+	if tracer == nil || (tracer.sampleRatio < 1.0 && rand.Float64() >= tracer.sampleRatio) {
+		return nil
+	}
+	trace := &QueryTrace{}
+	_, _ = crypto_rand.Read(trace.traceID[:])
+	trace.StartSpan(name, -1)
+	trace.spans[0].start = start
+	return trace
+}
+
+// Finish closes the spans that are still open and queues the trace for export
+func (tracer *Tracer) Finish(trace *QueryTrace) {
+	if tracer == nil || trace == nil {
+		return
+	}
+	now := time.Now()
+	for i := range trace.spans {
+		if trace.spans[i].end.IsZero() {
+			trace.spans[i].end = now
+		}
+	}
+	select {
+	case tracer.queue <- trace:
+	default:
+		dlog.Debug("Tracing queue is full - Dropping trace")
+	}
+}
+
+func (tracer *Tracer) exportLoop() {
+	ticker := time.NewTicker(TracerFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*QueryTrace, 0, TracerMaxBatchSize)
+	for {
+		select {
+		case trace := <-tracer.queue:
+			batch = append(batch, trace)
+			if len(batch) < TracerMaxBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := tracer.export(batch); err != nil {
+			dlog.Warnf("Unable to export traces to [%s]: [%v]", tracer.endpoint, err)
+		}
+		batch = batch[:0]
+	}
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+)
+
+func (tracer *Tracer) export(batch []*QueryTrace) error {
+	scopeSpans := otlpScopeSpans{}
+	scopeSpans.Scope.Name = "dnscrypt-proxy"
+	for _, trace := range batch {
+		traceID := hex.EncodeToString(trace.traceID[:])
+		for i, span := range trace.spans {
+			exported := otlpSpan{
+				TraceID:           traceID,
+				SpanID:            hex.EncodeToString(span.spanID[:]),
+				Name:              span.name,
+				Kind:              otlpSpanKindInternal,
+				StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+				EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			}
+			if i == 0 {
+				exported.Kind = otlpSpanKindServer
+			}
+			if span.parent >= 0 && span.parent < len(trace.spans) {
+				exported.ParentSpanID = hex.EncodeToString(trace.spans[span.parent].spanID[:])
+			}
+			for _, attribute := range span.attributes {
+				exported.Attributes = append(exported.Attributes, otlpKeyValue{Key: attribute[0], Value: otlpAnyValue{StringValue: attribute[1]}})
+			}
+			scopeSpans.Spans = append(scopeSpans.Spans, exported)
+		}
+	}
+	resourceSpans := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scopeSpans}}
+	resourceSpans.Resource.Attributes = []otlpKeyValue{
+		{Key: "service.name", Value: otlpAnyValue{StringValue: tracer.serviceName}},
+		{Key: "service.version", Value: otlpAnyValue{StringValue: AppVersion}},
+	}
+	body, err := json.Marshal(otlpTracesRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}})
+	if err != nil {
+		return err
+	}
+	resp, err := tracer.httpClient.Post(tracer.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New(resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// transparentConn is implemented by connections from clients whose queries were redirected to a transparent listener
+type transparentConn interface {
+	// OriginalDestination returns the address the client sent its query to, or nil if it is unknown
+	OriginalDestination() net.Addr
+}
+
+// addTransparentListener listens to plain DNS queries redirected by the firewall, e.g. with an nftables TPROXY rule
+func (proxy *Proxy) addTransparentListener(listenAddrStr string) {
+	udp := "udp"
+	tcp := "tcp"
+	isIPv4 := isDigit(listenAddrStr[0])
+	if isIPv4 {
+		udp = "udp4"
+		tcp = "tcp4"
+	}
+	udpListenConfig, err := proxy.udpListenerConfig()
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	udpListenConfig = proxy.bindListenConfig(udpListenConfig)
+	if err := setTransparent(udpListenConfig); err != nil {
+		dlog.Fatal(err)
+	}
+	clientPc, err := udpListenConfig.ListenPacket(context.Background(), udp, listenAddrStr)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	proxy.transparentUDPListeners = append(proxy.transparentUDPListeners, clientPc.(*net.UDPConn))
+	dlog.Noticef("Now listening to %v [UDP, transparent]", listenAddrStr)
+
+	tcpListenConfig, err := proxy.tcpListenerConfig()
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	tcpListenConfig = proxy.bindListenConfig(tcpListenConfig)
+	if err := setTransparent(tcpListenConfig); err != nil {
+		dlog.Fatal(err)
+	}
+	acceptPc, err := tcpListenConfig.Listen(context.Background(), tcp, listenAddrStr)
+	if err != nil {
+		dlog.Fatal(err)
+	}
+	proxy.transparentTCPListeners = append(proxy.transparentTCPListeners, acceptPc.(*net.TCPListener))
+	dlog.Noticef("Now listening to %v [TCP, transparent]", listenAddrStr)
+}
+
+func (proxy *Proxy) transparentUDPListener(clientPc *net.UDPConn) {
+	defer clientPc.Close()
+	oob := make([]byte, transparentOOBSize)
+	for {
+		buffer := getPacketBuffer()
+		length, clientAddr, origDst, err := readFromTransparentUDP(clientPc, (*buffer)[:MaxDNSPacketSize-1], oob)
+		if err != nil {
+			putPacketBuffer(buffer)
+			return
+		}
+		proxy.handleUDPQuery((*buffer)[:length], buffer, clientAddr, &transparentUDPConn{UDPConn: clientPc, origDst: origDst}, time.Now())
+	}
+}
+
+func (proxy *Proxy) transparentTCPListener(acceptPc *net.TCPListener) {
+	defer acceptPc.Close()
+	listener := proxy.tcpConnLimiter.Wrap(acceptPc)
+	for {
+		clientPc, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		proxy.acceptTCPClient(&transparentTCPConn{Conn: clientPc, listenAddr: acceptPc.Addr()})
+	}
+}
+
+// transparentUDPConn sends responses from the address the query was originally sent to, so that
+// clients accept them
+type transparentUDPConn struct {
+	*net.UDPConn
+	origDst *net.UDPAddr
+}
+
+func (conn *transparentUDPConn) OriginalDestination() net.Addr {
+	if conn.origDst == nil {
+		return nil
+	}
+	return conn.origDst
+}
+
+func (conn *transparentUDPConn) WriteTo(packet []byte, addr net.Addr) (int, error) {
+	if conn.origDst == nil || conn.isListenerAddr(conn.origDst) {
+		return conn.UDPConn.WriteTo(packet, addr)
+	}
+	replyPc, err := listenTransparentUDP(conn.origDst)
+	if err != nil {
+		return 0, err
+	}
+	defer replyPc.Close()
+	return replyPc.WriteTo(packet, addr)
+}
+
+// isListenerAddr returns true if a query was not redirected, but directly sent to the listener
+func (conn *transparentUDPConn) isListenerAddr(addr *net.UDPAddr) bool {
+	listenAddr, ok := conn.UDPConn.LocalAddr().(*net.UDPAddr)
+	return ok && listenAddr.Port == addr.Port && (listenAddr.IP.IsUnspecified() || listenAddr.IP.Equal(addr.IP))
+}
+
+// transparentTCPConn reports the listener address as its local address, so that per-listener
+// settings apply; the original destination is the actual local address of the connection
+type transparentTCPConn struct {
+	net.Conn
+	listenAddr net.Addr
+}
+
+func (conn *transparentTCPConn) LocalAddr() net.Addr {
+	return conn.listenAddr
+}
+
+func (conn *transparentTCPConn) OriginalDestination() net.Addr {
+	return conn.Conn.LocalAddr()
+}
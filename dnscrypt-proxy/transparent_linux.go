@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+var transparentOOBSize = unix.CmsgSpace(unix.SizeofSockaddrInet6)
+
+// setTransparent allows a socket to accept packets and connections for any destination address,
+// and to retrieve the original destination of UDP packets
+func setTransparent(listenConfig *net.ListenConfig) error {
+	control := listenConfig.Control
+	listenConfig.Control = func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = setTransparentSockopts(int(fd), network, true)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+	return nil
+}
+
+func setTransparentSockopts(fd int, network string, recvOrigDst bool) error {
+	if network == "udp4" || network == "tcp4" {
+		if err := unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1); err != nil {
+			return err
+		}
+		if recvOrigDst && network == "udp4" {
+			return unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+		}
+		return nil
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1); err != nil {
+		return err
+	}
+	if recvOrigDst && network == "udp6" {
+		if err := unix.SetsockoptInt(fd, unix.SOL_IPV6, unix.IPV6_RECVORIGDSTADDR, 1); err != nil {
+			return err
+		}
+		// Dual-stack sockets also receive IPv4 packets
+		_ = unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		_ = unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_RECVORIGDSTADDR, 1)
+	}
+	return nil
+}
+
+// readFromTransparentUDP reads a packet, along with the address it was originally sent to
+func readFromTransparentUDP(conn *net.UDPConn, buf []byte, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	length, oobLength, _, clientAddr, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobLength])
+	if err != nil {
+		return length, clientAddr, nil, nil
+	}
+	for _, msg := range msgs {
+		sa, err := unix.ParseOrigDstAddr(&msg)
+		if err != nil {
+			continue
+		}
+		switch sa := sa.(type) {
+		case *unix.SockaddrInet4:
+			return length, clientAddr, &net.UDPAddr{IP: net.IP(sa.Addr[:]).To16(), Port: sa.Port}, nil
+		case *unix.SockaddrInet6:
+			return length, clientAddr, &net.UDPAddr{IP: net.IP(sa.Addr[:]), Port: sa.Port}, nil
+		}
+	}
+	return length, clientAddr, nil, nil
+}
+
+// listenTransparentUDP creates a socket bound to a non-local address, to send a response from it
+func listenTransparentUDP(localAddr *net.UDPAddr) (*net.UDPConn, error) {
+	network := "udp6"
+	if localAddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	listenConfig := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr == nil {
+					sockErr = setTransparentSockopts(int(fd), network, false)
+				}
+			}); err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	pc, err := listenConfig.ListenPacket(context.Background(), network, localAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var transparentOOBSize = 0
+
+func setTransparent(listenConfig *net.ListenConfig) error {
+	return errors.New("Transparent listeners are only supported on Linux")
+}
+
+func readFromTransparentUDP(conn *net.UDPConn, buf []byte, oob []byte) (int, *net.UDPAddr, *net.UDPAddr, error) {
+	length, clientAddr, err := conn.ReadFromUDP(buf)
+	return length, clientAddr, nil, err
+}
+
+func listenTransparentUDP(localAddr *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, errors.New("Transparent listeners are only supported on Linux")
+}
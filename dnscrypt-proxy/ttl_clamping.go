@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// TTLRange is a minimum and a maximum TTL; a maximum of 0 means no maximum
+type TTLRange struct {
+	min uint32
+	max uint32
+}
+
+func (ttlRange TTLRange) isSet() bool {
+	return ttlRange.min > 0 || ttlRange.max > 0
+}
+
+func (ttlRange TTLRange) clamp(ttl uint32) uint32 {
+	if ttl < ttlRange.min {
+		ttl = ttlRange.min
+	}
+	if ttlRange.max > 0 && ttl > ttlRange.max {
+		ttl = ttlRange.max
+	}
+	return ttl
+}
+
+// TTLClamping adjusts the TTLs of the responses sent to clients, independently of the cache.
+// Responses forwarded by servers or served from the cache, responses from the cloaking rules and
+// synthesized responses for blocked queries each have their own range.
+type TTLClamping struct {
+	answers TTLRange
+	cloaked TTLRange
+	blocked TTLRange
+}
+
+// NewTTLClamping returns nil if no TTLs have to be changed
+func NewTTLClamping(config TTLClampingConfig) *TTLClamping {
+	clamping := TTLClamping{
+		answers: TTLRange{min: config.AnswersMinTTL, max: config.AnswersMaxTTL},
+		cloaked: TTLRange{min: config.CloakedMinTTL, max: config.CloakedMaxTTL},
+		blocked: TTLRange{min: config.BlockedMinTTL, max: config.BlockedMaxTTL},
+	}
+	if !clamping.answers.isSet() && !clamping.cloaked.isSet() && !clamping.blocked.isSet() {
+		return nil
+	}
+	return &clamping
+}
+
+func (clamping *TTLClamping) rangeFor(pluginsState *PluginsState) TTLRange {
+	switch {
+	case pluginsState.returnCode == PluginsReturnCodeReject || pluginsState.returnCode == PluginsReturnCodeSynth ||
+		pluginsState.action == PluginsActionReject:
+		return clamping.blocked
+	case pluginsState.returnCode == PluginsReturnCodeCloak:
+		return clamping.cloaked
+	}
+	return clamping.answers
+}
+
+// apply clamps the TTLs of all the records of a response, except the OPT record, in place
+func (clamping *TTLClamping) apply(pluginsState *PluginsState, response []byte) {
+	if clamping == nil {
+		return
+	}
+	ttlRange := clamping.rangeFor(pluginsState)
+	if !ttlRange.isSet() {
+		return
+	}
+	ttlOffsets, ok := wireTTLOffsets(response)
+	if !ok {
+		return
+	}
+	for _, offset := range ttlOffsets {
+		ttl := binary.BigEndian.Uint32(response[offset : offset+4])
+		binary.BigEndian.PutUint32(response[offset:offset+4], ttlRange.clamp(ttl))
+	}
+}
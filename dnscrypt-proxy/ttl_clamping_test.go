@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/powerman/check"
+)
+
+func TestTTLClamping(t *testing.T) {
+	c := check.T(t)
+	clamping := NewTTLClamping(TTLClampingConfig{AnswersMinTTL: 120, AnswersMaxTTL: 200, BlockedMaxTTL: 5})
+	c.NotNil(clamping)
+	c.Nil(NewTTLClamping(TTLClampingConfig{}))
+
+	packet, err := testCacheWireResponse().Pack()
+	c.Nil(err)
+	pluginsState := PluginsState{returnCode: PluginsReturnCodePass}
+	clamping.apply(&pluginsState, packet)
+	msg := dns.Msg{}
+	c.Nil(msg.Unpack(packet))
+	c.Equal(msg.Answer[0].Header().Ttl, uint32(200))
+	c.Equal(msg.Answer[1].Header().Ttl, uint32(120))
+
+	packet, err = testCacheWireResponse().Pack()
+	c.Nil(err)
+	pluginsState.returnCode = PluginsReturnCodeReject
+	clamping.apply(&pluginsState, packet)
+	c.Nil(msg.Unpack(packet))
+	c.Equal(msg.Answer[0].Header().Ttl, uint32(5))
+	c.Equal(msg.Answer[1].Header().Ttl, uint32(5))
+}
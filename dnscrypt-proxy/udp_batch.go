@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// batchPacketConn is implemented by both ipv4.PacketConn and ipv6.PacketConn.
+// On Linux, batches are read and written with a single recvmmsg/sendmmsg system call;
+// on other systems, messages are read and written one at a time.
+type batchPacketConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchPacketConn(conn *net.UDPConn) batchPacketConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		return ipv6.NewPacketConn(conn)
+	}
+	return ipv4.NewPacketConn(conn)
+}
+
+type batchResponse struct {
+	response []byte
+	addr     net.Addr
+}
+
+// batchUDPConn is a UDP listener whose responses are queued, so that they can be sent in batches.
+// `done` is closed when the listener stops, so that neither the writer nor in-flight queries block forever.
+type batchUDPConn struct {
+	*net.UDPConn
+	responses chan batchResponse
+	done      chan struct{}
+}
+
+func (conn *batchUDPConn) WriteTo(response []byte, addr net.Addr) (int, error) {
+	select {
+	case conn.responses <- batchResponse{response: response, addr: addr}:
+		return len(response), nil
+	case <-conn.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// writeBatches sends the queued responses. A batch is sent as soon as no more responses are immediately available,
+// so that batching never delays a response.
+func (conn *batchUDPConn) writeBatches(batchConn batchPacketConn, batchSize int) {
+	messages := make([]ipv4.Message, batchSize)
+	for {
+		count := 0
+		var first batchResponse
+		select {
+		case first = <-conn.responses:
+		case <-conn.done:
+			return
+		}
+		messages[count] = ipv4.Message{Buffers: [][]byte{first.response}, Addr: first.addr}
+		count++
+	drain:
+		for count < batchSize {
+			select {
+			case next := <-conn.responses:
+				messages[count] = ipv4.Message{Buffers: [][]byte{next.response}, Addr: next.addr}
+				count++
+			default:
+				break drain
+			}
+		}
+		for sent := 0; sent < count; {
+			n, err := batchConn.WriteBatch(messages[sent:count], 0)
+			sent += n
+			if err != nil {
+				// Skip the response that couldn't be sent, but not the following ones
+				if sent < count {
+					dlog.Debugf("Unable to send a response to [%v]: %v", messages[sent].Addr, err)
+				}
+				sent++
+			}
+		}
+		for i := 0; i < count; i++ {
+			messages[i] = ipv4.Message{}
+		}
+	}
+}
+
+// udpBatchListener is the same as udpListener, but reads queries and sends responses in batches
+func (proxy *Proxy) udpBatchListener(clientPc *net.UDPConn) {
+	defer clientPc.Close()
+	batchSize := proxy.udpBatchSize
+	batchConn := newBatchPacketConn(clientPc)
+	conn := &batchUDPConn{UDPConn: clientPc, responses: make(chan batchResponse, batchSize*4), done: make(chan struct{})}
+	defer close(conn.done)
+	go conn.writeBatches(batchConn, batchSize)
+	messages := make([]ipv4.Message, batchSize)
+	for i := range messages {
+		messages[i].Buffers = [][]byte{make([]byte, MaxDNSPacketSize-1)}
+	}
+	for {
+		count, err := batchConn.ReadBatch(messages, 0)
+		if err != nil {
+			return
+		}
+		start := time.Now()
+		for i := 0; i < count; i++ {
+			// Responses are sent asynchronously, so queries are copied out of the buffers reused for every batch
+			packet := append([]byte{}, messages[i].Buffers[0][:messages[i].N]...)
+			proxy.handleUDPQuery(packet, nil, messages[i].Addr, conn, start)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/powerman/check"
+)
+
+func TestUDPBatchWriter(t *testing.T) {
+	c := check.T(t)
+	serverPc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	c.Nil(err)
+	defer serverPc.Close()
+	clientPc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	c.Nil(err)
+	defer clientPc.Close()
+
+	conn := &batchUDPConn{UDPConn: serverPc, responses: make(chan batchResponse, 16), done: make(chan struct{})}
+	stopped := make(chan struct{})
+	go func() {
+		conn.writeBatches(newBatchPacketConn(serverPc), 4)
+		close(stopped)
+	}()
+	var packetConn net.PacketConn = conn
+	for i := 0; i < 10; i++ {
+		packetConn.WriteTo([]byte{byte(i)}, clientPc.LocalAddr())
+	}
+	c.Nil(clientPc.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	buffer := make([]byte, 16)
+	for i := 0; i < 10; i++ {
+		length, _, err := clientPc.ReadFrom(buffer)
+		c.Nil(err)
+		c.Equal(length, 1)
+		c.Equal(buffer[0], byte(i))
+	}
+
+	// Once the listener stops, the writer returns and responses are rejected instead of blocking
+	close(conn.done)
+	<-stopped
+	closedErrs := 0
+	for i := 0; i < 32; i++ {
+		if _, err := packetConn.WriteTo([]byte{0}, clientPc.LocalAddr()); err == net.ErrClosed {
+			closedErrs++
+		}
+	}
+	c.True(closedErrs >= 16)
+}
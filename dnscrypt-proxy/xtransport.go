@@ -4,6 +4,7 @@
 	"bytes"
 	"compress/gzip"
 	"context"
+	crypto_rand "crypto/rand"
 	"crypto/sha512"
 	"crypto/tls"
 	"crypto/x509"
@@ -40,7 +41,7 @@
 )
 
 type CachedIPItem struct {
-	ip         net.IP
+	ips        []net.IP
 	expiration *time.Time
 }
 
@@ -51,12 +52,18 @@ type CachedIPs struct {
 
 type AltSupport struct {
 	sync.RWMutex
-	cache map[string]uint16
+	cache         map[string]uint16
+	disabledUntil map[string]time.Time
 }
 
+// How long HTTP/2 is used after an HTTP/3 request failed
+const HTTP3FallbackDuration = 5 * time.Minute
+
 type XTransport struct {
 	transport                *http.Transport
 	h3Transport              *http3.RoundTripper
+	hostTransports           map[string]*http.Transport
+	hostH3Transports         map[string]*http3.RoundTripper
 	keepAlive                time.Duration
 	timeout                  time.Duration
 	cachedIPs                CachedIPs
@@ -69,10 +76,24 @@ type XTransport struct {
 	useIPv4                  bool
 	useIPv6                  bool
 	http3                    bool
+	http3Hosts               map[string]bool
 	tlsDisableSessionTickets bool
 	tlsCipherSuite           []uint16
+	tlsPostQuantum           bool
+	tlsSessionCache          tls.ClientSessionCache
 	proxyDialer              *netproxy.Dialer
+	proxyURL                 *url.URL
+	isolatedDialers          *IsolatedDialers
 	httpProxyFunction        func(*http.Request) (*url.URL, error)
+	hostProxies              map[string]*HostProxy
+	hostTLS                  map[string]*HostTLS
+	hostHeaders              map[string]map[string]string
+	dohMethod                string
+	dohMethods               map[string]string
+	dohTemplates             map[string]*DoHTemplate
+	tlsClientConfig          *tls.Config
+	ech                      ECHState
+	dohClient                DoHClientConfig
 	tlsClientCreds           DOHClientCreds
 	keyLogWriter             io.Writer
 }
@@ -83,7 +104,14 @@ func NewXTransport() *XTransport {
 	}
 	xTransport := XTransport{
 		cachedIPs:                CachedIPs{cache: make(map[string]*CachedIPItem)},
-		altSupport:               AltSupport{cache: make(map[string]uint16)},
+		altSupport:               AltSupport{cache: make(map[string]uint16), disabledUntil: make(map[string]time.Time)},
+		http3Hosts:               make(map[string]bool),
+		hostProxies:              make(map[string]*HostProxy),
+		hostTLS:                  make(map[string]*HostTLS),
+		hostHeaders:              make(map[string]map[string]string),
+		dohMethods:               make(map[string]string),
+		dohTemplates:             make(map[string]*DoHTemplate),
+		ech:                      NewECHState(),
 		keepAlive:                DefaultKeepAlive,
 		timeout:                  DefaultTimeout,
 		bootstrapResolvers:       []string{DefaultBootstrapResolver},
@@ -98,6 +126,103 @@ func NewXTransport() *XTransport {
 	return &xTransport
 }
 
+// HostProxy overrides the global proxy settings for a single server.
+// A nil dialer or HTTP proxy function means that connections are direct.
+type HostProxy struct {
+	proxyDialer       *netproxy.Dialer
+	proxyURL          *url.URL
+	httpProxyFunction func(*http.Request) (*url.URL, error)
+}
+
+// IsolatedDialers keeps a SOCKS dialer with distinct credentials for every host.
+// Tor uses different circuits for streams with different SOCKS credentials (IsolateSOCKSAuth),
+// so that queries sent to different servers can't be correlated by exit nodes.
+type IsolatedDialers struct {
+	sync.Mutex
+	password string
+	dialers  map[string]*netproxy.Dialer
+}
+
+func NewIsolatedDialers() *IsolatedDialers {
+	var password [16]byte
+	_, _ = crypto_rand.Read(password[:])
+	return &IsolatedDialers{password: hex.EncodeToString(password[:]), dialers: make(map[string]*netproxy.Dialer)}
+}
+
+func (isolatedDialers *IsolatedDialers) get(key string, proxyURL *url.URL, proxyDialer *netproxy.Dialer) *netproxy.Dialer {
+	isolatedDialers.Lock()
+	defer isolatedDialers.Unlock()
+	if isolatedDialer, ok := isolatedDialers.dialers[key]; ok {
+		return isolatedDialer
+	}
+	isolatedURL := *proxyURL
+	isolatedURL.User = url.UserPassword(key, isolatedDialers.password)
+	isolatedDialer, err := netproxy.FromURL(&isolatedURL, netproxy.Direct)
+	if err != nil {
+		dlog.Warnf("Unable to create an isolated proxy dialer for [%s]: [%v]", key, err)
+		return proxyDialer
+	}
+	isolatedDialers.dialers[key] = &isolatedDialer
+	return &isolatedDialer
+}
+
+func hostProxyKey(host string) string {
+	if ip := ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+func (xTransport *XTransport) SetHostHeaders(host string, headers map[string]string) {
+	xTransport.hostHeaders[hostProxyKey(host)] = headers
+}
+
+func (xTransport *XTransport) SetHostProxy(host string, hostProxy *HostProxy) {
+	xTransport.hostProxies[hostProxyKey(host)] = hostProxy
+}
+
+// dialerFor returns the proxy dialer to use to connect to a host, or nil for direct connections
+func (xTransport *XTransport) dialerFor(host string) *netproxy.Dialer {
+	key := hostProxyKey(host)
+	proxyDialer, proxyURL := xTransport.proxyDialer, xTransport.proxyURL
+	if hostProxy, ok := xTransport.hostProxies[key]; ok {
+		proxyDialer, proxyURL = hostProxy.proxyDialer, hostProxy.proxyURL
+	}
+	if proxyDialer == nil || xTransport.isolatedDialers == nil || proxyURL == nil || proxyURL.User != nil ||
+		(proxyURL.Scheme != "socks5" && proxyURL.Scheme != "socks5h") {
+		return proxyDialer
+	}
+	return xTransport.isolatedDialers.get(key, proxyURL, proxyDialer)
+}
+
+func (xTransport *XTransport) httpProxyFor(req *http.Request) (*url.URL, error) {
+	httpProxyFunction := xTransport.httpProxyFunction
+	if hostProxy, ok := xTransport.hostProxies[hostProxyKey(req.URL.Hostname())]; ok {
+		httpProxyFunction = hostProxy.httpProxyFunction
+	}
+	if httpProxyFunction == nil {
+		return nil, nil
+	}
+	return httpProxyFunction(req)
+}
+
+// proxied returns true if connections to a host go through a proxy, that resolves names by itself
+func (xTransport *XTransport) proxied(host string) bool {
+	if hostProxy, ok := xTransport.hostProxies[hostProxyKey(host)]; ok {
+		return hostProxy.proxyDialer != nil || hostProxy.httpProxyFunction != nil
+	}
+	return xTransport.proxyDialer != nil || xTransport.httpProxyFunction != nil
+}
+
+// curvePreferences returns the key exchanges to offer. The hybrid X25519+ML-KEM-768 post-quantum key exchange
+// is only offered if it was enabled; servers that don't support it can still negotiate X25519.
+func (xTransport *XTransport) curvePreferences() []tls.CurveID {
+	if !xTransport.tlsPostQuantum {
+		return []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384}
+	}
+	return []tls.CurveID{tls.X25519MLKEM768, tls.X25519, tls.CurveP256, tls.CurveP384}
+}
+
 func ParseIP(ipStr string) net.IP {
 	return net.ParseIP(strings.TrimRight(strings.TrimLeft(ipStr, "["), "]"))
 }
@@ -105,7 +230,16 @@ func ParseIP(ipStr string) net.IP {
 // If ttl < 0, never expire
 // Otherwise, ttl is set to max(ttl, MinResolverIPTTL)
 func (xTransport *XTransport) saveCachedIP(host string, ip net.IP, ttl time.Duration) {
-	item := &CachedIPItem{ip: ip, expiration: nil}
+	ips := []net.IP{}
+	if ip != nil {
+		ips = append(ips, ip)
+	}
+	xTransport.saveCachedIPs(host, ips, ttl)
+}
+
+// saveCachedIPs stores the addresses of a host, the preferred one first
+func (xTransport *XTransport) saveCachedIPs(host string, ips []net.IP, ttl time.Duration) {
+	item := &CachedIPItem{ips: ips, expiration: nil}
 	if ttl >= 0 {
 		if ttl < MinResolverIPTTL {
 			ttl = MinResolverIPTTL
@@ -118,15 +252,30 @@ func (xTransport *XTransport) saveCachedIP(host string, ip net.IP, ttl time.Dura
 	xTransport.cachedIPs.Unlock()
 }
 
+// loadCachedIP returns the address used by dials that don't race address families, such as DoQ and HTTP/3 dials.
+// IPv4 addresses are preferred, as they were before IPv4 and IPv6 connections could be raced.
 func (xTransport *XTransport) loadCachedIP(host string) (ip net.IP, expired bool) {
-	ip, expired = nil, false
+	ips, expired := xTransport.loadCachedIPs(host)
+	for _, cachedIP := range ips {
+		if cachedIP.To4() != nil {
+			return cachedIP, expired
+		}
+	}
+	if len(ips) > 0 {
+		ip = ips[0]
+	}
+	return
+}
+
+func (xTransport *XTransport) loadCachedIPs(host string) (ips []net.IP, expired bool) {
+	ips, expired = nil, false
 	xTransport.cachedIPs.RLock()
 	item, ok := xTransport.cachedIPs.cache[host]
 	xTransport.cachedIPs.RUnlock()
 	if !ok {
 		return
 	}
-	ip = item.ip
+	ips = item.ips
 	expiration := item.expiration
 	if expiration != nil && time.Until(*expiration) < 0 {
 		expired = true
@@ -139,45 +288,9 @@ func (xTransport *XTransport) rebuildTransport() {
 	if xTransport.transport != nil {
 		xTransport.transport.CloseIdleConnections()
 	}
-	timeout := xTransport.timeout
-	transport := &http.Transport{
-		DisableKeepAlives:      false,
-		DisableCompression:     true,
-		MaxIdleConns:           1,
-		IdleConnTimeout:        xTransport.keepAlive,
-		ResponseHeaderTimeout:  timeout,
-		ExpectContinueTimeout:  timeout,
-		MaxResponseHeaderBytes: 4096,
-		DialContext: func(ctx context.Context, network, addrStr string) (net.Conn, error) {
-			host, port := ExtractHostAndPort(addrStr, stamps.DefaultPort)
-			ipOnly := host
-			// resolveAndUpdateCache() is always called in `Fetch()` before the `Dial()`
-			// method is used, so that a cached entry must be present at this point.
-			cachedIP, _ := xTransport.loadCachedIP(host)
-			if cachedIP != nil {
-				if ipv4 := cachedIP.To4(); ipv4 != nil {
-					ipOnly = ipv4.String()
-				} else {
-					ipOnly = "[" + cachedIP.String() + "]"
-				}
-			} else {
-				dlog.Debugf("[%s] IP address was not cached in DialContext", host)
-			}
-			addrStr = ipOnly + ":" + strconv.Itoa(port)
-			if xTransport.proxyDialer == nil {
-				dialer := &net.Dialer{Timeout: timeout, KeepAlive: timeout, DualStack: true}
-				return dialer.DialContext(ctx, network, addrStr)
-			}
-			return (*xTransport.proxyDialer).Dial(network, addrStr)
-		},
-	}
-	if xTransport.httpProxyFunction != nil {
-		transport.Proxy = xTransport.httpProxyFunction
-	}
-
 	clientCreds := xTransport.tlsClientCreds
 
-	tlsClientConfig := tls.Config{}
+	tlsClientConfig := tls.Config{CurvePreferences: xTransport.curvePreferences()}
 	certPool, certPoolErr := x509.SystemCertPool()
 
 	if xTransport.keyLogWriter != nil {
@@ -217,9 +330,12 @@ func (xTransport *XTransport) rebuildTransport() {
 		tlsClientConfig.Certificates = []tls.Certificate{cert}
 	}
 
+	if xTransport.tlsSessionCache != nil && !xTransport.tlsDisableSessionTickets {
+		tlsClientConfig.ClientSessionCache = xTransport.tlsSessionCache
+	}
 	if xTransport.tlsDisableSessionTickets || xTransport.tlsCipherSuite != nil {
 		tlsClientConfig.SessionTicketsDisabled = xTransport.tlsDisableSessionTickets
-		if !xTransport.tlsDisableSessionTickets {
+		if !xTransport.tlsDisableSessionTickets && tlsClientConfig.ClientSessionCache == nil {
 			tlsClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(10)
 		}
 		if xTransport.tlsCipherSuite != nil {
@@ -247,140 +363,207 @@ func (xTransport *XTransport) rebuildTransport() {
 			}
 			if compatibleSuitesCount != len(tls.CipherSuites()) {
 				dlog.Notice("Explicit cipher suite configured - downgrading to TLS 1.2")
+				if xTransport.tlsPostQuantum {
+					dlog.Warn("Post-quantum key exchanges require TLS 1.3, and will not be used with DoH servers")
+				}
 				tlsClientConfig.MaxVersion = tls.VersionTLS12
 			}
 		}
 	}
-	transport.TLSClientConfig = &tlsClientConfig
-	if http2Transport, err := http2.ConfigureTransports(transport); err != nil {
-		http2Transport.ReadIdleTimeout = timeout
-		http2Transport.AllowHTTP = false
-	}
+	transport := xTransport.newHTTPTransport(&tlsClientConfig)
 	xTransport.transport = transport
-	if xTransport.http3 {
-		dial := func(ctx context.Context, addrStr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
-			dlog.Debugf("Dialing for H3: [%v]", addrStr)
+	xTransport.tlsClientConfig = &tlsClientConfig
+	xTransport.rebuildECHTransports()
+	if xTransport.http3 || len(xTransport.http3Hosts) > 0 {
+		xTransport.h3Transport = xTransport.newH3Transport(&tlsClientConfig)
+	}
+	xTransport.rebuildHostTransports()
+}
+
+func (xTransport *XTransport) newH3Transport(tlsClientConfig *tls.Config) *http3.RoundTripper {
+	return &http3.RoundTripper{DisableCompression: true, TLSClientConfig: tlsClientConfig, Dial: xTransport.dialH3}
+}
+
+func (xTransport *XTransport) dialH3(ctx context.Context, addrStr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	dlog.Debugf("Dialing for H3: [%v]", addrStr)
+	host, port := ExtractHostAndPort(addrStr, stamps.DefaultPort)
+	ipOnly := host
+	cachedIP, _ := xTransport.loadCachedIP(host)
+	network := "udp4"
+	if cachedIP != nil {
+		if ipv4 := cachedIP.To4(); ipv4 != nil {
+			ipOnly = ipv4.String()
+		} else {
+			ipOnly = "[" + cachedIP.String() + "]"
+			network = "udp6"
+		}
+	} else {
+		dlog.Debugf("[%s] IP address was not cached in H3 context", host)
+		if xTransport.useIPv6 {
+			if xTransport.useIPv4 {
+				network = "udp"
+			} else {
+				network = "udp6"
+			}
+		}
+	}
+	addrStr = ipOnly + ":" + strconv.Itoa(port)
+	udpAddr, err := net.ResolveUDPAddr(network, addrStr)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, err := listenOutboundUDP(network)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg.ServerName = host
+	return quic.DialEarly(ctx, udpConn, udpAddr, tlsCfg, cfg)
+}
+
+func (xTransport *XTransport) newHTTPTransport(tlsClientConfig *tls.Config) *http.Transport {
+	timeout := xTransport.timeout
+	idleTimeout := xTransport.keepAlive
+	if xTransport.dohClient.IdleTimeout > 0 {
+		idleTimeout = time.Duration(xTransport.dohClient.IdleTimeout) * time.Second
+	}
+	transport := &http.Transport{
+		DisableKeepAlives:      false,
+		DisableCompression:     true,
+		MaxIdleConns:           0,
+		MaxIdleConnsPerHost:    Max(1, xTransport.dohClient.MaxIdleConnsPerHost),
+		MaxConnsPerHost:        Max(0, xTransport.dohClient.MaxConnsPerHost),
+		IdleConnTimeout:        idleTimeout,
+		ResponseHeaderTimeout:  timeout,
+		ExpectContinueTimeout:  timeout,
+		MaxResponseHeaderBytes: 4096,
+		DialContext: func(ctx context.Context, network, addrStr string) (net.Conn, error) {
 			host, port := ExtractHostAndPort(addrStr, stamps.DefaultPort)
 			ipOnly := host
+			proxyDialer := xTransport.dialerFor(host)
+			// resolveAndUpdateCache() is always called in `Fetch()` before the `Dial()`
+			// method is used, so that a cached entry must be present at this point.
+			if cachedIPs, _ := xTransport.loadCachedIPs(host); len(cachedIPs) > 1 && proxyDialer == nil {
+				return xTransport.dialHappyEyeballs(ctx, network, host, port, timeout)
+			}
 			cachedIP, _ := xTransport.loadCachedIP(host)
-			network := "udp4"
 			if cachedIP != nil {
 				if ipv4 := cachedIP.To4(); ipv4 != nil {
 					ipOnly = ipv4.String()
 				} else {
 					ipOnly = "[" + cachedIP.String() + "]"
-					network = "udp6"
 				}
 			} else {
-				dlog.Debugf("[%s] IP address was not cached in H3 context", host)
-				if xTransport.useIPv6 {
-					if xTransport.useIPv4 {
-						network = "udp"
-					} else {
-						network = "udp6"
-					}
-				}
+				dlog.Debugf("[%s] IP address was not cached in DialContext", host)
 			}
 			addrStr = ipOnly + ":" + strconv.Itoa(port)
-			udpAddr, err := net.ResolveUDPAddr(network, addrStr)
-			if err != nil {
-				return nil, err
-			}
-			udpConn, err := net.ListenUDP(network, nil)
-			if err != nil {
-				return nil, err
+			if proxyDialer == nil {
+				return outboundDialer(timeout).DialContext(ctx, network, addrStr)
 			}
-			tlsCfg.ServerName = host
-			return quic.DialEarly(ctx, udpConn, udpAddr, tlsCfg, cfg)
+			return (*proxyDialer).Dial(network, addrStr)
+		},
+	}
+	if len(xTransport.hostProxies) > 0 {
+		transport.Proxy = xTransport.httpProxyFor
+	} else if xTransport.httpProxyFunction != nil {
+		transport.Proxy = xTransport.httpProxyFunction
+	}
+	transport.TLSClientConfig = tlsClientConfig
+	if http2Transport, err := http2.ConfigureTransports(transport); err == nil {
+		http2Transport.ReadIdleTimeout = timeout
+		if xTransport.dohClient.PingInterval > 0 {
+			http2Transport.ReadIdleTimeout = time.Duration(xTransport.dohClient.PingInterval) * time.Second
 		}
-		h3Transport := &http3.RoundTripper{DisableCompression: true, TLSClientConfig: &tlsClientConfig, Dial: dial}
-		xTransport.h3Transport = h3Transport
+		if xTransport.dohClient.PingTimeout > 0 {
+			http2Transport.PingTimeout = time.Duration(xTransport.dohClient.PingTimeout) * time.Second
+		}
+		http2Transport.StrictMaxConcurrentStreams = xTransport.dohClient.StrictMaxConcurrentStreams
+		http2Transport.AllowHTTP = false
+	} else {
+		dlog.Warnf("Unable to configure the HTTP/2 transport: [%v]", err)
+	}
+	return transport
+}
+
+// pickIPs keeps a random address of each enabled family, IPv6 first (RFC 8305)
+func (xTransport *XTransport) pickIPs(ipv4s []net.IP, ipv6s []net.IP) []net.IP {
+	ips := make([]net.IP, 0, 2)
+	if xTransport.useIPv6 && len(ipv6s) > 0 {
+		ips = append(ips, ipv6s[rand.Intn(len(ipv6s))])
+	}
+	if xTransport.useIPv4 && len(ipv4s) > 0 {
+		ips = append(ips, ipv4s[rand.Intn(len(ipv4s))])
 	}
+	return ips
 }
 
-func (xTransport *XTransport) resolveUsingSystem(host string) (ip net.IP, ttl time.Duration, err error) {
+func (xTransport *XTransport) resolveUsingSystem(host string) (ips []net.IP, ttl time.Duration, err error) {
 	ttl = SystemResolverIPTTL
 	var foundIPs []string
 	foundIPs, err = net.LookupHost(host)
 	if err != nil {
 		return
 	}
-	ips := make([]net.IP, 0)
+	ipv4s, ipv6s := make([]net.IP, 0), make([]net.IP, 0)
 	for _, ip := range foundIPs {
 		if foundIP := net.ParseIP(ip); foundIP != nil {
-			if xTransport.useIPv4 {
-				if ipv4 := foundIP.To4(); ipv4 != nil {
-					ips = append(ips, foundIP)
-				}
-			}
-			if xTransport.useIPv6 {
-				if ipv6 := foundIP.To16(); ipv6 != nil {
-					ips = append(ips, foundIP)
-				}
+			if foundIP.To4() != nil {
+				ipv4s = append(ipv4s, foundIP)
+			} else {
+				ipv6s = append(ipv6s, foundIP)
 			}
 		}
 	}
-	if len(ips) > 0 {
-		ip = ips[rand.Intn(len(ips))]
-	}
+	ips = xTransport.pickIPs(ipv4s, ipv6s)
 	return
 }
 
 func (xTransport *XTransport) resolveUsingResolver(
 	proto, host string,
 	resolver string,
-) (ip net.IP, ttl time.Duration, err error) {
-	dnsClient := dns.Client{Net: proto}
-	if xTransport.useIPv4 {
-		msg := dns.Msg{}
-		msg.SetQuestion(dns.Fqdn(host), dns.TypeA)
-		msg.SetEdns0(uint16(MaxDNSPacketSize), true)
-		var in *dns.Msg
-		if in, _, err = dnsClient.Exchange(&msg, resolver); err == nil {
-			answers := make([]dns.RR, 0)
-			for _, answer := range in.Answer {
-				if answer.Header().Rrtype == dns.TypeA {
-					answers = append(answers, answer)
-				}
-			}
-			if len(answers) > 0 {
-				answer := answers[rand.Intn(len(answers))]
-				ip = answer.(*dns.A).A
-				ttl = time.Duration(answer.Header().Ttl) * time.Second
-				return
-			}
+) (ips []net.IP, ttl time.Duration, err error) {
+	ipv4s, ipv6s := make([]net.IP, 0), make([]net.IP, 0)
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		if (qtype == dns.TypeA && !xTransport.useIPv4) || (qtype == dns.TypeAAAA && !xTransport.useIPv6) {
+			continue
 		}
-	}
-	if xTransport.useIPv6 {
 		msg := dns.Msg{}
-		msg.SetQuestion(dns.Fqdn(host), dns.TypeAAAA)
+		msg.SetQuestion(dns.Fqdn(host), qtype)
 		msg.SetEdns0(uint16(MaxDNSPacketSize), true)
-		var in *dns.Msg
-		if in, _, err = dnsClient.Exchange(&msg, resolver); err == nil {
-			answers := make([]dns.RR, 0)
-			for _, answer := range in.Answer {
-				if answer.Header().Rrtype == dns.TypeAAAA {
-					answers = append(answers, answer)
-				}
+		in, err := xTransport.exchangeWithBootstrapResolver(&msg, proto, resolver)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, answer := range in.Answer {
+			if answer.Header().Rrtype != qtype {
+				continue
+			}
+			switch answer := answer.(type) {
+			case *dns.A:
+				ipv4s = append(ipv4s, answer.A)
+			case *dns.AAAA:
+				ipv6s = append(ipv6s, answer.AAAA)
 			}
-			if len(answers) > 0 {
-				answer := answers[rand.Intn(len(answers))]
-				ip = answer.(*dns.AAAA).AAAA
-				ttl = time.Duration(answer.Header().Ttl) * time.Second
-				return
+			if answerTTL := time.Duration(answer.Header().Ttl) * time.Second; ttl == 0 || answerTTL < ttl {
+				ttl = answerTTL
 			}
 		}
 	}
+	ips = xTransport.pickIPs(ipv4s, ipv6s)
+	if len(ips) == 0 {
+		err = lastErr
+	}
 	return
 }
 
 func (xTransport *XTransport) resolveUsingResolvers(
 	proto, host string,
 	resolvers []string,
-) (ip net.IP, ttl time.Duration, err error) {
+) (ips []net.IP, ttl time.Duration, err error) {
 	err = errors.New("Empty resolvers")
 	for i, resolver := range resolvers {
-		ip, ttl, err = xTransport.resolveUsingResolver(proto, host, resolver)
+		ips, ttl, err = xTransport.resolveUsingResolver(proto, host, resolver)
 		if err == nil {
 			if i > 0 {
 				dlog.Infof("Resolution succeeded with resolver %s[%s]", proto, resolver)
@@ -395,17 +578,17 @@ func (xTransport *XTransport) resolveUsingResolvers(
 
 // If a name is not present in the cache, resolve the name and update the cache
 func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
-	if xTransport.proxyDialer != nil || xTransport.httpProxyFunction != nil {
+	if xTransport.proxied(host) {
 		return nil
 	}
 	if ParseIP(host) != nil {
 		return nil
 	}
-	cachedIP, expired := xTransport.loadCachedIP(host)
-	if cachedIP != nil && !expired {
+	cachedIPs, expired := xTransport.loadCachedIPs(host)
+	if len(cachedIPs) > 0 && !expired {
 		return nil
 	}
-	var foundIP net.IP
+	var foundIPs []net.IP
 	var ttl time.Duration
 	var err error
 	protos := []string{"udp", "tcp"}
@@ -415,7 +598,7 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 	if xTransport.ignoreSystemDNS {
 		if xTransport.internalResolverReady {
 			for _, proto := range protos {
-				foundIP, ttl, err = xTransport.resolveUsingResolvers(proto, host, xTransport.internalResolvers)
+				foundIPs, ttl, err = xTransport.resolveUsingResolvers(proto, host, xTransport.internalResolvers)
 				if err == nil {
 					break
 				}
@@ -425,7 +608,7 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 			dlog.Notice(err)
 		}
 	} else {
-		foundIP, ttl, err = xTransport.resolveUsingSystem(host)
+		foundIPs, ttl, err = xTransport.resolveUsingSystem(host)
 		if err != nil {
 			err = errors.New("System DNS is not usable yet")
 			dlog.Notice(err)
@@ -440,7 +623,7 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 					proto,
 				)
 			}
-			foundIP, ttl, err = xTransport.resolveUsingResolvers(proto, host, xTransport.bootstrapResolvers)
+			foundIPs, ttl, err = xTransport.resolveUsingResolvers(proto, host, xTransport.bootstrapResolvers)
 			if err == nil {
 				break
 			}
@@ -448,21 +631,21 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 	}
 	if err != nil && xTransport.ignoreSystemDNS {
 		dlog.Noticef("Bootstrap resolvers didn't respond - Trying with the system resolver as a last resort")
-		foundIP, ttl, err = xTransport.resolveUsingSystem(host)
+		foundIPs, ttl, err = xTransport.resolveUsingSystem(host)
 	}
 	if ttl < MinResolverIPTTL {
 		ttl = MinResolverIPTTL
 	}
 	if err != nil {
-		if cachedIP != nil {
+		if len(cachedIPs) > 0 {
 			dlog.Noticef("Using stale [%v] cached address for a grace period", host)
-			foundIP = cachedIP
+			foundIPs = cachedIPs
 			ttl = ExpiredCachedIPGraceTTL
 		} else {
 			return err
 		}
 	}
-	if foundIP == nil {
+	if len(foundIPs) == 0 {
 		if !xTransport.useIPv4 && xTransport.useIPv6 {
 			dlog.Warnf("no IPv6 address found for [%s]", host)
 		} else if xTransport.useIPv4 && !xTransport.useIPv6 {
@@ -471,8 +654,8 @@ func (xTransport *XTransport) resolveAndUpdateCache(host string) error {
 			dlog.Errorf("no IP address found for [%s]", host)
 		}
 	}
-	xTransport.saveCachedIP(host, foundIP, ttl)
-	dlog.Debugf("[%s] IP address [%s] added to the cache, valid for %v", host, foundIP, ttl)
+	xTransport.saveCachedIPs(host, foundIPs, ttl)
+	dlog.Debugf("[%s] IP addresses %v added to the cache, valid for %v", host, foundIPs, ttl)
 	return nil
 }
 
@@ -488,24 +671,33 @@ func (xTransport *XTransport) Fetch(
 	if timeout <= 0 {
 		timeout = xTransport.timeout
 	}
+	host, port := ExtractHostAndPort(url.Host, 443)
 	client := http.Client{
-		Transport: xTransport.transport,
+		Transport: xTransport.transportFor(host),
 		Timeout:   timeout,
 	}
-	host, port := ExtractHostAndPort(url.Host, 443)
-	hasAltSupport := false
+	hasAltSupport, useH3 := false, false
 	if xTransport.h3Transport != nil {
 		xTransport.altSupport.RLock()
 		var altPort uint16
 		altPort, hasAltSupport = xTransport.altSupport.cache[url.Host]
+		disabledUntil, disabled := xTransport.altSupport.disabledUntil[url.Host]
 		xTransport.altSupport.RUnlock()
-		if hasAltSupport {
-			if int(altPort) == port {
-				client.Transport = xTransport.h3Transport
-				dlog.Debugf("Using HTTP/3 transport for [%s]", url.Host)
-			}
+		useH3 = (hasAltSupport && int(altPort) == port) || xTransport.http3Hosts[url.Host]
+		if useH3 && ((disabled && time.Now().Before(disabledUntil)) || xTransport.proxied(host)) {
+			useH3 = false
+		}
+		if useH3 {
+			client.Transport = xTransport.h3TransportFor(host)
+			dlog.Debugf("Using HTTP/3 transport for [%s]", url.Host)
 		}
 	}
+	echTransport := xTransport.echTransportFor(host)
+	if echTransport != nil {
+		client.Transport = echTransport
+		useH3 = false
+		dlog.Debugf("Using ECH for [%s]", url.Host)
+	}
 	header := map[string][]string{"User-Agent": {"dnscrypt-proxy"}}
 	if len(accept) > 0 {
 		header["Accept"] = []string{accept}
@@ -514,6 +706,9 @@ func (xTransport *XTransport) Fetch(
 		header["Content-Type"] = []string{contentType}
 	}
 	header["Cache-Control"] = []string{"max-stale"}
+	for key, value := range xTransport.hostHeaders[hostProxyKey(host)] {
+		header[key] = []string{value}
+	}
 	if body != nil {
 		h := sha512.Sum512(*body)
 		qs := url.Query()
@@ -522,7 +717,7 @@ func (xTransport *XTransport) Fetch(
 		url2.RawQuery = qs.Encode()
 		url = &url2
 	}
-	if xTransport.proxyDialer == nil && strings.HasSuffix(host, ".onion") {
+	if xTransport.dialerFor(host) == nil && strings.HasSuffix(host, ".onion") {
 		return nil, 0, nil, 0, errors.New("Onion service is not reachable without Tor")
 	}
 	if err := xTransport.resolveAndUpdateCache(host); err != nil {
@@ -547,6 +742,26 @@ func (xTransport *XTransport) Fetch(
 	}
 	start := time.Now()
 	resp, err := client.Do(req)
+	if err != nil && useH3 {
+		dlog.Infof("HTTP/3 request to [%s] failed: [%v] - Falling back to HTTP/2", url.Host, err)
+		xTransport.altSupport.Lock()
+		xTransport.altSupport.disabledUntil[url.Host] = time.Now().Add(HTTP3FallbackDuration)
+		xTransport.altSupport.Unlock()
+		client.Transport = xTransport.transportFor(host)
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(*body))
+		}
+		start = time.Now()
+		resp, err = client.Do(req)
+	}
+	if err != nil && echTransport != nil && xTransport.echRetry(host, err) {
+		client.Transport = xTransport.echTransportFor(host)
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(*body))
+		}
+		start = time.Now()
+		resp, err = client.Do(req)
+	}
 	rtt := time.Since(start)
 	if err == nil {
 		if resp == nil {
@@ -556,7 +771,7 @@ func (xTransport *XTransport) Fetch(
 		}
 	} else {
 		dlog.Debugf("HTTP client error: [%v] - closing idle connections", err)
-		xTransport.transport.CloseIdleConnections()
+		xTransport.transportFor(host).CloseIdleConnections()
 	}
 	statusCode := 503
 	if resp != nil {
@@ -573,7 +788,7 @@ func (xTransport *XTransport) Fetch(
 		}
 		return nil, statusCode, nil, rtt, err
 	}
-	if xTransport.h3Transport != nil && !hasAltSupport {
+	if xTransport.http3 && !hasAltSupport {
 		if alt, found := resp.Header["Alt-Svc"]; found {
 			dlog.Debugf("Alt-Svc [%s]: [%s]", url.Host, alt)
 			altPort := uint16(port & 0xffff)
@@ -669,6 +884,22 @@ func (xTransport *XTransport) DoHQuery(
 	body []byte,
 	timeout time.Duration,
 ) ([]byte, int, *tls.ConnectionState, time.Duration, error) {
+	host, _ := ExtractHostAndPort(url.Host, 443)
+	if dohTemplate, ok := xTransport.dohTemplates[hostProxyKey(host)]; ok {
+		dataType := "application/dns-message"
+		if useGet {
+			templateURL, err := dohTemplate.Expand(body)
+			if err != nil {
+				return nil, 0, nil, 0, err
+			}
+			return xTransport.Get(templateURL, dataType, timeout)
+		}
+		templateURL, err := dohTemplate.Expand(nil)
+		if err != nil {
+			return nil, 0, nil, 0, err
+		}
+		return xTransport.Post(templateURL, dataType, dataType, &body, timeout)
+	}
 	return xTransport.dohLikeQuery("application/dns-message", useGet, url, body, timeout)
 }
 
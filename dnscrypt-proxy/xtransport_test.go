@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/powerman/check"
+)
+
+func TestPostQuantumHandshake(t *testing.T) {
+	c := check.T(t)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {}))
+	defer server.Close()
+	for _, postQuantum := range []bool{false, true} {
+		xTransport := NewXTransport()
+		xTransport.tlsPostQuantum = postQuantum
+		c.Equal(slices.Contains(xTransport.curvePreferences(), tls.X25519MLKEM768), postQuantum)
+		tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		tlsConfig.CurvePreferences = xTransport.curvePreferences()
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), tlsConfig)
+		c.Must(c.Nil(err))
+		conn.Close()
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/dnscrypt/dnscrypt-proxy
 
-go 1.23
+go 1.24
 
 require (
 	github.com/BurntSushi/toml v1.4.0
@@ -17,8 +17,8 @@ require (
 	github.com/jedisct1/xsecretbox v0.0.0-20230811132812-b950633f9f1f
 	github.com/k-sone/critbitgo v1.4.0
 	github.com/kardianos/service v1.2.2
+	github.com/klauspost/compress v1.17.11
 	github.com/miekg/dns v1.1.62
-	github.com/opencoff/go-sieve v0.2.1
 	github.com/powerman/check v1.7.0
 	github.com/quic-go/quic-go v0.48.1
 	golang.org/x/crypto v0.28.0